@@ -0,0 +1,114 @@
+// Package adaptive adapts the number of tenants whose rules are fetched concurrently between sync cycles, so that
+// cycles finish within their budget as the number of tenants changes, without overloading the rules backend.
+package adaptive
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultTarget is the default share of their budget sync cycles should take.
+const DefaultTarget = 0.8
+
+// Tuner gets and sets the fetch concurrency, e.g. a fetch.RulesObjstoreFetcher.
+type Tuner interface {
+	Concurrency() int
+	SetConcurrency(concurrency int)
+}
+
+// Config configures a Controller.
+type Config struct {
+	// Min and Max bound the concurrency.
+	Min int
+	Max int
+	// Target is the share of their budget sync cycles should take, e.g. 0.8 to keep some slack. If 0, it is
+	// DefaultTarget.
+	Target float64
+}
+
+// Controller adapts the fetch concurrency to the sync cycles it observes, in the manner of additive increase,
+// multiplicative decrease: a cycle taking more than the target share of its budget, mostly fetching, raises it by 1,
+// and a failed fetch, the sign of an overloaded rules backend, halves it. A cycle taking less than half of the target
+// lowers it by 1, so that the rules backend isn't loaded more than needed.
+type Controller struct {
+	tuner Tuner
+	cfg   Config
+
+	adjustments *prometheus.CounterVec
+}
+
+// New creates a new Controller of the concurrency set with the tuner. Its metrics are registered with the given
+// registerer, if not nil.
+func New(r prometheus.Registerer, t Tuner, cfg Config) (*Controller, error) {
+	if cfg.Target == 0 {
+		cfg.Target = DefaultTarget
+	}
+	if cfg.Target < 0 || cfg.Target > 1 {
+		return nil, fmt.Errorf("the target share of the budget must be between 0 and 1, got %v", cfg.Target)
+	}
+	if cfg.Min < 1 || cfg.Max < cfg.Min {
+		return nil, fmt.Errorf("invalid concurrency bounds [%d, %d]", cfg.Min, cfg.Max)
+	}
+
+	c := &Controller{
+		tuner: t,
+		cfg:   cfg,
+		adjustments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_fetch_concurrency_adjustments_total",
+			Help: "Total number of adjustments of the fetch concurrency between sync cycles, by direction.",
+		}, []string{"direction"}),
+	}
+
+	if r != nil {
+		r.MustRegister(c.adjustments)
+	}
+
+	return c, nil
+}
+
+// Observe adjusts the concurrency after the sync cycle, and is a syncer.Observer. Cycles without a budget, e.g. not
+// run by the Loop, and failing to authenticate, which isn't a matter of load, are ignored.
+func (c *Controller) Observe(_ context.Context, cycle syncer.Cycle) {
+	if cycle.Budget <= 0 {
+		return
+	}
+
+	var fetched *syncer.PhaseResult
+	for i := range cycle.Phases {
+		if cycle.Phases[i].Name == syncer.PhaseFetch {
+			fetched = &cycle.Phases[i]
+		}
+	}
+	if fetched == nil || fetch.IsAuthError(fetched.Err) {
+		return
+	}
+
+	current := c.tuner.Concurrency()
+	target := c.cfg.Target * cycle.Budget.Seconds()
+	next := current
+	switch {
+	case fetched.Err != nil:
+		next = current / 2
+	case cycle.Duration.Seconds() > target && 2*fetched.Duration > cycle.Duration:
+		next = current + 1
+	case cycle.Duration.Seconds() < target/2:
+		next = current - 1
+	}
+	next = min(max(next, c.cfg.Min), c.cfg.Max)
+	if next == current {
+		return
+	}
+
+	direction := "increase"
+	if next < current {
+		direction = "decrease"
+	}
+	c.adjustments.WithLabelValues(direction).Inc()
+	log.Printf("sync cycle took %s of its budget of %s, fetching rules of %d tenants concurrently instead of %d", cycle.Duration, cycle.Budget, next, current)
+	c.tuner.SetConcurrency(next)
+}
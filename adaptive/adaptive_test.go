@@ -0,0 +1,145 @@
+package adaptive
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTuner struct {
+	concurrency int
+}
+
+func (t *testTuner) Concurrency() int {
+	return t.concurrency
+}
+
+func (t *testTuner) SetConcurrency(concurrency int) {
+	t.concurrency = concurrency
+}
+
+func TestNew(t *testing.T) {
+	testCases := map[string]struct {
+		cfg Config
+
+		expectErr bool
+	}{
+		"default target": {
+			cfg: Config{Min: 1, Max: 8},
+		},
+		"target above the budget": {
+			cfg:       Config{Min: 1, Max: 8, Target: 1.5},
+			expectErr: true,
+		},
+		"no minimum": {
+			cfg:       Config{Max: 8},
+			expectErr: true,
+		},
+		"maximum below minimum": {
+			cfg:       Config{Min: 4, Max: 2},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(nil, &testTuner{}, tc.cfg)
+			if tc.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestControllerObserve(t *testing.T) {
+	fetched := func(d time.Duration, err error) []syncer.PhaseResult {
+		return []syncer.PhaseResult{{Name: syncer.PhaseFetch, Duration: d, Err: err}}
+	}
+
+	testCases := map[string]struct {
+		concurrency int
+		cycle       syncer.Cycle
+
+		expectConcurrency int
+		expectDirection   string
+	}{
+		"within budget": {
+			concurrency:       8,
+			cycle:             syncer.Cycle{Budget: time.Minute, Duration: 40 * time.Second, Phases: fetched(30*time.Second, nil)},
+			expectConcurrency: 8,
+		},
+		"over budget fetching": {
+			concurrency:       8,
+			cycle:             syncer.Cycle{Budget: time.Minute, Duration: 55 * time.Second, Phases: fetched(50*time.Second, nil)},
+			expectConcurrency: 9,
+			expectDirection:   "increase",
+		},
+		"over budget not fetching": {
+			concurrency: 8,
+			cycle: syncer.Cycle{Budget: time.Minute, Duration: 55 * time.Second, Phases: []syncer.PhaseResult{
+				{Name: syncer.PhaseFetch, Duration: 5 * time.Second},
+				{Name: syncer.PhaseReload, Duration: 50 * time.Second},
+			}},
+			expectConcurrency: 8,
+		},
+		"at the maximum": {
+			concurrency:       16,
+			cycle:             syncer.Cycle{Budget: time.Minute, Duration: 55 * time.Second, Phases: fetched(50*time.Second, nil)},
+			expectConcurrency: 16,
+		},
+		"well within budget": {
+			concurrency:       8,
+			cycle:             syncer.Cycle{Budget: time.Minute, Duration: 10 * time.Second, Phases: fetched(5*time.Second, nil)},
+			expectConcurrency: 7,
+			expectDirection:   "decrease",
+		},
+		"failed fetch": {
+			concurrency:       8,
+			cycle:             syncer.Cycle{Budget: time.Minute, Duration: 55 * time.Second, Phases: fetched(55*time.Second, &fetch.StatusError{StatusCode: 503})},
+			expectConcurrency: 4,
+			expectDirection:   "decrease",
+		},
+		"at the minimum": {
+			concurrency:       2,
+			cycle:             syncer.Cycle{Budget: time.Minute, Duration: 5 * time.Second, Phases: fetched(5*time.Second, errors.New("connection refused"))},
+			expectConcurrency: 2,
+		},
+		"failed authentication": {
+			concurrency:       8,
+			cycle:             syncer.Cycle{Budget: time.Minute, Duration: time.Second, Phases: fetched(time.Second, &fetch.StatusError{StatusCode: 401})},
+			expectConcurrency: 8,
+		},
+		"no budget": {
+			concurrency:       8,
+			cycle:             syncer.Cycle{Duration: 55 * time.Second, Phases: fetched(50*time.Second, nil)},
+			expectConcurrency: 8,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tuner := &testTuner{concurrency: tc.concurrency}
+			c, err := New(nil, tuner, Config{Min: 2, Max: 16})
+			assert.NoError(t, err)
+
+			c.Observe(context.Background(), tc.cycle)
+
+			assert.Equal(t, tc.expectConcurrency, tuner.concurrency)
+			for _, direction := range []string{"increase", "decrease"} {
+				expected := 0.0
+				if direction == tc.expectDirection {
+					expected = 1
+				}
+				assert.Equal(t, expected, testutil.ToFloat64(c.adjustments.WithLabelValues(direction)), direction)
+			}
+		})
+	}
+}
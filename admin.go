@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/metalmatze/signal/internalserver"
+	"github.com/observatorium/thanos-rule-syncer/amroute"
+	"github.com/observatorium/thanos-rule-syncer/lint"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"gopkg.in/yaml.v3"
+)
+
+// readAdminToken reads the bearer token protecting the admin endpoints from a file.
+func readAdminToken(file string) (string, error) {
+	token, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read admin token file: %w", err)
+	}
+
+	t := strings.TrimSpace(string(token))
+	if t == "" {
+		return "", fmt.Errorf("admin token file %s is empty", file)
+	}
+
+	return t, nil
+}
+
+// withAdminAuth only lets POST requests with the admin bearer token through to the handler.
+func withAdminAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	return withMethod(http.MethodPost, withBearerToken(token, next))
+}
+
+// withMethod only lets requests with the method through to the handler.
+func withMethod(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// withBearerToken only lets requests with the bearer token through to the handler.
+func withBearerToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// withReady only lets requests through to the handler once the syncer is ready.
+func withReady(ready func() bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// addReadyEndpoint adds the endpoint responding with 503 until the dependencies of the syncer were initialized,
+// e.g. for the readiness probe of the pod.
+func addReadyEndpoint(h *internalserver.Handler, ready func() bool) {
+	h.AddEndpoint("/-/ready", "Readiness of the syncer, once its dependencies were initialized", withReady(ready, func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ready")
+	}))
+}
+
+type pauser interface {
+	Pause()
+	Resume()
+}
+
+// addPauseEndpoints adds the endpoints pausing and resuming the sync to the internal server.
+func addPauseEndpoints(h *internalserver.Handler, token string, p pauser) {
+	h.AddEndpoint("/-/pause", "Pause writing rules and reloading the ruler (POST, admin)", withAdminAuth(token, func(w http.ResponseWriter, _ *http.Request) {
+		p.Pause()
+		log.Print("sync paused")
+		fmt.Fprintln(w, "sync paused")
+	}))
+	h.AddEndpoint("/-/resume", "Resume writing rules and reloading the ruler (POST, admin)", withAdminAuth(token, func(w http.ResponseWriter, _ *http.Request) {
+		p.Resume()
+		log.Print("sync resumed")
+		fmt.Fprintln(w, "sync resumed")
+	}))
+}
+
+// addPromoteEndpoint adds the endpoint promoting the standby syncer to the internal server.
+func addPromoteEndpoint(h *internalserver.Handler, token string, promote func() bool) {
+	h.AddEndpoint("/-/promote", "Promote the standby syncer, writing rules and reloading the ruler from now on (POST, admin)", withAdminAuth(token, func(w http.ResponseWriter, _ *http.Request) {
+		if !promote() {
+			fmt.Fprintln(w, "syncer already active")
+			return
+		}
+		fmt.Fprintln(w, "syncer promoted")
+	}))
+}
+
+type triggerer interface {
+	Trigger()
+}
+
+// addSyncEndpoint adds the endpoint triggering a sync cycle right away to the internal server.
+func addSyncEndpoint(h *internalserver.Handler, token string, t triggerer) {
+	h.AddEndpoint("/-/sync", "Run a sync cycle right away (POST, admin)", withAdminAuth(token, func(w http.ResponseWriter, _ *http.Request) {
+		t.Trigger()
+		log.Print("sync triggered")
+		fmt.Fprintln(w, "sync triggered")
+	}))
+}
+
+// addSyncHandler adds the endpoint running a sync cycle on each request to the internal server.
+// It requires the admin bearer token if there is one.
+func addSyncHandler(h *internalserver.Handler, token string, sync http.Handler) {
+	handler := sync.ServeHTTP
+	if token != "" {
+		handler = withAdminAuth(token, handler)
+	}
+	h.AddEndpoint("/sync", "Run a sync cycle and respond once it is over (POST)", handler)
+}
+
+// addLifecycleEndpoints adds the endpoints quitting the process and reloading its configuration
+// to the internal server, like the lifecycle endpoints of Prometheus.
+func addLifecycleEndpoints(h *internalserver.Handler, token string, quit func(), reloadConfig func() error) {
+	h.AddEndpoint("/-/quit", "Quit gracefully (POST, admin)", withAdminAuth(token, func(w http.ResponseWriter, _ *http.Request) {
+		log.Print("quit requested")
+		fmt.Fprintln(w, "quitting")
+		quit()
+	}))
+	h.AddEndpoint("/-/reload-config", "Reload the tenants and merge policy files (POST, admin)", withAdminAuth(token, func(w http.ResponseWriter, _ *http.Request) {
+		if err := reloadConfig(); err != nil {
+			log.Printf("failed to reload config: %v", err)
+			http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Print("config reloaded")
+		fmt.Fprintln(w, "config reloaded")
+	}))
+}
+
+type tuner interface {
+	Interval() time.Duration
+	SetInterval(interval time.Duration)
+	Timeouts() syncer.Timeouts
+	SetTimeouts(timeouts syncer.Timeouts)
+}
+
+type concurrencyTuner interface {
+	Concurrency() int
+	SetConcurrency(concurrency int)
+}
+
+// tuning is the runtime tuning of the sync set and reported by the tuning endpoint. Durations are formatted like 1m30s,
+// and the fields left out of a request are kept.
+type tuning struct {
+	Interval    string         `json:"interval,omitempty"`
+	Concurrency int            `json:"concurrency,omitempty"`
+	Timeouts    tuningTimeouts `json:"timeouts"`
+}
+
+// tuningTimeouts are the timeouts of the phases of sync cycles in a tuning. A timeout of 0s doesn't limit the phase.
+type tuningTimeouts struct {
+	Fetch  string `json:"fetch,omitempty"`
+	Parse  string `json:"parse,omitempty"`
+	Write  string `json:"write,omitempty"`
+	Reload string `json:"reload,omitempty"`
+}
+
+// maxTuningSize is the maximum size of the tuning posted to the tuning endpoint.
+const maxTuningSize = 1 << 10
+
+// addTuningEndpoint adds the endpoint reporting and changing the interval between sync cycles, the concurrency of
+// fetches if c is not nil, and the timeouts of the phases of sync cycles to the internal server, e.g. so that on-call
+// can throttle the syncer during an incident of the rules source without a redeploy. The changes are kept in memory
+// until the syncer restarts. The interval can only be changed if tuneInterval is true, as it is only used by a loop
+// of sync cycles without a schedule.
+func addTuningEndpoint(h *internalserver.Handler, token string, t tuner, c concurrencyTuner, tuneInterval bool) {
+	current := func() tuning {
+		timeouts := t.Timeouts()
+		current := tuning{
+			Timeouts: tuningTimeouts{
+				Fetch:  timeouts.Fetch.String(),
+				Parse:  timeouts.Parse.String(),
+				Write:  timeouts.Write.String(),
+				Reload: timeouts.Reload.String(),
+			},
+		}
+		if tuneInterval {
+			current.Interval = t.Interval().String()
+		}
+		if c != nil {
+			current.Concurrency = c.Concurrency()
+		}
+		return current
+	}
+
+	h.AddEndpoint("/-/tuning", "Interval, concurrency and timeouts of the sync (GET, or POST to change them, admin)", withBearerToken(token, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var requested tuning
+			decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTuningSize))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&requested); err != nil {
+				http.Error(w, fmt.Sprintf("failed to decode tuning: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := applyTuning(requested, t, c, tuneInterval); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("sync tuned: %+v", current())
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(current()); err != nil {
+			log.Printf("failed to write tuning: %v", err)
+		}
+	}))
+}
+
+// applyTuning validates the requested tuning and applies it, only if all of it is valid.
+func applyTuning(requested tuning, t tuner, c concurrencyTuner, tuneInterval bool) error {
+	var interval time.Duration
+	if requested.Interval != "" {
+		if !tuneInterval {
+			return errors.New("the interval can't be changed, as sync cycles don't run at an interval")
+		}
+
+		var err error
+		interval, err = time.ParseDuration(requested.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid interval: %w", err)
+		}
+		if interval <= 0 {
+			return errors.New("the interval must be positive")
+		}
+	}
+
+	if requested.Concurrency != 0 {
+		if c == nil {
+			return errors.New("the concurrency can't be changed, as the rules aren't fetched from the rules backend")
+		}
+		if requested.Concurrency < 0 {
+			return errors.New("the concurrency must be positive")
+		}
+	}
+
+	timeouts := t.Timeouts()
+	for _, timeout := range []struct {
+		phase     string
+		requested string
+		timeout   *time.Duration
+	}{
+		{syncer.PhaseFetch, requested.Timeouts.Fetch, &timeouts.Fetch},
+		{syncer.PhaseParse, requested.Timeouts.Parse, &timeouts.Parse},
+		{syncer.PhaseWrite, requested.Timeouts.Write, &timeouts.Write},
+		{syncer.PhaseReload, requested.Timeouts.Reload, &timeouts.Reload},
+	} {
+		if timeout.requested == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(timeout.requested)
+		if err != nil {
+			return fmt.Errorf("invalid %s timeout: %w", timeout.phase, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("the %s timeout must not be negative", timeout.phase)
+		}
+		*timeout.timeout = d
+	}
+
+	if interval > 0 {
+		t.SetInterval(interval)
+	}
+	if requested.Concurrency > 0 {
+		c.SetConcurrency(requested.Concurrency)
+	}
+	t.SetTimeouts(timeouts)
+
+	return nil
+}
+
+type lintReporter interface {
+	Report() map[string][]lint.Violation
+}
+
+type routingReporter interface {
+	Report() map[string][]amroute.Unrouted
+}
+
+type fetchReporter interface {
+	LastAttempted() map[string]time.Time
+	ParseErrors() map[string]string
+}
+
+// tenantStatus is the status of the rules of a tenant.
+type tenantStatus struct {
+	Violations []lint.Violation `json:"violations"`
+	// LastAttempted is when the fetch of the rules of the tenant last started, if known.
+	LastAttempted *time.Time `json:"lastAttempted,omitempty"`
+	// ParseError is why the rules of the tenant last fetched are invalid, if they are. Its last valid rules are synced instead.
+	ParseError string `json:"parseError,omitempty"`
+	// Unrouted are the alerts of the tenant falling through to the default route of Alertmanager, if they are checked.
+	Unrouted []amroute.Unrouted `json:"unrouted,omitempty"`
+}
+
+// addStatusEndpoint adds the endpoint reporting the status of the rules of tenants in the last sync,
+// e.g. the alerts violating conventions, when their rules were last attempted to be fetched and why they are invalid,
+// and the alerts not routed by Alertmanager, to the internal server, along with the effective configuration of the
+// syncer. The fetches are only reported if f is not nil, the routing of alerts if r is not nil, and the configuration
+// if c is not nil.
+func addStatusEndpoint(h *internalserver.Handler, l lintReporter, f fetchReporter, r routingReporter, c *effectiveConfig) {
+	h.AddEndpoint("/status", "Status of the rules of tenants in the last sync, e.g. alerts violating conventions", func(w http.ResponseWriter, _ *http.Request) {
+		status := struct {
+			Tenants map[string]tenantStatus `json:"tenants"`
+			Config  *effectiveConfig        `json:"config,omitempty"`
+		}{Tenants: map[string]tenantStatus{}, Config: c}
+		for tenant, violations := range l.Report() {
+			status.Tenants[tenant] = tenantStatus{Violations: violations}
+		}
+		tenantStatusOf := func(tenant string) tenantStatus {
+			tenantStatus := status.Tenants[tenant]
+			if tenantStatus.Violations == nil {
+				tenantStatus.Violations = []lint.Violation{}
+			}
+			return tenantStatus
+		}
+		if f != nil {
+			for tenant, attempted := range f.LastAttempted() {
+				attempted := attempted
+				tenantStatus := tenantStatusOf(tenant)
+				tenantStatus.LastAttempted = &attempted
+				status.Tenants[tenant] = tenantStatus
+			}
+			for tenant, parseErr := range f.ParseErrors() {
+				tenantStatus := tenantStatusOf(tenant)
+				tenantStatus.ParseError = parseErr
+				status.Tenants[tenant] = tenantStatus
+			}
+		}
+		if r != nil {
+			for tenant, unrouted := range r.Report() {
+				tenantStatus := tenantStatusOf(tenant)
+				tenantStatus.Unrouted = unrouted
+				status.Tenants[tenant] = tenantStatus
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("failed to write status: %v", err)
+		}
+	})
+}
+
+type tenantRulesValidator interface {
+	Validate(ctx context.Context, content []byte) validation
+}
+
+// maxValidatedRulesSize is the maximum size of the rules posted to the validation endpoint.
+const maxValidatedRulesSize = 10 << 20
+
+// addValidateEndpoint adds the endpoint validating the rules of a tenant with the checks of the sync pipeline to the
+// internal server, e.g. called by the Observatorium API before it accepts rules uploaded by a tenant, so that tenants
+// get immediate feedback instead of syncs failing later. The rules are posted to /validate/{tenant}, and the response is
+// a 200 if they are accepted or a 422 if they are rejected, with the validation as JSON. If tenant is not empty, it is
+// the only tenant whose rules are synced, and the rules of other tenants are not validated.
+func addValidateEndpoint(h *internalserver.Handler, token string, v tenantRulesValidator, tenant string) {
+	handler := withMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		rulesTenant := strings.TrimPrefix(r.URL.Path, "/validate/")
+		if rulesTenant == "" || strings.Contains(rulesTenant, "/") {
+			http.Error(w, "the rules must be posted to /validate/{tenant}", http.StatusNotFound)
+			return
+		}
+		if tenant != "" && rulesTenant != tenant {
+			http.Error(w, fmt.Sprintf("the rules of tenant %s are not synced", rulesTenant), http.StatusNotFound)
+			return
+		}
+
+		content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValidatedRulesSize))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read rules: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		result := v.Validate(r.Context(), content)
+		status := http.StatusOK
+		if !result.Accepted {
+			log.Printf("rejected rules of tenant %s: %s", rulesTenant, strings.Join(result.Errors, "; "))
+			status = http.StatusUnprocessableEntity
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("failed to write validation: %v", err)
+		}
+	})
+	if token != "" {
+		handler = withBearerToken(token, handler)
+	}
+	h.AddEndpoint("/validate/", "Validate the rules of a tenant, at /validate/{tenant} (POST)", handler)
+}
+
+// addUsageEndpoint adds the endpoint serving the last report of the usage of the rules of tenants to the internal server.
+func addUsageEndpoint(h *internalserver.Handler, u http.Handler) {
+	h.AddEndpoint("/usage", "Last report of the usage of the rules of tenants, e.g. for chargeback (GET)", withMethod(http.MethodGet, u.ServeHTTP))
+}
+
+type rulesInspector interface {
+	LastFetched() []byte
+	LastWritten() []byte
+}
+
+// addDebugRulesEndpoints adds the endpoints returning the rules last written and the rules of a tenant last fetched
+// to the internal server, so that what the syncer believes can be inspected without exec'ing into the pod.
+// The tenant owning a group is given by groupTenant.
+func addDebugRulesEndpoints(h *internalserver.Handler, token string, i rulesInspector, groupTenant func(groupName string) string) {
+	h.AddEndpoint("/debug/rules", "Rules last written (GET, admin)", withMethod(http.MethodGet, withBearerToken(token, func(w http.ResponseWriter, _ *http.Request) {
+		content := i.LastWritten()
+		if content == nil {
+			http.Error(w, "no rules written yet", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/yaml")
+		if _, err := w.Write(content); err != nil {
+			log.Printf("failed to write rules: %v", err)
+		}
+	})))
+	h.AddEndpoint("/debug/rules/", "Rules of a tenant last fetched, at /debug/rules/{tenant} (GET, admin)", withMethod(http.MethodGet, withBearerToken(token, func(w http.ResponseWriter, r *http.Request) {
+		tenant := strings.TrimPrefix(r.URL.Path, "/debug/rules/")
+		content := i.LastFetched()
+		if content == nil {
+			http.Error(w, "no rules fetched yet", http.StatusNotFound)
+			return
+		}
+
+		var groups rules.RuleGroups
+		if err := yaml.Unmarshal(content, &groups); err != nil {
+			http.Error(w, fmt.Sprintf("failed to unmarshal rules: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		var tenantGroups rules.RuleGroups
+		for _, group := range groups.Groups {
+			if groupTenant(group.Name) == tenant {
+				tenantGroups.Groups = append(tenantGroups.Groups, group)
+			}
+		}
+		if len(tenantGroups.Groups) == 0 {
+			http.Error(w, fmt.Sprintf("no rules fetched for tenant %q", tenant), http.StatusNotFound)
+			return
+		}
+
+		tenantContent, err := yaml.Marshal(tenantGroups)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to marshal rules: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/yaml")
+		if _, err := w.Write(tenantContent); err != nil {
+			log.Printf("failed to write rules: %v", err)
+		}
+	})))
+}
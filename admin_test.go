@@ -0,0 +1,567 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metalmatze/signal/internalserver"
+	"github.com/observatorium/thanos-rule-syncer/amroute"
+	"github.com/observatorium/thanos-rule-syncer/compat"
+	"github.com/observatorium/thanos-rule-syncer/lint"
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/observatorium/thanos-rule-syncer/tmplcheck"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithAdminAuth(t *testing.T) {
+	testCases := map[string]struct {
+		method        string
+		authorization string
+		expectStatus  int
+	}{
+		"valid token": {
+			method:        http.MethodPost,
+			authorization: "Bearer secret",
+			expectStatus:  http.StatusOK,
+		},
+		"invalid token": {
+			method:        http.MethodPost,
+			authorization: "Bearer wrong",
+			expectStatus:  http.StatusUnauthorized,
+		},
+		"missing token": {
+			method:       http.MethodPost,
+			expectStatus: http.StatusUnauthorized,
+		},
+		"wrong method": {
+			method:        http.MethodGet,
+			authorization: "Bearer secret",
+			expectStatus:  http.StatusMethodNotAllowed,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var called bool
+			h := withAdminAuth("secret", func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+
+			req := httptest.NewRequest(tc.method, "/-/pause", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, req)
+
+			assert.Equal(t, tc.expectStatus, rec.Code)
+			assert.Equal(t, tc.expectStatus == http.StatusOK, called)
+		})
+	}
+}
+
+func TestLifecycleEndpoints(t *testing.T) {
+	testCases := map[string]struct {
+		path           string
+		reloadErr      error
+		expectStatus   int
+		expectQuit     bool
+		expectReloaded bool
+	}{
+		"quit": {
+			path:         "/-/quit",
+			expectStatus: http.StatusOK,
+			expectQuit:   true,
+		},
+		"reload config": {
+			path:           "/-/reload-config",
+			expectStatus:   http.StatusOK,
+			expectReloaded: true,
+		},
+		"failed reload config": {
+			path:           "/-/reload-config",
+			reloadErr:      errors.New("invalid policy file"),
+			expectStatus:   http.StatusInternalServerError,
+			expectReloaded: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var quit, reloaded bool
+			h := internalserver.NewHandler()
+			addLifecycleEndpoints(h, "secret", func() { quit = true }, func() error {
+				reloaded = true
+				return tc.reloadErr
+			})
+
+			req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectStatus, rec.Code)
+			assert.Equal(t, tc.expectQuit, quit)
+			assert.Equal(t, tc.expectReloaded, reloaded)
+		})
+	}
+}
+
+func TestPromoteEndpoint(t *testing.T) {
+	promoted := 0
+	h := internalserver.NewHandler()
+	addPromoteEndpoint(h, "secret", func() bool {
+		promoted++
+		return promoted == 1
+	})
+
+	for _, expectBody := range []string{"syncer promoted\n", "syncer already active\n"} {
+		req := httptest.NewRequest(http.MethodPost, "/-/promote", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, expectBody, rec.Body.String())
+	}
+	assert.Equal(t, 2, promoted)
+}
+
+type testConcurrencyTuner struct {
+	concurrency int
+}
+
+func (c *testConcurrencyTuner) Concurrency() int { return c.concurrency }
+
+func (c *testConcurrencyTuner) SetConcurrency(concurrency int) { c.concurrency = concurrency }
+
+func TestTuningEndpoint(t *testing.T) {
+	testCases := map[string]struct {
+		method        string
+		body          string
+		noConcurrency bool
+		fixedInterval bool
+
+		expectStatus int
+		expectBody   string
+	}{
+		"current tuning": {
+			method:       http.MethodGet,
+			expectStatus: http.StatusOK,
+			expectBody:   `{"interval":"1m0s","concurrency":8,"timeouts":{"fetch":"30s","parse":"0s","write":"0s","reload":"0s"}}`,
+		},
+		"changed tuning": {
+			method:       http.MethodPost,
+			body:         `{"interval": "5m", "concurrency": 2, "timeouts": {"fetch": "2m", "reload": "10s"}}`,
+			expectStatus: http.StatusOK,
+			expectBody:   `{"interval":"5m0s","concurrency":2,"timeouts":{"fetch":"2m0s","parse":"0s","write":"0s","reload":"10s"}}`,
+		},
+		"fields left out are kept": {
+			method:       http.MethodPost,
+			body:         `{"timeouts": {"parse": "1s"}}`,
+			expectStatus: http.StatusOK,
+			expectBody:   `{"interval":"1m0s","concurrency":8,"timeouts":{"fetch":"30s","parse":"1s","write":"0s","reload":"0s"}}`,
+		},
+		"no concurrency": {
+			method:        http.MethodGet,
+			noConcurrency: true,
+			expectStatus:  http.StatusOK,
+			expectBody:    `{"interval":"1m0s","timeouts":{"fetch":"30s","parse":"0s","write":"0s","reload":"0s"}}`,
+		},
+		"invalid interval": {
+			method:       http.MethodPost,
+			body:         `{"interval": "0s", "concurrency": 2}`,
+			expectStatus: http.StatusBadRequest,
+			expectBody:   "the interval must be positive",
+		},
+		"invalid timeout": {
+			method:       http.MethodPost,
+			body:         `{"concurrency": 2, "timeouts": {"write": "soon"}}`,
+			expectStatus: http.StatusBadRequest,
+			expectBody:   "invalid write timeout",
+		},
+		"unknown field": {
+			method:       http.MethodPost,
+			body:         `{"intervals": "5m"}`,
+			expectStatus: http.StatusBadRequest,
+			expectBody:   "failed to decode tuning",
+		},
+		"fixed interval": {
+			method:        http.MethodPost,
+			body:          `{"interval": "5m"}`,
+			fixedInterval: true,
+			expectStatus:  http.StatusBadRequest,
+			expectBody:    "the interval can't be changed",
+		},
+		"concurrency without fetcher": {
+			method:        http.MethodPost,
+			body:          `{"concurrency": 2}`,
+			noConcurrency: true,
+			expectStatus:  http.StatusBadRequest,
+			expectBody:    "the concurrency can't be changed",
+		},
+		"wrong method": {
+			method:       http.MethodDelete,
+			expectStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			s := syncer.New(nil, nil, nil, syncer.WithInterval(time.Minute), syncer.WithTimeouts(syncer.Timeouts{Fetch: 30 * time.Second}))
+			var c concurrencyTuner
+			if !tc.noConcurrency {
+				c = &testConcurrencyTuner{concurrency: 8}
+			}
+			h := internalserver.NewHandler()
+			addTuningEndpoint(h, "secret", s, c, !tc.fixedInterval)
+
+			req := httptest.NewRequest(tc.method, "/-/tuning", strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectStatus, rec.Code)
+			if tc.expectStatus == http.StatusOK {
+				assert.JSONEq(t, tc.expectBody, rec.Body.String())
+			} else {
+				assert.Contains(t, rec.Body.String(), tc.expectBody)
+			}
+			if tc.expectStatus != http.StatusOK {
+				// Invalid tunings change nothing.
+				assert.Equal(t, time.Minute, s.Interval())
+				assert.Equal(t, syncer.Timeouts{Fetch: 30 * time.Second}, s.Timeouts())
+				if c != nil {
+					assert.Equal(t, 8, c.Concurrency())
+				}
+			}
+		})
+	}
+}
+
+func TestTuningEndpointUnauthorized(t *testing.T) {
+	h := internalserver.NewHandler()
+	addTuningEndpoint(h, "secret", syncer.New(nil, nil, nil), nil, true)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/tuning", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+type testLintReporter map[string][]lint.Violation
+
+func (r testLintReporter) Report() map[string][]lint.Violation {
+	return r
+}
+
+type testRoutingReporter map[string][]amroute.Unrouted
+
+func (r testRoutingReporter) Report() map[string][]amroute.Unrouted {
+	return r
+}
+
+type testFetchReporter struct {
+	attempts    map[string]time.Time
+	parseErrors map[string]string
+}
+
+func (r testFetchReporter) LastAttempted() map[string]time.Time {
+	return r.attempts
+}
+
+func (r testFetchReporter) ParseErrors() map[string]string {
+	return r.parseErrors
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	testCases := map[string]struct {
+		fetches fetchReporter
+		routing routingReporter
+		config  *effectiveConfig
+
+		expectStatus string
+	}{
+		"violations": {
+			expectStatus: `{"tenants": {
+				"tenant-a": {"violations": [{"group": "tenant-a.alerts", "alert": "Down", "convention": "severity", "message": "no severity"}]},
+				"tenant-b": {"violations": []}
+			}}`,
+		},
+		"violations and attempts": {
+			fetches: testFetchReporter{attempts: map[string]time.Time{
+				"tenant-a": time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC),
+				"tenant-c": time.Date(2024, 1, 1, 0, 0, 2, 0, time.UTC),
+			}},
+			expectStatus: `{"tenants": {
+				"tenant-a": {"violations": [{"group": "tenant-a.alerts", "alert": "Down", "convention": "severity", "message": "no severity"}], "lastAttempted": "2024-01-01T00:00:01Z"},
+				"tenant-b": {"violations": []},
+				"tenant-c": {"violations": [], "lastAttempted": "2024-01-01T00:00:02Z"}
+			}}`,
+		},
+		"parse errors": {
+			fetches: testFetchReporter{
+				attempts:    map[string]time.Time{"tenant-c": time.Date(2024, 1, 1, 0, 0, 2, 0, time.UTC)},
+				parseErrors: map[string]string{"tenant-b": "unclosed left parenthesis", "tenant-c": "unclosed left parenthesis"},
+			},
+			expectStatus: `{"tenants": {
+				"tenant-a": {"violations": [{"group": "tenant-a.alerts", "alert": "Down", "convention": "severity", "message": "no severity"}]},
+				"tenant-b": {"violations": [], "parseError": "unclosed left parenthesis"},
+				"tenant-c": {"violations": [], "lastAttempted": "2024-01-01T00:00:02Z", "parseError": "unclosed left parenthesis"}
+			}}`,
+		},
+		"unrouted alerts": {
+			routing: testRoutingReporter{
+				"tenant-a": {},
+				"tenant-c": {{Group: "tenant-c.alerts", Alert: "NoTeam", Receiver: "default"}},
+			},
+			expectStatus: `{"tenants": {
+				"tenant-a": {"violations": [{"group": "tenant-a.alerts", "alert": "Down", "convention": "severity", "message": "no severity"}]},
+				"tenant-b": {"violations": []},
+				"tenant-c": {"violations": [], "unrouted": [{"group": "tenant-c.alerts", "alert": "NoTeam", "receiver": "default"}]}
+			}}`,
+		},
+		"effective configuration": {
+			config: &effectiveConfig{
+				Modes:    map[string]string{"source": "rules-backend"},
+				Computed: map[string]string{"cycleTimeout": "1m0s"},
+				Flags:    []effectiveFlag{{Name: "oidc.client-secret", Value: redacted, Set: true}},
+			},
+			expectStatus: `{"tenants": {
+				"tenant-a": {"violations": [{"group": "tenant-a.alerts", "alert": "Down", "convention": "severity", "message": "no severity"}]},
+				"tenant-b": {"violations": []}
+			}, "config": {
+				"modes": {"source": "rules-backend"},
+				"computed": {"cycleTimeout": "1m0s"},
+				"flags": [{"name": "oidc.client-secret", "value": "xxxxx", "set": true}]
+			}}`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			h := internalserver.NewHandler()
+			addStatusEndpoint(h, testLintReporter{
+				"tenant-a": {{Group: "tenant-a.alerts", Alert: "Down", Convention: lint.ConventionSeverity, Message: "no severity"}},
+				"tenant-b": {},
+			}, tc.fetches, tc.routing, tc.config)
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.JSONEq(t, tc.expectStatus, rec.Body.String())
+		})
+	}
+}
+
+type testRulesInspector struct {
+	fetched, written []byte
+}
+
+func (i testRulesInspector) LastFetched() []byte { return i.fetched }
+
+func (i testRulesInspector) LastWritten() []byte { return i.written }
+
+func TestDebugRulesEndpoints(t *testing.T) {
+	fetched := []byte(`groups:
+  - name: tenant-a.alerts
+    rules:
+      - alert: Down
+        expr: up == 0
+  - name: tenant-b.alerts
+    rules:
+      - alert: Up
+        expr: up == 1
+`)
+
+	testCases := map[string]struct {
+		method        string
+		path          string
+		authorization string
+		inspector     testRulesInspector
+
+		expectStatus int
+		expectBody   string
+	}{
+		"rules last written": {
+			path:         "/debug/rules",
+			inspector:    testRulesInspector{fetched: fetched, written: []byte("groups: []")},
+			expectStatus: http.StatusOK,
+			expectBody:   "groups: []",
+		},
+		"no rules written yet": {
+			path:         "/debug/rules",
+			inspector:    testRulesInspector{fetched: fetched},
+			expectStatus: http.StatusNotFound,
+		},
+		"rules of a tenant last fetched": {
+			path:         "/debug/rules/tenant-b",
+			inspector:    testRulesInspector{fetched: fetched},
+			expectStatus: http.StatusOK,
+			expectBody: `groups:
+    - name: tenant-b.alerts
+      rules:
+        - alert: Up
+          expr: up == 1
+`,
+		},
+		"unknown tenant": {
+			path:         "/debug/rules/tenant-c",
+			inspector:    testRulesInspector{fetched: fetched},
+			expectStatus: http.StatusNotFound,
+		},
+		"no rules fetched yet": {
+			path:         "/debug/rules/tenant-a",
+			expectStatus: http.StatusNotFound,
+		},
+		"invalid token": {
+			path:          "/debug/rules",
+			authorization: "Bearer wrong",
+			inspector:     testRulesInspector{fetched: fetched, written: []byte("groups: []")},
+			expectStatus:  http.StatusUnauthorized,
+		},
+		"wrong method": {
+			method:       http.MethodPost,
+			path:         "/debug/rules/tenant-a",
+			inspector:    testRulesInspector{fetched: fetched},
+			expectStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			h := internalserver.NewHandler()
+			addDebugRulesEndpoints(h, "secret", tc.inspector, func(groupName string) string {
+				tenant, _, _ := strings.Cut(groupName, ".")
+				return tenant
+			})
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			authorization := tc.authorization
+			if authorization == "" {
+				authorization = "Bearer secret"
+			}
+			req := httptest.NewRequest(method, tc.path, nil)
+			req.Header.Set("Authorization", authorization)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectStatus, rec.Code)
+			if tc.expectStatus == http.StatusOK {
+				assert.Equal(t, tc.expectBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	m, err := merge.New(nil, merge.Config{DuplicateAlerts: merge.DuplicateAlertsIgnore}, nil, nil)
+	assert.NoError(t, err)
+	linter, err := lint.New(nil, lint.Config{Policy: lint.PolicyReject, Severities: []string{"critical", "warning"}}, merge.GroupTenantFunc(""))
+	assert.NoError(t, err)
+	checker, err := compat.New(nil, compat.StaticVersion(compat.Version{Minor: 31}), compat.Config{Policy: compat.PolicyStrip})
+	assert.NoError(t, err)
+	templates, err := tmplcheck.New(nil, tmplcheck.PolicyWarn, merge.GroupTenantFunc(""))
+	assert.NoError(t, err)
+	validator := &ruleValidator{merger: m, linter: linter, templates: templates, checker: checker}
+
+	testCases := map[string]struct {
+		method        string
+		path          string
+		authorization string
+		body          string
+		tenant        string
+
+		expectStatus     int
+		expectValidation string
+	}{
+		"accepted rules": {
+			method:           http.MethodPost,
+			path:             "/validate/tenant-a",
+			authorization:    "Bearer secret",
+			body:             "groups:\n- name: alerts\n  rules:\n  - alert: Down\n    expr: up == 0\n    labels:\n      severity: critical\n",
+			expectStatus:     http.StatusOK,
+			expectValidation: `{"accepted": true}`,
+		},
+		"accepted rules with warnings": {
+			method:           http.MethodPost,
+			path:             "/validate/tenant-a",
+			authorization:    "Bearer secret",
+			body:             "groups:\n- name: alerts\n  rules:\n  - alert: Down\n    expr: up == 0\n    keep_firing_for: 5m\n    labels:\n      severity: critical\n",
+			expectStatus:     http.StatusOK,
+			expectValidation: `{"accepted": true, "warnings": ["group \"alerts\": field keep_firing_for requires Thanos Ruler v0.32.0, but it runs v0.31.0, it will be stripped"]}`,
+		},
+		"templates failing to render": {
+			method:           http.MethodPost,
+			path:             "/validate/tenant-a",
+			authorization:    "Bearer secret",
+			body:             "groups:\n- name: alerts\n  rules:\n  - alert: Down\n    expr: up == 0\n    labels:\n      severity: critical\n    annotations:\n      summary: '{{ template \"missing\" }}'\n",
+			expectStatus:     http.StatusOK,
+			expectValidation: `{"accepted": true, "warnings": ["group \"alerts\": alert Down: annotation \"summary\": error executing template __alert_Down: template: __alert_Down:1:124: executing \"__alert_Down\" at <{{template \"missing\"}}>: template \"missing\" not defined"]}`,
+		},
+		"rules violating conventions": {
+			method:           http.MethodPost,
+			path:             "/validate/tenant-a",
+			authorization:    "Bearer secret",
+			body:             "groups:\n- name: alerts\n  rules:\n  - alert: Down\n    expr: up == 0\n",
+			expectStatus:     http.StatusUnprocessableEntity,
+			expectValidation: `{"accepted": false, "errors": ["alerts violate conventions: group \"alerts\": alert Down has no severity label, must be one of: critical, warning"]}`,
+		},
+		"invalid rules": {
+			method:        http.MethodPost,
+			path:          "/validate/tenant-a",
+			authorization: "Bearer secret",
+			body:          "groups:\n- name: alerts\n  rules:\n  - alert: Down\n",
+			expectStatus:  http.StatusUnprocessableEntity,
+		},
+		"tenant not synced": {
+			method:        http.MethodPost,
+			path:          "/validate/tenant-b",
+			authorization: "Bearer secret",
+			tenant:        "tenant-a",
+			expectStatus:  http.StatusNotFound,
+		},
+		"no tenant": {
+			method:        http.MethodPost,
+			path:          "/validate/",
+			authorization: "Bearer secret",
+			expectStatus:  http.StatusNotFound,
+		},
+		"wrong method": {
+			method:        http.MethodGet,
+			path:          "/validate/tenant-a",
+			authorization: "Bearer secret",
+			expectStatus:  http.StatusMethodNotAllowed,
+		},
+		"no token": {
+			method:       http.MethodPost,
+			path:         "/validate/tenant-a",
+			expectStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			h := internalserver.NewHandler()
+			addValidateEndpoint(h, "secret", validator, tc.tenant)
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Authorization", tc.authorization)
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectStatus, rec.Code)
+			if tc.expectValidation != "" {
+				assert.JSONEq(t, tc.expectValidation, rec.Body.String())
+			}
+		})
+	}
+}
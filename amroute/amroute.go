@@ -0,0 +1,268 @@
+// Package amroute checks the alerting rules of tenants against the route tree of an Alertmanager configuration, and
+// reports the alerts that no route matches, which fall through to the default route of the tree, so that unroutable
+// alerts are caught when rules are synced instead of during incidents.
+package amroute
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"gopkg.in/yaml.v3"
+)
+
+// Unrouted is an alert falling through to the default route.
+type Unrouted struct {
+	Group string `json:"group"`
+	Alert string `json:"alert"`
+	// Receiver is the receiver of the default route, which gets the alert.
+	Receiver string `json:"receiver"`
+}
+
+// Route is a route of the route tree of an Alertmanager configuration. Only the fields selecting alerts are read.
+type Route struct {
+	Receiver string `yaml:"receiver"`
+	// Matchers are matchers of the form name="value", with any of the =, !=, =~ and !~ operators.
+	Matchers []string `yaml:"matchers"`
+	// Match and MatchRE are the deprecated equality and regular expression matchers.
+	Match   map[string]string `yaml:"match"`
+	MatchRE map[string]string `yaml:"match_re"`
+	Routes  []*Route          `yaml:"routes"`
+
+	matchers []*labels.Matcher
+}
+
+// matcherRegexp parses a matcher of a route, whose value may be quoted.
+var matcherRegexp = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*(.*?)\s*$`)
+
+var matchTypes = map[string]labels.MatchType{
+	"=":  labels.MatchEqual,
+	"!=": labels.MatchNotEqual,
+	"=~": labels.MatchRegexp,
+	"!~": labels.MatchNotRegexp,
+}
+
+// ReadConfigFile reads the route tree of the Alertmanager configuration file.
+func ReadConfigFile(file string) (*Route, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Alertmanager configuration file: %w", err)
+	}
+
+	return ParseConfig(content)
+}
+
+// ParseConfig parses the route tree of an Alertmanager configuration.
+func ParseConfig(content []byte) (*Route, error) {
+	var cfg struct {
+		Route *Route `yaml:"route"`
+	}
+	if err := yaml.Unmarshal(content, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal Alertmanager configuration: %w", err)
+	}
+	if cfg.Route == nil {
+		return nil, fmt.Errorf("no route in Alertmanager configuration")
+	}
+	if cfg.Route.Receiver == "" {
+		return nil, fmt.Errorf("the root route has no receiver")
+	}
+	if len(cfg.Route.Matchers) > 0 || len(cfg.Route.Match) > 0 || len(cfg.Route.MatchRE) > 0 {
+		return nil, fmt.Errorf("the root route must not have any matchers")
+	}
+
+	if err := cfg.Route.parse(); err != nil {
+		return nil, err
+	}
+
+	return cfg.Route, nil
+}
+
+// parse parses the matchers of the route and of its child routes.
+func (r *Route) parse() error {
+	for _, m := range r.Matchers {
+		parts := matcherRegexp.FindStringSubmatch(m)
+		if parts == nil {
+			return fmt.Errorf("invalid matcher %q", m)
+		}
+		value := parts[3]
+		if strings.HasPrefix(value, `"`) {
+			var err error
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("invalid matcher %q: %w", m, err)
+			}
+		}
+
+		if err := r.addMatcher(matchTypes[parts[2]], parts[1], value); err != nil {
+			return fmt.Errorf("invalid matcher %q: %w", m, err)
+		}
+	}
+	for name, value := range r.Match {
+		if err := r.addMatcher(labels.MatchEqual, name, value); err != nil {
+			return err
+		}
+	}
+	for name, value := range r.MatchRE {
+		if err := r.addMatcher(labels.MatchRegexp, name, value); err != nil {
+			return fmt.Errorf("invalid regular expression of label %s: %w", name, err)
+		}
+	}
+
+	for _, child := range r.Routes {
+		if err := child.parse(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Route) addMatcher(t labels.MatchType, name, value string) error {
+	matcher, err := labels.NewMatcher(t, name, value)
+	if err != nil {
+		return err
+	}
+	r.matchers = append(r.matchers, matcher)
+
+	return nil
+}
+
+// matches tells whether the matchers of the route match the labels, a missing label matching the empty string like in
+// Alertmanager.
+func (r *Route) matches(lset map[string]string) bool {
+	for _, matcher := range r.matchers {
+		if !matcher.Matches(lset[matcher.Name]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Checker checks whether the alerts of tenants are routed by the route tree, and reports the unrouted alerts of each
+// tenant.
+type Checker struct {
+	root        *Route
+	groupTenant func(groupName string) string
+
+	// report are the unrouted alerts found by the last check, by tenant.
+	report   map[string][]Unrouted
+	reportMu sync.RWMutex
+
+	unrouted *prometheus.GaugeVec
+}
+
+// New creates a new Checker of the alerts against the route tree. The tenant owning a group is given by groupTenant.
+func New(r prometheus.Registerer, root *Route, groupTenant func(groupName string) string) *Checker {
+	c := &Checker{
+		root:        root,
+		groupTenant: groupTenant,
+		report:      map[string][]Unrouted{},
+		unrouted: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_unrouted_alerts",
+			Help: "Number of alerts of tenants in the last synced rules falling through to the default route of Alertmanager, by tenant.",
+		}, []string{"tenant"}),
+	}
+
+	if r != nil {
+		r.MustRegister(c.unrouted)
+	}
+
+	return c
+}
+
+// Check reports the alerts falling through to the default route. The alerts are matched on their static labels: the
+// labels of the series of their expressions and the external labels of the ruler aren't known. The rules are unchanged.
+func (c *Checker) Check(_ context.Context, content []byte) ([]byte, error) {
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	report := map[string][]Unrouted{}
+	for _, group := range groups.Groups {
+		tenant := c.groupTenant(group.Name)
+		if _, ok := report[tenant]; !ok {
+			// Tenants whose alerts are all routed are reported without unrouted alerts.
+			report[tenant] = []Unrouted{}
+		}
+
+		for _, rule := range group.Rules {
+			if rule.Alert.Value == "" || c.routed(rule.Alert.Value, rule.Labels) {
+				continue
+			}
+			report[tenant] = append(report[tenant], Unrouted{Group: group.Name, Alert: rule.Alert.Value, Receiver: c.root.Receiver})
+		}
+	}
+
+	c.setReport(report)
+
+	tenants := make([]string, 0, len(report))
+	for tenant := range report {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	var msgs []string
+	for _, tenant := range tenants {
+		for _, u := range report[tenant] {
+			msgs = append(msgs, fmt.Sprintf("tenant %s: group %q: alert %s", tenant, u.Group, u.Alert))
+		}
+	}
+	if len(msgs) > 0 {
+		log.Printf("alerts fall through to the default route of Alertmanager: %s", strings.Join(msgs, "; "))
+	}
+
+	return content, nil
+}
+
+// routed tells whether a child route of the root route matches the alert, so that it doesn't fall through to the
+// default route.
+func (c *Checker) routed(alert string, ruleLabels map[string]string) bool {
+	lset := make(map[string]string, len(ruleLabels)+1)
+	for name, value := range ruleLabels {
+		lset[name] = value
+	}
+	lset[labels.AlertName] = alert
+
+	for _, child := range c.root.Routes {
+		if child.matches(lset) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Checker) setReport(report map[string][]Unrouted) {
+	c.reportMu.Lock()
+	defer c.reportMu.Unlock()
+
+	c.unrouted.Reset()
+	for tenant, unrouted := range report {
+		c.unrouted.WithLabelValues(tenant).Set(float64(len(unrouted)))
+	}
+	c.report = report
+}
+
+// Report returns the unrouted alerts found by the last check, by tenant.
+func (c *Checker) Report() map[string][]Unrouted {
+	c.reportMu.RLock()
+	defer c.reportMu.RUnlock()
+
+	report := make(map[string][]Unrouted, len(c.report))
+	for tenant, unrouted := range c.report {
+		report[tenant] = slices.Clone(unrouted)
+	}
+
+	return report
+}
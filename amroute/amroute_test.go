@@ -0,0 +1,129 @@
+package amroute
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const alertmanagerConfig = `global:
+  resolve_timeout: 5m
+route:
+  receiver: default
+  group_by: [alertname]
+  routes:
+  - receiver: pager
+    matchers:
+    - severity="critical"
+    - team=~"sre|platform"
+  - receiver: tickets
+    match:
+      severity: warning
+  - receiver: watchdog
+    matchers:
+    - alertname = Watchdog
+receivers:
+- name: default
+- name: pager
+- name: tickets
+- name: watchdog
+`
+
+const tenantsRules = `groups:
+- name: tenant-a.alerts
+  rules:
+  - alert: Down
+    expr: up == 0
+    labels:
+      severity: critical
+      team: sre
+  - alert: NoTeam
+    expr: up == 0
+    labels:
+      severity: critical
+  - record: job:up:sum
+    expr: sum by (job) (up)
+- name: tenant-b.alerts
+  rules:
+  - alert: Slow
+    expr: vector(1)
+    labels:
+      severity: warning
+  - alert: Watchdog
+    expr: vector(1)
+  - alert: NoSeverity
+    expr: vector(1)
+`
+
+func groupTenant(groupName string) string {
+	tenant, _, _ := strings.Cut(groupName, ".")
+	return tenant
+}
+
+func TestParseConfig(t *testing.T) {
+	testCases := map[string]struct {
+		config    string
+		expectErr bool
+	}{
+		"valid": {
+			config: alertmanagerConfig,
+		},
+		"no route": {
+			config:    "receivers:\n- name: default\n",
+			expectErr: true,
+		},
+		"no receiver": {
+			config:    "route:\n  routes:\n  - receiver: pager\n",
+			expectErr: true,
+		},
+		"root matchers": {
+			config:    "route:\n  receiver: default\n  matchers: [severity=critical]\n",
+			expectErr: true,
+		},
+		"invalid matcher": {
+			config:    "route:\n  receiver: default\n  routes:\n  - receiver: pager\n    matchers: [severity]\n",
+			expectErr: true,
+		},
+		"invalid regular expression": {
+			config:    "route:\n  receiver: default\n  routes:\n  - receiver: pager\n    match_re:\n      team: \"(\"\n",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(tc.config))
+			if tc.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestChecker(t *testing.T) {
+	root, err := ParseConfig([]byte(alertmanagerConfig))
+	assert.NoError(t, err)
+	c := New(prometheus.NewRegistry(), root, groupTenant)
+
+	checked, err := c.Check(context.Background(), []byte(tenantsRules))
+	assert.NoError(t, err)
+	assert.Equal(t, tenantsRules, string(checked))
+
+	assert.Equal(t, map[string][]Unrouted{
+		"tenant-a": {{Group: "tenant-a.alerts", Alert: "NoTeam", Receiver: "default"}},
+		"tenant-b": {{Group: "tenant-b.alerts", Alert: "NoSeverity", Receiver: "default"}},
+	}, c.Report())
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.unrouted.WithLabelValues("tenant-a")))
+
+	// Tenants whose alerts are all routed are reported without unrouted alerts.
+	_, err = c.Check(context.Background(), []byte("groups:\n- name: tenant-a.alerts\n  rules:\n  - alert: Watchdog\n    expr: vector(1)\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]Unrouted{"tenant-a": {}}, c.Report())
+	assert.Equal(t, 0.0, testutil.ToFloat64(c.unrouted.WithLabelValues("tenant-a")))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// bindAddr resolves the local address upstream requests are dialed from, given as an IP address,
+// or as the name of a network interface whose first address is used, preferring IPv4 ones.
+func bindAddr(bind string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(bind); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+
+	iface, err := net.InterfaceByName(bind)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither an IP address nor a network interface: %w", bind, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the addresses of network interface %s: %w", bind, err)
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return &net.TCPAddr{IP: ip}, nil
+		}
+	}
+	if len(ips) > 0 {
+		return &net.TCPAddr{IP: ips[0]}, nil
+	}
+
+	return nil, fmt.Errorf("network interface %s has no IP address", bind)
+}
+
+// upstreamDialer returns a dialer like the one of http.DefaultTransport with the given connect timeout, dialing from
+// the local address and resolving hosts with the resolver, if not nil.
+func upstreamDialer(local *net.TCPAddr, resolver *net.Resolver, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Resolver:  resolver,
+	}
+	// A nil *net.TCPAddr in the net.Addr interface isn't nil, and fails dials.
+	if local != nil {
+		d.LocalAddr = local
+	}
+
+	return d
+}
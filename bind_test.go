@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// loopbackInterface returns the name of the loopback network interface, which differs between systems.
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	assert.NoError(t, err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback network interface")
+	return ""
+}
+
+func TestBindAddr(t *testing.T) {
+	testCases := map[string]struct {
+		bind string
+
+		expectErr bool
+		expectIP  string
+	}{
+		"IPv4 address": {
+			bind:     "127.0.0.1",
+			expectIP: "127.0.0.1",
+		},
+		"IPv6 address": {
+			bind:     "::1",
+			expectIP: "::1",
+		},
+		"loopback interface": {
+			bind:     loopbackInterface(t),
+			expectIP: "127.0.0.1",
+		},
+		"unknown interface": {
+			bind:      "does-not-exist0",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			addr, err := bindAddr(tc.bind)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectIP, addr.IP.String())
+		})
+	}
+}
+
+func TestUpstreamDialer(t *testing.T) {
+	var remoteHost string
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		remoteHost, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}))
+	defer server.Close()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = upstreamDialer(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil, 30*time.Second).DialContext
+
+	res, err := (&http.Client{Transport: transport}).Get(server.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "127.0.0.1", remoteHost)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// caFiles are the CA files the servers are verified against, read again when they change, e.g. when the intermediates
+// of an internal CA are rotated, so that the new certificates are trusted without restarting the syncer.
+type caFiles struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	files map[string]*caFile
+
+	reloads *prometheus.CounterVec
+}
+
+// newCAFiles returns the CA files read again at the given interval, or never if it is 0.
+func newCAFiles(r prometheus.Registerer, interval time.Duration) *caFiles {
+	c := &caFiles{
+		interval: interval,
+		files:    map[string]*caFile{},
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_ca_reloads_total",
+			Help: "Total number of times a changed CA file was read again, by file and result.",
+		}, []string{"file", "result"}),
+	}
+	if r != nil {
+		r.MustRegister(c.reloads)
+	}
+
+	return c
+}
+
+// add returns the CA file at the given path, watched for changes. It must be loaded before it verifies servers.
+func (c *caFiles) add(path string) *caFile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.files[path]
+	if !ok {
+		f = &caFile{path: path}
+		c.files[path] = f
+	}
+
+	return f
+}
+
+// Run reads the changed CA files again at the interval until the context is done. The certificates last read
+// are kept if a file can't be read or has no certificate, e.g. while it is being written.
+func (c *caFiles) Run(ctx context.Context) error {
+	if c.interval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		files := make([]*caFile, 0, len(c.files))
+		for _, f := range c.files {
+			files = append(files, f)
+		}
+		c.mu.Unlock()
+
+		for _, f := range files {
+			changed, err := f.load()
+			switch {
+			case err != nil:
+				log.Printf("failed to read CA file %s again, keeping its previous certificates: %v", f.path, err)
+				c.reloads.WithLabelValues(f.path, "failure").Inc()
+			case changed:
+				log.Printf("read CA file %s again", f.path)
+				c.reloads.WithLabelValues(f.path, "success").Inc()
+			}
+		}
+	}
+}
+
+// caFile is a CA file the servers are verified against, with the certificates it last had.
+type caFile struct {
+	path string
+
+	mu   sync.Mutex
+	sum  [sha256.Size]byte
+	pool atomic.Pointer[x509.CertPool]
+}
+
+// load reads the CA file, and tells whether its certificates changed since it was last read.
+func (f *caFile) load() (bool, error) {
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sum := sha256.Sum256(content)
+	if f.pool.Load() != nil && sum == f.sum {
+		return false, nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return false, fmt.Errorf("no certificate found in %s", f.path)
+	}
+	f.sum = sum
+	f.pool.Store(pool)
+
+	return true, nil
+}
+
+// configure makes the transport verify servers against the certificates the CA file last had.
+// The TLS configuration is updated rather than replaced, to keep the HTTP/2 protocols added to it.
+func (f *caFile) configure(t *http.Transport) {
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	// The roots of the TLS stack can't change, so the servers are verified by VerifyConnection instead.
+	t.TLSClientConfig.InsecureSkipVerify = true //nolint:gosec
+	t.TLSClientConfig.VerifyConnection = f.verify
+}
+
+// verify verifies the certificate chain of the server, like the TLS stack does with the certificates of the CA file as roots.
+func (f *caFile) verify(cs tls.ConnectionState) error {
+	roots := f.pool.Load()
+	if roots == nil {
+		return fmt.Errorf("CA file %s wasn't read yet", f.path)
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("the server sent no certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		return fmt.Errorf("failed to verify the certificate of the server with CA file %s: %w", f.path, err)
+	}
+
+	return nil
+}
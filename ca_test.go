@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertificate returns a self-signed certificate of 127.0.0.1, in PEM.
+func testCertificate(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestCAFiles(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	assert.NoError(t, os.WriteFile(path, testCertificate(t), 0o600))
+
+	cas := newCAFiles(nil, 10*time.Millisecond)
+	ca := cas.add(path)
+	assert.Same(t, ca, cas.add(path))
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = true
+	ca.configure(transport)
+	client := &http.Client{Transport: transport}
+	get := func() error {
+		res, err := client.Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	// The server isn't trusted before the CA file is read, nor with a CA that didn't sign its certificate.
+	assert.ErrorContains(t, get(), "wasn't read yet")
+	changed, err := ca.load()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.ErrorContains(t, get(), "failed to verify the certificate of the server with CA file")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- cas.Run(ctx)
+	}()
+
+	// The server is trusted once the CA file is rotated, and still is if it is then invalid.
+	assert.NoError(t, os.WriteFile(path, serverCA, 0o600))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(cas.reloads.WithLabelValues(path, "success")) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, get())
+
+	assert.NoError(t, os.WriteFile(path, []byte("partially written"), 0o600))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(cas.reloads.WithLabelValues(path, "failure")) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, get())
+
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,250 @@
+// Package canary verifies the whole sync pipeline end to end with a synthetic tenant whose rules the syncer generates
+// itself: a recording rule whose value is the time it was generated, whose series is then queried to check that the
+// rules were fetched, written, reloaded by the ruler and evaluated.
+package canary
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"gopkg.in/yaml.v3"
+)
+
+// Record is the name of the series recorded by the rule of the canary tenant, whose value is the Unix time
+// at which the rule was generated.
+const Record = "thanos_rule_syncer_canary_generated_timestamp_seconds"
+
+// Canary adds the rules of the synthetic canary tenant to the synced rules, and checks that the ruler evaluates them
+// by querying the series they record from a Prometheus-compatible query API, e.g. a Thanos Querier.
+type Canary struct {
+	tenant   string
+	queryURL string
+	client   *http.Client
+	// period is how often the rule is generated again with the current time. The rule is kept in between,
+	// so that the canary doesn't make the ruler reload on every sync.
+	period time.Duration
+	// grace is how long the rules generated at a time have to be synced and evaluated before the series must have their value.
+	grace time.Duration
+
+	clock clock.Clock
+
+	mu sync.Mutex
+	// current and previous are the times at which the rule was last generated.
+	current  time.Time
+	previous time.Time
+
+	healthy     prometheus.Gauge
+	checkErrors prometheus.Counter
+}
+
+// Option configures a Canary.
+type Option func(*Canary)
+
+// WithClock sets the clock timing the generations and the checks, e.g. a fake clock in tests.
+func WithClock(c clock.Clock) Option {
+	return func(ca *Canary) {
+		ca.clock = c
+	}
+}
+
+// New creates a new Canary adding the rules of the given tenant, generated again every period, and querying their
+// series from the query API at the given URL. The rules generated at a time must be evaluated within the grace period.
+// Its metrics are registered with the given registerer, if not nil.
+func New(r prometheus.Registerer, tenant, queryURL string, client *http.Client, period, grace time.Duration, opts ...Option) *Canary {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	c := &Canary{
+		tenant:   tenant,
+		queryURL: queryURL,
+		client:   client,
+		period:   period,
+		grace:    grace,
+		clock:    clock.Real(),
+		healthy: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_canary_healthy",
+			Help: "Whether the ruler evaluated the rules of the canary tenant generated at least the grace period before in the last check, so that the whole pipeline works. 1 if it did, 0 otherwise.",
+		}),
+		checkErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_canary_check_errors_total",
+			Help: "Total number of failed queries of the series recorded by the rules of the canary tenant.",
+		}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if r != nil {
+		r.MustRegister(c.healthy, c.checkErrors)
+	}
+
+	return c
+}
+
+// GroupName is the name of the rule group of the canary tenant, prefixed with the tenant like the merged groups of tenants.
+func (c *Canary) GroupName() string {
+	return c.tenant + ".canary"
+}
+
+// Inject adds the rule group of the canary tenant to the rules, generating its rule again with the current time
+// if it is older than the period. It must run after the rules are merged, as the rules of tenants are.
+func (c *Canary) Inject(_ context.Context, content []byte) ([]byte, error) {
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	for _, group := range groups.Groups {
+		if strings.HasPrefix(group.Name, c.tenant+".") {
+			return nil, fmt.Errorf("group %q: the canary tenant %s must not have rules of its own", group.Name, c.tenant)
+		}
+	}
+
+	generated := c.generate()
+
+	var group rules.RuleGroup
+	group.Name = c.GroupName()
+	group.Rules = []rulefmt.RuleNode{{
+		Record: yaml.Node{Kind: yaml.ScalarNode, Value: Record},
+		Expr:   yaml.Node{Kind: yaml.ScalarNode, Value: fmt.Sprintf("vector(%d)", generated.Unix())},
+	}}
+	groups.Groups = append(groups.Groups, group)
+
+	injected, err := yaml.Marshal(groups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	return injected, nil
+}
+
+// generate returns the time of the rule, generating it again if it is older than the period.
+func (c *Canary) generate() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	if c.current.IsZero() || now.Sub(c.current) >= c.period {
+		c.previous, c.current = c.current, now.Truncate(time.Second)
+	}
+
+	return c.current
+}
+
+// expected returns the time of the last rule generated at least the grace period before, which the ruler
+// must have evaluated, or false if there is none yet.
+func (c *Canary) expected() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	switch {
+	case !c.current.IsZero() && now.Sub(c.current) >= c.grace:
+		return c.current, true
+	case !c.previous.IsZero():
+		return c.previous, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// Run checks the canary at the given interval until the context is cancelled.
+func (c *Canary) Run(ctx context.Context, interval time.Duration) error {
+	ticker := c.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+			c.Check(ctx)
+		}
+	}
+}
+
+// Check queries the series recorded by the rule of the canary tenant, and reports the pipeline as healthy if its value
+// is at least the time of the last rule generated the grace period before. Nothing is reported until then.
+func (c *Canary) Check(ctx context.Context) {
+	expected, ok := c.expected()
+	if !ok {
+		return
+	}
+
+	evaluated, found, err := c.query(ctx)
+	if err != nil {
+		log.Printf("failed to query the series of the canary tenant %s: %v", c.tenant, err)
+		c.checkErrors.Inc()
+		return
+	}
+
+	switch {
+	case !found:
+		log.Printf("the series of the canary tenant %s is missing, its rules generated at %s weren't evaluated", c.tenant, expected.UTC().Format(time.RFC3339))
+		c.healthy.Set(0)
+	case evaluated.Before(expected):
+		log.Printf("the ruler evaluates the rules of the canary tenant %s generated at %s instead of %s", c.tenant, evaluated.UTC().Format(time.RFC3339), expected.UTC().Format(time.RFC3339))
+		c.healthy.Set(0)
+	default:
+		c.healthy.Set(1)
+	}
+}
+
+// query returns the latest generation time of the rules of the canary tenant evaluated by the ruler,
+// as recorded in its series, and whether the series was found.
+func (c *Canary) query(ctx context.Context) (time.Time, bool, error) {
+	query := url.Values{"query": {"max(" + Record + ")"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.queryURL+"/api/v1/query?"+query.Encode(), nil)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return time.Time{}, false, fmt.Errorf("got unexpected status from the query API: %d", res.StatusCode)
+	}
+
+	var queryRes struct {
+		Data struct {
+			Result []struct {
+				Value [2]any `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&queryRes); err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to decode query result: %w", err)
+	}
+	if len(queryRes.Data.Result) == 0 {
+		return time.Time{}, false, nil
+	}
+
+	value, ok := queryRes.Data.Result[0].Value[1].(string)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("unexpected value in the query result: %v", queryRes.Data.Result[0].Value[1])
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to parse the value of the query result: %w", err)
+	}
+
+	return time.Unix(int64(seconds), 0), true, nil
+}
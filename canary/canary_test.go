@@ -0,0 +1,130 @@
+package canary
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestCanaryInject(t *testing.T) {
+	fakeClock := clock.NewFake(time.Unix(1000, 0))
+	c := New(nil, "canary", "http://querier", nil, time.Minute, time.Minute, WithClock(fakeClock))
+
+	expr := func(content []byte) string {
+		var groups rules.RuleGroups
+		assert.NoError(t, yaml.Unmarshal(content, &groups))
+		assert.Len(t, groups.Groups, 2)
+		assert.Equal(t, "tenant-a.test", groups.Groups[0].Name)
+		assert.Equal(t, "canary.canary", groups.Groups[1].Name)
+		assert.Equal(t, Record, groups.Groups[1].Rules[0].Record.Value)
+		return groups.Groups[1].Rules[0].Expr.Value
+	}
+	content := []byte("groups:\n- name: tenant-a.test\n  rules:\n  - record: a\n    expr: vector(1)\n")
+
+	injected, err := c.Inject(context.Background(), content)
+	assert.NoError(t, err)
+	assert.Equal(t, "vector(1000)", expr(injected))
+	_, errs := rules.Parse(injected)
+	assert.Empty(t, errs)
+
+	// The rule is kept within the period, so that the ruler isn't reloaded on every sync.
+	fakeClock.Advance(30 * time.Second)
+	injected, err = c.Inject(context.Background(), content)
+	assert.NoError(t, err)
+	assert.Equal(t, "vector(1000)", expr(injected))
+
+	fakeClock.Advance(30 * time.Second)
+	injected, err = c.Inject(context.Background(), content)
+	assert.NoError(t, err)
+	assert.Equal(t, "vector(1060)", expr(injected))
+
+	// A tenant with the name of the canary tenant would have its rules mixed with the ones of the canary.
+	_, err = c.Inject(context.Background(), []byte("groups:\n- name: canary.test\n  rules: []\n"))
+	assert.ErrorContains(t, err, "the canary tenant canary must not have rules of its own")
+}
+
+func TestCanaryCheck(t *testing.T) {
+	testCases := map[string]struct {
+		// since is how long after the last generation the check runs.
+		since      time.Duration
+		evaluated  string
+		statusCode int
+
+		expectHealthy     float64
+		expectCheckErrors float64
+	}{
+		"last rules evaluated": {
+			since:         2 * time.Minute,
+			evaluated:     "1060",
+			expectHealthy: 1,
+		},
+		"last rules not evaluated yet within the grace period": {
+			since:         30 * time.Second,
+			evaluated:     "1000",
+			expectHealthy: 1,
+		},
+		"last rules not evaluated after the grace period": {
+			since:     2 * time.Minute,
+			evaluated: "1000",
+		},
+		"previous rules not evaluated": {
+			since:     30 * time.Second,
+			evaluated: "940",
+		},
+		"missing series": {
+			since: 2 * time.Minute,
+		},
+		"failed query": {
+			since:             2 * time.Minute,
+			statusCode:        http.StatusServiceUnavailable,
+			expectHealthy:     -1,
+			expectCheckErrors: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/v1/query", r.URL.Path)
+				assert.Equal(t, "max("+Record+")", r.URL.Query().Get("query"))
+				if tc.statusCode != 0 {
+					w.WriteHeader(tc.statusCode)
+					return
+				}
+				result := "[]"
+				if tc.evaluated != "" {
+					result = fmt.Sprintf(`[{"metric": {}, "value": [1100, %q]}]`, tc.evaluated)
+				}
+				fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "vector", "result": %s}}`, result)
+			}))
+			defer server.Close()
+
+			fakeClock := clock.NewFake(time.Unix(1000, 0))
+			c := New(nil, "canary", server.URL, server.Client(), time.Minute, time.Minute, WithClock(fakeClock))
+			// Nothing is checked before rules were generated.
+			c.healthy.Set(-1)
+			c.Check(context.Background())
+			assert.Equal(t, -1.0, testutil.ToFloat64(c.healthy))
+
+			_, err := c.Inject(context.Background(), []byte("groups: []"))
+			assert.NoError(t, err)
+			fakeClock.Advance(time.Minute)
+			_, err = c.Inject(context.Background(), []byte("groups: []"))
+			assert.NoError(t, err)
+
+			fakeClock.Advance(tc.since)
+			c.Check(context.Background())
+			assert.Equal(t, tc.expectHealthy, testutil.ToFloat64(c.healthy))
+			assert.Equal(t, tc.expectCheckErrors, testutil.ToFloat64(c.checkErrors))
+		})
+	}
+}
@@ -0,0 +1,133 @@
+// Package chaos injects failures into the syncer, e.g. failed fetches and slow reloads, to validate the alerts on the
+// failures of the syncer and how it handles them in non-production environments. It must not be enabled in production.
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/reload"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Targets of the injected failures.
+const (
+	TargetFetch  = "fetch"
+	TargetReload = "reload"
+)
+
+// Injector injects failures with the given probabilities, and counts them.
+type Injector struct {
+	// random returns a number in [0, 1), e.g. a fixed one in tests.
+	random func() float64
+
+	injected *prometheus.CounterVec
+}
+
+// Option configures an Injector.
+type Option func(*Injector)
+
+// WithRandom sets the function returning the random numbers in [0, 1) drawn to inject failures, e.g. a fixed one
+// in tests. By default, they are drawn from math/rand.
+func WithRandom(random func() float64) Option {
+	return func(i *Injector) {
+		i.random = random
+	}
+}
+
+// NewInjector creates a new Injector. Its metrics are registered with the given registerer, if not nil.
+func NewInjector(r prometheus.Registerer, opts ...Option) *Injector {
+	i := &Injector{
+		random: rand.Float64,
+		injected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_debug_injected_failures_total",
+			Help: "Total number of failures injected by the -debug flags, by target.",
+		}, []string{"target"}),
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	for _, target := range []string{TargetFetch, TargetReload} {
+		i.injected.WithLabelValues(target)
+	}
+
+	if r != nil {
+		r.MustRegister(i.injected)
+	}
+
+	return i
+}
+
+// fail returns whether to inject a failure with the given probability in percent, and counts it.
+func (i *Injector) fail(target string, percent float64) bool {
+	if percent <= 0 || i.random()*100 >= percent {
+		return false
+	}
+	i.injected.WithLabelValues(target).Inc()
+
+	return true
+}
+
+// Transport returns a transport responding to the given percentage of requests with 503 Service Unavailable instead
+// of sending them, like an unavailable upstream, and sending the other ones with the given transport.
+func (i *Injector) Transport(transport http.RoundTripper, percent float64) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if !i.fail(TargetFetch, percent) {
+			return transport.RoundTrip(req)
+		}
+		if req.Body != nil {
+			req.Body.Close()
+		}
+
+		body := "failure injected by -debug.fail-fetch-percent"
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)),
+			StatusCode:    http.StatusServiceUnavailable,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"text/plain"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	})
+}
+
+// Reloader returns a reloader waiting for the given delay before each reload, e.g. to exceed -reload.timeout, and
+// failing the given percentage of reloads instead of reloading.
+func (i *Injector) Reloader(reloader reload.Reloader, delay time.Duration, percent float64) reload.Reloader {
+	return reloaderFunc(func(ctx context.Context) error {
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		if i.fail(TargetReload, percent) {
+			return fmt.Errorf("failure injected by -debug.fail-reload-percent")
+		}
+
+		return reloader.Reload(ctx)
+	})
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type reloaderFunc func(ctx context.Context) error
+
+func (f reloaderFunc) Reload(ctx context.Context) error {
+	return f(ctx)
+}
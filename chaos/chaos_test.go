@@ -0,0 +1,133 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransport(t *testing.T) {
+	testCases := map[string]struct {
+		percent float64
+		random  float64
+
+		expectStatus   int
+		expectSent     bool
+		expectInjected float64
+	}{
+		"disabled": {
+			random:       0,
+			expectStatus: http.StatusOK,
+			expectSent:   true,
+		},
+		"not drawn": {
+			percent:      25,
+			random:       0.25,
+			expectStatus: http.StatusOK,
+			expectSent:   true,
+		},
+		"drawn": {
+			percent:        25,
+			random:         0.24,
+			expectStatus:   http.StatusServiceUnavailable,
+			expectInjected: 1,
+		},
+		"always": {
+			percent:        100,
+			random:         0.99,
+			expectStatus:   http.StatusServiceUnavailable,
+			expectInjected: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var sent atomic.Bool
+			server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+				sent.Store(true)
+			}))
+			defer server.Close()
+
+			i := NewInjector(nil, WithRandom(func() float64 { return tc.random }))
+			client := &http.Client{Transport: i.Transport(http.DefaultTransport, tc.percent)}
+
+			res, err := client.Get(server.URL)
+			assert.NoError(t, err)
+			res.Body.Close()
+			assert.Equal(t, tc.expectStatus, res.StatusCode)
+			assert.Equal(t, tc.expectSent, sent.Load())
+			assert.Equal(t, tc.expectInjected, testutil.ToFloat64(i.injected.WithLabelValues(TargetFetch)))
+		})
+	}
+}
+
+type countingReloader struct {
+	reloads atomic.Int32
+}
+
+func (r *countingReloader) Reload(context.Context) error {
+	r.reloads.Add(1)
+	return nil
+}
+
+func TestReloader(t *testing.T) {
+	testCases := map[string]struct {
+		delay   time.Duration
+		percent float64
+		timeout time.Duration
+
+		expectErr      error
+		expectReloads  int32
+		expectInjected float64
+	}{
+		"disabled": {
+			expectReloads: 1,
+		},
+		"slow": {
+			delay:         10 * time.Millisecond,
+			timeout:       time.Second,
+			expectReloads: 1,
+		},
+		"slower than the timeout": {
+			delay:     time.Second,
+			timeout:   10 * time.Millisecond,
+			expectErr: context.DeadlineExceeded,
+		},
+		"failed": {
+			percent:        100,
+			expectErr:      errors.New("failure injected by -debug.fail-reload-percent"),
+			expectInjected: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+
+			next := &countingReloader{}
+			i := NewInjector(nil, WithRandom(func() float64 { return 0.5 }))
+			start := time.Now()
+			err := i.Reloader(next, tc.delay, tc.percent).Reload(ctx)
+			if tc.expectErr != nil {
+				assert.ErrorContains(t, err, tc.expectErr.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.GreaterOrEqual(t, time.Since(start), min(tc.delay, tc.timeout))
+			assert.Equal(t, tc.expectReloads, next.reloads.Load())
+			assert.Equal(t, tc.expectInjected, testutil.ToFloat64(i.injected.WithLabelValues(TargetReload)))
+		})
+	}
+}
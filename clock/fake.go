@@ -0,0 +1,197 @@
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Fake is a clock whose time only passes when it is advanced, firing the timers and tickers due meanwhile.
+// Timers and tickers drop the times they can't send, like the ones of the system.
+type Fake struct {
+	mu   sync.Mutex
+	now  time.Time
+	cond *sync.Cond
+	// waiters are the active timers and tickers.
+	waiters []*fakeTimer
+}
+
+// NewFake creates a new Fake clock set to the given time.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.cond = sync.NewCond(&f.mu)
+
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) Until(t time.Time) time.Duration {
+	return t.Sub(f.Now())
+}
+
+// Sleep blocks until the clock is advanced by d.
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.NewTimer(d).C()
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return f.add(d, 0)
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	return fakeTicker{f.add(d, d)}
+}
+
+func (f *Fake) add(d, period time.Duration) *fakeTimer {
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1), period: period}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.schedule(t, d)
+
+	return t
+}
+
+// schedule activates the timer to fire after d. It must be called with the lock held.
+func (f *Fake) schedule(t *fakeTimer, d time.Duration) {
+	t.when = f.now.Add(d)
+	if !t.active {
+		t.active = true
+		f.waiters = append(f.waiters, t)
+	}
+	f.cond.Broadcast()
+}
+
+// unschedule deactivates the timer, and returns whether it was active. It must be called with the lock held.
+func (f *Fake) unschedule(t *fakeTimer) bool {
+	if !t.active {
+		return false
+	}
+
+	t.active = false
+	for i, w := range f.waiters {
+		if w == t {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			break
+		}
+	}
+	f.cond.Broadcast()
+
+	return true
+}
+
+// Advance moves the time forward by d, firing the timers and tickers due meanwhile in order.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	end := f.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, w := range f.waiters {
+			if !w.when.After(end) && (next == nil || w.when.Before(next.when)) {
+				next = w
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		f.now = next.when
+		select {
+		case next.c <- next.when:
+		default:
+		}
+
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			f.unschedule(next)
+		}
+	}
+	f.now = end
+}
+
+// BlockUntil blocks until at least n timers and tickers are active, e.g. until the code under test waits for
+// the clock to be advanced, or until the context is done.
+func (f *Fake) BlockUntil(ctx context.Context, n int) error {
+	stop := context.AfterFunc(ctx, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.cond.Broadcast()
+	})
+	defer stop()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f.cond.Wait()
+	}
+
+	return nil
+}
+
+type fakeTimer struct {
+	clock  *Fake
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+	active bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop stops the timer, and drains its channel so that no stale time is received after it.
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.drain()
+
+	return t.clock.unschedule(t)
+}
+
+// Reset reschedules the timer to fire after d, and drains its channel so that no stale time is received after it.
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.drain()
+
+	active := t.active
+	t.clock.schedule(t, d)
+
+	return active
+}
+
+func (t *fakeTimer) drain() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
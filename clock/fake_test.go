@@ -0,0 +1,101 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// received returns the times received on the channel without blocking.
+func received(c <-chan time.Time) []time.Time {
+	var times []time.Time
+	for {
+		select {
+		case t := <-c:
+			times = append(times, t)
+		default:
+			return times
+		}
+	}
+}
+
+func TestFake(t *testing.T) {
+	start := time.Unix(0, 0)
+
+	testCases := map[string]struct {
+		run func(f *Fake) []time.Time
+
+		expect []time.Time
+	}{
+		"timer fires once due": {
+			run: func(f *Fake) []time.Time {
+				timer := f.NewTimer(time.Minute)
+				f.Advance(59 * time.Second)
+				times := received(timer.C())
+				f.Advance(time.Hour)
+				return append(times, received(timer.C())...)
+			},
+			expect: []time.Time{start.Add(time.Minute)},
+		},
+		"stopped timer doesn't fire": {
+			run: func(f *Fake) []time.Time {
+				timer := f.NewTimer(time.Minute)
+				assert.True(t, timer.Stop())
+				assert.False(t, timer.Stop())
+				f.Advance(time.Hour)
+				return received(timer.C())
+			},
+		},
+		"reset timer fires after the new duration": {
+			run: func(f *Fake) []time.Time {
+				timer := f.NewTimer(time.Minute)
+				f.Advance(time.Minute)
+				assert.False(t, timer.Reset(time.Hour))
+				f.Advance(time.Hour)
+				return received(timer.C())
+			},
+			expect: []time.Time{start.Add(time.Minute + time.Hour)},
+		},
+		"ticker drops ticks not received": {
+			run: func(f *Fake) []time.Time {
+				ticker := f.NewTicker(time.Minute)
+				f.Advance(3 * time.Minute)
+				times := received(ticker.C())
+				f.Advance(time.Minute)
+				times = append(times, received(ticker.C())...)
+				ticker.Stop()
+				f.Advance(time.Minute)
+				return append(times, received(ticker.C())...)
+			},
+			expect: []time.Time{start.Add(time.Minute), start.Add(4 * time.Minute)},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			f := NewFake(start)
+			assert.Equal(t, tc.expect, tc.run(f))
+		})
+	}
+}
+
+func TestFakeSleep(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	done := make(chan struct{})
+	go func() {
+		f.Sleep(time.Minute)
+		close(done)
+	}()
+
+	assert.NoError(t, f.BlockUntil(context.Background(), 1))
+	f.Advance(time.Minute)
+	<-done
+	assert.Equal(t, time.Minute, f.Since(time.Unix(0, 0)))
+
+	// Nothing waits on the clock anymore.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, f.BlockUntil(ctx, 1), context.Canceled)
+}
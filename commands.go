@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/output"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/yaml.v3"
+)
+
+// commandsUsage describes the commands that can be run instead of the syncer.
+const commandsUsage = `
+Commands:
+  check-tenant <name>
+    	Fetch the rules of a single tenant with the configured source and auth, validate them, report their group and rule counts and exit.
+  diff
+    	Fetch the rules with the configured source and auth, merge them like a sync cycle, print a unified diff against the -file and exit with code 9 if they differ.
+  export-tenant <name>
+    	Download the rules of a single tenant with the configured source and auth, as they are stored, and print them.
+  import-tenant <name> <file>
+    	Validate the rules of the file, or of the standard input if the file is "-", and upload them as the rules of a single tenant with the configured source and auth.
+  migrate-tenants-file
+    	Read the -tenants-file, in any supported format and version, and print it in the YAML format of the latest version.
+`
+
+// runCommand runs the command given as arguments and returns the exit code of the process.
+func runCommand(ctx context.Context, cfg *config, client *http.Client, clients *tenantClients, args []string) int {
+	switch args[0] {
+	case "check-tenant":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: check-tenant <name>")
+			return exitUsage
+		}
+
+		if err := checkTenant(ctx, cfg, client, clients, args[1], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "tenant %s: check failed (%s error): %v\n", args[1], syncer.ErrorClass(err), err)
+			return exitCode(err)
+		}
+
+		return 0
+	case "diff":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: diff")
+			return exitUsage
+		}
+
+		drift, err := diffRules(ctx, cfg, client, clients, configureMerger(cfg, client, nil), os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "diff failed (%s error): %v\n", syncer.ErrorClass(err), err)
+			return exitCode(err)
+		}
+		if drift {
+			return exitDrift
+		}
+
+		return 0
+	case "export-tenant":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: export-tenant <name>")
+			return exitUsage
+		}
+
+		if err := exportTenant(ctx, cfg, client, clients, args[1], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "tenant %s: export failed (%s error): %v\n", args[1], syncer.ErrorClass(err), err)
+			return exitCode(err)
+		}
+
+		return 0
+	case "import-tenant":
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, "usage: import-tenant <name> <file>")
+			return exitUsage
+		}
+
+		if err := importTenant(ctx, cfg, client, clients, args[1], args[2], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "tenant %s: import failed (%s error): %v\n", args[1], syncer.ErrorClass(err), err)
+			return exitCode(err)
+		}
+
+		return 0
+	case "migrate-tenants-file":
+		if len(args) != 1 || cfg.tenantsFile == "" {
+			fmt.Fprintln(os.Stderr, "usage: -tenants-file=<path> migrate-tenants-file")
+			return exitUsage
+		}
+
+		if err := migrateTenantsFile(cfg.tenantsFile, cfg.tenantsFormat, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to migrate tenants file: %v\n", err)
+			return exitCode(err)
+		}
+
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s", args[0], commandsUsage)
+		return exitUsage
+	}
+}
+
+// tenantClient returns the client of the tenant of a command: the one of its OIDC client credentials in the tenants
+// file, if any, like the syncer, and the default client otherwise.
+func tenantClient(cfg *config, client *http.Client, clients *tenantClients, tenant string) (*http.Client, error) {
+	if cfg.tenantsFile == "" || clients == nil {
+		return client, nil
+	}
+
+	tenants, err := readTenantsFile(cfg.tenantsFile, cfg.tenantsFormat)
+	if err != nil {
+		return nil, classError(syncer.ErrorConfig, "failed to read tenants file: %w", err)
+	}
+	for _, t := range tenants.Tenants {
+		if t.ID == tenant {
+			return clients.client(t), nil
+		}
+	}
+
+	return client, nil
+}
+
+// checkTenant fetches and validates the rules of a tenant, and writes a report of them to w.
+// The tenant is fetched with its client, see tenantClient.
+func checkTenant(ctx context.Context, cfg *config, client *http.Client, clients *tenantClients, tenant string, w io.Writer) error {
+	client, err := tenantClient(cfg, client, clients, tenant)
+	if err != nil {
+		return err
+	}
+
+	var f fetch.Fetcher
+	// parseErrors are the errors of the rules fetched from the rules backend, whose fetcher doesn't fail on them.
+	var parseErrors func() map[string]string
+	switch {
+	case cfg.rulesBackendURL != "":
+		rof, err := fetch.NewRulesObjstoreFetcher(cfg.rulesBackendURL, []string{tenant}, client, fetch.WithResolver(fetchResolver(cfg)))
+		if err != nil {
+			return classError(syncer.ErrorConfig, "failed to initialize Rules Object Store fetcher: %w", err)
+		}
+		f = fetch.FetcherFunc(rof.GetTenantsRules)
+		parseErrors = rof.ParseErrors
+	case cfg.observatoriumURL != "":
+		obsAPIFetcher, err := fetch.NewObservatoriumAPIFetcher(cfg.observatoriumURL, tenant, client)
+		if err != nil {
+			return classError(syncer.ErrorConfig, "failed to initialize Observatorium API fetcher: %w", err)
+		}
+		f = obsAPIFetcher
+	default:
+		return classError(syncer.ErrorConfig, "either -rules-backend-url or -observatorium-api-url must be specified")
+	}
+
+	fetched, err := f.GetRules(ctx)
+	if err != nil {
+		return fetchError(fmt.Errorf("failed to get rules: %w", err))
+	}
+	defer fetched.Close()
+
+	content, err := io.ReadAll(fetched)
+	if err != nil {
+		return fetchError(fmt.Errorf("failed to read rules: %w", err))
+	}
+	if parseErrors != nil {
+		if parseErr, ok := parseErrors()[tenant]; ok {
+			return classError(syncer.ErrorValidation, "invalid rules: %s", parseErr)
+		}
+	}
+
+	groups, errs := rules.Parse(content)
+	if len(errs) > 0 {
+		return classError(syncer.ErrorValidation, "invalid rules: %w", errors.Join(errs...))
+	}
+
+	alerts, records := countRules(groups)
+	fmt.Fprintf(w, "tenant %s: OK, %d groups, %d rules (%d alerting, %d recording)\n", tenant, len(groups.Groups), alerts+records, alerts, records)
+	for _, group := range groups.Groups {
+		fmt.Fprintf(w, "  %s: %d rules\n", group.Name, len(group.Rules))
+	}
+
+	return nil
+}
+
+// diffRules fetches the rules of the configured tenants, merges them with m and annotates them like a sync cycle,
+// and writes a unified diff of the rules file against them to w. It returns whether they differ. The rules aren't
+// checked, so that the rules the checks would drop, e.g. for exceeding the output capacity, show in the diff.
+// The tenants of the tenants file are fetched with their clients.
+func diffRules(ctx context.Context, cfg *config, client *http.Client, clients *tenantClients, m *merge.Merger, w io.Writer) (bool, error) {
+	if cfg.output.tenantTemplate() != "" || cfg.output.routingFile != "" {
+		return false, classError(syncer.ErrorConfig, "diff can't be used with -output.tenant-dir, -file-template or -output.routing-file")
+	}
+
+	var f fetch.Fetcher
+	var lastModified func(tenant string) (time.Time, bool)
+	// Rules fetched from the Observatorium API for a single tenant are not prefixed with its name.
+	var mergeTenant string
+	switch {
+	case cfg.source == sourceStdin || cfg.source == sourceNATS:
+		return false, classError(syncer.ErrorConfig, "diff can't be used with -source=%s", cfg.source)
+	case cfg.rulesBackendURL != "":
+		rof, err := fetch.NewRulesObjstoreFetcher(cfg.rulesBackendURL, nil, client, fetch.WithResolver(fetchResolver(cfg)))
+		if err != nil {
+			return false, classError(syncer.ErrorConfig, "failed to initialize Rules Object Store fetcher: %w", err)
+		}
+		lastModified = rof.LastModified
+
+		f = fetch.FetcherFunc(rof.GetAllRules)
+		switch {
+		case cfg.tenantsFile != "":
+			tenants, err := readTenantsFile(cfg.tenantsFile, cfg.tenantsFormat)
+			if err != nil {
+				return false, classError(syncer.ErrorConfig, "failed to read tenants file: %w", err)
+			}
+			objstoreTenantsSetter{fetcher: rof, merger: m, clients: clients.client, includeClients: clients.include}.SetTenants(tenants)
+			f = fetch.FetcherFunc(rof.GetTenantsRules)
+		case cfg.tenant != "":
+			rof.SetTenants([]string{cfg.tenant})
+			f = fetch.FetcherFunc(rof.GetTenantsRules)
+		}
+	case cfg.observatoriumURL != "" && cfg.tenantsFile != "":
+		rof, err := fetch.NewObservatoriumAPITenantsFetcher(cfg.observatoriumURL, nil, client)
+		if err != nil {
+			return false, classError(syncer.ErrorConfig, "failed to initialize Observatorium API fetcher: %w", err)
+		}
+		lastModified = rof.LastModified
+
+		tenants, err := readTenantsFile(cfg.tenantsFile, cfg.tenantsFormat)
+		if err != nil {
+			return false, classError(syncer.ErrorConfig, "failed to read tenants file: %w", err)
+		}
+		objstoreTenantsSetter{fetcher: rof, merger: m, clients: clients.client, observatoriumAPI: true, includeClients: clients.include}.SetTenants(tenants)
+		f = fetch.FetcherFunc(rof.GetTenantsRules)
+	case cfg.observatoriumURL != "":
+		if cfg.tenant == "" {
+			return false, classError(syncer.ErrorConfig, "a tenant must be specified with the -tenant or -tenants-file flag when using the Observatorium API")
+		}
+		obsAPIFetcher, err := fetch.NewObservatoriumAPIFetcher(cfg.observatoriumURL, cfg.tenant, client)
+		if err != nil {
+			return false, classError(syncer.ErrorConfig, "failed to initialize Observatorium API fetcher: %w", err)
+		}
+		f = obsAPIFetcher
+		lastModified = obsAPIFetcher.LastModified
+		mergeTenant = cfg.tenant
+	default:
+		return false, classError(syncer.ErrorConfig, "either -rules-backend-url or -observatorium-api-url must be specified")
+	}
+
+	fetched, err := f.GetRules(ctx)
+	if err != nil {
+		return false, fetchError(fmt.Errorf("failed to get rules: %w", err))
+	}
+	defer fetched.Close()
+
+	content, err := io.ReadAll(fetched)
+	if err != nil {
+		return false, fetchError(fmt.Errorf("failed to read rules: %w", err))
+	}
+	if content, err = m.Merge(ctx, content, mergeTenant); err != nil {
+		return false, classError(syncer.ErrorValidation, "failed to merge rules: %w", err)
+	}
+	if cfg.output.provenance {
+		if content, err = output.NewProvenance(merge.GroupTenantFunc(mergeTenant), lastModified).Annotate(ctx, content); err != nil {
+			return false, classError(syncer.ErrorValidation, "failed to annotate rules: %w", err)
+		}
+	}
+
+	// A missing rules file differs from any rules, like an empty one.
+	written, err := os.ReadFile(cfg.file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, classError(syncer.ErrorConfig, "failed to read rules file: %w", err)
+	}
+	if bytes.Equal(written, content) {
+		return false, nil
+	}
+
+	unified, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        diffLines(written),
+		B:        diffLines(content),
+		FromFile: cfg.file,
+		ToFile:   "upstream",
+		Context:  3,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to diff rules: %w", err)
+	}
+	_, err = io.WriteString(w, unified)
+
+	return true, err
+}
+
+// diffLines returns the lines of the content to diff, with their line endings.
+func diffLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// countRules returns the numbers of alerting and recording rules of the groups.
+func countRules(groups *rules.RuleGroups) (alerts, records int) {
+	for _, group := range groups.Groups {
+		for _, rule := range group.Rules {
+			if rule.Alert.Value != "" {
+				alerts++
+			} else {
+				records++
+			}
+		}
+	}
+
+	return alerts, records
+}
+
+// tenantBackend is where the rules of a single tenant are downloaded from and uploaded to by the commands.
+type tenantBackend struct {
+	get func(ctx context.Context) (io.ReadCloser, error)
+	set func(ctx context.Context, content []byte) error
+}
+
+// newTenantBackend returns the backend of the rules of the tenant: the rules backend, or the Observatorium API.
+func newTenantBackend(cfg *config, client *http.Client, tenant string) (*tenantBackend, error) {
+	switch {
+	case cfg.rulesBackendURL != "":
+		rof, err := fetch.NewRulesObjstoreFetcher(cfg.rulesBackendURL, []string{tenant}, client, fetch.WithResolver(fetchResolver(cfg)))
+		if err != nil {
+			return nil, classError(syncer.ErrorConfig, "failed to initialize Rules Object Store fetcher: %w", err)
+		}
+		return &tenantBackend{
+			get: func(ctx context.Context) (io.ReadCloser, error) { return rof.TenantRules(ctx, tenant) },
+			set: func(ctx context.Context, content []byte) error { return rof.SetTenantRules(ctx, tenant, content) },
+		}, nil
+	case cfg.observatoriumURL != "":
+		obsAPIFetcher, err := fetch.NewObservatoriumAPIFetcher(cfg.observatoriumURL, tenant, client)
+		if err != nil {
+			return nil, classError(syncer.ErrorConfig, "failed to initialize Observatorium API fetcher: %w", err)
+		}
+		return &tenantBackend{get: obsAPIFetcher.GetRules, set: obsAPIFetcher.SetRules}, nil
+	default:
+		return nil, classError(syncer.ErrorConfig, "either -rules-backend-url or -observatorium-api-url must be specified")
+	}
+}
+
+// exportTenant downloads the rules of a tenant with its client, see tenantClient, and writes them to w as they are
+// stored, e.g. to back them up.
+func exportTenant(ctx context.Context, cfg *config, client *http.Client, clients *tenantClients, tenant string, w io.Writer) error {
+	client, err := tenantClient(cfg, client, clients, tenant)
+	if err != nil {
+		return err
+	}
+
+	backend, err := newTenantBackend(cfg, client, tenant)
+	if err != nil {
+		return err
+	}
+
+	fetched, err := backend.get(ctx)
+	if err != nil {
+		return fetchError(fmt.Errorf("failed to get rules: %w", err))
+	}
+	defer fetched.Close()
+
+	if _, err := io.Copy(w, fetched); err != nil {
+		return fetchError(fmt.Errorf("failed to read rules: %w", err))
+	}
+
+	return nil
+}
+
+// importTenant validates the rules of the file, read from stdin if the file is "-", uploads them as the rules of
+// the tenant with its client, see tenantClient, and writes a summary of them to w. Invalid rules aren't uploaded.
+func importTenant(ctx context.Context, cfg *config, client *http.Client, clients *tenantClients, tenant, file string, stdin io.Reader, w io.Writer) error {
+	var content []byte
+	var err error
+	if file == "-" {
+		content, err = io.ReadAll(stdin)
+	} else {
+		content, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return classError(syncer.ErrorConfig, "failed to read rules file: %w", err)
+	}
+
+	groups, errs := rules.Parse(content)
+	if len(errs) > 0 {
+		return classError(syncer.ErrorValidation, "invalid rules: %w", errors.Join(errs...))
+	}
+
+	if client, err = tenantClient(cfg, client, clients, tenant); err != nil {
+		return err
+	}
+	backend, err := newTenantBackend(cfg, client, tenant)
+	if err != nil {
+		return err
+	}
+	if err := backend.set(ctx, content); err != nil {
+		return fetchError(fmt.Errorf("failed to set rules: %w", err))
+	}
+
+	alerts, records := countRules(groups)
+	fmt.Fprintf(w, "tenant %s: imported %d groups, %d rules (%d alerting, %d recording)\n", tenant, len(groups.Groups), alerts+records, alerts, records)
+
+	return nil
+}
+
+// migrateTenantsFile reads a tenants file and writes it to w in the YAML format of the latest version.
+// The fragments it includes are kept as they are.
+func migrateTenantsFile(file, format string, w io.Writer) error {
+	tenantsCfg, err := parseTenantsFile(file, format)
+	if err != nil {
+		return classError(syncer.ErrorConfig, "%w", err)
+	}
+
+	out, err := yaml.Marshal(tenantsCfg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tenants file: %w", err)
+	}
+
+	_, err = w.Write(out)
+	return err
+}
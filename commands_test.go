@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckTenant(t *testing.T) {
+	testCases := map[string]struct {
+		responseBody   string
+		responseStatus int
+		expectErr      bool
+		expectClass    string
+		expectReport   string
+	}{
+		"valid rules are reported": {
+			responseBody: `
+groups:
+- name: test
+  rules:
+  - alert: TestAlert
+    expr: vector(1)
+  - record: test:record
+    expr: vector(1)
+`,
+			responseStatus: http.StatusOK,
+			expectReport:   "tenant tenant1: OK, 1 groups, 2 rules (1 alerting, 1 recording)\n  test: 2 rules\n",
+		},
+		"invalid rules fail": {
+			responseBody:   "groups:\n- name: test\n  rules:\n  - alert: TestAlert\n    expr: vector(\n",
+			responseStatus: http.StatusOK,
+			expectErr:      true,
+			expectClass:    syncer.ErrorValidation,
+		},
+		"upstream error fails": {
+			responseStatus: http.StatusNotFound,
+			expectErr:      true,
+			expectClass:    syncer.ErrorFetch,
+		},
+		"rejected credentials fail": {
+			responseStatus: http.StatusUnauthorized,
+			expectErr:      true,
+			expectClass:    syncer.ErrorAuth,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/metrics/v1/tenant1/api/v1/rules/raw", r.URL.Path)
+				w.WriteHeader(tc.responseStatus)
+				_, _ = w.Write([]byte(tc.responseBody))
+			}))
+			defer server.Close()
+
+			var report bytes.Buffer
+			cfg := &config{observatoriumURL: server.URL}
+			err := checkTenant(context.Background(), cfg, server.Client(), nil, "tenant1", &report)
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.Equal(t, tc.expectClass, syncer.ErrorClass(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectReport, report.String())
+		})
+	}
+}
+
+func TestCheckTenantRulesBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/rules/tenant1", r.URL.Path)
+		_, _ = w.Write([]byte("groups:\n- name: test\n  rules:\n  - alert: TestAlert\n    expr: vector(\n"))
+	}))
+	defer server.Close()
+
+	// The rules backend fetcher serves the last valid rules of tenants, but the check still fails.
+	var report bytes.Buffer
+	err := checkTenant(context.Background(), &config{rulesBackendURL: server.URL}, server.Client(), nil, "tenant1", &report)
+	assert.ErrorContains(t, err, "invalid rules: ")
+	assert.Equal(t, syncer.ErrorValidation, syncer.ErrorClass(err))
+	assert.Empty(t, report.String())
+}
+
+func TestMigrateTenantsFile(t *testing.T) {
+	testCases := map[string]struct {
+		fileContent string
+
+		expectErr    bool
+		expectOutput string
+	}{
+		"lines": {
+			fileContent:  "# tenants\ntenant1\ntenant2\n",
+			expectOutput: "version: 1\ntenants:\n    - id: tenant1\n    - id: tenant2\n",
+		},
+		"unversioned yaml": {
+			fileContent:  "tenants:\n- id: tenant1\n  shadow: true\n",
+			expectOutput: "version: 1\ntenants:\n    - id: tenant1\n      shadow: true\n",
+		},
+		"unsupported version": {
+			fileContent: "version: 2\ntenants:\n- id: tenant1\n",
+			expectErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "tenants")
+			assert.NoError(t, os.WriteFile(file, []byte(tc.fileContent), 0o600))
+
+			var out bytes.Buffer
+			err := migrateTenantsFile(file, tenantsFormatAuto, &out)
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.Equal(t, syncer.ErrorConfig, syncer.ErrorClass(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectOutput, out.String())
+
+			// The output is read back strictly, as a file of the latest version.
+			tenants, err := readTenantsConfig(out.Bytes(), tenantsFormatAuto)
+			assert.NoError(t, err)
+			assert.Equal(t, tenantsFileVersion, tenants.Version)
+		})
+	}
+}
+
+func TestExportTenant(t *testing.T) {
+	const stored = "groups:\n- name: test\n  rules:\n  - alert: TestAlert\n    expr: vector(\n"
+
+	testCases := map[string]struct {
+		cfg            func(url string) *config
+		expectPath     string
+		responseStatus int
+
+		expectErr    bool
+		expectClass  string
+		expectOutput string
+	}{
+		"rules backend": {
+			cfg:            func(url string) *config { return &config{rulesBackendURL: url} },
+			expectPath:     "/api/v1/rules/tenant1",
+			responseStatus: http.StatusOK,
+			// The rules are exported as they are stored, even if invalid.
+			expectOutput: stored,
+		},
+		"observatorium api": {
+			cfg:            func(url string) *config { return &config{observatoriumURL: url} },
+			expectPath:     "/api/metrics/v1/tenant1/api/v1/rules/raw",
+			responseStatus: http.StatusOK,
+			expectOutput:   stored,
+		},
+		"upstream error fails": {
+			cfg:            func(url string) *config { return &config{rulesBackendURL: url} },
+			expectPath:     "/api/v1/rules/tenant1",
+			responseStatus: http.StatusInternalServerError,
+			expectErr:      true,
+			expectClass:    syncer.ErrorFetch,
+		},
+		"no source fails": {
+			cfg:         func(string) *config { return &config{} },
+			expectErr:   true,
+			expectClass: syncer.ErrorConfig,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodGet, r.Method)
+				assert.Equal(t, tc.expectPath, r.URL.Path)
+				w.WriteHeader(tc.responseStatus)
+				_, _ = w.Write([]byte(stored))
+			}))
+			defer server.Close()
+
+			var out bytes.Buffer
+			err := exportTenant(context.Background(), tc.cfg(server.URL), server.Client(), nil, "tenant1", &out)
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.Equal(t, tc.expectClass, syncer.ErrorClass(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectOutput, out.String())
+		})
+	}
+}
+
+func TestImportTenant(t *testing.T) {
+	const valid = "groups:\n- name: test\n  rules:\n  - alert: TestAlert\n    expr: vector(1)\n"
+
+	testCases := map[string]struct {
+		cfg            func(url string) *config
+		content        string
+		stdin          bool
+		responseStatus int
+
+		expectPath   string
+		expectErr    bool
+		expectClass  string
+		expectOutput string
+	}{
+		"rules backend": {
+			cfg:            func(url string) *config { return &config{rulesBackendURL: url} },
+			content:        valid,
+			responseStatus: http.StatusOK,
+			expectPath:     "/api/v1/rules/tenant1",
+			expectOutput:   "tenant tenant1: imported 1 groups, 1 rules (1 alerting, 0 recording)\n",
+		},
+		"observatorium api from stdin": {
+			cfg:            func(url string) *config { return &config{observatoriumURL: url} },
+			content:        valid,
+			stdin:          true,
+			responseStatus: http.StatusOK,
+			expectPath:     "/api/metrics/v1/tenant1/api/v1/rules/raw",
+			expectOutput:   "tenant tenant1: imported 1 groups, 1 rules (1 alerting, 0 recording)\n",
+		},
+		"invalid rules aren't uploaded": {
+			cfg:         func(url string) *config { return &config{rulesBackendURL: url} },
+			content:     "groups:\n- name: test\n  rules:\n  - alert: TestAlert\n    expr: vector(\n",
+			expectErr:   true,
+			expectClass: syncer.ErrorValidation,
+		},
+		"rejected credentials fail": {
+			cfg:            func(url string) *config { return &config{rulesBackendURL: url} },
+			content:        valid,
+			responseStatus: http.StatusForbidden,
+			expectPath:     "/api/v1/rules/tenant1",
+			expectErr:      true,
+			expectClass:    syncer.ErrorAuth,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var uploaded string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPut, r.Method)
+				assert.Equal(t, tc.expectPath, r.URL.Path)
+				body, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				uploaded = string(body)
+				w.WriteHeader(tc.responseStatus)
+			}))
+			defer server.Close()
+
+			file := "-"
+			if !tc.stdin {
+				file = filepath.Join(t.TempDir(), "rules.yaml")
+				assert.NoError(t, os.WriteFile(file, []byte(tc.content), 0o600))
+			}
+
+			var out bytes.Buffer
+			err := importTenant(context.Background(), tc.cfg(server.URL), server.Client(), nil, "tenant1", file, strings.NewReader(tc.content), &out)
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.Equal(t, tc.expectClass, syncer.ErrorClass(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.content, uploaded)
+			assert.Equal(t, tc.expectOutput, out.String())
+		})
+	}
+}
+
+func TestTenantCommandsOIDC(t *testing.T) {
+	const valid = "groups:\n- name: test\n  rules:\n  - alert: TestAlert\n    expr: vector(1)\n"
+
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer": %q, "token_endpoint": %q}`, issuer.URL, issuer.URL+"/token")
+		case "/token":
+			clientID, _, _ := r.BasicAuth()
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token": "token-%s", "token_type": "bearer", "expires_in": 3600}`, clientID)
+		}
+	}))
+	defer issuer.Close()
+
+	var authorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(valid))
+	}))
+	defer upstream.Close()
+
+	// The tenants of the tenants file with their own credentials are fetched and uploaded with them.
+	cfg := &config{observatoriumURL: upstream.URL, tenantsFile: filepath.Join(t.TempDir(), "tenants.yaml"), tenantsFormat: tenantsFormatYAML}
+	assert.NoError(t, os.WriteFile(cfg.tenantsFile, []byte(fmt.Sprintf(`
+tenants:
+- id: tenant1
+  oidc:
+    issuerURL: %s
+    clientID: team-a
+    clientSecret: secret
+- id: tenant2
+`, issuer.URL)), 0o600))
+	rulesFile := filepath.Join(t.TempDir(), "rules.yaml")
+	assert.NoError(t, os.WriteFile(rulesFile, []byte(valid), 0o600))
+
+	r := prometheus.NewRegistry()
+	auth := newUpstreamAuth(cfg, newStartup(r, 0), http.DefaultTransport, newRoundTripperInstrumenter(r), r)
+	defaultClient := &http.Client{}
+	clients := newTenantClients(context.Background(), auth, http.DefaultTransport, defaultClient)
+
+	commands := map[string]func(tenant string) error{
+		"check-tenant": func(tenant string) error {
+			return checkTenant(context.Background(), cfg, defaultClient, clients, tenant, io.Discard)
+		},
+		"export-tenant": func(tenant string) error {
+			return exportTenant(context.Background(), cfg, defaultClient, clients, tenant, io.Discard)
+		},
+		"import-tenant": func(tenant string) error {
+			return importTenant(context.Background(), cfg, defaultClient, clients, tenant, rulesFile, nil, io.Discard)
+		},
+	}
+
+	for name, command := range commands {
+		t.Run(name, func(t *testing.T) {
+			authorization = ""
+			assert.NoError(t, command("tenant1"))
+			assert.Equal(t, "Bearer token-team-a", authorization)
+
+			// The other tenants use the default client.
+			authorization = ""
+			assert.NoError(t, command("tenant2"))
+			assert.Empty(t, authorization)
+		})
+	}
+}
+
+func TestDiffRules(t *testing.T) {
+	const upstream = "groups:\n- name: test\n  rules:\n  - alert: TestAlert\n    expr: vector(1)\n"
+
+	m, err := merge.New(nil, merge.Config{DuplicateAlerts: merge.DuplicateAlertsWarn}, nil, nil)
+	assert.NoError(t, err)
+	merged, err := m.Merge(context.Background(), []byte(upstream), "tenant1")
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		file           string
+		noFile         bool
+		tenantsFile    bool
+		tenantDir      string
+		responseStatus int
+
+		expectErr   bool
+		expectClass string
+		expectDrift bool
+		expectDiff  []string
+	}{
+		"in sync": {
+			file:           string(merged),
+			responseStatus: http.StatusOK,
+		},
+		"drift": {
+			file:           strings.Replace(string(merged), "vector(1)", "vector(2)", 1),
+			responseStatus: http.StatusOK,
+			expectDrift:    true,
+			expectDiff:     []string{"+++ upstream\n", "-          expr: vector(2)\n", "+          expr: vector(1)\n"},
+		},
+		"missing file": {
+			noFile:         true,
+			responseStatus: http.StatusOK,
+			expectDrift:    true,
+			expectDiff:     []string{"+++ upstream\n", "@@ -0,0 +1,5 @@\n", "+          expr: vector(1)\n"},
+		},
+		"tenants file prefixes the groups": {
+			file:           string(merged),
+			tenantsFile:    true,
+			responseStatus: http.StatusOK,
+			expectDrift:    true,
+			expectDiff:     []string{"-    - name: test\n", "+    - name: tenant1.test\n"},
+		},
+		"upstream error fails": {
+			file:           string(merged),
+			responseStatus: http.StatusInternalServerError,
+			expectErr:      true,
+			expectClass:    syncer.ErrorFetch,
+		},
+		"tenant dir output fails": {
+			tenantDir:   "rules",
+			expectErr:   true,
+			expectClass: syncer.ErrorConfig,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/metrics/v1/tenant1/api/v1/rules/raw", r.URL.Path)
+				w.WriteHeader(tc.responseStatus)
+				_, _ = w.Write([]byte(upstream))
+			}))
+			defer server.Close()
+
+			cfg := &config{observatoriumURL: server.URL, tenant: "tenant1", file: filepath.Join(t.TempDir(), "rules.yaml")}
+			cfg.output.tenantDir = tc.tenantDir
+			if tc.tenantsFile {
+				cfg.tenant, cfg.tenantsFile, cfg.tenantsFormat = "", filepath.Join(t.TempDir(), "tenants"), tenantsFormatLines
+				assert.NoError(t, os.WriteFile(cfg.tenantsFile, []byte("tenant1\n"), 0o600))
+			}
+			if !tc.noFile {
+				assert.NoError(t, os.WriteFile(cfg.file, []byte(tc.file), 0o600))
+			}
+
+			var out bytes.Buffer
+			r := prometheus.NewRegistry()
+			auth := newUpstreamAuth(cfg, newStartup(r, 0), http.DefaultTransport, newRoundTripperInstrumenter(r), r)
+			clients := newTenantClients(context.Background(), auth, http.DefaultTransport, server.Client())
+
+			drift, err := diffRules(context.Background(), cfg, server.Client(), clients, m, &out)
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.Equal(t, tc.expectClass, syncer.ErrorClass(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectDrift, drift)
+			if !tc.expectDrift {
+				assert.Empty(t, out.String())
+			}
+			for _, line := range tc.expectDiff {
+				assert.Contains(t, out.String(), line)
+			}
+		})
+	}
+}
@@ -0,0 +1,416 @@
+// Package compat checks that rules only use the fields supported by the version of the ruler reading them.
+package compat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/reload"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// Policies of handling the fields unsupported by the ruler.
+const (
+	// PolicyReject fails the sync, so that the ruler keeps its rules instead of failing to reload.
+	PolicyReject = "reject"
+	// PolicyStrip removes the fields from the rules.
+	PolicyStrip = "strip"
+	// PolicyDowngrade rewrites the rules to get the behavior of the fields without them where possible,
+	// e.g. query_offset into offset modifiers of the selectors of expressions, and strips them otherwise.
+	PolicyDowngrade = "downgrade"
+)
+
+// Version is a Thanos version.
+type Version struct {
+	Major, Minor, Patch int
+}
+
+// ParseVersion parses a version like v0.34.1 or 0.35.0-rc.0. Pre-release and build suffixes are ignored.
+func ParseVersion(s string) (Version, error) {
+	core, _, _ := strings.Cut(strings.TrimPrefix(s, "v"), "-")
+	core, _, _ = strings.Cut(core, "+")
+
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+
+	var v [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q", s)
+		}
+		v[i] = n
+	}
+
+	return Version{Major: v[0], Minor: v[1], Patch: v[2]}, nil
+}
+
+// Less returns whether v is older than o.
+func (v Version) Less(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// VersionSource returns the version of the ruler.
+type VersionSource func(ctx context.Context) (Version, error)
+
+// StaticVersion returns a VersionSource always returning the given version.
+func StaticVersion(v Version) VersionSource {
+	return func(context.Context) (Version, error) {
+		return v, nil
+	}
+}
+
+// NewBuildInfoVersionSource returns a VersionSource detecting the version of the Thanos Ruler at the given URL
+// from its /api/v1/status/buildinfo endpoint. The URL can be a unix:// one, see reload.NewThanosRule.
+func NewBuildInfoVersionSource(url string, client *http.Client) VersionSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if _, ok := reload.UnixSocketPath(url); ok {
+		url = "http://localhost"
+	}
+
+	return func(ctx context.Context) (Version, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/v1/status/buildinfo", nil)
+		if err != nil {
+			return Version{}, fmt.Errorf("failed to create request: %w", err)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return Version{}, fmt.Errorf("failed to do http request: %w", err)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode/100 != 2 {
+			return Version{}, fmt.Errorf("got unexpected status from Thanos Ruler: %d", res.StatusCode)
+		}
+
+		var buildInfo struct {
+			Data struct {
+				Version string `json:"version"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&buildInfo); err != nil {
+			return Version{}, fmt.Errorf("failed to decode build info: %w", err)
+		}
+
+		return ParseVersion(buildInfo.Data.Version)
+	}
+}
+
+// feature is a field of rules supported from a version of Thanos Ruler on.
+type feature struct {
+	field      string
+	minVersion Version
+	// used returns whether the group uses the field, and strip removes it from the group.
+	used  func(g *rules.RuleGroup) bool
+	strip func(g *rules.RuleGroup)
+	// downgrade rewrites the group to get the behavior of the field without it. If nil, the field is stripped.
+	downgrade func(g *rules.RuleGroup) error
+}
+
+var features = []feature{
+	{
+		field:      "limit",
+		minVersion: Version{0, 24, 0},
+		used:       func(g *rules.RuleGroup) bool { return g.Limit != 0 },
+		strip:      func(g *rules.RuleGroup) { g.Limit = 0 },
+	},
+	{
+		field:      "keep_firing_for",
+		minVersion: Version{0, 32, 0},
+		used: func(g *rules.RuleGroup) bool {
+			for _, r := range g.Rules {
+				if r.KeepFiringFor != 0 {
+					return true
+				}
+			}
+			return false
+		},
+		strip: func(g *rules.RuleGroup) {
+			for i := range g.Rules {
+				g.Rules[i].KeepFiringFor = 0
+			}
+		},
+	},
+	{
+		field:      "query_offset",
+		minVersion: Version{0, 36, 0},
+		used:       func(g *rules.RuleGroup) bool { return g.QueryOffset != nil },
+		strip:      func(g *rules.RuleGroup) { g.QueryOffset = nil },
+		downgrade:  downgradeQueryOffset,
+	},
+}
+
+// downgradeQueryOffset adds the query offset of the group to the offset of the selectors of its expressions.
+func downgradeQueryOffset(g *rules.RuleGroup) error {
+	offset := time.Duration(*g.QueryOffset)
+	for i, r := range g.Rules {
+		expr, err := parser.ParseExpr(r.Expr.Value)
+		if err != nil {
+			return fmt.Errorf("failed to parse expression: %w", err)
+		}
+
+		parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+			for _, p := range path {
+				// Selectors in subqueries are evaluated relative to the subquery, whose own offset is shifted.
+				if _, ok := p.(*parser.SubqueryExpr); ok {
+					return nil
+				}
+			}
+
+			switch n := node.(type) {
+			case *parser.VectorSelector:
+				// Selectors with @ are evaluated at a fixed time, regardless of the evaluation time.
+				if n.Timestamp == nil && n.StartOrEnd == 0 {
+					n.OriginalOffset += offset
+				}
+			case *parser.SubqueryExpr:
+				if n.Timestamp == nil && n.StartOrEnd == 0 {
+					n.OriginalOffset += offset
+				}
+			}
+			return nil
+		})
+
+		g.Rules[i].Expr.Value = expr.String()
+	}
+
+	g.QueryOffset = nil
+	return nil
+}
+
+// Config configures a Checker.
+type Config struct {
+	// Policy handles the unsupported fields without a policy in FieldPolicies.
+	Policy string
+	// FieldPolicies are the policies of unsupported fields by field name.
+	FieldPolicies map[string]string
+}
+
+// Checker checks that rules only use the fields supported by the version of the ruler.
+type Checker struct {
+	version       VersionSource
+	policy        string
+	fieldPolicies map[string]string
+
+	// lastVersion is the version last returned by the source, used when it fails.
+	lastVersion   *Version
+	lastVersionMu sync.Mutex
+
+	transformations *prometheus.CounterVec
+}
+
+// New creates a new Checker handling unsupported fields according to the policies of the config.
+func New(r prometheus.Registerer, version VersionSource, cfg Config) (*Checker, error) {
+	if err := validatePolicy(cfg.Policy); err != nil {
+		return nil, err
+	}
+
+	for field, policy := range cfg.FieldPolicies {
+		if !slices.ContainsFunc(features, func(f feature) bool { return f.field == field }) {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		if err := validatePolicy(policy); err != nil {
+			return nil, fmt.Errorf("field %s: %w", field, err)
+		}
+	}
+
+	c := &Checker{
+		version:       version,
+		policy:        cfg.Policy,
+		fieldPolicies: cfg.FieldPolicies,
+		transformations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_compat_transformations_total",
+			Help: "Total number of rule groups using fields unsupported by the ruler, by field and policy applied.",
+		}, []string{"field", "policy"}),
+	}
+
+	if r != nil {
+		r.MustRegister(c.transformations)
+	}
+
+	return c, nil
+}
+
+func validatePolicy(policy string) error {
+	switch policy {
+	case PolicyReject, PolicyStrip, PolicyDowngrade:
+		return nil
+	default:
+		return fmt.Errorf("unknown unsupported fields policy %q", policy)
+	}
+}
+
+// Fetcher returns a Fetcher checking the rules fetched by next.
+func (c *Checker) Fetcher(next fetch.Fetcher) fetch.Fetcher {
+	return fetch.FetcherFunc(func(ctx context.Context) (io.ReadCloser, error) {
+		fetched, err := next.GetRules(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer fetched.Close()
+
+		content, err := io.ReadAll(fetched)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rules: %w", err)
+		}
+
+		checked, err := c.Check(ctx, content)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.NopCloser(bytes.NewReader(checked)), nil
+	})
+}
+
+// Check checks the fields used by the rules against the version of the ruler, and handles the unsupported ones
+// according to their policies. Rules are returned unchanged if no version of the ruler is known.
+func (c *Checker) Check(ctx context.Context, content []byte) ([]byte, error) {
+	version, ok := c.rulerVersion(ctx)
+	if !ok {
+		return content, nil
+	}
+
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	var unsupported []string
+	for i := range groups.Groups {
+		group := &groups.Groups[i]
+		for _, f := range features {
+			if !version.Less(f.minVersion) || !f.used(group) {
+				continue
+			}
+
+			policy := c.fieldPolicy(f.field)
+			c.transformations.WithLabelValues(f.field, policy).Inc()
+
+			msg := fmt.Sprintf("group %q: field %s requires Thanos Ruler %s, but it runs %s", group.Name, f.field, f.minVersion, version)
+			switch {
+			case policy == PolicyReject:
+				unsupported = append(unsupported, msg)
+			case policy == PolicyDowngrade && f.downgrade != nil:
+				if err := f.downgrade(group); err != nil {
+					return nil, fmt.Errorf("group %q: failed to downgrade field %s: %w", group.Name, f.field, err)
+				}
+				log.Printf("%s, downgraded it", msg)
+			default:
+				f.strip(group)
+				log.Printf("%s, stripped it", msg)
+			}
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return nil, fmt.Errorf("rules use fields unsupported by the ruler: %s", strings.Join(unsupported, "; "))
+	}
+
+	checked, err := yaml.Marshal(groups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	return checked, nil
+}
+
+// Validate checks the fields used by the rules against the version of the ruler like Check, without changing nor counting
+// them, e.g. to give feedback on the rules of a tenant before they are synced. It returns a warning for each field that
+// would be stripped or downgraded, and an error if fields would be rejected. Rules are valid if no version of the ruler is known.
+func (c *Checker) Validate(ctx context.Context, content []byte) ([]string, error) {
+	version, ok := c.rulerVersion(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	var warnings, unsupported []string
+	for i := range groups.Groups {
+		group := &groups.Groups[i]
+		for _, f := range features {
+			if !version.Less(f.minVersion) || !f.used(group) {
+				continue
+			}
+
+			msg := fmt.Sprintf("group %q: field %s requires Thanos Ruler %s, but it runs %s", group.Name, f.field, f.minVersion, version)
+			switch policy := c.fieldPolicy(f.field); {
+			case policy == PolicyReject:
+				unsupported = append(unsupported, msg)
+			case policy == PolicyDowngrade && f.downgrade != nil:
+				warnings = append(warnings, msg+", it will be downgraded")
+			default:
+				warnings = append(warnings, msg+", it will be stripped")
+			}
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return warnings, fmt.Errorf("rules use fields unsupported by the ruler: %s", strings.Join(unsupported, "; "))
+	}
+
+	return warnings, nil
+}
+
+// fieldPolicy returns the policy applied to the field when it is unsupported.
+func (c *Checker) fieldPolicy(field string) string {
+	if p, ok := c.fieldPolicies[field]; ok {
+		return p
+	}
+
+	return c.policy
+}
+
+// rulerVersion returns the version of the ruler, or the last known one if it can't be got.
+// It returns false if no version is known, in which case rules are not checked.
+func (c *Checker) rulerVersion(ctx context.Context) (Version, bool) {
+	c.lastVersionMu.Lock()
+	defer c.lastVersionMu.Unlock()
+
+	version, err := c.version(ctx)
+	if err == nil {
+		c.lastVersion = &version
+		return version, true
+	}
+
+	if c.lastVersion == nil {
+		log.Printf("failed to get the version of the ruler, not checking rules: %v", err)
+		return Version{}, false
+	}
+
+	log.Printf("failed to get the version of the ruler, using the last known %s: %v", c.lastVersion, err)
+	return *c.lastVersion, true
+}
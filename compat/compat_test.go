@@ -0,0 +1,257 @@
+package compat
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersion(t *testing.T) {
+	testCases := map[string]struct {
+		version       string
+		expectVersion Version
+		expectErr     bool
+	}{
+		"with prefix": {
+			version:       "v0.34.1",
+			expectVersion: Version{0, 34, 1},
+		},
+		"without prefix": {
+			version:       "0.32.0",
+			expectVersion: Version{0, 32, 0},
+		},
+		"pre-release": {
+			version:       "0.36.0-rc.0",
+			expectVersion: Version{0, 36, 0},
+		},
+		"missing patch": {
+			version:   "0.34",
+			expectErr: true,
+		},
+		"not a number": {
+			version:   "0.x.1",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			v, err := ParseVersion(tc.version)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectVersion, v)
+		})
+	}
+}
+
+const newFieldsRules = `groups:
+    - name: tenant-a.test
+      rules:
+        - alert: Test
+          expr: vector(1)
+          keep_firing_for: 5m
+      query_offset: 1m
+`
+
+func TestCheckerCheck(t *testing.T) {
+	testCases := map[string]struct {
+		version       Version
+		policy        string
+		fieldPolicies map[string]string
+
+		expectErr      bool
+		expectContains []string
+		expectMissing  []string
+	}{
+		"supported fields are kept": {
+			version:        Version{0, 36, 0},
+			policy:         PolicyReject,
+			expectContains: []string{"keep_firing_for: 5m", "query_offset: 1m"},
+		},
+		"unsupported fields are rejected": {
+			version:   Version{0, 34, 1},
+			policy:    PolicyReject,
+			expectErr: true,
+		},
+		"unsupported fields are stripped": {
+			version:        Version{0, 34, 1},
+			policy:         PolicyStrip,
+			expectContains: []string{"keep_firing_for: 5m"},
+			expectMissing:  []string{"query_offset"},
+		},
+		"unsupported fields are downgraded": {
+			version:        Version{0, 34, 1},
+			policy:         PolicyDowngrade,
+			expectContains: []string{"expr: vector(1)", "keep_firing_for: 5m"},
+			expectMissing:  []string{"query_offset"},
+		},
+		"field policies override the policy": {
+			version:        Version{0, 31, 0},
+			policy:         PolicyReject,
+			fieldPolicies:  map[string]string{"keep_firing_for": PolicyStrip, "query_offset": PolicyStrip},
+			expectMissing:  []string{"keep_firing_for", "query_offset"},
+			expectContains: []string{"alert: Test"},
+		},
+		"all unsupported fields are stripped": {
+			version:       Version{0, 31, 0},
+			policy:        PolicyStrip,
+			expectMissing: []string{"keep_firing_for", "query_offset"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			c, err := New(registry, StaticVersion(tc.version), Config{Policy: tc.policy, FieldPolicies: tc.fieldPolicies})
+			assert.NoError(t, err)
+
+			checked, err := c.Check(context.Background(), []byte(newFieldsRules))
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			for _, s := range tc.expectContains {
+				assert.Contains(t, string(checked), s)
+			}
+			for _, s := range tc.expectMissing {
+				assert.NotContains(t, string(checked), s)
+			}
+		})
+	}
+}
+
+func TestCheckerValidate(t *testing.T) {
+	testCases := map[string]struct {
+		version       Version
+		policy        string
+		fieldPolicies map[string]string
+
+		expectErr      string
+		expectWarnings []string
+	}{
+		"supported fields": {
+			version: Version{0, 36, 0},
+			policy:  PolicyReject,
+		},
+		"unsupported fields are rejected": {
+			version:   Version{0, 34, 1},
+			policy:    PolicyReject,
+			expectErr: `group "tenant-a.test": field query_offset requires Thanos Ruler v0.36.0, but it runs v0.34.1`,
+		},
+		"unsupported fields are stripped and downgraded": {
+			version:       Version{0, 31, 0},
+			policy:        PolicyStrip,
+			fieldPolicies: map[string]string{"query_offset": PolicyDowngrade},
+			expectWarnings: []string{
+				`group "tenant-a.test": field keep_firing_for requires Thanos Ruler v0.32.0, but it runs v0.31.0, it will be stripped`,
+				`group "tenant-a.test": field query_offset requires Thanos Ruler v0.36.0, but it runs v0.31.0, it will be downgraded`,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c, err := New(nil, StaticVersion(tc.version), Config{Policy: tc.policy, FieldPolicies: tc.fieldPolicies})
+			assert.NoError(t, err)
+
+			warnings, err := c.Validate(context.Background(), []byte(newFieldsRules))
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectWarnings, warnings)
+
+			// Validations are not counted.
+			assert.Equal(t, 0, testutil.CollectAndCount(c.transformations))
+		})
+	}
+}
+
+func TestCheckerUnknownVersion(t *testing.T) {
+	var failing bool
+	c, err := New(nil, func(context.Context) (Version, error) {
+		if failing {
+			return Version{}, errors.New("unreachable")
+		}
+		return Version{0, 31, 0}, nil
+	}, Config{Policy: PolicyReject})
+	assert.NoError(t, err)
+
+	// The last known version is used when the version can't be got.
+	_, err = c.Check(context.Background(), []byte(newFieldsRules))
+	assert.Error(t, err)
+	failing = true
+	_, err = c.Check(context.Background(), []byte(newFieldsRules))
+	assert.Error(t, err)
+
+	// Rules are not checked if no version is known.
+	c.lastVersion = nil
+	checked, err := c.Check(context.Background(), []byte(newFieldsRules))
+	assert.NoError(t, err)
+	assert.Equal(t, newFieldsRules, string(checked))
+}
+
+func TestBuildInfoVersionSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/status/buildinfo", r.URL.Path)
+		_, _ = w.Write([]byte(`{"status":"success","data":{"version":"0.34.1","revision":"abc","branch":"HEAD"}}`))
+	}))
+	defer server.Close()
+
+	v, err := NewBuildInfoVersionSource(server.URL, server.Client())(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, Version{0, 34, 1}, v)
+}
+
+func TestDowngradeQueryOffset(t *testing.T) {
+	testCases := map[string]struct {
+		expr       string
+		expectExpr string
+	}{
+		"selectors are offset": {
+			expr:       `sum(rate(http_requests_total{job="a"}[5m])) / sum(rate(http_requests_total[5m] offset 1m))`,
+			expectExpr: `sum(rate(http_requests_total{job="a"}[5m] offset 2m)) / sum(rate(http_requests_total[5m] offset 3m))`,
+		},
+		"subqueries are offset, not their selectors": {
+			expr:       `max_over_time(rate(up[1m])[10m:1m])`,
+			expectExpr: `max_over_time(rate(up[1m])[10m:1m] offset 2m)`,
+		},
+		"selectors with @ are kept": {
+			expr:       `up @ 1609746000`,
+			expectExpr: `up @ 1609746000.000`,
+		},
+		"literals are kept": {
+			expr:       `vector(1)`,
+			expectExpr: `vector(1)`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			offset := model.Duration(2 * time.Minute)
+			group := &rules.RuleGroup{QueryOffset: &offset}
+			group.Rules = make([]rulefmt.RuleNode, 1)
+			group.Rules[0].Expr.SetString(tc.expr)
+
+			assert.NoError(t, downgradeQueryOffset(group))
+			assert.Equal(t, tc.expectExpr, group.Rules[0].Expr.Value)
+			assert.Nil(t, group.QueryOffset)
+		})
+	}
+}
@@ -0,0 +1,362 @@
+// Package config configures the sync pipeline for programs embedding it, with the same defaults and validation
+// as the command line flags of thanos-rule-syncer.
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/compat"
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/output"
+	"github.com/observatorium/thanos-rule-syncer/reload"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+)
+
+// Defaults of the options, which are also the defaults of the command line flags.
+const (
+	DefaultFile                 = "rules.yaml"
+	DefaultInterval             = 60 * time.Second
+	DefaultOverlapPolicy        = syncer.OverlapQueue
+	DefaultUnsupportedFields    = compat.PolicyStrip
+	DefaultDuplicateAlerts      = merge.DuplicateAlertsWarn
+	DefaultDuplicateAlertsLabel = "tenant"
+	DefaultSkipUnchanged        = true
+)
+
+// Options configures the sync pipeline. Fields are ordered as suggested by fieldalignment, so that the struct
+// stays small and quick to scan for the garbage collector.
+type Options struct {
+	// FieldPolicies overrides UnsupportedFields per field, e.g. keep_firing_for=reject.
+	FieldPolicies map[string]string
+	// RulesBackendURL is the URL of the rules-objstore. Exclusive with ObservatoriumAPIURL.
+	RulesBackendURL string
+	// ObservatoriumAPIURL is the URL of the Observatorium API. Exclusive with RulesBackendURL.
+	ObservatoriumAPIURL string
+	// ThanosRuleURL is the URL of the Thanos Ruler reloaded after the rules are written. Required.
+	ThanosRuleURL string
+	// ThanosVersion is the version of Thanos Ruler the rules are checked against. If empty, it is detected.
+	ThanosVersion string
+	// UnsupportedFields is the policy for the fields of rules unsupported by the version of Thanos Ruler.
+	UnsupportedFields string
+	// File is the path the rules are written to.
+	File string
+	// Schedule is a cron expression at whose times rules are synced instead of at every Interval, if not empty.
+	Schedule string
+	// OverlapPolicy is what happens to sync cycles due while a cycle is in progress.
+	OverlapPolicy string
+	// Tenants are the tenants whose rules are fetched from the rules backend. If empty, the rules of all tenants are.
+	// With the Observatorium API, it must be a single tenant.
+	Tenants []string
+	// Merge configures the post-processing of the rules of tenants.
+	Merge merge.Config
+	// Timeouts limit the phases of sync cycles.
+	Timeouts syncer.Timeouts
+	// Interval is the interval at which rules are synced.
+	Interval time.Duration
+	// FetchConcurrency is the number of tenants whose rules are fetched concurrently. If 0, it is fetch.DefaultConcurrency.
+	FetchConcurrency int
+	// Watch only fetches the rules of tenants that changed, see fetch.WithWatch.
+	Watch bool
+	// BatchSize is the number of tenants whose rules are fetched in one request, see fetch.WithBatchSize.
+	BatchSize int
+	// SkipUnchanged skips writing the rules and reloading the ruler when they are unchanged, see syncer.WithSkipUnchanged.
+	SkipUnchanged bool
+}
+
+// Option sets options.
+type Option func(*Options)
+
+// WithRulesBackend fetches the rules of the given tenants, or of all tenants if none, from the rules-objstore.
+func WithRulesBackend(url string, tenants ...string) Option {
+	return func(o *Options) {
+		o.RulesBackendURL = url
+		o.Tenants = tenants
+	}
+}
+
+// WithObservatoriumAPI fetches the rules of the tenant from the Observatorium API.
+func WithObservatoriumAPI(url, tenant string) Option {
+	return func(o *Options) {
+		o.ObservatoriumAPIURL = url
+		o.Tenants = []string{tenant}
+	}
+}
+
+// WithThanosRule reloads the Thanos Ruler at the given URL, of the given version. If version is empty, it is detected.
+func WithThanosRule(url, version string) Option {
+	return func(o *Options) {
+		o.ThanosRuleURL = url
+		o.ThanosVersion = version
+	}
+}
+
+// WithFile writes the rules to the file at the given path.
+func WithFile(path string) Option {
+	return func(o *Options) {
+		o.File = path
+	}
+}
+
+// WithInterval syncs rules at the given interval.
+func WithInterval(interval time.Duration) Option {
+	return func(o *Options) {
+		o.Interval = interval
+	}
+}
+
+// WithSchedule syncs rules at the times of the cron expression instead of at every interval.
+func WithSchedule(schedule string) Option {
+	return func(o *Options) {
+		o.Schedule = schedule
+	}
+}
+
+// WithOverlapPolicy sets what happens to sync cycles due while a cycle is in progress.
+// One of syncer.OverlapSkip or syncer.OverlapQueue.
+func WithOverlapPolicy(policy string) Option {
+	return func(o *Options) {
+		o.OverlapPolicy = policy
+	}
+}
+
+// WithTimeouts limits the phases of sync cycles.
+func WithTimeouts(timeouts syncer.Timeouts) Option {
+	return func(o *Options) {
+		o.Timeouts = timeouts
+	}
+}
+
+// WithFetchConcurrency sets the number of tenants whose rules are fetched concurrently from the rules backend.
+func WithFetchConcurrency(concurrency int) Option {
+	return func(o *Options) {
+		o.FetchConcurrency = concurrency
+	}
+}
+
+// WithWatch only fetches the rules of tenants that changed according to the change feed of the rules backend.
+func WithWatch(watch bool) Option {
+	return func(o *Options) {
+		o.Watch = watch
+	}
+}
+
+// WithBatchSize fetches the rules of up to size tenants in one request to the batch endpoint of the rules backend.
+func WithBatchSize(size int) Option {
+	return func(o *Options) {
+		o.BatchSize = size
+	}
+}
+
+// WithSkipUnchanged skips writing the rules and reloading the ruler when the rules are unchanged since the ruler was
+// last reloaded with them, if skip is true.
+func WithSkipUnchanged(skip bool) Option {
+	return func(o *Options) {
+		o.SkipUnchanged = skip
+	}
+}
+
+// WithMerge configures the post-processing of the rules of tenants.
+func WithMerge(cfg merge.Config) Option {
+	return func(o *Options) {
+		o.Merge = cfg
+	}
+}
+
+// WithUnsupportedFields sets the policy for the fields of rules unsupported by the version of Thanos Ruler,
+// and its overrides per field.
+func WithUnsupportedFields(policy string, fieldPolicies map[string]string) Option {
+	return func(o *Options) {
+		o.UnsupportedFields = policy
+		o.FieldPolicies = fieldPolicies
+	}
+}
+
+// Default returns the options with the defaults of the command line flags.
+func Default() Options {
+	return Options{
+		File:              DefaultFile,
+		Interval:          DefaultInterval,
+		OverlapPolicy:     DefaultOverlapPolicy,
+		UnsupportedFields: DefaultUnsupportedFields,
+		SkipUnchanged:     DefaultSkipUnchanged,
+		Merge: merge.Config{
+			DuplicateAlerts:      DefaultDuplicateAlerts,
+			DuplicateAlertsLabel: DefaultDuplicateAlertsLabel,
+		},
+	}
+}
+
+// New returns the default options with the given options applied, or an error if they are invalid.
+func New(opts ...Option) (*Options, error) {
+	o := Default()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// Validate returns an error if the options are invalid.
+func (o *Options) Validate() error {
+	switch {
+	case o.RulesBackendURL != "" && o.ObservatoriumAPIURL != "":
+		return fmt.Errorf("only one of the rules backend and the Observatorium API can be used")
+	case o.RulesBackendURL == "" && o.ObservatoriumAPIURL == "":
+		return fmt.Errorf("either the rules backend or the Observatorium API must be used")
+	case o.ObservatoriumAPIURL != "" && len(o.Tenants) != 1:
+		return fmt.Errorf("a single tenant must be specified when using the Observatorium API")
+	case o.ThanosRuleURL == "":
+		return fmt.Errorf("the URL of Thanos Ruler must be specified")
+	case o.File == "":
+		return fmt.Errorf("the rules file must be specified")
+	case o.Interval <= 0:
+		return fmt.Errorf("the sync interval must be positive")
+	case o.OverlapPolicy != syncer.OverlapSkip && o.OverlapPolicy != syncer.OverlapQueue:
+		return fmt.Errorf("unknown sync overlap policy %q, must be one of: skip, queue", o.OverlapPolicy)
+	}
+
+	if o.Schedule != "" {
+		if _, err := cron.ParseStandard(o.Schedule); err != nil {
+			return fmt.Errorf("failed to parse sync schedule: %w", err)
+		}
+	}
+
+	if o.ThanosVersion != "" {
+		if _, err := compat.ParseVersion(o.ThanosVersion); err != nil {
+			return fmt.Errorf("failed to parse Thanos version: %w", err)
+		}
+	}
+
+	// The merger and the checker validate their configuration when created.
+	if _, err := merge.New(nil, o.Merge, nil, nil); err != nil {
+		return fmt.Errorf("invalid merge options: %w", err)
+	}
+	if _, err := o.checker(nil, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Syncer creates the syncer of the pipeline configured by the options. The client is used to fetch the rules
+// and to reload the ruler, and the metrics of the pipeline are registered with r if not nil.
+func (o *Options) Syncer(client *http.Client, r prometheus.Registerer) (*syncer.Syncer, error) {
+	return o.SyncerWithClients(client, client, r)
+}
+
+// SyncerWithClients creates the syncer of the pipeline configured by the options like Syncer, fetching the rules
+// with fetchClient and reloading the ruler with reloadClient, e.g. so that the credentials of the rules source
+// aren't sent to the ruler.
+func (o *Options) SyncerWithClients(fetchClient, reloadClient *http.Client, r prometheus.Registerer) (*syncer.Syncer, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	f, mergeTenant, err := o.fetcher(fetchClient, r)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := merge.New(r, o.Merge, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure rules merging: %w", err)
+	}
+
+	checker, err := o.checker(reloadClient, r)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []syncer.Option{
+		syncer.WithInterval(o.Interval),
+		syncer.WithOverlapPolicy(o.OverlapPolicy),
+		syncer.WithTimeouts(o.Timeouts),
+		syncer.WithProcessors(func(ctx context.Context, rules []byte) ([]byte, error) {
+			return m.Merge(ctx, rules, mergeTenant)
+		}, checker.Check),
+	}
+	if o.SkipUnchanged {
+		opts = append(opts, syncer.WithSkipUnchanged())
+	}
+	if o.Schedule != "" {
+		schedule, err := cron.ParseStandard(o.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sync schedule: %w", err)
+		}
+		opts = append(opts, syncer.WithSchedule(schedule))
+	}
+
+	fileOpts := []output.FileOption{}
+	if r != nil {
+		opts = append(opts, syncer.WithRegisterer(r))
+		fileOpts = append(fileOpts, output.WithRegisterer(r))
+	}
+
+	reloader := reload.NewThanosRule(o.ThanosRuleURL, reloadClient, reload.WithMetrics(reload.NewMetrics(r)))
+
+	return syncer.New(f, output.NewFile(o.File, fileOpts...), reloader, opts...), nil
+}
+
+// fetcher returns the fetcher of the rules, and the tenant owning all of them if they are not prefixed with tenants.
+func (o *Options) fetcher(client *http.Client, r prometheus.Registerer) (fetch.Fetcher, string, error) {
+	if o.ObservatoriumAPIURL != "" {
+		f, err := fetch.NewObservatoriumAPIFetcher(o.ObservatoriumAPIURL, o.Tenants[0], client)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to initialize Observatorium API fetcher: %w", err)
+		}
+
+		return f, o.Tenants[0], nil
+	}
+
+	opts := []fetch.RulesObjstoreFetcherOption{
+		fetch.WithConcurrency(o.FetchConcurrency),
+		fetch.WithWatch(o.Watch),
+		fetch.WithBatchSize(o.BatchSize),
+	}
+	if r != nil {
+		opts = append(opts, fetch.WithRegisterer(r))
+	}
+
+	rof, err := fetch.NewRulesObjstoreFetcher(o.RulesBackendURL, o.Tenants, client, opts...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to initialize Rules Object Store fetcher: %w", err)
+	}
+
+	if len(o.Tenants) == 0 {
+		return fetch.FetcherFunc(rof.GetAllRules), "", nil
+	}
+
+	return fetch.FetcherFunc(rof.GetTenantsRules), "", nil
+}
+
+// checker returns the checker of the rules against the version of Thanos Ruler.
+func (o *Options) checker(client *http.Client, r prometheus.Registerer) (*compat.Checker, error) {
+	versionSource := compat.NewBuildInfoVersionSource(o.ThanosRuleURL, client)
+	if o.ThanosVersion != "" {
+		version, err := compat.ParseVersion(o.ThanosVersion)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse Thanos version: %w", err)
+		}
+		versionSource = compat.StaticVersion(version)
+	}
+
+	checker, err := compat.New(r, versionSource, compat.Config{
+		Policy:        o.UnsupportedFields,
+		FieldPolicies: o.FieldPolicies,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure rules compatibility checks: %w", err)
+	}
+
+	return checker, nil
+}
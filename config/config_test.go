@@ -0,0 +1,152 @@
+package config
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	testCases := map[string]struct {
+		opts []Option
+
+		expectErr bool
+	}{
+		"rules backend": {
+			opts: []Option{WithRulesBackend("http://rules-objstore", "tenant-a", "tenant-b"), WithThanosRule("http://thanos-rule", "")},
+		},
+		"rules backend of all tenants": {
+			opts: []Option{WithRulesBackend("http://rules-objstore"), WithThanosRule("http://thanos-rule", "0.32.0"), WithWatch(true)},
+		},
+		"observatorium API": {
+			opts: []Option{WithObservatoriumAPI("http://observatorium", "tenant-a"), WithThanosRule("http://thanos-rule", "")},
+		},
+		"schedule": {
+			opts: []Option{WithRulesBackend("http://rules-objstore"), WithThanosRule("http://thanos-rule", ""), WithSchedule("*/5 * * * *"), WithOverlapPolicy(syncer.OverlapSkip)},
+		},
+		"no source": {
+			opts:      []Option{WithThanosRule("http://thanos-rule", "")},
+			expectErr: true,
+		},
+		"both sources": {
+			opts:      []Option{WithRulesBackend("http://rules-objstore"), WithObservatoriumAPI("http://observatorium", "tenant-a"), WithThanosRule("http://thanos-rule", "")},
+			expectErr: true,
+		},
+		"no ruler": {
+			opts:      []Option{WithRulesBackend("http://rules-objstore")},
+			expectErr: true,
+		},
+		"no file": {
+			opts:      []Option{WithRulesBackend("http://rules-objstore"), WithThanosRule("http://thanos-rule", ""), WithFile("")},
+			expectErr: true,
+		},
+		"invalid interval": {
+			opts:      []Option{WithRulesBackend("http://rules-objstore"), WithThanosRule("http://thanos-rule", ""), WithInterval(0)},
+			expectErr: true,
+		},
+		"invalid schedule": {
+			opts:      []Option{WithRulesBackend("http://rules-objstore"), WithThanosRule("http://thanos-rule", ""), WithSchedule("every minute")},
+			expectErr: true,
+		},
+		"invalid overlap policy": {
+			opts:      []Option{WithRulesBackend("http://rules-objstore"), WithThanosRule("http://thanos-rule", ""), WithOverlapPolicy("wait")},
+			expectErr: true,
+		},
+		"invalid Thanos version": {
+			opts:      []Option{WithRulesBackend("http://rules-objstore"), WithThanosRule("http://thanos-rule", "latest")},
+			expectErr: true,
+		},
+		"invalid merge options": {
+			opts:      []Option{WithRulesBackend("http://rules-objstore"), WithThanosRule("http://thanos-rule", ""), WithMerge(merge.Config{DuplicateAlerts: "drop"})},
+			expectErr: true,
+		},
+		"invalid unsupported fields policy": {
+			opts:      []Option{WithRulesBackend("http://rules-objstore"), WithThanosRule("http://thanos-rule", ""), WithUnsupportedFields("drop", nil)},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			o, err := New(tc.opts...)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			s, err := o.Syncer(http.DefaultClient, prometheus.NewRegistry())
+			assert.NoError(t, err)
+			assert.NotNil(t, s)
+		})
+	}
+}
+
+func TestDefault(t *testing.T) {
+	o := Default()
+	o.RulesBackendURL = "http://rules-objstore"
+	o.ThanosRuleURL = "http://thanos-rule"
+
+	assert.NoError(t, o.Validate())
+	assert.Equal(t, DefaultFile, o.File)
+	assert.Equal(t, DefaultInterval, o.Interval)
+	assert.Equal(t, merge.DuplicateAlertsWarn, o.Merge.DuplicateAlerts)
+	assert.True(t, o.SkipUnchanged)
+}
+
+func TestSyncerSkipUnchanged(t *testing.T) {
+	testCases := map[string]struct {
+		skipUnchanged bool
+
+		expectReloads int
+	}{
+		"unchanged rules are skipped": {
+			skipUnchanged: true,
+			expectReloads: 1,
+		},
+		"unchanged rules are written and reloaded": {
+			expectReloads: 2,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var reloads atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/-/reload":
+					reloads.Add(1)
+				case "/api/v1/rules/tenant-a":
+					io.WriteString(w, "groups:\n- name: test\n  rules:\n  - record: a\n    expr: vector(1)\n")
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			o, err := New(
+				WithRulesBackend(server.URL, "tenant-a"),
+				WithThanosRule(server.URL, "0.32.0"),
+				WithFile(filepath.Join(t.TempDir(), "rules.yaml")),
+				WithSkipUnchanged(tc.skipUnchanged),
+			)
+			assert.NoError(t, err)
+			s, err := o.Syncer(server.Client(), nil)
+			assert.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				assert.NoError(t, s.Sync(context.Background()))
+			}
+			assert.Equal(t, int32(tc.expectReloads), reloads.Load())
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stdinFile is the path of the files read from the standard input, e.g. piped by an init container or a templating system.
+const stdinFile = "-"
+
+// stdin is the content of the standard input, read at most once as it can't be read again.
+var stdin struct {
+	once sync.Once
+	data []byte
+	err  error
+
+	// tenants is the tenants document of the configuration read from the standard input, if any.
+	// It is the tenants file when both -config and -tenants-file are read from the standard input.
+	tenants []byte
+	// split is whether the standard input holds the configuration, so that the tenants file is its tenants document.
+	split bool
+}
+
+// readStdin returns the content of the standard input, read on the first call.
+func readStdin() ([]byte, error) {
+	stdin.once.Do(func() {
+		stdin.data, stdin.err = io.ReadAll(os.Stdin)
+		if stdin.err != nil {
+			stdin.err = fmt.Errorf("failed to read standard input: %w", stdin.err)
+		}
+	})
+
+	return stdin.data, stdin.err
+}
+
+// readStdinTenants returns the tenants file read from the standard input: the tenants document of the configuration
+// if it is read from the standard input too, or the whole standard input otherwise.
+func readStdinTenants() ([]byte, error) {
+	data, err := readStdin()
+	if err != nil {
+		return nil, err
+	}
+
+	if !stdin.split {
+		return data, nil
+	}
+	if stdin.tenants == nil {
+		return nil, errors.New("the configuration read from standard input has no tenants document")
+	}
+
+	return stdin.tenants, nil
+}
+
+// loadConfigFile sets the flags of fs from a YAML configuration file, or from the standard input if the path is -.
+// The file is a stream of documents mapping flag names to their values, lists being joined with commas, e.g. as
+// rendered by several templates. Later documents override earlier ones, and flags set on the command line override
+// the file. When the tenants file is read from the standard input too, the document with a tenants key is the tenants file.
+// All the errors of the file are returned, joined, except after a syntax error ending the stream of documents.
+// It returns the pipelines listed under the pipelines key of the documents, see pipelineConfig.
+func loadConfigFile(fs *flag.FlagSet, path string) ([]pipelineConfig, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if path == stdinFile {
+		data, err = readStdin()
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// Flags set on the command line override the ones of the file.
+	setFlags := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	var (
+		tenants     []byte
+		tenantsLine int
+		pipelines   []pipelineConfig
+		// pipelineNames are the names of the pipelines of all documents, which must be unique.
+		pipelineNames = map[string]bool{}
+		// errs are all the errors of the file, so that they can be fixed at once rather than one restart at a time.
+		errs []error
+	)
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			// The documents after a syntax error can't be read.
+			errs = append(errs, fmt.Errorf("failed to unmarshal config file: %w", err))
+			return nil, errors.Join(errs...)
+		}
+
+		if len(doc.Content) == 0 || doc.Content[0].Tag == "!!null" {
+			continue
+		}
+		root := doc.Content[0]
+		if root.Kind != yaml.MappingNode {
+			errs = append(errs, fmt.Errorf("line %d: the config file must map flag names to their values", root.Line))
+			continue
+		}
+
+		if mappingValue(&doc, "tenants") != nil {
+			if tenants != nil {
+				errs = append(errs, fmt.Errorf("line %d: the config file has several tenants documents", root.Line))
+				continue
+			}
+			if tenants, err = yaml.Marshal(&doc); err != nil {
+				return nil, fmt.Errorf("failed to marshal tenants document: %w", err)
+			}
+			tenantsLine = root.Line
+			continue
+		}
+
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			key, value := root.Content[i], root.Content[i+1]
+			// The pipelines of the documents add up, e.g. rendered by a template each.
+			if key.Value == "pipelines" {
+				docPipelines, err := readPipelines(value)
+				if err != nil {
+					errs = append(errs, err)
+				}
+				for _, p := range docPipelines {
+					if pipelineNames[p.Name] {
+						errs = append(errs, fmt.Errorf("line %d: duplicate pipeline %s", value.Line, p.Name))
+						continue
+					}
+					pipelineNames[p.Name] = true
+					pipelines = append(pipelines, p)
+				}
+				continue
+			}
+			if key.Value == "config" || fs.Lookup(key.Value) == nil {
+				errs = append(errs, fmt.Errorf("line %d: unknown flag %q", key.Line, key.Value))
+				continue
+			}
+
+			v, err := configFlagValue(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("line %d: flag %s: %w", value.Line, key.Value, err))
+				continue
+			}
+			if setFlags[key.Value] {
+				continue
+			}
+			if err := fs.Set(key.Value, v); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: flag %s: %w", value.Line, key.Value, err))
+			}
+		}
+	}
+
+	// The tenants file can be set by the config file itself.
+	if tenantsFile := fs.Lookup("tenants-file"); path == stdinFile && tenantsFile != nil && tenantsFile.Value.String() == stdinFile {
+		// The flags are loaded before the tenants file is read, which doesn't need to synchronize.
+		stdin.split, stdin.tenants = true, tenants
+	} else if tenants != nil {
+		errs = append(errs, fmt.Errorf("line %d: tenants documents require -config=- and -tenants-file=-", tenantsLine))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return pipelines, nil
+}
+
+// configFlagValue returns the value of a flag given in the config file, as it would be given on the command line.
+func configFlagValue(value *yaml.Node) (string, error) {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		return value.Value, nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(value.Content))
+		for _, item := range value.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("lists must only hold scalar values")
+			}
+			values = append(values, item.Value)
+		}
+		return strings.Join(values, ","), nil
+	default:
+		return "", errors.New("the value must be a scalar or a list of scalars")
+	}
+}
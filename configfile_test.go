@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testFlagSet returns a flag set with a few flags of the syncer, parsed from args.
+func testFlagSet(t *testing.T, args ...string) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.String("tenants-file", "", "")
+	fs.String("thanos-rule-url", "", "")
+	fs.String("reload.extra-urls", "", "")
+	fs.Uint("interval", 60, "")
+	fs.Bool("fetch.watch", false, "")
+	assert.NoError(t, fs.Parse(args))
+
+	return fs
+}
+
+// setTestStdin makes the standard input read the given content, for the duration of the test.
+func setTestStdin(t *testing.T, content string) {
+	file := filepath.Join(t.TempDir(), "stdin")
+	assert.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	f, err := os.Open(file)
+	assert.NoError(t, err)
+
+	previous := os.Stdin
+	os.Stdin = f
+	resetStdin := func() {
+		stdin.once = sync.Once{}
+		stdin.data, stdin.err, stdin.tenants, stdin.split = nil, nil, nil, false
+	}
+	resetStdin()
+	t.Cleanup(func() {
+		os.Stdin = previous
+		f.Close()
+		resetStdin()
+	})
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	testCases := map[string]struct {
+		content string
+		args    []string
+
+		expectErr       string
+		expectFlags     map[string]string
+		expectPipelines []pipelineConfig
+	}{
+		"flags": {
+			content: "thanos-rule-url: http://thanos-rule:10902\ninterval: 30\nfetch.watch: true\n",
+			expectFlags: map[string]string{
+				"thanos-rule-url": "http://thanos-rule:10902",
+				"interval":        "30",
+				"fetch.watch":     "true",
+			},
+		},
+		"lists are joined": {
+			content:     "reload.extra-urls:\n- http://thanos-rule-1:10902\n- http://thanos-rule-2:10902\n",
+			expectFlags: map[string]string{"reload.extra-urls": "http://thanos-rule-1:10902,http://thanos-rule-2:10902"},
+		},
+		"later documents override earlier ones": {
+			content:     "interval: 30\nthanos-rule-url: http://thanos-rule:10902\n---\n---\ninterval: 10\n",
+			expectFlags: map[string]string{"interval": "10", "thanos-rule-url": "http://thanos-rule:10902"},
+		},
+		"command line overrides the file": {
+			content:     "interval: 30\n",
+			args:        []string{"-interval=10"},
+			expectFlags: map[string]string{"interval": "10"},
+		},
+		"unknown flag": {
+			content:   "interval: 30\nintreval: 10\n",
+			expectErr: `line 2: unknown flag "intreval"`,
+		},
+		"config is not a flag of the file": {
+			content:   "config: other.yaml\n",
+			expectErr: `line 1: unknown flag "config"`,
+		},
+		"invalid value": {
+			content:   "interval: soon\n",
+			expectErr: "line 1: flag interval: ",
+		},
+		"mapping value": {
+			content:   "interval:\n  seconds: 30\n",
+			expectErr: "line 2: flag interval: the value must be a scalar or a list of scalars",
+		},
+		"not a mapping": {
+			content:   "- interval\n",
+			expectErr: "line 1: the config file must map flag names to their values",
+		},
+		"pipelines of several documents": {
+			content: "interval: 30\npipelines:\n- name: metrics\n  rules-backend-url: http://rules-objstore\n  thanos-rule-url: http://thanos-rule:10902\n" +
+				"---\npipelines:\n- name: logs\n  rules-backend-url: http://loki-rules-objstore\n  tenants: [tenant1]\n  file: loki-rules.yaml\n  thanos-rule-url: http://loki-ruler:3100\n  interval: 10\n",
+			expectFlags: map[string]string{"interval": "30"},
+			expectPipelines: []pipelineConfig{
+				{Name: "metrics", RulesBackendURL: "http://rules-objstore", ThanosRuleURL: "http://thanos-rule:10902"},
+				{Name: "logs", RulesBackendURL: "http://loki-rules-objstore", Tenants: []string{"tenant1"}, File: "loki-rules.yaml", ThanosRuleURL: "http://loki-ruler:3100", Interval: 10},
+			},
+		},
+		"duplicate pipelines": {
+			content:   "pipelines:\n- name: metrics\n---\npipelines:\n- name: metrics\n",
+			expectErr: "line 5: duplicate pipeline metrics",
+		},
+		"pipeline without name": {
+			content:   "pipelines:\n- file: rules.yaml\n",
+			expectErr: "line 2: pipeline has no name",
+		},
+		"unknown pipeline field": {
+			content:   "pipelines:\n- name: metrics\n  thanos-ruler-url: http://thanos-rule:10902\n",
+			expectErr: `line 3: unknown pipeline field "thanos-ruler-url"`,
+		},
+		"all errors are reported": {
+			content: "intreval: 10\ninterval: soon\npipelines:\n- name: metrics\n  thanos-ruler-url: http://thanos-rule:10902\n- file: rules.yaml\n" +
+				"---\n- interval\n---\nfetch.watch: maybe\n",
+			expectErr: `line 1: unknown flag "intreval"` + "\n" +
+				`line 2: flag interval: parse error` + "\n" +
+				`line 5: unknown pipeline field "thanos-ruler-url"` + "\n" +
+				`line 6: pipeline has no name` + "\n" +
+				`line 8: the config file must map flag names to their values` + "\n" +
+				`line 10: flag fetch.watch: parse error`,
+		},
+		"tenants document without tenants file from standard input": {
+			content:   "interval: 30\n---\ntenants:\n- id: tenant1\n",
+			expectErr: "line 3: tenants documents require -config=- and -tenants-file=-",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.yaml")
+			assert.NoError(t, os.WriteFile(file, []byte(tc.content), 0o600))
+
+			fs := testFlagSet(t, tc.args...)
+			pipelines, err := loadConfigFile(fs, file)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectPipelines, pipelines)
+			for name, value := range tc.expectFlags {
+				assert.Equal(t, value, fs.Lookup(name).Value.String(), name)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileStdin(t *testing.T) {
+	testCases := map[string]struct {
+		stdin string
+		args  []string
+
+		expectErr     string
+		expectTenants []string
+	}{
+		"config and tenants documents": {
+			stdin:         "thanos-rule-url: http://thanos-rule:10902\ntenants-file: '-'\n---\nversion: 1\ntenants:\n- id: tenant1\n- id: tenant2\n",
+			expectTenants: []string{"tenant1", "tenant2"},
+		},
+		"tenants file from the command line": {
+			stdin:         "tenants:\n- id: tenant1\n---\nthanos-rule-url: http://thanos-rule:10902\n",
+			args:          []string{"-tenants-file=-"},
+			expectTenants: []string{"tenant1"},
+		},
+		"no tenants document": {
+			stdin:     "thanos-rule-url: http://thanos-rule:10902\n",
+			args:      []string{"-tenants-file=-"},
+			expectErr: "has no tenants document",
+		},
+		"several tenants documents": {
+			stdin:     "tenants:\n- id: tenant1\n---\ntenants:\n- id: tenant2\n",
+			args:      []string{"-tenants-file=-"},
+			expectErr: "line 4: the config file has several tenants documents",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			setTestStdin(t, tc.stdin)
+
+			fs := testFlagSet(t, append(tc.args, "-config=-")...)
+			_, err := loadConfigFile(fs, stdinFile)
+			if err == nil {
+				var tenants *TenantsConfig
+				tenants, err = readTenantsFile(stdinFile, tenantsFormatAuto)
+				if err == nil {
+					assert.Equal(t, tc.expectTenants, tenants.IDs())
+				}
+			}
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "http://thanos-rule:10902", fs.Lookup("thanos-rule-url").Value.String())
+		})
+	}
+}
+
+func TestReadTenantsFileStdin(t *testing.T) {
+	setTestStdin(t, "tenant1\ntenant2\n")
+
+	// The standard input is read once, and reloads get the same tenants.
+	for i := 0; i < 2; i++ {
+		tenants, err := readTenantsFile(stdinFile, tenantsFormatAuto)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"tenant1", "tenant2"}, tenants.IDs())
+	}
+}
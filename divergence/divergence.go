@@ -0,0 +1,282 @@
+// Package divergence detects when the rules file or the rules loaded by the ruler diverge from the rules last synced,
+// e.g. because another process or a second syncer instance overwrites the file.
+package divergence
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/observatorium/thanos-rule-syncer/reload"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// Sources compared with the rules last synced.
+const (
+	// SourceFile is the rules file on disk.
+	SourceFile = "file"
+	// SourceRuler is the rules loaded by the ruler, as listed by its rules API.
+	SourceRuler = "ruler"
+)
+
+// errRulesAPIUnavailable is returned when the ruler has no rules API to compare its rules with.
+var errRulesAPIUnavailable = errors.New("the ruler has no rules API")
+
+// Checker periodically compares the hash of the rules last synced with the hashes of the rules file and of the rules
+// loaded by the ruler, and exports whether they diverge.
+type Checker struct {
+	path    string
+	written func() []byte
+
+	rulerURL    string
+	rulerClient *http.Client
+
+	clock clock.Clock
+
+	divergence  *prometheus.GaugeVec
+	checkErrors *prometheus.CounterVec
+}
+
+// Option configures a Checker.
+type Option func(*Checker)
+
+// WithRuler also compares the rules loaded by the Thanos Ruler at the given URL, as listed by its /api/v1/rules endpoint.
+// The URL can be a unix:// one, see reload.NewThanosRule.
+func WithRuler(url string, client *http.Client) Option {
+	return func(c *Checker) {
+		if client == nil {
+			client = http.DefaultClient
+		}
+		if _, ok := reload.UnixSocketPath(url); ok {
+			url = "http://localhost"
+		}
+
+		c.rulerURL = url
+		c.rulerClient = client
+	}
+}
+
+// WithClock sets the clock scheduling the checks, e.g. a fake clock in tests.
+func WithClock(c clock.Clock) Option {
+	return func(ch *Checker) {
+		ch.clock = c
+	}
+}
+
+// New creates a new Checker comparing the rules file at the given path with the rules last written, as returned
+// by written, and registers its metrics with the given registerer, if not nil.
+func New(r prometheus.Registerer, path string, written func() []byte, opts ...Option) *Checker {
+	c := &Checker{
+		path:    path,
+		written: written,
+		clock:   clock.Real(),
+		divergence: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_divergence",
+			Help: "Whether the rules of a source diverged from the rules last synced in the last check, by source. 1 if they diverged, 0 otherwise.",
+		}, []string{"source"}),
+		checkErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_divergence_check_errors_total",
+			Help: "Total number of failed comparisons of the rules of a source with the rules last synced, by source.",
+		}, []string{"source"}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if r != nil {
+		r.MustRegister(c.divergence, c.checkErrors)
+	}
+
+	return c
+}
+
+// Run checks the divergence at the given interval until the context is cancelled.
+func (c *Checker) Run(ctx context.Context, interval time.Duration) error {
+	ticker := c.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+			c.Check(ctx)
+		}
+	}
+}
+
+// Check compares the rules file, and the rules loaded by the ruler if configured, with the rules last synced.
+// Nothing is compared until rules were synced. A sync cycle running during the check can make the sources diverge
+// until the next check, so alerts on the divergence should only fire if it lasts.
+func (c *Checker) Check(ctx context.Context) {
+	written := c.written()
+	if written == nil {
+		return
+	}
+
+	c.check(SourceFile, func() (bool, error) {
+		content, err := os.ReadFile(c.path)
+		if err != nil {
+			return false, fmt.Errorf("failed to read rules file: %w", err)
+		}
+
+		return sha256.Sum256(content) != sha256.Sum256(written), nil
+	})
+
+	if c.rulerURL == "" {
+		return
+	}
+	c.check(SourceRuler, func() (bool, error) {
+		want, err := hashWritten(written)
+		if err != nil {
+			return false, err
+		}
+
+		got, err := c.hashRuler(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		return got != want, nil
+	})
+}
+
+func (c *Checker) check(source string, diverged func() (bool, error)) {
+	d, err := diverged()
+	if errors.Is(err, errRulesAPIUnavailable) {
+		c.divergence.DeleteLabelValues(source)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to compare the rules of the %s with the rules last synced: %v", source, err)
+		c.checkErrors.WithLabelValues(source).Inc()
+		return
+	}
+
+	if d {
+		log.Printf("the rules of the %s diverge from the rules last synced", source)
+		c.divergence.WithLabelValues(source).Set(1)
+		return
+	}
+	c.divergence.WithLabelValues(source).Set(0)
+}
+
+// group and rule are the parts of rule groups both in the rules file and in the rules API of the ruler,
+// normalized so that their hashes match if the ruler loaded the rules of the file.
+type group struct {
+	Name  string `json:"name"`
+	Rules []rule `json:"rules"`
+}
+
+type rule struct {
+	Type  string  `json:"type"`
+	Name  string  `json:"name"`
+	Query string  `json:"query"`
+	For   float64 `json:"duration"`
+}
+
+// hashGroups returns the hash of the groups, regardless of their order.
+func hashGroups(groups []group) ([sha256.Size]byte, error) {
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	content, err := json.Marshal(groups)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	return sha256.Sum256(content), nil
+}
+
+// hashWritten returns the hash of the rules written to the file.
+func hashWritten(content []byte) ([sha256.Size]byte, error) {
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	normalized := make([]group, 0, len(groups.Groups))
+	for _, g := range groups.Groups {
+		ng := group{Name: g.Name, Rules: make([]rule, 0, len(g.Rules))}
+		for _, r := range g.Rules {
+			// The ruler lists the expressions as formatted by the PromQL parser.
+			query := r.Expr.Value
+			if expr, err := parser.ParseExpr(query); err == nil {
+				query = expr.String()
+			}
+
+			nr := rule{Type: "recording", Name: r.Record.Value, Query: query}
+			if r.Alert.Value != "" {
+				nr = rule{Type: "alerting", Name: r.Alert.Value, Query: query, For: time.Duration(r.For).Seconds()}
+			}
+			ng.Rules = append(ng.Rules, nr)
+		}
+		normalized = append(normalized, ng)
+	}
+
+	return hashGroups(normalized)
+}
+
+// hashRuler returns the hash of the rules loaded by the ruler from a file with the same name as the rules file,
+// as the ruler can mount it at another path.
+func (c *Checker) hashRuler(ctx context.Context) ([sha256.Size]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.rulerURL+"/api/v1/rules", nil)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	res, err := c.rulerClient.Do(req)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return [sha256.Size]byte{}, errRulesAPIUnavailable
+	}
+	if res.StatusCode/100 != 2 {
+		return [sha256.Size]byte{}, fmt.Errorf("got unexpected status from Thanos Ruler: %d", res.StatusCode)
+	}
+
+	var rulesRes struct {
+		Data struct {
+			Groups []struct {
+				group
+				File string `json:"file"`
+			} `json:"groups"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&rulesRes); err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("failed to decode rules: %w", err)
+	}
+
+	loaded := []group{}
+	for _, g := range rulesRes.Data.Groups {
+		if filepath.Base(g.File) != filepath.Base(c.path) {
+			continue
+		}
+		for i := range g.Rules {
+			if g.Rules[i].Type != "alerting" {
+				g.Rules[i].For = 0
+			}
+		}
+		if g.Rules == nil {
+			g.Rules = []rule{}
+		}
+		loaded = append(loaded, g.group)
+	}
+
+	return hashGroups(loaded)
+}
@@ -0,0 +1,119 @@
+package divergence
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const written = `groups:
+  - name: tenant-a.alerts
+    rules:
+      - alert: Down
+        expr: up==0
+        for: 5m
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`
+
+// loaded is the response of the rules API of a ruler that loaded the written rules.
+const loaded = `{"status": "success", "data": {"groups": [
+	{"name": "tenant-a.alerts", "file": "/etc/thanos/rules/rules.yaml", "interval": 60, "rules": [
+		{"type": "alerting", "name": "Down", "query": "up == 0", "duration": 300, "labels": {}, "alerts": []},
+		{"type": "recording", "name": "job:up:sum", "query": "sum by (job) (up)"}
+	]},
+	{"name": "other", "file": "/etc/thanos/rules/other.yaml", "interval": 60, "rules": []}
+]}}`
+
+func TestCheckerCheck(t *testing.T) {
+	testCases := map[string]struct {
+		file        string
+		written     string
+		rulerStatus int
+		rulerBody   string
+
+		expectSeries      int
+		expectFile        float64
+		expectRuler       float64
+		expectRulerErrors float64
+	}{
+		"nothing synced yet": {
+			file:         written,
+			rulerBody:    loaded,
+			expectSeries: 0,
+		},
+		"no divergence": {
+			file:         written,
+			written:      written,
+			rulerBody:    loaded,
+			expectSeries: 2,
+		},
+		"file overwritten": {
+			file:         "groups: []\n",
+			written:      written,
+			rulerBody:    loaded,
+			expectSeries: 2,
+			expectFile:   1,
+		},
+		"ruler loaded other rules": {
+			file:         "groups: []\n",
+			written:      "groups: []\n",
+			rulerBody:    loaded,
+			expectSeries: 2,
+			expectFile:   0,
+			expectRuler:  1,
+		},
+		"ruler without rules API": {
+			file:         written,
+			written:      written,
+			rulerStatus:  http.StatusNotFound,
+			expectSeries: 1,
+		},
+		"ruler failing": {
+			file:              written,
+			written:           written,
+			rulerStatus:       http.StatusInternalServerError,
+			expectSeries:      1,
+			expectRulerErrors: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.yaml")
+			assert.NoError(t, os.WriteFile(path, []byte(tc.file), 0o600))
+
+			ruler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/v1/rules", r.URL.Path)
+				if tc.rulerStatus != 0 {
+					w.WriteHeader(tc.rulerStatus)
+					return
+				}
+				_, _ = w.Write([]byte(tc.rulerBody))
+			}))
+			defer ruler.Close()
+
+			var content []byte
+			if tc.written != "" {
+				content = []byte(tc.written)
+			}
+			c := New(nil, path, func() []byte { return content }, WithRuler(ruler.URL, ruler.Client()))
+			c.Check(context.Background())
+
+			assert.Equal(t, tc.expectSeries, testutil.CollectAndCount(c.divergence))
+			if tc.expectSeries > 0 {
+				assert.Equal(t, tc.expectFile, testutil.ToFloat64(c.divergence.WithLabelValues(SourceFile)))
+			}
+			if tc.expectSeries > 1 {
+				assert.Equal(t, tc.expectRuler, testutil.ToFloat64(c.divergence.WithLabelValues(SourceRuler)))
+			}
+			assert.Equal(t, tc.expectRulerErrors, testutil.ToFloat64(c.checkErrors.WithLabelValues(SourceRuler)))
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/reload"
+	"github.com/observatorium/thanos-rule-syncer/secret"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+)
+
+// redacted replaces the secrets of the effective configuration, like the passwords of URLs redacted by url.URL.Redacted.
+const redacted = "xxxxx"
+
+// effectiveConfig is the configuration the syncer runs with once its flags are resolved, e.g. from -config, with
+// its secrets redacted, so that misdeployments can be troubleshot without reverse-engineering the flags of the pod.
+type effectiveConfig struct {
+	// Modes are the modes of the syncer, e.g. where the rules are read from and written to, by aspect.
+	Modes map[string]string `json:"modes"`
+	// Computed are the values derived from the flags, e.g. the timeout of sync cycles.
+	Computed map[string]string `json:"computed"`
+	Flags    []effectiveFlag   `json:"flags"`
+}
+
+// effectiveFlag is the value of a flag, and whether it was set rather than left to its default.
+type effectiveFlag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Set   bool   `json:"set"`
+}
+
+// newEffectiveConfig returns the effective configuration of the flags of fs, resolved into cfg.
+func newEffectiveConfig(cfg *config, fs *flag.FlagSet) *effectiveConfig {
+	c := &effectiveConfig{
+		Modes: effectiveModes(cfg),
+		Computed: map[string]string{
+			"cycleTimeout": syncer.CycleTimeout(time.Duration(cfg.interval)*time.Second, cfg.timeouts).String(),
+			"gomaxprocs":   fmt.Sprint(runtime.GOMAXPROCS(0)),
+		},
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	fs.VisitAll(func(f *flag.Flag) {
+		c.Flags = append(c.Flags, effectiveFlag{Name: f.Name, Value: redactFlag(f.Name, f.Value.String()), Set: set[f.Name]})
+	})
+
+	return c
+}
+
+// effectiveModes returns the modes of the syncer by aspect.
+func effectiveModes(cfg *config) map[string]string {
+	modes := map[string]string{"sync": cfg.syncMode}
+
+	switch {
+	case cfg.source == sourceStdin || cfg.source == sourceNATS:
+		modes["source"] = cfg.source
+	case cfg.rulesBackendURL != "":
+		modes["source"] = "rules-backend"
+	case cfg.observatoriumURL != "":
+		modes["source"] = "observatorium-api"
+	default:
+		modes["source"] = "none"
+	}
+	switch {
+	case cfg.tenantsFile != "":
+		modes["tenants"] = "tenants-file"
+	case cfg.tenant != "":
+		modes["tenants"] = "tenant"
+	case cfg.rulesBackendURL != "":
+		modes["tenants"] = "all"
+	}
+
+	switch {
+	case cfg.output.routingFile != "":
+		modes["output"] = "routing-file"
+	case cfg.output.tenantDir != "":
+		modes["output"] = "tenant-dir"
+	case cfg.output.fileTemplate != "":
+		modes["output"] = "file-template"
+	default:
+		modes["output"] = "file"
+	}
+	if _, ok := reload.UnixSocketPath(cfg.thanosRuleURL); ok {
+		modes["reload"] = "unix-socket"
+	} else {
+		modes["reload"] = "http"
+	}
+
+	switch {
+	case cfg.oidc.issuerURL != "":
+		modes["auth"] = "oidc"
+	default:
+		modes["auth"] = "none"
+	}
+
+	if cfg.syncMode == syncModeLoop {
+		if cfg.schedule != "" {
+			modes["sync"] += " on schedule " + cfg.schedule
+		} else {
+			modes["sync"] += fmt.Sprintf(" every %s", time.Duration(cfg.interval)*time.Second)
+		}
+	}
+	if cfg.standby.enabled {
+		modes["role"] = "standby"
+	} else {
+		modes["role"] = "active"
+	}
+	if len(cfg.pipelines) > 0 {
+		modes["pipelines"] = fmt.Sprint(len(cfg.pipelines))
+	}
+
+	return modes
+}
+
+// redactFlag returns the value of the flag with its secrets redacted: the plaintext values of secret flags, unlike
+// references to secrets, and the passwords and query values of URLs, e.g. the signature of a pre-signed URL.
+func redactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if strings.HasSuffix(name, "-secret") || strings.HasSuffix(name, "-password") {
+		if secret.Scheme(value) == "" {
+			return redacted
+		}
+		return value
+	}
+
+	values := strings.Split(value, ",")
+	for i, v := range values {
+		u, err := url.Parse(strings.TrimSpace(v))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			continue
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		if u.RawQuery != "" {
+			query := u.Query()
+			for key := range query {
+				query[key] = []string{redacted}
+			}
+			u.RawQuery = query.Encode()
+		}
+		values[i] = u.String()
+	}
+
+	return strings.Join(values, ",")
+}
+
+// String returns the effective configuration for logging, the modes and computed values on the first line, and the
+// flags on the next ones, marking the ones left to their default.
+func (c *effectiveConfig) String() string {
+	var b strings.Builder
+	b.WriteString("effective configuration:")
+	for _, values := range []map[string]string{c.Modes, c.Computed} {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, " %s=%q", key, values[key])
+		}
+	}
+	for _, f := range c.Flags {
+		fmt.Fprintf(&b, "\n  -%s=%q", f.Name, f.Value)
+		if !f.Set {
+			b.WriteString(" (default)")
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,167 @@
+// Package events publishes a compact event for each change of the rules of a tenant to a message bus, so that
+// downstream systems, e.g. documentation generators or audit pipelines, can react to changes without polling the
+// syncer.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/report"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// Conn publishes messages to the subjects of a message bus, e.g. a *nats.Conn.
+type Conn interface {
+	Publish(subject string, data []byte) error
+	// FlushWithContext returns once the messages published are received by the server.
+	FlushWithContext(ctx context.Context) error
+}
+
+// Event is the change of the rules of a tenant written by a sync cycle.
+type Event struct {
+	// Time is the start time of the sync cycle that wrote the change.
+	Time   time.Time `json:"time"`
+	Tenant string    `json:"tenant"`
+	// Change is how the rules of the tenant changed: report.TenantAdded, report.TenantChanged or report.TenantRemoved.
+	Change string `json:"change"`
+	// SHA256 is the hash of the rule groups of the tenant written, empty if it was removed.
+	SHA256 string       `json:"sha256,omitempty"`
+	Groups int          `json:"groups"`
+	Rules  int          `json:"rules"`
+	Diff   *report.Diff `json:"diff,omitempty"`
+}
+
+// Publisher publishes the changes of the rules of tenants written by the sync cycles it observes, each to the subject
+// of its tenant.
+type Publisher struct {
+	conn     Conn
+	subject  string
+	reporter *report.Reporter
+	timeout  time.Duration
+
+	published *prometheus.CounterVec
+}
+
+// Option configures a Publisher.
+type Option func(*Publisher)
+
+// WithTimeout sets how long publishing the events of a sync cycle can take before it fails.
+func WithTimeout(timeout time.Duration) Option {
+	return func(p *Publisher) {
+		if timeout > 0 {
+			p.timeout = timeout
+		}
+	}
+}
+
+// NewPublisher creates a new Publisher of events to the <subject>.<tenant> subjects, telling the tenants of rule groups
+// apart with groupTenant, e.g. merge.GroupTenantFunc. Its metrics are registered with the given registerer, if not nil.
+func NewPublisher(r prometheus.Registerer, conn Conn, subject string, groupTenant func(groupName string) string, opts ...Option) *Publisher {
+	p := &Publisher{
+		conn:     conn,
+		subject:  subject,
+		reporter: report.New(nil, groupTenant),
+		timeout:  defaultTimeout,
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_change_events_total",
+			Help: "Total number of events of changes of the rules of tenants published, by result.",
+		}, []string{"result"}),
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if r != nil {
+		r.MustRegister(p.published)
+	}
+
+	return p
+}
+
+// Observe publishes the changes of the rules written by the sync cycle, and is a syncer.Observer. Failures to publish
+// are logged and counted, and don't fail the cycle.
+func (p *Publisher) Observe(ctx context.Context, c syncer.Cycle) {
+	events := p.Events(c)
+	if len(events) == 0 {
+		return
+	}
+
+	// The events are published even if the cycle ran out of time.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.timeout)
+	defer cancel()
+
+	published := 0
+	for _, event := range events {
+		content, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("failed to marshal the change event of tenant %s: %v", event.Tenant, err)
+			p.published.WithLabelValues("failure").Inc()
+			continue
+		}
+		if err := p.conn.Publish(p.subject+"."+Subject(event.Tenant), content); err != nil {
+			log.Printf("failed to publish the change event of tenant %s: %v", event.Tenant, err)
+			p.published.WithLabelValues("failure").Inc()
+			continue
+		}
+		published++
+	}
+	if published == 0 {
+		return
+	}
+
+	if err := p.conn.FlushWithContext(ctx); err != nil {
+		log.Printf("failed to flush %d change events, they may be delivered later: %v", published, err)
+		p.published.WithLabelValues("failure").Add(float64(published))
+		return
+	}
+	p.published.WithLabelValues("success").Add(float64(published))
+}
+
+// Events returns the events of the changes of the rules written by the sync cycle, in the order of the tenants.
+// Cycles that didn't write rules have none.
+func (p *Publisher) Events(c syncer.Cycle) []Event {
+	if c.Written == nil {
+		return nil
+	}
+
+	var events []Event
+	for _, tenant := range p.reporter.Report(c).Tenants {
+		switch tenant.Outcome {
+		case report.TenantAdded, report.TenantChanged, report.TenantRemoved:
+			events = append(events, Event{
+				Time:   c.Start,
+				Tenant: tenant.Tenant,
+				Change: tenant.Outcome,
+				SHA256: tenant.SHA256,
+				Groups: tenant.Groups,
+				Rules:  tenant.Rules,
+				Diff:   tenant.Diff,
+			})
+		}
+	}
+
+	return events
+}
+
+// Subject returns the subject token of the tenant, whose characters that can't be in a token, e.g. dots and
+// wildcards, are replaced with underscores. The token of rule groups without a tenant is an underscore.
+func Subject(tenant string) string {
+	if tenant == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, tenant)
+}
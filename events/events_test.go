@@ -0,0 +1,146 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/report"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const previousRules = `groups:
+- name: tenant-a.test
+  rules:
+  - record: a
+    expr: vector(1)
+- name: tenant-b.test
+  rules:
+  - record: b
+    expr: vector(1)
+- name: tenant-c.test
+  rules:
+  - record: c
+    expr: vector(1)
+`
+
+const writtenRules = `groups:
+- name: tenant-a.test
+  rules:
+  - record: a
+    expr: vector(1)
+- name: tenant-b.test
+  rules:
+  - record: b
+    expr: vector(2)
+- name: tenant-d.test
+  rules:
+  - record: d
+    expr: vector(1)
+`
+
+type testMessage struct {
+	subject string
+	event   Event
+}
+
+type testConn struct {
+	messages []testMessage
+	flushErr error
+}
+
+func (c *testConn) Publish(subject string, data []byte) error {
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+	c.messages = append(c.messages, testMessage{subject: subject, event: event})
+	return nil
+}
+
+func (c *testConn) FlushWithContext(context.Context) error {
+	return c.flushErr
+}
+
+func TestPublisherObserve(t *testing.T) {
+	start := time.Date(2024, 1, 16, 4, 3, 5, 0, time.UTC)
+
+	testCases := map[string]struct {
+		cycle    syncer.Cycle
+		flushErr error
+
+		expectMessages []testMessage
+		expectSuccess  float64
+		expectFailure  float64
+	}{
+		"changed": {
+			cycle: syncer.Cycle{Start: start, Previous: []byte(previousRules), Written: []byte(writtenRules)},
+			expectMessages: []testMessage{
+				{subject: "rules.tenant-b", event: Event{Time: start, Tenant: "tenant-b", Change: report.TenantChanged, Groups: 1, Rules: 1, Diff: &report.Diff{Changed: []string{"tenant-b.test"}}}},
+				{subject: "rules.tenant-c", event: Event{Time: start, Tenant: "tenant-c", Change: report.TenantRemoved, Diff: &report.Diff{Removed: []string{"tenant-c.test"}}}},
+				{subject: "rules.tenant-d", event: Event{Time: start, Tenant: "tenant-d", Change: report.TenantAdded, Groups: 1, Rules: 1, Diff: &report.Diff{Added: []string{"tenant-d.test"}}}},
+			},
+			expectSuccess: 3,
+		},
+		"unchanged": {
+			cycle: syncer.Cycle{Start: start, Previous: []byte(previousRules), Written: []byte(previousRules)},
+		},
+		"not written": {
+			cycle: syncer.Cycle{Start: start, Previous: []byte(previousRules), Err: errors.New("failed")},
+		},
+		"failed flush": {
+			cycle:    syncer.Cycle{Start: start, Previous: []byte(writtenRules), Written: []byte(previousRules)},
+			flushErr: errors.New("timeout"),
+			expectMessages: []testMessage{
+				{subject: "rules.tenant-b", event: Event{Time: start, Tenant: "tenant-b", Change: report.TenantChanged, Groups: 1, Rules: 1, Diff: &report.Diff{Changed: []string{"tenant-b.test"}}}},
+				{subject: "rules.tenant-c", event: Event{Time: start, Tenant: "tenant-c", Change: report.TenantAdded, Groups: 1, Rules: 1, Diff: &report.Diff{Added: []string{"tenant-c.test"}}}},
+				{subject: "rules.tenant-d", event: Event{Time: start, Tenant: "tenant-d", Change: report.TenantRemoved, Diff: &report.Diff{Removed: []string{"tenant-d.test"}}}},
+			},
+			expectFailure: 3,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			conn := &testConn{flushErr: tc.flushErr}
+			p := NewPublisher(nil, conn, "rules", merge.GroupTenantFunc(""))
+
+			p.Observe(context.Background(), tc.cycle)
+
+			// The hashes of the tenants are checked apart.
+			for i := range conn.messages {
+				if conn.messages[i].event.Change != report.TenantRemoved {
+					assert.Len(t, conn.messages[i].event.SHA256, 64)
+				}
+				conn.messages[i].event.SHA256 = ""
+			}
+			assert.Equal(t, tc.expectMessages, conn.messages)
+			assert.Equal(t, tc.expectSuccess, testutil.ToFloat64(p.published.WithLabelValues("success")))
+			assert.Equal(t, tc.expectFailure, testutil.ToFloat64(p.published.WithLabelValues("failure")))
+		})
+	}
+}
+
+func TestSubject(t *testing.T) {
+	testCases := map[string]struct {
+		tenant string
+
+		expect string
+	}{
+		"plain":     {tenant: "tenant-a", expect: "tenant-a"},
+		"dots":      {tenant: "team.tenant", expect: "team_tenant"},
+		"wildcards": {tenant: "a*b>c d", expect: "a_b_c_d"},
+		"empty":     {tenant: "", expect: "_"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, Subject(tc.tenant))
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime/pprof"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+)
+
+// Exit codes of the process, by class of error, so that automation running it can tell failures apart,
+// e.g. rejected credentials from an unavailable rules source.
+const (
+	exitError      = 1
+	exitUsage      = 2
+	exitConfig     = 3
+	exitAuth       = 4
+	exitFetch      = 5
+	exitValidation = 6
+	exitWrite      = 7
+	exitReload     = 8
+	// exitDrift is the exit code of the diff command when the rules file differs from the upstream rules.
+	exitDrift = 9
+)
+
+var exitCodes = map[string]int{
+	syncer.ErrorConfig:     exitConfig,
+	syncer.ErrorAuth:       exitAuth,
+	syncer.ErrorFetch:      exitFetch,
+	syncer.ErrorValidation: exitValidation,
+	syncer.ErrorWrite:      exitWrite,
+	syncer.ErrorReload:     exitReload,
+}
+
+// exitCode returns the exit code of the class of the error, or exitError if it has none.
+func exitCode(err error) int {
+	if code, ok := exitCodes[syncer.ErrorClass(err)]; ok {
+		return code
+	}
+
+	return exitError
+}
+
+// classError returns an error of the given class.
+func classError(class string, format string, args ...any) error {
+	return &syncer.Error{Class: class, Err: fmt.Errorf(format, args...)}
+}
+
+// fetchError classifies an error fetching rules as an auth or a fetch error.
+func fetchError(err error) error {
+	if fetch.IsAuthError(err) {
+		return &syncer.Error{Class: syncer.ErrorAuth, Err: err}
+	}
+
+	return &syncer.Error{Class: syncer.ErrorFetch, Err: err}
+}
+
+// fatal logs the error with its class and exits with its exit code.
+func fatal(err error) {
+	if class := syncer.ErrorClass(err); class != "" {
+		log.Printf("%v (%s error)", err, class)
+	} else {
+		log.Print(err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// fatalf logs an error of the given class and exits with its exit code.
+func fatalf(class string, format string, args ...any) {
+	fatal(classError(class, format, args...))
+}
+
+// watchdog returns an actor running the watchdog of the loop of the syncer, of the named pipeline if any, which exits
+// once the loop is stalled, as a stalled loop may never return, logging the stacks of all goroutines to find where
+// it is stuck.
+func watchdog(ctx context.Context, s *syncer.Syncer, pipeline string) func() error {
+	return func() error {
+		err := s.Watchdog(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if pipeline != "" {
+			err = fmt.Errorf("pipeline %s: %w", pipeline, err)
+		}
+		_ = pprof.Lookup("goroutine").WriteTo(log.Writer(), 2)
+		fatal(err)
+		return err
+	}
+}
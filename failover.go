@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+type failoverConfig struct {
+	file          string
+	afterFailures int
+	recoverAfter  int
+	probeInterval time.Duration
+	probePath     string
+}
+
+// StandbysConfig lists the standby upstreams of -failover.file, in order of preference.
+type StandbysConfig struct {
+	Standbys []StandbyConfig `yaml:"standbys"`
+}
+
+// StandbyConfig is an upstream the rules are fetched from while the primary one, and the standbys listed before, are failing,
+// e.g. the Observatorium API of a secondary region. It is requested like the primary upstream, with its own URL.
+type StandbyConfig struct {
+	// Name tells the standby apart in logs and in the upstream label of metrics. If empty, it is the host of its URL.
+	Name string `yaml:"name,omitempty"`
+	// URL is the base URL of the standby, replacing the one of the primary upstream in the requests.
+	URL string `yaml:"url"`
+	// CA is the path to a file containing the TLS CA against which to verify the standby. If empty, it is -observatorium-ca.
+	CA string `yaml:"ca,omitempty"`
+	// OIDC are the OIDC client credentials of the standby. If nil, they are the ones of the -oidc flags.
+	OIDC *StandbyOIDCConfig `yaml:"oidc,omitempty"`
+}
+
+// StandbyOIDCConfig are OIDC client credentials, like the -oidc flags.
+type StandbyOIDCConfig struct {
+	IssuerURL string `yaml:"issuer-url"`
+	ClientID  string `yaml:"client-id"`
+	// ClientSecret can be a reference to the secret, like -oidc.client-secret.
+	ClientSecret string `yaml:"client-secret"`
+	Audience     string `yaml:"audience,omitempty"`
+}
+
+// readStandbysFile reads the standby upstreams of -failover.file, rejecting unknown fields.
+func readStandbysFile(path string) (*StandbysConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	standbys := &StandbysConfig{}
+	if err := decoder.Decode(standbys); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal file: %w", err)
+	}
+	if len(standbys.Standbys) == 0 {
+		return nil, fmt.Errorf("the file lists no standbys")
+	}
+
+	return standbys, nil
+}
+
+// primaryUpstreamURL returns the URL of the upstream the standbys of -failover.file stand in for.
+func primaryUpstreamURL(cfg *config) (*url.URL, error) {
+	raw := cfg.rulesBackendURL
+	if raw == "" {
+		raw = cfg.observatoriumURL
+	}
+	if raw == "" {
+		return nil, fmt.Errorf("-failover.file requires -rules-backend-url or -observatorium-api-url")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the URL of the primary upstream: %w", err)
+	}
+	if strings.HasPrefix(u.Scheme, "dnssrv+") {
+		return nil, fmt.Errorf("-failover.file can't be used with a dnssrv+ URL, whose hosts already fail over")
+	}
+
+	return u, nil
+}
+
+// configureFailover returns the transport failing over from the primary upstream, sent requests with the given transport,
+// to the standbys of -failover.file, and a function closing the idle connections of all the upstreams.
+// The standbys are dialed like the primary upstream, with their own CA and OIDC client credentials if any.
+func configureFailover(ctx context.Context, cfg *config, st *startup, cas *caFiles, primary http.RoundTripper, fetchTransport *http.Transport, auth *upstreamAuth, roundTripperInst *roundTripperInstrumenter, r prometheus.Registerer) (*fetch.FailoverTransport, func()) {
+	if len(cfg.pipelines) > 0 {
+		fatalf(syncer.ErrorConfig, "-failover.file can't be used with pipelines")
+	}
+	if cfg.failover.probeInterval <= 0 {
+		fatalf(syncer.ErrorConfig, "-failover.probe-interval must be positive")
+	}
+	primaryURL, err := primaryUpstreamURL(cfg)
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "%v", err)
+	}
+	standbys, err := readStandbysFile(cfg.failover.file)
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "failed to read -failover.file: %v", err)
+	}
+
+	endpoints := []fetch.FailoverEndpoint{{Name: primaryURL.Host, URL: primaryURL, Transport: primary}}
+	closers := []func(){fetchTransport.CloseIdleConnections}
+	for i, standby := range standbys.Standbys {
+		u, err := url.Parse(standby.URL)
+		if err != nil || u.Host == "" {
+			fatalf(syncer.ErrorConfig, "invalid URL of standby %d of -failover.file: %q", i+1, standby.URL)
+		}
+		name := standby.Name
+		if name == "" {
+			name = u.Host
+		}
+
+		t := fetchTransport.Clone()
+		// Without a CA file of its own, the standby is verified like the primary upstream.
+		if standby.CA != "" {
+			if cfg.fetchSPIFFE.enabled {
+				fatalf(syncer.ErrorConfig, "standby %s of -failover.file can't have a CA file with -fetch.spiffe, which verifies the upstreams against the bundles of the Workload API", name)
+			}
+			ca := cas.add(standby.CA)
+			ca.configure(t)
+			st.add("the CA of standby "+name, func(context.Context) error {
+				if _, err := ca.load(); err != nil {
+					return classError(syncer.ErrorConfig, "failed to read the CA file of standby %s: %w", name, err)
+				}
+				return nil
+			})
+		}
+		closers = append(closers, t.CloseIdleConnections)
+
+		oidcCfg := cfg.oidc
+		if standby.OIDC != nil {
+			oidcCfg = oidcConfig{
+				issuerURL:    standby.OIDC.IssuerURL,
+				clientID:     standby.OIDC.ClientID,
+				clientSecret: standby.OIDC.ClientSecret,
+				audience:     standby.OIDC.Audience,
+			}
+		}
+		transport := auth.transport(ctx, oidcCfg, fmt.Sprintf("the client secret of standby %s", name), roundTripperInst.NewRoundTripper("fetch", st.transport(t)))
+		endpoints = append(endpoints, fetch.FailoverEndpoint{Name: name, URL: u, Transport: transport})
+	}
+
+	failover, err := fetch.NewFailoverTransport(endpoints,
+		fetch.WithFailoverAfter(cfg.failover.afterFailures),
+		fetch.WithRecoverAfter(cfg.failover.recoverAfter),
+		fetch.WithProbePath(cfg.failover.probePath),
+		fetch.WithFailoverRegisterer(r),
+	)
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "invalid -failover.file: %v", err)
+	}
+
+	return failover, func() {
+		for _, closeIdleConnections := range closers {
+			closeIdleConnections()
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadStandbysFile(t *testing.T) {
+	testCases := map[string]struct {
+		content string
+
+		expectErr      string
+		expectStandbys []StandbyConfig
+	}{
+		"standbys": {
+			content: `
+standbys:
+- name: us-east-1
+  url: https://observatorium.us-east-1.example.com
+  ca: /etc/ca/us-east-1.pem
+  oidc:
+    issuer-url: https://sso.us-east-1.example.com
+    client-id: syncer
+    client-secret: env:US_EAST_1_SECRET
+- url: https://observatorium.eu-west-1.example.com
+`,
+			expectStandbys: []StandbyConfig{
+				{
+					Name: "us-east-1",
+					URL:  "https://observatorium.us-east-1.example.com",
+					CA:   "/etc/ca/us-east-1.pem",
+					OIDC: &StandbyOIDCConfig{
+						IssuerURL:    "https://sso.us-east-1.example.com",
+						ClientID:     "syncer",
+						ClientSecret: "env:US_EAST_1_SECRET",
+					},
+				},
+				{URL: "https://observatorium.eu-west-1.example.com"},
+			},
+		},
+		"unknown field": {
+			content:   "standbys:\n- url: https://observatorium.example.com\n  token: secret\n",
+			expectErr: "field token not found",
+		},
+		"no standbys": {
+			content:   "standbys: []\n",
+			expectErr: "the file lists no standbys",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "standbys.yaml")
+			assert.NoError(t, os.WriteFile(path, []byte(tc.content), 0o600))
+
+			standbys, err := readStandbysFile(path)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectStandbys, standbys.Standbys)
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// Results of the requests to the batch endpoint of the rules backend.
+const (
+	batchSuccess     = "success"
+	batchError       = "error"
+	batchUnsupported = "unsupported"
+)
+
+// WithBatchSize enables fetching the rules of tenants from the batch endpoint of the rules backend, which lists the rules
+// of up to size tenants in one request, instead of with a request per tenant. The tenants are fetched in batches of the
+// size, concurrently up to the concurrency of the fetcher, and the tenants left out of the response of their batch, or
+// whose batch failed, are fetched one by one. The rules of all tenants are fetched one by one if the rules backend has no
+// batch endpoint. If 0, the rules of tenants are always fetched one by one.
+func WithBatchSize(size int) RulesObjstoreFetcherOption {
+	return func(f *RulesObjstoreFetcher) {
+		f.batchSize = size
+	}
+}
+
+// batchTenantRules are the rules of a tenant in the response of the batch endpoint.
+type batchTenantRules struct {
+	Rules        string     `json:"rules"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+}
+
+// batchRules fetches the rules of the tenants from the batch endpoint of the rules backend, see WithBatchSize, and returns
+// the rules of the tenants it listed. The tenants with a fallback source are left out, since their rules may come from it.
+// Failed batches are logged, so that their tenants are fetched one by one instead.
+func (f *RulesObjstoreFetcher) batchRules(ctx context.Context, tenants []string) map[string][]byte {
+	if f.batchSize <= 0 {
+		return nil
+	}
+
+	batched := make([]string, 0, len(tenants))
+	for _, tenant := range tenants {
+		if !f.hasFallback(tenant) {
+			batched = append(batched, tenant)
+		}
+	}
+
+	var (
+		mtx    sync.Mutex
+		bodies = make(map[string][]byte, len(batched))
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, f.Concurrency())
+	)
+	for start := 0; start < len(batched); start += f.batchSize {
+		batch := batched[start:min(start+f.batchSize, len(batched))]
+
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return bodies
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			listed, err := f.listBatch(ctx, batch)
+			if err != nil {
+				return
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			for tenant, tenantRules := range listed {
+				bodies[tenant] = []byte(tenantRules.Rules)
+				f.modTimes.setTime(tenant, tenantRules.LastModified)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return bodies
+}
+
+// listBatch lists the rules of the tenants with POST /api/v1/batch/rules, whose body is the list of the tenants,
+// e.g. {"tenants": ["tenant-a", "tenant-b"]}, and whose response is the rules of the tenants found with their
+// modification time, e.g. {"tenants": {"tenant-a": {"rules": "groups: ...", "lastModified": "2024-01-02T03:04:05Z"}}}.
+// Only the tenants of the batch are returned.
+func (f *RulesObjstoreFetcher) listBatch(ctx context.Context, tenants []string) (map[string]batchTenantRules, error) {
+	listed, err := f.doBatch(ctx, tenants)
+
+	f.batchMtx.Lock()
+	defer f.batchMtx.Unlock()
+
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusMethodNotAllowed):
+		f.batchRequests.WithLabelValues(batchUnsupported).Inc()
+		if !f.batchAbsent {
+			log.Print("the rules backend has no batch endpoint, fetching the rules of tenants one by one")
+			f.batchAbsent = true
+		}
+		return nil, err
+	case err != nil:
+		f.batchRequests.WithLabelValues(batchError).Inc()
+		log.Printf("failed to list the rules of a batch of %d tenants, fetching them one by one: %v", len(tenants), err)
+		return nil, err
+	}
+	f.batchAbsent = false
+	f.batchRequests.WithLabelValues(batchSuccess).Inc()
+
+	requested := make(map[string]bool, len(tenants))
+	for _, tenant := range tenants {
+		requested[tenant] = true
+	}
+	for tenant := range listed {
+		if !requested[tenant] {
+			delete(listed, tenant)
+		}
+	}
+
+	return listed, nil
+}
+
+func (f *RulesObjstoreFetcher) doBatch(ctx context.Context, tenants []string) (map[string]batchTenantRules, error) {
+	body, err := json.Marshal(struct {
+		Tenants []string `json:"tenants"`
+	}{Tenants: tenants})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tenants: %w", err)
+	}
+
+	u := *f.baseURL
+	u.Path = path.Join(u.Path, "/api/v1/batch/rules")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := f.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return nil, &StatusError{Source: "rules backend", StatusCode: res.StatusCode}
+	}
+
+	var batch struct {
+		Tenants map[string]batchTenantRules `json:"tenants"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("failed to decode rules: %w", err)
+	}
+
+	return batch.Tenants, nil
+}
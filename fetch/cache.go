@@ -0,0 +1,198 @@
+package fetch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CacheTransport wraps an http.RoundTripper and reuses the successful responses to GET requests for a TTL, keyed by
+// their URL, which includes the tenant of the rules, so that fetching the rules of the same tenant again within the
+// TTL, e.g. for several pipelines, doesn't issue another request. Concurrent requests for the same URL share a single
+// request. Requests with conditional or range headers aren't cached.
+type CacheTransport struct {
+	transport http.RoundTripper
+	ttl       time.Duration
+	clock     clock.Clock
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+
+	requests *prometheus.CounterVec
+}
+
+// cacheEntry is a cached response, or a response being fetched until done is closed.
+type cacheEntry struct {
+	done chan struct{}
+	// ok is whether the response was cached, set before done is closed.
+	ok      bool
+	expires time.Time
+
+	status     string
+	statusCode int
+	proto      string
+	header     http.Header
+	body       []byte
+}
+
+// CacheTransportCfg is the configuration for a CacheTransport.
+type CacheTransportCfg struct {
+	Transport http.RoundTripper
+	// TTL is how long responses are reused for.
+	TTL time.Duration
+	// Clock expires the responses, e.g. a fake clock in tests. If nil, it is the clock of the system.
+	Clock clock.Clock
+	// Registerer registers the metrics of the cache, if not nil.
+	Registerer prometheus.Registerer
+}
+
+// NewCacheTransport creates a new CacheTransport.
+func NewCacheTransport(cfg *CacheTransportCfg) *CacheTransport {
+	c := cfg.Clock
+	if c == nil {
+		c = clock.Real()
+	}
+
+	t := &CacheTransport{
+		transport: cfg.Transport,
+		ttl:       cfg.TTL,
+		clock:     c,
+		entries:   map[string]*cacheEntry{},
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_fetch_cache_requests_total",
+			Help: "Total number of cacheable requests fetching rules, by result: hit if the response was reused, miss otherwise.",
+		}, []string{"result"}),
+	}
+	t.requests.WithLabelValues("hit")
+	t.requests.WithLabelValues("miss")
+	if cfg.Registerer != nil {
+		cfg.Registerer.MustRegister(t.requests)
+	}
+
+	return t
+}
+
+func (t *CacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cacheable(req) {
+		return t.transport.RoundTrip(req)
+	}
+	key := req.URL.String()
+
+	for {
+		t.mu.Lock()
+		e, ok := t.entries[key]
+		if !ok || (isDone(e.done) && !t.clock.Now().Before(e.expires)) {
+			break
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-e.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if e.ok {
+			t.requests.WithLabelValues("hit").Inc()
+			return e.response(req), nil
+		}
+		// The shared request failed, so this one is sent again rather than failing with the same error.
+		t.mu.Lock()
+		if t.entries[key] == e {
+			delete(t.entries, key)
+		}
+		t.mu.Unlock()
+	}
+
+	e := &cacheEntry{done: make(chan struct{})}
+	t.entries[key] = e
+	t.removeExpired()
+	t.mu.Unlock()
+	t.requests.WithLabelValues("miss").Inc()
+
+	res, err := t.store(req, e)
+	close(e.done)
+	if !e.ok {
+		t.mu.Lock()
+		if t.entries[key] == e {
+			delete(t.entries, key)
+		}
+		t.mu.Unlock()
+	}
+
+	return res, err
+}
+
+// store sends the request and caches its response in the entry if it is successful.
+func (t *CacheTransport) store(req *http.Request, e *cacheEntry) (*http.Response, error) {
+	res, err := t.transport.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		return res, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	e.status, e.statusCode, e.proto = res.Status, res.StatusCode, res.Proto
+	e.header = res.Header.Clone()
+	e.body = body
+	e.expires = t.clock.Now().Add(t.ttl)
+	e.ok = true
+
+	return e.response(req), nil
+}
+
+// removeExpired removes the expired responses, e.g. of tenants no longer fetched. It must be called with mu held.
+func (t *CacheTransport) removeExpired() {
+	now := t.clock.Now()
+	for key, e := range t.entries {
+		if isDone(e.done) && !now.Before(e.expires) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// response returns a copy of the cached response to the request.
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        e.status,
+		StatusCode:    e.statusCode,
+		Proto:         e.proto,
+		Header:        e.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// cacheable returns whether the response to the request can be cached.
+func cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	for _, header := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		if req.Header.Get(header) != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isDone returns whether the channel is closed.
+func isDone(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,159 @@
+package fetch
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheTransport(t *testing.T) {
+	type request struct {
+		method string
+		path   string
+		header map[string]string
+		// after is how long after the previous request it is sent.
+		after time.Duration
+	}
+
+	testCases := map[string]struct {
+		status   int
+		requests []request
+
+		expectCalls  int32
+		expectHits   float64
+		expectMisses float64
+	}{
+		"repeated within ttl": {
+			status:       http.StatusOK,
+			requests:     []request{{path: "/api/v1/rules/tenant1"}, {path: "/api/v1/rules/tenant1", after: 59 * time.Second}},
+			expectCalls:  1,
+			expectHits:   1,
+			expectMisses: 1,
+		},
+		"repeated after ttl": {
+			status:       http.StatusOK,
+			requests:     []request{{path: "/api/v1/rules/tenant1"}, {path: "/api/v1/rules/tenant1", after: time.Minute}},
+			expectCalls:  2,
+			expectMisses: 2,
+		},
+		"other tenant": {
+			status:       http.StatusOK,
+			requests:     []request{{path: "/api/v1/rules/tenant1"}, {path: "/api/v1/rules/tenant2"}},
+			expectCalls:  2,
+			expectMisses: 2,
+		},
+		"error not cached": {
+			status:       http.StatusInternalServerError,
+			requests:     []request{{path: "/api/v1/rules/tenant1"}, {path: "/api/v1/rules/tenant1"}},
+			expectCalls:  2,
+			expectMisses: 2,
+		},
+		"put not cached": {
+			status:      http.StatusOK,
+			requests:    []request{{method: http.MethodPut, path: "/api/v1/rules/tenant1"}, {method: http.MethodPut, path: "/api/v1/rules/tenant1"}},
+			expectCalls: 2,
+		},
+		"range not cached": {
+			status: http.StatusOK,
+			requests: []request{
+				{path: "/api/v1/rules", header: map[string]string{"Range": "bytes=10-"}},
+				{path: "/api/v1/rules", header: map[string]string{"Range": "bytes=10-"}},
+			},
+			expectCalls: 2,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte("rules of " + r.URL.Path))
+			}))
+			defer server.Close()
+
+			fake := clock.NewFake(time.Unix(1000, 0))
+			transport := NewCacheTransport(&CacheTransportCfg{
+				Transport: http.DefaultTransport,
+				TTL:       time.Minute,
+				Clock:     fake,
+			})
+			client := &http.Client{Transport: transport}
+
+			for _, r := range tc.requests {
+				fake.Advance(r.after)
+				method := r.method
+				if method == "" {
+					method = http.MethodGet
+				}
+				req, err := http.NewRequest(method, server.URL+r.path, nil)
+				assert.NoError(t, err)
+				for key, value := range r.header {
+					req.Header.Set(key, value)
+				}
+
+				res, err := client.Do(req)
+				assert.NoError(t, err)
+				body, err := io.ReadAll(res.Body)
+				res.Body.Close()
+				assert.NoError(t, err)
+				// Cached responses are the same as the upstream ones.
+				assert.Equal(t, tc.status, res.StatusCode)
+				assert.Equal(t, "rules of "+r.path, string(body))
+				assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", res.Header.Get("Last-Modified"))
+			}
+
+			assert.Equal(t, tc.expectCalls, calls.Load())
+			assert.Equal(t, tc.expectHits, testutil.ToFloat64(transport.requests.WithLabelValues("hit")))
+			assert.Equal(t, tc.expectMisses, testutil.ToFloat64(transport.requests.WithLabelValues("miss")))
+		})
+	}
+}
+
+func TestCacheTransportConcurrent(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		<-release
+		_, _ = w.Write([]byte("rules"))
+	}))
+	defer server.Close()
+
+	transport := NewCacheTransport(&CacheTransportCfg{Transport: http.DefaultTransport, TTL: time.Minute})
+	client := &http.Client{Transport: transport}
+
+	// Concurrent requests for the same tenant share a single request.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(server.URL + "/api/v1/rules/tenant1")
+			if !assert.NoError(t, err) {
+				return
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.Equal(t, "rules", string(body))
+		}()
+	}
+	assert.Eventually(t, func() bool { return calls.Load() == 1 }, 5*time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, 4.0, testutil.ToFloat64(transport.requests.WithLabelValues("hit")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(transport.requests.WithLabelValues("miss")))
+
+}
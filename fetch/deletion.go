@@ -0,0 +1,170 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+)
+
+// tombstone is what the rules backend tells about a tenant whose rules weren't found.
+type tombstone int
+
+const (
+	// tombstoneUnknown is when the rules backend has no tombstones, or they couldn't be read.
+	tombstoneUnknown tombstone = iota
+	// tombstoneDeleted is when the rules backend has a tombstone of the tenant, which was deleted.
+	tombstoneDeleted
+	// tombstoneLive is when the rules backend knows the tenant, so its rules not being found is transient, e.g. a routing error.
+	tombstoneLive
+)
+
+// WithNotFoundThreshold deletes the rules of a tenant once they weren't found by the given number of fetches in a row,
+// instead of failing the fetch. Until then, the last rules of the tenant are kept, as the rules backend can respond
+// with a 404 transiently, e.g. because of a routing error. If 0, a tenant whose rules aren't found fails the fetch,
+// unless its deletion is confirmed by a tombstone, see WithTombstones.
+func WithNotFoundThreshold(fetches int) RulesObjstoreFetcherOption {
+	return func(f *RulesObjstoreFetcher) {
+		f.notFoundThreshold = fetches
+	}
+}
+
+// WithTombstones confirms the deletion of a tenant whose rules aren't found with the tombstones of the rules backend,
+// at /api/v1/tenants/{tenant}, which responds with {"deleted": true} if the tenant was deleted and {"deleted": false}
+// if it still exists. The rules of a deleted tenant are deleted right away, and the last rules of a tenant that still
+// exists are kept regardless of WithNotFoundThreshold. Without a tombstone, the threshold applies.
+func WithTombstones(tombstones bool) RulesObjstoreFetcherOption {
+	return func(f *RulesObjstoreFetcher) {
+		f.tombstones = tombstones
+	}
+}
+
+// isNotFound returns whether the error is a rules source not finding the rules of a tenant, rather than a document
+// they include.
+func isNotFound(err error) bool {
+	var included *includedError
+	if errors.As(err, &included) {
+		return false
+	}
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+// tombstoneOf reads the tombstone of a tenant from the rules backend, if WithTombstones is enabled.
+func (f *RulesObjstoreFetcher) tombstoneOf(ctx context.Context, tenant string) tombstone {
+	if !f.tombstones {
+		return tombstoneUnknown
+	}
+
+	deleted, err := f.readTombstone(ctx, tenant)
+	if err != nil {
+		log.Printf("failed to read the tombstone of tenant %s: %v", tenant, err)
+		return tombstoneUnknown
+	}
+	if deleted {
+		return tombstoneDeleted
+	}
+
+	return tombstoneLive
+}
+
+// readTombstone returns whether the rules backend has a tombstone of the tenant.
+func (f *RulesObjstoreFetcher) readTombstone(ctx context.Context, tenant string) (bool, error) {
+	u := *f.baseURL
+	u.Path = path.Join(u.Path, "/api/v1/tenants", tenant)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	res, err := f.httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return false, &StatusError{Source: "rules backend", StatusCode: res.StatusCode}
+	}
+
+	var status struct {
+		Deleted *bool `json:"deleted"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		return false, fmt.Errorf("failed to decode tenant status: %w", err)
+	}
+	if status.Deleted == nil {
+		return false, errors.New("the tenant status has no deleted field")
+	}
+
+	return *status.Deleted, nil
+}
+
+// notFoundTenant returns the groups of a tenant whose rules weren't found, and whether they replace its rules
+// instead of failing the fetch: no groups once the tenant is deleted, its last rules otherwise. Fetches without
+// last rules to keep fail, so that the rules written before aren't replaced until the tenant is deleted.
+func (f *RulesObjstoreFetcher) notFoundTenant(tenant string, t tombstone) ([]rules.RuleGroup, bool) {
+	if f.notFoundThreshold <= 0 && !f.tombstones {
+		return nil, false
+	}
+
+	f.parseMtx.Lock()
+	defer f.parseMtx.Unlock()
+
+	f.tenantsNotFound.WithLabelValues(tenant).Inc()
+	if t != tombstoneLive {
+		f.notFound[tenant]++
+	}
+
+	switch {
+	case f.deleted[tenant]:
+		return nil, true
+	case t == tombstoneDeleted || (t == tombstoneUnknown && f.notFoundThreshold > 0 && f.notFound[tenant] >= f.notFoundThreshold):
+		reason := "its tombstone"
+		if t != tombstoneDeleted {
+			reason = fmt.Sprintf("%d fetches in a row not finding its rules", f.notFound[tenant])
+		}
+		log.Printf("tenant %s was deleted according to %s, deleting its rules", tenant, reason)
+		f.deleted[tenant] = true
+		f.deletedTenants.Set(float64(len(f.deleted)))
+		delete(f.lastValid, tenant)
+		delete(f.parseErrors, tenant)
+		if f.spool != nil {
+			if err := f.spool.remove(tenant); err != nil {
+				log.Printf("failed to delete the rules of tenant %s: %v", tenant, err)
+			}
+		}
+		return nil, true
+	}
+
+	lastValid, ok := f.lastValid[tenant]
+	if f.spool != nil {
+		ok = f.spool.has(tenant)
+	}
+	if !ok {
+		return nil, false
+	}
+	if t == tombstoneLive {
+		log.Printf("the rules of tenant %s weren't found but the tenant still exists, keeping its last rules", tenant)
+	} else {
+		log.Printf("the rules of tenant %s weren't found by %d fetches in a row, keeping its last rules until it is deleted", tenant, f.notFound[tenant])
+	}
+
+	return lastValid, true
+}
+
+// foundTenant forgets that the rules of a tenant weren't found, once they are. It must be called with parseMtx held.
+func (f *RulesObjstoreFetcher) foundTenant(tenant string) {
+	delete(f.notFound, tenant)
+	if f.deleted[tenant] {
+		log.Printf("tenant %s deleted before has rules again", tenant)
+		delete(f.deleted, tenant)
+		f.deletedTenants.Set(float64(len(f.deleted)))
+	}
+}
@@ -0,0 +1,85 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// srvScheme prefixes the scheme of the URL of a rules backend given by a DNS SRV record,
+// e.g. dnssrv+http://_http._tcp.rules-objstore.observatorium.svc.
+const srvScheme = "dnssrv+"
+
+// NewResolver creates a resolver sending DNS queries to the DNS server at the given address, e.g. 10.0.0.10:53,
+// instead of the ones of the system.
+func NewResolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// WithResolver sets the resolver of the DNS SRV record of a dnssrv+ rules backend URL.
+// If not set, the resolver of the system is used.
+func WithResolver(r *net.Resolver) RulesObjstoreFetcherOption {
+	return func(f *RulesObjstoreFetcher) {
+		f.resolver = r
+	}
+}
+
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// srvTransport sends the requests to the host of a DNS SRV record to a target of the record, resolved on each request
+// so that requests follow the rules backend when it moves, e.g. after a failover.
+type srvTransport struct {
+	next     http.RoundTripper
+	name     string
+	resolver srvResolver
+}
+
+func newSRVTransport(next http.RoundTripper, name string, resolver srvResolver) *srvTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &srvTransport{next: next, name: name, resolver: resolver}
+}
+
+func (t *srvTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Hostname() != t.name {
+		return t.next.RoundTrip(req)
+	}
+
+	// The targets are ordered by priority and randomized by weight.
+	_, addrs, err := t.resolver.LookupSRV(req.Context(), "", "", t.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve SRV record %s: %w", t.name, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("SRV record %s has no targets", t.name)
+	}
+
+	r := req.Clone(req.Context())
+	r.URL.Host = net.JoinHostPort(strings.TrimSuffix(addrs[0].Target, "."), strconv.Itoa(int(addrs[0].Port)))
+	r.Host = ""
+
+	return t.next.RoundTrip(r)
+}
+
+// NewReconnecting returns a Fetcher closing the idle connections to the upstream with closeIdleConnections before each
+// fetch, so that its host is resolved again in each sync instead of keepalive connections pinning a stale address.
+func NewReconnecting(f Fetcher, closeIdleConnections func()) Fetcher {
+	return FetcherFunc(func(ctx context.Context) (io.ReadCloser, error) {
+		closeIdleConnections()
+		return f.GetRules(ctx)
+	})
+}
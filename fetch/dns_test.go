@@ -0,0 +1,98 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSRVResolver struct {
+	addrs []*net.SRV
+	err   error
+}
+
+func (r testSRVResolver) LookupSRV(_ context.Context, _, _, _ string) (string, []*net.SRV, error) {
+	return "", r.addrs, r.err
+}
+
+func TestSRVTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("groups: []"))
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+	port, err := strconv.Atoi(serverURL.Port())
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		url      string
+		resolver testSRVResolver
+
+		expectErr string
+	}{
+		"request sent to the first target": {
+			url: "http://_http._tcp.rules.example/api/v1/rules",
+			resolver: testSRVResolver{addrs: []*net.SRV{
+				{Target: "127.0.0.1.", Port: uint16(port)},
+				{Target: "unreachable.example.", Port: 1},
+			}},
+		},
+		"other hosts are not resolved": {
+			url:      server.URL + "/api/v1/rules",
+			resolver: testSRVResolver{err: errors.New("must not be resolved")},
+		},
+		"failed resolution": {
+			url:       "http://_http._tcp.rules.example/api/v1/rules",
+			resolver:  testSRVResolver{err: errors.New("no such host")},
+			expectErr: "failed to resolve SRV record _http._tcp.rules.example: no such host",
+		},
+		"no targets": {
+			url:       "http://_http._tcp.rules.example/api/v1/rules",
+			expectErr: "SRV record _http._tcp.rules.example has no targets",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client := &http.Client{Transport: newSRVTransport(nil, "_http._tcp.rules.example", tc.resolver)}
+			res, err := client.Get(tc.url)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, "groups: []", string(body))
+		})
+	}
+}
+
+func TestNewReconnecting(t *testing.T) {
+	var calls []string
+	f := NewReconnecting(FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+		calls = append(calls, "fetch")
+		return io.NopCloser(strings.NewReader("groups: []")), nil
+	}), func() {
+		calls = append(calls, "close")
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := f.GetRules(context.Background())
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"close", "fetch", "close", "fetch"}, calls)
+}
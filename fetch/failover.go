@@ -0,0 +1,324 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FailoverEndpoint is an upstream of a FailoverTransport, e.g. the Observatorium API of a region.
+type FailoverEndpoint struct {
+	// Name tells the endpoint apart in logs and metrics, e.g. its region.
+	Name string
+	// URL is the base URL of the endpoint, replacing the one of the primary endpoint in the requests.
+	URL *url.URL
+	// Transport sends the requests to the endpoint, e.g. with its own CA and credentials.
+	Transport http.RoundTripper
+}
+
+// FailoverTransport sends the requests to the active one of several endpoints of the same upstream, listed in order
+// of preference, e.g. the Observatorium APIs of several regions. The active endpoint is sticky: it is only replaced by the
+// next one once it failed a number of requests in a row, and it is replaced by a more preferred endpoint only once
+// that one answered a number of recovery probes in a row, see Run. Requests to other hosts than the one of the first
+// endpoint are sent as is with its transport.
+type FailoverTransport struct {
+	endpoints    []FailoverEndpoint
+	after        int
+	recoverAfter int
+	probePath    string
+	clock        clock.Clock
+
+	mu     sync.Mutex
+	active int
+	// failures is the number of failed requests in a row of the active endpoint.
+	failures int
+	// recoveries are the numbers of successful probes in a row of the endpoints more preferred than the active one.
+	recoveries map[int]int
+
+	activeEndpoint *prometheus.GaugeVec
+	failovers      *prometheus.CounterVec
+	probeFailures  *prometheus.CounterVec
+}
+
+// FailoverOption configures a FailoverTransport.
+type FailoverOption func(*FailoverTransport)
+
+// WithFailoverAfter fails over to the next endpoint once the active one failed the given number of requests in a row.
+func WithFailoverAfter(failures int) FailoverOption {
+	return func(t *FailoverTransport) {
+		t.after = failures
+	}
+}
+
+// WithRecoverAfter switches back to a more preferred endpoint once it answered the given number of probes in a row.
+func WithRecoverAfter(probes int) FailoverOption {
+	return func(t *FailoverTransport) {
+		t.recoverAfter = probes
+	}
+}
+
+// WithProbePath sets the path, relative to the URL of the endpoints, requested by the recovery probes.
+func WithProbePath(path string) FailoverOption {
+	return func(t *FailoverTransport) {
+		t.probePath = path
+	}
+}
+
+// WithFailoverClock sets the clock timing the recovery probes, e.g. a fake clock in tests.
+func WithFailoverClock(c clock.Clock) FailoverOption {
+	return func(t *FailoverTransport) {
+		t.clock = c
+	}
+}
+
+// WithFailoverRegisterer registers the metrics of the FailoverTransport with the given registerer.
+func WithFailoverRegisterer(r prometheus.Registerer) FailoverOption {
+	return func(t *FailoverTransport) {
+		if r != nil {
+			r.MustRegister(t.activeEndpoint, t.failovers, t.probeFailures)
+		}
+	}
+}
+
+// NewFailoverTransport creates a new FailoverTransport over the given endpoints, the first one being active.
+func NewFailoverTransport(endpoints []FailoverEndpoint, opts ...FailoverOption) (*FailoverTransport, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("failover requires at least one endpoint")
+	}
+	names := map[string]bool{}
+	for _, e := range endpoints {
+		if e.URL == nil || e.URL.Host == "" {
+			return nil, fmt.Errorf("endpoint %s has no URL", e.Name)
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("duplicate endpoint %s", e.Name)
+		}
+		names[e.Name] = true
+	}
+
+	t := &FailoverTransport{
+		endpoints:    endpoints,
+		after:        3,
+		recoverAfter: 3,
+		probePath:    "/",
+		clock:        clock.Real(),
+		recoveries:   map[int]int{},
+		activeEndpoint: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_upstream_active",
+			Help: "Whether the upstream endpoint is the active one the requests are sent to. 1 if it is, 0 otherwise.",
+		}, []string{"upstream"}),
+		failovers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_upstream_failovers_total",
+			Help: "Total number of switches of the active upstream endpoint, by endpoint switched from and to.",
+		}, []string{"from", "to"}),
+		probeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_upstream_probe_failures_total",
+			Help: "Total number of failed recovery probes of the upstream endpoints more preferred than the active one.",
+		}, []string{"upstream"}),
+	}
+	for _, e := range endpoints {
+		t.activeEndpoint.WithLabelValues(e.Name).Set(0)
+	}
+	t.activeEndpoint.WithLabelValues(endpoints[0].Name).Set(1)
+
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.after = max(t.after, 1)
+	t.recoverAfter = max(t.recoverAfter, 1)
+
+	return t, nil
+}
+
+// Active returns the name of the active endpoint.
+func (t *FailoverTransport) Active() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.endpoints[t.active].Name
+}
+
+// RoundTrip sends the request to the active endpoint. Once the active endpoint failed too many requests in a row,
+// the next endpoint becomes active and requests without a body are sent to it again right away.
+func (t *FailoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	primary := t.endpoints[0].URL
+	if req.URL.Scheme != primary.Scheme || req.URL.Host != primary.Host {
+		return t.endpoints[0].Transport.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	active := t.active
+	t.mu.Unlock()
+
+	res, err := t.send(req, active)
+	if !endpointFailed(res, err) {
+		t.succeeded(active)
+		return res, err
+	}
+
+	next, ok := t.failed(active, res, err)
+	if !ok || req.Context().Err() != nil || (req.Body != nil && req.Body != http.NoBody) {
+		return res, err
+	}
+	if res != nil {
+		_, _ = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	res, err = t.send(req, next)
+	if !endpointFailed(res, err) {
+		t.succeeded(next)
+	}
+
+	return res, err
+}
+
+// send sends the request to the endpoint of the given index.
+func (t *FailoverTransport) send(req *http.Request, endpoint int) (*http.Response, error) {
+	e := t.endpoints[endpoint]
+	if endpoint == 0 {
+		return e.Transport.RoundTrip(req)
+	}
+
+	r := req.Clone(req.Context())
+	r.URL.Scheme, r.URL.Host = e.URL.Scheme, e.URL.Host
+	r.URL.Path = strings.TrimSuffix(e.URL.Path, "/") + strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(t.endpoints[0].URL.Path, "/"))
+	r.URL.RawPath = ""
+	r.Host = ""
+
+	return e.Transport.RoundTrip(r)
+}
+
+// endpointFailed returns whether the response of an endpoint is a failure of the endpoint rather than of the request.
+func endpointFailed(res *http.Response, err error) bool {
+	return err != nil || res.StatusCode >= http.StatusInternalServerError
+}
+
+// succeeded resets the failures of the endpoint if it is still the active one.
+func (t *FailoverTransport) succeeded(endpoint int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if endpoint == t.active {
+		t.failures = 0
+	}
+}
+
+// failed counts a failure of the endpoint if it is still the active one, and fails over to the next endpoint once it failed
+// too many requests in a row. It returns the endpoint to send the request to again, if the active one changed.
+func (t *FailoverTransport) failed(endpoint int, res *http.Response, err error) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if endpoint != t.active {
+		// Another request already failed over, so this one can be sent again to the new active endpoint.
+		return t.active, true
+	}
+	t.failures++
+	if t.failures < t.after || len(t.endpoints) == 1 {
+		return 0, false
+	}
+
+	var reason string
+	if err != nil {
+		reason = err.Error()
+	} else {
+		reason = fmt.Sprintf("got unexpected status %d", res.StatusCode)
+	}
+	next := (t.active + 1) % len(t.endpoints)
+	log.Printf("upstream endpoint %s failed %d requests in a row, failing over to %s: %s", t.endpoints[t.active].Name, t.failures, t.endpoints[next].Name, reason)
+	t.switchTo(next)
+
+	return next, true
+}
+
+// switchTo makes the endpoint of the given index active. It must be called with mu held.
+func (t *FailoverTransport) switchTo(endpoint int) {
+	t.failovers.WithLabelValues(t.endpoints[t.active].Name, t.endpoints[endpoint].Name).Inc()
+	t.activeEndpoint.WithLabelValues(t.endpoints[t.active].Name).Set(0)
+	t.activeEndpoint.WithLabelValues(t.endpoints[endpoint].Name).Set(1)
+	t.active, t.failures = endpoint, 0
+	clear(t.recoveries)
+}
+
+// Run probes the endpoints more preferred than the active one at the given interval until the context is cancelled.
+func (t *FailoverTransport) Run(ctx context.Context, interval time.Duration) error {
+	ticker := t.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+			t.Probe(ctx)
+		}
+	}
+}
+
+// Probe requests the probe path of the endpoints more preferred than the active one, and switches back to the most
+// preferred of them that answered enough probes in a row. An endpoint answers a probe if it responds without a server error.
+func (t *FailoverTransport) Probe(ctx context.Context) {
+	t.mu.Lock()
+	active := t.active
+	t.mu.Unlock()
+
+	for i := 0; i < active; i++ {
+		err := t.probe(ctx, i)
+		if err != nil {
+			t.probeFailures.WithLabelValues(t.endpoints[i].Name).Inc()
+		}
+
+		t.mu.Lock()
+		if t.active != active {
+			t.mu.Unlock()
+			return
+		}
+		if err != nil {
+			t.recoveries[i] = 0
+			t.mu.Unlock()
+			continue
+		}
+		t.recoveries[i]++
+		if t.recoveries[i] >= t.recoverAfter {
+			log.Printf("upstream endpoint %s answered %d probes in a row, switching back to it from %s", t.endpoints[i].Name, t.recoveries[i], t.endpoints[active].Name)
+			t.switchTo(i)
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Unlock()
+	}
+}
+
+// probe requests the probe path of the endpoint of the given index.
+func (t *FailoverTransport) probe(ctx context.Context, endpoint int) error {
+	u := *t.endpoints[endpoint].URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(t.probePath, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	res, err := t.endpoints[endpoint].Transport.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("failed to do http request: %w", err)
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return &StatusError{Source: t.endpoints[endpoint].Name, StatusCode: res.StatusCode}
+	}
+
+	return nil
+}
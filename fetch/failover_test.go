@@ -0,0 +1,145 @@
+package fetch_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// failoverServer is an endpoint of a FailoverTransport failing with 503 Service Unavailable while down.
+type failoverServer struct {
+	*httptest.Server
+	down  atomic.Bool
+	paths chan string
+}
+
+func newFailoverServer(t *testing.T, name string) *failoverServer {
+	s := &failoverServer{paths: make(chan string, 100)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.paths <- r.URL.Path
+		if s.down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(name))
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *failoverServer) endpoint(t *testing.T, name, path string) fetch.FailoverEndpoint {
+	u, err := url.Parse(s.URL + path)
+	assert.NoError(t, err)
+
+	return fetch.FailoverEndpoint{Name: name, URL: u, Transport: http.DefaultTransport}
+}
+
+func TestFailoverTransport(t *testing.T) {
+	primary, standby := newFailoverServer(t, "primary"), newFailoverServer(t, "standby")
+	reg := prometheus.NewRegistry()
+	transport, err := fetch.NewFailoverTransport([]fetch.FailoverEndpoint{
+		primary.endpoint(t, "primary", "/primary"),
+		standby.endpoint(t, "standby", "/standby/"),
+	}, fetch.WithFailoverAfter(2), fetch.WithRecoverAfter(2), fetch.WithProbePath("/-/healthy"), fetch.WithFailoverRegisterer(reg))
+	assert.NoError(t, err)
+	client := &http.Client{Transport: transport}
+
+	get := func() (int, string) {
+		res, err := client.Get(primary.URL + "/primary/api/v1/rules?tenant=a")
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+	lastPath := func(s *failoverServer) string {
+		var path string
+		for len(s.paths) > 0 {
+			path = <-s.paths
+		}
+		return path
+	}
+
+	status, body := get()
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "primary", body)
+
+	// The active endpoint is only replaced once it failed enough requests in a row.
+	primary.down.Store(true)
+	status, _ = get()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "primary", transport.Active())
+
+	// The request failing over is sent again to the standby endpoint, with its base path.
+	status, body = get()
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "standby", body)
+	assert.Equal(t, "standby", transport.Active())
+	assert.Equal(t, "/standby/api/v1/rules", lastPath(standby))
+
+	// The standby endpoint stays active until the primary one answered enough probes in a row.
+	transport.Probe(context.Background())
+	assert.Equal(t, "/primary/-/healthy", lastPath(primary))
+	primary.down.Store(false)
+	transport.Probe(context.Background())
+	assert.Equal(t, "standby", transport.Active())
+	_, body = get()
+	assert.Equal(t, "standby", body)
+
+	transport.Probe(context.Background())
+	assert.Equal(t, "primary", transport.Active())
+	_, body = get()
+	assert.Equal(t, "primary", body)
+	assert.Equal(t, "/primary/api/v1/rules", lastPath(primary))
+
+	// The standby endpoint isn't probed while the primary one is active.
+	lastPath(standby)
+	transport.Probe(context.Background())
+	assert.Empty(t, standby.paths)
+
+	expected := `
+# HELP thanos_rule_syncer_upstream_active Whether the upstream endpoint is the active one the requests are sent to. 1 if it is, 0 otherwise.
+# TYPE thanos_rule_syncer_upstream_active gauge
+thanos_rule_syncer_upstream_active{upstream="primary"} 1
+thanos_rule_syncer_upstream_active{upstream="standby"} 0
+# HELP thanos_rule_syncer_upstream_failovers_total Total number of switches of the active upstream endpoint, by endpoint switched from and to.
+# TYPE thanos_rule_syncer_upstream_failovers_total counter
+thanos_rule_syncer_upstream_failovers_total{from="primary",to="standby"} 1
+thanos_rule_syncer_upstream_failovers_total{from="standby",to="primary"} 1
+# HELP thanos_rule_syncer_upstream_probe_failures_total Total number of failed recovery probes of the upstream endpoints more preferred than the active one.
+# TYPE thanos_rule_syncer_upstream_probe_failures_total counter
+thanos_rule_syncer_upstream_probe_failures_total{upstream="primary"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "thanos_rule_syncer_upstream_active", "thanos_rule_syncer_upstream_failovers_total", "thanos_rule_syncer_upstream_probe_failures_total"))
+}
+
+func TestFailoverTransportOtherHosts(t *testing.T) {
+	primary, other := newFailoverServer(t, "primary"), newFailoverServer(t, "other")
+	primary.down.Store(true)
+
+	transport, err := fetch.NewFailoverTransport([]fetch.FailoverEndpoint{
+		primary.endpoint(t, "primary", ""),
+		newFailoverServer(t, "standby").endpoint(t, "standby", ""),
+	}, fetch.WithFailoverAfter(1))
+	assert.NoError(t, err)
+	client := &http.Client{Transport: transport}
+
+	// Requests to other hosts, e.g. fallback sources, neither fail over nor count as failures of the endpoints.
+	res, err := client.Get(other.URL + "/api/v1/rules")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "primary", transport.Active())
+	assert.Equal(t, "/api/v1/rules", <-other.paths)
+}
@@ -0,0 +1,88 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Fallback fetches rules from a primary fetcher, and from a fallback one while the primary has been failing
+// for a number of times in a row, e.g. from a secondary region during an outage of the primary one.
+// The primary fetcher is tried first every time, so that it is used again as soon as it recovers.
+type Fallback struct {
+	primary Fetcher
+	after   int
+
+	mu       sync.Mutex
+	fallback Fetcher
+	failures int
+}
+
+// NewFallback creates a new Fallback using the fallback fetcher after the given number of failures
+// of the primary one in a row.
+func NewFallback(primary, fallback Fetcher, after int) *Fallback {
+	return &Fallback{
+		primary:  primary,
+		fallback: fallback,
+		after:    max(after, 1),
+	}
+}
+
+// SetFallback replaces the fallback fetcher, keeping the count of failures of the primary one.
+// This method is thread-safe.
+func (f *Fallback) SetFallback(fallback Fetcher) {
+	f.mu.Lock()
+	f.fallback = fallback
+	f.mu.Unlock()
+}
+
+// GetRules fetches the rules from the primary fetcher, or from the fallback one if the primary failed
+// for the configured number of times in a row.
+func (f *Fallback) GetRules(ctx context.Context) (io.ReadCloser, error) {
+	rules, err := f.primary.GetRules(ctx)
+
+	f.mu.Lock()
+	if err == nil {
+		f.failures = 0
+		f.mu.Unlock()
+		return rules, nil
+	}
+	f.failures++
+	failures, fallback := f.failures, f.fallback
+	f.mu.Unlock()
+
+	if failures < f.after || fallback == nil {
+		return nil, err
+	}
+
+	log.Printf("primary rules source failed %d times in a row, using the fallback one: %v", failures, err)
+	rules, fallbackErr := fallback.GetRules(ctx)
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("%w; fallback failed too: %v", err, fallbackErr)
+	}
+
+	return rules, nil
+}
+
+// FileFetcher fetches rules from a file, e.g. a snapshot of the rules of a tenant.
+type FileFetcher struct {
+	path string
+}
+
+// NewFileFetcher creates a new FileFetcher reading rules from the given path.
+func NewFileFetcher(path string) *FileFetcher {
+	return &FileFetcher{path: path}
+}
+
+// GetRules opens the file.
+func (f *FileFetcher) GetRules(_ context.Context) (io.ReadCloser, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rules file: %w", err)
+	}
+
+	return file, nil
+}
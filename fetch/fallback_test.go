@@ -0,0 +1,59 @@
+package fetch_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFallback(t *testing.T) {
+	var primaryErr error
+	primary := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+		if primaryErr != nil {
+			return nil, primaryErr
+		}
+		return io.NopCloser(strings.NewReader("primary")), nil
+	})
+	fallback := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("fallback")), nil
+	})
+	f := fetch.NewFallback(primary, fallback, 2)
+
+	getRules := func() (string, error) {
+		rules, err := f.GetRules(context.Background())
+		if err != nil {
+			return "", err
+		}
+		defer rules.Close()
+
+		content, err := io.ReadAll(rules)
+		return string(content), err
+	}
+
+	content, err := getRules()
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", content)
+
+	// The fallback is used once the primary failed twice in a row.
+	primaryErr = errors.New("region outage")
+	_, err = getRules()
+	assert.Error(t, err)
+	content, err = getRules()
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback", content)
+
+	// The primary is used again as soon as it recovers.
+	primaryErr = nil
+	content, err = getRules()
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", content)
+
+	primaryErr = errors.New("region outage")
+	_, err = getRules()
+	assert.Error(t, err)
+}
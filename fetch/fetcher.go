@@ -0,0 +1,1093 @@
+// Package fetch fetches the rules of tenants from the Observatorium API or from the rules-objstore.
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rulesspec "github.com/observatorium/api/rules"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v3"
+)
+
+// Fetcher fetches rules.
+type Fetcher interface {
+	GetRules(ctx context.Context) (rules io.ReadCloser, err error)
+}
+
+// FetcherFunc is an adapter to use ordinary functions as Fetchers.
+type FetcherFunc func(ctx context.Context) (rules io.ReadCloser, err error)
+
+// GetRules calls f(ctx).
+func (f FetcherFunc) GetRules(ctx context.Context) (rules io.ReadCloser, err error) {
+	return f(ctx)
+}
+
+// StatusError is returned when a rules source responds with an unexpected status.
+type StatusError struct {
+	// Source describes the rules source, e.g. Observatorium API.
+	Source     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("got unexpected status from %s: %d", e.Source, e.StatusCode)
+}
+
+// IsAuthError returns whether the error is due to the credentials of the syncer: a rules source responding
+// with 401 Unauthorized or 403 Forbidden, or a failed exchange of an OIDC token.
+func IsAuthError(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr)
+}
+
+// DefaultConcurrency returns the default number of tenants whose rules are fetched concurrently.
+// Fetching is I/O bound, so it is a multiple of GOMAXPROCS, which reflects the CPU quota of the
+// container when set by automaxprocs.
+func DefaultConcurrency() int {
+	return 4 * runtime.GOMAXPROCS(0)
+}
+
+// RulesObjstoreFetcher fetches rules for all configured tenants from the rules-objstore.
+type RulesObjstoreFetcher struct {
+	client      rulesspec.ClientInterface
+	tenants     []string
+	tenantsMtx  sync.Mutex
+	concurrency int
+	// concurrencyMtx guards concurrency, which can be changed at runtime, see SetConcurrency.
+	concurrencyMtx sync.Mutex
+
+	// fallbacks are the fetchers of the tenants with a fallback source.
+	fallbacks     map[string]*Fallback
+	fallbacksMtx  sync.Mutex
+	fallbackAfter int
+
+	// included are the documents included in the rules of tenants, see SetIncludedRules.
+	included    map[string][]IncludedRules
+	includedMtx sync.Mutex
+
+	// watch enables fetching only the rules of tenants that changed, see WithWatch.
+	watch            bool
+	baseURL          *url.URL
+	httpClient       *http.Client
+	watched          map[string]watchedTenant
+	watchMtx         sync.Mutex
+	changeFeedAbsent bool
+
+	// batchSize is the number of tenants whose rules are listed by a request to the batch endpoint, see WithBatchSize.
+	batchSize   int
+	batchAbsent bool
+	batchMtx    sync.Mutex
+
+	// observatoriumAPI fetches the rules of each tenant from the Observatorium API at the base URL instead of
+	// the rules-objstore, see NewObservatoriumAPITenantsFetcher, and tenantClients are the clients fetching
+	// the rules of tenants with their own, see SetTenantClients.
+	observatoriumAPI bool
+	tenantClients    map[string]*http.Client
+	tenantClientsMtx sync.Mutex
+
+	// resolver resolves the DNS SRV record of a dnssrv+ base URL, see WithResolver.
+	resolver *net.Resolver
+
+	// resumeAttempts is the number of times an interrupted download of all rules is resumed, see WithResumeAttempts.
+	resumeAttempts int
+	partial        partialDownload
+	partialMtx     sync.Mutex
+
+	modTimes modTimes
+
+	// shuffle randomizes the order in which tenants are fetched, see WithShuffle.
+	shuffle    *rand.Rand
+	shuffleMtx sync.Mutex
+	// lastAttempted is when the fetch of the rules of each tenant last started.
+	lastAttempted    map[string]time.Time
+	lastAttemptedMtx sync.Mutex
+	// lastValid are the last rules of each tenant that parsed, served while its rules are invalid or not found,
+	// unless they are kept in the spool, and parseErrors are the errors of the tenants whose rules are invalid.
+	lastValid   map[string][]rules.RuleGroup
+	parseErrors map[string]string
+	// notFound are the numbers of fetches in a row not finding the rules of tenants, and deleted are the tenants
+	// deleted since, see WithNotFoundThreshold and WithTombstones.
+	notFoundThreshold int
+	tombstones        bool
+	notFound          map[string]int
+	deleted           map[string]bool
+	// ruleLimits are the maximum numbers of rules of tenants, see SetRuleLimits.
+	ruleLimits map[string]int
+	// spool keeps the rules of tenants in files, see WithSpoolDir.
+	spool *spool
+	// parseMtx guards the last valid rules, the spool, the parse errors, the tenants not found and the rule limits.
+	parseMtx sync.Mutex
+
+	queueDepth       prometheus.Gauge
+	concurrencyGauge prometheus.GaugeFunc
+	inFlight         prometheus.Gauge
+	unchangedTenants prometheus.Counter
+	batchRequests    *prometheus.CounterVec
+	resumedDownloads prometheus.Counter
+	abortedTenants   *prometheus.CounterVec
+	tenantParseErrs  *prometheus.CounterVec
+	tenantsNotFound  *prometheus.CounterVec
+	deletedTenants   prometheus.Gauge
+}
+
+// watchedTenant is the version of the rules of a tenant in the change feed of the rules backend
+// when they were last fetched, along with their groups.
+type watchedTenant struct {
+	version string
+	groups  []rules.RuleGroup
+}
+
+// maxParseErrorSize is the size of the error of invalid rules of a tenant kept for its status.
+const maxParseErrorSize = 1 << 10
+
+// RulesObjstoreFetcherOption configures a RulesObjstoreFetcher.
+type RulesObjstoreFetcherOption func(*RulesObjstoreFetcher)
+
+// WithConcurrency sets the number of tenants whose rules are fetched concurrently.
+// Values lower than 1 keep the DefaultConcurrency.
+func WithConcurrency(concurrency int) RulesObjstoreFetcherOption {
+	return func(f *RulesObjstoreFetcher) {
+		if concurrency > 0 {
+			f.concurrency = concurrency
+		}
+	}
+}
+
+// WithFallbackAfter sets the number of failures in a row of the rules-objstore for a tenant
+// after which its fallback source is used, see SetFallbacks.
+func WithFallbackAfter(failures int) RulesObjstoreFetcherOption {
+	return func(f *RulesObjstoreFetcher) {
+		f.fallbackAfter = failures
+	}
+}
+
+// WithWatch enables fetching only the rules of tenants that changed since they were last fetched according to
+// the change feed of the rules backend, reducing the requests of each sync from one per tenant to one per changed tenant.
+// The rules of all tenants are fetched if the rules backend has no change feed.
+func WithWatch(watch bool) RulesObjstoreFetcherOption {
+	return func(f *RulesObjstoreFetcher) {
+		f.watch = watch
+	}
+}
+
+// WithResumeAttempts sets the number of times an interrupted download of all rules is resumed with a range request
+// in a call to GetAllRules, instead of starting over. A download still interrupted is resumed on the next call.
+// Downloads are only resumed if the rules backend supports range requests and sets a strong ETag, and are checked
+// against the SHA-256 digest of the rules if it sets one. If 0, downloads are not resumed.
+func WithResumeAttempts(attempts int) RulesObjstoreFetcherOption {
+	return func(f *RulesObjstoreFetcher) {
+		f.resumeAttempts = attempts
+	}
+}
+
+// WithShuffle randomizes the order in which the rules of tenants are fetched on each call to GetTenantsRules
+// with the given source, so that the same tenants aren't always fetched last, and the first ones to run out of time.
+// If nil, tenants are fetched in the order they are set.
+func WithShuffle(src rand.Source) RulesObjstoreFetcherOption {
+	return func(f *RulesObjstoreFetcher) {
+		f.shuffle = nil
+		if src != nil {
+			f.shuffle = rand.New(src)
+		}
+	}
+}
+
+// WithRegisterer registers the metrics of the RulesObjstoreFetcher with the given registerer.
+func WithRegisterer(r prometheus.Registerer) RulesObjstoreFetcherOption {
+	return func(f *RulesObjstoreFetcher) {
+		r.MustRegister(f.queueDepth, f.concurrencyGauge, f.inFlight, f.unchangedTenants, f.batchRequests, f.resumedDownloads, f.abortedTenants, f.tenantParseErrs, f.tenantsNotFound, f.deletedTenants)
+	}
+}
+
+// NewRulesObjstoreFetcher creates a new RulesObjtoreFetcher.
+// The tenants list must be deduplicated otherwise, rules groups will not be unique.
+func NewRulesObjstoreFetcher(baseURL string, tenants []string, client *http.Client, opts ...RulesObjstoreFetcherOption) (*RulesObjstoreFetcher, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	baseURLParsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RulesObjtoreFetcher URL: %w", err)
+	}
+	// The URL scheme is reserved to select a gRPC fetcher once the rules-objstore exposes a gRPC API.
+	if baseURLParsed.Scheme == "grpc" || baseURLParsed.Scheme == "grpcs" {
+		return nil, fmt.Errorf("unsupported rules backend URL %s: the rules-objstore has no gRPC API, use its HTTP API", baseURL)
+	}
+	scheme, srv := strings.CutPrefix(baseURLParsed.Scheme, srvScheme)
+	baseURLParsed.Scheme = scheme
+
+	f := &RulesObjstoreFetcher{
+		tenants:       tenants,
+		concurrency:   DefaultConcurrency(),
+		fallbacks:     map[string]*Fallback{},
+		lastAttempted: map[string]time.Time{},
+		lastValid:     map[string][]rules.RuleGroup{},
+		parseErrors:   map[string]string{},
+		notFound:      map[string]int{},
+		deleted:       map[string]bool{},
+		baseURL:       baseURLParsed,
+		resolver:      net.DefaultResolver,
+		queueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_fetch_queue_depth",
+			Help: "Number of tenants waiting for their rules to be fetched.",
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_fetch_in_flight",
+			Help: "Number of tenants whose rules are being fetched.",
+		}),
+		unchangedTenants: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_fetch_unchanged_tenants_total",
+			Help: "Number of fetches of the rules of tenants skipped because the change feed of the rules backend reported them unchanged.",
+		}),
+		batchRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_fetch_batch_requests_total",
+			Help: "Number of requests listing the rules of a batch of tenants from the batch endpoint of the rules backend, by result.",
+		}, []string{"result"}),
+		resumedDownloads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_fetch_resumed_downloads_total",
+			Help: "Number of interrupted downloads of all rules resumed with a range request.",
+		}),
+		abortedTenants: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_fetch_aborted_tenants_total",
+			Help: "Number of fetches of the rules of tenants aborted because their share of the time of the fetch ran out, by tenant.",
+		}, []string{"tenant"}),
+		tenantParseErrs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_tenant_parse_errors_total",
+			Help: "Number of fetches of invalid rules of tenants, replaced with the last valid rules of the tenant, by tenant.",
+		}, []string{"tenant"}),
+		tenantsNotFound: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_fetch_tenant_not_found_total",
+			Help: "Number of fetches not finding the rules of tenants, replaced with their last rules until they are deleted, by tenant.",
+		}, []string{"tenant"}),
+		deletedTenants: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_fetch_deleted_tenants",
+			Help: "Number of tenants whose rules were deleted because the tenant was deleted from the rules backend.",
+		}),
+	}
+
+	f.concurrencyGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "thanos_rule_syncer_fetch_concurrency",
+		Help: "Number of tenants whose rules are fetched concurrently.",
+	}, func() float64 {
+		return float64(f.Concurrency())
+	})
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	if f.spool != nil {
+		if err := os.MkdirAll(f.spool.dir, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create spool directory: %w", err)
+		}
+	}
+
+	if srv {
+		srvClient := *client
+		srvClient.Transport = newSRVTransport(client.Transport, baseURLParsed.Hostname(), f.resolver)
+		client = &srvClient
+	}
+	f.httpClient = client
+
+	f.client, err = rulesspec.NewClient(baseURLParsed.String(), rulesspec.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rules-objstore client: %w", err)
+	}
+
+	return f, nil
+}
+
+type tenantFetchResult struct {
+	tenant string
+	body   []byte
+	// included are the contents of the documents included in the rules of the tenant, in order.
+	included [][]byte
+	err      error
+	// tombstone tells whether the tenant was deleted when its rules weren't found.
+	tombstone tombstone
+}
+
+// GetTenantsRules fetches rules for all configured tenants from the rules-objstore.
+// With WithWatch, the rules of tenants unchanged since they were last fetched are reused instead of being fetched again.
+// With WithSpoolDir, the rules are read from the fragments of the tenants.
+// The tenants whose fetch was aborted keep their last valid rules, and are reported by TenantErrors, see fetchTenants.
+func (f *RulesObjstoreFetcher) GetTenantsRules(ctx context.Context) (io.ReadCloser, error) {
+	// tenants can be changed concurrently, we copy the list to avoid locking for too long.
+	f.tenantsMtx.Lock()
+	tenants := make([]string, len(f.tenants))
+	copy(tenants, f.tenants)
+	f.tenantsMtx.Unlock()
+
+	changed, versions := tenants, map[string]string(nil)
+	if f.watch {
+		changed, versions = f.changedTenants(ctx, tenants)
+	}
+
+	fetched, aborted, err := f.fetchTenants(ctx, changed, f.batchRules(ctx, changed))
+	if err != nil {
+		return nil, err
+	}
+	f.forgetRemovedTenants(tenants)
+
+	// The aborted tenants aren't fetched, so that their last rules are used: the watched ones, the ones of their fragment,
+	// or their last valid ones.
+	var groups []rules.RuleGroup
+	if f.watch {
+		groups = f.updateWatched(tenants, fetched, versions)
+	}
+	if f.spool != nil {
+		return withTenantErrors(f.spool.open(tenants), aborted), nil
+	}
+	if !f.watch {
+		for _, tenant := range tenants {
+			tenantGroups, ok := fetched[tenant]
+			if !ok {
+				tenantGroups = f.lastValidRules(tenant)
+			}
+			groups = append(groups, tenantGroups...)
+		}
+	}
+
+	returnData, err := yaml.Marshal(rules.RuleGroups{Groups: groups})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	ret := io.NopCloser(bytes.NewReader(returnData))
+	return withTenantErrors(ret, aborted), nil
+}
+
+// fetchedRules are fetched rules including the last rules of tenants whose fetch failed, see TenantErrors.
+type fetchedRules struct {
+	io.ReadCloser
+	tenantErrs []*rules.TenantError
+}
+
+// withTenantErrors returns the fetched rules along with the errors of the tenants whose last rules they include, if any.
+func withTenantErrors(fetched io.ReadCloser, tenantErrs []*rules.TenantError) io.ReadCloser {
+	if len(tenantErrs) == 0 {
+		return fetched
+	}
+
+	return &fetchedRules{ReadCloser: fetched, tenantErrs: tenantErrs}
+}
+
+// TenantErrors returns the errors of the tenants of the rules fetched by a fetcher whose last rules were fetched
+// instead of failing the fetch, e.g. because their fetch was aborted, see RulesObjstoreFetcher.GetTenantsRules.
+func TenantErrors(fetched io.Reader) []*rules.TenantError {
+	if r, ok := fetched.(*fetchedRules); ok {
+		return r.tenantErrs
+	}
+
+	return nil
+}
+
+// fetchTenants fetches the rules of the given tenants concurrently, returning their groups by tenant
+// with their names prefixed with the tenant. The rules of the tenants in batched, listed by the batch endpoint,
+// aren't fetched again. With the spool, the groups are written to the fragments of the tenants
+// instead, and are nil.
+// If the context has a deadline, each tenant gets a fair share of the time left when its fetch starts, see tenantContext,
+// and the fetches of the tenants running out of it are aborted. The aborted tenants are returned with their errors,
+// without groups, if they all have last valid rules to keep, and fail the fetch together once the other tenants are
+// fetched otherwise, e.g. when they weren't fetched since the start. Other errors are returned right away.
+func (f *RulesObjstoreFetcher) fetchTenants(ctx context.Context, tenants []string, batched map[string][]byte) (map[string][]rules.RuleGroup, []*rules.TenantError, error) {
+	tenants = f.fetchOrder(tenants)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := f.Concurrency()
+	var sem = make(chan struct{}, concurrency)
+	results := make(chan tenantFetchResult)
+	// consumed is closed once the results aren't consumed anymore, so that they aren't sent.
+	consumed := make(chan struct{})
+	defer close(consumed)
+	send := func(result tenantFetchResult) {
+		select {
+		case results <- result:
+		case <-consumed:
+		}
+	}
+	// finished is the number of tenants whose fetch is over.
+	var finished atomic.Int64
+
+	// Launch goroutines that fetch rules for each tenant concurrently.
+	go func() {
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait() // Wait for all goroutines to finish before closing results channel.
+			close(results)
+		}()
+
+		f.queueDepth.Add(float64(len(tenants)))
+		for i, tenantID := range tenants {
+			// Use semaphore to limit concurrency, and return early if context is cancelled.
+			select {
+			case <-ctx.Done():
+				f.queueDepth.Sub(float64(len(tenants) - i))
+				for _, tenantID := range tenants[i:] {
+					send(tenantFetchResult{tenant: tenantID, err: &abortedError{ctx.Err()}})
+				}
+				return
+			case sem <- struct{}{}:
+			}
+			f.queueDepth.Dec()
+			f.inFlight.Inc()
+			f.attempted(tenantID)
+
+			tenantCtx, tenantCancel := f.tenantContext(ctx, len(tenants)-int(finished.Load()), concurrency)
+
+			// Launch goroutine to fetch rules for a tenant.
+			wg.Add(1)
+			go func(tenantID string) {
+				defer func() {
+					tenantCancel()
+					finished.Add(1)
+					wg.Done()
+					f.inFlight.Dec()
+					<-sem
+				}()
+				body, ok := batched[tenantID]
+				var err error
+				if !ok {
+					body, err = f.fetchTenant(tenantCtx, tenantID)
+				}
+				if err != nil && tenantCtx.Err() != nil {
+					// The share of the tenant, or the time of the whole fetch, ran out.
+					err = &abortedError{err}
+				}
+				var t tombstone
+				if isNotFound(err) {
+					t = f.tombstoneOf(tenantCtx, tenantID)
+				}
+				var included [][]byte
+				if err == nil {
+					included, err = f.fetchIncluded(tenantCtx, tenantID)
+					if err != nil && tenantCtx.Err() != nil {
+						err = &abortedError{err}
+					}
+				}
+				send(tenantFetchResult{tenant: tenantID, body: body, included: included, err: err, tombstone: t})
+			}(tenantID)
+		}
+	}()
+
+	// Consume results and return on the first error other than aborted fetches.
+	// Returning cancels the context, which in turn cancels all goroutines.
+	groups := make(map[string][]rules.RuleGroup, len(tenants))
+	var aborted []*rules.TenantError
+	// kept is whether all the aborted tenants have last valid rules.
+	kept := true
+	for result := range results {
+		var abortedErr *abortedError
+		if errors.As(result.err, &abortedErr) {
+			f.abortedTenants.WithLabelValues(result.tenant).Inc()
+			aborted = append(aborted, &rules.TenantError{Tenant: result.tenant, Err: abortedErr.err})
+			kept = kept && f.hasLastValidRules(result.tenant)
+			continue
+		}
+		if isNotFound(result.err) {
+			if tenantGroups, ok := f.notFoundTenant(result.tenant, result.tombstone); ok {
+				groups[result.tenant] = tenantGroups
+				continue
+			}
+		}
+		if result.err != nil {
+			return nil, nil, &rules.TenantError{Tenant: result.tenant, Err: result.err}
+		}
+
+		tenantGroups, err := f.parseTenant(result.tenant, result.body, result.included)
+		if err != nil {
+			return nil, nil, &rules.TenantError{Tenant: result.tenant, Err: err}
+		}
+		groups[result.tenant] = tenantGroups
+	}
+
+	if len(aborted) == 0 {
+		return groups, nil, nil
+	}
+	errs := make([]error, 0, len(aborted))
+	for _, tenantErr := range aborted {
+		errs = append(errs, tenantErr)
+	}
+	err := fmt.Errorf("aborted fetching the rules of %d of %d tenants: %w", len(aborted), len(tenants), errors.Join(errs...))
+	if !kept {
+		return nil, nil, err
+	}
+	log.Printf("%v, keeping their last valid rules", err)
+
+	return groups, aborted, nil
+}
+
+// hasLastValidRules tells whether the tenant has last valid rules, in its fragment with the spool.
+func (f *RulesObjstoreFetcher) hasLastValidRules(tenant string) bool {
+	f.parseMtx.Lock()
+	defer f.parseMtx.Unlock()
+
+	if f.spool != nil {
+		return f.spool.has(tenant)
+	}
+	_, ok := f.lastValid[tenant]
+	return ok
+}
+
+// lastValidRules returns the last valid rules of the tenant, if any.
+func (f *RulesObjstoreFetcher) lastValidRules(tenant string) []rules.RuleGroup {
+	f.parseMtx.Lock()
+	defer f.parseMtx.Unlock()
+
+	return f.lastValid[tenant]
+}
+
+// parseTenant parses the rules of a tenant, along with the groups of the documents they include, with their group names
+// prefixed with the tenant. If they are invalid or
+// exceed the rule limit of the tenant, the error is recorded and counted, and the last valid rules of the tenant are
+// returned, if any, so that a tenant uploading invalid rules doesn't fail the sync of the others.
+// With the spool, valid rules are written to the fragment of the tenant instead, and invalid ones keep it.
+func (f *RulesObjstoreFetcher) parseTenant(tenant string, body []byte, included [][]byte) ([]rules.RuleGroup, error) {
+	rulesParsed, errs := rules.Parse(body)
+	for i, content := range included {
+		includedParsed, includedErrs := rules.Parse(content)
+		for _, err := range includedErrs {
+			errs = append(errs, fmt.Errorf("included rules %d: %w", i+1, err))
+		}
+		if len(errs) > 0 {
+			continue
+		}
+		for _, group := range includedParsed.Groups {
+			if slices.ContainsFunc(rulesParsed.Groups, func(g rules.RuleGroup) bool { return g.Name == group.Name }) {
+				errs = append(errs, fmt.Errorf("included rules %d: group %q is already defined", i+1, group.Name))
+			}
+		}
+		rulesParsed.Groups = append(rulesParsed.Groups, includedParsed.Groups...)
+	}
+
+	f.parseMtx.Lock()
+	defer f.parseMtx.Unlock()
+
+	f.foundTenant(tenant)
+	if limit := f.ruleLimits[tenant]; len(errs) == 0 && limit > 0 {
+		count := 0
+		for _, group := range rulesParsed.Groups {
+			count += len(group.Rules)
+		}
+		if count > limit {
+			errs = append(errs, fmt.Errorf("%d rules exceed the limit of %d rules of the tenant", count, limit))
+		}
+	}
+	if len(errs) > 0 {
+		message := errors.Join(errs...).Error()
+		if len(message) > maxParseErrorSize {
+			message = message[:maxParseErrorSize] + "..."
+		}
+		f.parseErrors[tenant] = message
+		f.tenantParseErrs.WithLabelValues(tenant).Inc()
+		log.Printf("invalid rules of tenant %s, keeping its last valid rules: %s", tenant, message)
+
+		return f.lastValid[tenant], nil
+	}
+
+	// Prepend tenant name to all rules group names to avoid conflicts
+	// This reflects the behavior of the rules-objstore api for ListAllRules.
+	for i, group := range rulesParsed.Groups {
+		rulesParsed.Groups[i].Name = tenant + "." + group.Name
+	}
+	delete(f.parseErrors, tenant)
+	if f.spool != nil {
+		return nil, f.spool.write(tenant, rulesParsed.Groups)
+	}
+	f.lastValid[tenant] = rulesParsed.Groups
+
+	return rulesParsed.Groups, nil
+}
+
+// forgetRemovedTenants forgets the last valid rules, including their fragments, the parse errors and the fetches not finding the rules
+// of the tenants not in the given ones anymore.
+func (f *RulesObjstoreFetcher) forgetRemovedTenants(tenants []string) {
+	current := make(map[string]bool, len(tenants))
+	for _, tenant := range tenants {
+		current[tenant] = true
+	}
+
+	f.parseMtx.Lock()
+	defer f.parseMtx.Unlock()
+
+	for tenant := range f.lastValid {
+		if !current[tenant] {
+			delete(f.lastValid, tenant)
+		}
+	}
+	for tenant := range f.parseErrors {
+		if !current[tenant] {
+			delete(f.parseErrors, tenant)
+		}
+	}
+	for tenant := range f.notFound {
+		if !current[tenant] {
+			delete(f.notFound, tenant)
+		}
+	}
+	for tenant := range f.deleted {
+		if !current[tenant] {
+			delete(f.deleted, tenant)
+		}
+	}
+	f.deletedTenants.Set(float64(len(f.deleted)))
+
+	if f.spool == nil {
+		return
+	}
+	spooled, err := f.spool.tenants()
+	if err != nil {
+		log.Printf("failed to forget the rules of removed tenants: %v", err)
+		return
+	}
+	for _, tenant := range spooled {
+		if current[tenant] {
+			continue
+		}
+		if err := f.spool.remove(tenant); err != nil {
+			log.Printf("failed to forget the rules of removed tenant %s: %v", tenant, err)
+		}
+	}
+}
+
+// ParseErrors returns the errors of the tenants whose last fetched rules are invalid, and are replaced with
+// their last valid rules.
+func (f *RulesObjstoreFetcher) ParseErrors() map[string]string {
+	f.parseMtx.Lock()
+	defer f.parseMtx.Unlock()
+
+	return maps.Clone(f.parseErrors)
+}
+
+// fetchOrder returns the order in which the given tenants are fetched: shuffled with WithShuffle, as given otherwise.
+func (f *RulesObjstoreFetcher) fetchOrder(tenants []string) []string {
+	f.shuffleMtx.Lock()
+	defer f.shuffleMtx.Unlock()
+	if f.shuffle == nil {
+		return tenants
+	}
+
+	// The groups of tenants are returned in the order of the given tenants, which must not change.
+	order := slices.Clone(tenants)
+	f.shuffle.Shuffle(len(order), func(i, j int) {
+		order[i], order[j] = order[j], order[i]
+	})
+
+	return order
+}
+
+// attempted records that the fetch of the rules of a tenant starts.
+func (f *RulesObjstoreFetcher) attempted(tenant string) {
+	f.lastAttemptedMtx.Lock()
+	defer f.lastAttemptedMtx.Unlock()
+	f.lastAttempted[tenant] = time.Now()
+}
+
+// LastAttempted returns when the fetch of the rules of each tenant last started in GetTenantsRules,
+// e.g. to check that all tenants get their turn when fetches run out of time.
+// Tenants whose fetch never started, or removed since, are omitted.
+func (f *RulesObjstoreFetcher) LastAttempted() map[string]time.Time {
+	f.tenantsMtx.Lock()
+	tenants := slices.Clone(f.tenants)
+	f.tenantsMtx.Unlock()
+
+	f.lastAttemptedMtx.Lock()
+	defer f.lastAttemptedMtx.Unlock()
+	attempts := make(map[string]time.Time, len(tenants))
+	for _, tenant := range tenants {
+		if t, ok := f.lastAttempted[tenant]; ok {
+			attempts[tenant] = t
+		}
+	}
+
+	return attempts
+}
+
+// abortedError is the error of the fetch of the rules of a tenant aborted because its share of the time ran out.
+type abortedError struct {
+	err error
+}
+
+func (e *abortedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *abortedError) Unwrap() error {
+	return e.err
+}
+
+// tenantContext returns the context of fetching the rules of a tenant while the fetches of the given number of tenants,
+// including this one, aren't over. If the context has a deadline, the tenant gets a fair share of the time left:
+// the outstanding tenants are fetched in rounds of the given concurrency, and each round gets the same time.
+// This keeps slow tenants from using up the time of the tenants after them, which would always time out otherwise.
+func (f *RulesObjstoreFetcher) tenantContext(ctx context.Context, outstanding, concurrency int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	rounds := (outstanding + concurrency - 1) / concurrency
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(max(rounds, 1)))
+}
+
+// fetchTenant fetches and reads the rules of a tenant.
+func (f *RulesObjstoreFetcher) fetchTenant(ctx context.Context, tenant string) ([]byte, error) {
+	return readRules(ctx, f.tenantFetcher(tenant))
+}
+
+// changedTenants returns the tenants whose rules must be fetched because they changed since they were last fetched
+// according to the change feed of the rules backend, along with the versions of the rules listed by the feed.
+// Tenants missing from the feed or with a fallback source, whose rules may come from it, are always returned.
+// All tenants are returned if the change feed can't be listed, e.g. because the rules backend doesn't expose it.
+func (f *RulesObjstoreFetcher) changedTenants(ctx context.Context, tenants []string) ([]string, map[string]string) {
+	versions, err := f.listChanges(ctx)
+
+	f.watchMtx.Lock()
+	defer f.watchMtx.Unlock()
+
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound:
+		if !f.changeFeedAbsent {
+			log.Print("the rules backend has no change feed, fetching the rules of all tenants on every sync")
+			f.changeFeedAbsent = true
+		}
+		return tenants, nil
+	case err != nil:
+		log.Printf("failed to list changes of rules, fetching the rules of all tenants: %v", err)
+		return tenants, nil
+	}
+	f.changeFeedAbsent = false
+
+	changed := make([]string, 0, len(tenants))
+	for _, tenant := range tenants {
+		cached, ok := f.watched[tenant]
+		version, listed := versions[tenant]
+		if !ok || !listed || version != cached.version || f.hasFallback(tenant) || len(f.includedRules(tenant)) > 0 {
+			changed = append(changed, tenant)
+		}
+	}
+	f.unchangedTenants.Add(float64(len(tenants) - len(changed)))
+
+	return changed, versions
+}
+
+// updateWatched remembers the rules fetched along with their versions, and returns the groups of all tenants,
+// those not fetched being the ones remembered from previous syncs, or the last valid ones of aborted tenants.
+func (f *RulesObjstoreFetcher) updateWatched(tenants []string, fetched map[string][]rules.RuleGroup, versions map[string]string) []rules.RuleGroup {
+	f.watchMtx.Lock()
+	defer f.watchMtx.Unlock()
+
+	var groups []rules.RuleGroup
+	watched := make(map[string]watchedTenant, len(tenants))
+	for _, tenant := range tenants {
+		tenantGroups, ok := fetched[tenant]
+		if !ok {
+			last, ok := f.watched[tenant]
+			if !ok {
+				// The fetch of the tenant was aborted before it was watched.
+				groups = append(groups, f.lastValidRules(tenant)...)
+				continue
+			}
+			watched[tenant] = last
+			groups = append(groups, last.groups...)
+			continue
+		}
+
+		if version, listed := versions[tenant]; listed {
+			watched[tenant] = watchedTenant{version: version, groups: tenantGroups}
+		}
+		groups = append(groups, tenantGroups...)
+	}
+	f.watched = watched
+
+	return groups
+}
+
+// listChanges lists the versions of the rules of tenants, e.g. their ETags or modification times, from the change feed
+// of the rules backend at /api/v1/changes. The versions are opaque, and change whenever the rules of a tenant change.
+func (f *RulesObjstoreFetcher) listChanges(ctx context.Context) (map[string]string, error) {
+	u := *f.baseURL
+	u.Path = path.Join(u.Path, "/api/v1/changes")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	res, err := f.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return nil, &StatusError{Source: "rules backend", StatusCode: res.StatusCode}
+	}
+
+	var changes struct {
+		Tenants map[string]string `json:"tenants"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&changes); err != nil {
+		return nil, fmt.Errorf("failed to decode changes: %w", err)
+	}
+
+	return changes.Tenants, nil
+}
+
+// hasFallback returns whether the tenant has a fallback source.
+func (f *RulesObjstoreFetcher) hasFallback(tenant string) bool {
+	f.fallbacksMtx.Lock()
+	defer f.fallbacksMtx.Unlock()
+
+	_, ok := f.fallbacks[tenant]
+	return ok
+}
+
+// tenantFetcher returns the fetcher of the rules of a tenant, falling back to its fallback source if it has one.
+func (f *RulesObjstoreFetcher) tenantFetcher(tenant string) Fetcher {
+	f.fallbacksMtx.Lock()
+	defer f.fallbacksMtx.Unlock()
+
+	if fallback, ok := f.fallbacks[tenant]; ok {
+		return fallback
+	}
+
+	return FetcherFunc(func(ctx context.Context) (io.ReadCloser, error) {
+		return f.listRules(ctx, tenant)
+	})
+}
+
+// listRules fetches the rules of a tenant from the rules-objstore, or from the Observatorium API.
+func (f *RulesObjstoreFetcher) listRules(ctx context.Context, tenant string) (io.ReadCloser, error) {
+	if f.observatoriumAPI {
+		return f.observatoriumAPIRules(ctx, tenant)
+	}
+
+	res, err := f.client.ListRules(ctx, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+
+	if res.StatusCode/100 != 2 {
+		res.Body.Close()
+		return nil, &StatusError{Source: "Observatorium API", StatusCode: res.StatusCode}
+	}
+	f.modTimes.set(tenant, res.Header)
+
+	return res.Body, nil
+}
+
+// TenantRules fetches the rules of a tenant from the rules-objstore as they are stored, without parsing them.
+func (f *RulesObjstoreFetcher) TenantRules(ctx context.Context, tenant string) (io.ReadCloser, error) {
+	return f.listRules(ctx, tenant)
+}
+
+// SetTenantRules replaces the rules of a tenant in the rules-objstore with the given content.
+func (f *RulesObjstoreFetcher) SetTenantRules(ctx context.Context, tenant string, content []byte) error {
+	res, err := f.client.SetRulesWithBody(ctx, tenant, "application/yaml", bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return &StatusError{Source: "rules backend", StatusCode: res.StatusCode}
+	}
+
+	return nil
+}
+
+// GetAllRules fetches all rules from the rules-objstore.
+// With WithResumeAttempts, interrupted downloads are resumed instead of starting over.
+func (f *RulesObjstoreFetcher) GetAllRules(ctx context.Context) (io.ReadCloser, error) {
+	if f.resumeAttempts > 0 {
+		return f.getAllRulesResumable(ctx)
+	}
+
+	res, err := f.client.ListAllRules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, &StatusError{Source: "rules backend", StatusCode: res.StatusCode}
+	}
+	f.modTimes.set("", res.Header)
+
+	return res.Body, nil
+}
+
+// LastModified returns the modification time of the rules of the tenant last fetched, if the rules backend gave it.
+// Rules fetched from a fallback source have none.
+func (f *RulesObjstoreFetcher) LastModified(tenant string) (time.Time, bool) {
+	return f.modTimes.get(tenant)
+}
+
+// SetTenants sets the tenants to fetch rules for.
+// This method is thread-safe.
+func (f *RulesObjstoreFetcher) SetTenants(tenants []string) {
+	f.tenantsMtx.Lock()
+	f.tenants = tenants
+	f.tenantsMtx.Unlock()
+}
+
+// SetRuleLimits replaces the maximum numbers of rules of tenants from the next fetch on. The rules of a tenant
+// exceeding its limit are handled like invalid rules: its last valid rules are kept. Tenants without a limit
+// aren't limited. This method is thread-safe.
+func (f *RulesObjstoreFetcher) SetRuleLimits(limits map[string]int) {
+	f.parseMtx.Lock()
+	defer f.parseMtx.Unlock()
+
+	f.ruleLimits = limits
+}
+
+// SetConcurrency sets the number of tenants whose rules are fetched concurrently from the next fetch on,
+// e.g. to throttle the syncer during an incident of the rules backend. Values lower than 1 are ignored.
+// This method is thread-safe.
+func (f *RulesObjstoreFetcher) SetConcurrency(concurrency int) {
+	if concurrency < 1 {
+		return
+	}
+
+	f.concurrencyMtx.Lock()
+	f.concurrency = concurrency
+	f.concurrencyMtx.Unlock()
+}
+
+// Concurrency returns the number of tenants whose rules are fetched concurrently.
+// This method is thread-safe.
+func (f *RulesObjstoreFetcher) Concurrency() int {
+	f.concurrencyMtx.Lock()
+	defer f.concurrencyMtx.Unlock()
+
+	return f.concurrency
+}
+
+// SetFallbacks sets the fallback sources of the rules of tenants, used while the rules-objstore has been failing
+// for a tenant for the number of times set by WithFallbackAfter. Counts of failures are kept across calls.
+// This method is thread-safe.
+func (f *RulesObjstoreFetcher) SetFallbacks(fallbacks map[string]Fetcher) {
+	f.fallbacksMtx.Lock()
+	defer f.fallbacksMtx.Unlock()
+
+	for tenant := range f.fallbacks {
+		if _, ok := fallbacks[tenant]; !ok {
+			delete(f.fallbacks, tenant)
+		}
+	}
+
+	for tenant, fallback := range fallbacks {
+		if existing, ok := f.fallbacks[tenant]; ok {
+			existing.SetFallback(fallback)
+			continue
+		}
+
+		tenant := tenant
+		primary := FetcherFunc(func(ctx context.Context) (io.ReadCloser, error) {
+			return f.listRules(ctx, tenant)
+		})
+		f.fallbacks[tenant] = NewFallback(primary, fallback, f.fallbackAfter)
+	}
+}
+
+// ObservatoriumAPIFetcher fetches rules for a tenant from Observatorium API.
+type ObservatoriumAPIFetcher struct {
+	endpoint *url.URL
+	client   *http.Client
+	modTimes modTimes
+}
+
+// NewObservatoriumAPIFetcher creates a new ObservatoriumAPIFetcher.
+func NewObservatoriumAPIFetcher(baseURL string, tenant string, client *http.Client) (*ObservatoriumAPIFetcher, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Observatorium API URL: %w", err)
+	}
+
+	return &ObservatoriumAPIFetcher{
+		endpoint: observatoriumAPIRulesURL(u, tenant),
+		client:   client,
+	}, nil
+}
+
+// GetRules fetches the rules of the tenant.
+func (f *ObservatoriumAPIFetcher) GetRules(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, f.endpoint.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, &StatusError{Source: "Observatorium API", StatusCode: res.StatusCode}
+	}
+	f.modTimes.set("", res.Header)
+
+	return res.Body, nil
+}
+
+// SetRules replaces the rules of the tenant with the given content.
+func (f *ObservatoriumAPIFetcher) SetRules(ctx context.Context, content []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, f.endpoint.String(), bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/yaml")
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return &StatusError{Source: "Observatorium API", StatusCode: res.StatusCode}
+	}
+
+	return nil
+}
+
+// LastModified returns the modification time of the rules of the tenant last fetched, if the Observatorium API gave it.
+func (f *ObservatoriumAPIFetcher) LastModified(_ string) (time.Time, bool) {
+	return f.modTimes.get("")
+}
+
+// observatoriumAPIRulesURL returns the URL of the rules of a tenant in the Observatorium API at the base URL.
+func observatoriumAPIRulesURL(baseURL *url.URL, tenant string) *url.URL {
+	u := *baseURL
+	u.Path = path.Join("/api/metrics/v1", tenant, "/api/v1/rules/raw")
+
+	return &u
+}
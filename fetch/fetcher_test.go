@@ -0,0 +1,863 @@
+package fetch_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/stretchr/testify/assert"
+)
+
+var ruleGroups = `
+groups:
+- name: test
+  rules:
+  - alert: TestAlert
+    expr: vector(1)
+    for: 1m
+- name: test2
+  rules:
+  - record: TestRecord2
+    expr: vector(1)
+`
+
+func TestRulesObjtoreFetcher(t *testing.T) {
+	var callsCount int64
+
+	testCases := map[string]struct {
+		tenants        []string
+		responseBody   string
+		responseStatus int
+		ctxCancelled   bool
+		concurrency    int
+
+		expectErr         bool
+		expectCalls       int
+		expectGroups      int
+		expectMaxInFlight int64
+	}{
+		"rule groups are aggregated": {
+			tenants:        []string{"tenant1", "tenant2"},
+			responseBody:   ruleGroups,
+			responseStatus: http.StatusOK,
+			expectCalls:    2,
+			expectGroups:   4,
+		},
+		"concurrency is limited": {
+			tenants:           []string{"tenant1", "tenant2", "tenant3"},
+			responseBody:      ruleGroups,
+			responseStatus:    http.StatusOK,
+			concurrency:       1,
+			expectCalls:       3,
+			expectGroups:      6,
+			expectMaxInFlight: 1,
+		},
+		"first error returns": {
+			tenants:        []string{"tenant1", "tenant2"},
+			responseBody:   "internal server error",
+			responseStatus: http.StatusInternalServerError,
+			expectErr:      true,
+			expectCalls:    1,
+		},
+		"empty response returns without error": {
+			tenants:        []string{"tenant1"},
+			responseBody:   "",
+			responseStatus: http.StatusOK,
+			expectCalls:    1,
+			expectGroups:   0,
+		},
+		"timeout returns early": {
+			tenants:        []string{"tenant1", "tenant2"},
+			responseBody:   ruleGroups,
+			responseStatus: http.StatusOK,
+			ctxCancelled:   true,
+			expectErr:      true,
+			expectCalls:    0,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			callsCount = 0
+			var inFlightMtx sync.Mutex
+			var inFlight, maxInFlight int64
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt64(&callsCount, 1)
+
+				inFlightMtx.Lock()
+				inFlight++
+				maxInFlight = max(maxInFlight, inFlight)
+				inFlightMtx.Unlock()
+				defer func() {
+					inFlightMtx.Lock()
+					inFlight--
+					inFlightMtx.Unlock()
+				}()
+				time.Sleep(time.Millisecond)
+				w.WriteHeader(tc.responseStatus)
+				w.Write([]byte(tc.responseBody))
+			}
+			testServer := httptest.NewServer(http.HandlerFunc(handler))
+			defer testServer.Close()
+
+			fetcher, err := fetch.NewRulesObjstoreFetcher(testServer.URL, tc.tenants, testServer.Client(), fetch.WithConcurrency(tc.concurrency))
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Hour)
+			if tc.ctxCancelled {
+				cancel()
+			} else {
+				defer cancel()
+			}
+
+			dataReader, err := fetcher.GetTenantsRules(ctx)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			assert.EqualValues(t, tc.expectCalls, callsCount)
+			if tc.expectMaxInFlight > 0 {
+				assert.Equal(t, tc.expectMaxInFlight, maxInFlight)
+			}
+
+			data, err := io.ReadAll(dataReader)
+			assert.NoError(t, err)
+
+			var ruleGroups *rulefmt.RuleGroups
+			if len(data) > 0 {
+				var errors []error
+				ruleGroups, errors = rulefmt.Parse(data)
+				assert.Len(t, errors, 0)
+
+				// Check that rule groups are prefixed with tenant name
+				tenantsMap := make(map[string]bool)
+				for _, tenant := range tc.tenants {
+					tenantsMap[tenant] = true
+				}
+				for _, group := range ruleGroups.Groups {
+					_, ok := tenantsMap[strings.Split(group.Name, ".")[0]]
+					assert.True(t, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestRulesObjstoreFetcherWatch(t *testing.T) {
+	testCases := map[string]struct {
+		noChangeFeed bool
+		// unlisted are tenants missing from the change feed.
+		unlisted []string
+
+		expectCalls map[string]int
+	}{
+		"only changed tenants are fetched": {
+			expectCalls: map[string]int{"tenant1": 2, "tenant2": 1},
+		},
+		"tenants missing from the change feed are fetched": {
+			unlisted:    []string{"tenant2"},
+			expectCalls: map[string]int{"tenant1": 2, "tenant2": 2},
+		},
+		"all tenants are fetched without change feed": {
+			noChangeFeed: true,
+			expectCalls:  map[string]int{"tenant1": 2, "tenant2": 2},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			versions := map[string]string{"tenant1": "1", "tenant2": "1"}
+			for _, tenant := range tc.unlisted {
+				delete(versions, tenant)
+			}
+			calls := map[string]int{}
+
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if r.URL.Path == "/api/v1/changes" {
+					if tc.noChangeFeed {
+						http.NotFound(w, r)
+						return
+					}
+					assert.NoError(t, json.NewEncoder(w).Encode(map[string]any{"tenants": versions}))
+					return
+				}
+
+				tenant := strings.TrimPrefix(r.URL.Path, "/api/v1/rules/")
+				calls[tenant]++
+				w.Write([]byte(strings.ReplaceAll(ruleGroups, "TestRecord2", "Record"+strconv.Itoa(calls[tenant]))))
+			}
+			testServer := httptest.NewServer(http.HandlerFunc(handler))
+			defer testServer.Close()
+
+			fetcher, err := fetch.NewRulesObjstoreFetcher(testServer.URL, []string{"tenant1", "tenant2"}, testServer.Client(), fetch.WithWatch(true))
+			assert.NoError(t, err)
+
+			_, err = fetcher.GetTenantsRules(context.Background())
+			assert.NoError(t, err)
+
+			mu.Lock()
+			if _, ok := versions["tenant1"]; ok {
+				versions["tenant1"] = "2"
+			}
+			mu.Unlock()
+
+			dataReader, err := fetcher.GetTenantsRules(context.Background())
+			assert.NoError(t, err)
+			data, err := io.ReadAll(dataReader)
+			assert.NoError(t, err)
+
+			assert.Equal(t, tc.expectCalls, calls)
+			// The rules of unchanged tenants are the ones fetched last.
+			ruleGroups, errs := rulefmt.Parse(data)
+			assert.Len(t, errs, 0)
+			assert.Len(t, ruleGroups.Groups, 4)
+			for _, group := range ruleGroups.Groups {
+				if group.Name == "tenant2.test2" {
+					assert.Equal(t, "Record"+strconv.Itoa(tc.expectCalls["tenant2"]), group.Rules[0].Record.Value)
+				}
+			}
+		})
+	}
+}
+
+func TestRulesObjstoreFetcherBatch(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tenants := []string{"tenant1", "tenant2", "tenant3"}
+
+	testCases := map[string]struct {
+		batchSize int
+		// batchStatus is the status of the responses of the batch endpoint, 200 if 0.
+		batchStatus int
+		// unlisted are tenants missing from the responses of the batch endpoint.
+		unlisted []string
+
+		expectBatches []string
+		expectCalls   map[string]int
+		expectResults map[string]float64
+	}{
+		"tenants are fetched in batches": {
+			batchSize:     2,
+			expectBatches: []string{"tenant1,tenant2", "tenant3"},
+			expectCalls:   map[string]int{},
+			expectResults: map[string]float64{"success": 2},
+		},
+		"tenants missing from the batch are fetched one by one": {
+			batchSize:     3,
+			unlisted:      []string{"tenant2"},
+			expectBatches: []string{"tenant1,tenant2,tenant3"},
+			expectCalls:   map[string]int{"tenant2": 1},
+			expectResults: map[string]float64{"success": 1},
+		},
+		"tenants are fetched one by one without batch endpoint": {
+			batchSize:     3,
+			batchStatus:   http.StatusNotFound,
+			expectBatches: []string{"tenant1,tenant2,tenant3"},
+			expectCalls:   map[string]int{"tenant1": 1, "tenant2": 1, "tenant3": 1},
+			expectResults: map[string]float64{"unsupported": 1},
+		},
+		"tenants of failed batches are fetched one by one": {
+			batchSize:     3,
+			batchStatus:   http.StatusInternalServerError,
+			expectBatches: []string{"tenant1,tenant2,tenant3"},
+			expectCalls:   map[string]int{"tenant1": 1, "tenant2": 1, "tenant3": 1},
+			expectResults: map[string]float64{"error": 1},
+		},
+		"tenants are fetched one by one without batch size": {
+			expectCalls:   map[string]int{"tenant1": 1, "tenant2": 1, "tenant3": 1},
+			expectResults: map[string]float64{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var (
+				mu      sync.Mutex
+				batches []string
+				calls   = map[string]int{}
+			)
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if r.URL.Path == "/api/v1/batch/rules" {
+					assert.Equal(t, http.MethodPost, r.Method)
+					var req struct {
+						Tenants []string `json:"tenants"`
+					}
+					assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+					batches = append(batches, strings.Join(req.Tenants, ","))
+					if tc.batchStatus != 0 {
+						w.WriteHeader(tc.batchStatus)
+						return
+					}
+
+					listed := map[string]any{
+						// Tenants out of the batch are ignored.
+						"other": map[string]any{"rules": ruleGroups},
+					}
+					for _, tenant := range req.Tenants {
+						if !slices.Contains(tc.unlisted, tenant) {
+							listed[tenant] = map[string]any{"rules": ruleGroups, "lastModified": modified}
+						}
+					}
+					assert.NoError(t, json.NewEncoder(w).Encode(map[string]any{"tenants": listed}))
+					return
+				}
+
+				calls[strings.TrimPrefix(r.URL.Path, "/api/v1/rules/")]++
+				io.WriteString(w, ruleGroups)
+			}
+			testServer := httptest.NewServer(http.HandlerFunc(handler))
+			defer testServer.Close()
+
+			r := prometheus.NewRegistry()
+			fetcher, err := fetch.NewRulesObjstoreFetcher(testServer.URL, tenants, testServer.Client(),
+				fetch.WithBatchSize(tc.batchSize), fetch.WithConcurrency(1), fetch.WithRegisterer(r))
+			assert.NoError(t, err)
+
+			dataReader, err := fetcher.GetTenantsRules(context.Background())
+			assert.NoError(t, err)
+			data, err := io.ReadAll(dataReader)
+			assert.NoError(t, err)
+
+			assert.Equal(t, tc.expectBatches, batches)
+			assert.Equal(t, tc.expectCalls, calls)
+			ruleGroups, errs := rulefmt.Parse(data)
+			assert.Len(t, errs, 0)
+			assert.Len(t, ruleGroups.Groups, 6)
+
+			metrics, err := r.Gather()
+			assert.NoError(t, err)
+			results := map[string]float64{}
+			for _, mf := range metrics {
+				if mf.GetName() != "thanos_rule_syncer_fetch_batch_requests_total" {
+					continue
+				}
+				for _, m := range mf.GetMetric() {
+					results[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+				}
+			}
+			assert.Equal(t, tc.expectResults, results)
+
+			// The modification times of the batch are kept.
+			lastModified, ok := fetcher.LastModified("tenant1")
+			assert.Equal(t, tc.expectResults["success"] > 0, ok)
+			if ok {
+				assert.True(t, modified.Equal(lastModified))
+			}
+		})
+	}
+}
+
+func TestRulesObjstoreFetcherLastModified(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	testCases := map[string]struct {
+		tenants []string
+		// lastModified are the Last-Modified times served by path, none if missing.
+		lastModified map[string]time.Time
+
+		expectTimes map[string]time.Time
+	}{
+		"rules of tenants": {
+			tenants: []string{"tenant-a", "tenant-b"},
+			lastModified: map[string]time.Time{
+				"/api/v1/rules/tenant-a": modified,
+			},
+			expectTimes: map[string]time.Time{"tenant-a": modified},
+		},
+		"rules of all tenants": {
+			lastModified: map[string]time.Time{
+				"/api/v1/rules": modified,
+			},
+			expectTimes: map[string]time.Time{"tenant-a": modified, "tenant-b": modified},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				if lastModified, ok := tc.lastModified[r.URL.Path]; ok {
+					w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+				}
+				io.WriteString(w, ruleGroups)
+			}
+			testServer := httptest.NewServer(http.HandlerFunc(handler))
+			defer testServer.Close()
+
+			fetcher, err := fetch.NewRulesObjstoreFetcher(testServer.URL, tc.tenants, testServer.Client())
+			assert.NoError(t, err)
+
+			getRules := fetcher.GetTenantsRules
+			if len(tc.tenants) == 0 {
+				getRules = fetcher.GetAllRules
+			}
+			rules, err := getRules(context.Background())
+			assert.NoError(t, err)
+			rules.Close()
+
+			for _, tenant := range []string{"tenant-a", "tenant-b"} {
+				lastModified, ok := fetcher.LastModified(tenant)
+				expected, expectOk := tc.expectTimes[tenant]
+				assert.Equal(t, expectOk, ok, tenant)
+				assert.True(t, expected.Equal(lastModified), tenant)
+			}
+		})
+	}
+}
+
+func TestNewRulesObjstoreFetcherScheme(t *testing.T) {
+	for _, url := range []string{"grpc://rules-objstore:10901", "grpcs://rules-objstore:10901"} {
+		_, err := fetch.NewRulesObjstoreFetcher(url, nil, nil)
+		assert.ErrorContains(t, err, "no gRPC API", url)
+	}
+
+	_, err := fetch.NewRulesObjstoreFetcher("http://rules-objstore:8080", nil, nil)
+	assert.NoError(t, err)
+}
+
+func TestRulesObjstoreFetcherFairDeadline(t *testing.T) {
+	testCases := map[string]struct {
+		tenants     []string
+		slowTenants map[string]bool
+
+		expectErr     string
+		expectAborted []string
+		expectFetched []string
+	}{
+		"slow tenant doesn't use up the time of the others": {
+			tenants:       []string{"slow", "fast1", "fast2", "fast3"},
+			slowTenants:   map[string]bool{"slow": true},
+			expectErr:     "aborted fetching the rules of 1 of 4 tenants",
+			expectAborted: []string{"slow"},
+			expectFetched: []string{"fast1", "fast2", "fast3"},
+		},
+		"all tenants are reported": {
+			tenants:       []string{"slow1", "slow2", "slow3"},
+			slowTenants:   map[string]bool{"slow1": true, "slow2": true, "slow3": true},
+			expectErr:     "aborted fetching the rules of 3 of 3 tenants",
+			expectAborted: []string{"slow1", "slow2", "slow3"},
+		},
+		"fast tenants are fetched": {
+			tenants:       []string{"fast1", "fast2"},
+			expectFetched: []string{"fast1", "fast2"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var fetchedMtx sync.Mutex
+			var fetched []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tenant := strings.TrimPrefix(r.URL.Path, "/api/v1/rules/")
+				if tc.slowTenants[tenant] {
+					<-r.Context().Done()
+					return
+				}
+
+				fetchedMtx.Lock()
+				fetched = append(fetched, tenant)
+				fetchedMtx.Unlock()
+				_, _ = w.Write([]byte(ruleGroups))
+			}))
+			defer server.Close()
+
+			fetcher, err := fetch.NewRulesObjstoreFetcher(server.URL, tc.tenants, server.Client(), fetch.WithConcurrency(1))
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 800*time.Millisecond)
+			defer cancel()
+
+			_, err = fetcher.GetTenantsRules(ctx)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				assert.ElementsMatch(t, tc.expectAborted, rules.ErrorTenants(err))
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.ElementsMatch(t, tc.expectFetched, fetched)
+		})
+	}
+}
+
+func TestRulesObjstoreFetcherAbortedLastValid(t *testing.T) {
+	testCases := map[string]struct {
+		opts func(t *testing.T) []fetch.RulesObjstoreFetcherOption
+	}{
+		"last valid rules": {
+			opts: func(*testing.T) []fetch.RulesObjstoreFetcherOption { return nil },
+		},
+		"spool": {
+			opts: func(t *testing.T) []fetch.RulesObjstoreFetcherOption {
+				return []fetch.RulesObjstoreFetcherOption{fetch.WithSpoolDir(t.TempDir())}
+			},
+		},
+		"watch": {
+			opts: func(*testing.T) []fetch.RulesObjstoreFetcherOption {
+				return []fetch.RulesObjstoreFetcherOption{fetch.WithWatch(true)}
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var slow atomic.Bool
+			var version atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/api/v1/changes" {
+					// The rules of the slow tenant change, so that they are fetched again.
+					fmt.Fprintf(w, `{"tenants": {"slow": "%d", "fast": "1"}}`, version.Add(1))
+					return
+				}
+				if strings.TrimPrefix(r.URL.Path, "/api/v1/rules/") == "slow" && slow.Load() {
+					<-r.Context().Done()
+					return
+				}
+				_, _ = w.Write([]byte(ruleGroups))
+			}))
+			defer server.Close()
+
+			fetcher, err := fetch.NewRulesObjstoreFetcher(server.URL, []string{"slow", "fast"}, server.Client(), append(tc.opts(t), fetch.WithConcurrency(1))...)
+			assert.NoError(t, err)
+			get := func() ([]byte, []*rules.TenantError, error) {
+				ctx, cancel := context.WithTimeout(context.Background(), 800*time.Millisecond)
+				defer cancel()
+				fetched, err := fetcher.GetTenantsRules(ctx)
+				if err != nil {
+					return nil, nil, err
+				}
+				defer fetched.Close()
+				content, err := io.ReadAll(fetched)
+				return content, fetch.TenantErrors(fetched), err
+			}
+
+			first, tenantErrs, err := get()
+			assert.NoError(t, err)
+			assert.Empty(t, tenantErrs)
+
+			// The aborted tenant keeps its last valid rules, and the rules of the other tenants are fetched.
+			slow.Store(true)
+			content, tenantErrs, err := get()
+			assert.NoError(t, err)
+			assert.YAMLEq(t, string(first), string(content))
+			if assert.Len(t, tenantErrs, 1) {
+				assert.Equal(t, "slow", tenantErrs[0].Tenant)
+			}
+		})
+	}
+}
+
+func TestRulesObjstoreFetcherShuffle(t *testing.T) {
+	tenants := []string{"tenant1", "tenant2", "tenant3", "tenant4", "tenant5", "tenant6", "tenant7", "tenant8"}
+
+	testCases := map[string]struct {
+		shuffle rand.Source
+
+		expectShuffled bool
+	}{
+		"tenants are fetched in order": {},
+		"tenants are shuffled": {
+			shuffle:        rand.NewSource(1),
+			expectShuffled: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var orders [][]string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Tenants are fetched one at a time.
+				orders[len(orders)-1] = append(orders[len(orders)-1], strings.TrimPrefix(r.URL.Path, "/api/v1/rules/"))
+				_, _ = w.Write([]byte(ruleGroups))
+			}))
+			defer server.Close()
+
+			fetcher, err := fetch.NewRulesObjstoreFetcher(server.URL, tenants, server.Client(), fetch.WithConcurrency(1), fetch.WithShuffle(tc.shuffle))
+			assert.NoError(t, err)
+
+			var contents []string
+			for i := 0; i < 3; i++ {
+				orders = append(orders, nil)
+				start := time.Now()
+				body, err := fetcher.GetTenantsRules(context.Background())
+				assert.NoError(t, err)
+				content, err := io.ReadAll(body)
+				assert.NoError(t, err)
+				contents = append(contents, string(content))
+
+				attempts := fetcher.LastAttempted()
+				assert.Len(t, attempts, len(tenants))
+				for tenant, attempt := range attempts {
+					assert.False(t, attempt.Before(start), tenant)
+				}
+			}
+
+			for _, order := range orders {
+				assert.ElementsMatch(t, tenants, order)
+			}
+			if tc.expectShuffled {
+				assert.NotEqual(t, orders[0], orders[1])
+				assert.NotEqual(t, orders[1], orders[2])
+			} else {
+				assert.Equal(t, [][]string{tenants, tenants, tenants}, orders)
+			}
+
+			// The rules are returned in the order of the tenants, whatever the order they were fetched in.
+			assert.Equal(t, contents[0], contents[1])
+			assert.Equal(t, contents[0], contents[2])
+		})
+	}
+}
+
+func TestRulesObjstoreFetcherParseErrors(t *testing.T) {
+	invalid := "groups:\n- name: test\n  rules:\n  - alert: TestAlert\n    expr: vector(1\n"
+	var mtx sync.Mutex
+	bodies := map[string]string{"tenant-a": ruleGroups, "tenant-b": ruleGroups, "tenant-c": invalid}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		_, _ = w.Write([]byte(bodies[strings.TrimPrefix(r.URL.Path, "/api/v1/rules/")]))
+	}))
+	defer server.Close()
+	setBody := func(tenant, body string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		bodies[tenant] = body
+	}
+
+	reg := prometheus.NewRegistry()
+	fetcher, err := fetch.NewRulesObjstoreFetcher(server.URL, []string{"tenant-a", "tenant-b", "tenant-c"}, server.Client(), fetch.WithRegisterer(reg))
+	assert.NoError(t, err)
+	erroredTenants := func() []string {
+		var tenants []string
+		for tenant := range fetcher.ParseErrors() {
+			tenants = append(tenants, tenant)
+		}
+		slices.Sort(tenants)
+		return tenants
+	}
+	groupNames := func() []string {
+		t.Helper()
+		body, err := fetcher.GetTenantsRules(context.Background())
+		assert.NoError(t, err)
+		content, err := io.ReadAll(body)
+		assert.NoError(t, err)
+		groups, errs := rulefmt.Parse(content)
+		assert.Empty(t, errs)
+
+		var names []string
+		for _, group := range groups.Groups {
+			names = append(names, group.Name)
+		}
+		return names
+	}
+
+	// A tenant with invalid rules from the start has no rules, and doesn't fail the others.
+	assert.Equal(t, []string{"tenant-a.test", "tenant-a.test2", "tenant-b.test", "tenant-b.test2"}, groupNames())
+	assert.Equal(t, []string{"tenant-c"}, erroredTenants())
+	assert.Contains(t, fetcher.ParseErrors()["tenant-c"], "unclosed left parenthesis")
+
+	// A tenant uploading invalid rules keeps its last valid rules.
+	setBody("tenant-b", invalid)
+	assert.Equal(t, []string{"tenant-a.test", "tenant-a.test2", "tenant-b.test", "tenant-b.test2"}, groupNames())
+	assert.Equal(t, []string{"tenant-b", "tenant-c"}, erroredTenants())
+
+	// The errors of tenants are cleared once their rules are valid, or once they are removed.
+	setBody("tenant-b", "groups: []\n")
+	fetcher.SetTenants([]string{"tenant-a", "tenant-b"})
+	assert.Equal(t, []string{"tenant-a.test", "tenant-a.test2"}, groupNames())
+	assert.Empty(t, fetcher.ParseErrors())
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP thanos_rule_syncer_tenant_parse_errors_total Number of fetches of invalid rules of tenants, replaced with the last valid rules of the tenant, by tenant.
+# TYPE thanos_rule_syncer_tenant_parse_errors_total counter
+thanos_rule_syncer_tenant_parse_errors_total{tenant="tenant-b"} 1
+thanos_rule_syncer_tenant_parse_errors_total{tenant="tenant-c"} 2
+`), "thanos_rule_syncer_tenant_parse_errors_total"))
+
+	// A tenant whose rules exceed its rule limit keeps its last valid rules.
+	fetcher.SetRuleLimits(map[string]int{"tenant-a": 1, "tenant-b": 2})
+	assert.Equal(t, []string{"tenant-a.test", "tenant-a.test2"}, groupNames())
+	assert.Equal(t, []string{"tenant-a"}, erroredTenants())
+	assert.Contains(t, fetcher.ParseErrors()["tenant-a"], "2 rules exceed the limit of 1 rules of the tenant")
+}
+
+func TestRulesObjstoreFetcherSetConcurrency(t *testing.T) {
+	fetcher, err := fetch.NewRulesObjstoreFetcher("http://rules-objstore", nil, http.DefaultClient, fetch.WithConcurrency(8))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, fetcher.Concurrency())
+
+	fetcher.SetConcurrency(2)
+	assert.Equal(t, 2, fetcher.Concurrency())
+
+	// Invalid concurrencies are ignored.
+	fetcher.SetConcurrency(0)
+	assert.Equal(t, 2, fetcher.Concurrency())
+}
+
+func TestRulesObjstoreFetcherNotFound(t *testing.T) {
+	type step struct {
+		found bool
+
+		expectErr    bool
+		expectGroups []string
+	}
+	withB := []string{"tenant-a.test", "tenant-a.test2", "tenant-b.test", "tenant-b.test2"}
+	withoutB := []string{"tenant-a.test", "tenant-a.test2"}
+
+	testCases := map[string]struct {
+		threshold int
+		// tombstone is the response of the rules backend to the tombstone requests, or empty if it has none.
+		tombstone string
+
+		steps         []step
+		expectDeleted float64
+	}{
+		"not found fails the fetch": {
+			steps: []step{
+				{found: true, expectGroups: withB},
+				{expectErr: true},
+			},
+		},
+		"last rules kept until the threshold": {
+			threshold: 2,
+			steps: []step{
+				{found: true, expectGroups: withB},
+				{expectGroups: withB},
+				{expectGroups: withoutB},
+				{expectGroups: withoutB},
+			},
+			expectDeleted: 1,
+		},
+		"rules found again": {
+			threshold: 2,
+			steps: []step{
+				{found: true, expectGroups: withB},
+				{expectGroups: withB},
+				{found: true, expectGroups: withB},
+				{expectGroups: withB},
+				{expectGroups: withoutB},
+				{found: true, expectGroups: withB},
+			},
+		},
+		"no last rules fails until the threshold": {
+			threshold: 2,
+			steps: []step{
+				{expectErr: true},
+				{expectGroups: withoutB},
+			},
+			expectDeleted: 1,
+		},
+		"deletion confirmed by a tombstone": {
+			tombstone: `{"deleted": true}`,
+			steps: []step{
+				{found: true, expectGroups: withB},
+				{expectGroups: withoutB},
+			},
+			expectDeleted: 1,
+		},
+		"tenant still existing": {
+			threshold: 1,
+			tombstone: `{"deleted": false}`,
+			steps: []step{
+				{found: true, expectGroups: withB},
+				{expectGroups: withB},
+				{expectGroups: withB},
+			},
+		},
+		"invalid tombstone": {
+			threshold: 2,
+			tombstone: `{}`,
+			steps: []step{
+				{found: true, expectGroups: withB},
+				{expectGroups: withB},
+				{expectGroups: withoutB},
+			},
+			expectDeleted: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var found atomic.Bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v1/rules/tenant-a":
+					_, _ = w.Write([]byte(ruleGroups))
+				case "/api/v1/rules/tenant-b":
+					if !found.Load() {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					_, _ = w.Write([]byte(ruleGroups))
+				case "/api/v1/tenants/tenant-b":
+					if tc.tombstone == "" {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					_, _ = w.Write([]byte(tc.tombstone))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			reg := prometheus.NewRegistry()
+			fetcher, err := fetch.NewRulesObjstoreFetcher(server.URL, []string{"tenant-a", "tenant-b"}, server.Client(),
+				fetch.WithNotFoundThreshold(tc.threshold),
+				fetch.WithTombstones(tc.tombstone != ""),
+				fetch.WithRegisterer(reg),
+			)
+			assert.NoError(t, err)
+
+			for i, step := range tc.steps {
+				found.Store(step.found)
+				body, err := fetcher.GetTenantsRules(context.Background())
+				if step.expectErr {
+					assert.ErrorContains(t, err, "tenant tenant-b", "step %d", i)
+					continue
+				}
+				assert.NoError(t, err, "step %d", i)
+
+				content, err := io.ReadAll(body)
+				assert.NoError(t, err)
+				groups, errs := rulefmt.Parse(content)
+				assert.Empty(t, errs)
+				var names []string
+				for _, group := range groups.Groups {
+					names = append(names, group.Name)
+				}
+				assert.Equal(t, step.expectGroups, names, "step %d", i)
+			}
+
+			expected := fmt.Sprintf(`
+# HELP thanos_rule_syncer_fetch_deleted_tenants Number of tenants whose rules were deleted because the tenant was deleted from the rules backend.
+# TYPE thanos_rule_syncer_fetch_deleted_tenants gauge
+thanos_rule_syncer_fetch_deleted_tenants %v
+`, tc.expectDeleted)
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "thanos_rule_syncer_fetch_deleted_tenants"))
+		})
+	}
+}
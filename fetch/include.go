@@ -0,0 +1,110 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// IncludedRules is a rules document included in the rules of a tenant, e.g. the rules of a tenant kept outside of
+// the rules backend during a migration, see SetIncludedRules.
+type IncludedRules struct {
+	// Name tells the document apart in errors, e.g. its URL.
+	Name    string
+	Fetcher Fetcher
+}
+
+// includedError is the error of a document included in the rules of a tenant, which doesn't tell whether the rules of
+// the tenant were found.
+type includedError struct {
+	name string
+	err  error
+}
+
+func (e *includedError) Error() string {
+	return fmt.Sprintf("failed to fetch included rules %s: %v", e.name, e.err)
+}
+
+func (e *includedError) Unwrap() error {
+	return e.err
+}
+
+// SetIncludedRules replaces the documents included in the rules of tenants from the next fetch on. They are fetched
+// after the rules of their tenant, and their rule groups are appended to the ones of the tenant, prefixed with the
+// tenant like them. A document failing to be fetched fails the fetch of the rules of its tenant, and invalid documents
+// are handled like invalid rules of the tenant. This method is thread-safe.
+func (f *RulesObjstoreFetcher) SetIncludedRules(included map[string][]IncludedRules) {
+	f.includedMtx.Lock()
+	defer f.includedMtx.Unlock()
+
+	f.included = included
+}
+
+// includedRules returns the documents included in the rules of a tenant.
+func (f *RulesObjstoreFetcher) includedRules(tenant string) []IncludedRules {
+	f.includedMtx.Lock()
+	defer f.includedMtx.Unlock()
+
+	return f.included[tenant]
+}
+
+// fetchIncluded fetches and reads the documents included in the rules of a tenant, in order.
+func (f *RulesObjstoreFetcher) fetchIncluded(ctx context.Context, tenant string) ([][]byte, error) {
+	var contents [][]byte
+	for _, included := range f.includedRules(tenant) {
+		content, err := readRules(ctx, included.Fetcher)
+		if err != nil {
+			return nil, &includedError{name: included.Name, err: err}
+		}
+		contents = append(contents, content)
+	}
+
+	return contents, nil
+}
+
+// readRules fetches and reads rules.
+func readRules(ctx context.Context, f Fetcher) ([]byte, error) {
+	body, err := f.GetRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return content, nil
+}
+
+// URLFetcher fetches rules from a URL, e.g. a rules document included in the rules of a tenant.
+type URLFetcher struct {
+	url    string
+	client *http.Client
+}
+
+// NewURLFetcher creates a new URLFetcher requesting the given URL with the client.
+func NewURLFetcher(url string, client *http.Client) *URLFetcher {
+	return &URLFetcher{url: url, client: client}
+}
+
+// GetRules fetches the rules at the URL.
+func (f *URLFetcher) GetRules(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	if res.StatusCode/100 != 2 {
+		res.Body.Close()
+		return nil, &StatusError{Source: f.url, StatusCode: res.StatusCode}
+	}
+
+	return res.Body, nil
+}
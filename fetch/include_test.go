@@ -0,0 +1,102 @@
+package fetch_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRulesObjstoreFetcherIncludedRules(t *testing.T) {
+	const included = `
+groups:
+- name: legacy
+  rules:
+  - alert: LegacyAlert
+    expr: vector(1)
+`
+
+	testCases := map[string]struct {
+		// included are the paths of the documents included in the rules of tenant-a.
+		included []string
+
+		expectErr         bool
+		expectGroups      []string
+		expectParseErrors []string
+	}{
+		"included groups are prefixed with the tenant": {
+			included:     []string{"/included.yaml"},
+			expectGroups: []string{"tenant-a.test", "tenant-a.test2", "tenant-a.legacy", "tenant-b.test", "tenant-b.test2"},
+		},
+		"missing included rules fail the fetch": {
+			included:  []string{"/missing.yaml"},
+			expectErr: true,
+		},
+		"invalid included rules are invalid rules of the tenant": {
+			included:          []string{"/invalid.yaml"},
+			expectGroups:      []string{"tenant-b.test", "tenant-b.test2"},
+			expectParseErrors: []string{"tenant-a"},
+		},
+		"included groups must not be defined by the tenant": {
+			included:          []string{"/included.yaml", "/included.yaml"},
+			expectGroups:      []string{"tenant-b.test", "tenant-b.test2"},
+			expectParseErrors: []string{"tenant-a"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v1/rules/tenant-a", "/api/v1/rules/tenant-b":
+					io.WriteString(w, ruleGroups)
+				case "/included.yaml":
+					io.WriteString(w, included)
+				case "/invalid.yaml":
+					io.WriteString(w, "groups: [")
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}
+			testServer := httptest.NewServer(http.HandlerFunc(handler))
+			defer testServer.Close()
+
+			// Tenants not found are kept, so that a missing included document must not be taken for a deleted tenant.
+			fetcher, err := fetch.NewRulesObjstoreFetcher(testServer.URL, []string{"tenant-a", "tenant-b"}, testServer.Client(), fetch.WithNotFoundThreshold(3))
+			assert.NoError(t, err)
+			var includedRules []fetch.IncludedRules
+			for _, path := range tc.included {
+				includedRules = append(includedRules, fetch.IncludedRules{Name: path, Fetcher: fetch.NewURLFetcher(testServer.URL+path, testServer.Client())})
+			}
+			fetcher.SetIncludedRules(map[string][]fetch.IncludedRules{"tenant-a": includedRules})
+
+			body, err := fetcher.GetTenantsRules(context.Background())
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			data, err := io.ReadAll(body)
+			assert.NoError(t, err)
+
+			groups, errs := rulefmt.Parse(data)
+			assert.Empty(t, errs)
+			var names []string
+			for _, group := range groups.Groups {
+				names = append(names, group.Name)
+			}
+			assert.Equal(t, tc.expectGroups, names)
+
+			var parseErrors []string
+			for tenant := range fetcher.ParseErrors() {
+				parseErrors = append(parseErrors, tenant)
+			}
+			assert.Equal(t, tc.expectParseErrors, parseErrors)
+		})
+	}
+}
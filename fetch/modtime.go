@@ -0,0 +1,61 @@
+package fetch
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// modTimes records the modification times of the rules of tenants, as given by the Last-Modified header
+// of the responses of their source. The empty tenant holds the time of the rules of all tenants fetched at once.
+type modTimes struct {
+	mtx   sync.Mutex
+	times map[string]time.Time
+}
+
+// set records the modification time of the rules of the tenant from the headers of a response,
+// or forgets it if the response has none.
+func (m *modTimes) set(tenant string, h http.Header) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	t, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		delete(m.times, tenant)
+		return
+	}
+
+	if m.times == nil {
+		m.times = map[string]time.Time{}
+	}
+	m.times[tenant] = t
+}
+
+// setTime records the modification time of the rules of the tenant, or forgets it if it is nil.
+func (m *modTimes) setTime(tenant string, t *time.Time) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if t == nil {
+		delete(m.times, tenant)
+		return
+	}
+
+	if m.times == nil {
+		m.times = map[string]time.Time{}
+	}
+	m.times[tenant] = *t
+}
+
+// get returns the modification time of the rules of the tenant, or the one of the rules of all tenants.
+func (m *modTimes) get(tenant string) (time.Time, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if t, ok := m.times[tenant]; ok {
+		return t, true
+	}
+	t, ok := m.times[""]
+
+	return t, ok
+}
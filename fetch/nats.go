@@ -0,0 +1,192 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// NATSFetcher keeps the rules of tenants published to a NATS JetStream key-value bucket, each key being a tenant and
+// holding its complete rules document, e.g. put by a control plane on each change of rules, so that changes are synced
+// as they are published instead of polling the rules backend. Like fetched rules, the group names are prefixed with
+// the tenant, and invalid rules of a tenant keep its last valid rules. Deleting the key of a tenant removes its rules.
+type NATSFetcher struct {
+	mu          sync.Mutex
+	tenants     map[string][]rules.RuleGroup
+	parseErrors map[string]string
+	received    map[string]time.Time
+	// initialized is closed once the values of the bucket when it was first watched are received.
+	initialized chan struct{}
+
+	updates *prometheus.CounterVec
+}
+
+// NATSFetcherOption configures a NATSFetcher.
+type NATSFetcherOption func(*NATSFetcher)
+
+// WithNATSRegisterer registers the metrics of the NATSFetcher with the given registerer.
+func WithNATSRegisterer(r prometheus.Registerer) NATSFetcherOption {
+	return func(f *NATSFetcher) {
+		r.MustRegister(f.updates)
+	}
+}
+
+// NewNATSFetcher creates a new NATSFetcher, whose rules are received by Run.
+func NewNATSFetcher(opts ...NATSFetcherOption) *NATSFetcher {
+	f := &NATSFetcher{
+		tenants:     map[string][]rules.RuleGroup{},
+		parseErrors: map[string]string{},
+		received:    map[string]time.Time{},
+		initialized: make(chan struct{}),
+		updates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_nats_updates_total",
+			Help: "Total number of updates of the rules of tenants received from the NATS bucket, by result.",
+		}, []string{"result"}),
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return f
+}
+
+// Run watches the bucket until the context is done, keeping the rules of tenants as they change, and calls changed
+// after each change once the initial values of the bucket are received, e.g. to trigger a sync cycle.
+func (f *NATSFetcher) Run(ctx context.Context, kv nats.KeyValue, changed func()) error {
+	watcher, err := kv.WatchAll(nats.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to watch NATS bucket %s: %w", kv.Bucket(), err)
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("watch of NATS bucket %s stopped", kv.Bucket())
+			}
+
+			// A nil entry marks the end of the initial values.
+			if entry == nil {
+				close(f.initialized)
+				changed()
+				continue
+			}
+
+			f.apply(entry)
+			select {
+			case <-f.initialized:
+				changed()
+			default:
+			}
+		}
+	}
+}
+
+// apply applies the change of the rules of a tenant.
+func (f *NATSFetcher) apply(entry nats.KeyValueEntry) {
+	tenant := entry.Key()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if op := entry.Operation(); op == nats.KeyValueDelete || op == nats.KeyValuePurge {
+		delete(f.tenants, tenant)
+		delete(f.parseErrors, tenant)
+		delete(f.received, tenant)
+		f.updates.WithLabelValues("deleted").Inc()
+		return
+	}
+
+	f.received[tenant] = time.Now()
+	parsed, errs := rules.Parse(entry.Value())
+	if len(errs) > 0 {
+		message := errors.Join(errs...).Error()
+		if len(message) > maxParseErrorSize {
+			message = message[:maxParseErrorSize] + "..."
+		}
+		f.parseErrors[tenant] = message
+		f.updates.WithLabelValues("invalid").Inc()
+		log.Printf("invalid rules of tenant %s received from NATS, keeping its last valid rules: %s", tenant, message)
+		return
+	}
+
+	for i, group := range parsed.Groups {
+		parsed.Groups[i].Name = tenant + "." + group.Name
+	}
+	f.tenants[tenant] = parsed.Groups
+	delete(f.parseErrors, tenant)
+	f.updates.WithLabelValues("applied").Inc()
+}
+
+// GetRules returns the rules of the tenants in the order of their IDs, once the initial values of the bucket are
+// received.
+func (f *NATSFetcher) GetRules(ctx context.Context) (io.ReadCloser, error) {
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("rules not received from NATS yet: %w", ctx.Err())
+	case <-f.initialized:
+	}
+
+	f.mu.Lock()
+	tenants := make([]string, 0, len(f.tenants))
+	for tenant := range f.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	groups := []rules.RuleGroup{}
+	for _, tenant := range tenants {
+		groups = append(groups, f.tenants[tenant]...)
+	}
+	f.mu.Unlock()
+
+	content, err := yaml.Marshal(rules.RuleGroups{Groups: groups})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+// ParseErrors returns why the last rules received of tenants are invalid, by tenant.
+func (f *NATSFetcher) ParseErrors() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parseErrors := make(map[string]string, len(f.parseErrors))
+	for tenant, message := range f.parseErrors {
+		parseErrors[tenant] = message
+	}
+
+	return parseErrors
+}
+
+// LastAttempted returns when the rules of each tenant were last received, valid or not. Deleted tenants are omitted.
+func (f *NATSFetcher) LastAttempted() map[string]time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	received := make(map[string]time.Time, len(f.received))
+	for tenant, t := range f.received {
+		received[tenant] = t
+	}
+
+	return received
+}
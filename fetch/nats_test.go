@@ -0,0 +1,107 @@
+package fetch_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/stretchr/testify/assert"
+)
+
+type testKeyValue struct {
+	nats.KeyValue
+	watcher *testKeyWatcher
+}
+
+func (kv *testKeyValue) Bucket() string {
+	return "rules"
+}
+
+func (kv *testKeyValue) WatchAll(...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return kv.watcher, nil
+}
+
+type testKeyWatcher struct {
+	nats.KeyWatcher
+	updates chan nats.KeyValueEntry
+}
+
+func (w *testKeyWatcher) Updates() <-chan nats.KeyValueEntry {
+	return w.updates
+}
+
+func (w *testKeyWatcher) Stop() error {
+	return nil
+}
+
+type testKeyValueEntry struct {
+	nats.KeyValueEntry
+	key   string
+	value string
+	op    nats.KeyValueOp
+}
+
+func (e testKeyValueEntry) Key() string {
+	return e.key
+}
+
+func (e testKeyValueEntry) Value() []byte {
+	return []byte(e.value)
+}
+
+func (e testKeyValueEntry) Operation() nats.KeyValueOp {
+	return e.op
+}
+
+func TestNATSFetcher(t *testing.T) {
+	watcher := &testKeyWatcher{updates: make(chan nats.KeyValueEntry)}
+	f := fetch.NewNATSFetcher()
+	changes := make(chan struct{}, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, f.Run(ctx, &testKeyValue{watcher: watcher}, func() { changes <- struct{}{} }))
+	}()
+	getRules := func() string {
+		t.Helper()
+		rules, err := f.GetRules(context.Background())
+		assert.NoError(t, err)
+		content, err := io.ReadAll(rules)
+		assert.NoError(t, err)
+		return string(content)
+	}
+
+	// The rules aren't available until the initial values are received.
+	timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer timeoutCancel()
+	_, err := f.GetRules(timeoutCtx)
+	assert.Error(t, err)
+
+	watcher.updates <- testKeyValueEntry{key: "tenant-b", value: "groups:\n- name: b\n  rules: []\n", op: nats.KeyValuePut}
+	watcher.updates <- testKeyValueEntry{key: "tenant-a", value: "groups:\n- name: a\n  rules: []\n", op: nats.KeyValuePut}
+	watcher.updates <- nil
+	<-changes
+	assert.Equal(t, "groups:\n    - name: tenant-a.a\n      rules: []\n    - name: tenant-b.b\n      rules: []\n", getRules())
+
+	// Invalid rules keep the last valid rules of the tenant.
+	watcher.updates <- testKeyValueEntry{key: "tenant-a", value: "groups:\n- name: a\n  rules:\n  - record: a\n    expr: sum(\n", op: nats.KeyValuePut}
+	<-changes
+	assert.Equal(t, "groups:\n    - name: tenant-a.a\n      rules: []\n    - name: tenant-b.b\n      rules: []\n", getRules())
+	assert.Contains(t, f.ParseErrors(), "tenant-a")
+	assert.Contains(t, f.LastAttempted(), "tenant-a")
+
+	// Deleted tenants are removed.
+	watcher.updates <- testKeyValueEntry{key: "tenant-a", op: nats.KeyValueDelete}
+	<-changes
+	assert.Equal(t, "groups:\n    - name: tenant-b.b\n      rules: []\n", getRules())
+	assert.Empty(t, f.ParseErrors())
+	assert.NotContains(t, f.LastAttempted(), "tenant-a")
+
+	cancel()
+	<-done
+}
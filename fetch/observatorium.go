@@ -0,0 +1,69 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// NewObservatoriumAPITenantsFetcher creates a fetcher of the rules of the given tenants from the Observatorium API
+// at /api/metrics/v1/{tenant}/api/v1/rules/raw, fetched concurrently and merged like the rules of tenants fetched
+// from the rules-objstore by GetTenantsRules: the names of their groups are prefixed with their tenant.
+// The Observatorium API has neither a change feed, tombstones, a batch endpoint nor a route listing the rules of all
+// tenants, so GetAllRules, WithWatch, WithResumeAttempts, WithTombstones and WithBatchSize must not be used.
+func NewObservatoriumAPITenantsFetcher(baseURL string, tenants []string, client *http.Client, opts ...RulesObjstoreFetcherOption) (*RulesObjstoreFetcher, error) {
+	f, err := NewRulesObjstoreFetcher(baseURL, tenants, client, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Observatorium API fetcher: %w", err)
+	}
+	if f.watch || f.resumeAttempts > 0 || f.tombstones || f.batchSize > 0 {
+		return nil, fmt.Errorf("the Observatorium API has no change feed, range requests of all rules, tombstones nor batch endpoint")
+	}
+	f.observatoriumAPI = true
+
+	return f, nil
+}
+
+// SetTenantClients replaces the clients fetching the rules of tenants from the Observatorium API from the next fetch
+// on, e.g. with the credentials of each tenant. The rules of tenants without a client are fetched with the client
+// of the fetcher. This method is thread-safe.
+func (f *RulesObjstoreFetcher) SetTenantClients(clients map[string]*http.Client) {
+	f.tenantClientsMtx.Lock()
+	defer f.tenantClientsMtx.Unlock()
+
+	f.tenantClients = clients
+}
+
+// tenantClient returns the client fetching the rules of a tenant.
+func (f *RulesObjstoreFetcher) tenantClient(tenant string) *http.Client {
+	f.tenantClientsMtx.Lock()
+	defer f.tenantClientsMtx.Unlock()
+
+	if client, ok := f.tenantClients[tenant]; ok {
+		return client
+	}
+
+	return f.httpClient
+}
+
+// observatoriumAPIRules fetches the rules of a tenant from the Observatorium API.
+func (f *RulesObjstoreFetcher) observatoriumAPIRules(ctx context.Context, tenant string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, observatoriumAPIRulesURL(f.baseURL, tenant).String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	res, err := f.tenantClient(tenant).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+
+	if res.StatusCode/100 != 2 {
+		res.Body.Close()
+		return nil, &StatusError{Source: "Observatorium API", StatusCode: res.StatusCode}
+	}
+	f.modTimes.set(tenant, res.Header)
+
+	return res.Body, nil
+}
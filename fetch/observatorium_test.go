@@ -0,0 +1,106 @@
+package fetch_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObservatoriumAPITenantsFetcher(t *testing.T) {
+	testCases := map[string]struct {
+		tenants []string
+		// tenantClients are the tenants fetching their rules with their own client, authorized with their name.
+		tenantClients []string
+		opts          []fetch.RulesObjstoreFetcherOption
+
+		expectErr           bool
+		expectGroups        []string
+		expectAuthorization map[string]string
+	}{
+		"rules of tenants are prefixed with their tenant": {
+			tenants:             []string{"tenant-a", "tenant-b"},
+			expectGroups:        []string{"tenant-a.test", "tenant-a.test2", "tenant-b.test", "tenant-b.test2"},
+			expectAuthorization: map[string]string{"tenant-a": "", "tenant-b": ""},
+		},
+		"tenants with their own client": {
+			tenants:             []string{"tenant-a", "tenant-b"},
+			tenantClients:       []string{"tenant-b"},
+			expectGroups:        []string{"tenant-a.test", "tenant-a.test2", "tenant-b.test", "tenant-b.test2"},
+			expectAuthorization: map[string]string{"tenant-a": "", "tenant-b": "Bearer tenant-b"},
+		},
+		"change feed is not supported": {
+			tenants:   []string{"tenant-a"},
+			opts:      []fetch.RulesObjstoreFetcherOption{fetch.WithWatch(true)},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			authorization := map[string]string{}
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				tenant, ok := strings.CutPrefix(r.URL.Path, "/api/metrics/v1/")
+				tenant, found := strings.CutSuffix(tenant, "/api/v1/rules/raw")
+				if !ok || !found {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				mu.Lock()
+				authorization[tenant] = r.Header.Get("Authorization")
+				mu.Unlock()
+				io.WriteString(w, ruleGroups)
+			}
+			testServer := httptest.NewServer(http.HandlerFunc(handler))
+			defer testServer.Close()
+
+			fetcher, err := fetch.NewObservatoriumAPITenantsFetcher(testServer.URL, tc.tenants, testServer.Client(), tc.opts...)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			clients := map[string]*http.Client{}
+			for _, tenant := range tc.tenantClients {
+				clients[tenant] = &http.Client{Transport: authorizingTransport{token: tenant, next: testServer.Client().Transport}}
+			}
+			fetcher.SetTenantClients(clients)
+
+			body, err := fetcher.GetTenantsRules(context.Background())
+			assert.NoError(t, err)
+			data, err := io.ReadAll(body)
+			assert.NoError(t, err)
+
+			groups, errs := rulefmt.Parse(data)
+			assert.Empty(t, errs)
+			var names []string
+			for _, group := range groups.Groups {
+				names = append(names, group.Name)
+			}
+			assert.Equal(t, tc.expectGroups, names)
+			assert.Equal(t, tc.expectAuthorization, authorization)
+		})
+	}
+}
+
+// authorizingTransport authorizes requests with a bearer token.
+type authorizingTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t authorizingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,169 @@
+package fetch
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Headers announcing the rate limit of an upstream, e.g. the Observatorium API.
+const (
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset"
+)
+
+// RateLimitTransport wraps an http.RoundTripper and paces the requests to an upstream announcing its rate limit in the
+// X-RateLimit-Remaining and X-RateLimit-Reset headers of its responses, spreading the remaining requests until the limit
+// resets, so that fetching many tenants doesn't exhaust the limit at the start of each cycle and get 429s.
+type RateLimitTransport struct {
+	transport http.RoundTripper
+	pace      bool
+	clock     clock.Clock
+
+	mu sync.Mutex
+	// remaining is the number of requests left until reset, negative if unknown.
+	remaining int
+	reset     time.Time
+	// next is the time the next request can be sent at.
+	next time.Time
+
+	remainingGauge prometheus.Gauge
+	resetGauge     prometheus.Gauge
+	waits          prometheus.Counter
+}
+
+// RateLimitTransportCfg is the configuration for a RateLimitTransport.
+type RateLimitTransportCfg struct {
+	Transport http.RoundTripper
+	// Pace paces the requests. If false, the rate limit is only exported as metrics.
+	Pace bool
+	// Clock times the pacing, e.g. a fake clock in tests. If nil, it is the clock of the system.
+	Clock clock.Clock
+	// Registerer registers the metrics of the rate limit, if not nil.
+	Registerer prometheus.Registerer
+}
+
+// NewRateLimitTransport creates a new RateLimitTransport.
+func NewRateLimitTransport(cfg *RateLimitTransportCfg) *RateLimitTransport {
+	c := cfg.Clock
+	if c == nil {
+		c = clock.Real()
+	}
+
+	t := &RateLimitTransport{
+		transport: cfg.Transport,
+		pace:      cfg.Pace,
+		clock:     c,
+		remaining: -1,
+		remainingGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_fetch_rate_limit_remaining",
+			Help: "Number of requests the upstream last announced were left until its rate limit resets.",
+		}),
+		resetGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_fetch_rate_limit_reset_timestamp_seconds",
+			Help: "Unix timestamp the upstream last announced its rate limit resets at.",
+		}),
+		waits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_fetch_rate_limit_wait_seconds_total",
+			Help: "Total number of seconds requests to the upstream waited to stay under its rate limit.",
+		}),
+	}
+	if cfg.Registerer != nil {
+		cfg.Registerer.MustRegister(t.remainingGauge, t.resetGauge, t.waits)
+	}
+
+	return t
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := t.reserve(); wait > 0 {
+		timer := t.clock.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C():
+		}
+		t.waits.Add(wait.Seconds())
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err == nil {
+		t.update(resp.Header)
+	}
+
+	return resp, err
+}
+
+// reserve reserves a request within the rate limit, and returns how long it must wait before it is sent.
+func (t *RateLimitTransport) reserve() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	if !t.pace || t.remaining < 0 || !now.Before(t.reset) {
+		return 0
+	}
+
+	start := now
+	if t.next.After(start) {
+		start = t.next
+	}
+	if t.remaining == 0 {
+		// No request is left until the limit resets, at which point the upstream will announce the next limit.
+		if t.reset.After(start) {
+			start = t.reset
+		}
+		t.next = start
+		return start.Sub(now)
+	}
+
+	t.next = start
+	if start.Before(t.reset) {
+		t.next = start.Add(t.reset.Sub(start) / time.Duration(t.remaining))
+	}
+	t.remaining--
+
+	return start.Sub(now)
+}
+
+// update updates the rate limit with the one announced by the headers of a response, if any.
+func (t *RateLimitTransport) update(h http.Header) {
+	remaining, err := strconv.Atoi(h.Get(RateLimitRemainingHeader))
+	if err != nil || remaining < 0 {
+		return
+	}
+	reset, ok := parseRateLimitReset(h.Get(RateLimitResetHeader), t.clock.Now())
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	t.remaining, t.reset = remaining, reset
+	t.mu.Unlock()
+
+	t.remainingGauge.Set(float64(remaining))
+	t.resetGauge.Set(float64(reset.UnixMilli()) / 1000)
+}
+
+// parseRateLimitReset parses the reset of a rate limit, either the number of seconds until it resets or the Unix
+// timestamp it resets at, in seconds or milliseconds, as gateways differ.
+func parseRateLimitReset(value string, now time.Time) (time.Time, bool) {
+	reset, err := strconv.ParseFloat(value, 64)
+	if err != nil || reset < 0 {
+		return time.Time{}, false
+	}
+
+	switch {
+	case reset >= 1e12:
+		return time.UnixMilli(int64(reset)), true
+	case reset >= 1e9:
+		return time.UnixMilli(int64(reset * 1000)), true
+	default:
+		return now.Add(time.Duration(reset * float64(time.Second))), true
+	}
+}
@@ -0,0 +1,174 @@
+package fetch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimitReset(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	testCases := map[string]struct {
+		value string
+
+		expectReset time.Time
+		expectOK    bool
+	}{
+		"seconds until reset": {
+			value:       "30",
+			expectReset: now.Add(30 * time.Second),
+			expectOK:    true,
+		},
+		"fractional seconds until reset": {
+			value:       "0.5",
+			expectReset: now.Add(500 * time.Millisecond),
+			expectOK:    true,
+		},
+		"timestamp in seconds": {
+			value:       "1700000060",
+			expectReset: now.Add(time.Minute),
+			expectOK:    true,
+		},
+		"timestamp in milliseconds": {
+			value:       "1700000060500",
+			expectReset: now.Add(time.Minute + 500*time.Millisecond),
+			expectOK:    true,
+		},
+		"missing": {
+			value: "",
+		},
+		"negative": {
+			value: "-1",
+		},
+		"date": {
+			value: "Wed, 21 Oct 2015 07:28:00 GMT",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			reset, ok := parseRateLimitReset(tc.value, now)
+			assert.Equal(t, tc.expectOK, ok)
+			assert.True(t, tc.expectReset.Equal(reset), "expected %v, got %v", tc.expectReset, reset)
+		})
+	}
+}
+
+func TestRateLimitTransportReserve(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	testCases := map[string]struct {
+		pace      bool
+		remaining int
+		reset     time.Time
+
+		expectWaits []time.Duration
+	}{
+		"unknown limit": {
+			pace:        true,
+			remaining:   -1,
+			expectWaits: []time.Duration{0, 0},
+		},
+		"remaining requests spread until reset": {
+			pace:        true,
+			remaining:   2,
+			reset:       now.Add(10 * time.Second),
+			expectWaits: []time.Duration{0, 5 * time.Second, 10 * time.Second},
+		},
+		"no remaining request": {
+			pace:        true,
+			remaining:   0,
+			reset:       now.Add(30 * time.Second),
+			expectWaits: []time.Duration{30 * time.Second, 30 * time.Second},
+		},
+		"limit reset": {
+			pace:        true,
+			remaining:   0,
+			reset:       now.Add(-time.Second),
+			expectWaits: []time.Duration{0},
+		},
+		"not paced": {
+			remaining:   0,
+			reset:       now.Add(30 * time.Second),
+			expectWaits: []time.Duration{0},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			transport := NewRateLimitTransport(&RateLimitTransportCfg{Pace: tc.pace, Clock: clock.NewFake(now)})
+			transport.remaining, transport.reset = tc.remaining, tc.reset
+
+			waits := make([]time.Duration, 0, len(tc.expectWaits))
+			for range tc.expectWaits {
+				waits = append(waits, transport.reserve())
+			}
+			assert.Equal(t, tc.expectWaits, waits)
+		})
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set(RateLimitRemainingHeader, "0")
+		w.Header().Set(RateLimitResetHeader, "30")
+	}))
+	defer server.Close()
+
+	fake := clock.NewFake(time.Unix(1000, 0))
+	transport := NewRateLimitTransport(&RateLimitTransportCfg{
+		Transport: http.DefaultTransport,
+		Pace:      true,
+		Clock:     fake,
+	})
+	client := &http.Client{Transport: transport}
+	get := func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		assert.NoError(t, err)
+		res, err := client.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first request is sent right away and tells that no request is left for 30s.
+	assert.NoError(t, get(ctx))
+	assert.Equal(t, 0.0, testutil.ToFloat64(transport.remainingGauge))
+	assert.Equal(t, 1030.0, testutil.ToFloat64(transport.resetGauge))
+
+	// The next request waits until the limit resets.
+	done := make(chan error)
+	go func() {
+		done <- get(ctx)
+	}()
+	assert.NoError(t, fake.BlockUntil(ctx, 1))
+	assert.Equal(t, int32(1), calls.Load())
+	fake.Advance(30 * time.Second)
+	assert.NoError(t, <-done)
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, 30.0, testutil.ToFloat64(transport.waits))
+
+	// A request whose context is done while it waits isn't sent.
+	requestCtx, requestCancel := context.WithCancel(ctx)
+	go func() {
+		done <- get(requestCtx)
+	}()
+	assert.NoError(t, fake.BlockUntil(ctx, 1))
+	requestCancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Equal(t, int32(2), calls.Load())
+}
@@ -0,0 +1,146 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	rulesspec "github.com/observatorium/api/rules"
+)
+
+// partialDownload is an interrupted download of all rules, which can be resumed with a range request
+// as long as the rules keep the same ETag.
+type partialDownload struct {
+	etag string
+	// digest is the SHA-256 digest of all rules announced by the rules backend, if any.
+	digest []byte
+	data   []byte
+}
+
+// getAllRulesResumable downloads all rules, resuming interrupted downloads with range requests up to the configured
+// number of times. A download still interrupted is resumed on the next call, so that large downloads over flaky
+// connections progress from one sync to the next instead of starting over.
+func (f *RulesObjstoreFetcher) getAllRulesResumable(ctx context.Context) (io.ReadCloser, error) {
+	f.partialMtx.Lock()
+	defer f.partialMtx.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		data, err := f.downloadAllRules(ctx)
+		if err == nil {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+
+		if attempt >= f.resumeAttempts || len(f.partial.data) == 0 || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Printf("download of all rules interrupted after %d bytes, resuming it: %v", len(f.partial.data), err)
+	}
+}
+
+// downloadAllRules downloads all rules, resuming the partial download if there is one.
+// The partial download is kept if the download is interrupted again and can be resumed.
+func (f *RulesObjstoreFetcher) downloadAllRules(ctx context.Context) ([]byte, error) {
+	p := &f.partial
+
+	var editors []rulesspec.RequestEditorFn
+	if len(p.data) > 0 {
+		editors = append(editors, func(_ context.Context, req *http.Request) error {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(p.data)))
+			// The rules backend sends all rules if they changed since the partial download.
+			req.Header.Set("If-Range", p.etag)
+			return nil
+		})
+	}
+
+	res, err := f.client.ListAllRules(ctx, editors...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent && len(p.data) > 0:
+		if start, ok := contentRangeStart(res.Header.Get("Content-Range")); !ok || start != len(p.data) {
+			*p = partialDownload{}
+			return nil, fmt.Errorf("got unexpected content range from rules backend: %q", res.Header.Get("Content-Range"))
+		}
+		f.resumedDownloads.Inc()
+	case res.StatusCode/100 == 2:
+		*p = partialDownload{digest: sha256Digest(res.Header)}
+		// Weak ETags can't be used to resume downloads.
+		if etag := res.Header.Get("ETag"); res.Header.Get("Accept-Ranges") == "bytes" && strings.HasPrefix(etag, `"`) {
+			p.etag = etag
+		}
+	default:
+		return nil, &StatusError{Source: "rules backend", StatusCode: res.StatusCode}
+	}
+	f.modTimes.set("", res.Header)
+
+	buf := bytes.NewBuffer(p.data)
+	_, err = buf.ReadFrom(res.Body)
+	p.data = buf.Bytes()
+	if err != nil {
+		if p.etag == "" {
+			*p = partialDownload{}
+		}
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	data, digest := p.data, p.digest
+	*p = partialDownload{}
+
+	if digest != nil {
+		if sum := sha256.Sum256(data); !bytes.Equal(sum[:], digest) {
+			return nil, fmt.Errorf("checksum of rules from rules backend doesn't match their digest")
+		}
+	}
+
+	return data, nil
+}
+
+// contentRangeStart returns the first byte of a Content-Range header, e.g. 100 for bytes 100-199/200.
+func contentRangeStart(contentRange string) (int, bool) {
+	r, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, false
+	}
+
+	start, _, ok := strings.Cut(r, "-")
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(start)
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// sha256Digest returns the SHA-256 digest of a response announced by its Repr-Digest header (RFC 9530),
+// e.g. sha-256=:<base64>:, or by its legacy Digest header (RFC 3230), e.g. SHA-256=<base64>. It returns nil if there is none.
+func sha256Digest(h http.Header) []byte {
+	for _, header := range []string{"Repr-Digest", "Digest"} {
+		for _, d := range strings.Split(h.Get(header), ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(d), "=")
+			if !ok || !strings.EqualFold(alg, "sha-256") {
+				continue
+			}
+
+			digest, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+			if err == nil {
+				return digest
+			}
+		}
+	}
+
+	return nil
+}
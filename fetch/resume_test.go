@@ -0,0 +1,147 @@
+package fetch_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAllRulesResume(t *testing.T) {
+	changedRuleGroups := strings.ReplaceAll(ruleGroups, "TestAlert", "ChangedAlert")
+	half := len(ruleGroups) / 2
+
+	testCases := map[string]struct {
+		// contents are the rules served on each request, the last ones being served on the following requests.
+		contents []string
+		// truncated are the indexes of the requests whose response is interrupted halfway.
+		truncated      []int
+		digest         string
+		resumeAttempts int
+		syncs          int
+
+		expectErr     bool
+		expectContent string
+		expectRanges  []string
+	}{
+		"download is complete": {
+			contents:       []string{ruleGroups},
+			resumeAttempts: 1,
+			expectContent:  ruleGroups,
+			expectRanges:   []string{""},
+		},
+		"interrupted download is resumed": {
+			contents:       []string{ruleGroups},
+			truncated:      []int{0},
+			resumeAttempts: 1,
+			expectContent:  ruleGroups,
+			expectRanges:   []string{"", fmt.Sprintf("bytes=%d-", half)},
+		},
+		"interrupted download fails without resume attempts": {
+			contents:     []string{ruleGroups},
+			truncated:    []int{0},
+			expectErr:    true,
+			expectRanges: []string{""},
+		},
+		"download starts over when rules changed": {
+			contents:       []string{ruleGroups, changedRuleGroups},
+			truncated:      []int{0},
+			resumeAttempts: 1,
+			expectContent:  changedRuleGroups,
+			expectRanges:   []string{"", fmt.Sprintf("bytes=%d-", half)},
+		},
+		"partial download is resumed in the next sync": {
+			contents:       []string{ruleGroups},
+			truncated:      []int{0, 1},
+			resumeAttempts: 1,
+			syncs:          2,
+			expectContent:  ruleGroups,
+			expectRanges:   []string{"", fmt.Sprintf("bytes=%d-", half), fmt.Sprintf("bytes=%d-", half+(len(ruleGroups)-half)/2)},
+		},
+		"checksum mismatch fails": {
+			contents:       []string{ruleGroups},
+			truncated:      []int{0},
+			digest:         "sha-256=:" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)) + ":",
+			resumeAttempts: 1,
+			expectErr:      true,
+			expectRanges:   []string{"", fmt.Sprintf("bytes=%d-", half)},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ranges []string
+
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				n := len(ranges)
+				ranges = append(ranges, r.Header.Get("Range"))
+				mu.Unlock()
+
+				content := tc.contents[min(n, len(tc.contents)-1)]
+				sum := sha256.Sum256([]byte(content))
+				etag := fmt.Sprintf(`"%x"`, sum)
+				digest := tc.digest
+				if digest == "" {
+					digest = "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+				}
+				w.Header().Set("ETag", etag)
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("Repr-Digest", digest)
+
+				body, status := content, http.StatusOK
+				if start, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok && r.Header.Get("If-Range") == etag {
+					offset, err := strconv.Atoi(strings.TrimSuffix(start, "-"))
+					assert.NoError(t, err)
+					body, status = content[offset:], http.StatusPartialContent
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(content)-1, len(content)))
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				w.WriteHeader(status)
+
+				if slices.Contains(tc.truncated, n) {
+					io.WriteString(w, body[:len(body)/2])
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+				io.WriteString(w, body)
+			}
+			testServer := httptest.NewServer(http.HandlerFunc(handler))
+			defer testServer.Close()
+
+			fetcher, err := fetch.NewRulesObjstoreFetcher(testServer.URL, nil, testServer.Client(), fetch.WithResumeAttempts(tc.resumeAttempts))
+			assert.NoError(t, err)
+
+			var content []byte
+			for i := 0; i < max(tc.syncs, 1); i++ {
+				var rules io.ReadCloser
+				rules, err = fetcher.GetAllRules(context.Background())
+				if err != nil {
+					continue
+				}
+				content, err = io.ReadAll(rules)
+				rules.Close()
+			}
+
+			assert.Equal(t, tc.expectRanges, ranges)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectContent, string(content))
+		})
+	}
+}
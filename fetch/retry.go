@@ -1,18 +1,21 @@
-package main
+package fetch
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
+	"github.com/observatorium/thanos-rule-syncer/clock"
 )
 
 // RetryableTransport wraps an http.RoundTripper and retries on failure.
 type RetryableTransport struct {
 	transport     http.RoundTripper
 	backoffConfig *backoff.ExponentialBackOff
+	clock         clock.Clock
 }
 
 // RetryableTransportCfg is the configuration for a RetryableTransport.
@@ -21,6 +24,8 @@ type RetryableTransportCfg struct {
 	InitialInterval time.Duration
 	MaxInterval     time.Duration
 	MaxElapsedTime  time.Duration
+	// Clock times the backoffs, e.g. a fake clock in tests. If nil, it is the clock of the system.
+	Clock clock.Clock
 }
 
 // NewRetryableTransport creates a new RetryableTransport.
@@ -31,24 +36,47 @@ func NewRetryableTransport(cfg *RetryableTransportCfg) *RetryableTransport {
 		}
 	}
 
+	c := cfg.Clock
+	if c == nil {
+		c = clock.Real()
+	}
+
 	backoffConfig := backoff.NewExponentialBackOff()
 	setIfNotZero(&backoffConfig.InitialInterval, cfg.InitialInterval)
 	setIfNotZero(&backoffConfig.MaxInterval, cfg.MaxInterval)
 	setIfNotZero(&backoffConfig.MaxElapsedTime, cfg.MaxElapsedTime)
+	backoffConfig.Clock = c
 
 	return &RetryableTransport{
 		transport:     cfg.Transport,
 		backoffConfig: backoffConfig,
+		clock:         c,
 	}
 }
 
 func (r *RetryableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	var resp *http.Response
 	var err error
-	startTime := time.Now()
+	startTime := r.clock.Now()
 
+	attempt := 0
 	operation := func() error {
-		resp, err = r.transport.RoundTrip(req)
+		attempt++
+		attemptReq := req
+		// The body of the request was read by the previous attempt, e.g. of a PUT, so it is read again from its start.
+		if attempt > 1 && req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return backoff.Permanent(errors.New("can't retry the request, its body can't be read again"))
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return backoff.Permanent(fmt.Errorf("failed to read the body of the request again: %w", bodyErr))
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err = r.transport.RoundTrip(attemptReq)
 		if err != nil {
 			if err, ok := err.(net.Error); ok && err.Timeout() {
 				return err
@@ -64,11 +92,11 @@ func (r *RetryableTransport) RoundTrip(req *http.Request) (*http.Response, error
 			resp.Body.Close()
 			if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
 				if delay, err := time.ParseDuration(retryAfter); err == nil {
-					if delay > r.backoffConfig.MaxElapsedTime || time.Since(startTime)+delay > r.backoffConfig.MaxElapsedTime {
+					if delay > r.backoffConfig.MaxElapsedTime || r.clock.Since(startTime)+delay > r.backoffConfig.MaxElapsedTime {
 						return backoff.Permanent(fmt.Errorf("retry-after delay is greater than max elapsed time: %v", delay))
 					}
 
-					time.Sleep(delay)
+					r.clock.Sleep(delay)
 				}
 			}
 			return fmt.Errorf("rate limit reached: %d %v", resp.StatusCode, resp.Status)
@@ -80,7 +108,31 @@ func (r *RetryableTransport) RoundTrip(req *http.Request) (*http.Response, error
 		return nil
 	}
 
-	backoff.Retry(operation, r.backoffConfig)
+	backoff.RetryNotifyWithTimer(operation, r.backoffConfig, nil, &backoffTimer{clock: r.clock})
 
 	return resp, err
 }
+
+// backoffTimer times the backoffs between retries with a clock.
+type backoffTimer struct {
+	clock clock.Clock
+	timer clock.Timer
+}
+
+func (t *backoffTimer) Start(d time.Duration) {
+	if t.timer == nil {
+		t.timer = t.clock.NewTimer(d)
+		return
+	}
+	t.timer.Reset(d)
+}
+
+func (t *backoffTimer) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+func (t *backoffTimer) C() <-chan time.Time {
+	return t.timer.C()
+}
@@ -1,11 +1,15 @@
-package main
+package fetch
 
 import (
+	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/observatorium/thanos-rule-syncer/clock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,7 +19,7 @@ func TestRetryableTransport(t *testing.T) {
 	testCases := map[string]struct {
 		setupServer      func() *httptest.Server
 		transportCfg     *RetryableTransportCfg
-		expectRetries    bool
+		expectCalls      int
 		expectedError    bool
 		expectedRespCode int
 	}{
@@ -28,7 +32,7 @@ func TestRetryableTransport(t *testing.T) {
 			},
 			transportCfg:     &RetryableTransportCfg{},
 			expectedRespCode: http.StatusOK,
-			expectRetries:    false,
+			expectCalls:      1,
 		},
 		"Server Error": {
 			setupServer: func() *httptest.Server {
@@ -38,12 +42,12 @@ func TestRetryableTransport(t *testing.T) {
 				}))
 			},
 			transportCfg: &RetryableTransportCfg{
-				InitialInterval: 50 * time.Millisecond,
-				MaxInterval:     100 * time.Millisecond,
-				MaxElapsedTime:  200 * time.Millisecond,
+				InitialInterval: time.Second,
+				MaxInterval:     time.Second,
+				MaxElapsedTime:  10 * time.Second,
 			},
 			expectedRespCode: http.StatusInternalServerError,
-			expectRetries:    true,
+			expectCalls:      6,
 		},
 		"Clientside Error": {
 			setupServer: func() *httptest.Server {
@@ -54,23 +58,23 @@ func TestRetryableTransport(t *testing.T) {
 			},
 			transportCfg:     &RetryableTransportCfg{},
 			expectedRespCode: http.StatusNotFound,
-			expectRetries:    false,
+			expectCalls:      1,
 		},
 		"Rate Limiting": {
 			setupServer: func() *httptest.Server {
 				return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 					callsCount++
-					w.Header().Set("Retry-After", "100ms")
+					w.Header().Set("Retry-After", "1s")
 					w.WriteHeader(http.StatusTooManyRequests)
 				}))
 			},
 			transportCfg: &RetryableTransportCfg{
-				InitialInterval: 50 * time.Millisecond,
-				MaxInterval:     100 * time.Millisecond,
-				MaxElapsedTime:  200 * time.Millisecond,
+				InitialInterval: time.Second,
+				MaxInterval:     time.Second,
+				MaxElapsedTime:  10 * time.Second,
 			},
 			expectedRespCode: http.StatusTooManyRequests,
-			expectRetries:    true,
+			expectCalls:      3,
 		},
 		"Rate Limiting with excessive Retry-After": {
 			setupServer: func() *httptest.Server {
@@ -81,12 +85,12 @@ func TestRetryableTransport(t *testing.T) {
 				}))
 			},
 			transportCfg: &RetryableTransportCfg{
-				InitialInterval: 50 * time.Millisecond,
-				MaxInterval:     100 * time.Millisecond,
-				MaxElapsedTime:  200 * time.Millisecond,
+				InitialInterval: time.Second,
+				MaxInterval:     time.Second,
+				MaxElapsedTime:  10 * time.Second,
 			},
 			expectedRespCode: http.StatusTooManyRequests,
-			expectRetries:    false,
+			expectCalls:      1,
 		},
 	}
 
@@ -96,16 +100,26 @@ func TestRetryableTransport(t *testing.T) {
 			server := tc.setupServer()
 			defer server.Close()
 
+			// Each backoff and Retry-After delay is over once the clock is advanced by 2s.
+			fakeClock := clock.NewFake(time.Unix(0, 0))
 			tc.transportCfg.Transport = server.Client().Transport
+			tc.transportCfg.Clock = fakeClock
 			transport := NewRetryableTransport(tc.transportCfg)
 
 			req, err := http.NewRequest("GET", server.URL, nil)
 			assert.NoError(t, err)
 
-			resp, err := transport.RoundTrip(req)
-			if tc.expectRetries {
-				assert.True(t, callsCount > 1)
+			var resp *http.Response
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				defer cancel()
+				resp, err = transport.RoundTrip(req)
+			}()
+			for fakeClock.BlockUntil(ctx, 1) == nil {
+				fakeClock.Advance(2 * time.Second)
 			}
+
+			assert.Equal(t, tc.expectCalls, callsCount)
 			if tc.expectedError {
 				assert.Error(t, err)
 				return
@@ -116,3 +130,43 @@ func TestRetryableTransport(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryableTransportBody(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	fakeClock := clock.NewFake(time.Unix(0, 0))
+	transport := NewRetryableTransport(&RetryableTransportCfg{
+		Transport:       server.Client().Transport,
+		InitialInterval: time.Second,
+		MaxInterval:     time.Second,
+		MaxElapsedTime:  10 * time.Second,
+		Clock:           fakeClock,
+	})
+
+	req, err := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("groups: []"))
+	assert.NoError(t, err)
+
+	var resp *http.Response
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		resp, err = transport.RoundTrip(req)
+	}()
+	for fakeClock.BlockUntil(ctx, 1) == nil {
+		fakeClock.Advance(2 * time.Second)
+	}
+
+	// The retry sends the whole body again.
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"groups: []", "groups: []"}, bodies)
+}
@@ -0,0 +1,201 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"gopkg.in/yaml.v3"
+)
+
+// WithSpoolDir keeps the rules of each tenant in a fragment file of the given directory from the time they are fetched
+// and parsed, and concatenates the fragments in the order of the tenant IDs once all tenants are fetched, so that the
+// rules are in the same order whatever order they were fetched in. The fragment of a tenant is its last valid rules: it
+// is kept while the rules of the tenant are invalid or not found, until it is removed or deleted, and across restarts
+// if the directory persists. The concatenated rules are still read, merged and checked as a whole in memory, as some
+// of the processing of the syncer spans tenants, so the spool doesn't reduce its peak memory.
+func WithSpoolDir(dir string) RulesObjstoreFetcherOption {
+	return func(f *RulesObjstoreFetcher) {
+		f.spool = &spool{dir: dir}
+	}
+}
+
+// fragmentExt is the extension of the fragment files of tenants.
+const fragmentExt = ".yaml"
+
+// spool keeps the rule groups of tenants in fragment files, each holding the YAML sequence of the groups of a tenant,
+// so that they are concatenated into a rules file under a groups key.
+type spool struct {
+	dir string
+}
+
+// path returns the path of the fragment of the tenant, whose ID is escaped to be a valid file name.
+func (s *spool) path(tenant string) string {
+	return filepath.Join(s.dir, url.PathEscape(tenant)+fragmentExt)
+}
+
+// write replaces the fragment of the tenant with the given groups, atomically so that an interrupted write doesn't
+// lose its previous groups.
+func (s *spool) write(tenant string, groups []rules.RuleGroup) error {
+	var content []byte
+	if len(groups) > 0 {
+		var err error
+		if content, err = yaml.Marshal(groups); err != nil {
+			return fmt.Errorf("failed to marshal rules of tenant %s: %w", tenant, err)
+		}
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".fragment-*")
+	if err != nil {
+		return fmt.Errorf("failed to create fragment of tenant %s: %w", tenant, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write fragment of tenant %s: %w", tenant, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write fragment of tenant %s: %w", tenant, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(tenant)); err != nil {
+		return fmt.Errorf("failed to rename fragment of tenant %s: %w", tenant, err)
+	}
+
+	return nil
+}
+
+// has tells whether the tenant has a fragment.
+func (s *spool) has(tenant string) bool {
+	_, err := os.Stat(s.path(tenant))
+	return err == nil
+}
+
+// remove removes the fragment of the tenant, if any.
+func (s *spool) remove(tenant string) error {
+	if err := os.Remove(s.path(tenant)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove fragment of tenant %s: %w", tenant, err)
+	}
+
+	return nil
+}
+
+// tenants returns the tenants with a fragment.
+func (s *spool) tenants() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	var tenants []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), fragmentExt)
+		if !ok || entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if tenant, err := url.PathUnescape(name); err == nil {
+			tenants = append(tenants, tenant)
+		}
+	}
+
+	return tenants, nil
+}
+
+// open returns the rules file concatenating the fragments of the given tenants in the order of their IDs.
+// The fragments are opened one at a time while the rules are read.
+func (s *spool) open(tenants []string) io.ReadCloser {
+	tenants = slices.Clone(tenants)
+	slices.Sort(tenants)
+
+	return &fragmentsReader{spool: s, tenants: tenants}
+}
+
+// fragmentsReader reads the fragments of tenants in order under a groups key, or an empty list of groups if they
+// have no groups.
+type fragmentsReader struct {
+	spool   *spool
+	tenants []string
+	// current is the fragment being read, and header the rest of the groups key to read before it.
+	current *os.File
+	header  string
+	started bool
+	done    bool
+}
+
+func (r *fragmentsReader) Read(p []byte) (int, error) {
+	for {
+		if r.header != "" {
+			n := copy(p, r.header)
+			r.header = r.header[n:]
+			return n, nil
+		}
+		if r.current != nil {
+			n, err := r.current.Read(p)
+			if errors.Is(err, io.EOF) {
+				r.current.Close()
+				r.current, err = nil, nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// next opens the next non-empty fragment, preceded by the groups key if it is the first one, or ends the rules.
+func (r *fragmentsReader) next() error {
+	for len(r.tenants) > 0 {
+		tenant := r.tenants[0]
+		r.tenants = r.tenants[1:]
+
+		file, err := os.Open(r.spool.path(tenant))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open fragment of tenant %s: %w", tenant, err)
+		}
+		info, err := file.Stat()
+		if err != nil || info.Size() == 0 {
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("failed to open fragment of tenant %s: %w", tenant, err)
+			}
+			continue
+		}
+
+		r.current = file
+		if !r.started {
+			r.started, r.header = true, "groups:\n"
+		}
+		return nil
+	}
+
+	r.done = true
+	if !r.started {
+		r.started, r.header = true, "groups: []\n"
+	}
+	return nil
+}
+
+func (r *fragmentsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package fetch_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRulesObjstoreFetcherSpool(t *testing.T) {
+	invalid := "groups:\n- name: test\n  rules:\n  - alert: TestAlert\n    expr: vector(1\n"
+	var mtx sync.Mutex
+	bodies := map[string]string{"tenant/a": ruleGroups, "tenant-b": ruleGroups, "tenant-c": invalid}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		tenant, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1/rules/"))
+		assert.NoError(t, err)
+		_, _ = w.Write([]byte(bodies[tenant]))
+	}))
+	defer server.Close()
+	setBody := func(tenant, body string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		bodies[tenant] = body
+	}
+
+	dir := filepath.Join(t.TempDir(), "spool")
+	newFetcher := func(tenants ...string) *fetch.RulesObjstoreFetcher {
+		fetcher, err := fetch.NewRulesObjstoreFetcher(server.URL, tenants, server.Client(), fetch.WithSpoolDir(dir))
+		assert.NoError(t, err)
+		return fetcher
+	}
+	getRules := func(fetcher *fetch.RulesObjstoreFetcher) (string, []string) {
+		t.Helper()
+		body, err := fetcher.GetTenantsRules(context.Background())
+		assert.NoError(t, err)
+		defer body.Close()
+		content, err := io.ReadAll(body)
+		assert.NoError(t, err)
+		groups, errs := rulefmt.Parse(content)
+		assert.Empty(t, errs)
+
+		var names []string
+		for _, group := range groups.Groups {
+			names = append(names, group.Name)
+		}
+		return string(content), names
+	}
+	fragments := func() []string {
+		entries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	// The rules are in the order of the tenants, whatever the order they are configured and fetched in.
+	fetcher := newFetcher("tenant/a", "tenant-c", "tenant-b")
+	_, names := getRules(fetcher)
+	assert.Equal(t, []string{"tenant-b.test", "tenant-b.test2", "tenant/a.test", "tenant/a.test2"}, names)
+	assert.Equal(t, []string{"tenant%2Fa.yaml", "tenant-b.yaml"}, fragments())
+
+	// A tenant uploading invalid rules keeps its fragment, across restarts too.
+	setBody("tenant-b", invalid)
+	_, names = getRules(newFetcher("tenant-b", "tenant/a"))
+	assert.Equal(t, []string{"tenant-b.test", "tenant-b.test2", "tenant/a.test", "tenant/a.test2"}, names)
+
+	// The fragments of removed tenants are removed, and tenants without groups have none.
+	setBody("tenant/a", "groups: []\n")
+	fetcher.SetTenants([]string{"tenant/a"})
+	content, names := getRules(fetcher)
+	assert.Empty(t, names)
+	assert.Equal(t, "groups: []\n", content)
+	assert.Equal(t, []string{"tenant%2Fa.yaml"}, fragments())
+}
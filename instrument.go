@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 
+	"github.com/observatorium/thanos-rule-syncer/metrics"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -22,11 +23,11 @@ func newRoundTripperInstrumenter(r prometheus.Registerer) *roundTripperInstrumen
 			[]string{"code", "method", "client"},
 		),
 		requestDuration: prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
+			metrics.HistogramOpts(prometheus.HistogramOpts{
 				Name:    "request_duration_seconds",
 				Help:    "A histogram of request latencies.",
 				Buckets: prometheus.DefBuckets,
-			},
+			}),
 			[]string{"method", "client"},
 		),
 	}
@@ -0,0 +1,5 @@
+// Package flock takes exclusive locks of files shared with other processes, e.g. syncers sharing a ruler.
+//
+// File locks are only supported on unix platforms. On other platforms, taking a lock fails with an error wrapping
+// errors.ErrUnsupported rather than falling back to a lock within the process, which other syncers wouldn't see.
+package flock
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package flock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errUnsupported = fmt.Errorf("file locks are not supported on this platform: %w", errors.ErrUnsupported)
+
+// TryLock fails as file locks are not supported on this platform.
+func TryLock(_ *os.File) (bool, error) {
+	return false, errUnsupported
+}
+
+// Unlock fails as file locks are not supported on this platform.
+func Unlock(_ *os.File) error {
+	return errUnsupported
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package flock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTryLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	open := func() *os.File {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o666)
+		assert.NoError(t, err)
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	holder, other := open(), open()
+
+	locked, err := TryLock(holder)
+	assert.NoError(t, err)
+	assert.True(t, locked)
+
+	// The lock is held until it is released, even within the process.
+	locked, err = TryLock(other)
+	assert.NoError(t, err)
+	assert.False(t, locked)
+
+	assert.NoError(t, Unlock(holder))
+	locked, err = TryLock(other)
+	assert.NoError(t, err)
+	assert.True(t, locked)
+
+	// Closing the file releases the lock too.
+	assert.NoError(t, other.Close())
+	locked, err = TryLock(holder)
+	assert.NoError(t, err)
+	assert.True(t, locked)
+}
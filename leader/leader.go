@@ -0,0 +1,95 @@
+// Package leader elects the active syncer among instances sharing a lock file, e.g. on a volume shared by the syncers
+// of a disaster recovery setup, so that a standby takes over as soon as the active syncer exits.
+package leader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/internal/flock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Elector elects the syncer holding the exclusive lock of a lock file as the leader. The lock is held until the
+// context of Run is done or the process exits, even if it crashes, the lock being released by the operating system.
+type Elector struct {
+	path     string
+	interval time.Duration
+
+	leader prometheus.Gauge
+}
+
+// NewElector creates a new Elector trying to take the lock of the file at path at every interval. Its metrics are
+// registered with the given registerer, if not nil.
+func NewElector(r prometheus.Registerer, path string, interval time.Duration) *Elector {
+	e := &Elector{
+		path:     path,
+		interval: interval,
+		leader: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_leader",
+			Help: "Whether the syncer holds the lock of the leader election lock file.",
+		}),
+	}
+
+	if r != nil {
+		r.MustRegister(e.leader)
+	}
+
+	return e
+}
+
+// Run waits until the syncer holds the lock, calls elected, and holds the lock until the context is done.
+// Failing to open or lock the file is an error, e.g. on platforms without file locks, see flock.
+func (e *Elector) Run(ctx context.Context, elected func()) error {
+	f, err := os.OpenFile(e.path, os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return fmt.Errorf("failed to open the leader lock file: %w", err)
+	}
+	defer f.Close()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		locked, err := flock.TryLock(f)
+		if err != nil {
+			return fmt.Errorf("failed to lock the leader lock file %s: %w", e.path, err)
+		}
+		if locked {
+			break
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	e.leader.Set(1)
+	defer e.leader.Set(0)
+	if err := recordLeader(f); err != nil {
+		// The record is only informative, e.g. for operators looking for the leader.
+		log.Printf("failed to write the leader lock file %s: %v", e.path, err)
+	}
+	elected()
+
+	<-ctx.Done()
+	return nil
+}
+
+// recordLeader records the host and process ID of the leader in the lock file.
+func recordLeader(f *os.File) error {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt([]byte(fmt.Sprintf("%s %d\n", host, os.Getpid())), 0)
+
+	return err
+}
@@ -0,0 +1,62 @@
+//go:build unix
+
+package leader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestElectorRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	first := NewElector(nil, path, 10*time.Millisecond)
+	second := NewElector(nil, path, 10*time.Millisecond)
+
+	firstCtx, firstCancel := context.WithCancel(context.Background())
+	firstElected := make(chan struct{})
+	firstDone := make(chan error, 1)
+	go func() {
+		firstDone <- first.Run(firstCtx, func() { close(firstElected) })
+	}()
+	<-firstElected
+	assert.Equal(t, 1.0, testutil.ToFloat64(first.leader))
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(string(content)), " "+strconv.Itoa(os.Getpid())))
+
+	// The second syncer isn't elected while the first one holds the lock.
+	secondCtx, secondCancel := context.WithCancel(context.Background())
+	defer secondCancel()
+	secondElected := make(chan struct{})
+	secondDone := make(chan error, 1)
+	go func() {
+		secondDone <- second.Run(secondCtx, func() { close(secondElected) })
+	}()
+	select {
+	case <-secondElected:
+		t.Fatal("second syncer elected while the first one is the leader")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// It is elected once the first one stops.
+	firstCancel()
+	assert.NoError(t, <-firstDone)
+	assert.Equal(t, 0.0, testutil.ToFloat64(first.leader))
+	select {
+	case <-secondElected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second syncer not elected after the first one stopped")
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(second.leader))
+
+	secondCancel()
+	assert.NoError(t, <-secondDone)
+}
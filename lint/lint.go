@@ -0,0 +1,260 @@
+// Package lint checks that the alerting rules of tenants follow conventions, e.g. that their severity is one of an
+// allowed set, so that alert hygiene is enforced when rules are synced instead of in reviews.
+package lint
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// Policies of handling the alerts violating conventions.
+const (
+	// PolicyWarn only reports the violations.
+	PolicyWarn = "warn"
+	// PolicyDrop removes the violating alerts from the rules, keeping the other rules of their groups.
+	PolicyDrop = "drop"
+	// PolicyReject fails the sync, so that the ruler keeps its rules.
+	PolicyReject = "reject"
+)
+
+// Conventions checked.
+const (
+	// ConventionSeverity requires the severity label of alerts to be one of the allowed severities.
+	ConventionSeverity = "severity"
+	// ConventionFor requires alerts not of a critical severity to be pending for at least a minimum duration,
+	// so that they don't fire on blips.
+	ConventionFor = "for"
+)
+
+// DefaultSeverityLabel is the label holding the severity of alerts.
+const DefaultSeverityLabel = "severity"
+
+// Config configures a Linter.
+type Config struct {
+	// Policy handles the alerts violating conventions.
+	Policy string
+	// SeverityLabel is the label holding the severity of alerts. If empty, it is DefaultSeverityLabel.
+	SeverityLabel string
+	// Severities are the allowed values of the severity label. If empty, the severity is not checked.
+	Severities []string
+	// CriticalSeverities are the severities of alerts exempt from MinFor.
+	CriticalSeverities []string
+	// MinFor is the minimum for of alerts not of a critical severity. If 0, it is not checked.
+	MinFor time.Duration
+}
+
+// Violation is a violation of a convention by an alert.
+type Violation struct {
+	Group      string `json:"group"`
+	Alert      string `json:"alert"`
+	Convention string `json:"convention"`
+	Message    string `json:"message"`
+}
+
+// Linter checks that the alerts of tenants follow conventions, and reports the violations of each tenant.
+type Linter struct {
+	cfg         Config
+	groupTenant func(groupName string) string
+
+	// report are the violations found by the last check, by tenant.
+	report   map[string][]Violation
+	reportMu sync.RWMutex
+
+	violations *prometheus.GaugeVec
+}
+
+// New creates a new Linter checking the conventions of the config. The tenant owning a group is given by groupTenant.
+func New(r prometheus.Registerer, cfg Config, groupTenant func(groupName string) string) (*Linter, error) {
+	switch cfg.Policy {
+	case PolicyWarn, PolicyDrop, PolicyReject:
+	default:
+		return nil, fmt.Errorf("unknown convention violations policy %q", cfg.Policy)
+	}
+	if cfg.MinFor < 0 {
+		return nil, fmt.Errorf("negative minimum for %s", cfg.MinFor)
+	}
+	if cfg.SeverityLabel == "" {
+		cfg.SeverityLabel = DefaultSeverityLabel
+	}
+
+	l := &Linter{
+		cfg:         cfg,
+		groupTenant: groupTenant,
+		report:      map[string][]Violation{},
+		violations: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_lint_violations",
+			Help: "Number of alerts of tenants violating conventions in the last synced rules, by tenant and convention.",
+		}, []string{"tenant", "convention"}),
+	}
+
+	if r != nil {
+		r.MustRegister(l.violations)
+	}
+
+	return l, nil
+}
+
+// Enabled returns whether any convention is checked.
+func (l *Linter) Enabled() bool {
+	return len(l.cfg.Severities) > 0 || l.cfg.MinFor > 0
+}
+
+// Check checks the alerts against the conventions, reports the violations and handles them according to the policy.
+func (l *Linter) Check(_ context.Context, content []byte) ([]byte, error) {
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	report := map[string][]Violation{}
+	dropped := 0
+	for i := range groups.Groups {
+		group := &groups.Groups[i]
+		tenant := l.groupTenant(group.Name)
+		if _, ok := report[tenant]; !ok {
+			// Tenants following the conventions are reported without violations.
+			report[tenant] = []Violation{}
+		}
+
+		kept := group.Rules[:0]
+		for _, rule := range group.Rules {
+			violations := l.check(group.Name, rule.Alert.Value, rule.Labels[l.cfg.SeverityLabel], time.Duration(rule.For))
+			report[tenant] = append(report[tenant], violations...)
+			if len(violations) > 0 && l.cfg.Policy == PolicyDrop {
+				dropped++
+				continue
+			}
+			kept = append(kept, rule)
+		}
+		group.Rules = kept
+	}
+
+	l.setReport(report)
+
+	tenants := make([]string, 0, len(report))
+	for tenant := range report {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	var msgs []string
+	for _, tenant := range tenants {
+		for _, v := range report[tenant] {
+			msgs = append(msgs, fmt.Sprintf("tenant %s: %s", tenant, v.Message))
+		}
+	}
+	if len(msgs) == 0 {
+		return content, nil
+	}
+
+	switch l.cfg.Policy {
+	case PolicyReject:
+		return nil, fmt.Errorf("alerts violate conventions: %s", strings.Join(msgs, "; "))
+	case PolicyDrop:
+		log.Printf("dropped %d alerts violating conventions: %s", dropped, strings.Join(msgs, "; "))
+	default:
+		log.Printf("alerts violate conventions: %s", strings.Join(msgs, "; "))
+		return content, nil
+	}
+
+	checked, err := yaml.Marshal(groups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	return checked, nil
+}
+
+// Validate checks the alerts against the conventions like Check, without reporting the violations nor changing the rules,
+// e.g. to give feedback on the rules of a tenant before they are synced. It returns the violations, and an error if there
+// are any and the policy rejects them.
+func (l *Linter) Validate(_ context.Context, content []byte) ([]Violation, error) {
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	var violations []Violation
+	for _, group := range groups.Groups {
+		for _, rule := range group.Rules {
+			violations = append(violations, l.check(group.Name, rule.Alert.Value, rule.Labels[l.cfg.SeverityLabel], time.Duration(rule.For))...)
+		}
+	}
+
+	if len(violations) > 0 && l.cfg.Policy == PolicyReject {
+		msgs := make([]string, 0, len(violations))
+		for _, v := range violations {
+			msgs = append(msgs, v.Message)
+		}
+		return violations, fmt.Errorf("alerts violate conventions: %s", strings.Join(msgs, "; "))
+	}
+
+	return violations, nil
+}
+
+// check returns the violations of the conventions by a rule, which are none for recording rules.
+func (l *Linter) check(group, alert, severity string, pendingFor time.Duration) []Violation {
+	if alert == "" {
+		return nil
+	}
+
+	var violations []Violation
+	add := func(convention, format string, args ...any) {
+		violations = append(violations, Violation{
+			Group:      group,
+			Alert:      alert,
+			Convention: convention,
+			Message:    fmt.Sprintf("group %q: alert %s ", group, alert) + fmt.Sprintf(format, args...),
+		})
+	}
+
+	if len(l.cfg.Severities) > 0 && !slices.Contains(l.cfg.Severities, severity) {
+		if severity == "" {
+			add(ConventionSeverity, "has no %s label, must be one of: %s", l.cfg.SeverityLabel, strings.Join(l.cfg.Severities, ", "))
+		} else {
+			add(ConventionSeverity, "has %s %q, must be one of: %s", l.cfg.SeverityLabel, severity, strings.Join(l.cfg.Severities, ", "))
+		}
+	}
+
+	if pendingFor < l.cfg.MinFor && !slices.Contains(l.cfg.CriticalSeverities, severity) {
+		add(ConventionFor, "is pending for %s, must be at least %s unless critical", pendingFor, l.cfg.MinFor)
+	}
+
+	return violations
+}
+
+func (l *Linter) setReport(report map[string][]Violation) {
+	l.reportMu.Lock()
+	defer l.reportMu.Unlock()
+
+	l.violations.Reset()
+	for tenant, violations := range report {
+		for _, v := range violations {
+			l.violations.WithLabelValues(tenant, v.Convention).Inc()
+		}
+	}
+	l.report = report
+}
+
+// Report returns the violations found by the last check, by tenant.
+func (l *Linter) Report() map[string][]Violation {
+	l.reportMu.RLock()
+	defer l.reportMu.RUnlock()
+
+	report := make(map[string][]Violation, len(l.report))
+	for tenant, violations := range l.report {
+		report[tenant] = slices.Clone(violations)
+	}
+
+	return report
+}
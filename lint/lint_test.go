@@ -0,0 +1,203 @@
+package lint
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const tenantsRules = `groups:
+- name: tenant-a.alerts
+  rules:
+  - alert: Down
+    expr: up == 0
+    for: 5m
+    labels:
+      severity: warning
+  - alert: Flapping
+    expr: changes(up[5m]) > 3
+    labels:
+      severity: warning
+  - record: job:up:sum
+    expr: sum by (job) (up)
+- name: tenant-b.alerts
+  rules:
+  - alert: Burning
+    expr: vector(1)
+    labels:
+      severity: critical
+  - alert: Unknown
+    expr: vector(1)
+    for: 10m
+    labels:
+      severity: page
+`
+
+func groupTenant(groupName string) string {
+	tenant, _, _ := strings.Cut(groupName, ".")
+	return tenant
+}
+
+func TestLinter(t *testing.T) {
+	testCases := map[string]struct {
+		cfg Config
+
+		expectErr        bool
+		expectAlerts     []string
+		expectViolations map[string][]string
+	}{
+		"no conventions": {
+			cfg:              Config{Policy: PolicyWarn},
+			expectAlerts:     []string{"Down", "Flapping", "Burning", "Unknown"},
+			expectViolations: map[string][]string{"tenant-a": {}, "tenant-b": {}},
+		},
+		"violations are reported": {
+			cfg: Config{
+				Policy:             PolicyWarn,
+				Severities:         []string{"critical", "warning", "info"},
+				CriticalSeverities: []string{"critical"},
+				MinFor:             time.Minute,
+			},
+			expectAlerts: []string{"Down", "Flapping", "Burning", "Unknown"},
+			expectViolations: map[string][]string{
+				"tenant-a": {"Flapping/for"},
+				"tenant-b": {"Unknown/severity"},
+			},
+		},
+		"violating alerts are dropped": {
+			cfg: Config{
+				Policy:             PolicyDrop,
+				Severities:         []string{"critical", "warning", "info"},
+				CriticalSeverities: []string{"critical"},
+				MinFor:             time.Minute,
+			},
+			expectAlerts: []string{"Down", "Burning"},
+			expectViolations: map[string][]string{
+				"tenant-a": {"Flapping/for"},
+				"tenant-b": {"Unknown/severity"},
+			},
+		},
+		"violations are rejected": {
+			cfg: Config{
+				Policy: PolicyReject,
+				MinFor: time.Minute,
+			},
+			expectErr: true,
+			expectViolations: map[string][]string{
+				"tenant-a": {"Flapping/for"},
+				"tenant-b": {"Burning/for"},
+			},
+		},
+		"custom severity label": {
+			cfg: Config{
+				Policy:        PolicyWarn,
+				SeverityLabel: "priority",
+				Severities:    []string{"P1"},
+			},
+			expectAlerts: []string{"Down", "Flapping", "Burning", "Unknown"},
+			expectViolations: map[string][]string{
+				"tenant-a": {"Down/severity", "Flapping/severity"},
+				"tenant-b": {"Burning/severity", "Unknown/severity"},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			l, err := New(prometheus.NewRegistry(), tc.cfg, groupTenant)
+			assert.NoError(t, err)
+
+			checked, err := l.Check(context.Background(), []byte(tenantsRules))
+			violations := map[string][]string{}
+			for tenant, vs := range l.Report() {
+				violations[tenant] = []string{}
+				for _, v := range vs {
+					violations[tenant] = append(violations[tenant], v.Alert+"/"+v.Convention)
+				}
+			}
+			assert.Equal(t, tc.expectViolations, violations)
+
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			for _, alert := range []string{"Down", "Flapping", "Burning", "Unknown"} {
+				assert.Equal(t, slices.Contains(tc.expectAlerts, alert), strings.Contains(string(checked), "alert: "+alert), alert)
+			}
+			assert.Contains(t, string(checked), "record: job:up:sum")
+		})
+	}
+}
+
+func TestLinterValidate(t *testing.T) {
+	testCases := map[string]struct {
+		policy string
+
+		expectErr bool
+	}{
+		"violations are warned about": {
+			policy: PolicyWarn,
+		},
+		"violations are dropped": {
+			policy: PolicyDrop,
+		},
+		"violations are rejected": {
+			policy:    PolicyReject,
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			l, err := New(prometheus.NewRegistry(), Config{Policy: tc.policy, MinFor: time.Minute}, groupTenant)
+			assert.NoError(t, err)
+
+			violations, err := l.Validate(context.Background(), []byte(tenantsRules))
+			if tc.expectErr {
+				assert.ErrorContains(t, err, "alert Flapping is pending for 0s")
+			} else {
+				assert.NoError(t, err)
+			}
+
+			var alerts []string
+			for _, v := range violations {
+				alerts = append(alerts, v.Alert+"/"+v.Convention)
+			}
+			assert.Equal(t, []string{"Flapping/for", "Burning/for"}, alerts)
+
+			// Validations are not reported.
+			assert.Empty(t, l.Report())
+			assert.Equal(t, 0, testutil.CollectAndCount(l.violations))
+		})
+	}
+}
+
+func TestLinterMetrics(t *testing.T) {
+	l, err := New(nil, Config{Policy: PolicyWarn, MinFor: time.Minute}, groupTenant)
+	assert.NoError(t, err)
+
+	_, err = l.Check(context.Background(), []byte(tenantsRules))
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(l.violations.WithLabelValues("tenant-a", ConventionFor)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(l.violations.WithLabelValues("tenant-b", ConventionFor)))
+
+	// Violations fixed by tenants are not reported anymore.
+	_, err = l.Check(context.Background(), []byte(tenantsRules[:strings.Index(tenantsRules, "- name: tenant-b")]))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, testutil.CollectAndCount(l.violations))
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New(nil, Config{Policy: "ignore"}, groupTenant)
+	assert.Error(t, err)
+
+	_, err = New(nil, Config{Policy: PolicyWarn, MinFor: -time.Minute}, groupTenant)
+	assert.Error(t, err)
+}
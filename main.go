@@ -1,89 +1,529 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"io/fs"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/coreos/go-oidc"
+	"github.com/cenkalti/backoff/v4"
 	"github.com/metalmatze/signal/internalserver"
+	"github.com/nats-io/nats.go"
+	"github.com/observatorium/thanos-rule-syncer/adaptive"
+	"github.com/observatorium/thanos-rule-syncer/amroute"
+	"github.com/observatorium/thanos-rule-syncer/canary"
+	"github.com/observatorium/thanos-rule-syncer/chaos"
+	"github.com/observatorium/thanos-rule-syncer/compat"
+	syncconfig "github.com/observatorium/thanos-rule-syncer/config"
+	"github.com/observatorium/thanos-rule-syncer/divergence"
+	"github.com/observatorium/thanos-rule-syncer/events"
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/leader"
+	"github.com/observatorium/thanos-rule-syncer/lint"
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/metrics"
+	"github.com/observatorium/thanos-rule-syncer/otlp"
+	"github.com/observatorium/thanos-rule-syncer/output"
+	"github.com/observatorium/thanos-rule-syncer/reload"
+	"github.com/observatorium/thanos-rule-syncer/report"
+	"github.com/observatorium/thanos-rule-syncer/route"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/observatorium/thanos-rule-syncer/secret"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/observatorium/thanos-rule-syncer/tmplcheck"
+	"github.com/observatorium/thanos-rule-syncer/usage"
 	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/clientcredentials"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/automaxprocs/maxprocs"
+)
+
+// Modes of running sync cycles.
+const (
+	// syncModeLoop runs sync cycles at every interval or at the times of the schedule.
+	syncModeLoop = "loop"
+	// syncModeHTTP runs a sync cycle on each request to the /sync endpoint, e.g. on serverless platforms.
+	syncModeHTTP = "http"
+	// syncModeOnce runs a single sync cycle and exits, e.g. in jobs.
+	syncModeOnce = "once"
 )
 
 type config struct {
 	rulesBackendURL  string
+	fetchConcurrency int
+	adaptive         adaptiveConfig
+	fetchWatch       bool
+	fetchBatchSize   int
+	fetchSpoolDir    string
+	fetchRateLimit   bool
+	fetchCacheTTL    time.Duration
+	fetchResume      int
+	fetchDeletion    fetchDeletionConfig
+	failover         failoverConfig
+	fetchBindAddress string
+	fetchDNS         fetchDNSConfig
+	fetchSPIFFE      fetchSPIFFEConfig
+	fetchShuffle     fetchShuffleConfig
 	observatoriumURL string
 	observatoriumCA  string
+	caReloadInterval time.Duration
+	httpClient       httpClientConfig
 	thanosRuleURL    string
+	thanos           thanosConfig
 	file             string
 	tenant           string
+	configFile       string
+	pipelines        []pipelineConfig
 	tenantsFile      string
+	tenantsFormat    string
+	tenantsRemoval   tenantsRemovalConfig
+	fallback         fallbackConfig
 	oidc             oidcConfig
+	oidcDiscovery    oidcDiscoveryConfig
+	secrets          secretsConfig
 	interval         uint
+	schedule         string
+	syncMode         string
+	syncWatchdog     bool
+	skipUnchanged    bool
+	source           string
+	overlapPolicy    string
+	timeouts         syncer.Timeouts
+	merge            mergeConfig
+	lint             lintConfig
+	templatesPolicy  string
+	amConfigFile     string
+	output           outputConfig
+	postWrite        postWriteConfig
+	report           reportConfig
+	events           eventsConfig
+	standby          standbyConfig
+	usage            usageConfig
+	otlp             otlpConfig
+	nats             natsConfig
+	divergenceCheck  time.Duration
+	canary           canaryConfig
+	reload           reloadConfig
+	startupTimeout   time.Duration
+
+	listenInternal  string
+	adminTokenFile  string
+	enableLifecycle bool
+	debugRules      bool
+	validate        bool
+
+	nativeHistograms bool
 
-	listenInternal string
+	chaos chaosConfig
 }
 
-type oidcConfig struct {
-	audience     string
-	clientID     string
-	clientSecret string
-	issuerURL    string
+type fallbackConfig struct {
+	FallbackConfig
+	afterFailures int
+}
+
+type fetchDNSConfig struct {
+	resolver string
+	refresh  bool
+}
+
+type fetchSPIFFEConfig struct {
+	enabled  bool
+	socket   string
+	serverID string
+}
+
+type fetchShuffleConfig struct {
+	enabled bool
+	seed    int64
 }
 
-type fetcher interface {
-	getRules(ctx context.Context) (rules io.ReadCloser, err error)
+type httpClientConfig struct {
+	dialTimeout         time.Duration
+	tlsHandshakeTimeout time.Duration
+	proxyUsername       string
+	proxyPassword       string
+	tlsMinVersion       string
+	tlsCipherSuites     string
+	// tls is the TLS configuration of -tls.min-version and -tls.cipher-suites.
+	tls *tls.Config
 }
 
-type fetcherFunc func(ctx context.Context) (rules io.ReadCloser, err error)
+type fetchDeletionConfig struct {
+	notFoundThreshold int
+	tombstones        bool
+}
 
-func (f fetcherFunc) getRules(ctx context.Context) (rules io.ReadCloser, err error) {
-	return f(ctx)
+type reloadConfig struct {
+	extraURLs    string
+	retries      int
+	retryBackoff time.Duration
+	quorum       int
+	lockFile     string
+	debounce     time.Duration
+}
+
+type canaryConfig struct {
+	tenant        string
+	queryURL      string
+	period        time.Duration
+	grace         time.Duration
+	checkInterval time.Duration
+}
+
+type tenantsRemovalConfig struct {
+	maxPercent float64
+	allowMass  bool
+}
+
+type thanosConfig struct {
+	version                string
+	unsupportedFields      string
+	unsupportedFieldPolicy string
+}
+
+type outputConfig struct {
+	fileMode      string
+	dirMode       string
+	fsync         bool
+	preserveOwner bool
+	contentAddr   bool
+	provenance    bool
+	routingFile   string
+	tenantDir     string
+	fileTemplate  string
+	nameTemplate  string
+	ruleFiles     string
+	tenantGrace   time.Duration
+	maxRules      int
+	maxBytes      int
+	scrapeHints   string
+}
+
+// tenantTemplate returns the path template of the rules files of tenants, of -file-template or -output.tenant-dir,
+// or an empty string if the rules are written to a single file.
+func (c outputConfig) tenantTemplate() string {
+	if c.tenantDir != "" {
+		return filepath.Join(c.tenantDir, output.TenantPlaceholder+".yaml")
+	}
+
+	return c.fileTemplate
+}
+
+type postWriteConfig struct {
+	command string
+	timeout time.Duration
+	policy  string
+}
+
+type reportConfig struct {
+	dir            string
+	webhookURL     string
+	webhookTimeout time.Duration
+	changesOnly    bool
+}
+
+type adaptiveConfig struct {
+	adaptive.Config
+	enabled bool
+}
+
+// chaosConfig configures the failures injected by the hidden -debug flags.
+type chaosConfig struct {
+	failFetchPercent  float64
+	failReloadPercent float64
+	slowReload        time.Duration
+}
+
+type standbyConfig struct {
+	enabled      bool
+	lockFile     string
+	lockInterval time.Duration
+}
+
+type eventsConfig struct {
+	natsURL             string
+	natsSubject         string
+	natsCredentialsFile string
+	timeout             time.Duration
+}
+
+type natsConfig struct {
+	url             string
+	bucket          string
+	credentialsFile string
+}
+
+type otlpConfig struct {
+	metricsURL  string
+	interval    time.Duration
+	timeout     time.Duration
+	headersFile string
+}
+
+type usageConfig struct {
+	interval           time.Duration
+	evaluationInterval time.Duration
+	uploadURL          string
+	uploadTimeout      time.Duration
+}
+
+type mergeConfig struct {
+	merge.Config
+	policyFile     string
+	library        string
+	reservedLabels string
+}
+
+type lintConfig struct {
+	lint.Config
+	severities         string
+	criticalSeverities string
+}
+
+type secretsConfig struct {
+	cacheTTL       time.Duration
+	vaultAddr      string
+	vaultTokenFile string
+}
+
+type oidcConfig struct {
+	audience     string
+	clientID     string
+	clientSecret string
+	issuerURL    string
 }
 
 func parseFlags() *config {
 	cfg := &config{}
 
 	// Common flags.
-	flag.StringVar(&cfg.file, "file", "rules.yaml", "The path to the file the rules are written to on disk so that Thanos Ruler can read it from. Required.")
-	flag.StringVar(&cfg.thanosRuleURL, "thanos-rule-url", "", "The URL of Thanos Ruler that is used to trigger reloads of rules. We will append /-/reload. Required.")
-	flag.UintVar(&cfg.interval, "interval", 60, "The interval at which to poll the Observatorium API for updates to rules, given in seconds.")
+	flag.StringVar(&cfg.configFile, "config", "", "The path to a YAML file setting flags, mapping their names to their values, or - to read it from the standard input. It can hold several documents, later ones overriding earlier ones, and flags set on the command line override it. With -tenants-file=-, its document with a tenants key is the tenants file. Its pipelines run several sync pipelines instead of the one of the flags.")
+	flag.StringVar(&cfg.file, "file", syncconfig.DefaultFile, "The path to the file the rules are written to on disk so that Thanos Ruler can read it from. Required.")
+	flag.StringVar(&cfg.output.fileMode, "output.file-mode", "", "The permissions of the rules file in octal, e.g. 0640. If empty, the file is created with 0666 before umask and the permissions of an existing file are kept.")
+	flag.StringVar(&cfg.output.dirMode, "output.dir-mode", "", "The permissions in octal, e.g. 0750, of the missing parent directories of the rules file, which are created. If empty, they are not created, except the directories of -file-template below its first {tenant}, which are created with the permissions of the directory they are in.")
+	flag.BoolVar(&cfg.output.fsync, "output.fsync", false, "Flush the directory of the rules file to disk after replacing the file, so that the new file survives a crash of the node. The content of the file is always flushed before it replaces the previous one.")
+	flag.BoolVar(&cfg.output.preserveOwner, "output.preserve-owner", false, "Keep the owner and group of the rules file when replacing it. Otherwise, the replaced file is owned by the user of the syncer.")
+	flag.BoolVar(&cfg.output.provenance, "output.provenance", false, "Write a comment above each rule group of -file with the tenant owning it, the modification time of the rules of the tenant in the rules backend or Observatorium API if known, and the SHA-256 hash of the group, to make the file self-explanatory. It makes the file larger.")
+	flag.StringVar(&cfg.output.scrapeHints, "output.scrape-hints-file", "", "The path to a YAML file to write, after the rules, with the metrics selected by the rules other than the ones they record, and a metric relabel config keeping only their series if all the selectors of the rules select metrics by name, so that scrapers, e.g. Prometheus in agent mode, can drop the series the rules don't need.")
+	flag.BoolVar(&cfg.output.contentAddr, "output.content-addressed", false, "Write the rules to a file named after their SHA-256 hash next to -file, e.g. rules-<sha256>.yaml, and replace -file with a symbolic link to it before reloading the ruler, so that consumers caching files by name always see consistent content.")
+	flag.StringVar(&cfg.output.routingFile, "output.routing-file", "", "The path to a YAML file with a routing table sending the rule groups it selects by tenant and labels to other rules files and rulers than -file and -thanos-rule-url.")
+	flag.StringVar(&cfg.output.tenantDir, "output.tenant-dir", "", "The path to a directory the rules of each tenant are written to, in a <tenant>.yaml file, instead of -file. Thanos Ruler must read them with a glob, e.g. --rule-file=<dir>/*.yaml. Files in the directory not written by the syncer are reported but never removed.")
+	flag.StringVar(&cfg.output.fileTemplate, "file-template", "", "The path template of the files the rules of each tenant are written to instead of -file, where {tenant} is replaced with the tenant, e.g. /etc/thanos/rules/{tenant}.yaml, or /etc/thanos/rules/{tenant}/rules.yaml to give each tenant its own directory, created with the permissions of /etc/thanos/rules unless -output.dir-mode is set. Only the files whose rules changed are written, and the files of removed tenants are removed after -output.tenant-dir.grace-period. Thanos Ruler must read them with a glob, e.g. --rule-file=/etc/thanos/rules/*/rules.yaml. It can't be used with -output.tenant-dir.")
+	flag.StringVar(&cfg.output.nameTemplate, "output.name-template", "", "A text/template of the paths of the rules files instead of -file and of the files of the routes of -output.routing-file and the pipelines of -config, e.g. /etc/thanos/rules/{{.Signal}}-{{.Shard}}-rules.yaml, where .Signal is the name of the pipeline and .Shard the name of the route, default for the rules not routed. The syncer refuses to start if two outputs would write the same file. It can't be used with -file, -output.tenant-dir or -file-template, nor with the files of routes and pipelines.")
+	flag.StringVar(&cfg.output.ruleFiles, "output.ruler-rule-files", "", "The comma-separated globs of the rule_files of the rulers, e.g. /etc/thanos/rules/*.yaml, which the rules files written by the syncer must match to be loaded. The syncer refuses to start if one doesn't. If empty, they are not checked.")
+	flag.StringVar(&cfg.postWrite.command, "post-write-cmd", "", "The path to an executable run after the rules are written and before the ruler is reloaded, when the rules changed, e.g. to copy them to peers or to invalidate caches. It is given the path of -file, of -output.tenant-dir, or of the directory of -file-template before {tenant}, and the hex SHA-256 hash of the rules as arguments, also set in the RULES_FILE and RULES_SHA256 environment variables. It can't be used with -output.routing-file.")
+	flag.DurationVar(&cfg.postWrite.timeout, "post-write-cmd.timeout", 30*time.Second, "How long -post-write-cmd can run before it is killed and fails.")
+	flag.StringVar(&cfg.postWrite.policy, "post-write-cmd.failure-policy", output.HookFail, "What happens when -post-write-cmd fails. One of: fail, which fails the sync cycle without reloading the ruler, so that the rules are written again and the command run again at the next cycle, or warn, which logs the failure and reloads the ruler anyway.")
+	flag.StringVar(&cfg.report.dir, "report.dir", "", "The directory to which a JSON report of each sync cycle is written, e.g. for compliance tooling: the outcome of the cycle and of each tenant, the durations of its phases, the hashes of the rules, the rule groups added, removed and changed by tenant, and the result of the reload. Reports are named after the start time of their cycle, and are not deleted.")
+	flag.StringVar(&cfg.report.webhookURL, "report.webhook-url", "", "The URL to which the JSON report of each sync cycle is posted, like the reports of -report.dir.")
+	flag.DurationVar(&cfg.report.webhookTimeout, "report.webhook-timeout", 10*time.Second, "How long posting a report to -report.webhook-url can take before it fails.")
+	flag.BoolVar(&cfg.report.changesOnly, "report.changes-only", false, "Only report the sync cycles that changed the rules or failed.")
+	flag.StringVar(&cfg.events.natsURL, "events.nats-url", "", "The URL of the NATS server to which an event is published for each tenant whose rules were added, changed or removed by a sync cycle, e.g. nats://nats:4222, so that downstream systems can react to changes without polling. If empty, no event is published.")
+	flag.StringVar(&cfg.events.natsSubject, "events.nats-subject", "thanos-rule-syncer.changes", "The prefix of the subjects the events of -events.nats-url are published to, followed by the tenant, e.g. thanos-rule-syncer.changes.tenant-a.")
+	flag.StringVar(&cfg.events.natsCredentialsFile, "events.nats-credentials-file", "", "The path to the credentials file of the NATS user publishing the events of -events.nats-url. If empty, the NATS server is connected to without credentials.")
+	flag.DurationVar(&cfg.events.timeout, "events.timeout", 10*time.Second, "How long publishing the events of a sync cycle to -events.nats-url can take before it fails.")
+	flag.DurationVar(&cfg.usage.interval, "usage.interval", 0, "The interval at which a JSON report of the usage of the rules last written by each tenant is generated and served on /usage, e.g. for chargeback and capacity planning: the number of rules, the rules by evaluation interval, the evaluations per minute and the estimated cost of their queries. The first report is generated once the first rules are written. If 0, no report is generated.")
+	flag.DurationVar(&cfg.usage.evaluationInterval, "usage.evaluation-interval", usage.DefaultEvaluationInterval, "The evaluation interval of the rule groups that don't set one, the --eval-interval of the ruler, used by the -usage.interval reports.")
+	flag.StringVar(&cfg.usage.uploadURL, "usage.upload-url", "", "The URL of an object store bucket, or of a prefix in it, to which each -usage.interval report is put with an HTTP PUT, as an object named after the time it was generated. Its query, e.g. a shared access signature, is kept.")
+	flag.DurationVar(&cfg.usage.uploadTimeout, "usage.upload-timeout", 10*time.Second, "How long uploading a report to -usage.upload-url can take before it fails.")
+	flag.StringVar(&cfg.otlp.metricsURL, "otlp.metrics-url", "", "The URL of the OTLP/HTTP metrics endpoint of an OpenTelemetry collector, e.g. http://otel-collector:4318/v1/metrics, to which the metrics served on /metrics are also pushed at -otlp.metrics-interval. If empty, they are not pushed.")
+	flag.DurationVar(&cfg.otlp.interval, "otlp.metrics-interval", time.Minute, "The interval at which the metrics are pushed to -otlp.metrics-url.")
+	flag.DurationVar(&cfg.otlp.timeout, "otlp.metrics-timeout", 10*time.Second, "How long pushing the metrics to -otlp.metrics-url can take before it fails.")
+	flag.StringVar(&cfg.otlp.headersFile, "otlp.metrics-headers-file", "", "The path to a file of headers sent to -otlp.metrics-url, one Name: value per line, e.g. for authentication.")
+	flag.DurationVar(&cfg.output.tenantGrace, "output.tenant-dir.grace-period", time.Hour, "How long the rules file of a tenant without rules anymore, e.g. removed from the tenants file, is kept in -output.tenant-dir or at -file-template before it is removed and the ruler reloaded.")
+	flag.IntVar(&cfg.output.maxRules, "output.max-total-rules", 0, "The maximum number of rules the ruler can evaluate. Rules exceeding it drop the rules of whole tenants, lowest priority in the tenants file first, and aren't written if the tenant with the highest priority exceeds it by itself. If 0, the number of rules isn't limited.")
+	flag.IntVar(&cfg.output.maxBytes, "output.max-bytes", 0, "The maximum size in bytes of the rules the ruler can load, handled like -output.max-total-rules. If 0, the size of the rules isn't limited.")
+	flag.StringVar(&cfg.thanosRuleURL, "thanos-rule-url", "", "The URL of Thanos Ruler that is used to trigger reloads of rules. We will append /-/reload. It can be a unix:///path/to/socket URL if Thanos Ruler listens on a Unix domain socket. Required.")
+	flag.StringVar(&cfg.thanos.version, "thanos.version", "", "The version of Thanos Ruler, e.g. v0.34.1, against which the fields used by rules are checked. If empty, it is detected from the /api/v1/status/buildinfo endpoint of -thanos-rule-url on each sync.")
+	flag.StringVar(&cfg.thanos.unsupportedFields, "thanos.unsupported-fields", syncconfig.DefaultUnsupportedFields, "What to do with the fields of rules unsupported by the version of Thanos Ruler, e.g. keep_firing_for before v0.32.0. One of: reject (fail the sync), strip (remove them), downgrade (rewrite rules to get their behavior without them where possible, e.g. query_offset into offset modifiers, and strip them otherwise).")
+	flag.StringVar(&cfg.thanos.unsupportedFieldPolicy, "thanos.unsupported-fields.policies", "", "Comma-separated per field overrides of -thanos.unsupported-fields, e.g. keep_firing_for=reject,query_offset=downgrade.")
+	flag.UintVar(&cfg.interval, "interval", uint(syncconfig.DefaultInterval/time.Second), "The interval at which to poll the Observatorium API for updates to rules, given in seconds.")
+	flag.StringVar(&cfg.schedule, "schedule", "", "A cron expression, e.g. '*/5 8-18 * * 1-5' or '@hourly', at whose times to sync rules instead of at every -interval. It is evaluated in the local time zone unless prefixed with CRON_TZ=<zone>.")
+	flag.StringVar(&cfg.syncMode, "sync.mode", syncModeLoop, "How sync cycles are run. One of: loop (at every -interval or at the times of the -schedule), http (on each POST request to the /sync endpoint of the internal server, responding once the cycle is over, e.g. on serverless platforms triggered by an external scheduler), once (a single cycle, exiting with the exit code of its error, e.g. in jobs).")
+	flag.StringVar(&cfg.source, "source", sourceAPI, "Where the rules are read from. One of: api (fetched from -rules-backend-url or -observatorium-api-url), stdin (a complete rules document read from the standard input until EOF, and read again on SIGHUP if it is a regular file, e.g. generated by an external tool), nats (the rules documents of tenants in the -nats.bucket key-value bucket, keyed by tenant, synced as they change).")
+	flag.StringVar(&cfg.nats.url, "nats.url", "", "The URL of the NATS server the rules of tenants are received from with -source=nats, e.g. nats://nats:4222.")
+	flag.StringVar(&cfg.nats.bucket, "nats.bucket", "rules", "The JetStream key-value bucket holding the complete rules document of each tenant, keyed by tenant, with -source=nats.")
+	flag.StringVar(&cfg.nats.credentialsFile, "nats.credentials-file", "", "The path to the credentials file of the NATS user. If empty, the NATS server is connected to without credentials.")
+	flag.BoolVar(&cfg.standby.enabled, "standby", false, "Start as a standby, e.g. of a syncer in another region for disaster recovery, fetching and post-processing the rules like the active syncer, so that its caches and metrics are warm, but never writing them nor reloading the ruler until promoted, with the /-/promote admin endpoint or by -standby.lock-file. It can't be used with -sync.mode=once.")
+	flag.StringVar(&cfg.standby.lockFile, "standby.lock-file", "", "The path to a lock file shared with the other syncers of -standby, on a shared volume, whose lock elects the active syncer: the standby holding it is promoted, and holds it until it exits, when another standby takes it over. If empty, the standby is only promoted with the /-/promote admin endpoint.")
+	flag.DurationVar(&cfg.standby.lockInterval, "standby.lock-interval", 5*time.Second, "The interval at which a standby tries to take the lock of -standby.lock-file.")
+	flag.BoolVar(&cfg.skipUnchanged, "sync.skip-unchanged", syncconfig.DefaultSkipUnchanged, "Skip writing the rules and reloading Thanos Ruler when the rules are unchanged since it was last reloaded with them, as reloads restart the evaluation of rules. Disable it to write -file and reload the ruler at every sync, e.g. when another process may overwrite -file.")
+	flag.BoolVar(&cfg.syncWatchdog, "sync.watchdog", true, "Exit, logging the stacks of all goroutines, when no sync cycle of the loop is over for 3 intervals, or until the next cycle due has timed out if later, e.g. because of a fetch deadlocked ignoring its timeout, so that the orchestrator restarts the syncer.")
+	flag.DurationVar(&cfg.timeouts.Fetch, "fetch.timeout", 0, "The maximum duration of fetching the rules in a sync cycle. If 0, only the timeout of the whole cycle applies, which is the larger of -interval, 60s and the sum of the timeouts of its phases.")
+	flag.DurationVar(&cfg.timeouts.Parse, "parse.timeout", 0, "The maximum duration of post-processing the fetched rules in a sync cycle, e.g. merging them and checking them against the version of Thanos Ruler. If 0, only the timeout of the whole cycle applies.")
+	flag.DurationVar(&cfg.timeouts.Write, "write.timeout", 0, "The maximum duration of writing the rules in a sync cycle. If 0, only the timeout of the whole cycle applies.")
+	flag.DurationVar(&cfg.timeouts.Reload, "reload.timeout", 0, "The maximum duration of reloading Thanos Ruler in a sync cycle. If 0, only the timeout of the whole cycle applies.")
+	flag.StringVar(&cfg.reload.extraURLs, "reload.extra-urls", "", "The comma-separated URLs of further Thanos Rulers, e.g. in other clusters, reloaded together with -thanos-rule-url once the rules are written. They must read the same rules as -thanos-rule-url, e.g. from a replicated -file. It can't be used with -output.routing-file.")
+	flag.IntVar(&cfg.reload.retries, "reload.retries", 0, "The number of times a failed reload of a ruler is retried within a sync cycle.")
+	flag.DurationVar(&cfg.reload.retryBackoff, "reload.retry-backoff", time.Second, "How long to wait before the first retry of a failed reload of a ruler, doubled before each following retry.")
+	flag.IntVar(&cfg.reload.quorum, "reload.quorum", 0, "The number of rulers among -thanos-rule-url and -reload.extra-urls that must reload for a sync cycle to succeed. The failures of the other rulers are logged and counted. If 0, all rulers must reload.")
+	flag.StringVar(&cfg.reload.lockFile, "reload.lock-file", "", "The path to a lock file shared with the other syncers reloading the same ruler, e.g. syncing the rules of other signals or sets of tenants, on a shared volume. Reloads are made holding its lock, skipped if another syncer reloaded the ruler since they were requested, and delayed until -reload.debounce after the last reload, so that the ruler isn't reloaded several times within seconds. If empty, reloads are not coordinated.")
+	flag.DurationVar(&cfg.reload.debounce, "reload.debounce", 5*time.Second, "The minimum time between the starts of reloads of the ruler by the syncers sharing -reload.lock-file.")
+	flag.DurationVar(&cfg.divergenceCheck, "divergence.interval", 0, "The interval at which the rules file and the rules loaded by Thanos Ruler, as listed by the /api/v1/rules endpoint of -thanos-rule-url, are compared with the rules last synced, e.g. to detect another process overwriting -file. If 0, they are not compared. It can't be used with -output.tenant-dir, -file-template or -output.routing-file.")
+	flag.StringVar(&cfg.canary.tenant, "canary.tenant", "", "The name of a synthetic tenant whose rules the syncer generates itself, a recording rule of thanos_rule_syncer_canary_generated_timestamp_seconds set to the time it was generated, so that the series evaluated by the ruler checks the whole pipeline end to end. It must not be the name of a real tenant. If empty, there is no canary tenant. It requires -rules-backend-url and -canary.query-url.")
+	flag.StringVar(&cfg.canary.queryURL, "canary.query-url", "", "The URL of a Prometheus-compatible query API, e.g. a Thanos Querier, from which the series of the -canary.tenant evaluated by the ruler is queried.")
+	flag.DurationVar(&cfg.canary.period, "canary.period", 5*time.Minute, "How often the rule of the -canary.tenant is generated again with the current time, which makes the ruler reload.")
+	flag.DurationVar(&cfg.canary.grace, "canary.grace-period", 5*time.Minute, "How long the rule of the -canary.tenant has to be synced, evaluated and queryable after it is generated before the pipeline is reported unhealthy.")
+	flag.DurationVar(&cfg.canary.checkInterval, "canary.check-interval", time.Minute, "The interval at which the series of the -canary.tenant is queried.")
+	flag.StringVar(&cfg.overlapPolicy, "sync.overlap-policy", syncconfig.DefaultOverlapPolicy, "What happens to sync cycles due while a cycle is still in progress. One of: skip (count them as skipped), queue (run a single cycle right after the one in progress).")
 
 	// Use rules backend where no auth is needed and only single instance of thanos-rule-syncer sidecar is required.
-	flag.StringVar(&cfg.rulesBackendURL, "rules-backend-url", "", "The URL of the Rules Storage Backend from which to fetch the rules. If specified, it gets priority over -observatorium-api-url and auth flags are no longer needed.")
+	flag.StringVar(&cfg.rulesBackendURL, "rules-backend-url", "", "The URL of the Rules Storage Backend from which to fetch the rules. If specified, it gets priority over -observatorium-api-url and auth flags are no longer needed. A dnssrv+http:// or dnssrv+https:// URL, e.g. dnssrv+http://_http._tcp.rules-objstore.observatorium.svc, names a DNS SRV record resolved on each request.")
+
+	flag.IntVar(&cfg.fetchConcurrency, "fetch.concurrency", 0, "The number of tenants whose rules are fetched concurrently from the rules backend. If 0, it is 4 times GOMAXPROCS, which is derived from the CPU quota of the container.")
+	flag.BoolVar(&cfg.adaptive.enabled, "fetch.concurrency.adaptive", false, "Adapt the -fetch.concurrency between sync cycles run at an interval or schedule, so that they take -fetch.concurrency.target of the time before the next cycle is due: raise it by 1 after a cycle taking longer, mostly fetching, halve it after a failed fetch, and lower it by 1 after a cycle taking less than half of it, within -fetch.concurrency.min and -fetch.concurrency.max.")
+	flag.IntVar(&cfg.adaptive.Min, "fetch.concurrency.min", 1, "The minimum concurrency set by -fetch.concurrency.adaptive.")
+	flag.IntVar(&cfg.adaptive.Max, "fetch.concurrency.max", 0, "The maximum concurrency set by -fetch.concurrency.adaptive. If 0, it is 4 times the initial -fetch.concurrency.")
+	flag.Float64Var(&cfg.adaptive.Target, "fetch.concurrency.target", adaptive.DefaultTarget, "The share of the time before the next sync cycle is due that cycles should take with -fetch.concurrency.adaptive, keeping the rest as slack.")
+
+	flag.BoolVar(&cfg.fetchShuffle.enabled, "fetch.shuffle", true, "Fetch the rules of tenants from the rules backend in a random order on each sync, so that the same tenants aren't always fetched last, and the first ones to run out of time. When they were last attempted is reported per tenant on /status.")
+	flag.Int64Var(&cfg.fetchShuffle.seed, "fetch.shuffle-seed", 0, "The seed of the random order of -fetch.shuffle, e.g. to reproduce an order. If 0, it is random.")
+
+	flag.BoolVar(&cfg.fetchRateLimit, "fetch.rate-limit.pace", true, "Pace the requests fetching rules to stay under the rate limit the upstream announces in the X-RateLimit-Remaining and X-RateLimit-Reset headers of its responses, e.g. the Observatorium API, spreading the remaining requests until the limit resets instead of getting 429s. The announced limit is exported as metrics either way.")
+	flag.DurationVar(&cfg.fetchCacheTTL, "fetch.cache-ttl", 0, "How long the responses fetching the rules of tenants are cached for, keyed by tenant, so that fetching the rules of the same tenant again within it, e.g. for several pipelines of -config, reuses the response instead of requesting it again. Only successful responses are cached. If 0, responses aren't cached.")
+	flag.StringVar(&cfg.fetchSpoolDir, "fetch.spool-dir", "", "A directory keeping the rules of each tenant of -tenant or -tenants-file in a file from the time they are fetched, and from which the rules of all tenants are read in the order of their IDs once they are fetched, so that their order doesn't depend on the order they were fetched in. The last valid rules of tenants are kept there, across restarts if it persists. It doesn't reduce the memory of the syncer, which still merges and checks the rules of all tenants at once.")
+	flag.BoolVar(&cfg.fetchWatch, "fetch.watch", false, "Only fetch the rules of tenants that changed since they were last fetched, according to the change feed of the rules backend at /api/v1/changes listing the versions of the rules of tenants. If the rules backend has no change feed, the rules of all tenants are fetched.")
+	flag.IntVar(&cfg.fetchBatchSize, "fetch.batch-size", 0, "The number of tenants whose rules are fetched in one request to the batch endpoint of the rules backend at /api/v1/batch/rules. The tenants missing from the response of their batch are fetched one by one, as are all tenants if the rules backend has no batch endpoint. If 0, the rules of tenants are fetched one by one.")
+
+	flag.StringVar(&cfg.fetchBindAddress, "fetch.bind-address", "", "The local IP address, or the name of the network interface, from which the requests fetching rules and exchanging OIDC tokens are dialed, e.g. on dual-homed nodes where the Observatorium API is only reachable through one network. For an interface, its first IPv4 address is used, or its first IPv6 one if it has none. If empty, the system picks it.")
+	flag.BoolVar(&cfg.fetchSPIFFE.enabled, "fetch.spiffe", false, "Authenticate the requests fetching rules with mTLS, presenting the X.509 SVID of the syncer fetched from the SPIFFE Workload API of the local agent, e.g. SPIRE, and rotated with it, and verify the SVID of the servers against the bundles of the Workload API instead of the system certificates or -observatorium-ca.")
+	flag.StringVar(&cfg.fetchSPIFFE.socket, "fetch.spiffe.endpoint-socket", "", "The address of the SPIFFE Workload API of -fetch.spiffe, e.g. unix:///run/spire/sockets/agent.sock. If empty, the SPIFFE_ENDPOINT_SOCKET environment variable is used.")
+	flag.StringVar(&cfg.fetchSPIFFE.serverID, "fetch.spiffe.server-id", "", "The SPIFFE ID the servers of -fetch.spiffe must present, e.g. spiffe://example.org/ns/observatorium/sa/api. If empty, any member of the trust domain of the syncer is accepted.")
+	flag.StringVar(&cfg.fetchDNS.resolver, "fetch.dns.resolver", "", "The address of the DNS server, e.g. 10.0.0.10:53, resolving the hosts of the requests fetching rules and exchanging OIDC tokens, and the SRV record of a dnssrv+ -rules-backend-url. If empty, the resolvers of the system are used.")
+	flag.BoolVar(&cfg.fetchDNS.refresh, "fetch.dns.refresh", false, "Close the idle connections to the upstream at the start of each sync, so that its host is resolved again instead of keepalive connections pinning a stale address, e.g. of a gateway after a failover.")
+	flag.IntVar(&cfg.fetchResume, "fetch.resume-attempts", 0, "The number of times an interrupted download of the rules of all tenants from the rules backend is resumed with a range request in a sync, instead of starting over. A download still interrupted is resumed in the next sync. Requires the rules backend to support range requests and to set strong ETags. If 0, downloads are not resumed.")
+	flag.IntVar(&cfg.fetchDeletion.notFoundThreshold, "fetch.not-found-threshold", 0, "The number of syncs in a row the rules backend must respond with 404 Not Found to the rules of a tenant before its rules are deleted, as the tenant was deleted. Until then, the last rules of the tenant are kept. If 0, a tenant whose rules aren't found fails the sync, unless its deletion is confirmed by -fetch.tombstones.")
+	flag.BoolVar(&cfg.fetchDeletion.tombstones, "fetch.tombstones", false, "Confirm the deletion of a tenant whose rules aren't found with the tombstones of the rules backend at /api/v1/tenants/{tenant}. The rules of a deleted tenant are deleted right away, and the last rules of a tenant that still exists are kept. Without a tombstone, -fetch.not-found-threshold applies.")
 
 	// Use Observatorium API, which requires auth and needs a thanos-rule-syncer sidecar per tenant.
-	flag.StringVar(&cfg.observatoriumURL, "observatorium-api-url", "", "The URL of the Observatorium API from which to fetch the rules. If specified, auth flags must also be provided.")
+	flag.StringVar(&cfg.observatoriumURL, "observatorium-api-url", "", "The URL of the Observatorium API from which to fetch the rules of the -tenant, or of each tenant of the -tenants-file. If specified, auth flags must also be provided.")
 	flag.StringVar(&cfg.tenant, "tenant", "", "The name of the tenant whose rules should be synced.")
-	flag.StringVar(&cfg.tenantsFile, "tenants-file", "", "The path to a file containing the list of tenants whose rules should be synced. There must be one tenant per line.")
+	flag.StringVar(&cfg.tenantsFile, "tenants-file", "", "The path to a file containing the list of tenants whose rules should be synced, in the format of -tenants-file-format, or - to read it once from the standard input.")
+	flag.StringVar(&cfg.tenantsFormat, "tenants-file-format", tenantsFormatAuto, "The format of the tenants file. One of: yaml (a list of tenants under the tenants key, which can configure each tenant), lines (one tenant per line, lines starting with # are ignored), auto (yaml if the file is a YAML mapping, lines otherwise).")
+	flag.Float64Var(&cfg.tenantsRemoval.maxPercent, "tenants.max-removal-percent", 50, "The maximum percentage of the tenants that a reload of the tenants file can remove at once. Reloads removing more, e.g. from a truncated file, are refused and the previous tenants are kept. 100 disables the check.")
+	flag.BoolVar(&cfg.tenantsRemoval.allowMass, "tenants.allow-mass-removal", false, "Allow reloads of the tenants file removing more than -tenants.max-removal-percent of the tenants, logging them instead of refusing them.")
+	flag.StringVar(&cfg.fallback.ObservatoriumAPIURL, "fallback.observatorium-api-url", "", "The URL of an Observatorium API, e.g. in a secondary region, from which to fetch the rules of the -tenant while the primary source is failing. Tenants of the -tenants-file configure their own fallback source.")
+	flag.StringVar(&cfg.fallback.File, "fallback.file", "", "The path to a file with the rules of the -tenant, e.g. a snapshot, used while the primary source is failing. Mutually exclusive with -fallback.observatorium-api-url.")
+	flag.IntVar(&cfg.fallback.afterFailures, "fallback.after-failures", 3, "The number of failed syncs in a row from the primary source of the rules of a tenant after which its fallback source is used.")
+	flag.StringVar(&cfg.failover.file, "failover.file", "", "The path to a YAML file listing standby upstreams, e.g. the Observatorium APIs of other regions, to which the requests to -rules-backend-url or -observatorium-api-url fail over while it is failing. Each standby can have its own CA and OIDC client credentials.")
+	flag.IntVar(&cfg.failover.afterFailures, "failover.after-failures", 3, "The number of failed requests in a row, with a network error or a server error, after which the active upstream fails over to the next one of -failover.file.")
+	flag.IntVar(&cfg.failover.recoverAfter, "failover.recover-after", 3, "The number of recovery probes in a row a more preferred upstream must answer before the requests switch back to it.")
+	flag.DurationVar(&cfg.failover.probeInterval, "failover.probe-interval", 30*time.Second, "The interval at which the upstreams more preferred than the active one are probed.")
+	flag.StringVar(&cfg.failover.probePath, "failover.probe-path", "/", "The path, relative to the URL of the upstreams, requested by the recovery probes. An upstream answers a probe if it responds without a server error.")
 	flag.StringVar(&cfg.observatoriumCA, "observatorium-ca", "", "Path to a file containing the TLS CA against which to verify the Observatorium API. If no server CA is specified, the client will use the system certificates.")
+	flag.DurationVar(&cfg.httpClient.dialTimeout, "http.dial-timeout", 30*time.Second, "The timeout of establishing the TCP connections of all the requests, e.g. to the upstreams, the OIDC issuer, the ruler, or to the proxy of the HTTPS_PROXY environment variable.")
+	flag.DurationVar(&cfg.httpClient.tlsHandshakeTimeout, "http.tls-handshake-timeout", 10*time.Second, "The timeout of the TLS handshakes of all the requests, including the ones tunneled through a proxy.")
+	flag.StringVar(&cfg.httpClient.proxyUsername, "http.proxy-username", "", "The username authenticating the CONNECT requests of HTTPS requests to the proxy of the HTTPS_PROXY environment variable with basic auth, unless its URL has credentials. If empty, they aren't authenticated.")
+	flag.StringVar(&cfg.httpClient.proxyPassword, "http.proxy-password", "", "The password of -http.proxy-username. Like -oidc.client-secret, it can be a reference to a secret, e.g. file:/etc/proxy/password, resolved again for each connection to the proxy once it is no longer cached.")
+	flag.StringVar(&cfg.httpClient.tlsMinVersion, "tls.min-version", "1.2", "The minimum TLS version of all the outbound connections, e.g. to the upstreams, the OIDC issuer, the ruler, the webhooks and the NATS servers of tls:// URLs. One of: 1.0, 1.1, 1.2, 1.3.")
+	flag.StringVar(&cfg.httpClient.tlsCipherSuites, "tls.cipher-suites", "", "The comma-separated names of the cipher suites of the outbound connections negotiating TLS 1.2 or lower, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. The suites of TLS 1.3 can't be restricted, and insecure suites aren't accepted. If empty, the secure suites of Go are used.")
+	flag.DurationVar(&cfg.caReloadInterval, "tls.reload-interval", time.Minute, "The interval at which the CA files, i.e. the -observatorium-ca and the ones of the standbys of -failover.file, are read again if they changed, e.g. when the intermediates of the CA are rotated, so that the servers are verified against their new certificates without restart. If 0, they are only read at startup.")
 	flag.StringVar(&cfg.oidc.issuerURL, "oidc.issuer-url", "", "The OIDC issuer URL, see https://openid.net/specs/openid-connect-discovery-1_0.html#IssuerDiscovery.")
-	flag.StringVar(&cfg.oidc.clientSecret, "oidc.client-secret", "", "The OIDC client secret, see https://tools.ietf.org/html/rfc6749#section-2.3.")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc.client-secret", "", "The OIDC client secret, see https://tools.ietf.org/html/rfc6749#section-2.3, or a reference to it: env:<variable>, file:<path>, kubernetes:[<namespace>/]<name>/<key> or vault:<path>#<key>. Referenced secrets are fetched again after -secrets.cache-ttl, so that they can be rotated.")
 	flag.StringVar(&cfg.oidc.clientID, "oidc.client-id", "", "The OIDC client ID, see https://tools.ietf.org/html/rfc6749#section-2.3.")
+	flag.DurationVar(&cfg.secrets.cacheTTL, "secrets.cache-ttl", secret.DefaultTTL, "How long referenced secrets, e.g. -oidc.client-secret=vault:<path>#<key>, are cached before they are fetched again. If fetching a secret fails, the cached one is used until the next attempt.")
+	flag.StringVar(&cfg.secrets.vaultAddr, "secrets.vault.address", "", "The address of the Vault server of vault: secrets, e.g. https://vault:8200. If empty, it is the VAULT_ADDR environment variable.")
+	flag.StringVar(&cfg.secrets.vaultTokenFile, "secrets.vault.token-file", "", "The path to a file containing the Vault token, read again for each secret fetched, e.g. a sink of the Vault agent. If empty, the token is the VAULT_TOKEN environment variable.")
 	flag.StringVar(&cfg.oidc.audience, "oidc.audience", "", "The audience for whom the access token is intended, see https://openid.net/specs/openid-connect-core-1_0.html#IDToken.")
+	flag.DurationVar(&cfg.oidcDiscovery.refreshInterval, "oidc.discovery.refresh-interval", time.Hour, "How long the token URL discovered from the discovery document of the OIDC issuer is cached before it is discovered again on the next token exchange. If discovering it again fails, the cached one is used.")
+	flag.DurationVar(&cfg.oidcDiscovery.startupTimeout, "oidc.discovery.startup-timeout", time.Minute, "How long the discovery of the OIDC issuer is retried at startup, e.g. while the issuer is unreachable during the boot of the node. If it still fails, the token URL of -oidc.discovery.cache-file is used, or it is discovered again on the next token exchange.")
+	flag.StringVar(&cfg.oidcDiscovery.cacheFile, "oidc.discovery.cache-file", "", "The path to a file caching the token URLs discovered from the OIDC issuers, used when the issuers can't be reached at startup. If empty, they are only cached in memory.")
+
+	flag.StringVar(&cfg.merge.library, "merge.library", "", "The path or HTTP(S) URL of a YAML rule library with parameterized rule templates that rule groups of tenants can reference. It is loaded on each sync.")
+	flag.StringVar(&cfg.merge.SLODir, "merge.slo-dir", "", "The path to a directory with one sub-directory per tenant containing SLO specs in the Sloth prometheus/v1 format. Recording and alerting rules generated from them are merged with the rules of tenants.")
+	flag.StringVar(&cfg.merge.policyFile, "merge.policy-file", "", "The path to a YAML file with the policies enforced on the rules of tenants when merging them, e.g. per tenant or per label selector partial response strategies and evaluation intervals.")
+	flag.StringVar(&cfg.merge.PartialResponseStrategy, "merge.partial-response-strategy", "", "The partial response strategy set on rule groups not selected by the policy file. One of: warn, abort. If empty, the strategy set by tenants is kept.")
+	flag.StringVar(&cfg.merge.DuplicateAlerts, "merge.duplicate-alerts", syncconfig.DefaultDuplicateAlerts, "The policy for alerts with the same name defined by several tenants. One of: ignore, warn (log and count them), label (also add the tenant to their labels), rename (also prefix their name with the tenant).")
+	flag.StringVar(&cfg.merge.TenantLabel, "merge.tenant-label", "", "The label set to the owning tenant on all rules, overriding the value set by tenants, e.g. so that a stateless Thanos Ruler remote writing to a Thanos Receive with -receive.split-tenant-label-name writes the evaluated series to the tenant. If empty, it is not set.")
+	flag.StringVar(&cfg.merge.reservedLabels, "merge.reserved-labels", "", "The comma-separated labels tenants must not set, in the labels of their rules or with label_replace or label_join in their expressions, e.g. the labels routing the evaluated series or the alerts to tenants. If empty, no label is reserved.")
+	flag.StringVar(&cfg.merge.ReservedMetricNames, "merge.reserved-metric-names", "", "A regular expression of the metric names recording rules of tenants must not record, e.g. up|node_.* for the scraped metrics the series of tenants would collide with. If empty, any name can be recorded.")
+	flag.StringVar(&cfg.merge.ReservedLabelsPolicy, "merge.reserved-labels.policy", merge.ReservedLabelsStrip, "What to do with rules setting -merge.reserved-labels or recording -merge.reserved-metric-names. One of: warn (only log and count them), strip (remove the labels, and the recording rules), reject (fail the sync).")
+	flag.StringVar(&cfg.amConfigFile, "alertmanager.config-file", "", "The path to the configuration file of the Alertmanager receiving the alerts, against whose route tree the alerts of tenants are checked. The alerts falling through to the default route are reported per tenant in metrics and on /status. If empty, they are not checked.")
+	flag.StringVar(&cfg.merge.RecordNameAllow, "merge.record-names.allow", "", "A regular expression the names of the recording rules of tenants must match, {tenant} being replaced with the owning tenant, e.g. {tenant}:.+ so that tenants don't record the same series in a shared TSDB. If empty, all names are allowed.")
+	flag.StringVar(&cfg.merge.RecordNameDeny, "merge.record-names.deny", "", "A regular expression the names of the recording rules of tenants must not match, {tenant} being replaced with the owning tenant. If empty, no name is denied.")
+	flag.StringVar(&cfg.merge.RecordNamePrefix, "merge.record-names.prefix", "", "The prefix prepended to the names of the recording rules not following -merge.record-names.allow and -merge.record-names.deny with the rewrite policy, {tenant} being replaced with the owning tenant, e.g. {tenant}:.")
+	flag.StringVar(&cfg.merge.RecordNamePolicy, "merge.record-names.policy", merge.RecordNamesWarn, "What to do with recording rules whose names don't follow -merge.record-names.allow and -merge.record-names.deny, and with metric names recorded by more than one tenant. One of: warn (only log and count them), reject (fail the sync), rewrite (prefix the names with -merge.record-names.prefix, in the expressions of the tenant too, removing the rules still not following the patterns).")
+	flag.BoolVar(&cfg.merge.SourceTenants, "merge.source-tenants", false, "Set the source_tenants of all rule groups to the owning tenant, overriding the ones set by tenants, so that a multi-tenant aware Thanos Ruler only queries the data of the tenant to evaluate its rules.")
+	flag.StringVar(&cfg.merge.DuplicateAlertsLabel, "merge.duplicate-alerts.label", syncconfig.DefaultDuplicateAlertsLabel, "The label set to the tenant on duplicate alerts when -merge.duplicate-alerts=label.")
+
+	flag.StringVar(&cfg.lint.severities, "lint.severities", "", "The comma-separated values allowed for the severity label of alerts, e.g. critical,warning,info. If empty, the severity of alerts is not checked.")
+	flag.StringVar(&cfg.lint.SeverityLabel, "lint.severity-label", lint.DefaultSeverityLabel, "The label holding the severity of alerts.")
+	flag.DurationVar(&cfg.lint.MinFor, "lint.min-for", 0, "The minimum for of alerts not of a -lint.critical-severities severity, so that they don't fire on blips. If 0, it is not checked.")
+	flag.StringVar(&cfg.lint.criticalSeverities, "lint.critical-severities", "critical", "The comma-separated severities of alerts exempt from -lint.min-for.")
+	flag.StringVar(&cfg.lint.Policy, "lint.policy", lint.PolicyWarn, "What to do with alerts violating the conventions of the -lint flags, which are reported per tenant in metrics and on /status. One of: warn (only report them), drop (remove the alerts), reject (fail the sync).")
+	flag.StringVar(&cfg.templatesPolicy, "templates.policy", tmplcheck.PolicyWarn, "What to do with alerts whose label and annotation templates fail to render, which are rendered with sample data when rules are synced instead of when the alerts fire. One of: ignore (don't render them), warn (only report them), drop (remove the alerts), reject (fail the sync).")
+
+	flag.DurationVar(&cfg.startupTimeout, "startup.timeout", 0, "How long the initialization of the dependencies that may be briefly unavailable at startup, i.e. reading the CA files and the tenants file, getting the OIDC client secrets and discovering the OIDC issuers, is retried before exiting. The syncer isn't ready until it succeeds. If 0, it is retried until it succeeds.")
+	flag.StringVar(&cfg.listenInternal, "web.internal.listen", ":8083", "The address on which the internal server listens. It can be a unix:///path/to/socket URL to listen on a Unix domain socket instead of a TCP port.")
+	flag.StringVar(&cfg.adminTokenFile, "web.internal.admin-token-file", "", "The path to a file containing the bearer token required by the admin endpoints of the internal server, e.g. /-/pause, /-/resume, /-/sync and /-/tuning. If empty, the admin endpoints are disabled.")
+
+	flag.BoolVar(&cfg.enableLifecycle, "web.internal.enable-lifecycle", false, "Enable the /-/quit and /-/reload-config admin endpoints of the internal server, which quit the process and reload the tenants and merge policy files. Requires -web.internal.admin-token-file.")
+	flag.BoolVar(&cfg.validate, "web.internal.validate", false, "Enable the /validate/{tenant} endpoint of the internal server, which validates the rules of a tenant posted to it with the checks of the sync pipeline, e.g. called by the Observatorium API before accepting rules uploaded by a tenant. It requires the admin bearer token if -web.internal.admin-token-file is set.")
+	flag.BoolVar(&cfg.debugRules, "web.internal.debug-rules", true, "Enable the /debug/rules and /debug/rules/{tenant} admin endpoints of the internal server, which return the rules last written and the rules of a tenant last fetched. Requires -web.internal.admin-token-file.")
+
+	flag.BoolVar(&cfg.nativeHistograms, "metrics.native-histograms", false, "Expose the duration histograms as native histograms too, which keep per tenant latencies cheap. Prometheus scrapes them from version 2.40 on with the native-histograms feature enabled, and other scrapers keep reading the classic buckets.")
+
+	// The -debug flags inject failures for resilience testing, and are hidden from the usage so that they aren't
+	// mistaken for production settings.
+	flag.Float64Var(&cfg.chaos.failFetchPercent, "debug.fail-fetch-percent", 0, "The percentage of the requests fetching rules responded to with 503 Service Unavailable instead of being sent, for resilience testing. Not for production.")
+	flag.Float64Var(&cfg.chaos.failReloadPercent, "debug.fail-reload-percent", 0, "The percentage of the reloads of the ruler failed instead of being sent, for resilience testing. Not for production.")
+	flag.DurationVar(&cfg.chaos.slowReload, "debug.slow-reload", 0, "How long each reload of the ruler waits before it is sent, for resilience testing. Not for production.")
 
-	flag.StringVar(&cfg.listenInternal, "web.internal.listen", ":8083", "The address on which the internal server listens.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s: [flags] [command]\n", os.Args[0])
+		printDefaults(flag.CommandLine)
+		fmt.Fprint(flag.CommandLine.Output(), commandsUsage)
+	}
 
 	flag.Parse()
+	cfg.merge.ReservedLabels = splitList(cfg.merge.reservedLabels)
+	if cfg.configFile != "" {
+		var err error
+		if cfg.pipelines, err = loadConfigFile(flag.CommandLine, cfg.configFile); err != nil {
+			fatalf(syncer.ErrorConfig, "failed to load -config: %v", err)
+		}
+	}
+	var err error
+	if cfg.httpClient.tls, err = outboundTLS(cfg.httpClient.tlsMinVersion, cfg.httpClient.tlsCipherSuites); err != nil {
+		fatalf(syncer.ErrorConfig, "invalid -tls.min-version or -tls.cipher-suites: %v", err)
+	}
+
 	return cfg
 }
 
 func main() {
 	cfg := parseFlags()
+	if len(cfg.pipelines) == 0 {
+		configureOutputNames(cfg, flag.CommandLine)
+	}
 
+	if _, err := maxprocs.Set(maxprocs.Logger(log.Printf)); err != nil {
+		log.Printf("failed to set GOMAXPROCS from the CPU quota: %v", err)
+	}
+
+	// The commands write to the standard output, so that logging the configuration would only clutter it.
+	effective := newEffectiveConfig(cfg, flag.CommandLine)
+	if flag.NArg() == 0 {
+		log.Print(effective)
+	}
+
+	metrics.SetNativeHistograms(cfg.nativeHistograms)
 	registry := prometheus.NewRegistry()
 	registry.MustRegister(
 		collectors.NewGoCollector(),
@@ -91,232 +531,1185 @@ func main() {
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 
-	reloadDuration := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "thanos_rule_syncer_reload_duration_seconds",
-		Help: "Total duration of tenants file reload.",
-	})
-	registry.MustRegister(reloadDuration)
-
 	roundTripperInst := newRoundTripperInstrumenter(registry)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	t := http.DefaultTransport.(*http.Transport).Clone()
+	st := newStartup(registry, cfg.startupTimeout)
+	cas := newCAFiles(registry, cfg.caReloadInterval)
+	injector := configureChaos(cfg, registry)
+	ctx, clientFetcher, clientReloader, tenantClients, failover, closeIdleFetchConnections := configureClients(ctx, cfg, st, cas, roundTripperInst, injector, registry)
 
-	if cfg.observatoriumCA != "" {
-		caFile, err := os.ReadFile(cfg.observatoriumCA)
-		if err != nil {
-			log.Fatalf("failed to read Observatorium CA file: %v", err)
-		}
-
-		certPool := x509.NewCertPool()
-		certPool.AppendCertsFromPEM(caFile)
-		t.TLSClientConfig = &tls.Config{
-			RootCAs: certPool,
+	if flag.NArg() > 0 {
+		// Commands run once, so the dependencies are initialized before.
+		if err := st.Run(ctx); err != nil {
+			fatal(err)
 		}
+		os.Exit(runCommand(ctx, cfg, clientFetcher, tenantClients, flag.Args()))
 	}
 
-	clientFetcher := &http.Client{
-		Transport: roundTripperInst.NewRoundTripper("fetch", t),
+	if len(cfg.pipelines) > 0 {
+		runPipelines(ctx, cfg, st, cas, clientFetcher, func(url string) *http.Client {
+			return reloadClient(url, clientReloader, roundTripperInst)
+		}, registry)
+		return
 	}
-	clientReloader := &http.Client{
-		Transport: roundTripperInst.NewRoundTripper("reload", t),
+
+	m := configureMerger(cfg, clientFetcher, registry)
+
+	// Rules fetched from the Observatorium API for a single tenant are not prefixed with its name.
+	var mergeTenant string
+	if cfg.rulesBackendURL == "" && cfg.tenantsFile == "" {
+		mergeTenant = cfg.tenant
 	}
 
-	if cfg.oidc.issuerURL != "" {
-		provider, err := oidc.NewProvider(context.Background(), cfg.oidc.issuerURL)
-		if err != nil {
-			log.Fatalf("OIDC provider initialization failed: %v", err)
-		}
-		ctx = context.WithValue(ctx, oauth2.HTTPClient, http.Client{
-			Transport: roundTripperInst.NewRoundTripper("oauth", http.DefaultTransport),
-		})
-		ccc := clientcredentials.Config{
-			ClientID:     cfg.oidc.clientID,
-			ClientSecret: cfg.oidc.clientSecret,
-			TokenURL:     provider.Endpoint().TokenURL,
-		}
-		if cfg.oidc.audience != "" {
-			ccc.EndpointParams = url.Values{
-				"audience": []string{cfg.oidc.audience},
-			}
-		}
-		clientFetcher = &http.Client{
-			Transport: &oauth2.Transport{
-				Base:   clientFetcher.Transport,
-				Source: ccc.TokenSource(ctx),
-			},
-		}
+	var capacity *output.Capacity
+	if cfg.output.maxRules < 0 || cfg.output.maxBytes < 0 {
+		fatalf(syncer.ErrorConfig, "-output.max-total-rules and -output.max-bytes must not be negative")
+	}
+	if cfg.output.maxRules > 0 || cfg.output.maxBytes > 0 {
+		capacity = output.NewCapacity(registry, merge.GroupTenantFunc(mergeTenant), cfg.output.maxRules, cfg.output.maxBytes)
 	}
 
-	// Set retryable HTTP client.
-	clientFetcher.Transport = NewRetryableTransport(&RetryableTransportCfg{
-		Transport:       clientFetcher.Transport,
-		InitialInterval: 200 * time.Millisecond,
-		MaxInterval:     2 * time.Second,
-		MaxElapsedTime:  10 * time.Second,
-	})
+	reloadMetrics := reload.NewMetrics(registry)
+	// The router is created before the fetcher, as the tenants file can route tenants.
+	var router *route.Router
+	if cfg.output.routingFile != "" {
+		router = configureRouter(cfg, mergeTenant, func(url string) *http.Client {
+			return reloadClient(url, clientReloader, roundTripperInst)
+		}, reloadMetrics, registry)
+	}
 
-	var rulesFetcher fetcher
+	var rulesFetcher fetch.Fetcher
+	// lastModified gives the modification time of the rules of tenants in their source.
+	var lastModified func(tenant string) (time.Time, bool)
+	var fetches fetchReporter
+	var fetchConcurrency concurrencyTuner
 	var gr run.Group
 	var tenantsUpdater tenantsSetter
 
+	var stdinSource *stdinRules
+	var natsSource *fetch.NATSFetcher
+	var natsRules *natsBucket
+	if cfg.source != sourceAPI && cfg.source != sourceStdin && cfg.source != sourceNATS {
+		fatalf(syncer.ErrorConfig, "unknown source %q, must be one of: api, stdin, nats", cfg.source)
+	}
+
 	// If rulesBackendURL is specified, use it to fetch rules in priority.
 	// Otherwise, use observatoriumURL to fetch rules.
-	if cfg.rulesBackendURL != "" {
-		rof := configureRulesObjtoreFetcher(cfg, clientFetcher)
-		tenantsUpdater = rof
+	if cfg.source == sourceStdin {
+		if cfg.rulesBackendURL != "" || cfg.observatoriumURL != "" || cfg.tenant != "" || cfg.tenantsFile != "" {
+			fatalf(syncer.ErrorConfig, "-rules-backend-url, -observatorium-api-url, -tenant and -tenants-file can't be used with -source=stdin")
+		}
+		if cfg.configFile == stdinFile {
+			fatalf(syncer.ErrorConfig, "-config can't be read from the standard input with -source=stdin")
+		}
+		stdinSource = newStdinRules(os.Stdin)
+		rulesFetcher = stdinSource
+	} else if cfg.source == sourceNATS {
+		if cfg.rulesBackendURL != "" || cfg.observatoriumURL != "" || cfg.tenant != "" || cfg.tenantsFile != "" {
+			fatalf(syncer.ErrorConfig, "-rules-backend-url, -observatorium-api-url, -tenant and -tenants-file can't be used with -source=nats")
+		}
+		if cfg.nats.url == "" {
+			fatalf(syncer.ErrorConfig, "-nats.url must be specified with -source=nats")
+		}
+		natsRules = connectNATS(cfg, st)
+		natsSource = fetch.NewNATSFetcher(fetch.WithNATSRegisterer(registry))
+		rulesFetcher = natsSource
+		fetches = natsSource
+	} else if cfg.rulesBackendURL != "" {
+		rof, tenantsSetter := configureRulesObjtoreFetcher(cfg, st, clientFetcher, tenantClients, m, capacity, router, registry)
+		tenantsUpdater = tenantsSetter
+		lastModified = rof.LastModified
+		fetches = rof
+		fetchConcurrency = rof
 
 		// If at least one tenant is specified, use GetTenantsRules to fetch rules for each tenant.
 		// Otherwise, use GetAllRules to fetch rules for all tenants.
-		rulesFetcher = fetcherFunc(rof.GetAllRules)
-		if len(cfg.tenant) > 0 {
-			rulesFetcher = fetcherFunc(rof.GetTenantsRules)
+		rulesFetcher = fetch.FetcherFunc(rof.GetAllRules)
+		if len(cfg.tenant) > 0 || cfg.tenantsFile != "" {
+			rulesFetcher = fetch.FetcherFunc(rof.GetTenantsRules)
 		}
+	} else if cfg.observatoriumURL != "" && cfg.tenantsFile != "" {
+		// The rules of the tenants of the tenants file are fetched concurrently and merged like from the rules backend.
+		rof, tenantsSetter := configureRulesObjtoreFetcher(cfg, st, clientFetcher, tenantClients, m, capacity, router, registry)
+		tenantsUpdater = tenantsSetter
+		lastModified = rof.LastModified
+		fetches = rof
+		fetchConcurrency = rof
+		rulesFetcher = fetch.FetcherFunc(rof.GetTenantsRules)
 	} else if cfg.observatoriumURL != "" {
-		if cfg.tenantsFile != "" || cfg.tenant == "" {
-			log.Fatal("a tenant must be specified with the -tenant flag when using the Observatorium API")
+		if cfg.tenant == "" {
+			fatalf(syncer.ErrorConfig, "a tenant must be specified with the -tenant or -tenants-file flag when using the Observatorium API")
 		}
 
-		obsAPIFetcher, err := newObservatoriumAPIFetcher(cfg.observatoriumURL, cfg.tenant, clientFetcher)
+		obsAPIFetcher, err := fetch.NewObservatoriumAPIFetcher(cfg.observatoriumURL, cfg.tenant, clientFetcher)
 		if err != nil {
-			log.Fatalf("failed to initialize Observatorium API fetcher: %v", err)
+			fatalf(syncer.ErrorConfig, "failed to initialize Observatorium API fetcher: %v", err)
 		}
 
 		rulesFetcher = obsAPIFetcher
+		lastModified = obsAPIFetcher.LastModified
+		if fallback := singleTenantFallback(cfg); fallback != nil {
+			fallbackFetcher, err := fallback.fetcher(cfg.tenant, clientFetcher)
+			if err != nil {
+				fatalf(syncer.ErrorConfig, "failed to initialize fallback fetcher: %v", err)
+			}
+			rulesFetcher = fetch.NewFallback(obsAPIFetcher, fallbackFetcher, cfg.fallback.afterFailures)
+		}
 	} else {
-		log.Fatal("either -rules-backend-url or -observatorium-api-url must be specified")
+		fatalf(syncer.ErrorConfig, "either -rules-backend-url or -observatorium-api-url must be specified")
+	}
+	if cfg.fetchDNS.refresh {
+		rulesFetcher = fetch.NewReconnecting(rulesFetcher, closeIdleFetchConnections)
+	}
+	if failover != nil {
+		gr.Add(st.then(ctx, func() error {
+			return failover.Run(ctx, cfg.failover.probeInterval)
+		}), func(_ error) {
+			cancel()
+		})
+	}
+
+	processors := []syncer.Processor{func(ctx context.Context, rules []byte) ([]byte, error) {
+		return m.Merge(ctx, rules, mergeTenant)
+	}}
+	if cfg.canary.tenant != "" {
+		c := configureCanary(cfg, clientReloader, registry)
+		// The rules of the canary tenant go through the same checks as the rules of the other tenants.
+		processors = append(processors, c.Inject)
+		gr.Add(st.then(ctx, func() error {
+			return c.Run(ctx, cfg.canary.checkInterval)
+		}), func(_ error) {
+			cancel()
+		})
+	}
+
+	cfg.lint.Severities = splitList(cfg.lint.severities)
+	cfg.lint.CriticalSeverities = splitList(cfg.lint.criticalSeverities)
+	linter, err := lint.New(registry, cfg.lint.Config, merge.GroupTenantFunc(mergeTenant))
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "failed to configure alert conventions checks: %v", err)
+	}
+	if linter.Enabled() {
+		processors = append(processors, linter.Check)
+	}
+	templates, err := tmplcheck.New(registry, cfg.templatesPolicy, merge.GroupTenantFunc(mergeTenant))
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "failed to configure alert templates checks: %v", err)
+	}
+	if templates.Enabled() {
+		processors = append(processors, templates.Check)
+	}
+	var routing routingReporter
+	if cfg.amConfigFile != "" {
+		root, err := amroute.ReadConfigFile(cfg.amConfigFile)
+		if err != nil {
+			fatalf(syncer.ErrorConfig, "failed to configure alert routing checks: %v", err)
+		}
+		routeChecker := amroute.New(registry, root, merge.GroupTenantFunc(mergeTenant))
+		processors = append(processors, routeChecker.Check)
+		routing = routeChecker
+	}
+
+	versionSource := compat.NewBuildInfoVersionSource(cfg.thanosRuleURL, reloadClient(cfg.thanosRuleURL, clientReloader, roundTripperInst))
+	if cfg.thanos.version != "" {
+		version, err := compat.ParseVersion(cfg.thanos.version)
+		if err != nil {
+			fatalf(syncer.ErrorConfig, "failed to parse -thanos.version: %v", err)
+		}
+		versionSource = compat.StaticVersion(version)
+	}
+
+	fieldPolicies, err := parseFieldPolicies(cfg.thanos.unsupportedFieldPolicy)
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "failed to parse -thanos.unsupported-fields.policies: %v", err)
+	}
+
+	checker, err := compat.New(registry, versionSource, compat.Config{
+		Policy:        cfg.thanos.unsupportedFields,
+		FieldPolicies: fieldPolicies,
+	})
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "failed to configure rules compatibility checks: %v", err)
+	}
+	processors = append(processors, checker.Check)
+	if capacity != nil {
+		processors = append(processors, capacity.Check)
+	}
+	// The rules are validated once all the processors changing them ran, so that Thanos Ruler doesn't fail to reload them.
+	processors = append(processors, func(_ context.Context, content []byte) ([]byte, error) {
+		if err := rules.ValidateStrict(content, merge.GroupTenantFunc(mergeTenant)); err != nil {
+			return nil, fmt.Errorf("invalid merged rules: %w", err)
+		}
+		return content, nil
+	})
+
+	if cfg.output.provenance {
+		if cfg.output.tenantTemplate() != "" || cfg.output.routingFile != "" {
+			fatalf(syncer.ErrorConfig, "-output.provenance can't be used with -output.tenant-dir, -file-template or -output.routing-file")
+		}
+		// Comments are dropped by the processors parsing the rules, so they are added last.
+		processors = append(processors, output.NewProvenance(merge.GroupTenantFunc(mergeTenant), lastModified).Annotate)
 	}
 
 	// If tenantsFile is specified, reload the list of tenants at the same rate as the rules.
 	if cfg.tenantsFile != "" {
-		tenantsReader := func() ([]string, error) {
-			return readTenantsFile(cfg.tenantsFile)
+		tenantsReader := func() (*TenantsConfig, error) {
+			return readTenantsFile(cfg.tenantsFile, cfg.tenantsFormat)
 		}
 		interval := time.Duration(cfg.interval) * time.Second
 
-		gr.Add(func() error {
+		gr.Add(st.then(ctx, func() error {
 			return newTenantsFileReloader(ctx, tenantsReader, interval, tenantsUpdater)
-		}, func(_ error) {
+		}), func(_ error) {
 			cancel()
 		})
 	}
 
 	gr.Add(run.SignalHandler(ctx, os.Interrupt))
 
-	gr.Add(func() error {
-		fn := func(ctx context.Context) error {
-			rules, err := rulesFetcher.getRules(ctx)
-			if err != nil {
-				return fmt.Errorf("failed to get rules from url: %v", err)
+	if cfg.syncMode != syncModeLoop && cfg.syncMode != syncModeHTTP && cfg.syncMode != syncModeOnce {
+		fatalf(syncer.ErrorConfig, "unknown sync mode %q, must be one of: loop, http, once", cfg.syncMode)
+	}
+	if cfg.overlapPolicy != syncer.OverlapSkip && cfg.overlapPolicy != syncer.OverlapQueue {
+		fatalf(syncer.ErrorConfig, "unknown sync overlap policy %q, must be one of: skip, queue", cfg.overlapPolicy)
+	}
+
+	syncerOpts := []syncer.Option{
+		syncer.WithInterval(time.Duration(cfg.interval) * time.Second),
+		syncer.WithOverlapPolicy(cfg.overlapPolicy),
+		syncer.WithProcessors(processors...),
+		syncer.WithTimeouts(cfg.timeouts),
+		syncer.WithRegisterer(registry),
+	}
+	if cfg.skipUnchanged {
+		syncerOpts = append(syncerOpts, syncer.WithSkipUnchanged())
+	}
+	if cfg.standby.enabled {
+		if cfg.syncMode == syncModeOnce {
+			fatalf(syncer.ErrorConfig, "-standby can't be used with -sync.mode=once")
+		}
+		syncerOpts = append(syncerOpts, syncer.WithStandby())
+	} else if cfg.standby.lockFile != "" {
+		fatalf(syncer.ErrorConfig, "-standby must be specified with -standby.lock-file")
+	}
+	if cfg.report.dir != "" || cfg.report.webhookURL != "" {
+		reporter := configureReporter(cfg, mergeTenant, roundTripperInst, registry)
+		syncerOpts = append(syncerOpts, syncer.WithObservers(reporter.Observe))
+	}
+	if cfg.events.natsURL != "" {
+		syncerOpts = append(syncerOpts, syncer.WithObservers(configureEventPublisher(cfg, mergeTenant, registry).Observe))
+	}
+	var usageReporter *usage.Reporter
+	if cfg.usage.interval > 0 {
+		usageReporter = configureUsageReporter(cfg, mergeTenant, roundTripperInst, registry)
+		syncerOpts = append(syncerOpts, syncer.WithObservers(usageReporter.Observe))
+	} else if cfg.usage.uploadURL != "" {
+		fatalf(syncer.ErrorConfig, "-usage.interval must be specified with -usage.upload-url")
+	}
+	if cfg.adaptive.enabled {
+		syncerOpts = append(syncerOpts, syncer.WithObservers(configureAdaptiveConcurrency(cfg, fetchConcurrency, registry).Observe))
+	}
+	if cfg.schedule != "" {
+		schedule, err := cron.ParseStandard(cfg.schedule)
+		if err != nil {
+			fatalf(syncer.ErrorConfig, "failed to parse sync schedule: %v", err)
+		}
+		syncerOpts = append(syncerOpts, syncer.WithSchedule(schedule))
+	}
+
+	var (
+		writer   output.Writer   = configureOutputFile(cfg, cfg.file, registry)
+		reloader reload.Reloader = reload.NewThanosRule(cfg.thanosRuleURL, reloadClient(cfg.thanosRuleURL, clientReloader, roundTripperInst), reload.WithMetrics(reloadMetrics))
+	)
+	if template := cfg.output.tenantTemplate(); template != "" {
+		if cfg.output.tenantDir != "" && cfg.output.fileTemplate != "" {
+			fatalf(syncer.ErrorConfig, "only one of -output.tenant-dir and -file-template can be specified")
+		}
+		if cfg.output.routingFile != "" {
+			fatalf(syncer.ErrorConfig, "only one of -output.routing-file, -output.tenant-dir and -file-template can be specified")
+		}
+		if cfg.output.contentAddr {
+			fatalf(syncer.ErrorConfig, "-output.content-addressed can't be used with -output.tenant-dir or -file-template")
+		}
+		if err := output.ValidateTenantTemplate(template); err != nil {
+			fatalf(syncer.ErrorConfig, "invalid -file-template: %v", err)
+		}
+		writer = output.NewTenantFilesTemplate(registry, template, merge.GroupTenantFunc(mergeTenant), cfg.output.tenantGrace, outputFileOptions(cfg)...)
+	}
+	if cfg.reload.extraURLs != "" || cfg.reload.retries > 0 || cfg.reload.quorum > 0 {
+		if cfg.output.routingFile != "" {
+			fatalf(syncer.ErrorConfig, "-reload.extra-urls, -reload.retries and -reload.quorum can't be used with -output.routing-file")
+		}
+		reloader = configureMultiReloader(cfg, func(url string) *http.Client {
+			return reloadClient(url, clientReloader, roundTripperInst)
+		}, reloadMetrics, registry)
+	}
+	if router != nil {
+		writer, reloader = router, router
+	}
+
+	if cfg.output.scrapeHints != "" {
+		writer = output.NewScrapeHints(registry, writer, cfg.output.scrapeHints)
+	}
+	if cfg.postWrite.command != "" {
+		writer = configurePostWriteHook(cfg, writer, registry)
+	}
+	if injector != nil {
+		reloader = injector.Reloader(reloader, cfg.chaos.slowReload, cfg.chaos.failReloadPercent)
+	}
+	if cfg.reload.lockFile != "" {
+		reloader = reload.NewCoordinated(registry, reloader, cfg.reload.lockFile, cfg.reload.debounce)
+	}
+
+	rulesSyncer := syncer.New(rulesFetcher, writer, reloader, syncerOpts...)
+	// promote promotes the standby syncer, and syncs the rules right away so that the failover doesn't wait for the
+	// next interval.
+	promote := func(by string) bool {
+		if !rulesSyncer.Promote() {
+			return false
+		}
+		log.Printf("promoted from standby by %s", by)
+		if cfg.syncMode == syncModeLoop {
+			rulesSyncer.Trigger()
+		}
+		return true
+	}
+
+	if cfg.divergenceCheck > 0 {
+		if cfg.output.tenantTemplate() != "" || cfg.output.routingFile != "" {
+			fatalf(syncer.ErrorConfig, "-divergence.interval can't be used with -output.tenant-dir, -file-template or -output.routing-file")
+		}
+
+		checker := divergence.New(registry, cfg.file, rulesSyncer.LastWritten,
+			divergence.WithRuler(cfg.thanosRuleURL, reloadClient(cfg.thanosRuleURL, clientReloader, roundTripperInst)))
+		gr.Add(st.then(ctx, func() error {
+			return checker.Run(ctx, cfg.divergenceCheck)
+		}), func(_ error) {
+			cancel()
+		})
+	}
+
+	// The dependencies are initialized within the run group, so that the internal server already serves the metrics
+	// and the readiness while they can't be.
+	gr.Add(st.actor(ctx), func(_ error) {
+		cancel()
+	})
+	gr.Add(st.then(ctx, func() error {
+		return cas.Run(ctx)
+	}), func(_ error) {
+		cancel()
+	})
+	if usageReporter != nil {
+		gr.Add(st.then(ctx, func() error {
+			return usageReporter.Run(ctx)
+		}), func(_ error) {
+			cancel()
+		})
+	}
+	if cfg.otlp.metricsURL != "" {
+		exporter := configureOTLPExporter(cfg, roundTripperInst, registry)
+		// The metrics are also pushed while starting up, like they are served.
+		gr.Add(func() error {
+			return exporter.Run(ctx)
+		}, func(_ error) {
+			cancel()
+		})
+	}
+	if cfg.syncMode == syncModeLoop {
+		gr.Add(st.then(ctx, func() error {
+			return rulesSyncer.Loop(ctx)
+		}), func(err error) {
+			cancel()
+		})
+		if cfg.syncWatchdog {
+			gr.Add(st.then(ctx, watchdog(ctx, rulesSyncer, "")), func(_ error) {
+				cancel()
+			})
+		}
+	}
+	if cfg.syncMode == syncModeOnce {
+		gr.Add(st.then(ctx, func() error {
+			if err := rulesSyncer.Once(ctx); err != nil {
+				fatal(err)
 			}
-			defer rules.Close()
-			file, err := os.Create(cfg.file)
+			log.Print("rules synced")
+			return nil
+		}), func(_ error) {
+			cancel()
+		})
+	}
+	if cfg.standby.lockFile != "" {
+		if cfg.standby.lockInterval <= 0 {
+			fatalf(syncer.ErrorConfig, "-standby.lock-interval must be positive")
+		}
+		elector := leader.NewElector(registry, cfg.standby.lockFile, cfg.standby.lockInterval)
+		// The lock is only taken once the startup is over, so that a standby unable to start doesn't hold it.
+		gr.Add(st.then(ctx, func() error {
+			return elector.Run(ctx, func() { promote("leader election") })
+		}), func(_ error) {
+			cancel()
+		})
+	}
+	if stdinSource != nil {
+		gr.Add(rereadOnHangup(ctx, stdinSource, rulesSyncer), func(_ error) {
+			cancel()
+		})
+	}
+	if natsSource != nil {
+		gr.Add(st.then(ctx, func() error {
+			defer natsRules.conn.Close()
+			// Each change of the rules of a tenant runs a sync cycle.
+			return natsSource.Run(ctx, natsRules.kv, rulesSyncer.Trigger)
+		}), func(_ error) {
+			cancel()
+		})
+	}
+
+	{
+		h := newInternalHandler(registry)
+
+		var token string
+		if cfg.adminTokenFile != "" {
+			var err error
+			token, err = readAdminToken(cfg.adminTokenFile)
 			if err != nil {
-				return fmt.Errorf("failed to create or open the rules file %s: %v", cfg.file, err)
+				fatal(&syncer.Error{Class: syncer.ErrorConfig, Err: err})
 			}
-			w := bufio.NewWriter(file)
-			if _, err = w.ReadFrom(rules); err != nil {
-				return fmt.Errorf("failed to write to rules file %s: %v", cfg.file, err)
-			}
-			if err := file.Close(); err != nil {
-				return fmt.Errorf("failed to close the rules file %s: %v", cfg.file, err)
+		}
+
+		if cfg.syncMode == syncModeHTTP {
+			// A sync before the tenants file is read would remove the rules of all tenants.
+			addSyncHandler(h, token, withReady(st.Ready, rulesSyncer.Handler().ServeHTTP))
+		}
+		addStatusEndpoint(h, linter, fetches, routing, effective)
+		addReadyEndpoint(h, st.Ready)
+		if usageReporter != nil {
+			addUsageEndpoint(h, usageReporter)
+		}
+		if cfg.validate {
+			validator := &ruleValidator{merger: m, checker: checker}
+			if linter.Enabled() {
+				validator.linter = linter
 			}
-			if err := reloadThanosRule(ctx, clientReloader, cfg.thanosRuleURL); err != nil {
-				return fmt.Errorf("failed to trigger thanos rule reload: %v", err)
+			if templates.Enabled() {
+				validator.templates = templates
 			}
-			return nil
+			addValidateEndpoint(h, token, validator, mergeTenant)
 		}
-		if err := fn(ctx); err != nil {
-			log.Print(err.Error())
-		}
-
-		ticker := time.NewTicker(time.Duration(cfg.interval) * time.Second)
-		for {
-			select {
-			case <-ticker.C:
-				startTime := time.Now()
-				timeout := max(60*time.Second, time.Duration(cfg.interval)*time.Second)
-				ctx, cancel := context.WithTimeout(ctx, timeout)
-				if err := fn(ctx); err != nil {
-					log.Print(err.Error())
-				} else {
-					reloadDuration.Set(time.Since(startTime).Seconds())
+
+		if token != "" {
+			addPauseEndpoints(h, token, rulesSyncer)
+			if cfg.standby.enabled {
+				addPromoteEndpoint(h, token, func() bool { return promote("admin endpoint") })
+			}
+			addTuningEndpoint(h, token, rulesSyncer, fetchConcurrency, cfg.syncMode == syncModeLoop && cfg.schedule == "")
+			if cfg.debugRules {
+				addDebugRulesEndpoints(h, token, rulesSyncer, merge.GroupTenantFunc(mergeTenant))
+			}
+			if cfg.syncMode == syncModeLoop {
+				addSyncEndpoint(h, token, rulesSyncer)
+			}
+
+			if cfg.enableLifecycle {
+				quit := make(chan struct{})
+				var quitOnce sync.Once
+
+				reloadConfig := func() error {
+					if cfg.tenantsFile != "" {
+						tenants, err := readTenantsFile(cfg.tenantsFile, cfg.tenantsFormat)
+						if err != nil {
+							return err
+						}
+						tenantsUpdater.SetTenants(tenants)
+					}
+
+					if cfg.merge.policyFile != "" {
+						mergePolicy, err := merge.ReadPolicyFile(cfg.merge.policyFile)
+						if err != nil {
+							return fmt.Errorf("failed to read merge policy file: %w", err)
+						}
+						m.SetPolicy(mergePolicy)
+					}
+
+					rulesSyncer.Trigger()
+					return nil
 				}
-				cancel()
-			case <-ctx.Done():
-				return nil
+
+				addLifecycleEndpoints(h, token, func() { quitOnce.Do(func() { close(quit) }) }, reloadConfig)
+
+				gr.Add(func() error {
+					select {
+					case <-quit:
+					case <-ctx.Done():
+					}
+					return nil
+				}, func(_ error) {
+					cancel()
+				})
 			}
+		} else if cfg.enableLifecycle {
+			fatalf(syncer.ErrorConfig, "-web.internal.admin-token-file must be specified with -web.internal.enable-lifecycle")
 		}
-	}, func(err error) {
-		cancel()
+
+		addInternalServer(&gr, cfg.listenInternal, h)
+	}
+
+	if err := gr.Run(); err != nil {
+		fatal(fmt.Errorf("thanos-rule-syncer quit unexpectectly: %w", err))
+	}
+}
+
+// newInternalHandler returns the handler of the internal server, serving the metrics of the registry and pprof.
+func newInternalHandler(registry *prometheus.Registry) *internalserver.Handler {
+	return internalserver.NewHandler(
+		internalserver.WithName("Internal - thanos-rule-syncer"),
+		internalserver.WithPrometheusRegistry(registry),
+		internalserver.WithPProf(),
+	)
+}
+
+// addInternalServer adds the internal server, listening on addr, to the run group.
+func addInternalServer(gr *run.Group, addr string, h http.Handler) {
+	//nolint:exhaustivestruct
+	s := http.Server{
+		Addr:    addr,
+		Handler: h,
+	}
+
+	l, err := listen(addr)
+	if err != nil {
+		log.Fatalf("failed to listen for the internal server: %v", err)
+	}
+
+	gr.Add(func() error {
+		log.Print("starting internal HTTP server at address: ", addr)
+
+		return s.Serve(l) //nolint:wrapcheck
+	}, func(_ error) {
+		_ = s.Shutdown(context.Background())
 	})
+}
 
-	{
-		h := internalserver.NewHandler(
-			internalserver.WithName("Internal - thanos-rule-syncer"),
-			internalserver.WithPrometheusRegistry(registry),
-			internalserver.WithPProf(),
-		)
+// fetchResolver returns the resolver of the upstream hosts set by -fetch.dns.resolver, or the one of the system.
+func fetchResolver(cfg *config) *net.Resolver {
+	if cfg.fetchDNS.resolver == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(cfg.fetchDNS.resolver); err != nil {
+		fatalf(syncer.ErrorConfig, "invalid -fetch.dns.resolver: %v", err)
+	}
 
-		//nolint:exhaustivestruct
-		s := http.Server{
-			Addr:    cfg.listenInternal,
-			Handler: h,
+	return fetch.NewResolver(cfg.fetchDNS.resolver)
+}
+
+// configureClients creates the HTTP clients used to fetch rules, authenticated with OIDC if configured, to reload the ruler,
+// and to query the Observatorium API for tenants with their own OIDC client credentials, the transport failing over to the standby upstreams of -failover.file if any, and a function closing the idle connections
+// of the client fetching rules. The returned context carries the HTTP client used for OIDC token exchanges.
+// The CA files and the OIDC client credentials are initialized by the steps added to the startup, the clients waiting for it,
+// and the CA files are read again when they change.
+func configureClients(ctx context.Context, cfg *config, st *startup, cas *caFiles, roundTripperInst *roundTripperInstrumenter, injector *chaos.Injector, r prometheus.Registerer) (context.Context, *http.Client, *http.Client, *tenantClients, *fetch.FailoverTransport, func()) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = upstreamDialer(nil, nil, cfg.httpClient.dialTimeout).DialContext
+	t.TLSHandshakeTimeout = cfg.httpClient.tlsHandshakeTimeout
+	configureTLS(t, cfg.httpClient.tls)
+
+	// Only the upstream requests are dialed from -fetch.bind-address and resolved with -fetch.dns.resolver,
+	// the ruler is reached as usual.
+	fetchTransport, oauthTransport := t.Clone(), t.Clone()
+	if cfg.fetchBindAddress != "" || cfg.fetchDNS.resolver != "" {
+		var local *net.TCPAddr
+		if cfg.fetchBindAddress != "" {
+			var err error
+			local, err = bindAddr(cfg.fetchBindAddress)
+			if err != nil {
+				fatalf(syncer.ErrorConfig, "invalid -fetch.bind-address: %v", err)
+			}
+			log.Printf("dialing upstream requests from %s", local.IP)
 		}
 
-		gr.Add(func() error {
-			log.Print("starting internal HTTP server at address: ", s.Addr)
+		dialer := upstreamDialer(local, fetchResolver(cfg), cfg.httpClient.dialTimeout)
+		fetchTransport.DialContext = dialer.DialContext
+		oauthTransport.DialContext = dialer.DialContext
+	}
 
-			return s.ListenAndServe() //nolint:wrapcheck
-		}, func(_ error) {
-			_ = s.Shutdown(context.Background())
+	if cfg.fetchSPIFFE.enabled {
+		identity := newSPIFFEIdentity(r)
+		if err := identity.configure(fetchTransport, cfg.fetchSPIFFE.serverID); err != nil {
+			fatalf(syncer.ErrorConfig, "invalid -fetch.spiffe.server-id: %v", err)
+		}
+		st.add("-fetch.spiffe", func(stepCtx context.Context) error {
+			return identity.start(stepCtx, cfg.fetchSPIFFE.socket, ctx.Done())
 		})
+	} else if cfg.fetchSPIFFE.socket != "" || cfg.fetchSPIFFE.serverID != "" {
+		fatalf(syncer.ErrorConfig, "-fetch.spiffe must be specified with -fetch.spiffe.endpoint-socket and -fetch.spiffe.server-id")
 	}
 
-	if err := gr.Run(); err != nil {
-		log.Fatalf("thanos-rule-syncer quit unexpectectly: %v", err)
+	if cfg.observatoriumCA != "" {
+		ca := cas.add(cfg.observatoriumCA)
+		ca.configure(t)
+		// With -fetch.spiffe, the upstreams are verified against the bundles of the Workload API instead.
+		if !cfg.fetchSPIFFE.enabled {
+			ca.configure(fetchTransport)
+		}
+		st.add("-observatorium-ca", func(context.Context) error {
+			if _, err := ca.load(); err != nil {
+				return classError(syncer.ErrorConfig, "failed to read Observatorium CA file: %w", err)
+			}
+			return nil
+		})
+	}
+
+	clientReloader := &http.Client{
+		Transport: roundTripperInst.NewRoundTripper("reload", st.transport(t)),
+	}
+
+	auth := newUpstreamAuth(cfg, st, oauthTransport, roundTripperInst, r)
+	ctx = auth.context(ctx)
+	if cfg.httpClient.proxyUsername != "" {
+		// The header is set before the transport of the standbys are cloned from the one fetching rules.
+		header := proxyConnectHeader(cfg.httpClient.proxyUsername, cfg.httpClient.proxyPassword, auth.resolver())
+		for _, transport := range []*http.Transport{t, fetchTransport, oauthTransport} {
+			transport.GetProxyConnectHeader = header
+		}
+		st.add("-http.proxy-password", func(ctx context.Context) error {
+			if _, err := auth.resolver().Secret(ctx, cfg.httpClient.proxyPassword); err != nil {
+				return classError(syncer.ErrorConfig, "failed to get -http.proxy-password: %w", err)
+			}
+			return nil
+		})
+	} else if cfg.httpClient.proxyPassword != "" {
+		fatalf(syncer.ErrorConfig, "-http.proxy-username must be specified with -http.proxy-password")
+	}
+	fetchBase := roundTripperInst.NewRoundTripper("fetch", st.transport(fetchTransport))
+	fetchRoundTripper := auth.transport(ctx, cfg.oidc, "-oidc.client-secret", fetchBase)
+
+	closeIdleConnections := fetchTransport.CloseIdleConnections
+	var failover *fetch.FailoverTransport
+	if cfg.failover.file != "" {
+		failover, closeIdleConnections = configureFailover(ctx, cfg, st, cas, fetchRoundTripper, fetchTransport, auth, roundTripperInst, r)
+		fetchRoundTripper = failover
+	}
+
+	// The rate limit paces each attempt of the retryable transport.
+	fetchRoundTripper = fetch.NewRateLimitTransport(&fetch.RateLimitTransportCfg{
+		Transport:  fetchRoundTripper,
+		Pace:       cfg.fetchRateLimit,
+		Registerer: r,
+	})
+
+	if injector != nil {
+		// The failures are injected below the retries, like the ones of the upstream.
+		fetchRoundTripper = injector.Transport(fetchRoundTripper, cfg.chaos.failFetchPercent)
 	}
+
+	// Set retryable HTTP client.
+	fetchRoundTripper = fetch.NewRetryableTransport(&fetch.RetryableTransportCfg{
+		Transport:       fetchRoundTripper,
+		InitialInterval: 200 * time.Millisecond,
+		MaxInterval:     2 * time.Second,
+		MaxElapsedTime:  10 * time.Second,
+	})
+	if cfg.fetchCacheTTL < 0 {
+		fatalf(syncer.ErrorConfig, "-fetch.cache-ttl must not be negative")
+	}
+	if cfg.fetchCacheTTL > 0 {
+		// Cached responses aren't retried nor paced.
+		fetchRoundTripper = fetch.NewCacheTransport(&fetch.CacheTransportCfg{
+			Transport:  fetchRoundTripper,
+			TTL:        cfg.fetchCacheTTL,
+			Registerer: r,
+		})
+	}
+	clientFetcher := &http.Client{Transport: fetchRoundTripper}
+
+	return ctx, clientFetcher, clientReloader, newTenantClients(ctx, auth, fetchBase, clientFetcher), failover, closeIdleConnections
 }
 
-func reloadThanosRule(ctx context.Context, client *http.Client, url string) error {
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/-/reload", url), nil)
-	if err != nil {
-		return err
+// configureSecrets creates the resolver of the secrets referenced by flags. Kubernetes secrets are read with the service
+// account of the pod, and fail if it doesn't run in a Kubernetes cluster.
+func configureSecrets(cfg *config, r prometheus.Registerer) *secret.Resolver {
+	vaultAddr := cfg.secrets.vaultAddr
+	if vaultAddr == "" {
+		vaultAddr = os.Getenv("VAULT_ADDR")
 	}
-	req = req.WithContext(ctx)
 
-	res, err := client.Do(req)
-	if err != nil {
-		return err
+	var kubernetes secret.Provider
+	if k, err := secret.NewInClusterKubernetes(); err == nil {
+		kubernetes = k
+	} else {
+		kubernetes = secret.ProviderFunc(func(context.Context, string) (string, error) {
+			return "", err
+		})
+	}
+
+	opts := []secret.Option{
+		secret.WithTTL(cfg.secrets.cacheTTL),
+		secret.WithProvider(secret.SchemeKubernetes, kubernetes),
+		secret.WithRegisterer(r),
 	}
-	if res.StatusCode/100 != 2 {
-		return fmt.Errorf("got unexpected status from Thanos Ruler: %d", res.StatusCode)
+	if vaultAddr != "" {
+		opts = append(opts, secret.WithProvider(secret.SchemeVault, secret.NewVault(vaultAddr, cfg.secrets.vaultTokenFile, &http.Client{Transport: outboundTransport(cfg.httpClient.tls), Timeout: 30 * time.Second})))
 	}
 
-	return nil
+	return secret.NewResolver(opts...)
 }
 
-func configureRulesObjtoreFetcher(cfg *config, client *http.Client) *RulesObjstoreFetcher {
+func configureRulesObjtoreFetcher(cfg *config, st *startup, client *http.Client, clients *tenantClients, m *merge.Merger, capacity *output.Capacity, router *route.Router, r prometheus.Registerer) (*fetch.RulesObjstoreFetcher, tenantsSetter) {
 	if cfg.tenantsFile != "" && cfg.tenant != "" {
-		log.Fatalf("only one of -tenant and -tenants-file can be specified")
+		fatalf(syncer.ErrorConfig, "only one of -tenant and -tenants-file can be specified")
+	}
+	if cfg.tenantsRemoval.maxPercent < 0 || cfg.tenantsRemoval.maxPercent > 100 {
+		fatalf(syncer.ErrorConfig, "-tenants.max-removal-percent must be between 0 and 100")
+	}
+	if cfg.fetchDeletion.notFoundThreshold < 0 {
+		fatalf(syncer.ErrorConfig, "-fetch.not-found-threshold must not be negative")
 	}
 
 	// Set initial tenants list
-	var tenants []string
-	if cfg.tenantsFile != "" {
+	tenants := &TenantsConfig{}
+	if cfg.tenant != "" {
+		tenants.Tenants = []TenantConfig{{ID: cfg.tenant, Fallback: singleTenantFallback(cfg)}}
+	}
+
+	opts := []fetch.RulesObjstoreFetcherOption{
+		fetch.WithConcurrency(cfg.fetchConcurrency),
+		fetch.WithFallbackAfter(cfg.fallback.afterFailures),
+		fetch.WithWatch(cfg.fetchWatch),
+		fetch.WithBatchSize(cfg.fetchBatchSize),
+		fetch.WithResumeAttempts(cfg.fetchResume),
+		fetch.WithNotFoundThreshold(cfg.fetchDeletion.notFoundThreshold),
+		fetch.WithTombstones(cfg.fetchDeletion.tombstones),
+		fetch.WithRegisterer(r),
+		fetch.WithResolver(fetchResolver(cfg)),
+		fetch.WithShuffle(fetchShuffleSource(cfg)),
+	}
+	if cfg.fetchSpoolDir != "" {
+		if cfg.tenant == "" && cfg.tenantsFile == "" {
+			fatalf(syncer.ErrorConfig, "-fetch.spool-dir can only be used with -tenant or -tenants-file")
+		}
+		opts = append(opts, fetch.WithSpoolDir(cfg.fetchSpoolDir))
+	}
+
+	// Without a rules backend, the rules of the tenants are fetched from the Observatorium API.
+	observatoriumAPI := cfg.rulesBackendURL == ""
+	var rof *fetch.RulesObjstoreFetcher
+	if observatoriumAPI {
+		if cfg.fetchWatch || cfg.fetchBatchSize > 0 || cfg.fetchResume > 0 || cfg.fetchDeletion.tombstones {
+			fatalf(syncer.ErrorConfig, "-fetch.watch, -fetch.batch-size, -fetch.resume-attempts and -fetch.tombstones require -rules-backend-url")
+		}
+		var err error
+		rof, err = fetch.NewObservatoriumAPITenantsFetcher(cfg.observatoriumURL, nil, client, opts...)
+		if err != nil {
+			fatalf(syncer.ErrorConfig, "failed to initialize Observatorium API fetcher: %v", err)
+		}
+	} else {
+		var err error
+		rof, err = fetch.NewRulesObjstoreFetcher(cfg.rulesBackendURL, nil, client, opts...)
+		if err != nil {
+			fatalf(syncer.ErrorConfig, "failed to initialize Rules Object Store fetcher: %v", err)
+		}
+	}
+
+	setter := newRemovalGuard(r, objstoreTenantsSetter{fetcher: rof, merger: m, capacity: capacity, router: router, clients: clients.client, observatoriumAPI: observatoriumAPI, includeClients: clients.include}, cfg.tenantsRemoval.maxPercent/100, cfg.tenantsRemoval.allowMass)
+	if cfg.tenantsFile == "" {
+		setter.SetTenants(tenants)
+		return rof, setter
+	}
+
+	// The tenants file is read again while it can't be opened, e.g. until it is mounted, but not if it is invalid.
+	st.add("-tenants-file", func(context.Context) error {
+		tenants, err := readTenantsFile(cfg.tenantsFile, cfg.tenantsFormat)
+		if err != nil {
+			err = classError(syncer.ErrorConfig, "failed to read tenants file: %w", err)
+			var pathErr *fs.PathError
+			if !errors.As(err, &pathErr) {
+				return backoff.Permanent(err)
+			}
+			return err
+		}
+		setter.SetTenants(tenants)
+		return nil
+	})
+
+	return rof, setter
+}
+
+// configureChaos returns the injector of the failures of the -debug flags, or nil if none is set.
+func configureChaos(cfg *config, r prometheus.Registerer) *chaos.Injector {
+	c := cfg.chaos
+	if c.failFetchPercent == 0 && c.failReloadPercent == 0 && c.slowReload == 0 {
+		return nil
+	}
+	if c.failFetchPercent < 0 || c.failFetchPercent > 100 || c.failReloadPercent < 0 || c.failReloadPercent > 100 {
+		fatalf(syncer.ErrorConfig, "-debug.fail-fetch-percent and -debug.fail-reload-percent must be between 0 and 100")
+	}
+	if c.slowReload < 0 {
+		fatalf(syncer.ErrorConfig, "-debug.slow-reload must not be negative")
+	}
+
+	log.Printf("WARNING: injecting failures for resilience testing, not for production: -debug.fail-fetch-percent=%v -debug.fail-reload-percent=%v -debug.slow-reload=%s",
+		c.failFetchPercent, c.failReloadPercent, c.slowReload)
+
+	return chaos.NewInjector(r)
+}
+
+// printDefaults prints the usage of the flags of fs like flag.PrintDefaults, without the hidden -debug flags.
+func printDefaults(fs *flag.FlagSet) {
+	visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	visible.SetOutput(fs.Output())
+	fs.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "debug.") {
+			return
+		}
+		visible.Var(f.Value, f.Name, f.Usage)
+		// The value may already be parsed from the arguments before the usage is printed.
+		visible.Lookup(f.Name).DefValue = f.DefValue
+	})
+	visible.PrintDefaults()
+}
+
+// configureMerger returns the merger of the rules of tenants, fetching the rules library with the given client.
+func configureMerger(cfg *config, client *http.Client, r prometheus.Registerer) *merge.Merger {
+	var mergePolicy *merge.Policy
+	if cfg.merge.policyFile != "" {
 		var err error
-		tenants, err = readTenantsFile(cfg.tenantsFile)
+		mergePolicy, err = merge.ReadPolicyFile(cfg.merge.policyFile)
+		if err != nil {
+			fatalf(syncer.ErrorConfig, "failed to read merge policy file: %v", err)
+		}
+	}
+
+	var library merge.LibraryLoader
+	if cfg.merge.library != "" {
+		library = merge.NewLibraryLoader(cfg.merge.library, client)
+	}
+
+	m, err := merge.New(r, cfg.merge.Config, mergePolicy, library)
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "failed to configure rules merging: %v", err)
+	}
+
+	return m
+}
+
+// configureCanary returns the canary tenant checking the pipeline end to end, querying its series with the given client.
+func configureCanary(cfg *config, client *http.Client, r prometheus.Registerer) *canary.Canary {
+	if cfg.rulesBackendURL == "" {
+		fatalf(syncer.ErrorConfig, "-canary.tenant requires -rules-backend-url, whose rule groups are prefixed with their tenant")
+	}
+	if cfg.canary.queryURL == "" {
+		fatalf(syncer.ErrorConfig, "-canary.query-url must be specified with -canary.tenant")
+	}
+	if strings.Contains(cfg.canary.tenant, ".") {
+		fatalf(syncer.ErrorConfig, "-canary.tenant must not contain a dot, which separates the tenant from the name of its rule groups")
+	}
+	if cfg.canary.period <= 0 || cfg.canary.grace <= 0 || cfg.canary.checkInterval <= 0 {
+		fatalf(syncer.ErrorConfig, "-canary.period, -canary.grace-period and -canary.check-interval must be positive")
+	}
+
+	return canary.New(r, cfg.canary.tenant, strings.TrimSuffix(cfg.canary.queryURL, "/"), client, cfg.canary.period, cfg.canary.grace)
+}
+
+// fetchShuffleSource returns the source of the random order in which tenants are fetched, or nil if it isn't random.
+func fetchShuffleSource(cfg *config) rand.Source {
+	if !cfg.fetchShuffle.enabled {
+		return nil
+	}
+
+	seed := cfg.fetchShuffle.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return rand.NewSource(seed)
+}
+
+// singleTenantFallback returns the fallback source of the -tenant configured by flags, or nil if there is none.
+func singleTenantFallback(cfg *config) *FallbackConfig {
+	if cfg.fallback.ObservatoriumAPIURL == "" && cfg.fallback.File == "" {
+		return nil
+	}
+
+	if err := cfg.fallback.validate(); err != nil {
+		fatalf(syncer.ErrorConfig, "invalid fallback flags: %v", err)
+	}
+
+	return &cfg.fallback.FallbackConfig
+}
+
+func configureOutputFile(cfg *config, file string, r prometheus.Registerer) *output.File {
+	return output.NewFile(file, append(outputFileOptions(cfg), output.WithRegisterer(r))...)
+}
+
+// configurePostWriteHook runs -post-write-cmd after the writer writes the rules.
+func configurePostWriteHook(cfg *config, w output.Writer, r prometheus.Registerer) output.Writer {
+	if cfg.output.routingFile != "" {
+		fatalf(syncer.ErrorConfig, "-post-write-cmd can't be used with -output.routing-file")
+	}
+	if cfg.postWrite.policy != output.HookFail && cfg.postWrite.policy != output.HookWarn {
+		fatalf(syncer.ErrorConfig, "unknown -post-write-cmd.failure-policy %q, must be one of: fail, warn", cfg.postWrite.policy)
+	}
+
+	if _, err := exec.LookPath(cfg.postWrite.command); err != nil {
+		fatalf(syncer.ErrorConfig, "invalid -post-write-cmd: %v", err)
+	}
+
+	path := cfg.file
+	if template := cfg.output.tenantTemplate(); template != "" {
+		path = output.TemplateRoot(template)
+	}
+
+	return output.NewHook(r, w, path, cfg.postWrite.command, output.WithHookTimeout(cfg.postWrite.timeout), output.WithHookPolicy(cfg.postWrite.policy))
+}
+
+// configureReporter reports the sync cycles to -report.dir and -report.webhook-url.
+func configureReporter(cfg *config, mergeTenant string, roundTripperInst *roundTripperInstrumenter, r prometheus.Registerer) *report.Reporter {
+	opts := []report.Option{report.WithChangesOnly(cfg.report.changesOnly)}
+	if cfg.report.dir != "" {
+		if info, err := os.Stat(cfg.report.dir); err != nil || !info.IsDir() {
+			fatalf(syncer.ErrorConfig, "-report.dir must be an existing directory: %s", cfg.report.dir)
+		}
+		opts = append(opts, report.WithDirectory(cfg.report.dir))
+	}
+	if cfg.report.webhookURL != "" {
+		if u, err := url.Parse(cfg.report.webhookURL); err != nil || u.Host == "" {
+			fatalf(syncer.ErrorConfig, "invalid -report.webhook-url: %q", cfg.report.webhookURL)
+		}
+		client := &http.Client{Transport: roundTripperInst.NewRoundTripper("report", outboundTransport(cfg.httpClient.tls))}
+		opts = append(opts, report.WithWebhook(cfg.report.webhookURL, client, cfg.report.webhookTimeout))
+	}
+
+	return report.New(r, merge.GroupTenantFunc(mergeTenant), opts...)
+}
+
+// configureEventPublisher publishes the changes of the rules of tenants to -events.nats-url. The connection is made in
+// the background and retried forever, so that an unavailable message bus doesn't hold the syncer back, the events
+// published meanwhile being buffered until it is connected.
+func configureEventPublisher(cfg *config, mergeTenant string, r prometheus.Registerer) *events.Publisher {
+	if cfg.events.natsSubject == "" || strings.ContainsAny(cfg.events.natsSubject, "*> \t\r\n") || strings.HasPrefix(cfg.events.natsSubject, ".") || strings.HasSuffix(cfg.events.natsSubject, ".") {
+		fatalf(syncer.ErrorConfig, "invalid -events.nats-subject: %q", cfg.events.natsSubject)
+	}
+
+	opts := []nats.Option{nats.Name("thanos-rule-syncer"), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true)}
+	opts = append(opts, natsTLS(cfg.events.natsURL, cfg.httpClient.tls)...)
+	if cfg.events.natsCredentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(cfg.events.natsCredentialsFile))
+	}
+	conn, err := nats.Connect(cfg.events.natsURL, opts...)
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "failed to connect to -events.nats-url: %v", err)
+	}
+
+	return events.NewPublisher(r, conn, cfg.events.natsSubject, merge.GroupTenantFunc(mergeTenant), events.WithTimeout(cfg.events.timeout))
+}
+
+// configureUsageReporter reports the usage of the rules of tenants at -usage.interval, and to -usage.upload-url.
+func configureUsageReporter(cfg *config, mergeTenant string, roundTripperInst *roundTripperInstrumenter, r prometheus.Registerer) *usage.Reporter {
+	if cfg.usage.evaluationInterval <= 0 {
+		fatalf(syncer.ErrorConfig, "-usage.evaluation-interval must be positive")
+	}
+	opts := []usage.Option{usage.WithEvaluationInterval(cfg.usage.evaluationInterval)}
+	if cfg.usage.uploadURL != "" {
+		u, err := url.Parse(cfg.usage.uploadURL)
+		if err != nil || u.Host == "" {
+			fatalf(syncer.ErrorConfig, "invalid -usage.upload-url: %q", cfg.usage.uploadURL)
+		}
+		client := &http.Client{Transport: roundTripperInst.NewRoundTripper("usage", outboundTransport(cfg.httpClient.tls))}
+		opts = append(opts, usage.WithUpload(u, client, cfg.usage.uploadTimeout))
+	}
+
+	return usage.New(r, merge.GroupTenantFunc(mergeTenant), cfg.usage.interval, opts...)
+}
+
+// configureAdaptiveConcurrency adapts the fetch concurrency to the budget of sync cycles with -fetch.concurrency.adaptive.
+func configureAdaptiveConcurrency(cfg *config, c concurrencyTuner, r prometheus.Registerer) *adaptive.Controller {
+	if c == nil {
+		fatalf(syncer.ErrorConfig, "-fetch.concurrency.adaptive requires -rules-backend-url")
+	}
+	if cfg.syncMode != syncModeLoop {
+		fatalf(syncer.ErrorConfig, "-fetch.concurrency.adaptive requires sync cycles run at an interval or schedule")
+	}
+	if cfg.adaptive.Max == 0 {
+		cfg.adaptive.Max = 4 * c.Concurrency()
+	}
+
+	controller, err := adaptive.New(r, c, cfg.adaptive.Config)
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "failed to configure adaptive fetch concurrency: %v", err)
+	}
+
+	return controller
+}
+
+// configureOTLPExporter pushes the metrics of the registry to -otlp.metrics-url.
+func configureOTLPExporter(cfg *config, roundTripperInst *roundTripperInstrumenter, registry *prometheus.Registry) *otlp.Exporter {
+	u, err := url.Parse(cfg.otlp.metricsURL)
+	if err != nil || u.Host == "" {
+		fatalf(syncer.ErrorConfig, "invalid -otlp.metrics-url: %q", cfg.otlp.metricsURL)
+	}
+	if cfg.otlp.interval <= 0 {
+		fatalf(syncer.ErrorConfig, "-otlp.metrics-interval must be positive")
+	}
+
+	client := &http.Client{Transport: roundTripperInst.NewRoundTripper("otlp", outboundTransport(cfg.httpClient.tls))}
+	opts := []otlp.Option{otlp.WithClient(client), otlp.WithTimeout(cfg.otlp.timeout)}
+	if cfg.otlp.headersFile != "" {
+		headers, err := otlp.ReadHeadersFile(cfg.otlp.headersFile)
 		if err != nil {
-			log.Fatalf("failed to read tenants file: %v", err)
+			fatalf(syncer.ErrorConfig, "failed to read -otlp.metrics-headers-file: %v", err)
 		}
-	} else if cfg.tenant != "" {
-		tenants = []string{cfg.tenant}
+		opts = append(opts, otlp.WithHeaders(headers))
+	}
+
+	return otlp.NewExporter(registry, registry, u, cfg.otlp.interval, opts...)
+}
+
+// outputFileOptions returns the options of the rules files set by flags.
+func outputFileOptions(cfg *config) []output.FileOption {
+	opts := []output.FileOption{
+		output.WithFsync(cfg.output.fsync),
+		output.WithPreserveOwner(cfg.output.preserveOwner),
+		output.WithContentAddressed(cfg.output.contentAddr),
+	}
+
+	if cfg.output.fileMode != "" {
+		mode, err := strconv.ParseUint(cfg.output.fileMode, 8, 32)
+		if err != nil {
+			fatalf(syncer.ErrorConfig, "invalid -output.file-mode %q: %v", cfg.output.fileMode, err)
+		}
+		opts = append(opts, output.WithFileMode(os.FileMode(mode)))
+	}
+
+	if cfg.output.dirMode != "" {
+		mode, err := strconv.ParseUint(cfg.output.dirMode, 8, 32)
+		if err != nil {
+			fatalf(syncer.ErrorConfig, "invalid -output.dir-mode %q: %v", cfg.output.dirMode, err)
+		}
+		opts = append(opts, output.WithDirMode(os.FileMode(mode)))
+	}
+
+	return opts
+}
+
+// parseFieldPolicies parses comma-separated field=policy pairs.
+func parseFieldPolicies(s string) (map[string]string, error) {
+	policies := map[string]string{}
+	if s == "" {
+		return policies, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		field, policy, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || field == "" {
+			return nil, fmt.Errorf("invalid field policy %q, must be field=policy", pair)
+		}
+		policies[field] = policy
+	}
+
+	return policies, nil
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// reloadClient returns the HTTP client reloading the ruler at the given URL, sending requests
+// to its socket for a unix:// URL.
+func reloadClient(url string, client *http.Client, roundTripperInst *roundTripperInstrumenter) *http.Client {
+	path, ok := reload.UnixSocketPath(url)
+	if !ok {
+		return client
+	}
+
+	return &http.Client{
+		Transport: roundTripperInst.NewRoundTripper("reload", reload.NewUnixSocketTransport(path)),
+	}
+}
+
+// listen listens on a TCP address, or on a Unix domain socket for a unix:// URL. A stale socket file
+// left by a previous process is removed.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+
+	return net.Listen("unix", path)
+}
+
+// configureMultiReloader creates the reloader of -thanos-rule-url and -reload.extra-urls, retrying failed reloads.
+func configureMultiReloader(cfg *config, client func(url string) *http.Client, reloadMetrics *reload.Metrics, r prometheus.Registerer) *reload.Multi {
+	urls := append([]string{cfg.thanosRuleURL}, splitList(cfg.reload.extraURLs)...)
+	targets := make([]reload.Target, 0, len(urls))
+	for _, url := range urls {
+		targets = append(targets, reload.Target{
+			Name:     url,
+			Reloader: reload.NewThanosRule(url, client(url), reload.WithMetrics(reloadMetrics)),
+		})
+	}
+
+	m, err := reload.NewMulti(r, targets, reload.WithRetries(cfg.reload.retries, cfg.reload.retryBackoff), reload.WithQuorum(cfg.reload.quorum))
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "failed to configure reloads: %v", err)
+	}
+
+	return m
+}
+
+// configureRouter creates the router of rule groups to the outputs of the routing table, and to -file
+// and -thanos-rule-url for the groups not selected by any route.
+func configureRouter(cfg *config, tenant string, client func(url string) *http.Client, reloadMetrics *reload.Metrics, r prometheus.Registerer) *route.Router {
+	tmpl, err := outputNameTemplate(cfg)
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "%v", err)
+	}
+	table, err := routeTable(cfg, tmpl)
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "failed to read routing file: %v", err)
+	}
+
+	rulers := map[string]reload.Reloader{
+		cfg.thanosRuleURL: reload.NewThanosRule(cfg.thanosRuleURL, client(cfg.thanosRuleURL), reload.WithMetrics(reloadMetrics)),
+	}
+
+	outputs := make([]route.Output, 0, len(table.Routes))
+	for _, rt := range table.Routes {
+		url := rt.ThanosRuleURL
+		if url == "" {
+			url = cfg.thanosRuleURL
+		}
+		if _, ok := rulers[url]; !ok {
+			rulers[url] = reload.NewThanosRule(url, client(url), reload.WithMetrics(reloadMetrics))
+		}
+
+		outputs = append(outputs, route.Output{
+			Writer:   configureOutputFile(cfg, rt.File, prometheus.WrapRegistererWith(prometheus.Labels{"route": rt.Name}, r)),
+			Reloader: rulers[url],
+		})
+	}
+
+	fallback := route.Output{
+		Writer:   configureOutputFile(cfg, cfg.file, prometheus.WrapRegistererWith(prometheus.Labels{"route": route.DefaultRoute}, r)),
+		Reloader: rulers[cfg.thanosRuleURL],
 	}
 
-	rof, err := NewRulesObjstoreFetcher(cfg.rulesBackendURL, tenants, client)
+	router, err := route.NewRouter(table, tenant, outputs, fallback)
 	if err != nil {
-		log.Fatalf("failed to initialize Rules Object Store fetcher: %v", err)
+		fatalf(syncer.ErrorConfig, "failed to configure routing: %v", err)
 	}
 
-	return rof
+	return router
 }
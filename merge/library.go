@@ -0,0 +1,213 @@
+package merge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"gopkg.in/yaml.v3"
+)
+
+// Library is a set of parameterized rule templates that tenants can reference from their rule groups.
+type Library struct {
+	Templates []Template `yaml:"templates"`
+
+	templates map[string]*Template
+}
+
+// Template is a list of rules with [[ .param ]] placeholders replaced by the parameters of the references.
+// The [[ ]] delimiters leave the {{ }} ones of alert templates untouched. Each scalar of the rules is rendered on its
+// own, so that the parameters, supplied by tenants, are values of the scalars whatever their characters, e.g. quotes
+// or newlines, and can't change the structure of the rules.
+type Template struct {
+	Name   string    `yaml:"name"`
+	Params []string  `yaml:"params"`
+	Rules  yaml.Node `yaml:"rules"`
+
+	// scalars are the templates of the scalars of the rules with placeholders.
+	scalars map[*yaml.Node]*template.Template
+}
+
+// LibraryLoader loads the rule library.
+type LibraryLoader func(ctx context.Context) (*Library, error)
+
+// NewLibraryLoader returns a LibraryLoader reading the rule library from a file, or from an HTTP(S) URL using the given client.
+func NewLibraryLoader(location string, client *http.Client) LibraryLoader {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return func(_ context.Context) (*Library, error) {
+			content, err := os.ReadFile(location)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read rule library file: %w", err)
+			}
+
+			return ParseLibrary(content)
+		}
+	}
+
+	return func(ctx context.Context) (*Library, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to do http request: %w", err)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode/100 != 2 {
+			return nil, fmt.Errorf("got unexpected status from rule library: %d", res.StatusCode)
+		}
+
+		content, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+
+		return ParseLibrary(content)
+	}
+}
+
+// ParseLibrary parses a rule library and its templates.
+func ParseLibrary(content []byte) (*Library, error) {
+	lib := &Library{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(lib); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rule library: %w", err)
+	}
+
+	lib.templates = make(map[string]*Template, len(lib.Templates))
+	for i := range lib.Templates {
+		rt := &lib.Templates[i]
+		if rt.Name == "" {
+			return nil, fmt.Errorf("template %d: name must be set", i)
+		}
+		if _, ok := lib.templates[rt.Name]; ok {
+			return nil, fmt.Errorf("template %q is defined more than once", rt.Name)
+		}
+
+		rt.scalars = map[*yaml.Node]*template.Template{}
+		if err := rt.parse(&rt.Rules); err != nil {
+			return nil, fmt.Errorf("template %q: failed to parse rules: %w", rt.Name, err)
+		}
+
+		lib.templates[rt.Name] = rt
+	}
+
+	return lib, nil
+}
+
+// parse parses the templates of the scalars of the node with placeholders.
+func (rt *Template) parse(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && strings.Contains(node.Value, "[[") {
+		tmpl, err := template.New(rt.Name).Delims("[[", "]]").Option("missingkey=error").Parse(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		rt.scalars[node] = tmpl
+	}
+
+	for _, child := range node.Content {
+		if err := rt.parse(child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// render returns a copy of the node with its scalars rendered with the parameters, as strings.
+func (rt *Template) render(node *yaml.Node, params map[string]string) (*yaml.Node, error) {
+	rendered := *node
+	if tmpl, ok := rt.scalars[node]; ok {
+		var value strings.Builder
+		if err := tmpl.Execute(&value, params); err != nil {
+			return nil, err
+		}
+		rendered.Value, rendered.Tag, rendered.Style = value.String(), "!!str", 0
+	}
+
+	if node.Alias != nil {
+		alias, err := rt.render(node.Alias, params)
+		if err != nil {
+			return nil, err
+		}
+		rendered.Alias = alias
+	}
+
+	rendered.Content = make([]*yaml.Node, 0, len(node.Content))
+	for _, child := range node.Content {
+		c, err := rt.render(child, params)
+		if err != nil {
+			return nil, err
+		}
+		rendered.Content = append(rendered.Content, c)
+	}
+
+	return &rendered, nil
+}
+
+// expand returns the rules of the referenced template, rendered with the parameters of the reference.
+func (l *Library) expand(ref rules.LibraryReference) ([]rulefmt.RuleNode, error) {
+	rt, ok := l.templates[ref.Template]
+	if !ok {
+		return nil, fmt.Errorf("unknown template %q", ref.Template)
+	}
+
+	var missing []string
+	for _, param := range rt.Params {
+		if _, ok := ref.Params[param]; !ok {
+			missing = append(missing, param)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("template %q: missing parameters: %v", ref.Template, missing)
+	}
+
+	var unknown []string
+	for param := range ref.Params {
+		if !slices.Contains(rt.Params, param) {
+			unknown = append(unknown, param)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("template %q: unknown parameters: %v", ref.Template, unknown)
+	}
+
+	rendered, err := rt.render(&rt.Rules, ref.Params)
+	if err != nil {
+		return nil, fmt.Errorf("template %q: failed to render rules: %w", ref.Template, err)
+	}
+
+	var renderedRules []rulefmt.RuleNode
+	if err := rendered.Decode(&renderedRules); err != nil {
+		return nil, fmt.Errorf("template %q: failed to unmarshal rendered rules: %w", ref.Template, err)
+	}
+
+	// Validate the rendered rules the same way tenants' rules are.
+	content, err := yaml.Marshal(rulefmt.RuleGroups{Groups: []rulefmt.RuleGroup{{Name: ref.Template, Rules: renderedRules}}})
+	if err != nil {
+		return nil, fmt.Errorf("template %q: failed to marshal rendered rules: %w", ref.Template, err)
+	}
+
+	parsed, errs := rulefmt.Parse(content)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("template %q: invalid rendered rules: %w", ref.Template, errors.Join(errs...))
+	}
+
+	return parsed.Groups[0].Rules, nil
+}
@@ -0,0 +1,197 @@
+package merge
+
+import (
+	"context"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/stretchr/testify/assert"
+)
+
+var ruleLibraryContent = `
+templates:
+- name: availability
+  params: [service, threshold]
+  rules:
+  - alert: '[[ .service ]]Unavailable'
+    expr: avg(up{job="[[ .service ]]"}) < [[ .threshold ]]
+    for: 5m
+    annotations:
+      summary: '{{ $value }} of [[ .service ]] instances are up.'
+`
+
+func TestRuleLibrary(t *testing.T) {
+	testCases := map[string]struct {
+		ref         rules.LibraryReference
+		expectErr   bool
+		expectAlert string
+		expectExpr  string
+	}{
+		"parameters are rendered": {
+			ref: rules.LibraryReference{
+				Template: "availability",
+				Params:   map[string]string{"service": "api", "threshold": "0.5"},
+			},
+			expectAlert: "apiUnavailable",
+			expectExpr:  `avg(up{job="api"}) < 0.5`,
+		},
+		"unknown template": {
+			ref:       rules.LibraryReference{Template: "latency"},
+			expectErr: true,
+		},
+		"missing parameters": {
+			ref: rules.LibraryReference{
+				Template: "availability",
+				Params:   map[string]string{"service": "api"},
+			},
+			expectErr: true,
+		},
+		"unknown parameters": {
+			ref: rules.LibraryReference{
+				Template: "availability",
+				Params:   map[string]string{"service": "api", "threshold": "0.5", "for": "1m"},
+			},
+			expectErr: true,
+		},
+		"invalid rendered rules": {
+			ref: rules.LibraryReference{
+				Template: "availability",
+				Params:   map[string]string{"service": "api", "threshold": "("},
+			},
+			expectErr: true,
+		},
+	}
+
+	lib, err := ParseLibrary([]byte(ruleLibraryContent))
+	assert.NoError(t, err)
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rules, err := lib.expand(tc.ref)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, rules, 1)
+			assert.Equal(t, tc.expectAlert, rules[0].Alert.Value)
+			assert.Equal(t, tc.expectExpr, rules[0].Expr.Value)
+			assert.Equal(t, "{{ $value }} of api instances are up.", rules[0].Annotations["summary"])
+		})
+	}
+}
+
+func TestRuleLibraryParamsEscaping(t *testing.T) {
+	lib, err := ParseLibrary([]byte(`
+templates:
+- name: down
+  params: [summary]
+  rules:
+  - alert: Down
+    expr: up == 0
+    annotations:
+      summary: "[[ .summary ]]"
+`))
+	assert.NoError(t, err)
+
+	// The parameters are the values of the scalars, even with characters breaking or extending the YAML of the rules.
+	for _, summary := range []string{
+		`"quoted": value # not a comment`,
+		"first line\n    labels:\n      severity: none",
+		"'\n  - record: injected\n    expr: vector(1)\n'",
+	} {
+		expanded, err := lib.expand(rules.LibraryReference{Template: "down", Params: map[string]string{"summary": summary}})
+		assert.NoError(t, err)
+		assert.Len(t, expanded, 1)
+		assert.Equal(t, summary, expanded[0].Annotations["summary"])
+		assert.Empty(t, expanded[0].Labels)
+	}
+}
+
+func TestMergerLibraryReferences(t *testing.T) {
+	content := `
+groups:
+- name: tenant1.slo
+  library:
+    template: availability
+    params:
+      service: api
+      threshold: "0.5"
+  rules: []
+`
+
+	testCases := map[string]struct {
+		library   LibraryLoader
+		expectErr bool
+	}{
+		"references are expanded": {
+			library: func(_ context.Context) (*Library, error) {
+				return ParseLibrary([]byte(ruleLibraryContent))
+			},
+		},
+		"references without library fail": {
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m, err := New(nil, Config{DuplicateAlerts: DuplicateAlertsIgnore}, nil, tc.library)
+			assert.NoError(t, err)
+
+			data, err := m.Merge(context.Background(), []byte(content), "")
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			ruleGroups, errs := rules.Parse(data)
+			assert.Len(t, errs, 0)
+			assert.Len(t, ruleGroups.Groups, 1)
+			assert.Nil(t, ruleGroups.Groups[0].Library)
+			assert.Len(t, ruleGroups.Groups[0].Rules, 1)
+		})
+	}
+}
+
+func TestMergerValidate(t *testing.T) {
+	testCases := map[string]struct {
+		content string
+		library LibraryLoader
+
+		expectErr string
+	}{
+		"valid rules": {
+			content: "groups:\n- name: alerts\n  rules:\n  - alert: Down\n    expr: up == 0\n",
+		},
+		"invalid rules": {
+			content:   "groups:\n- name: alerts\n  rules:\n  - alert: Down\n    expr: up ==\n",
+			expectErr: "alerts",
+		},
+		"references are expanded": {
+			content: "groups:\n- name: slo\n  library:\n    template: availability\n    params:\n      service: api\n      threshold: \"0.5\"\n  rules: []\n",
+			library: func(_ context.Context) (*Library, error) {
+				return ParseLibrary([]byte(ruleLibraryContent))
+			},
+		},
+		"references without library fail": {
+			content:   "groups:\n- name: slo\n  library:\n    template: availability\n  rules: []\n",
+			expectErr: `group "slo" references template "availability" but no rule library is configured`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m, err := New(nil, Config{DuplicateAlerts: DuplicateAlertsIgnore}, nil, tc.library)
+			assert.NoError(t, err)
+
+			err = m.Validate(context.Background(), []byte(tc.content))
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
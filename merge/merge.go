@@ -0,0 +1,467 @@
+// Package merge post-processes the rules of tenants merged into a single document, enforcing the policies of operators.
+package merge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Policies applied to alerts with the same name defined by several tenants.
+const (
+	DuplicateAlertsIgnore = "ignore"
+	DuplicateAlertsWarn   = "warn"
+	DuplicateAlertsLabel  = "label"
+	DuplicateAlertsRename = "rename"
+)
+
+// Config configures a Merger.
+type Config struct {
+	// DuplicateAlerts is the policy for alerts with the same name defined by several tenants.
+	DuplicateAlerts string
+	// DuplicateAlertsLabel is the label set to the tenant on duplicate alerts with the DuplicateAlertsLabel policy.
+	DuplicateAlertsLabel string
+	// PartialResponseStrategy is the strategy set on groups not selected by the policy. If empty, the one of tenants is kept.
+	PartialResponseStrategy string
+	// SLODir is a directory with one sub-directory of Sloth SLO specs per tenant to generate rules from.
+	SLODir string
+	// TenantLabel is the label set to the owning tenant on all rules, e.g. so that a stateless ruler remote writing
+	// to a Thanos Receive splitting tenants by this label writes the evaluated series to the tenant. If empty, it is not set.
+	TenantLabel string
+	// SourceTenants sets the source tenants of all groups to the owning tenant, so that a multi-tenant ruler
+	// only queries the data of the tenant to evaluate its rules.
+	SourceTenants bool
+	// ReservedLabels are the labels tenants must not set, in the labels of their rules or with label_replace or
+	// label_join in their expressions, e.g. a label routing the alerts to tenants.
+	ReservedLabels []string
+	// ReservedMetricNames is a regular expression of the metric names recording rules must not record, e.g. the ones
+	// of scraped metrics. If empty, the names of recording rules aren't checked.
+	ReservedMetricNames string
+	// ReservedLabelsPolicy handles the rules setting reserved labels or recording reserved metric names.
+	// If empty, it is ReservedLabelsStrip.
+	ReservedLabelsPolicy string
+	// RecordNameAllow is a regular expression the names of the recording rules of tenants must match, e.g.
+	// "{tenant}:.+", TenantPlaceholder being replaced with the owning tenant. If empty, all names are allowed.
+	RecordNameAllow string
+	// RecordNameDeny is a regular expression the names of the recording rules of tenants must not match,
+	// TenantPlaceholder being replaced with the owning tenant. If empty, no name is denied.
+	RecordNameDeny string
+	// RecordNamePrefix is prepended to the recording rule names not following the patterns with RecordNamesRewrite,
+	// e.g. "{tenant}:", TenantPlaceholder being replaced with the owning tenant.
+	RecordNamePrefix string
+	// RecordNamePolicy handles the recording rules whose names don't follow the patterns. If empty, it is RecordNamesWarn.
+	RecordNamePolicy string
+}
+
+// Merger post-processes the rules of tenants merged into a single document.
+type Merger struct {
+	duplicateAlertsPolicy   string
+	duplicateAlertsLabel    string
+	partialResponseStrategy string
+	policy                  atomic.Pointer[Policy]
+	tenantLabels            atomic.Pointer[map[string]map[string]string]
+	library                 LibraryLoader
+	sloDir                  string
+	tenantLabel             string
+	sourceTenants           bool
+	shadow                  *shadowTenants
+	reserved                *reservedLabels
+	recordNames             *recordNames
+
+	duplicateAlerts prometheus.Gauge
+}
+
+// New creates a new Merger. The policy and the library are optional.
+func New(r prometheus.Registerer, cfg Config, p *Policy, library LibraryLoader) (*Merger, error) {
+	switch cfg.DuplicateAlerts {
+	case DuplicateAlertsIgnore, DuplicateAlertsWarn, DuplicateAlertsLabel, DuplicateAlertsRename:
+	default:
+		return nil, fmt.Errorf("unknown duplicate alerts policy %q", cfg.DuplicateAlerts)
+	}
+
+	if err := rules.ValidatePartialResponseStrategy(cfg.PartialResponseStrategy); err != nil {
+		return nil, err
+	}
+
+	if cfg.TenantLabel != "" && !model.LabelName(cfg.TenantLabel).IsValid() {
+		return nil, fmt.Errorf("invalid tenant label name %q", cfg.TenantLabel)
+	}
+
+	reserved, err := newReservedLabels(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	recordNames, err := newRecordNames(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Merger{
+		duplicateAlertsPolicy:   cfg.DuplicateAlerts,
+		duplicateAlertsLabel:    cfg.DuplicateAlertsLabel,
+		partialResponseStrategy: cfg.PartialResponseStrategy,
+		library:                 library,
+		sloDir:                  cfg.SLODir,
+		tenantLabel:             cfg.TenantLabel,
+		sourceTenants:           cfg.SourceTenants,
+		shadow:                  newShadowTenants(),
+		reserved:                reserved,
+		recordNames:             recordNames,
+		duplicateAlerts: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_duplicate_alerts",
+			Help: "Number of alert names defined by more than one tenant in the last synced rules.",
+		}),
+	}
+
+	m.policy.Store(p)
+
+	if r != nil {
+		r.MustRegister(m.duplicateAlerts, m.shadow.groups, m.shadow.rules, m.reserved.violations,
+			m.recordNames.violations, m.recordNames.collisions)
+	}
+
+	return m, nil
+}
+
+// SetPolicy replaces the policy enforced from the next merge on, e.g. after the policy file changed.
+func (m *Merger) SetPolicy(p *Policy) {
+	m.policy.Store(p)
+}
+
+// SetTenantLabels replaces the labels set on all the rules of each tenant from the next merge on,
+// e.g. the labels of the organization of the tenant.
+func (m *Merger) SetTenantLabels(labels map[string]map[string]string) {
+	m.tenantLabels.Store(&labels)
+}
+
+// SetShadowTenants replaces the shadow tenants from the next merge on. The rule groups of shadow tenants are validated
+// and reported, with metrics and logs of their changes, but removed from the merged rules.
+func (m *Merger) SetShadowTenants(tenants []string) {
+	m.shadow.set(tenants)
+}
+
+// Fetcher wraps the given fetcher so that the rules it returns are post-processed by the Merger.
+// If tenant is empty, the rules are expected to come from several tenants and group names to be prefixed
+// with the name of the tenant owning them, as done by the rules-objstore and RulesObjstoreFetcher.GetTenantsRules.
+func (m *Merger) Fetcher(next fetch.Fetcher, tenant string) fetch.Fetcher {
+	return fetch.FetcherFunc(func(ctx context.Context) (io.ReadCloser, error) {
+		fetched, err := next.GetRules(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer fetched.Close()
+
+		body, err := io.ReadAll(fetched)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rules: %w", err)
+		}
+
+		merged, err := m.Merge(ctx, body, tenant)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.NopCloser(bytes.NewReader(merged)), nil
+	})
+}
+
+// Merge parses a merged rules document and applies the configured policies to it.
+// See Fetcher for the meaning of tenant.
+func (m *Merger) Merge(ctx context.Context, body []byte, tenant string) ([]byte, error) {
+	rulesParsed, errs := rules.Parse(body)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if err := m.expandLibraryReferences(ctx, rulesParsed.Groups); err != nil {
+		return nil, err
+	}
+
+	if m.sloDir != "" {
+		sloGroups, err := readSLODir(m.sloDir, tenant)
+		if err != nil {
+			return nil, err
+		}
+
+		rulesParsed.Groups, err = appendGroups(rulesParsed.Groups, sloGroups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	groupTenant := GroupTenantFunc(tenant)
+	rulesParsed.Groups = m.shadow.separate(rulesParsed.Groups, groupTenant)
+	// Reserved labels are enforced before the tenant label is set, which may be one of them.
+	if err := m.reserved.enforce(rulesParsed.Groups, groupTenant); err != nil {
+		return nil, err
+	}
+	if err := m.recordNames.enforce(rulesParsed.Groups, groupTenant); err != nil {
+		return nil, err
+	}
+	m.handleDuplicateAlerts(rulesParsed.Groups, groupTenant)
+	m.setPartialResponseStrategy(rulesParsed.Groups, groupTenant)
+	m.setInterval(rulesParsed.Groups, groupTenant)
+	m.setTenantLabels(rulesParsed.Groups, groupTenant)
+	m.setTenantLabel(rulesParsed.Groups, groupTenant)
+	m.setSourceTenants(rulesParsed.Groups, groupTenant)
+
+	returnData, err := yaml.Marshal(rulesParsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	return returnData, nil
+}
+
+// Validate checks the rules of a single tenant like Merge, without applying nor reporting the policies, e.g. to give
+// feedback on the rules of a tenant before they are synced: the rules must be valid, and the templates of the rule library
+// they reference must exist and expand.
+func (m *Merger) Validate(ctx context.Context, body []byte) error {
+	rulesParsed, errs := rules.Parse(body)
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	return m.expandLibraryReferences(ctx, rulesParsed.Groups)
+}
+
+// expandLibraryReferences appends the rules of the library templates referenced by groups to their rules.
+// The library is only loaded if at least one group references it.
+func (m *Merger) expandLibraryReferences(ctx context.Context, groups []rules.RuleGroup) error {
+	var lib *Library
+	for i, group := range groups {
+		if group.Library == nil {
+			continue
+		}
+
+		if lib == nil {
+			if m.library == nil {
+				return fmt.Errorf("group %q references template %q but no rule library is configured", group.Name, group.Library.Template)
+			}
+
+			var err error
+			lib, err = m.library(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to load rule library: %w", err)
+			}
+		}
+
+		rules, err := lib.expand(*group.Library)
+		if err != nil {
+			return fmt.Errorf("group %q: %w", group.Name, err)
+		}
+
+		groups[i].Rules = append(groups[i].Rules, rules...)
+		groups[i].Library = nil
+	}
+
+	return nil
+}
+
+// appendGroups appends generated groups to the fetched ones, failing if the name of a group is repeated.
+func appendGroups(groups, generated []rules.RuleGroup) ([]rules.RuleGroup, error) {
+	names := make(map[string]struct{}, len(groups))
+	for _, group := range groups {
+		names[group.Name] = struct{}{}
+	}
+
+	for _, group := range generated {
+		if _, ok := names[group.Name]; ok {
+			return nil, fmt.Errorf("generated group %q conflicts with an existing group", group.Name)
+		}
+		names[group.Name] = struct{}{}
+	}
+
+	return append(groups, generated...), nil
+}
+
+// handleDuplicateAlerts finds alerts with the same name defined by different tenants
+// and reports or disambiguates them according to the duplicate alerts policy.
+func (m *Merger) handleDuplicateAlerts(groups []rules.RuleGroup, groupTenant func(string) string) {
+	if m.duplicateAlertsPolicy == DuplicateAlertsIgnore {
+		return
+	}
+
+	duplicates := findDuplicateAlerts(groups, groupTenant)
+	m.duplicateAlerts.Set(float64(len(duplicates)))
+
+	names := make([]string, 0, len(duplicates))
+	for name := range duplicates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		log.Printf("alert %q is defined by multiple tenants: %v", name, duplicates[name])
+	}
+
+	if m.duplicateAlertsPolicy == DuplicateAlertsWarn || len(duplicates) == 0 {
+		return
+	}
+
+	for i, group := range groups {
+		tenant := groupTenant(group.Name)
+		for j, rule := range group.Rules {
+			if _, ok := duplicates[rule.Alert.Value]; !ok {
+				continue
+			}
+
+			switch m.duplicateAlertsPolicy {
+			case DuplicateAlertsLabel:
+				if rule.Labels == nil {
+					groups[i].Rules[j].Labels = map[string]string{}
+				}
+				groups[i].Rules[j].Labels[m.duplicateAlertsLabel] = tenant
+			case DuplicateAlertsRename:
+				groups[i].Rules[j].Alert.Value = tenant + "." + rule.Alert.Value
+			}
+		}
+	}
+}
+
+// findDuplicateAlerts returns the alert names defined by more than one tenant,
+// along with the sorted list of tenants defining each of them.
+func findDuplicateAlerts(groups []rules.RuleGroup, groupTenant func(string) string) map[string][]string {
+	alertTenants := make(map[string]map[string]struct{})
+	for _, group := range groups {
+		tenant := groupTenant(group.Name)
+		for _, rule := range group.Rules {
+			if rule.Alert.Value == "" {
+				continue
+			}
+			if _, ok := alertTenants[rule.Alert.Value]; !ok {
+				alertTenants[rule.Alert.Value] = make(map[string]struct{})
+			}
+			alertTenants[rule.Alert.Value][tenant] = struct{}{}
+		}
+	}
+
+	duplicates := make(map[string][]string)
+	for name, tenantsSet := range alertTenants {
+		if len(tenantsSet) < 2 {
+			continue
+		}
+
+		tenants := make([]string, 0, len(tenantsSet))
+		for tenant := range tenantsSet {
+			tenants = append(tenants, tenant)
+		}
+		sort.Strings(tenants)
+		duplicates[name] = tenants
+	}
+
+	return duplicates
+}
+
+// setPartialResponseStrategy enforces the partial response strategy of the groups selected by the policy,
+// or the default one if set, regardless of the strategy set by tenants.
+func (m *Merger) setPartialResponseStrategy(groups []rules.RuleGroup, groupTenant func(string) string) {
+	for i, group := range groups {
+		if strategy, ok := m.policy.Load().partialResponseStrategy(groupTenant(group.Name), group.RuleGroup); ok {
+			groups[i].PartialResponseStrategy = strategy
+			continue
+		}
+
+		if m.partialResponseStrategy != "" {
+			groups[i].PartialResponseStrategy = m.partialResponseStrategy
+		}
+	}
+}
+
+// setInterval enforces the evaluation interval of the groups selected by the policy, regardless of the interval set
+// by tenants.
+func (m *Merger) setInterval(groups []rules.RuleGroup, groupTenant func(string) string) {
+	for i, group := range groups {
+		if interval, ok := m.policy.Load().interval(groupTenant(group.Name), group.RuleGroup); ok {
+			groups[i].Interval = interval
+		}
+	}
+}
+
+// setTenantLabel sets the tenant label to the owning tenant on all rules, overriding the value set by tenants.
+func (m *Merger) setTenantLabel(groups []rules.RuleGroup, groupTenant func(string) string) {
+	if m.tenantLabel == "" {
+		return
+	}
+
+	for i, group := range groups {
+		tenant := groupTenant(group.Name)
+		for j, rule := range group.Rules {
+			if value, ok := rule.Labels[m.tenantLabel]; ok && value != tenant {
+				log.Printf("group %q: overriding label %s=%q of a rule with the owning tenant %q", group.Name, m.tenantLabel, value, tenant)
+			}
+			if rule.Labels == nil {
+				groups[i].Rules[j].Labels = map[string]string{}
+			}
+			groups[i].Rules[j].Labels[m.tenantLabel] = tenant
+		}
+	}
+}
+
+// setTenantLabels sets the labels of each tenant on all its rules, overriding the labels set by the tenant.
+func (m *Merger) setTenantLabels(groups []rules.RuleGroup, groupTenant func(string) string) {
+	tenantLabels := m.tenantLabels.Load()
+	if tenantLabels == nil || len(*tenantLabels) == 0 {
+		return
+	}
+
+	for i, group := range groups {
+		labels := (*tenantLabels)[groupTenant(group.Name)]
+		if len(labels) == 0 {
+			continue
+		}
+		for j, rule := range group.Rules {
+			if rule.Labels == nil {
+				groups[i].Rules[j].Labels = map[string]string{}
+			}
+			for name, value := range labels {
+				if previous, ok := rule.Labels[name]; ok && previous != value {
+					log.Printf("group %q: overriding label %s=%q of a rule with the one of the tenant %q", group.Name, name, previous, value)
+				}
+				groups[i].Rules[j].Labels[name] = value
+			}
+		}
+	}
+}
+
+// setSourceTenants sets the source tenants of all groups to the owning tenant, overriding the ones set by tenants.
+func (m *Merger) setSourceTenants(groups []rules.RuleGroup, groupTenant func(string) string) {
+	if !m.sourceTenants {
+		return
+	}
+
+	for i, group := range groups {
+		tenant := groupTenant(group.Name)
+		if len(group.SourceTenants) > 0 && !slices.Equal(group.SourceTenants, []string{tenant}) {
+			log.Printf("group %q: overriding source tenants %v with the owning tenant %q", group.Name, group.SourceTenants, tenant)
+		}
+		groups[i].SourceTenants = []string{tenant}
+	}
+}
+
+// GroupTenantFunc returns a function giving the tenant owning a rule group.
+// If tenant is empty, the tenant is given by the prefix of the group name.
+func GroupTenantFunc(tenant string) func(groupName string) string {
+	if tenant != "" {
+		return func(string) string { return tenant }
+	}
+
+	return func(groupName string) string {
+		prefix, _, _ := strings.Cut(groupName, ".")
+		return prefix
+	}
+}
@@ -0,0 +1,461 @@
+package merge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/stretchr/testify/assert"
+)
+
+var mergedRuleGroups = `
+groups:
+- name: tenant1.test
+  rules:
+  - alert: TestAlert
+    expr: vector(1)
+  - alert: Tenant1Alert
+    expr: vector(1)
+- name: tenant2.test
+  rules:
+  - alert: TestAlert
+    expr: vector(1)
+  - record: TestRecord
+    expr: vector(1)
+`
+
+func TestMergerDuplicateAlerts(t *testing.T) {
+	testCases := map[string]struct {
+		policy           string
+		expectErr        bool
+		expectDuplicates float64
+		expectAlerts     []string
+		expectLabels     []map[string]string
+	}{
+		"unknown policy": {
+			policy:    "drop",
+			expectErr: true,
+		},
+		"warn keeps rules unchanged": {
+			policy:           DuplicateAlertsWarn,
+			expectDuplicates: 1,
+			expectAlerts:     []string{"TestAlert", "Tenant1Alert", "TestAlert", ""},
+			expectLabels:     []map[string]string{nil, nil, nil, nil},
+		},
+		"label adds the tenant to duplicates": {
+			policy:           DuplicateAlertsLabel,
+			expectDuplicates: 1,
+			expectAlerts:     []string{"TestAlert", "Tenant1Alert", "TestAlert", ""},
+			expectLabels: []map[string]string{
+				{"tenant": "tenant1"}, nil, {"tenant": "tenant2"}, nil,
+			},
+		},
+		"rename prefixes duplicates with the tenant": {
+			policy:           DuplicateAlertsRename,
+			expectDuplicates: 1,
+			expectAlerts:     []string{"tenant1.TestAlert", "Tenant1Alert", "tenant2.TestAlert", ""},
+			expectLabels:     []map[string]string{nil, nil, nil, nil},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m, err := New(nil, Config{DuplicateAlerts: tc.policy, DuplicateAlertsLabel: "tenant"}, nil, nil)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			data, err := m.Merge(context.Background(), []byte(mergedRuleGroups), "")
+			assert.NoError(t, err)
+
+			ruleGroups, errs := rulefmt.Parse(data)
+			assert.Len(t, errs, 0)
+
+			var alerts []string
+			var labels []map[string]string
+			for _, group := range ruleGroups.Groups {
+				for _, rule := range group.Rules {
+					alerts = append(alerts, rule.Alert.Value)
+					labels = append(labels, rule.Labels)
+				}
+			}
+
+			assert.Equal(t, tc.expectAlerts, alerts)
+			assert.Equal(t, tc.expectLabels, labels)
+			assert.Equal(t, tc.expectDuplicates, testutil.ToFloat64(m.duplicateAlerts))
+		})
+	}
+}
+
+func TestMergerPartialResponseStrategy(t *testing.T) {
+	testCases := map[string]struct {
+		defaultStrategy  string
+		policy           string
+		tenant           string
+		expectErr        bool
+		expectStrategies []string
+	}{
+		"unknown default strategy": {
+			defaultStrategy: "fail",
+			expectErr:       true,
+		},
+		"no strategy keeps groups unchanged": {
+			expectStrategies: []string{"", ""},
+		},
+		"default strategy applies to all groups": {
+			defaultStrategy:  rules.PartialResponseWarn,
+			expectStrategies: []string{rules.PartialResponseWarn, rules.PartialResponseWarn},
+		},
+		"policy overrides default strategy per tenant": {
+			defaultStrategy: rules.PartialResponseWarn,
+			policy: `
+partialResponseStrategy:
+- tenants: [tenant2]
+  strategy: abort
+`,
+			expectStrategies: []string{rules.PartialResponseWarn, rules.PartialResponseAbort},
+		},
+		"policy applies to single tenant rules": {
+			policy: `
+partialResponseStrategy:
+- tenants: [tenant1]
+  strategy: abort
+`,
+			tenant:           "tenant1",
+			expectStrategies: []string{rules.PartialResponseAbort, rules.PartialResponseAbort},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var p *Policy
+			if tc.policy != "" {
+				var err error
+				p, err = readPolicyConfig([]byte(tc.policy))
+				assert.NoError(t, err)
+			}
+
+			m, err := New(nil, Config{DuplicateAlerts: DuplicateAlertsIgnore, PartialResponseStrategy: tc.defaultStrategy}, p, nil)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			data, err := m.Merge(context.Background(), []byte(mergedRuleGroups), tc.tenant)
+			assert.NoError(t, err)
+
+			ruleGroups, errs := rules.Parse(data)
+			assert.Len(t, errs, 0)
+
+			var strategies []string
+			for _, group := range ruleGroups.Groups {
+				strategies = append(strategies, group.PartialResponseStrategy)
+			}
+			assert.Equal(t, tc.expectStrategies, strategies)
+		})
+	}
+}
+
+func TestMergerInterval(t *testing.T) {
+	const content = `
+groups:
+- name: tenant1.test
+  interval: 30s
+  rules:
+  - alert: TestAlert
+    expr: vector(1)
+    labels:
+      criticality: low
+- name: tenant2.test
+  interval: 1m
+  rules:
+  - alert: TestAlert
+    expr: vector(1)
+- name: tenant3.test
+  rules:
+  - alert: TestAlert
+    expr: vector(1)
+`
+
+	testCases := map[string]struct {
+		policy          string
+		expectIntervals []model.Duration
+	}{
+		"no policy keeps intervals of tenants": {
+			expectIntervals: []model.Duration{model.Duration(30 * time.Second), model.Duration(time.Minute), 0},
+		},
+		"policy overrides intervals of tenants": {
+			policy: `
+interval:
+- tenants: [tenant2, tenant3]
+  interval: 5m
+`,
+			expectIntervals: []model.Duration{model.Duration(30 * time.Second), model.Duration(5 * time.Minute), model.Duration(5 * time.Minute)},
+		},
+		"first policy selecting a group applies": {
+			policy: `
+interval:
+- selector: '{criticality="low"}'
+  interval: 10m
+- interval: 2m
+`,
+			expectIntervals: []model.Duration{model.Duration(10 * time.Minute), model.Duration(2 * time.Minute), model.Duration(2 * time.Minute)},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var p *Policy
+			if tc.policy != "" {
+				var err error
+				p, err = readPolicyConfig([]byte(tc.policy))
+				assert.NoError(t, err)
+			}
+
+			m, err := New(nil, Config{DuplicateAlerts: DuplicateAlertsIgnore}, p, nil)
+			assert.NoError(t, err)
+
+			data, err := m.Merge(context.Background(), []byte(content), "")
+			assert.NoError(t, err)
+
+			ruleGroups, errs := rules.Parse(data)
+			assert.Len(t, errs, 0)
+
+			var intervals []model.Duration
+			for _, group := range ruleGroups.Groups {
+				intervals = append(intervals, group.Interval)
+			}
+			assert.Equal(t, tc.expectIntervals, intervals)
+		})
+	}
+}
+
+func TestMergerTenantLabel(t *testing.T) {
+	testCases := map[string]struct {
+		tenantLabel  string
+		tenantLabels map[string]map[string]string
+		tenant       string
+		content      string
+		expectErr    bool
+		expectLabels []map[string]string
+	}{
+		"invalid tenant label": {
+			tenantLabel: "tenant-id",
+			expectErr:   true,
+		},
+		"no tenant label keeps rules unchanged": {
+			content:      mergedRuleGroups,
+			expectLabels: []map[string]string{nil, nil, nil, nil},
+		},
+		"tenant label is set to the owning tenant": {
+			tenantLabel:  "tenant_id",
+			content:      mergedRuleGroups,
+			expectLabels: []map[string]string{{"tenant_id": "tenant1"}, {"tenant_id": "tenant1"}, {"tenant_id": "tenant2"}, {"tenant_id": "tenant2"}},
+		},
+		"tenant label is set to the single tenant": {
+			tenantLabel:  "tenant_id",
+			tenant:       "tenant3",
+			content:      mergedRuleGroups,
+			expectLabels: []map[string]string{{"tenant_id": "tenant3"}, {"tenant_id": "tenant3"}, {"tenant_id": "tenant3"}, {"tenant_id": "tenant3"}},
+		},
+		"tenant label set by tenants is overridden": {
+			tenantLabel: "tenant_id",
+			content: `
+groups:
+- name: tenant1.test
+  rules:
+  - record: TestRecord
+    expr: vector(1)
+    labels:
+      tenant_id: tenant2
+      team: a
+`,
+			expectLabels: []map[string]string{{"tenant_id": "tenant1", "team": "a"}},
+		},
+		"labels of tenants are set and override the labels set by tenants": {
+			tenantLabels: map[string]map[string]string{"tenant1": {"org": "acme", "team": "b"}},
+			content: `
+groups:
+- name: tenant1.test
+  rules:
+  - record: TestRecord
+    expr: vector(1)
+    labels:
+      team: a
+- name: tenant2.test
+  rules:
+  - record: TestRecord
+    expr: vector(1)
+`,
+			expectLabels: []map[string]string{{"org": "acme", "team": "b"}, nil},
+		},
+		"tenant label overrides the labels of tenants": {
+			tenantLabel:  "tenant_id",
+			tenantLabels: map[string]map[string]string{"tenant1": {"tenant_id": "acme"}},
+			content: `
+groups:
+- name: tenant1.test
+  rules:
+  - record: TestRecord
+    expr: vector(1)
+`,
+			expectLabels: []map[string]string{{"tenant_id": "tenant1"}},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m, err := New(nil, Config{DuplicateAlerts: DuplicateAlertsIgnore, TenantLabel: tc.tenantLabel}, nil, nil)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			m.SetTenantLabels(tc.tenantLabels)
+
+			data, err := m.Merge(context.Background(), []byte(tc.content), tc.tenant)
+			assert.NoError(t, err)
+
+			ruleGroups, errs := rules.Parse(data)
+			assert.Len(t, errs, 0)
+
+			var labels []map[string]string
+			for _, group := range ruleGroups.Groups {
+				for _, rule := range group.Rules {
+					labels = append(labels, rule.Labels)
+				}
+			}
+			assert.Equal(t, tc.expectLabels, labels)
+		})
+	}
+}
+
+func TestMergerShadowTenants(t *testing.T) {
+	testCases := map[string]struct {
+		shadow []string
+		tenant string
+
+		expectGroups       []string
+		expectShadowGroups float64
+		expectShadowRules  float64
+	}{
+		"no shadow tenants": {
+			expectGroups: []string{"tenant1.test", "tenant2.test"},
+		},
+		"groups of shadow tenants are excluded": {
+			shadow:             []string{"tenant2"},
+			expectGroups:       []string{"tenant1.test"},
+			expectShadowGroups: 1,
+			expectShadowRules:  2,
+		},
+		"shadow tenants without rules are reported": {
+			shadow:       []string{"tenant3"},
+			expectGroups: []string{"tenant1.test", "tenant2.test"},
+		},
+		"single shadow tenant": {
+			shadow:             []string{"tenant3"},
+			tenant:             "tenant3",
+			expectShadowGroups: 2,
+			expectShadowRules:  4,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m, err := New(nil, Config{DuplicateAlerts: DuplicateAlertsWarn}, nil, nil)
+			assert.NoError(t, err)
+			m.SetShadowTenants(tc.shadow)
+
+			data, err := m.Merge(context.Background(), []byte(mergedRuleGroups), tc.tenant)
+			assert.NoError(t, err)
+
+			ruleGroups, errs := rules.Parse(data)
+			assert.Len(t, errs, 0)
+
+			var groups []string
+			for _, group := range ruleGroups.Groups {
+				groups = append(groups, group.Name)
+			}
+			assert.Equal(t, tc.expectGroups, groups)
+			// Alerts of shadow tenants don't count as duplicates.
+			assert.Equal(t, float64(len(tc.expectGroups)/2), testutil.ToFloat64(m.duplicateAlerts))
+
+			assert.Equal(t, len(tc.shadow), testutil.CollectAndCount(m.shadow.groups))
+			for _, tenant := range tc.shadow {
+				assert.Equal(t, tc.expectShadowGroups, testutil.ToFloat64(m.shadow.groups.WithLabelValues(tenant)))
+				assert.Equal(t, tc.expectShadowRules, testutil.ToFloat64(m.shadow.rules.WithLabelValues(tenant)))
+			}
+		})
+	}
+}
+
+func TestMergerSourceTenants(t *testing.T) {
+	testCases := map[string]struct {
+		sourceTenants bool
+		tenant        string
+		content       string
+
+		expectSourceTenants [][]string
+	}{
+		"source tenants are kept when disabled": {
+			content: `
+groups:
+- name: tenant1.test
+  source_tenants: [tenant2]
+  rules:
+  - record: TestRecord
+    expr: vector(1)
+`,
+			expectSourceTenants: [][]string{{"tenant2"}},
+		},
+		"source tenants are set to the owning tenant": {
+			sourceTenants:       true,
+			content:             mergedRuleGroups,
+			expectSourceTenants: [][]string{{"tenant1"}, {"tenant2"}},
+		},
+		"source tenants are set to the single tenant": {
+			sourceTenants:       true,
+			tenant:              "tenant3",
+			content:             mergedRuleGroups,
+			expectSourceTenants: [][]string{{"tenant3"}, {"tenant3"}},
+		},
+		"source tenants set by tenants are overridden": {
+			sourceTenants: true,
+			content: `
+groups:
+- name: tenant1.test
+  source_tenants: [tenant1, tenant2]
+  rules:
+  - record: TestRecord
+    expr: vector(1)
+`,
+			expectSourceTenants: [][]string{{"tenant1"}},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m, err := New(nil, Config{DuplicateAlerts: DuplicateAlertsIgnore, SourceTenants: tc.sourceTenants}, nil, nil)
+			assert.NoError(t, err)
+
+			data, err := m.Merge(context.Background(), []byte(tc.content), tc.tenant)
+			assert.NoError(t, err)
+
+			ruleGroups, errs := rules.Parse(data)
+			assert.Len(t, errs, 0)
+
+			var sourceTenants [][]string
+			for _, group := range ruleGroups.Groups {
+				sourceTenants = append(sourceTenants, group.SourceTenants)
+			}
+			assert.Equal(t, tc.expectSourceTenants, sourceTenants)
+		})
+	}
+}
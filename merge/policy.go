@@ -0,0 +1,176 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// Policy holds the settings operators enforce on the rules of tenants when merging them.
+type Policy struct {
+	PartialResponseStrategy []PartialResponseStrategyPolicy `yaml:"partialResponseStrategy"`
+	Interval                []IntervalPolicy                `yaml:"interval"`
+}
+
+// PartialResponseStrategyPolicy sets the partial response strategy of the groups it selects.
+type PartialResponseStrategyPolicy struct {
+	GroupSelector `yaml:",inline"`
+	Strategy      string `yaml:"strategy"`
+}
+
+// IntervalPolicy sets the evaluation interval of the groups it selects, overriding the one set by tenants,
+// e.g. to bound the evaluation cost of tenants on a shared ruler.
+type IntervalPolicy struct {
+	GroupSelector `yaml:",inline"`
+	Interval      model.Duration `yaml:"interval"`
+}
+
+// GroupSelector selects rule groups by tenant and by labels.
+// Empty fields match every group.
+type GroupSelector struct {
+	Tenants []string `yaml:"tenants"`
+	// Selector is a PromQL series selector, e.g. {team="a"}, matched against the labels of the group.
+	Selector string `yaml:"selector"`
+
+	matchers []*labels.Matcher
+}
+
+// ReadPolicyFile reads and validates the policy file.
+func ReadPolicyFile(file string) (*Policy, error) {
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	return readPolicyConfig(f)
+}
+
+func readPolicyConfig(f []byte) (*Policy, error) {
+	p := &Policy{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(f))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(p); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal policy file: %w", err)
+	}
+
+	for i := range p.PartialResponseStrategy {
+		prs := &p.PartialResponseStrategy[i]
+		if prs.Strategy == "" {
+			return nil, fmt.Errorf("partialResponseStrategy %d: strategy must be set", i)
+		}
+		if err := rules.ValidatePartialResponseStrategy(prs.Strategy); err != nil {
+			return nil, fmt.Errorf("partialResponseStrategy %d: %w", i, err)
+		}
+		if err := prs.Compile(); err != nil {
+			return nil, fmt.Errorf("partialResponseStrategy %d: %w", i, err)
+		}
+	}
+
+	for i := range p.Interval {
+		ip := &p.Interval[i]
+		if ip.Interval <= 0 {
+			return nil, fmt.Errorf("interval %d: interval must be positive", i)
+		}
+		if err := ip.Compile(); err != nil {
+			return nil, fmt.Errorf("interval %d: %w", i, err)
+		}
+	}
+
+	return p, nil
+}
+
+// interval returns the evaluation interval of the first policy selecting the group.
+func (p *Policy) interval(tenant string, group rulefmt.RuleGroup) (model.Duration, bool) {
+	if p == nil {
+		return 0, false
+	}
+
+	for _, ip := range p.Interval {
+		if ip.Matches(tenant, group) {
+			return ip.Interval, true
+		}
+	}
+
+	return 0, false
+}
+
+// partialResponseStrategy returns the partial response strategy of the first policy selecting the group.
+func (p *Policy) partialResponseStrategy(tenant string, group rulefmt.RuleGroup) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+
+	for _, prs := range p.PartialResponseStrategy {
+		if prs.Matches(tenant, group) {
+			return prs.Strategy, true
+		}
+	}
+
+	return "", false
+}
+
+// Compile parses the selector. It must be called before matching groups.
+func (s *GroupSelector) Compile() error {
+	if s.Selector == "" {
+		return nil
+	}
+
+	matchers, err := parser.ParseMetricSelector(s.Selector)
+	if err != nil {
+		return fmt.Errorf("failed to parse selector %q: %w", s.Selector, err)
+	}
+	s.matchers = matchers
+
+	return nil
+}
+
+// Matches returns whether the group owned by the tenant is selected.
+func (s *GroupSelector) Matches(tenant string, group rulefmt.RuleGroup) bool {
+	if len(s.Tenants) > 0 && !slices.Contains(s.Tenants, tenant) {
+		return false
+	}
+
+	if len(s.matchers) == 0 {
+		return true
+	}
+
+	groupLbls := groupLabels(group)
+	for _, m := range s.matchers {
+		if !m.Matches(groupLbls[m.Name]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// groupLabels returns the labels of a rule group, that is the labels shared by all of its rules.
+func groupLabels(group rulefmt.RuleGroup) map[string]string {
+	if len(group.Rules) == 0 {
+		return map[string]string{}
+	}
+
+	lbls := make(map[string]string, len(group.Rules[0].Labels))
+	for name, value := range group.Rules[0].Labels {
+		lbls[name] = value
+	}
+
+	for _, rule := range group.Rules[1:] {
+		for name, value := range lbls {
+			if rule.Labels[name] != value {
+				delete(lbls, name)
+			}
+		}
+	}
+
+	return lbls
+}
@@ -0,0 +1,141 @@
+package merge
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestPolicyConfig(t *testing.T) {
+	testCases := map[string]struct {
+		fileContent string
+		expectErr   bool
+	}{
+		"empty file": {
+			fileContent: "",
+			expectErr:   true,
+		},
+		"valid policy": {
+			fileContent: `
+partialResponseStrategy:
+- tenants: [tenant1]
+  selector: '{team="a"}'
+  strategy: abort
+- strategy: warn
+`,
+		},
+		"valid interval policy": {
+			fileContent: `
+interval:
+- tenants: [tenant1]
+  interval: 5m
+- selector: '{criticality="low"}'
+  interval: 10m
+`,
+		},
+		"missing interval": {
+			fileContent: `
+interval:
+- tenants: [tenant1]
+`,
+			expectErr: true,
+		},
+		"invalid interval": {
+			fileContent: `
+interval:
+- interval: 5 minutes
+`,
+			expectErr: true,
+		},
+		"unknown field": {
+			fileContent: `
+partialResponse: []
+`,
+			expectErr: true,
+		},
+		"missing strategy": {
+			fileContent: `
+partialResponseStrategy:
+- tenants: [tenant1]
+`,
+			expectErr: true,
+		},
+		"invalid selector": {
+			fileContent: `
+partialResponseStrategy:
+- selector: '{team=}'
+  strategy: abort
+`,
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := readPolicyConfig([]byte(tc.fileContent))
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestGroupSelector(t *testing.T) {
+	group := rulefmt.RuleGroup{
+		Name: "test",
+		Rules: []rulefmt.RuleNode{
+			{
+				Alert:  yaml.Node{Kind: yaml.ScalarNode, Value: "Alert1"},
+				Labels: map[string]string{"team": "a", "severity": "critical"},
+			},
+			{
+				Alert:  yaml.Node{Kind: yaml.ScalarNode, Value: "Alert2"},
+				Labels: map[string]string{"team": "a", "severity": "warning"},
+			},
+		},
+	}
+
+	testCases := map[string]struct {
+		selector    GroupSelector
+		tenant      string
+		expectMatch bool
+	}{
+		"empty selector matches": {
+			tenant:      "tenant1",
+			expectMatch: true,
+		},
+		"tenant matches": {
+			selector:    GroupSelector{Tenants: []string{"tenant1", "tenant2"}},
+			tenant:      "tenant1",
+			expectMatch: true,
+		},
+		"tenant doesn't match": {
+			selector: GroupSelector{Tenants: []string{"tenant2"}},
+			tenant:   "tenant1",
+		},
+		"label shared by all rules matches": {
+			selector:    GroupSelector{Selector: `{team="a"}`},
+			tenant:      "tenant1",
+			expectMatch: true,
+		},
+		"label not shared by all rules doesn't match": {
+			selector: GroupSelector{Selector: `{severity="critical"}`},
+			tenant:   "tenant1",
+		},
+		"tenant and label must both match": {
+			selector: GroupSelector{Tenants: []string{"tenant2"}, Selector: `{team="a"}`},
+			tenant:   "tenant1",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, tc.selector.Compile())
+			assert.Equal(t, tc.expectMatch, tc.selector.Matches(tc.tenant, group))
+		})
+	}
+}
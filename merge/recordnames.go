@@ -0,0 +1,276 @@
+package merge
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Policies applied to recording rules whose names don't follow the patterns.
+const (
+	// RecordNamesWarn only reports the rules.
+	RecordNamesWarn = "warn"
+	// RecordNamesReject fails the sync, so that the ruler keeps its rules.
+	RecordNamesReject = "reject"
+	// RecordNamesRewrite prefixes the names with the prefix, renaming the metric in the expressions of the tenant too.
+	RecordNamesRewrite = "rewrite"
+)
+
+// TenantPlaceholder is replaced with the owning tenant in the patterns and the prefix of recording rule names,
+// its characters invalid in metric names being replaced with underscores.
+const TenantPlaceholder = "{tenant}"
+
+var invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// recordNames checks the names recording rules of tenants record, so that the series recorded by a tenant don't
+// collide with the ones of another tenant in a shared TSDB, where they would silently merge.
+type recordNames struct {
+	allow, deny string
+	prefix      string
+	policy      string
+
+	violations *prometheus.GaugeVec
+	collisions prometheus.Gauge
+}
+
+func newRecordNames(cfg Config) (*recordNames, error) {
+	r := &recordNames{
+		allow:  cfg.RecordNameAllow,
+		deny:   cfg.RecordNameDeny,
+		prefix: cfg.RecordNamePrefix,
+		policy: cfg.RecordNamePolicy,
+		violations: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_record_name_violations",
+			Help: "Number of recording rules of tenants whose names don't follow the patterns in the last synced rules, by tenant.",
+		}, []string{"tenant"}),
+		collisions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_record_name_collisions",
+			Help: "Number of metric names recorded by more than one tenant in the last synced rules.",
+		}),
+	}
+
+	switch r.policy {
+	case "":
+		r.policy = RecordNamesWarn
+	case RecordNamesWarn, RecordNamesReject:
+	case RecordNamesRewrite:
+		if r.prefix == "" {
+			return nil, fmt.Errorf("the %s record names policy requires a prefix", RecordNamesRewrite)
+		}
+	default:
+		return nil, fmt.Errorf("unknown record names policy %q", r.policy)
+	}
+
+	// The patterns are checked with a tenant, as they are compiled for each tenant.
+	for _, pattern := range []string{r.allow, r.deny} {
+		if _, err := r.compile(pattern, "tenant"); err != nil {
+			return nil, err
+		}
+	}
+	if r.prefix != "" && !model.IsValidMetricName(model.LabelValue(r.name(r.prefix, "tenant"))) {
+		return nil, fmt.Errorf("invalid record name prefix %q", r.prefix)
+	}
+
+	return r, nil
+}
+
+// name replaces the placeholder of the template with the tenant.
+func (r *recordNames) name(template, tenant string) string {
+	return strings.ReplaceAll(template, TenantPlaceholder, invalidMetricNameChars.ReplaceAllString(tenant, "_"))
+}
+
+// compile compiles the anchored pattern of the tenant, nil if it is empty.
+func (r *recordNames) compile(pattern, tenant string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile("^(?:" + strings.ReplaceAll(pattern, TenantPlaceholder, regexp.QuoteMeta(r.name(TenantPlaceholder, tenant))) + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse record name pattern %q: %w", pattern, err)
+	}
+
+	return re, nil
+}
+
+// recordNamePatterns are the compiled patterns of a tenant.
+type recordNamePatterns struct {
+	allow, deny *regexp.Regexp
+}
+
+// check returns why the name doesn't follow the patterns, if it doesn't.
+func (p recordNamePatterns) check(name string) (string, bool) {
+	if p.allow != nil && !p.allow.MatchString(name) {
+		return fmt.Sprintf("doesn't match %s", p.allow), false
+	}
+	if p.deny != nil && p.deny.MatchString(name) {
+		return fmt.Sprintf("matches denied %s", p.deny), false
+	}
+
+	return "", true
+}
+
+// enforce checks the names of the recording rules and handles the ones not following the patterns according to
+// the policy, then reports the names recorded by more than one tenant.
+func (r *recordNames) enforce(groups []rules.RuleGroup, groupTenant func(string) string) error {
+	if r.allow == "" && r.deny == "" {
+		return nil
+	}
+
+	r.violations.Reset()
+	patterns := map[string]recordNamePatterns{}
+	// renames are the names rewritten by tenant.
+	renames := map[string]map[string]string{}
+	var errs []error
+	for i := range groups {
+		group := &groups[i]
+		tenant := groupTenant(group.Name)
+		p, ok := patterns[tenant]
+		if !ok {
+			// The patterns were checked when the recordNames was created.
+			p.allow, _ = r.compile(r.allow, tenant)
+			p.deny, _ = r.compile(r.deny, tenant)
+			patterns[tenant] = p
+		}
+
+		kept := group.Rules[:0]
+		for _, rule := range group.Rules {
+			name := rule.Record.Value
+			reason, ok := p.check(name)
+			if name == "" || ok {
+				kept = append(kept, rule)
+				continue
+			}
+
+			r.violations.WithLabelValues(tenant).Inc()
+			msg := fmt.Sprintf("group %q: recording rule %s %s", group.Name, name, reason)
+			switch r.policy {
+			case RecordNamesReject:
+				errs = append(errs, &rules.TenantError{Tenant: tenant, Err: errors.New(msg)})
+			case RecordNamesRewrite:
+				renamed := r.name(r.prefix, tenant) + name
+				if reason, ok := p.check(renamed); !ok {
+					log.Printf("tenant %s: %s, removing it as %s %s too", tenant, msg, renamed, reason)
+					continue
+				}
+				log.Printf("tenant %s: %s, renaming it %s", tenant, msg, renamed)
+				if renames[tenant] == nil {
+					renames[tenant] = map[string]string{}
+				}
+				renames[tenant][name] = renamed
+				rule.Record.Value = renamed
+			default:
+				log.Printf("tenant %s: %s", tenant, msg)
+			}
+			kept = append(kept, rule)
+		}
+		group.Rules = kept
+	}
+
+	for i, group := range groups {
+		if tenantRenames, ok := renames[groupTenant(group.Name)]; ok {
+			renameMetrics(groups[i].Rules, tenantRenames)
+		}
+	}
+
+	collisions := findRecordNameCollisions(groups, groupTenant)
+	r.collisions.Set(float64(len(collisions)))
+	for _, name := range sortedKeys(collisions) {
+		msg := fmt.Sprintf("metric %s is recorded by multiple tenants: %v", name, collisions[name])
+		log.Print(msg)
+		if r.policy == RecordNamesReject {
+			for _, tenant := range collisions[name] {
+				errs = append(errs, &rules.TenantError{Tenant: tenant, Err: errors.New(msg)})
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("recording rule names don't follow the patterns: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// renameMetrics renames the metrics selected by the expressions of the rules.
+func renameMetrics(nodes []rulefmt.RuleNode, renames map[string]string) {
+	for i, rule := range nodes {
+		// The expression was validated when the rules were parsed.
+		expr, err := parser.ParseExpr(rule.Expr.Value)
+		if err != nil {
+			continue
+		}
+
+		renamed := false
+		parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+			vs, ok := node.(*parser.VectorSelector)
+			if !ok {
+				return nil
+			}
+			for j, m := range vs.LabelMatchers {
+				if m.Name != model.MetricNameLabel || m.Type != labels.MatchEqual {
+					continue
+				}
+				if name, ok := renames[m.Value]; ok {
+					vs.LabelMatchers[j] = labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, name)
+					if vs.Name != "" {
+						vs.Name = name
+					}
+					renamed = true
+				}
+			}
+			return nil
+		})
+		if renamed {
+			nodes[i].Expr.Value = expr.String()
+		}
+	}
+}
+
+// findRecordNameCollisions returns the metric names recorded by more than one tenant,
+// along with the sorted list of tenants recording each of them.
+func findRecordNameCollisions(groups []rules.RuleGroup, groupTenant func(string) string) map[string][]string {
+	nameTenants := map[string]map[string]struct{}{}
+	for _, group := range groups {
+		tenant := groupTenant(group.Name)
+		for _, rule := range group.Rules {
+			if rule.Record.Value == "" {
+				continue
+			}
+			if _, ok := nameTenants[rule.Record.Value]; !ok {
+				nameTenants[rule.Record.Value] = map[string]struct{}{}
+			}
+			nameTenants[rule.Record.Value][tenant] = struct{}{}
+		}
+	}
+
+	collisions := map[string][]string{}
+	for name, tenantsSet := range nameTenants {
+		if len(tenantsSet) < 2 {
+			continue
+		}
+		collisions[name] = sortedKeys(tenantsSet)
+	}
+
+	return collisions
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
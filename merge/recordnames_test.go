@@ -0,0 +1,151 @@
+package merge
+
+import (
+	"context"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const recordNameRuleGroups = `
+groups:
+- name: tenant-1.test
+  rules:
+  - record: tenant_1:requests:rate5m
+    expr: rate(requests_total[5m])
+  - record: job:up:sum
+    expr: sum by (job) (up)
+  - alert: Down
+    expr: job:up:sum == 0
+  - record: job:up:avg
+    expr: avg by (job) ({__name__="job:up:sum"})
+- name: tenant2.test
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)
+  - record: internal:up
+    expr: up
+`
+
+func TestMergerRecordNames(t *testing.T) {
+	testCases := map[string]struct {
+		policy string
+
+		expectErr        string
+		expectErrTenants []string
+		expectRules      map[string][]string
+		expectCollisions float64
+	}{
+		"warn": {
+			policy: RecordNamesWarn,
+			expectRules: map[string][]string{
+				"tenant-1.test": {
+					"tenant_1:requests:rate5m: rate(requests_total[5m])",
+					"job:up:sum: sum by (job) (up)",
+					": job:up:sum == 0",
+					`job:up:avg: avg by (job) ({__name__="job:up:sum"})`,
+				},
+				"tenant2.test": {
+					"job:up:sum: sum by (job) (up)",
+					"internal:up: up",
+				},
+			},
+			expectCollisions: 1,
+		},
+		"reject": {
+			policy:           RecordNamesReject,
+			expectErr:        `recording rule names don't follow the patterns: tenant tenant-1: group "tenant-1.test": recording rule job:up:sum doesn't match ^(?:tenant_1:.+)$`,
+			expectErrTenants: []string{"tenant-1", "tenant2"},
+		},
+		"rewrite": {
+			policy: RecordNamesRewrite,
+			expectRules: map[string][]string{
+				"tenant-1.test": {
+					"tenant_1:requests:rate5m: rate(requests_total[5m])",
+					"tenant_1:job:up:sum: sum by (job) (up)",
+					": tenant_1:job:up:sum == 0",
+					`tenant_1:job:up:avg: avg by (job) ({__name__="tenant_1:job:up:sum"})`,
+				},
+				"tenant2.test": {
+					"tenant2:job:up:sum: sum by (job) (up)",
+				},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m, err := New(nil, Config{
+				DuplicateAlerts:  DuplicateAlertsIgnore,
+				RecordNameAllow:  TenantPlaceholder + ":.+",
+				RecordNameDeny:   ".*internal:.+",
+				RecordNamePrefix: TenantPlaceholder + ":",
+				RecordNamePolicy: tc.policy,
+			}, nil, nil)
+			assert.NoError(t, err)
+
+			data, err := m.Merge(context.Background(), []byte(recordNameRuleGroups), "")
+			assert.Equal(t, 2.0, testutil.ToFloat64(m.recordNames.violations.WithLabelValues("tenant-1")))
+			assert.Equal(t, 2.0, testutil.ToFloat64(m.recordNames.violations.WithLabelValues("tenant2")))
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				assert.Equal(t, tc.expectErrTenants, rules.ErrorTenants(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectCollisions, testutil.ToFloat64(m.recordNames.collisions))
+
+			ruleGroups, errs := rules.Parse(data)
+			assert.Len(t, errs, 0)
+			got := map[string][]string{}
+			for _, group := range ruleGroups.Groups {
+				for _, rule := range group.Rules {
+					got[group.Name] = append(got[group.Name], rule.Record.Value+": "+rule.Expr.Value)
+				}
+			}
+			assert.Equal(t, tc.expectRules, got)
+		})
+	}
+}
+
+func TestNewRecordNames(t *testing.T) {
+	testCases := map[string]struct {
+		cfg Config
+
+		expectErr string
+	}{
+		"default policy": {
+			cfg: Config{RecordNameAllow: TenantPlaceholder + ":.+"},
+		},
+		"unknown policy": {
+			cfg:       Config{RecordNamePolicy: "drop"},
+			expectErr: `unknown record names policy "drop"`,
+		},
+		"rewrite without prefix": {
+			cfg:       Config{RecordNamePolicy: RecordNamesRewrite},
+			expectErr: "the rewrite record names policy requires a prefix",
+		},
+		"invalid pattern": {
+			cfg:       Config{RecordNameDeny: "node_("},
+			expectErr: `failed to parse record name pattern "node_("`,
+		},
+		"invalid prefix": {
+			cfg:       Config{RecordNamePrefix: "0" + TenantPlaceholder},
+			expectErr: `invalid record name prefix "0{tenant}"`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r, err := newRecordNames(tc.cfg)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, RecordNamesWarn, r.policy)
+		})
+	}
+}
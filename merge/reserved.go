@@ -0,0 +1,181 @@
+package merge
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Policies applied to rules setting reserved labels.
+const (
+	// ReservedLabelsWarn only reports the rules.
+	ReservedLabelsWarn = "warn"
+	// ReservedLabelsStrip removes the reserved labels from the labels of the rules and from the series of their
+	// expressions, and the recording rules recording reserved metric names.
+	ReservedLabelsStrip = "strip"
+	// ReservedLabelsReject fails the sync, so that the ruler keeps its rules.
+	ReservedLabelsReject = "reject"
+)
+
+// reservedLabels finds the rules of tenants setting the labels operators rely on, e.g. to route the evaluated series
+// or the alerts to tenants, or recording the metrics of others, so that a tenant can't spoof the series of another.
+type reservedLabels struct {
+	labels      []string
+	metricNames *regexp.Regexp
+	policy      string
+
+	violations *prometheus.GaugeVec
+}
+
+func newReservedLabels(cfg Config) (*reservedLabels, error) {
+	r := &reservedLabels{
+		labels: cfg.ReservedLabels,
+		policy: cfg.ReservedLabelsPolicy,
+		violations: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_reserved_labels_violations",
+			Help: "Number of rules of tenants setting reserved labels in the last synced rules, by tenant and label, __name__ being a reserved metric name recorded.",
+		}, []string{"tenant", "label"}),
+	}
+
+	switch r.policy {
+	case "":
+		r.policy = ReservedLabelsStrip
+	case ReservedLabelsWarn, ReservedLabelsStrip, ReservedLabelsReject:
+	default:
+		return nil, fmt.Errorf("unknown reserved labels policy %q", r.policy)
+	}
+
+	for _, l := range r.labels {
+		if !model.LabelName(l).IsValid() {
+			return nil, fmt.Errorf("invalid reserved label name %q", l)
+		}
+	}
+
+	if cfg.ReservedMetricNames != "" {
+		var err error
+		r.metricNames, err = regexp.Compile("^(?:" + cfg.ReservedMetricNames + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse reserved metric names: %w", err)
+		}
+	}
+
+	return r, nil
+}
+
+// enforce finds the rules setting reserved labels and handles them according to the policy.
+func (r *reservedLabels) enforce(groups []rules.RuleGroup, groupTenant func(string) string) error {
+	if len(r.labels) == 0 && r.metricNames == nil {
+		return nil
+	}
+
+	r.violations.Reset()
+	var errs []error
+	for i := range groups {
+		group := &groups[i]
+		tenant := groupTenant(group.Name)
+
+		kept := group.Rules[:0]
+		for _, rule := range group.Rules {
+			name := rule.Record.Value
+			if name == "" {
+				name = rule.Alert.Value
+			}
+			report := func(label, format string, args ...any) {
+				msg := fmt.Sprintf("group %q: rule %s ", group.Name, name) + fmt.Sprintf(format, args...)
+				log.Printf("tenant %s: %s", tenant, msg)
+				r.violations.WithLabelValues(tenant, label).Inc()
+				errs = append(errs, &rules.TenantError{Tenant: tenant, Err: errors.New(msg)})
+			}
+
+			for _, l := range r.labels {
+				if _, ok := rule.Labels[l]; ok {
+					report(l, "sets reserved label %s", l)
+					if r.policy == ReservedLabelsStrip {
+						delete(rule.Labels, l)
+					}
+				}
+			}
+
+			// The expression was validated when the rules were parsed.
+			if expr, err := parser.ParseExpr(rule.Expr.Value); err == nil {
+				replaced := replacedLabels(expr)
+				stripped := false
+				for _, l := range r.labels {
+					if !replaced[l] {
+						continue
+					}
+					report(l, "sets reserved label %s with label_replace or label_join", l)
+					if r.policy == ReservedLabelsStrip && expr.Type() == parser.ValueTypeVector {
+						expr, stripped = withoutLabel(expr, l), true
+					}
+				}
+				if stripped {
+					rule.Expr.Value = expr.String()
+				}
+			}
+
+			if rule.Record.Value != "" && r.metricNames != nil && r.metricNames.MatchString(rule.Record.Value) {
+				report(model.MetricNameLabel, "records reserved metric name %s", rule.Record.Value)
+				if r.policy == ReservedLabelsStrip {
+					continue
+				}
+			}
+
+			kept = append(kept, rule)
+		}
+		group.Rules = kept
+	}
+
+	if len(errs) > 0 && r.policy == ReservedLabelsReject {
+		return fmt.Errorf("rules set reserved labels: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// replacedLabels returns the labels set by the label_replace and label_join calls of the expression.
+func replacedLabels(expr parser.Expr) map[string]bool {
+	replaced := map[string]bool{}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		call, ok := node.(*parser.Call)
+		if !ok || (call.Func.Name != "label_replace" && call.Func.Name != "label_join") || len(call.Args) < 2 {
+			return nil
+		}
+		if dst, ok := unwrapParens(call.Args[1]).(*parser.StringLiteral); ok {
+			replaced[dst.Val] = true
+		}
+		return nil
+	})
+
+	return replaced
+}
+
+func unwrapParens(expr parser.Expr) parser.Expr {
+	for {
+		paren, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
+}
+
+// withoutLabel wraps the vector expression so that the label is removed from its series.
+func withoutLabel(expr parser.Expr, label string) parser.Expr {
+	return &parser.Call{
+		Func: parser.Functions["label_replace"],
+		Args: parser.Expressions{
+			expr,
+			&parser.StringLiteral{Val: label},
+			&parser.StringLiteral{Val: ""},
+			&parser.StringLiteral{Val: ""},
+			&parser.StringLiteral{Val: ""},
+		},
+	}
+}
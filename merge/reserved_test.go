@@ -0,0 +1,138 @@
+package merge
+
+import (
+	"context"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const reservedRuleGroups = `
+groups:
+- name: tenant1.test
+  rules:
+  - record: up
+    expr: vector(1)
+  - record: tenant1:requests:rate5m
+    expr: label_replace(rate(requests_total[5m]), "tenant_id", "tenant2", "", "")
+  - alert: Down
+    expr: up == 0
+    labels:
+      tenant_id: tenant2
+      severity: critical
+- name: tenant2.test
+  rules:
+  - record: tenant2:up
+    expr: sum by (job) (label_join(up, "team", ",", "job"))
+`
+
+func TestMergerReservedLabels(t *testing.T) {
+	testCases := map[string]struct {
+		policy string
+
+		expectErr    string
+		expectRules  map[string][]string
+		expectLabels map[string]string
+	}{
+		"warn": {
+			policy: ReservedLabelsWarn,
+			expectRules: map[string][]string{
+				"tenant1.test": {
+					"vector(1)",
+					`label_replace(rate(requests_total[5m]), "tenant_id", "tenant2", "", "")`,
+					"up == 0",
+				},
+				"tenant2.test": {`sum by (job) (label_join(up, "team", ",", "job"))`},
+			},
+			expectLabels: map[string]string{"tenant_id": "tenant2", "severity": "critical"},
+		},
+		"strip": {
+			policy: ReservedLabelsStrip,
+			expectRules: map[string][]string{
+				"tenant1.test": {
+					`label_replace(label_replace(rate(requests_total[5m]), "tenant_id", "tenant2", "", ""), "tenant_id", "", "", "")`,
+					"up == 0",
+				},
+				"tenant2.test": {`sum by (job) (label_join(up, "team", ",", "job"))`},
+			},
+			expectLabels: map[string]string{"severity": "critical"},
+		},
+		"reject": {
+			policy:    ReservedLabelsReject,
+			expectErr: `rules set reserved labels: tenant tenant1: group "tenant1.test": rule up records reserved metric name up`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m, err := New(nil, Config{
+				DuplicateAlerts:      DuplicateAlertsIgnore,
+				ReservedLabels:       []string{"tenant_id"},
+				ReservedMetricNames:  "up|node_.*",
+				ReservedLabelsPolicy: tc.policy,
+			}, nil, nil)
+			assert.NoError(t, err)
+
+			data, err := m.Merge(context.Background(), []byte(reservedRuleGroups), "")
+			assert.Equal(t, 1.0, testutil.ToFloat64(m.reserved.violations.WithLabelValues("tenant1", "__name__")))
+			assert.Equal(t, 2.0, testutil.ToFloat64(m.reserved.violations.WithLabelValues("tenant1", "tenant_id")))
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				assert.Equal(t, []string{"tenant1"}, rules.ErrorTenants(err))
+				return
+			}
+			assert.NoError(t, err)
+
+			ruleGroups, errs := rules.Parse(data)
+			assert.Len(t, errs, 0)
+			exprs := map[string][]string{}
+			for _, group := range ruleGroups.Groups {
+				for _, rule := range group.Rules {
+					exprs[group.Name] = append(exprs[group.Name], rule.Expr.Value)
+					if rule.Alert.Value == "Down" {
+						assert.Equal(t, tc.expectLabels, rule.Labels)
+					}
+				}
+			}
+			assert.Equal(t, tc.expectRules, exprs)
+		})
+	}
+}
+
+func TestNewReservedLabels(t *testing.T) {
+	testCases := map[string]struct {
+		cfg Config
+
+		expectErr string
+	}{
+		"default policy": {
+			cfg: Config{ReservedLabels: []string{"tenant_id"}},
+		},
+		"unknown policy": {
+			cfg:       Config{ReservedLabelsPolicy: "drop"},
+			expectErr: `unknown reserved labels policy "drop"`,
+		},
+		"invalid label": {
+			cfg:       Config{ReservedLabels: []string{"tenant-id"}},
+			expectErr: `invalid reserved label name "tenant-id"`,
+		},
+		"invalid metric names": {
+			cfg:       Config{ReservedMetricNames: "node_("},
+			expectErr: "failed to parse reserved metric names",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r, err := newReservedLabels(tc.cfg)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, ReservedLabelsStrip, r.policy)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package merge
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// shadowTenants separates the rule groups of shadow tenants from the merged rules. The rules of shadow tenants are
+// fetched, validated and reported but not synced, e.g. to evaluate the volume and quality of the rules of a new tenant
+// before they affect the shared ruler.
+type shadowTenants struct {
+	mu      sync.Mutex
+	tenants map[string]struct{}
+	// previous are the marshalled rule groups of each shadow tenant by name on the last merge, to report their changes.
+	previous map[string]map[string]string
+
+	groups *prometheus.GaugeVec
+	rules  *prometheus.GaugeVec
+}
+
+func newShadowTenants() *shadowTenants {
+	return &shadowTenants{
+		previous: map[string]map[string]string{},
+		groups: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_shadow_tenant_rule_groups",
+			Help: "Number of rule groups of shadow tenants in the last merged rules, which are excluded from the synced rules.",
+		}, []string{"tenant"}),
+		rules: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_shadow_tenant_rules",
+			Help: "Number of rules of shadow tenants in the last merged rules, which are excluded from the synced rules.",
+		}, []string{"tenant"}),
+	}
+}
+
+// set replaces the shadow tenants.
+func (s *shadowTenants) set(tenants []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tenants = make(map[string]struct{}, len(tenants))
+	for _, tenant := range tenants {
+		s.tenants[tenant] = struct{}{}
+	}
+}
+
+// separate reports the rule groups of shadow tenants and returns the other groups.
+func (s *shadowTenants) separate(groups []rules.RuleGroup, groupTenant func(string) string) []rules.RuleGroup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shadowGroups := make(map[string][]rules.RuleGroup, len(s.tenants))
+	kept := make([]rules.RuleGroup, 0, len(groups))
+	for _, group := range groups {
+		tenant := groupTenant(group.Name)
+		if _, ok := s.tenants[tenant]; ok {
+			shadowGroups[tenant] = append(shadowGroups[tenant], group)
+			continue
+		}
+		kept = append(kept, group)
+	}
+
+	s.groups.Reset()
+	s.rules.Reset()
+	previous := make(map[string]map[string]string, len(s.tenants))
+	for tenant := range s.tenants {
+		var count int
+		for _, group := range shadowGroups[tenant] {
+			count += len(group.Rules)
+		}
+		s.groups.WithLabelValues(tenant).Set(float64(len(shadowGroups[tenant])))
+		s.rules.WithLabelValues(tenant).Set(float64(count))
+
+		previous[tenant] = marshalGroups(shadowGroups[tenant])
+		s.reportChanges(tenant, s.previous[tenant], previous[tenant], count)
+	}
+	s.previous = previous
+
+	return kept
+}
+
+// reportChanges logs the rule groups of a shadow tenant added, removed and changed since the last merge.
+func (s *shadowTenants) reportChanges(tenant string, previous, current map[string]string, rulesCount int) {
+	var added, removed, changed []string
+	for name, group := range current {
+		previousGroup, ok := previous[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case previousGroup != group:
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := current[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	if len(added) == 0 && len(removed) == 0 && len(changed) == 0 {
+		return
+	}
+
+	for _, names := range [][]string{added, removed, changed} {
+		sort.Strings(names)
+	}
+	log.Printf("shadow tenant %s: %d groups, %d rules, not synced; added groups %v, removed groups %v, changed groups %v", tenant, len(current), rulesCount, added, removed, changed)
+}
+
+// marshalGroups returns the marshalled rule groups by name.
+func marshalGroups(groups []rules.RuleGroup) map[string]string {
+	marshalled := make(map[string]string, len(groups))
+	for _, group := range groups {
+		content, err := yaml.Marshal(group)
+		if err != nil {
+			// Groups were unmarshalled from YAML, marshalling them fails only on programming errors.
+			content = []byte(err.Error())
+		}
+		marshalled[group.Name] = string(content)
+	}
+
+	return marshalled
+}
@@ -0,0 +1,291 @@
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"gopkg.in/yaml.v3"
+)
+
+// slothVersion is the only version of the Sloth SLO specification supported.
+const slothVersion = "prometheus/v1"
+
+// sliWindows are the windows of the SLI error ratio recording rules used by the burn rate alerts.
+var sliWindows = []string{"5m", "30m", "1h", "2h", "6h", "1d", "3d"}
+
+// slothSpec is a set of SLOs of a service in the Sloth format, see https://sloth.dev/specs/default/.
+type slothSpec struct {
+	Version string            `yaml:"version"`
+	Service string            `yaml:"service"`
+	Labels  map[string]string `yaml:"labels"`
+	SLOs    []slothSLO        `yaml:"slos"`
+}
+
+type slothSLO struct {
+	Name        string            `yaml:"name"`
+	Objective   float64           `yaml:"objective"`
+	Description string            `yaml:"description"`
+	Labels      map[string]string `yaml:"labels"`
+	SLI         slothSLI          `yaml:"sli"`
+	Alerting    slothAlerting     `yaml:"alerting"`
+}
+
+// slothSLI holds the queries of an SLI, in which {{.window}} is replaced by the window of the recording rules.
+type slothSLI struct {
+	Events *struct {
+		ErrorQuery string `yaml:"error_query"`
+		TotalQuery string `yaml:"total_query"`
+	} `yaml:"events"`
+	Raw *struct {
+		ErrorRatioQuery string `yaml:"error_ratio_query"`
+	} `yaml:"raw"`
+}
+
+type slothAlerting struct {
+	Name        string            `yaml:"name"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+	PageAlert   slothAlert        `yaml:"page_alert"`
+	TicketAlert slothAlert        `yaml:"ticket_alert"`
+}
+
+type slothAlert struct {
+	Disable     bool              `yaml:"disable"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// readSLODir reads the SLO specs of tenants from a directory with one sub-directory of YAML files per tenant,
+// and returns the rule groups generated from them, prefixed with the tenant owning them.
+// If tenant is not empty, only the SLOs of this tenant are read and the groups are not prefixed.
+func readSLODir(dir, tenant string) ([]rules.RuleGroup, error) {
+	tenants := []string{tenant}
+	if tenant == "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SLO directory: %w", err)
+		}
+
+		tenants = tenants[:0]
+		for _, entry := range entries {
+			if entry.IsDir() {
+				tenants = append(tenants, entry.Name())
+			}
+		}
+	}
+
+	var groups []rules.RuleGroup
+	for _, t := range tenants {
+		files, err := filepath.Glob(filepath.Join(dir, t, "*.yaml"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list SLO files of tenant %s: %w", t, err)
+		}
+		sort.Strings(files)
+
+		for _, file := range files {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read SLO file: %w", err)
+			}
+
+			fileGroups, err := generateSLORules(content)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate rules from SLO file %s: %w", file, err)
+			}
+
+			for _, group := range fileGroups {
+				if tenant == "" {
+					group.Name = t + "." + group.Name
+				}
+				groups = append(groups, rules.RuleGroup{RuleGroup: group})
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+// generateSLORules generates a rule group per SLO of a Sloth spec, with the SLI recording rules
+// and the multi-window multi-burn-rate alerts of the SLO.
+func generateSLORules(content []byte) ([]rulefmt.RuleGroup, error) {
+	spec := &slothSpec{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(spec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal SLO spec: %w", err)
+	}
+
+	if spec.Version != slothVersion {
+		return nil, fmt.Errorf("unsupported SLO spec version %q, expected %q", spec.Version, slothVersion)
+	}
+	if spec.Service == "" {
+		return nil, fmt.Errorf("service must be set")
+	}
+
+	groups := make([]rulefmt.RuleGroup, 0, len(spec.SLOs))
+	for _, slo := range spec.SLOs {
+		sloRules, err := generateSLORulesFor(spec, slo)
+		if err != nil {
+			return nil, fmt.Errorf("SLO %q: %w", slo.Name, err)
+		}
+
+		groups = append(groups, rulefmt.RuleGroup{
+			Name:  "slo-" + spec.Service + "-" + slo.Name,
+			Rules: sloRules,
+		})
+	}
+
+	// Validate the generated rules the same way tenants' rules are.
+	generated, err := yaml.Marshal(rulefmt.RuleGroups{Groups: groups})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal generated rules: %w", err)
+	}
+
+	parsed, errs := rulefmt.Parse(generated)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid generated rules: %w", errors.Join(errs...))
+	}
+
+	return parsed.Groups, nil
+}
+
+func generateSLORulesFor(spec *slothSpec, slo slothSLO) ([]rulefmt.RuleNode, error) {
+	if slo.Name == "" {
+		return nil, fmt.Errorf("name must be set")
+	}
+	if slo.Objective <= 0 || slo.Objective >= 100 {
+		return nil, fmt.Errorf("objective must be between 0 and 100 exclusive, got %v", slo.Objective)
+	}
+
+	var errorRatioQuery string
+	switch {
+	case slo.SLI.Events != nil && slo.SLI.Raw == nil:
+		errorRatioQuery = fmt.Sprintf("(%s)\n/\n(%s)", slo.SLI.Events.ErrorQuery, slo.SLI.Events.TotalQuery)
+	case slo.SLI.Raw != nil && slo.SLI.Events == nil:
+		errorRatioQuery = slo.SLI.Raw.ErrorRatioQuery
+	default:
+		return nil, fmt.Errorf("exactly one of sli.events and sli.raw must be set")
+	}
+
+	tmpl, err := template.New(slo.Name).Option("missingkey=error").Parse(errorRatioQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SLI queries: %w", err)
+	}
+
+	id := spec.Service + "-" + slo.Name
+	sloLabels := mergeLabels(spec.Labels, slo.Labels, map[string]string{
+		"sloth_id":      id,
+		"sloth_service": spec.Service,
+		"sloth_slo":     slo.Name,
+	})
+	selector := fmt.Sprintf("{sloth_id=%q, sloth_service=%q, sloth_slo=%q}", id, spec.Service, slo.Name)
+
+	var rules []rulefmt.RuleNode
+	for _, window := range sliWindows {
+		var expr bytes.Buffer
+		if err := tmpl.Execute(&expr, map[string]string{"window": window}); err != nil {
+			return nil, fmt.Errorf("failed to render SLI queries: %w", err)
+		}
+
+		rules = append(rules, recordingRule(
+			"slo:sli_error:ratio_rate"+window,
+			expr.String(),
+			mergeLabels(sloLabels, map[string]string{"sloth_window": window}),
+		))
+	}
+
+	errorBudget := formatRatio((100 - slo.Objective) / 100)
+	rules = append(rules,
+		recordingRule(
+			"slo:sli_error:ratio_rate30d",
+			fmt.Sprintf("sum_over_time(slo:sli_error:ratio_rate5m%[1]s[30d])\n/ ignoring (sloth_window)\ncount_over_time(slo:sli_error:ratio_rate5m%[1]s[30d])", selector),
+			mergeLabels(sloLabels, map[string]string{"sloth_window": "30d"}),
+		),
+		recordingRule("slo:objective:ratio", "vector("+formatRatio(slo.Objective/100)+")", sloLabels),
+		recordingRule("slo:error_budget:ratio", "vector("+errorBudget+")", sloLabels),
+	)
+
+	if slo.Alerting.Name == "" {
+		return rules, nil
+	}
+
+	burnRateCondition := func(factor, longWindow, shortWindow string) string {
+		return fmt.Sprintf(
+			"(max(slo:sli_error:ratio_rate%[2]s%[4]s > (%[1]s * %[5]s)) without (sloth_window)\n"+
+				"and\nmax(slo:sli_error:ratio_rate%[3]s%[4]s > (%[1]s * %[5]s)) without (sloth_window))",
+			factor, longWindow, shortWindow, selector, errorBudget,
+		)
+	}
+
+	alerts := []struct {
+		severity string
+		alert    slothAlert
+		expr     string
+	}{
+		{
+			severity: "page",
+			alert:    slo.Alerting.PageAlert,
+			expr:     burnRateCondition("14.4", "1h", "5m") + "\nor\n" + burnRateCondition("6", "6h", "30m"),
+		},
+		{
+			severity: "ticket",
+			alert:    slo.Alerting.TicketAlert,
+			expr:     burnRateCondition("3", "1d", "2h") + "\nor\n" + burnRateCondition("1", "3d", "6h"),
+		},
+	}
+
+	for _, a := range alerts {
+		if a.alert.Disable {
+			continue
+		}
+
+		rule := rulefmt.RuleNode{
+			Alert:       yaml.Node{Kind: yaml.ScalarNode, Value: slo.Alerting.Name},
+			Expr:        yaml.Node{Kind: yaml.ScalarNode, Value: a.expr},
+			Labels:      mergeLabels(sloLabels, slo.Alerting.Labels, a.alert.Labels, map[string]string{"sloth_severity": a.severity}),
+			Annotations: mergeLabels(slo.Alerting.Annotations, a.alert.Annotations),
+		}
+		if len(rule.Annotations) == 0 {
+			rule.Annotations = nil
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func recordingRule(record, expr string, lbls map[string]string) rulefmt.RuleNode {
+	return rulefmt.RuleNode{
+		Record: yaml.Node{Kind: yaml.ScalarNode, Value: record},
+		Expr:   yaml.Node{Kind: yaml.ScalarNode, Value: expr},
+		Labels: lbls,
+	}
+}
+
+// mergeLabels merges label sets into a new one, later sets overriding earlier ones.
+func mergeLabels(sets ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, set := range sets {
+		for name, value := range set {
+			merged[name] = value
+		}
+	}
+
+	return merged
+}
+
+// formatRatio formats a ratio without the floating point noise of its computation.
+func formatRatio(ratio float64) string {
+	return strings.TrimRight(strconv.FormatFloat(ratio, 'f', 10, 64), "0")
+}
@@ -0,0 +1,126 @@
+package merge
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var slothSpecContent = `
+version: prometheus/v1
+service: api
+labels:
+  owner: team-a
+slos:
+- name: requests-availability
+  objective: 99.9
+  sli:
+    events:
+      error_query: sum(rate(http_requests_total{job="api",code=~"5.."}[{{.window}}]))
+      total_query: sum(rate(http_requests_total{job="api"}[{{.window}}]))
+  alerting:
+    name: APIHighErrorRate
+    labels:
+      category: availability
+    ticket_alert:
+      disable: true
+`
+
+func TestGenerateSLORules(t *testing.T) {
+	testCases := map[string]struct {
+		spec              string
+		expectErr         bool
+		expectRecords     int
+		expectAlerts      int
+		expectErrorBudget string
+	}{
+		"rules are generated": {
+			spec:              slothSpecContent,
+			expectRecords:     len(sliWindows) + 3,
+			expectAlerts:      1,
+			expectErrorBudget: "vector(0.001)",
+		},
+		"unsupported version": {
+			spec:      "version: prometheus/v2\nservice: api\n",
+			expectErr: true,
+		},
+		"invalid objective": {
+			spec: `
+version: prometheus/v1
+service: api
+slos:
+- name: availability
+  objective: 100
+  sli:
+    raw:
+      error_ratio_query: vector(0)
+`,
+			expectErr: true,
+		},
+		"invalid SLI query": {
+			spec: `
+version: prometheus/v1
+service: api
+slos:
+- name: availability
+  objective: 99
+  sli:
+    raw:
+      error_ratio_query: rate(errors[{{.window}}]
+`,
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			groups, err := generateSLORules([]byte(tc.spec))
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, groups, 1)
+			assert.Equal(t, "slo-api-requests-availability", groups[0].Name)
+
+			var records, alerts int
+			for _, rule := range groups[0].Rules {
+				if rule.Alert.Value != "" {
+					alerts++
+					assert.Equal(t, "page", rule.Labels["sloth_severity"])
+					assert.Equal(t, "availability", rule.Labels["category"])
+					continue
+				}
+
+				records++
+				assert.Equal(t, "team-a", rule.Labels["owner"])
+				if rule.Record.Value == "slo:error_budget:ratio" {
+					assert.Equal(t, tc.expectErrorBudget, rule.Expr.Value)
+				}
+			}
+			assert.Equal(t, tc.expectRecords, records)
+			assert.Equal(t, tc.expectAlerts, alerts)
+		})
+	}
+}
+
+func TestReadSLODir(t *testing.T) {
+	dir := t.TempDir()
+	for _, tenant := range []string{"tenant1", "tenant2"} {
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, tenant), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, tenant, "api.yaml"), []byte(slothSpecContent), 0o644))
+	}
+
+	groups, err := readSLODir(dir, "")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 2)
+	assert.Equal(t, "tenant1.slo-api-requests-availability", groups[0].Name)
+	assert.Equal(t, "tenant2.slo-api-requests-availability", groups[1].Name)
+
+	groups, err = readSLODir(dir, "tenant2")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 1)
+	assert.Equal(t, "slo-api-requests-availability", groups[0].Name)
+}
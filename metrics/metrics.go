@@ -0,0 +1,39 @@
+// Package metrics holds the settings of the metrics shared by the packages of the syncer.
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Settings of native histograms, as recommended by the Prometheus client library: buckets growing by at most 10%,
+// and no more than 160 of them, halving the resolution or resetting the histogram if needed, at most once per hour.
+const (
+	nativeHistogramBucketFactor     = 1.1
+	nativeHistogramMaxBucketNumber  = 160
+	nativeHistogramMinResetDuration = time.Hour
+)
+
+var nativeHistograms atomic.Bool
+
+// SetNativeHistograms sets whether the histograms created afterwards with HistogramOpts are also native histograms.
+// Native histograms are cheap at high cardinality, e.g. per tenant, but are only scraped by Prometheus 2.40 and later
+// with the native-histograms feature enabled. Their classic buckets are kept as fallback for other scrapers.
+func SetNativeHistograms(enabled bool) {
+	nativeHistograms.Store(enabled)
+}
+
+// HistogramOpts returns the options of a histogram with the settings of native histograms if they are enabled.
+func HistogramOpts(opts prometheus.HistogramOpts) prometheus.HistogramOpts {
+	if !nativeHistograms.Load() {
+		return opts
+	}
+
+	opts.NativeHistogramBucketFactor = nativeHistogramBucketFactor
+	opts.NativeHistogramMaxBucketNumber = nativeHistogramMaxBucketNumber
+	opts.NativeHistogramMinResetDuration = nativeHistogramMinResetDuration
+
+	return opts
+}
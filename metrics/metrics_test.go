@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramOpts(t *testing.T) {
+	testCases := map[string]struct {
+		native bool
+
+		expectNative bool
+	}{
+		"classic histogram": {},
+		"native histogram": {
+			native:       true,
+			expectNative: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			SetNativeHistograms(tc.native)
+			defer SetNativeHistograms(false)
+
+			h := prometheus.NewHistogram(HistogramOpts(prometheus.HistogramOpts{
+				Name:    "test_duration_seconds",
+				Help:    "Test durations.",
+				Buckets: prometheus.DefBuckets,
+			}))
+			h.Observe(0.3)
+
+			var m dto.Metric
+			assert.NoError(t, h.Write(&m))
+
+			// The classic buckets are kept as fallback.
+			assert.Len(t, m.GetHistogram().GetBucket(), len(prometheus.DefBuckets))
+			assert.Equal(t, tc.expectNative, m.GetHistogram().Schema != nil)
+		})
+	}
+}
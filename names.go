@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	syncconfig "github.com/observatorium/thanos-rule-syncer/config"
+	"github.com/observatorium/thanos-rule-syncer/output"
+	"github.com/observatorium/thanos-rule-syncer/route"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+)
+
+// outputNameTemplate returns the template of -output.name-template, or nil if it isn't set.
+func outputNameTemplate(cfg *config) (*output.NameTemplate, error) {
+	if cfg.output.nameTemplate == "" {
+		return nil, nil
+	}
+
+	tmpl, err := output.ParseNameTemplate(cfg.output.nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -output.name-template: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+// configureOutputNames names the rules files of the pipeline of the flags with -output.name-template, i.e. -file as the
+// default shard and the files of the routes of -output.routing-file by the names of the routes, and checks that no two
+// outputs write the same rules file and that they all match -output.ruler-rule-files. The flags set in fs explicitly
+// naming a rules file are refused along with the template, as it would be ambiguous which applies.
+func configureOutputNames(cfg *config, fs *flag.FlagSet) {
+	tmpl, err := outputNameTemplate(cfg)
+	if err != nil {
+		fatalf(syncer.ErrorConfig, "%v", err)
+	}
+
+	if tmpl != nil {
+		fileSet := false
+		fs.Visit(func(f *flag.Flag) {
+			fileSet = fileSet || f.Name == "file"
+		})
+		switch {
+		case fileSet:
+			fatalf(syncer.ErrorConfig, "only one of -file and -output.name-template can be specified")
+		case cfg.output.tenantTemplate() != "":
+			fatalf(syncer.ErrorConfig, "-output.name-template can't be used with -output.tenant-dir or -file-template, which name the rules files by tenant")
+		case tmpl.UsesSignal():
+			fatalf(syncer.ErrorConfig, "-output.name-template can only use {{.Signal}} with the pipelines of -config, which name the signals")
+		}
+		if cfg.file, err = tmpl.Name(output.NameData{Shard: output.DefaultShard}); err != nil {
+			fatalf(syncer.ErrorConfig, "invalid -output.name-template: %v", err)
+		}
+	}
+
+	paths := map[string]string{}
+	switch {
+	case cfg.output.tenantTemplate() != "":
+		// The rules file of any tenant must match the globs, and the one of a tenant named tenant stands for them.
+		paths["the rules files of tenants"] = strings.ReplaceAll(cfg.output.tenantTemplate(), output.TenantPlaceholder, "tenant")
+	case cfg.output.routingFile != "":
+		table, err := routeTable(cfg, tmpl)
+		if err != nil {
+			fatalf(syncer.ErrorConfig, "failed to read routing file: %v", err)
+		}
+		for _, rt := range table.Routes {
+			paths["route "+rt.Name] = rt.File
+		}
+		paths["route "+route.DefaultRoute] = cfg.file
+	default:
+		paths["the rules file"] = cfg.file
+	}
+
+	if err := output.CheckNames(paths, splitList(cfg.output.ruleFiles)); err != nil {
+		fatalf(syncer.ErrorConfig, "invalid rules files: %v", err)
+	}
+}
+
+// routeTable reads the routing table of -output.routing-file, naming the rules files of its routes with the template
+// if not nil.
+func routeTable(cfg *config, tmpl *output.NameTemplate) (*route.Table, error) {
+	var opts []route.TableOption
+	if tmpl != nil {
+		opts = append(opts, route.WithFileNames(func(name string) (string, error) {
+			return tmpl.Name(output.NameData{Shard: name})
+		}))
+	}
+
+	return route.ReadTableFile(cfg.output.routingFile, opts...)
+}
+
+// pipelineFiles names the rules files of the pipelines with -output.name-template, by the names of the pipelines, and
+// checks that no two pipelines write the same rules file and that they all match -output.ruler-rule-files. It returns
+// the pipelines with their files.
+func pipelineFiles(cfg *config, pipelines []pipelineConfig) ([]pipelineConfig, error) {
+	tmpl, err := outputNameTemplate(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	named := make([]pipelineConfig, 0, len(pipelines))
+	paths := map[string]string{}
+	var errs []error
+	for _, p := range pipelines {
+		if tmpl != nil {
+			if p.File != "" {
+				errs = append(errs, fmt.Errorf("pipeline %s: file can't be set with -output.name-template", p.Name))
+				continue
+			}
+			if p.File, err = tmpl.Name(output.NameData{Signal: p.Name, Shard: output.DefaultShard}); err != nil {
+				errs = append(errs, fmt.Errorf("pipeline %s: %w", p.Name, err))
+				continue
+			}
+		}
+		if p.File == "" {
+			p.File = syncconfig.DefaultFile
+		}
+		paths["pipeline "+p.Name] = p.File
+		named = append(named, p)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if err := output.CheckNames(paths, splitList(cfg.output.ruleFiles)); err != nil {
+		return nil, err
+	}
+
+	return named, nil
+}
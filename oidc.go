@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/metrics"
+	"github.com/observatorium/thanos-rule-syncer/secret"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// Classes of failed OIDC token exchanges.
+const (
+	tokenErrorTimeout  = "timeout"
+	tokenErrorNetwork  = "network"
+	tokenErrorRejected = "rejected"
+	tokenErrorServer   = "server"
+	tokenErrorOther    = "other"
+)
+
+type tokenSourceInstrumenter struct {
+	exchangeDuration prometheus.Histogram
+	exchangeFailures *prometheus.CounterVec
+	tokenTTL         prometheus.GaugeFunc
+	// discoveryFailures counts the failed discoveries of the token URLs of the issuers, see oidcDiscovery.
+	discoveryFailures *prometheus.CounterVec
+
+	// expiry is the expiry time in Unix nanoseconds of the last token, or 0.
+	expiry atomic.Int64
+}
+
+func newTokenSourceInstrumenter(r prometheus.Registerer) *tokenSourceInstrumenter {
+	ins := &tokenSourceInstrumenter{
+		exchangeDuration: prometheus.NewHistogram(metrics.HistogramOpts(prometheus.HistogramOpts{
+			Name:    "thanos_rule_syncer_oidc_token_exchange_duration_seconds",
+			Help:    "Duration of OIDC token exchanges.",
+			Buckets: prometheus.DefBuckets,
+		})),
+		exchangeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_oidc_token_exchange_failures_total",
+			Help: "Total number of failed OIDC token exchanges, by class of error.",
+		}, []string{"class"}),
+		discoveryFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_oidc_discovery_failures_total",
+			Help: "Total number of failed discoveries of the token URL of OIDC issuers, by issuer URL.",
+		}, []string{"issuer"}),
+	}
+	ins.tokenTTL = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "thanos_rule_syncer_oidc_token_ttl_seconds",
+		Help: "Time until the expiry of the current OIDC token, or 0 if there is none.",
+	}, func() float64 {
+		expiry := ins.expiry.Load()
+		if expiry == 0 {
+			return 0
+		}
+		return max(time.Until(time.Unix(0, expiry)).Seconds(), 0)
+	})
+
+	if r != nil {
+		r.MustRegister(
+			ins.exchangeDuration,
+			ins.exchangeFailures,
+			ins.tokenTTL,
+			ins.discoveryFailures,
+		)
+	}
+
+	return ins
+}
+
+// NewTokenSource returns a token source exchanging tokens with the given function, instrumented with metrics.
+// Tokens are reused until they expire. Failures are logged with the given description of the exchange,
+// e.g. the issuer and audience, which must not contain secrets.
+func (i *tokenSourceInstrumenter) NewTokenSource(ctx context.Context, description string, exchange func(ctx context.Context) (*oauth2.Token, error)) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, tokenSourceFunc(func() (*oauth2.Token, error) {
+		start := time.Now()
+		token, err := exchange(ctx)
+		i.exchangeDuration.Observe(time.Since(start).Seconds())
+
+		if err != nil {
+			class := tokenErrorClass(err)
+			i.exchangeFailures.WithLabelValues(class).Inc()
+			log.Printf("OIDC token exchange failed (%s, %s): %v", class, description, err)
+			return nil, err
+		}
+
+		if token.Expiry.IsZero() {
+			i.expiry.Store(0)
+		} else {
+			i.expiry.Store(token.Expiry.UnixNano())
+		}
+
+		return token, nil
+	}))
+}
+
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) {
+	return f()
+}
+
+// tokenErrorClass classifies the error of a token exchange.
+func tokenErrorClass(err error) string {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil {
+		if retrieveErr.Response.StatusCode >= 500 {
+			return tokenErrorServer
+		}
+		return tokenErrorRejected
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return tokenErrorTimeout
+		}
+		return tokenErrorNetwork
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return tokenErrorTimeout
+	}
+
+	return tokenErrorOther
+}
+
+// upstreamAuth authenticates the requests to the upstreams with OIDC client credentials, e.g. the ones of the flags
+// or of a standby upstream. The upstreams share the resolver of the client secrets and the metrics of the token exchanges.
+type upstreamAuth struct {
+	cfg              *config
+	startup          *startup
+	oauthTransport   http.RoundTripper
+	roundTripperInst *roundTripperInstrumenter
+	r                prometheus.Registerer
+
+	// mu guards the secrets, tokens and discoveries, also used by the credentials of tenants when they are reloaded.
+	mu sync.Mutex
+	// secrets and tokens are created with the first secret referenced and the first upstream authenticated with OIDC,
+	// so that their metrics are only registered once, and only if they are used.
+	secrets *secret.Resolver
+	tokens  *tokenSourceInstrumenter
+	// discoveries are the token URLs of the issuers, shared by the upstreams of the same issuer.
+	discoveries    map[string]*oidcDiscovery
+	discoveryCache *oidcDiscoveryCache
+}
+
+func newUpstreamAuth(cfg *config, st *startup, oauthTransport http.RoundTripper, roundTripperInst *roundTripperInstrumenter, r prometheus.Registerer) *upstreamAuth {
+	return &upstreamAuth{
+		cfg:              cfg,
+		startup:          st,
+		oauthTransport:   oauthTransport,
+		roundTripperInst: roundTripperInst,
+		r:                r,
+		discoveries:      map[string]*oidcDiscovery{},
+		discoveryCache:   readOIDCDiscoveryCache(cfg.oidcDiscovery.cacheFile),
+	}
+}
+
+// context returns the context carrying the HTTP client used for OIDC token exchanges, if the flags configure OIDC.
+func (a *upstreamAuth) context(ctx context.Context) context.Context {
+	if a.cfg.oidc.issuerURL == "" {
+		return ctx
+	}
+
+	return a.oauthContext(ctx)
+}
+
+// oauthContext returns the context carrying the HTTP client used for OIDC token exchanges.
+func (a *upstreamAuth) oauthContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+		Transport: a.roundTripperInst.NewRoundTripper("oauth", a.oauthTransport),
+	})
+}
+
+// resolver returns the resolver of the secrets referenced by flags, created on first use so that its metrics are only
+// registered if secrets are used.
+func (a *upstreamAuth) resolver() *secret.Resolver {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.secrets == nil {
+		a.secrets = configureSecrets(a.cfg, a.r)
+	}
+
+	return a.secrets
+}
+
+// tokenSources returns the instrumenter of the token sources, created on first use so that its metrics are only
+// registered if OIDC is used.
+func (a *upstreamAuth) tokenSources() *tokenSourceInstrumenter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.tokens == nil {
+		a.tokens = newTokenSourceInstrumenter(a.r)
+	}
+
+	return a.tokens
+}
+
+// discovery returns the discovery of the token URL of the issuer, and whether it was created by this call.
+func (a *upstreamAuth) discovery(issuerURL string) (*oidcDiscovery, bool) {
+	tokens := a.tokenSources()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if discovery, ok := a.discoveries[issuerURL]; ok {
+		return discovery, false
+	}
+	discovery := newOIDCDiscovery(issuerURL, &http.Client{Transport: a.oauthTransport}, a.cfg.oidcDiscovery.refreshInterval, a.discoveryCache, tokens.discoveryFailures.WithLabelValues(issuerURL))
+	a.discoveries[issuerURL] = discovery
+
+	return discovery, true
+}
+
+// transport wraps the transport of an upstream with the OIDC client credentials of the given configuration, if any.
+// The client secret is named as given in the errors, e.g. -oidc.client-secret. Getting it and discovering the token URL
+// of the issuer are steps of the startup, retried while the secret store or the issuer can't be reached.
+func (a *upstreamAuth) transport(ctx context.Context, c oidcConfig, secretName string, base http.RoundTripper) http.RoundTripper {
+	if c.issuerURL == "" {
+		return base
+	}
+
+	secrets := a.resolver()
+	a.startup.add(secretName, func(ctx context.Context) error {
+		if _, err := secrets.Secret(ctx, c.clientSecret); err != nil {
+			return classError(syncer.ErrorConfig, "failed to get %s: %w", secretName, err)
+		}
+		return nil
+	})
+
+	if discovery, created := a.discovery(c.issuerURL); created {
+		a.startup.add("the OIDC discovery of "+c.issuerURL, func(ctx context.Context) error {
+			discovery.start(ctx, a.cfg.oidcDiscovery.startupTimeout)
+			return nil
+		})
+	}
+
+	return a.oidcTransport(ctx, c, base)
+}
+
+// oidcTransport wraps the transport with the OIDC client credentials of the given configuration. The client secret
+// and the token URL of the issuer are only got on the first token exchange, e.g. for the credentials of tenants
+// configured after the startup.
+func (a *upstreamAuth) oidcTransport(ctx context.Context, c oidcConfig, base http.RoundTripper) http.RoundTripper {
+	secrets := a.resolver()
+	discovery, _ := a.discovery(c.issuerURL)
+	ccc := clientcredentials.Config{
+		ClientID: c.clientID,
+	}
+	if c.audience != "" {
+		ccc.EndpointParams = url.Values{
+			"audience": []string{c.audience},
+		}
+	}
+
+	// Describe the exchange for troubleshooting, without the client secret.
+	description := fmt.Sprintf("issuer %s, client ID %s, audience %q", c.issuerURL, c.clientID, c.audience)
+	log.Printf("using OIDC client credentials: %s", description)
+
+	// The client secret is resolved for each exchange, so that a rotated secret is used.
+	// The token URL is discovered again once its refresh interval is over.
+	exchange := func(ctx context.Context) (*oauth2.Token, error) {
+		tokenURL, err := discovery.TokenURL(ctx)
+		if err != nil {
+			return nil, err
+		}
+		clientSecret, err := secrets.Secret(ctx, c.clientSecret)
+		if err != nil {
+			return nil, err
+		}
+		ccc := ccc
+		ccc.TokenURL, ccc.ClientSecret = tokenURL, clientSecret
+		return ccc.Token(ctx)
+	}
+
+	return &oauth2.Transport{
+		Base:   base,
+		Source: a.tokenSources().NewTokenSource(ctx, description, exchange),
+	}
+}
+
+// tenantClients returns the clients querying the Observatorium API for tenants, authenticated with the OIDC client
+// credentials of the tenants that have their own, e.g. tenants of another IdP, and the default client otherwise.
+// The clients of the same credentials are shared.
+type tenantClients struct {
+	ctx  context.Context
+	auth *upstreamAuth
+	// base is the transport the clients of tenants authenticate the requests of, without the credentials of the flags.
+	base          http.RoundTripper
+	defaultClient *http.Client
+
+	mu      sync.Mutex
+	clients map[TenantOIDCConfig]*http.Client
+}
+
+func newTenantClients(ctx context.Context, auth *upstreamAuth, base http.RoundTripper, defaultClient *http.Client) *tenantClients {
+	return &tenantClients{
+		ctx:           auth.oauthContext(ctx),
+		auth:          auth,
+		base:          base,
+		defaultClient: defaultClient,
+		clients:       map[TenantOIDCConfig]*http.Client{},
+	}
+}
+
+// client returns the client of the tenant.
+func (c *tenantClients) client(tenant TenantConfig) *http.Client {
+	if tenant.OIDC == nil {
+		return c.defaultClient
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, ok := c.clients[*tenant.OIDC]
+	if !ok {
+		transport := c.auth.oidcTransport(c.ctx, oidcConfig{
+			audience:     tenant.OIDC.Audience,
+			clientID:     tenant.OIDC.ClientID,
+			clientSecret: tenant.OIDC.ClientSecret,
+			issuerURL:    tenant.OIDC.IssuerURL,
+		}, c.base)
+		// The rate limit announced to the credentials of the flags doesn't apply to the ones of the tenant.
+		client = retryableClient(transport)
+		c.clients[*tenant.OIDC] = client
+	}
+
+	return client
+}
+
+// include returns the client requesting a document included in the rules of a tenant, authenticated with its bearer
+// token or OIDC client credentials, if any, but never with the credentials of the flags, as it is outside of the upstream.
+func (c *tenantClients) include(include IncludeRulesConfig) *http.Client {
+	switch {
+	case include.OIDC != nil:
+		return c.client(TenantConfig{OIDC: include.OIDC})
+	case include.BearerToken != "":
+		return retryableClient(&bearerTransport{token: include.BearerToken, secrets: c.auth.resolver(), base: c.base})
+	default:
+		return retryableClient(c.base)
+	}
+}
+
+// retryableClient returns a client retrying the failed requests of the transport.
+func retryableClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{Transport: fetch.NewRetryableTransport(&fetch.RetryableTransportCfg{
+		Transport:       transport,
+		InitialInterval: 200 * time.Millisecond,
+		MaxInterval:     2 * time.Second,
+		MaxElapsedTime:  10 * time.Second,
+	})}
+}
+
+// bearerTransport authenticates requests with a bearer token, or the secret it refers to, got on each request so that
+// rotated secrets are used once the cache of the resolver expires.
+type bearerTransport struct {
+	token   string
+	secrets *secret.Resolver
+	base    http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.secrets.Secret(req.Context(), t.token)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("failed to get bearer token: %w", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+func TestTokenSourceInstrumenter(t *testing.T) {
+	testCases := map[string]struct {
+		responseStatus int
+		responseBody   string
+
+		expectErr        bool
+		expectErrorClass string
+		expectTTL        bool
+	}{
+		"successful exchange": {
+			responseStatus: http.StatusOK,
+			responseBody:   `{"access_token":"token","token_type":"Bearer","expires_in":3600}`,
+			expectTTL:      true,
+		},
+		"rejected exchange": {
+			responseStatus:   http.StatusUnauthorized,
+			responseBody:     `{"error":"invalid_client"}`,
+			expectErr:        true,
+			expectErrorClass: tokenErrorRejected,
+		},
+		"server error": {
+			responseStatus:   http.StatusBadGateway,
+			expectErr:        true,
+			expectErrorClass: tokenErrorServer,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.responseStatus)
+				_, _ = w.Write([]byte(tc.responseBody))
+			}))
+			defer server.Close()
+
+			ccc := clientcredentials.Config{ClientID: "id", ClientSecret: "secret", TokenURL: server.URL}
+			ins := newTokenSourceInstrumenter(prometheus.NewRegistry())
+			_, err := ins.NewTokenSource(context.Background(), "test", ccc.Token).Token()
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.Equal(t, 1.0, testutil.ToFloat64(ins.exchangeFailures.WithLabelValues(tc.expectErrorClass)))
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, 1, testutil.CollectAndCount(ins.exchangeDuration))
+			if tc.expectTTL {
+				assert.InDelta(t, 3600, testutil.ToFloat64(ins.tokenTTL), 10)
+			} else {
+				assert.Equal(t, 0.0, testutil.ToFloat64(ins.tokenTTL))
+			}
+		})
+	}
+}
+
+func TestTenantClients(t *testing.T) {
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer": %q, "token_endpoint": %q}`, issuer.URL, issuer.URL+"/token")
+		case "/token":
+			clientID, clientSecret, _ := r.BasicAuth()
+			if clientSecret != "secret-"+clientID {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token": "token-%s", "token_type": "bearer", "expires_in": 3600}`, clientID)
+		}
+	}))
+	defer issuer.Close()
+
+	var authorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	r := prometheus.NewRegistry()
+	auth := newUpstreamAuth(&config{}, newStartup(r, 0), http.DefaultTransport, newRoundTripperInstrumenter(r), r)
+	defaultClient := &http.Client{}
+	clients := newTenantClients(context.Background(), auth, http.DefaultTransport, defaultClient)
+
+	credentials := func(clientID string) *TenantOIDCConfig {
+		return &TenantOIDCConfig{IssuerURL: issuer.URL, ClientID: clientID, ClientSecret: "secret-" + clientID}
+	}
+
+	// Tenants without their own credentials share the default client.
+	assert.Same(t, defaultClient, clients.client(TenantConfig{ID: "tenant1"}))
+
+	testCases := map[string]struct {
+		tenant TenantConfig
+
+		expectErr           bool
+		expectAuthorization string
+	}{
+		"own credentials": {
+			tenant:              TenantConfig{ID: "tenant2", OIDC: credentials("team-a")},
+			expectAuthorization: "Bearer token-team-a",
+		},
+		"other credentials": {
+			tenant:              TenantConfig{ID: "tenant3", OIDC: credentials("team-b")},
+			expectAuthorization: "Bearer token-team-b",
+		},
+		"rejected credentials": {
+			tenant:    TenantConfig{ID: "tenant4", OIDC: &TenantOIDCConfig{IssuerURL: issuer.URL, ClientID: "team-c", ClientSecret: "wrong"}},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			authorization = ""
+			res, err := clients.client(tc.tenant).Get(upstream.URL)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			res.Body.Close()
+			assert.Equal(t, tc.expectAuthorization, authorization)
+		})
+	}
+
+	// Tenants with the same credentials share their client.
+	assert.Same(t, clients.client(TenantConfig{ID: "tenant2", OIDC: credentials("team-a")}), clients.client(TenantConfig{ID: "tenant5", OIDC: credentials("team-a")}))
+}
+
+func TestTenantClientsInclude(t *testing.T) {
+	var authorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	r := prometheus.NewRegistry()
+	auth := newUpstreamAuth(&config{}, newStartup(r, 0), http.DefaultTransport, newRoundTripperInstrumenter(r), r)
+	// The default client has the credentials of the flags, which must not be sent outside of the upstream.
+	defaultClient := &http.Client{Transport: &bearerTransport{token: "upstream", secrets: auth.resolver(), base: http.DefaultTransport}}
+	clients := newTenantClients(context.Background(), auth, http.DefaultTransport, defaultClient)
+	t.Setenv("INCLUDE_TOKEN", "token-from-env")
+
+	testCases := map[string]struct {
+		include IncludeRulesConfig
+
+		expectAuthorization string
+	}{
+		"without credentials": {
+			include: IncludeRulesConfig{URL: upstream.URL},
+		},
+		"bearer token": {
+			include:             IncludeRulesConfig{URL: upstream.URL, BearerToken: "token"},
+			expectAuthorization: "Bearer token",
+		},
+		"bearer token reference": {
+			include:             IncludeRulesConfig{URL: upstream.URL, BearerToken: "env:INCLUDE_TOKEN"},
+			expectAuthorization: "Bearer token-from-env",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			authorization = ""
+			res, err := clients.include(tc.include).Get(tc.include.URL)
+			assert.NoError(t, err)
+			res.Body.Close()
+			assert.Equal(t, tc.expectAuthorization, authorization)
+		})
+	}
+}
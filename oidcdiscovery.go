@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/coreos/go-oidc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type oidcDiscoveryConfig struct {
+	refreshInterval time.Duration
+	startupTimeout  time.Duration
+	cacheFile       string
+}
+
+// oidcDiscovery caches the token URL of an OIDC issuer, discovered from its discovery document, so that a briefly
+// unreachable issuer, e.g. during the boot of a node, neither fails the start nor the token exchanges once it was
+// discovered. The token URL is discovered again once it is older than the refresh interval, the cached one being
+// kept if that fails. It can be persisted to a cache file shared by the issuers, to be used on the next start.
+type oidcDiscovery struct {
+	issuerURL string
+	client    *http.Client
+	refresh   time.Duration
+	cache     *oidcDiscoveryCache
+	failures  prometheus.Counter
+
+	mu         sync.Mutex
+	tokenURL   string
+	discovered time.Time
+}
+
+func newOIDCDiscovery(issuerURL string, client *http.Client, refresh time.Duration, cache *oidcDiscoveryCache, failures prometheus.Counter) *oidcDiscovery {
+	d := &oidcDiscovery{
+		issuerURL: issuerURL,
+		client:    client,
+		refresh:   refresh,
+		cache:     cache,
+		failures:  failures,
+	}
+	if tokenURL, ok := cache.tokenURL(issuerURL); ok {
+		// The cached token URL is used until it is discovered again, which is tried right away.
+		d.tokenURL = tokenURL
+	}
+
+	return d
+}
+
+// start discovers the token URL, retrying with backoff within the timeout. If it still fails, the token URL of the cache
+// file is used if any, and it is discovered again on the next token exchange otherwise, instead of failing the start.
+func (d *oidcDiscovery) start(ctx context.Context, timeout time.Duration) {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = timeout
+
+	err := backoff.RetryNotify(func() error {
+		return d.discover(ctx)
+	}, backoff.WithContext(b, ctx), func(err error, next time.Duration) {
+		log.Printf("OIDC discovery of issuer %s failed, retrying in %s: %v", d.issuerURL, next.Round(time.Millisecond), err)
+	})
+	if err == nil {
+		return
+	}
+
+	if tokenURL, ok := d.cached(); ok {
+		log.Printf("OIDC discovery of issuer %s failed, using the cached token URL %s: %v", d.issuerURL, tokenURL, err)
+		return
+	}
+	log.Printf("OIDC discovery of issuer %s failed, it is retried on the next token exchange: %v", d.issuerURL, err)
+}
+
+// TokenURL returns the token URL of the issuer, discovering it again if it is older than the refresh interval.
+// The cached token URL is returned if discovering it fails, and the error only if there is none.
+func (d *oidcDiscovery) TokenURL(ctx context.Context) (string, error) {
+	d.mu.Lock()
+	tokenURL, stale := d.tokenURL, time.Since(d.discovered) >= d.refresh
+	d.mu.Unlock()
+
+	if !stale {
+		return tokenURL, nil
+	}
+
+	err := d.discover(ctx)
+	if err == nil {
+		tokenURL, _ = d.cached()
+		return tokenURL, nil
+	}
+	if tokenURL == "" {
+		return "", fmt.Errorf("OIDC discovery of issuer %s failed: %w", d.issuerURL, err)
+	}
+	log.Printf("OIDC discovery of issuer %s failed, using the cached token URL: %v", d.issuerURL, err)
+
+	return tokenURL, nil
+}
+
+// cached returns the token URL last discovered or read from the cache file, if any.
+func (d *oidcDiscovery) cached() (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.tokenURL, d.tokenURL != ""
+}
+
+// discover discovers the token URL of the issuer and caches it.
+func (d *oidcDiscovery) discover(ctx context.Context) error {
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, d.client), d.issuerURL)
+	if err != nil {
+		d.failures.Inc()
+		return err
+	}
+	tokenURL := provider.Endpoint().TokenURL
+
+	d.mu.Lock()
+	if tokenURL != d.tokenURL {
+		log.Printf("discovered the token URL %s of OIDC issuer %s", tokenURL, d.issuerURL)
+	}
+	d.tokenURL, d.discovered = tokenURL, time.Now()
+	d.mu.Unlock()
+
+	if err := d.cache.setTokenURL(d.issuerURL, tokenURL); err != nil {
+		log.Printf("failed to write the OIDC discovery cache file: %v", err)
+	}
+
+	return nil
+}
+
+// oidcDiscoveryCache is the cache file of the token URLs of the OIDC issuers, by issuer URL. A nil cache has no file.
+type oidcDiscoveryCache struct {
+	path string
+
+	mu        sync.Mutex
+	tokenURLs map[string]string
+}
+
+// readOIDCDiscoveryCache reads the cache file at the given path. A missing or invalid file is an empty cache.
+func readOIDCDiscoveryCache(path string) *oidcDiscoveryCache {
+	if path == "" {
+		return nil
+	}
+
+	c := &oidcDiscoveryCache{path: path, tokenURLs: map[string]string{}}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to read the OIDC discovery cache file: %v", err)
+		}
+		return c
+	}
+	if err := json.Unmarshal(content, &c.tokenURLs); err != nil {
+		log.Printf("failed to unmarshal the OIDC discovery cache file, ignoring it: %v", err)
+		c.tokenURLs = map[string]string{}
+	}
+
+	return c
+}
+
+func (c *oidcDiscoveryCache) tokenURL(issuerURL string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tokenURL, ok := c.tokenURLs[issuerURL]
+	return tokenURL, ok
+}
+
+// setTokenURL caches the token URL of the issuer, writing the cache file if it changed.
+func (c *oidcDiscoveryCache) setTokenURL(issuerURL, tokenURL string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tokenURLs[issuerURL] == tokenURL {
+		return nil
+	}
+	c.tokenURLs[issuerURL] = tokenURL
+
+	content, err := json.Marshal(c.tokenURLs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache: %w", err)
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("failed to rename cache: %w", err)
+	}
+
+	return nil
+}
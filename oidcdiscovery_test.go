@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestIssuer returns an OIDC issuer serving its discovery document while it is up.
+func newTestIssuer(t *testing.T, up *atomic.Bool) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() || r.URL.Path != "/.well-known/openid-configuration" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"issuer": %q, "token_endpoint": %q}`, server.URL, server.URL+"/token")
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	var up atomic.Bool
+	issuer := newTestIssuer(t, &up)
+	cacheFile := filepath.Join(t.TempDir(), "discovery.json")
+	failures := prometheus.NewCounter(prometheus.CounterOpts{Name: "failures"})
+
+	// The start doesn't fail while the issuer is unreachable, the token URL is discovered on the next exchange.
+	d := newOIDCDiscovery(issuer.URL, issuer.Client(), time.Hour, readOIDCDiscoveryCache(cacheFile), failures)
+	d.start(context.Background(), 10*time.Millisecond)
+	_, err := d.TokenURL(context.Background())
+	assert.ErrorContains(t, err, "OIDC discovery of issuer "+issuer.URL+" failed")
+
+	up.Store(true)
+	tokenURL, err := d.TokenURL(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, issuer.URL+"/token", tokenURL)
+	failed := testutil.ToFloat64(failures)
+	assert.Equal(t, 2.0, failed)
+
+	// The token URL is cached until the refresh interval is over, and kept if discovering it again fails.
+	up.Store(false)
+	tokenURL, err = d.TokenURL(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, issuer.URL+"/token", tokenURL)
+	assert.Equal(t, failed, testutil.ToFloat64(failures))
+
+	d.refresh = 0
+	tokenURL, err = d.TokenURL(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, issuer.URL+"/token", tokenURL)
+	assert.Equal(t, failed+1, testutil.ToFloat64(failures))
+
+	// The token URL of the cache file is used on the next start while the issuer is unreachable.
+	restarted := newOIDCDiscovery(issuer.URL, issuer.Client(), time.Hour, readOIDCDiscoveryCache(cacheFile), failures)
+	restarted.start(context.Background(), 10*time.Millisecond)
+	tokenURL, err = restarted.TokenURL(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, issuer.URL+"/token", tokenURL)
+}
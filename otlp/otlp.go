@@ -0,0 +1,429 @@
+// Package otlp exports the metrics of the syncer to an OpenTelemetry collector with the OTLP/HTTP protocol, for the
+// fleets whose collectors don't scrape the internal server.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// serviceName is the service.name resource attribute of the exported metrics.
+const serviceName = "thanos-rule-syncer"
+
+const defaultTimeout = 10 * time.Second
+
+// aggregationTemporalityCumulative is the temporality of the sums and histograms, which are exported as cumulative
+// like they are scraped.
+const aggregationTemporalityCumulative = 2
+
+// Exporter pushes the metrics gathered from a Prometheus registry to an OTLP/HTTP endpoint at an interval, so that the
+// same metrics are served on /metrics and exported. Their names and labels are kept as they are.
+type Exporter struct {
+	gatherer prometheus.Gatherer
+	url      *url.URL
+	interval time.Duration
+	client   *http.Client
+	timeout  time.Duration
+	headers  map[string]string
+	clock    clock.Clock
+
+	// start is the start time of the cumulative metrics not telling when they were created.
+	start    time.Time
+	resource resource
+
+	exports *prometheus.CounterVec
+}
+
+// Option configures an Exporter.
+type Option func(*Exporter)
+
+// WithClient sets the client of the requests to the endpoint.
+func WithClient(client *http.Client) Option {
+	return func(e *Exporter) {
+		e.client = client
+	}
+}
+
+// WithTimeout sets how long an export can take before it fails.
+func WithTimeout(timeout time.Duration) Option {
+	return func(e *Exporter) {
+		if timeout > 0 {
+			e.timeout = timeout
+		}
+	}
+}
+
+// WithHeaders sets headers of the requests to the endpoint, e.g. for authentication.
+func WithHeaders(headers map[string]string) Option {
+	return func(e *Exporter) {
+		e.headers = headers
+	}
+}
+
+// WithClock sets the clock timing the exports.
+func WithClock(c clock.Clock) Option {
+	return func(e *Exporter) {
+		e.clock = c
+	}
+}
+
+// NewExporter creates a new Exporter of the metrics of the gatherer to the OTLP/HTTP metrics endpoint at the given URL,
+// e.g. http://otel-collector:4318/v1/metrics, at the given interval. Its metrics are registered with the given
+// registerer, if not nil.
+func NewExporter(reg prometheus.Registerer, g prometheus.Gatherer, u *url.URL, interval time.Duration, opts ...Option) *Exporter {
+	e := &Exporter{
+		gatherer: g,
+		url:      u,
+		interval: interval,
+		client:   http.DefaultClient,
+		timeout:  defaultTimeout,
+		clock:    clock.Real(),
+		exports: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_otlp_exports_total",
+			Help: "Total number of exports of metrics to the OTLP endpoint, by result.",
+		}, []string{"result"}),
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	e.start = e.clock.Now()
+	e.resource.Attributes = []attribute{stringAttribute("service.name", serviceName)}
+	if hostname, err := os.Hostname(); err == nil {
+		e.resource.Attributes = append(e.resource.Attributes, stringAttribute("service.instance.id", hostname))
+	}
+
+	if reg != nil {
+		reg.MustRegister(e.exports)
+	}
+
+	return e
+}
+
+// Run exports the metrics at the interval until the context is done, and a last time then so that the last values
+// aren't lost. Failures to export are logged and counted, and don't stop the next exports.
+func (e *Exporter) Run(ctx context.Context) error {
+	ticker := e.clock.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// The context of the last export isn't the one done.
+			if err := e.Export(context.Background()); err != nil {
+				log.Printf("failed to export metrics: %v", err)
+			}
+			return nil
+		case <-ticker.C():
+		}
+
+		if err := e.Export(ctx); err != nil {
+			log.Printf("failed to export metrics: %v", err)
+		}
+	}
+}
+
+// Export gathers the metrics and pushes them to the endpoint.
+func (e *Exporter) Export(ctx context.Context) error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		e.exports.WithLabelValues("failure").Inc()
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	content, err := json.Marshal(e.request(families, e.clock.Now()))
+	if err != nil {
+		e.exports.WithLabelValues("failure").Inc()
+		return fmt.Errorf("failed to marshal metrics: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	if err := e.push(ctx, content); err != nil {
+		e.exports.WithLabelValues("failure").Inc()
+		return err
+	}
+	e.exports.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+func (e *Exporter) push(ctx context.Context, content []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url.String(), bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("got unexpected status from the OTLP endpoint: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// request converts the metric families to an export request of the OTLP JSON encoding. Counters are exported as
+// monotonic sums, gauges and untyped metrics as gauges, and histograms and summaries as histograms and summaries with
+// their classic buckets and quantiles.
+func (e *Exporter) request(families []*dto.MetricFamily, now time.Time) exportRequest {
+	metrics := make([]metric, 0, len(families))
+	for _, family := range families {
+		m := metric{Name: family.GetName(), Description: family.GetHelp()}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			m.Sum = &sum{AggregationTemporality: aggregationTemporalityCumulative, IsMonotonic: true}
+			for _, sample := range family.GetMetric() {
+				m.Sum.DataPoints = append(m.Sum.DataPoints, numberDataPoint{
+					Attributes:        attributes(sample.GetLabel()),
+					StartTimeUnixNano: e.startOf(sample.GetCounter().GetCreatedTimestamp().AsTime(), sample.GetCounter().GetCreatedTimestamp() != nil),
+					TimeUnixNano:      unixNano(now),
+					AsDouble:          number(sample.GetCounter().GetValue()),
+				})
+			}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			m.Gauge = &gauge{}
+			for _, sample := range family.GetMetric() {
+				value := sample.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = sample.GetUntyped().GetValue()
+				}
+				m.Gauge.DataPoints = append(m.Gauge.DataPoints, numberDataPoint{
+					Attributes:   attributes(sample.GetLabel()),
+					TimeUnixNano: unixNano(now),
+					AsDouble:     number(value),
+				})
+			}
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			m.Histogram = &histogram{AggregationTemporality: aggregationTemporalityCumulative}
+			for _, sample := range family.GetMetric() {
+				m.Histogram.DataPoints = append(m.Histogram.DataPoints, e.histogramDataPoint(sample, now))
+			}
+		case dto.MetricType_SUMMARY:
+			m.Summary = &summary{}
+			for _, sample := range family.GetMetric() {
+				s := sample.GetSummary()
+				point := summaryDataPoint{
+					Attributes:        attributes(sample.GetLabel()),
+					StartTimeUnixNano: e.startOf(s.GetCreatedTimestamp().AsTime(), s.GetCreatedTimestamp() != nil),
+					TimeUnixNano:      unixNano(now),
+					Count:             strconv.FormatUint(s.GetSampleCount(), 10),
+					Sum:               number(s.GetSampleSum()),
+					QuantileValues:    []quantileValue{},
+				}
+				for _, q := range s.GetQuantile() {
+					point.QuantileValues = append(point.QuantileValues, quantileValue{Quantile: q.GetQuantile(), Value: number(q.GetValue())})
+				}
+				m.Summary.DataPoints = append(m.Summary.DataPoints, point)
+			}
+		default:
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+
+	return exportRequest{ResourceMetrics: []resourceMetrics{{
+		Resource: e.resource,
+		ScopeMetrics: []scopeMetrics{{
+			Scope:   scope{Name: serviceName},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+// histogramDataPoint converts the cumulative buckets of a Prometheus histogram to the counts of the buckets between
+// its bounds, the last one being above the last bound.
+func (e *Exporter) histogramDataPoint(sample *dto.Metric, now time.Time) histogramDataPoint {
+	h := sample.GetHistogram()
+	point := histogramDataPoint{
+		Attributes:        attributes(sample.GetLabel()),
+		StartTimeUnixNano: e.startOf(h.GetCreatedTimestamp().AsTime(), h.GetCreatedTimestamp() != nil),
+		TimeUnixNano:      unixNano(now),
+		Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+		Sum:               number(h.GetSampleSum()),
+		BucketCounts:      []string{},
+		ExplicitBounds:    []float64{},
+	}
+
+	var cumulative uint64
+	for _, bucket := range h.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		point.ExplicitBounds = append(point.ExplicitBounds, bucket.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(bucket.GetCumulativeCount()-cumulative, 10))
+		cumulative = bucket.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(h.GetSampleCount()-cumulative, 10))
+
+	return point
+}
+
+// startOf returns the start time of a cumulative metric, when it was created if known, or else when the exporter was.
+func (e *Exporter) startOf(created time.Time, known bool) string {
+	if known {
+		return unixNano(created)
+	}
+	return unixNano(e.start)
+}
+
+func attributes(labels []*dto.LabelPair) []attribute {
+	attrs := make([]attribute, 0, len(labels))
+	for _, label := range labels {
+		attrs = append(attrs, stringAttribute(label.GetName(), label.GetValue()))
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+
+	return attrs
+}
+
+// unixNano returns the time in the encoding of the fixed64 fields of OTLP JSON, a string.
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// number is a float64 encoded like the double fields of OTLP JSON, which are strings for non-finite values.
+type number float64
+
+func (n number) MarshalJSON() ([]byte, error) {
+	switch f := float64(n); {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	default:
+		return json.Marshal(f)
+	}
+}
+
+// The types of the OTLP JSON encoding of an export request of metrics.
+type (
+	exportRequest struct {
+		ResourceMetrics []resourceMetrics `json:"resourceMetrics"`
+	}
+	resourceMetrics struct {
+		Resource     resource       `json:"resource"`
+		ScopeMetrics []scopeMetrics `json:"scopeMetrics"`
+	}
+	resource struct {
+		Attributes []attribute `json:"attributes"`
+	}
+	scopeMetrics struct {
+		Scope   scope    `json:"scope"`
+		Metrics []metric `json:"metrics"`
+	}
+	scope struct {
+		Name string `json:"name"`
+	}
+	attribute struct {
+		Key   string         `json:"key"`
+		Value attributeValue `json:"value"`
+	}
+	attributeValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	metric struct {
+		Name        string     `json:"name"`
+		Description string     `json:"description,omitempty"`
+		Gauge       *gauge     `json:"gauge,omitempty"`
+		Sum         *sum       `json:"sum,omitempty"`
+		Histogram   *histogram `json:"histogram,omitempty"`
+		Summary     *summary   `json:"summary,omitempty"`
+	}
+	gauge struct {
+		DataPoints []numberDataPoint `json:"dataPoints"`
+	}
+	sum struct {
+		DataPoints             []numberDataPoint `json:"dataPoints"`
+		AggregationTemporality int               `json:"aggregationTemporality"`
+		IsMonotonic            bool              `json:"isMonotonic"`
+	}
+	histogram struct {
+		DataPoints             []histogramDataPoint `json:"dataPoints"`
+		AggregationTemporality int                  `json:"aggregationTemporality"`
+	}
+	summary struct {
+		DataPoints []summaryDataPoint `json:"dataPoints"`
+	}
+	numberDataPoint struct {
+		Attributes        []attribute `json:"attributes"`
+		StartTimeUnixNano string      `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string      `json:"timeUnixNano"`
+		AsDouble          number      `json:"asDouble"`
+	}
+	histogramDataPoint struct {
+		Attributes        []attribute `json:"attributes"`
+		StartTimeUnixNano string      `json:"startTimeUnixNano"`
+		TimeUnixNano      string      `json:"timeUnixNano"`
+		Count             string      `json:"count"`
+		Sum               number      `json:"sum"`
+		BucketCounts      []string    `json:"bucketCounts"`
+		ExplicitBounds    []float64   `json:"explicitBounds"`
+	}
+	summaryDataPoint struct {
+		Attributes        []attribute     `json:"attributes"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               number          `json:"sum"`
+		QuantileValues    []quantileValue `json:"quantileValues"`
+	}
+	quantileValue struct {
+		Quantile float64 `json:"quantile"`
+		Value    number  `json:"value"`
+	}
+)
+
+func stringAttribute(key, value string) attribute {
+	return attribute{Key: key, Value: attributeValue{StringValue: value}}
+}
+
+// ReadHeadersFile reads the headers of the requests to the endpoint from a file, one "Name: value" per line. Empty
+// lines and lines starting with # are ignored.
+func ReadHeadersFile(file string) (map[string]string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read headers file: %w", err)
+	}
+
+	headers := map[string]string{}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("line %d: invalid header, must be Name: value", i+1)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	return headers, nil
+}
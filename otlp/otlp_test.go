@@ -0,0 +1,173 @@
+package otlp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var startTimeRegexp = regexp.MustCompile(`"startTimeUnixNano":"[0-9]+"`)
+
+func TestExporterExport(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	registry := prometheus.NewRegistry()
+	syncs := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "syncs_total", Help: "Total number of syncs."}, []string{"result"})
+	tenants := prometheus.NewGauge(prometheus.GaugeOpts{Name: "tenants", Help: "Number of tenants."})
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "sync_duration_seconds", Help: "Sync durations.", Buckets: []float64{1, 10}})
+	registry.MustRegister(syncs, tenants, duration)
+	syncs.WithLabelValues("success").Add(3)
+	tenants.Set(2)
+	duration.Observe(0.5)
+	duration.Observe(5)
+	duration.Observe(50)
+
+	testCases := map[string]struct {
+		status int
+
+		expectErr     bool
+		expectRequest string
+	}{
+		"exported": {
+			status: http.StatusOK,
+			expectRequest: `{"resourceMetrics": [{
+				"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "thanos-rule-syncer"}}]},
+				"scopeMetrics": [{"scope": {"name": "thanos-rule-syncer"}, "metrics": [
+					{"name": "sync_duration_seconds", "description": "Sync durations.", "histogram": {"aggregationTemporality": 2, "dataPoints": [{
+						"attributes": [], "startTimeUnixNano": "created", "timeUnixNano": "1704067260000000000",
+						"count": "3", "sum": 55.5, "bucketCounts": ["1", "1", "1"], "explicitBounds": [1, 10]
+					}]}},
+					{"name": "syncs_total", "description": "Total number of syncs.", "sum": {"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": [{
+						"attributes": [{"key": "result", "value": {"stringValue": "success"}}], "startTimeUnixNano": "created", "timeUnixNano": "1704067260000000000",
+						"asDouble": 3
+					}]}},
+					{"name": "tenants", "description": "Number of tenants.", "gauge": {"dataPoints": [{
+						"attributes": [], "timeUnixNano": "1704067260000000000", "asDouble": 2
+					}]}}
+				]}]
+			}]}`,
+		},
+		"failed": {
+			status:    http.StatusServiceUnavailable,
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var request string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/v1/metrics", r.URL.Path)
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+				body, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				request = string(body)
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			u, err := url.Parse(server.URL + "/v1/metrics")
+			assert.NoError(t, err)
+			c := clock.NewFake(now)
+			e := NewExporter(nil, registry, u, time.Minute, WithClock(c), WithHeaders(map[string]string{"Authorization": "Bearer token"}))
+			// The host doesn't matter to the test.
+			e.resource.Attributes = e.resource.Attributes[:1]
+			c.Advance(time.Minute)
+
+			err = e.Export(context.Background())
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.Equal(t, 1.0, testutil.ToFloat64(e.exports.WithLabelValues("failure")))
+				return
+			}
+			assert.NoError(t, err)
+			// The counters and histograms start when they are created.
+			assert.JSONEq(t, tc.expectRequest, startTimeRegexp.ReplaceAllString(request, `"startTimeUnixNano":"created"`))
+			assert.Equal(t, 1.0, testutil.ToFloat64(e.exports.WithLabelValues("success")))
+		})
+	}
+}
+
+func TestExporterRun(t *testing.T) {
+	var mtx sync.Mutex
+	exports := 0
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		exports++
+	}))
+	defer server.Close()
+	exported := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return exports
+	}
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	e := NewExporter(nil, prometheus.NewRegistry(), u, time.Minute, WithClock(c))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, e.Run(ctx))
+	}()
+
+	// The metrics are exported at the interval.
+	c.BlockUntil(ctx, 1)
+	c.Advance(time.Minute)
+	assert.Eventually(t, func() bool { return exported() == 1 }, time.Second, 10*time.Millisecond)
+
+	// And a last time once the context is done.
+	cancel()
+	<-done
+	assert.Equal(t, 2, exported())
+}
+
+func TestReadHeadersFile(t *testing.T) {
+	testCases := map[string]struct {
+		content string
+
+		expectErr     bool
+		expectHeaders map[string]string
+	}{
+		"headers": {
+			content:       "# Collector credentials.\nAuthorization: Bearer token\n\nX-Scope-OrgID:  tenant \n",
+			expectHeaders: map[string]string{"Authorization": "Bearer token", "X-Scope-OrgID": "tenant"},
+		},
+		"invalid header": {
+			content:   "Authorization Bearer token\n",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "headers")
+			assert.NoError(t, os.WriteFile(file, []byte(tc.content), 0o600))
+
+			headers, err := ReadHeadersFile(file)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectHeaders, headers)
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// Capacity guards the ruler against rules exceeding its known capacity, e.g. so many rules that it runs out of memory.
+// When the rules exceed it, the rules of whole tenants are dropped, lowest priority first, until the others fit,
+// and the rules aren't written at all if the tenant with the highest priority doesn't fit by itself.
+type Capacity struct {
+	groupTenant func(groupName string) string
+	// maxRules and maxBytes are the maximum numbers of rules and bytes of the rules, or 0 if they aren't limited.
+	maxRules int
+	maxBytes int
+
+	mu         sync.Mutex
+	priorities map[string]int
+
+	droppedTenants *prometheus.GaugeVec
+	blocked        prometheus.Counter
+}
+
+// NewCapacity creates a new Capacity limiting the rules to maxRules rules and maxBytes bytes, if not 0.
+// The tenant owning a group is given by groupTenant. Its metrics are registered with the given registerer, if not nil.
+func NewCapacity(r prometheus.Registerer, groupTenant func(groupName string) string, maxRules, maxBytes int) *Capacity {
+	c := &Capacity{
+		groupTenant: groupTenant,
+		maxRules:    maxRules,
+		maxBytes:    maxBytes,
+		droppedTenants: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_output_capacity_dropped_tenant",
+			Help: "Whether the rules of the tenant were dropped from the last synced rules because they exceeded the capacity of the ruler.",
+		}, []string{"tenant"}),
+		blocked: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_output_capacity_blocked_total",
+			Help: "Total number of syncs whose rules weren't written because they exceeded the capacity of the ruler.",
+		}),
+	}
+
+	if r != nil {
+		r.MustRegister(c.droppedTenants, c.blocked)
+	}
+
+	return c
+}
+
+// SetPriorities replaces the priorities of the tenants. The rules of tenants with lower priorities are dropped first,
+// and tenants without a priority have the priority 0.
+func (c *Capacity) SetPriorities(priorities map[string]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.priorities = priorities
+}
+
+// tenantUsage is the share of the capacity of the ruler used by the rules of a tenant.
+type tenantUsage struct {
+	tenant   string
+	priority int
+	rules    int
+	bytes    int
+}
+
+// Check returns the rules unchanged if they fit in the capacity of the ruler, the rules without the tenants
+// dropped for the others to fit otherwise, or an error if the tenant with the highest priority doesn't fit.
+func (c *Capacity) Check(_ context.Context, content []byte) ([]byte, error) {
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	c.droppedTenants.Reset()
+
+	total := 0
+	for _, group := range groups.Groups {
+		total += len(group.Rules)
+	}
+	if c.fits(total, len(content)) {
+		return content, nil
+	}
+
+	c.mu.Lock()
+	priorities := c.priorities
+	c.mu.Unlock()
+
+	usages := map[string]*tenantUsage{}
+	for _, group := range groups.Groups {
+		tenant := c.groupTenant(group.Name)
+		usage, ok := usages[tenant]
+		if !ok {
+			usage = &tenantUsage{tenant: tenant, priority: priorities[tenant]}
+			usages[tenant] = usage
+		}
+
+		groupContent, err := yaml.Marshal(group)
+		if err != nil {
+			return nil, fmt.Errorf("group %q: failed to marshal rules: %w", group.Name, err)
+		}
+		usage.rules += len(group.Rules)
+		usage.bytes += len(groupContent)
+	}
+
+	// Tenants with the lowest priority are dropped first, and the largest of them first so that fewer are dropped.
+	order := make([]*tenantUsage, 0, len(usages))
+	for _, usage := range usages {
+		order = append(order, usage)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].priority != order[j].priority {
+			return order[i].priority < order[j].priority
+		}
+		if order[i].bytes != order[j].bytes {
+			return order[i].bytes > order[j].bytes
+		}
+		return order[i].tenant < order[j].tenant
+	})
+
+	// The sizes of the groups of the tenants are estimates of their share of the rules file,
+	// which is only marshalled again once the rules fit according to them.
+	dropped := map[string]struct{}{}
+	var droppedNames []string
+	keptRules, keptBytes := total, len(content)
+	for i := 0; i < len(order)-1; i++ {
+		usage := order[i]
+		dropped[usage.tenant] = struct{}{}
+		droppedNames = append(droppedNames, usage.tenant)
+		keptRules -= usage.rules
+		keptBytes -= usage.bytes
+		if !c.fits(keptRules, keptBytes) {
+			continue
+		}
+
+		kept, err := c.without(groups, dropped)
+		if err != nil {
+			return nil, err
+		}
+		if c.fits(keptRules, len(kept)) {
+			c.report(droppedNames, total, len(content), keptRules, len(kept))
+			return kept, nil
+		}
+		keptBytes = len(kept)
+	}
+
+	c.blocked.Inc()
+	if len(order) == 0 {
+		return nil, fmt.Errorf("rules of %d bytes exceed the capacity of the ruler of %s", len(content), c.limits())
+	}
+	return nil, fmt.Errorf("rules of %d rules and %d bytes exceed the capacity of the ruler of %s, even with only the rules of tenant %s", total, len(content), c.limits(), order[len(order)-1].tenant)
+}
+
+// fits returns whether rules of the given numbers of rules and bytes fit in the capacity of the ruler.
+func (c *Capacity) fits(ruleCount, byteCount int) bool {
+	return (c.maxRules == 0 || ruleCount <= c.maxRules) && (c.maxBytes == 0 || byteCount <= c.maxBytes)
+}
+
+// without returns the marshalled rules without the groups of the dropped tenants.
+func (c *Capacity) without(groups rules.RuleGroups, dropped map[string]struct{}) ([]byte, error) {
+	kept := rules.RuleGroups{Groups: make([]rules.RuleGroup, 0, len(groups.Groups))}
+	for _, group := range groups.Groups {
+		if _, ok := dropped[c.groupTenant(group.Name)]; !ok {
+			kept.Groups = append(kept.Groups, group)
+		}
+	}
+
+	content, err := yaml.Marshal(kept)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	return content, nil
+}
+
+// report logs and exposes the tenants whose rules were dropped.
+func (c *Capacity) report(dropped []string, totalRules, totalBytes, keptRules, keptBytes int) {
+	for _, tenant := range dropped {
+		c.droppedTenants.WithLabelValues(tenant).Set(1)
+	}
+	log.Printf("dropped the rules of tenants %s, as rules of %d rules and %d bytes exceed the capacity of the ruler of %s; %d rules and %d bytes are kept",
+		strings.Join(dropped, ", "), totalRules, totalBytes, c.limits(), keptRules, keptBytes)
+}
+
+// limits describes the capacity of the ruler.
+func (c *Capacity) limits() string {
+	var limits []string
+	if c.maxRules > 0 {
+		limits = append(limits, fmt.Sprintf("%d rules", c.maxRules))
+	}
+	if c.maxBytes > 0 {
+		limits = append(limits, fmt.Sprintf("%d bytes", c.maxBytes))
+	}
+
+	return strings.Join(limits, " and ")
+}
@@ -0,0 +1,118 @@
+package output
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+const capacityRules = `groups:
+- name: tenant-a.test
+  rules:
+  - record: a1
+    expr: vector(1)
+  - record: a2
+    expr: vector(1)
+- name: tenant-b.test
+  rules:
+  - record: b
+    expr: vector(1)
+- name: tenant-c.test
+  rules:
+  - record: c
+    expr: vector(1)
+`
+
+func TestCapacityCheck(t *testing.T) {
+	testCases := map[string]struct {
+		maxRules   int
+		maxBytes   int
+		priorities map[string]int
+
+		expectErr     string
+		expectGroups  []string
+		expectDropped []string
+	}{
+		"within capacity": {
+			maxRules:     4,
+			maxBytes:     len(capacityRules),
+			expectGroups: []string{"tenant-a.test", "tenant-b.test", "tenant-c.test"},
+		},
+		"largest tenant of the lowest priority dropped": {
+			maxRules:      3,
+			expectGroups:  []string{"tenant-b.test", "tenant-c.test"},
+			expectDropped: []string{"tenant-a"},
+		},
+		"lowest priority dropped": {
+			maxRules:      3,
+			priorities:    map[string]int{"tenant-a": 2, "tenant-b": 1},
+			expectGroups:  []string{"tenant-a.test", "tenant-b.test"},
+			expectDropped: []string{"tenant-c"},
+		},
+		"several tenants dropped": {
+			maxRules:      2,
+			priorities:    map[string]int{"tenant-a": 1},
+			expectGroups:  []string{"tenant-a.test"},
+			expectDropped: []string{"tenant-b", "tenant-c"},
+		},
+		"bytes exceeded": {
+			maxBytes:      len(capacityRules) - 1,
+			priorities:    map[string]int{"tenant-a": 1, "tenant-b": 1},
+			expectGroups:  []string{"tenant-a.test", "tenant-b.test"},
+			expectDropped: []string{"tenant-c"},
+		},
+		"highest priority exceeding the capacity": {
+			maxRules:   1,
+			priorities: map[string]int{"tenant-a": 1},
+			expectErr:  "exceed the capacity of the ruler of 1 rules, even with only the rules of tenant tenant-a",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c := NewCapacity(prometheus.NewRegistry(), groupTenant, tc.maxRules, tc.maxBytes)
+			c.SetPriorities(tc.priorities)
+
+			checked, err := c.Check(context.Background(), []byte(capacityRules))
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				assert.Equal(t, 1.0, testutil.ToFloat64(c.blocked))
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, c.fits(strings.Count(string(checked), "record:"), len(checked)))
+
+			var groups rules.RuleGroups
+			assert.NoError(t, yaml.Unmarshal(checked, &groups))
+			var names []string
+			for _, group := range groups.Groups {
+				names = append(names, group.Name)
+			}
+			assert.Equal(t, tc.expectGroups, names)
+
+			assert.Equal(t, len(tc.expectDropped), testutil.CollectAndCount(c.droppedTenants))
+			for _, tenant := range tc.expectDropped {
+				assert.Equal(t, 1.0, testutil.ToFloat64(c.droppedTenants.WithLabelValues(tenant)))
+			}
+		})
+	}
+}
+
+func TestCapacityCheckRecovered(t *testing.T) {
+	c := NewCapacity(nil, groupTenant, 3, 0)
+
+	_, err := c.Check(context.Background(), []byte(capacityRules))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, testutil.CollectAndCount(c.droppedTenants))
+
+	// Tenants are no longer reported as dropped once the rules fit again.
+	_, err = c.Check(context.Background(), []byte(tenantsRules))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, testutil.CollectAndCount(c.droppedTenants))
+}
@@ -0,0 +1,80 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// writeContentAddressed writes the rules to a file named after their hash, unless it already exists,
+// and atomically points the path of the File to it with a relative symbolic link.
+func (f *File) writeContentAddressed(ctx context.Context, rules io.Reader, owner *fileOwner) error {
+	content, err := io.ReadAll(&contextReader{ctx: ctx, r: rules})
+	if err != nil {
+		return fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	dir, base := filepath.Split(f.path)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	target := fmt.Sprintf("%s-%x%s", stem, sha256.Sum256(content), ext)
+
+	if _, err := os.Stat(filepath.Join(dir, target)); errors.Is(err, fs.ErrNotExist) {
+		if err := f.writeFile(ctx, filepath.Join(dir, target), bytes.NewReader(content), owner); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to check the rules file %s: %w", target, err)
+	}
+
+	// The previous target is kept for consumers still reading it.
+	previous, _ := os.Readlink(f.path)
+
+	link := f.path + ".tmp"
+	if err := os.Remove(link); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove the temporary link %s: %w", link, err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		return fmt.Errorf("failed to link %s to the rules file %s: %w", link, target, err)
+	}
+	if err := os.Rename(link, f.path); err != nil {
+		return fmt.Errorf("failed to replace %s with a link to the rules file %s: %w", f.path, target, err)
+	}
+
+	removeOldContentFiles(dir, stem, ext, target, previous)
+
+	return nil
+}
+
+// removeOldContentFiles removes the content-addressed rules files of the directory other than the given ones.
+// Failures are logged only, as old files don't prevent consumers from reading the current rules.
+func removeOldContentFiles(dir, stem, ext string, keep ...string) {
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(stem) + "-[0-9a-f]{64}" + regexp.QuoteMeta(ext) + "$")
+
+	entries, err := os.ReadDir(filepath.Join(dir, "."))
+	if err != nil {
+		log.Printf("failed to list old rules files: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !pattern.MatchString(name) || slices.Contains(keep, name) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			log.Printf("failed to remove old rules file %s: %v", name, err)
+		}
+	}
+}
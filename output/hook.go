@@ -0,0 +1,151 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Policies for the failures of the command of a Hook.
+const (
+	// HookFail fails the write, so that the ruler isn't reloaded and the rules are written again at the next sync cycle.
+	HookFail = "fail"
+	// HookWarn logs the failure and reloads the ruler anyway.
+	HookWarn = "warn"
+)
+
+// Environment variables set for the command of a Hook, in addition to the ones of the syncer.
+const (
+	HookEnvFile   = "RULES_FILE"
+	HookEnvSHA256 = "RULES_SHA256"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+// Hook runs a command after the rules are written by a Writer and before the ruler is reloaded, e.g. to copy
+// the rules file to peers or to invalidate caches. The command is run with the path of the rules and the hex
+// SHA-256 hash of the rules as arguments, also set in the RULES_FILE and RULES_SHA256 environment variables.
+// It only runs when the written rules differ from the rules of its last run.
+type Hook struct {
+	writer  Writer
+	path    string
+	command string
+	timeout time.Duration
+	policy  string
+
+	// lastHash is the hash of the rules of the last run of the command that didn't fail the write.
+	lastHash [sha256.Size]byte
+
+	runs *prometheus.CounterVec
+}
+
+// HookOption configures a Hook.
+type HookOption func(*Hook)
+
+// WithHookTimeout kills the command if it doesn't exit within the timeout, which is then a failure.
+func WithHookTimeout(timeout time.Duration) HookOption {
+	return func(h *Hook) {
+		h.timeout = timeout
+	}
+}
+
+// WithHookPolicy sets what happens when the command fails. One of HookFail or HookWarn.
+func WithHookPolicy(policy string) HookOption {
+	return func(h *Hook) {
+		h.policy = policy
+	}
+}
+
+// NewHook creates a new Hook running the executable at command after w writes the rules to path, which is given
+// to the command. Its metrics are registered with r if not nil.
+func NewHook(r prometheus.Registerer, w Writer, path, command string, opts ...HookOption) *Hook {
+	h := &Hook{
+		writer:  w,
+		path:    path,
+		command: command,
+		timeout: defaultHookTimeout,
+		policy:  HookFail,
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_post_write_cmd_runs_total",
+			Help: "Total number of runs of the command run after writing the rules, by result.",
+		}, []string{"result"}),
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if r != nil {
+		r.MustRegister(h.runs)
+	}
+
+	return h
+}
+
+// Pending tells whether the writer of the Hook has pending changes, see Pending.
+func (h *Hook) Pending() bool {
+	return Pending(h.writer)
+}
+
+// Write writes the rules with the writer of the Hook, then runs its command if the rules changed.
+func (h *Hook) Write(ctx context.Context, rules io.Reader) error {
+	content, err := io.ReadAll(&contextReader{ctx: ctx, r: rules})
+	if err != nil {
+		return fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	if err := h.writer.Write(ctx, bytes.NewReader(content)); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(content)
+	if hash == h.lastHash {
+		return nil
+	}
+
+	if err := h.run(ctx, hex.EncodeToString(hash[:])); err != nil {
+		h.runs.WithLabelValues("error").Inc()
+		if h.policy != HookWarn {
+			return err
+		}
+		log.Printf("reloading the ruler anyway: %v", err)
+	} else {
+		h.runs.WithLabelValues("success").Inc()
+	}
+	h.lastHash = hash
+
+	return nil
+}
+
+// run runs the command with the path and hash of the rules, passing its output through.
+func (h *Hook) run(ctx context.Context, hash string) error {
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, h.command, h.path, hash)
+	cmd.Env = append(os.Environ(), HookEnvFile+"="+h.path, HookEnvSHA256+"="+hash)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("post-write command %s timed out after %s: %w", h.command, h.timeout, err)
+		}
+		return fmt.Errorf("post-write command %s failed: %w", h.command, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package output
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeHookScript writes a shell script recording its arguments and environment to a log file, then running body.
+func writeHookScript(t *testing.T, dir, body string) (script, logFile string) {
+	script = filepath.Join(dir, "hook.sh")
+	logFile = filepath.Join(dir, "hook.log")
+	content := fmt.Sprintf("#!/bin/sh\necho \"$1 $2 $RULES_FILE $RULES_SHA256\" >> %s\n%s\n", logFile, body)
+	assert.NoError(t, os.WriteFile(script, []byte(content), 0o700))
+
+	return script, logFile
+}
+
+func TestHookWrite(t *testing.T) {
+	testCases := map[string]struct {
+		body string
+		opts []HookOption
+
+		expectErr  string
+		expectRuns string
+	}{
+		"command succeeds": {
+			body:       "exit 0",
+			expectRuns: "success",
+		},
+		"command fails": {
+			body:       "exit 1",
+			expectErr:  "post-write command",
+			expectRuns: "error",
+		},
+		"command fails with the warn policy": {
+			body:       "exit 1",
+			opts:       []HookOption{WithHookPolicy(HookWarn)},
+			expectRuns: "error",
+		},
+		"command times out": {
+			body:       "exec sleep 10",
+			opts:       []HookOption{WithHookTimeout(100 * time.Millisecond)},
+			expectErr:  "timed out after 100ms",
+			expectRuns: "error",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			script, logFile := writeHookScript(t, dir, tc.body)
+			path := filepath.Join(dir, "rules.yaml")
+
+			r := prometheus.NewRegistry()
+			h := NewHook(r, NewFile(path), path, script, tc.opts...)
+			err := h.Write(context.Background(), strings.NewReader("groups: []"))
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			// The rules are written before the command runs.
+			content, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			assert.Equal(t, "groups: []", string(content))
+
+			hash := fmt.Sprintf("%x", sha256.Sum256([]byte("groups: []")))
+			calls, err := os.ReadFile(logFile)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("%s %s %s %s\n", path, hash, path, hash), string(calls))
+			assert.Equal(t, 1.0, testutil.ToFloat64(h.runs.WithLabelValues(tc.expectRuns)))
+		})
+	}
+}
+
+func TestHookWriteUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	script, logFile := writeHookScript(t, dir, "exit 0")
+	path := filepath.Join(dir, "rules.yaml")
+
+	h := NewHook(nil, NewFile(path), path, script)
+	for _, content := range []string{"groups: []", "groups: []", "groups: [a]"} {
+		assert.NoError(t, h.Write(context.Background(), strings.NewReader(content)))
+	}
+
+	// The command only runs when the rules change.
+	calls, err := os.ReadFile(logFile)
+	assert.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(calls)), "\n"), 2)
+}
+
+func TestHookWriteFailedRetried(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "fail")
+	assert.NoError(t, os.WriteFile(marker, nil, 0o600))
+	script, logFile := writeHookScript(t, dir, fmt.Sprintf("if [ -e %s ]; then exit 1; fi", marker))
+	path := filepath.Join(dir, "rules.yaml")
+
+	h := NewHook(nil, NewFile(path), path, script)
+	assert.Error(t, h.Write(context.Background(), strings.NewReader("groups: []")))
+
+	// The command runs again for the same rules once it failed the write.
+	assert.NoError(t, os.Remove(marker))
+	assert.NoError(t, h.Write(context.Background(), strings.NewReader("groups: []")))
+
+	calls, err := os.ReadFile(logFile)
+	assert.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(calls)), "\n"), 2)
+}
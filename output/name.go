@@ -0,0 +1,129 @@
+package output
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// DefaultShard is the shard of the rules not routed to a route, see NameData.
+const DefaultShard = "default"
+
+// NameData is the data of the name template of the rules files of the outputs.
+type NameData struct {
+	// Signal is the name of the pipeline writing the rules file, e.g. metrics or logs.
+	Signal string
+	// Shard is the name of the route whose groups are written to the rules file, or DefaultShard.
+	Shard string
+}
+
+// NameTemplate names the rules files of the outputs with a text/template, e.g. /etc/thanos/rules/{{.Signal}}-{{.Shard}}-rules.yaml,
+// so that the files of several pipelines and routes follow a single convention the rulers can match with a glob.
+type NameTemplate struct {
+	tmpl *template.Template
+
+	signal bool
+	shard  bool
+}
+
+// ParseNameTemplate parses the name template, failing if it can't be executed or doesn't name a file.
+func ParseNameTemplate(text string) (*NameTemplate, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse name template: %w", err)
+	}
+
+	t := &NameTemplate{tmpl: tmpl}
+	// The fields the template uses are the ones whose value changes the name.
+	base, err := t.execute(NameData{Signal: "signal", Shard: "shard"})
+	if err != nil {
+		return nil, err
+	}
+	signal, err := t.execute(NameData{Signal: "other", Shard: "shard"})
+	if err != nil {
+		return nil, err
+	}
+	shard, err := t.execute(NameData{Signal: "signal", Shard: "other"})
+	if err != nil {
+		return nil, err
+	}
+	t.signal, t.shard = signal != base, shard != base
+
+	return t, nil
+}
+
+// UsesSignal tells whether the names depend on the signal.
+func (t *NameTemplate) UsesSignal() bool {
+	return t.signal
+}
+
+// UsesShard tells whether the names depend on the shard.
+func (t *NameTemplate) UsesShard() bool {
+	return t.shard
+}
+
+// Name returns the path of the rules file of the output. The signal and the shard must be usable in a file name.
+func (t *NameTemplate) Name(data NameData) (string, error) {
+	for _, v := range []struct{ field, value string }{{"signal", data.Signal}, {"shard", data.Shard}} {
+		if strings.ContainsRune(v.value, filepath.Separator) || v.value == "." || v.value == ".." {
+			return "", fmt.Errorf("the %s %q can't be used in a file name", v.field, v.value)
+		}
+	}
+
+	return t.execute(data)
+}
+
+func (t *NameTemplate) execute(data NameData) (string, error) {
+	var b bytes.Buffer
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to execute name template: %w", err)
+	}
+
+	name := b.String()
+	if name == "" || strings.HasSuffix(name, string(filepath.Separator)) {
+		return "", fmt.Errorf("the name template names the directory %q rather than a file", name)
+	}
+
+	return filepath.Clean(name), nil
+}
+
+// CheckNames returns an error if several outputs, by name, write the same rules file, or if the rules file of an
+// output doesn't match any of the globs of the rule_files of the ruler, if any, so that it wouldn't be loaded.
+// All the errors are returned, joined.
+func CheckNames(paths map[string]string, ruleFiles []string) error {
+	outputs := make([]string, 0, len(paths))
+	for output := range paths {
+		outputs = append(outputs, output)
+	}
+	slices.Sort(outputs)
+
+	for _, glob := range ruleFiles {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid rule files glob %q: %w", glob, err)
+		}
+	}
+
+	var errs []error
+	writers := map[string]string{}
+	for _, output := range outputs {
+		path := filepath.Clean(paths[output])
+		if other, ok := writers[path]; ok {
+			errs = append(errs, fmt.Errorf("%s and %s write the same rules file %s", other, output, path))
+			continue
+		}
+		writers[path] = output
+
+		if len(ruleFiles) > 0 && !slices.ContainsFunc(ruleFiles, func(glob string) bool {
+			matched, _ := filepath.Match(filepath.Clean(glob), path)
+			return matched
+		}) {
+			errs = append(errs, fmt.Errorf("the rules file %s of %s doesn't match any of the rule files globs %s of the ruler", path, output, strings.Join(ruleFiles, ", ")))
+		}
+	}
+
+	return errors.Join(errs...)
+}
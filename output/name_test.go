@@ -0,0 +1,118 @@
+package output
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNameTemplate(t *testing.T) {
+	testCases := map[string]struct {
+		template string
+		data     NameData
+
+		expectErr    string
+		expectName   string
+		expectSignal bool
+		expectShard  bool
+	}{
+		"signal and shard": {
+			template:     "/etc/thanos/rules/{{.Signal}}-{{.Shard}}-rules.yaml",
+			data:         NameData{Signal: "metrics", Shard: "critical"},
+			expectName:   "/etc/thanos/rules/metrics-critical-rules.yaml",
+			expectSignal: true,
+			expectShard:  true,
+		},
+		"shard only": {
+			template:    "/etc/thanos/rules/{{.Shard}}/rules.yaml",
+			data:        NameData{Shard: DefaultShard},
+			expectName:  "/etc/thanos/rules/default/rules.yaml",
+			expectShard: true,
+		},
+		"conditional signal": {
+			template:     `/etc/thanos/rules/{{if ne .Shard "default"}}{{.Shard}}-{{end}}{{.Signal}}.yaml`,
+			data:         NameData{Signal: "logs", Shard: DefaultShard},
+			expectName:   "/etc/thanos/rules/logs.yaml",
+			expectSignal: true,
+			expectShard:  true,
+		},
+		"invalid template": {
+			template:  "/etc/thanos/rules/{{.Signal}.yaml",
+			expectErr: "failed to parse name template",
+		},
+		"unknown field": {
+			template:  "/etc/thanos/rules/{{.Tenant}}.yaml",
+			expectErr: "failed to execute name template",
+		},
+		"directory": {
+			template:  "/etc/thanos/rules/{{.Signal}}/",
+			expectErr: "rather than a file",
+		},
+		"signal with a separator": {
+			template:     "/etc/thanos/rules/{{.Signal}}.yaml",
+			data:         NameData{Signal: "../metrics"},
+			expectErr:    `the signal "../metrics" can't be used in a file name`,
+			expectSignal: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tmpl, err := ParseNameTemplate(tc.template)
+			if err == nil {
+				assert.Equal(t, tc.expectSignal, tmpl.UsesSignal())
+				assert.Equal(t, tc.expectShard, tmpl.UsesShard())
+				var name string
+				name, err = tmpl.Name(tc.data)
+				assert.Equal(t, tc.expectName, name)
+			}
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	testCases := map[string]struct {
+		paths     map[string]string
+		ruleFiles []string
+
+		expectErr string
+	}{
+		"distinct files": {
+			paths: map[string]string{"pipeline metrics": "/etc/thanos/rules/metrics.yaml", "pipeline logs": "/etc/thanos/rules/logs.yaml"},
+		},
+		"matching globs": {
+			paths:     map[string]string{"route default": "/etc/thanos/rules/default.yaml", "route critical": "/etc/thanos-critical/rules.yaml"},
+			ruleFiles: []string{"/etc/thanos/rules/*.yaml", "/etc/thanos-critical/*.yaml"},
+		},
+		"same file": {
+			paths:     map[string]string{"pipeline metrics": "/etc/thanos/rules.yaml", "pipeline logs": "/etc/thanos/./rules.yaml"},
+			expectErr: "pipeline logs and pipeline metrics write the same rules file /etc/thanos/rules.yaml",
+		},
+		"unmatched glob": {
+			paths:     map[string]string{"route default": "/etc/thanos/rules/default.yml"},
+			ruleFiles: []string{"/etc/thanos/rules/*.yaml"},
+			expectErr: "the rules file /etc/thanos/rules/default.yml of route default doesn't match any of the rule files globs /etc/thanos/rules/*.yaml of the ruler",
+		},
+		"invalid glob": {
+			paths:     map[string]string{"route default": "/etc/thanos/rules/default.yaml"},
+			ruleFiles: []string{"/etc/thanos/rules/[.yaml"},
+			expectErr: "invalid rule files glob",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := CheckNames(tc.paths, tc.ruleFiles)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
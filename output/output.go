@@ -0,0 +1,252 @@
+// Package output writes synced rules to where the ruler reads them from.
+package output
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Writer writes rules.
+type Writer interface {
+	Write(ctx context.Context, rules io.Reader) error
+}
+
+// Pending tells whether the writer has changes to make on disk even if the rules are unchanged since its last write,
+// e.g. the files of tenants to remove after a grace period, which writers report with a Pending() bool method.
+func Pending(w Writer) bool {
+	p, ok := w.(interface{ Pending() bool })
+	return ok && p.Pending()
+}
+
+// File writes rules to a file on disk.
+type File struct {
+	path          string
+	fileMode      os.FileMode
+	dirMode       os.FileMode
+	fsync         bool
+	preserveOwner bool
+	// contentAddressed writes the rules to a file named after their hash, linked to from path.
+	contentAddressed bool
+
+	writeDuration *prometheus.HistogramVec
+}
+
+// FileOption configures a File.
+type FileOption func(*File)
+
+// WithFileMode sets the permissions of the file. If not set, the file is created with 0666 before umask
+// and the permissions of an existing file are kept.
+func WithFileMode(mode os.FileMode) FileOption {
+	return func(f *File) {
+		f.fileMode = mode
+	}
+}
+
+// WithDirMode creates the missing parent directories of the file with the given permissions.
+func WithDirMode(mode os.FileMode) FileOption {
+	return func(f *File) {
+		f.dirMode = mode
+	}
+}
+
+// WithFsync flushes the directory of the file to disk before Write returns, so that the new file is durable.
+// The content of the file is always flushed before it replaces the previous one.
+func WithFsync(fsync bool) FileOption {
+	return func(f *File) {
+		f.fsync = fsync
+	}
+}
+
+// WithPreserveOwner keeps the owner and group of the file when it is overwritten.
+func WithPreserveOwner(preserve bool) FileOption {
+	return func(f *File) {
+		f.preserveOwner = preserve
+	}
+}
+
+// WithContentAddressed writes the rules to a file named after their SHA-256 hash next to the path, e.g. rules-<sha256>.yaml,
+// and replaces the path with a symbolic link to it, so that consumers caching files by name always see consistent content.
+// The link is replaced atomically before Write returns, so that a ruler reloaded afterwards reads the new rules through it.
+// The previous file is kept for consumers still reading it, and older ones are removed.
+func WithContentAddressed(contentAddressed bool) FileOption {
+	return func(f *File) {
+		f.contentAddressed = contentAddressed
+	}
+}
+
+// WithRegisterer registers the metrics of the File with the given registerer.
+func WithRegisterer(r prometheus.Registerer) FileOption {
+	return func(f *File) {
+		r.MustRegister(f.writeDuration)
+	}
+}
+
+// NewFile creates a new File writing rules to the given path.
+func NewFile(path string, opts ...FileOption) *File {
+	f := &File{
+		path: path,
+		writeDuration: prometheus.NewHistogramVec(metrics.HistogramOpts(prometheus.HistogramOpts{
+			Name:    "thanos_rule_syncer_output_write_duration_seconds",
+			Help:    "Duration of writes of the rules file, by result.",
+			Buckets: prometheus.DefBuckets,
+		}), []string{"result"}),
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return f
+}
+
+// Write writes the rules to the file, replacing its content.
+// It stops writing and returns an error if the context is cancelled.
+func (f *File) Write(ctx context.Context, rules io.Reader) error {
+	start := time.Now()
+
+	err := f.write(ctx, rules)
+
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	f.writeDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+func (f *File) write(ctx context.Context, rules io.Reader) error {
+	if f.dirMode != 0 {
+		if err := os.MkdirAll(filepath.Dir(f.path), f.dirMode); err != nil {
+			return fmt.Errorf("failed to create the directory of the rules file %s: %w", f.path, err)
+		}
+	}
+
+	var owner *fileOwner
+	if f.preserveOwner {
+		var err error
+		owner, err = getFileOwner(f.path)
+		if err != nil {
+			return fmt.Errorf("failed to get the owner of the rules file %s: %w", f.path, err)
+		}
+	}
+
+	if f.contentAddressed {
+		return f.writeContentAddressed(ctx, rules, owner)
+	}
+
+	return f.writeFile(ctx, f.path, rules, owner)
+}
+
+// writeFile writes the rules to a temporary file next to the file at path, flushed to disk, and atomically renames it
+// over the file, so that the ruler never reads a partially written or empty file, even if the syncer crashes while
+// writing. The permissions of an existing file are kept, whatever the umask, unless the File has a mode, and its owner
+// is restored if not nil.
+// A file at path that is a symbolic link is replaced through it.
+func (f *File) writeFile(ctx context.Context, path string, rules io.Reader, owner *fileOwner) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+
+	// A new rules file gets the permissions of os.Create, subject to umask, unless the File has a mode.
+	mode, chmod := f.fileMode, f.fileMode != 0
+	if info, err := os.Stat(path); mode == 0 && err == nil {
+		mode, chmod = info.Mode().Perm(), true
+	} else if mode == 0 {
+		mode = 0o666
+	}
+
+	// A temporary file left by a write interrupted by a crash is replaced, so that it gets the mode.
+	tmp := tempPath(path)
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove the temporary file %s: %w", tmp, err)
+	}
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file for the rules file %s: %w", path, err)
+	}
+	// The temporary file is removed unless it replaced the rules file.
+	defer os.Remove(tmp)
+
+	if _, err := io.Copy(file, &contextReader{ctx: ctx, r: rules}); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write to rules file %s: %w", path, err)
+	}
+
+	if chmod {
+		// The mode given to OpenFile is subject to umask.
+		if err := file.Chmod(mode); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to set the permissions of the rules file %s: %w", path, err)
+		}
+	}
+
+	// The content is flushed before the rename, so that a crash doesn't leave the rules file empty.
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync the rules file %s: %w", path, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close the rules file %s: %w", path, err)
+	}
+
+	if owner != nil {
+		if err := owner.apply(tmp); err != nil {
+			return fmt.Errorf("failed to restore the owner of the rules file %s: %w", path, err)
+		}
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace the rules file %s: %w", path, err)
+	}
+
+	if f.fsync {
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("failed to sync the directory of the rules file %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// tempPath returns the path of the temporary file the rules file at path is written to. It is hidden and doesn't have
+// the extension of the rules file, so that rulers loading the files of a directory by extension ignore it.
+func tempPath(path string) string {
+	dir, base := filepath.Split(path)
+	return filepath.Join(dir, "."+base+".tmp")
+}
+
+// syncDir flushes the directory to disk, e.g. so that a file renamed in it stays renamed after a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// contextReader stops reading with the error of its context once it is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
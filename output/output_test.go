@@ -0,0 +1,193 @@
+package output
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileWrite(t *testing.T) {
+	testCases := map[string]struct {
+		opts         []FileOption
+		subDir       string
+		existing     bool
+		ctxCancelled bool
+
+		expectErr  bool
+		expectMode os.FileMode
+	}{
+		"file is written": {
+			expectMode: 0o644,
+			existing:   true,
+		},
+		"file mode is enforced on existing file": {
+			opts:       []FileOption{WithFileMode(0o600)},
+			existing:   true,
+			expectMode: 0o600,
+		},
+		"missing directories are created": {
+			opts:       []FileOption{WithFileMode(0o640), WithDirMode(0o750), WithFsync(true)},
+			subDir:     "a/b",
+			expectMode: 0o640,
+		},
+		"missing directories fail without dir mode": {
+			subDir:    "a/b",
+			expectErr: true,
+		},
+		"cancelled context stops write": {
+			ctxCancelled: true,
+			expectErr:    true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.subDir, "rules.yaml")
+			if tc.existing {
+				assert.NoError(t, os.WriteFile(path, []byte("old"), 0o644))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if tc.ctxCancelled {
+				cancel()
+			} else {
+				defer cancel()
+			}
+
+			err := NewFile(path, tc.opts...).Write(ctx, strings.NewReader("groups: []"))
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			content, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			assert.Equal(t, "groups: []", string(content))
+
+			info, err := os.Stat(path)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectMode, info.Mode().Perm())
+		})
+	}
+}
+
+func TestFileWriteContentAddressed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.yaml")
+	// An existing rules file is replaced with the link.
+	assert.NoError(t, os.WriteFile(path, []byte("old"), 0o644))
+
+	f := NewFile(path, WithContentAddressed(true))
+	ctx := context.Background()
+	for _, content := range []string{"groups: []", "groups: [a]", "groups: [a]", "groups: [b]"} {
+		assert.NoError(t, f.Write(ctx, strings.NewReader(content)))
+
+		read, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(read))
+
+		target, err := os.Readlink(path)
+		assert.NoError(t, err)
+		assert.Regexp(t, "^rules-[0-9a-f]{64}.yaml$", target)
+	}
+
+	// The current and previous rules files are kept.
+	files, err := filepath.Glob(filepath.Join(dir, "rules-*.yaml"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+// crashingReader returns the first part of the rules, then blocks until crashed, returning the error of the crash.
+type crashingReader struct {
+	first   string
+	read    chan struct{}
+	crashed chan error
+}
+
+func (r *crashingReader) Read(p []byte) (int, error) {
+	if r.first != "" {
+		n := copy(p, r.first)
+		r.first = r.first[n:]
+		if r.first == "" {
+			close(r.read)
+		}
+		return n, nil
+	}
+
+	return 0, <-r.crashed
+}
+
+func TestFileWriteAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("groups: [old]"), 0o640))
+	f := NewFile(path)
+
+	// The rules file isn't changed while the rules are written, nor by a write failing midway.
+	r := &crashingReader{first: "groups: [", read: make(chan struct{}), crashed: make(chan error)}
+	done := make(chan error)
+	go func() {
+		done <- f.Write(context.Background(), r)
+	}()
+	select {
+	case <-r.read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rules weren't read")
+	}
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "groups: [old]", string(content))
+
+	r.crashed <- errors.New("crash")
+	assert.Error(t, <-done)
+	content, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "groups: [old]", string(content))
+	_, err = os.Stat(filepath.Join(filepath.Dir(path), ".rules.yaml.tmp"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// A temporary file left by a crashed syncer is replaced, and the permissions of the rules file are kept.
+	assert.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(path), ".rules.yaml.tmp"), []byte("groups: [partial"), 0o600))
+	assert.NoError(t, f.Write(context.Background(), strings.NewReader("groups: [new]")))
+	content, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "groups: [new]", string(content))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Permissions the umask masks, e.g. group write under the usual 022, are kept too.
+	assert.NoError(t, os.Chmod(path, 0o664))
+	assert.NoError(t, f.Write(context.Background(), strings.NewReader("groups: [newer]")))
+	info, err = os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o664), info.Mode().Perm())
+}
+
+func TestFileWriteSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.yaml")
+	assert.NoError(t, os.WriteFile(target, []byte("groups: [old]"), 0o644))
+	path := filepath.Join(dir, "rules.yaml")
+	assert.NoError(t, os.Symlink("target.yaml", path))
+
+	assert.NoError(t, NewFile(path).Write(context.Background(), strings.NewReader("groups: [new]")))
+
+	// The target of the link is replaced, and the link kept.
+	link, err := os.Readlink(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "target.yaml", link)
+	content, err := os.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, "groups: [new]", string(content))
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package output
+
+// fileOwner is not supported on this platform.
+type fileOwner struct{}
+
+// getFileOwner always returns nil as file ownership is not supported on this platform.
+func getFileOwner(_ string) (*fileOwner, error) {
+	return nil, nil
+}
+
+func (o *fileOwner) apply(_ string) error {
+	return nil
+}
@@ -0,0 +1,47 @@
+//go:build unix
+
+package output
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// fileOwner is the owner and group of a file.
+type fileOwner struct {
+	uid int
+	gid int
+}
+
+// getFileOwner returns the owner of the file, or nil if it doesn't exist.
+func getFileOwner(path string) (*fileOwner, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, nil
+	}
+
+	return &fileOwner{uid: int(stat.Uid), gid: int(stat.Gid)}, nil
+}
+
+// apply sets the owner of the file if it differs.
+func (o *fileOwner) apply(path string) error {
+	current, err := getFileOwner(path)
+	if err != nil {
+		return err
+	}
+	if current != nil && *current == *o {
+		return nil
+	}
+
+	return os.Chown(path, o.uid, o.gid)
+}
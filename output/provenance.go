@@ -0,0 +1,82 @@
+package output
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Provenance annotates the rule groups of the rules file with comments noting where they come from, so that
+// the file read by the ruler can be inspected without the sources, e.g. during incidents.
+type Provenance struct {
+	groupTenant  func(groupName string) string
+	lastModified func(tenant string) (time.Time, bool)
+}
+
+// NewProvenance creates a new Provenance. The tenant owning a group is given by groupTenant,
+// and the modification time of the rules of a tenant in their source by lastModified, if not nil.
+func NewProvenance(groupTenant func(groupName string) string, lastModified func(tenant string) (time.Time, bool)) *Provenance {
+	return &Provenance{
+		groupTenant:  groupTenant,
+		lastModified: lastModified,
+	}
+}
+
+// Annotate adds a comment above each rule group with the tenant owning it, the modification time of the rules
+// of the tenant in their source if known, and the SHA-256 hash of the group. It must be the last processor
+// of the rules, as comments are dropped when rules are parsed again.
+func (p *Provenance) Annotate(_ context.Context, content []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	for _, group := range groupNodes(&doc) {
+		var name string
+		for i := 0; i+1 < len(group.Content); i += 2 {
+			if group.Content[i].Value == "name" {
+				name = group.Content[i+1].Value
+			}
+		}
+
+		groupContent, err := yaml.Marshal(group)
+		if err != nil {
+			return nil, fmt.Errorf("group %q: failed to marshal rules: %w", name, err)
+		}
+
+		tenant := p.groupTenant(name)
+		comment := fmt.Sprintf("tenant: %s", tenant)
+		if p.lastModified != nil {
+			if modified, ok := p.lastModified(tenant); ok {
+				comment += fmt.Sprintf(", modified: %s", modified.UTC().Format(time.RFC3339))
+			}
+		}
+		group.HeadComment = fmt.Sprintf("%s, sha256: %x", comment, sha256.Sum256(groupContent))
+	}
+
+	annotated, err := yaml.Marshal(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	return annotated, nil
+}
+
+// groupNodes returns the nodes of the rule groups of a rules document.
+func groupNodes(doc *yaml.Node) []*yaml.Node {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "groups" && root.Content[i+1].Kind == yaml.SequenceNode {
+			return root.Content[i+1].Content
+		}
+	}
+
+	return nil
+}
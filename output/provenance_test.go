@@ -0,0 +1,75 @@
+package output
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestProvenanceAnnotate(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	testCases := map[string]struct {
+		lastModified func(tenant string) (time.Time, bool)
+
+		expectComments []string
+	}{
+		"modification times known": {
+			lastModified: func(tenant string) (time.Time, bool) {
+				return modified, tenant == "tenant-a"
+			},
+			expectComments: []string{
+				"# tenant: tenant-a, modified: 2024-01-02T03:04:05Z, sha256: ",
+				"# tenant: tenant-b, sha256: ",
+			},
+		},
+		"no modification times": {
+			expectComments: []string{
+				"# tenant: tenant-a, sha256: ",
+				"# tenant: tenant-b, sha256: ",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			annotated, err := NewProvenance(groupTenant, tc.lastModified).Annotate(context.Background(), []byte(tenantsRules))
+			assert.NoError(t, err)
+
+			var comments []string
+			for _, line := range strings.Split(string(annotated), "\n") {
+				if line = strings.TrimSpace(line); strings.HasPrefix(line, "#") {
+					comments = append(comments, line)
+				}
+			}
+			assert.Len(t, comments, len(tc.expectComments))
+			for i, comment := range comments {
+				assert.True(t, strings.HasPrefix(comment, tc.expectComments[i]), comment)
+			}
+
+			// Comments don't change the rules read by the ruler.
+			var original, parsed any
+			assert.NoError(t, yaml.Unmarshal([]byte(tenantsRules), &original))
+			assert.NoError(t, yaml.Unmarshal(annotated, &parsed))
+			assert.Equal(t, original, parsed)
+		})
+	}
+}
+
+func TestProvenanceHash(t *testing.T) {
+	annotated, err := NewProvenance(groupTenant, nil).Annotate(context.Background(), []byte(tenantsRules))
+	assert.NoError(t, err)
+
+	// The hash is the one of the group alone, so that it only changes with the group.
+	var node yaml.Node
+	assert.NoError(t, yaml.Unmarshal([]byte("name: tenant-a.test\nrules:\n- record: a\n  expr: vector(1)\n"), &node))
+	group, err := yaml.Marshal(&node)
+	assert.NoError(t, err)
+	assert.Contains(t, string(annotated), fmt.Sprintf("sha256: %x", sha256.Sum256(group)))
+}
@@ -0,0 +1,201 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// rulerMetrics are the metrics written by the ruler itself, which aren't scraped.
+var rulerMetrics = []string{"ALERTS", "ALERTS_FOR_STATE"}
+
+// ScrapeHints writes, next to the rules written by a Writer, a file listing the metrics the rules select, so that
+// scrapers, e.g. Prometheus in agent mode, can keep only the series the rules need. The metrics recorded by the rules
+// and by the ruler itself are left out, as they aren't scraped. Failing to write the file doesn't fail the write of
+// the rules, but is logged and counted.
+type ScrapeHints struct {
+	writer Writer
+	file   *File
+
+	errors prometheus.Counter
+}
+
+// scrapeHintsFile is the content of the file written by ScrapeHints.
+type scrapeHintsFile struct {
+	// Metrics are the names of the metrics selected by the rules.
+	Metrics []string `yaml:"metrics"`
+	// Patterns are the regular expressions of the metric names selected by the rules, e.g. {__name__=~"http_.*"}.
+	Patterns []string `yaml:"patterns,omitempty"`
+	// UnnamedSelectors are the selectors of the rules not selecting metrics by name, e.g. {job="api"}, so that
+	// their series can't be kept by name.
+	UnnamedSelectors []string `yaml:"unnamedSelectors,omitempty"`
+	// MetricRelabelConfigs keep only the series of the metrics and patterns, for the metric_relabel_configs of the
+	// scrape configs. They are only set if the rules have no unnamed selectors.
+	MetricRelabelConfigs []relabelConfig `yaml:"metricRelabelConfigs,omitempty"`
+}
+
+// relabelConfig is a relabel config of Prometheus.
+type relabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Regex        string   `yaml:"regex"`
+	Action       string   `yaml:"action"`
+}
+
+// NewScrapeHints creates a new ScrapeHints writing the rules with w, and the metrics they select to the file at path.
+// Its metrics are registered with r if not nil.
+func NewScrapeHints(r prometheus.Registerer, w Writer, path string) *ScrapeHints {
+	h := &ScrapeHints{
+		writer: w,
+		file:   NewFile(path),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_scrape_hints_errors_total",
+			Help: "Total number of failures to write the metrics selected by the rules for scrapers.",
+		}),
+	}
+	if r != nil {
+		r.MustRegister(h.errors)
+	}
+
+	return h
+}
+
+// Pending tells whether the writer of the ScrapeHints has pending changes, see Pending.
+func (h *ScrapeHints) Pending() bool {
+	return Pending(h.writer)
+}
+
+// Write writes the rules with the writer of the ScrapeHints, then the metrics they select.
+func (h *ScrapeHints) Write(ctx context.Context, rules io.Reader) error {
+	content, err := io.ReadAll(&contextReader{ctx: ctx, r: rules})
+	if err != nil {
+		return fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	if err := h.writer.Write(ctx, bytes.NewReader(content)); err != nil {
+		return err
+	}
+
+	if err := h.write(ctx, content); err != nil {
+		h.errors.Inc()
+		log.Printf("failed to write scrape hints: %v", err)
+	}
+
+	return nil
+}
+
+func (h *ScrapeHints) write(ctx context.Context, content []byte) error {
+	hints, err := scrapeHintsOf(content)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Metrics selected by the rules synced by thanos-rule-syncer, to keep only the series they need when scraping.\n")
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(hints); err != nil {
+		return fmt.Errorf("failed to marshal scrape hints: %w", err)
+	}
+
+	return h.file.Write(ctx, &buf)
+}
+
+// scrapeHintsOf returns the metrics selected by the expressions of the rules, other than the ones they record.
+func scrapeHintsOf(content []byte) (*scrapeHintsFile, error) {
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	recorded := map[string]bool{}
+	for _, name := range rulerMetrics {
+		recorded[name] = true
+	}
+	for _, group := range groups.Groups {
+		for _, rule := range group.Rules {
+			if rule.Record.Value != "" {
+				recorded[rule.Record.Value] = true
+			}
+		}
+	}
+
+	metrics, patterns, unnamed := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, group := range groups.Groups {
+		for _, rule := range group.Rules {
+			expr, err := parser.ParseExpr(rule.Expr.Value)
+			if err != nil {
+				return nil, fmt.Errorf("group %q: failed to parse expression %q: %w", group.Name, rule.Expr.Value, err)
+			}
+
+			parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+				selector, ok := node.(*parser.VectorSelector)
+				if !ok {
+					return nil
+				}
+
+				named := false
+				for _, matcher := range selector.LabelMatchers {
+					if matcher.Name != labels.MetricName {
+						continue
+					}
+					switch matcher.Type {
+					case labels.MatchEqual:
+						if !recorded[matcher.Value] {
+							metrics[matcher.Value] = true
+						}
+						named = true
+					case labels.MatchRegexp:
+						patterns[matcher.Value] = true
+						named = true
+					}
+				}
+				if !named {
+					unnamed[selector.String()] = true
+				}
+				return nil
+			})
+		}
+	}
+
+	hints := &scrapeHintsFile{
+		Metrics:          sortedKeys(metrics),
+		Patterns:         sortedKeys(patterns),
+		UnnamedSelectors: sortedKeys(unnamed),
+	}
+	if len(hints.UnnamedSelectors) == 0 && (len(hints.Metrics) > 0 || len(hints.Patterns) > 0) {
+		alternatives := make([]string, 0, len(hints.Metrics)+len(hints.Patterns))
+		for _, metric := range hints.Metrics {
+			alternatives = append(alternatives, regexp.QuoteMeta(metric))
+		}
+		alternatives = append(alternatives, hints.Patterns...)
+		hints.MetricRelabelConfigs = []relabelConfig{{
+			SourceLabels: []string{labels.MetricName},
+			Regex:        strings.Join(alternatives, "|"),
+			Action:       "keep",
+		}}
+	}
+
+	return hints, nil
+}
+
+// sortedKeys returns the keys of the set in order, or an empty list if it has none.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
@@ -0,0 +1,130 @@
+package output
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrapeHintsOf(t *testing.T) {
+	testCases := map[string]struct {
+		rules string
+
+		expectErr   bool
+		expectHints *scrapeHintsFile
+	}{
+		"metrics by name": {
+			rules: `groups:
+- name: test
+  rules:
+  - record: job:http_requests:rate5m
+    expr: sum by (job) (rate(http_requests_total[5m])) / on (job) group_left up
+  - alert: HighErrorRate
+    expr: job:http_requests:rate5m > 10 and {__name__="http_errors_total"} > 0
+  - alert: Firing
+    expr: ALERTS{alertstate="firing"} > 0
+`,
+			expectHints: &scrapeHintsFile{
+				Metrics:          []string{"http_errors_total", "http_requests_total", "up"},
+				Patterns:         []string{},
+				UnnamedSelectors: []string{},
+				MetricRelabelConfigs: []relabelConfig{{
+					SourceLabels: []string{"__name__"},
+					Regex:        "http_errors_total|http_requests_total|up",
+					Action:       "keep",
+				}},
+			},
+		},
+		"patterns": {
+			rules: `groups:
+- name: test
+  rules:
+  - record: node:cpu:sum
+    expr: sum({__name__=~"node_cpu_.*"}) + count(node_load1)
+`,
+			expectHints: &scrapeHintsFile{
+				Metrics:          []string{"node_load1"},
+				Patterns:         []string{"node_cpu_.*"},
+				UnnamedSelectors: []string{},
+				MetricRelabelConfigs: []relabelConfig{{
+					SourceLabels: []string{"__name__"},
+					Regex:        "node_load1|node_cpu_.*",
+					Action:       "keep",
+				}},
+			},
+		},
+		"unnamed selectors": {
+			rules: `groups:
+- name: test
+  rules:
+  - alert: Down
+    expr: up == 0 or absent({job="api"})
+`,
+			expectHints: &scrapeHintsFile{
+				Metrics:          []string{"up"},
+				Patterns:         []string{},
+				UnnamedSelectors: []string{`{job="api"}`},
+			},
+		},
+		"no rules": {
+			rules: "groups: []\n",
+			expectHints: &scrapeHintsFile{
+				Metrics:          []string{},
+				Patterns:         []string{},
+				UnnamedSelectors: []string{},
+			},
+		},
+		"invalid expression": {
+			rules:     "groups:\n- name: test\n  rules:\n  - record: a\n    expr: sum(\n",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			hints, err := scrapeHintsOf([]byte(tc.rules))
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectHints, hints)
+		})
+	}
+}
+
+func TestScrapeHintsWrite(t *testing.T) {
+	dir := t.TempDir()
+	rulesPath, hintsPath := filepath.Join(dir, "rules.yaml"), filepath.Join(dir, "hints.yaml")
+	h := NewScrapeHints(nil, NewFile(rulesPath), hintsPath)
+
+	rules := "groups:\n- name: test\n  rules:\n  - alert: Down\n    expr: up == 0\n"
+	assert.NoError(t, h.Write(context.Background(), strings.NewReader(rules)))
+
+	written, err := os.ReadFile(rulesPath)
+	assert.NoError(t, err)
+	assert.Equal(t, rules, string(written))
+	hints, err := os.ReadFile(hintsPath)
+	assert.NoError(t, err)
+	assert.Equal(t, `# Metrics selected by the rules synced by thanos-rule-syncer, to keep only the series they need when scraping.
+metrics:
+  - up
+metricRelabelConfigs:
+  - source_labels:
+      - __name__
+    regex: up
+    action: keep
+`, string(hints))
+
+	// Failing to write the hints doesn't fail the write of the rules.
+	assert.NoError(t, os.Remove(hintsPath))
+	assert.NoError(t, os.Mkdir(hintsPath, 0o700))
+	assert.NoError(t, h.Write(context.Background(), strings.NewReader(rules)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.errors))
+}
@@ -0,0 +1,335 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// TenantPlaceholder is replaced with the tenant in the path templates of the rules files of tenants.
+const TenantPlaceholder = "{tenant}"
+
+// tenantFileHeader starts the rules files written by TenantFiles, so that they can be told apart
+// from the files of the directory not owned by the syncer, which are never removed.
+const tenantFileHeader = "# Generated by thanos-rule-syncer for tenant "
+
+// TenantFiles writes the rules of each tenant to its own file, whose path is a template with the TenantPlaceholder,
+// e.g. /etc/thanos/rules/{tenant}.yaml, or /etc/thanos/rules/{tenant}/rules.yaml to give each tenant its own directory.
+// The files of tenants without rules anymore, e.g. removed from the tenants file, are removed after a grace period,
+// so that the ruler reloaded after the write stops evaluating them.
+type TenantFiles struct {
+	template    string
+	groupTenant func(groupName string) string
+	grace       time.Duration
+	opts        []FileOption
+	now         func() time.Time
+
+	// lastHashes are the hashes of the rules files last written by tenant.
+	lastHashes map[string][sha256.Size]byte
+	// staleSince are the times since when owned files of tenants had no rules.
+	staleSince map[string]time.Time
+	// warned are the files not owned by the syncer already warned about.
+	warned map[string]bool
+
+	removed prometheus.Counter
+	unowned prometheus.Gauge
+}
+
+// NewTenantFiles creates a new TenantFiles writing the rules of tenants to <tenant>.yaml files in dir, see
+// NewTenantFilesTemplate.
+func NewTenantFiles(r prometheus.Registerer, dir string, groupTenant func(groupName string) string, grace time.Duration, opts ...FileOption) *TenantFiles {
+	return NewTenantFilesTemplate(r, filepath.Join(dir, TenantPlaceholder+".yaml"), groupTenant, grace, opts...)
+}
+
+// NewTenantFilesTemplate creates a new TenantFiles writing the rules of tenants to the files of the path template,
+// which must be valid according to ValidateTenantTemplate, with the given options, which must not include
+// WithRegisterer. The tenant owning a group is given by groupTenant, and the files of tenants without rules are
+// removed after grace.
+func NewTenantFilesTemplate(r prometheus.Registerer, template string, groupTenant func(groupName string) string, grace time.Duration, opts ...FileOption) *TenantFiles {
+	t := &TenantFiles{
+		template:    filepath.Clean(template),
+		groupTenant: groupTenant,
+		grace:       grace,
+		opts:        opts,
+		now:         time.Now,
+		lastHashes:  map[string][sha256.Size]byte{},
+		staleSince:  map[string]time.Time{},
+		warned:      map[string]bool{},
+		removed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_output_stale_tenant_files_removed_total",
+			Help: "Total number of rules files of tenants without rules anymore removed after the grace period.",
+		}),
+		unowned: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_output_unowned_files",
+			Help: "Number of rules files matching the path template of the rules files of tenants not written by the syncer.",
+		}),
+	}
+
+	if r != nil {
+		r.MustRegister(t.removed, t.unowned)
+	}
+
+	return t
+}
+
+// SetClock sets the clock timing the grace period, e.g. a fake clock in tests.
+func (t *TenantFiles) SetClock(c clock.Clock) {
+	t.now = c.Now
+}
+
+// Pending tells whether the grace period of the files of tenants without rules is over, so that the next write
+// removes them even if the rules are unchanged.
+func (t *TenantFiles) Pending() bool {
+	now := t.now()
+	for _, since := range t.staleSince {
+		if now.Sub(since) >= t.grace {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes the rules of each tenant to its file if they changed since the last write,
+// and removes the files of tenants without rules for longer than the grace period.
+func (t *TenantFiles) Write(ctx context.Context, content io.Reader) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(data, &groups); err != nil {
+		return fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	tenantGroups := map[string][]rules.RuleGroup{}
+	for _, group := range groups.Groups {
+		tenant := t.groupTenant(group.Name)
+		if tenant == "" || tenant != filepath.Base(tenant) || strings.HasPrefix(tenant, ".") {
+			return fmt.Errorf("group %q: invalid tenant %q for a file name", group.Name, tenant)
+		}
+		tenantGroups[tenant] = append(tenantGroups[tenant], group)
+	}
+
+	for tenant, groups := range tenantGroups {
+		if err := t.writeTenant(ctx, tenant, groups); err != nil {
+			return err
+		}
+		delete(t.staleSince, tenant)
+	}
+
+	return t.removeStale(tenantGroups)
+}
+
+func (t *TenantFiles) writeTenant(ctx context.Context, tenant string, groups []rules.RuleGroup) error {
+	content, err := yaml.Marshal(rules.RuleGroups{Groups: groups})
+	if err != nil {
+		return fmt.Errorf("failed to marshal rules of tenant %s: %w", tenant, err)
+	}
+	content = append([]byte(tenantFileHeader+tenant+". DO NOT EDIT.\n"), content...)
+
+	hash := sha256.Sum256(content)
+	lastHash, ok := t.lastHashes[tenant]
+	if !ok {
+		// After a restart, the file is only written again if its content changed, so that its modification time is kept.
+		if current, err := os.ReadFile(t.path(tenant)); err == nil {
+			lastHash, ok = sha256.Sum256(current), true
+		}
+	}
+	if ok && lastHash == hash {
+		t.lastHashes[tenant] = hash
+		return nil
+	}
+
+	file := NewFile(t.path(tenant), t.opts...)
+	if file.dirMode == 0 {
+		if err := t.createDirs(t.path(tenant)); err != nil {
+			return &rules.TenantError{Tenant: tenant, Err: err}
+		}
+	}
+	if err := file.Write(ctx, bytes.NewReader(content)); err != nil {
+		return &rules.TenantError{Tenant: tenant, Err: err}
+	}
+	t.lastHashes[tenant] = hash
+
+	return nil
+}
+
+// removeStale removes the owned files of the tenants without rules for longer than the grace period,
+// and warns about the files not owned by the syncer.
+func (t *TenantFiles) removeStale(tenantGroups map[string][]rules.RuleGroup) error {
+	paths, err := filepath.Glob(strings.ReplaceAll(t.template, TenantPlaceholder, "*"))
+	if err != nil {
+		return fmt.Errorf("failed to list rules files: %w", err)
+	}
+
+	var unowned int
+	now := t.now()
+	for _, path := range paths {
+		tenant, ok := t.tenant(path)
+		if !ok {
+			// e.g. /rules/a/b.yaml for /rules/{tenant}/{tenant}.yaml.
+			continue
+		}
+		if _, ok := tenantGroups[tenant]; ok {
+			continue
+		}
+
+		owned, err := ownedBy(path, tenant)
+		if err != nil {
+			return err
+		}
+		if !owned {
+			unowned++
+			if !t.warned[path] {
+				log.Printf("rules file %s was not written by the syncer, it is read by the ruler but never removed", path)
+				t.warned[path] = true
+			}
+			continue
+		}
+
+		since, ok := t.staleSince[tenant]
+		if !ok {
+			log.Printf("tenant %s has no rules anymore, removing its rules file %s after %s", tenant, path, t.grace)
+			since = now
+			t.staleSince[tenant] = since
+		}
+		if now.Sub(since) < t.grace {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove rules file %s of tenant %s: %w", path, tenant, err)
+		}
+		t.removeDirs(path)
+		log.Printf("removed rules file %s of tenant %s without rules for %s", path, tenant, now.Sub(since))
+		t.removed.Inc()
+		delete(t.staleSince, tenant)
+		delete(t.lastHashes, tenant)
+	}
+	t.unowned.Set(float64(unowned))
+
+	return nil
+}
+
+func (t *TenantFiles) path(tenant string) string {
+	return strings.ReplaceAll(t.template, TenantPlaceholder, tenant)
+}
+
+// tenant returns the tenant whose rules file is at the path listed from the template.
+func (t *TenantFiles) tenant(path string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(t.template, TenantPlaceholder)
+	rest := strings.TrimPrefix(path, prefix)
+	// The tenant ends at the fixed part of the template following it, e.g. its directory or extension.
+	end := len(rest)
+	if fixed, _, _ := strings.Cut(suffix, TenantPlaceholder); fixed != "" {
+		end = strings.Index(rest, fixed)
+	}
+	if end <= 0 {
+		return "", false
+	}
+
+	tenant := rest[:end]
+	if t.path(tenant) != path {
+		return "", false
+	}
+
+	return tenant, true
+}
+
+// createDirs creates the missing directories of the rules file of a tenant below the root directory of the template,
+// e.g. the directory of the tenant for /etc/thanos/rules/{tenant}/rules.yaml, with the permissions of the root
+// directory. The root directory itself isn't created, like the directory of a rules file without WithDirMode.
+func (t *TenantFiles) createDirs(path string) error {
+	root := TemplateRoot(t.template)
+	var missing []string
+	for dir := filepath.Dir(path); len(dir) > len(root) && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return fmt.Errorf("failed to get the permissions of the directory %s of the rules files of tenants: %w", root, err)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], info.Mode().Perm()); err != nil && !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("failed to create the directory of the rules file %s: %w", path, err)
+		}
+		// The permissions of the root directory are kept whatever the umask.
+		if err := os.Chmod(missing[i], info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to set the permissions of the directory of the rules file %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// removeDirs removes the directories of the removed rules file of a tenant left empty, up to the root directory of the
+// template, e.g. the directory of the tenant for /etc/thanos/rules/{tenant}/rules.yaml. Directories with other files,
+// or ones the tenants share, are kept.
+func (t *TenantFiles) removeDirs(path string) {
+	root := TemplateRoot(t.template)
+	for dir := filepath.Dir(path); len(dir) > len(root) && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+// TemplateRoot returns the directory of the rules files of tenants of the path template that doesn't depend on the
+// tenant, e.g. /etc/thanos/rules for /etc/thanos/rules/{tenant}/rules.yaml.
+func TemplateRoot(template string) string {
+	prefix, _, _ := strings.Cut(filepath.Clean(template), TenantPlaceholder)
+	return filepath.Dir(prefix + "_")
+}
+
+// ValidateTenantTemplate returns an error if the path template of the rules files of tenants has no TenantPlaceholder,
+// or has glob metacharacters, which would prevent listing the files of the template to remove the ones of removed
+// tenants.
+func ValidateTenantTemplate(template string) error {
+	if !strings.Contains(template, TenantPlaceholder) {
+		return fmt.Errorf("the path template %q has no %s placeholder", template, TenantPlaceholder)
+	}
+	if strings.ContainsAny(strings.ReplaceAll(template, TenantPlaceholder, ""), `*?[\`) {
+		return fmt.Errorf("the path template %q can't have the glob metacharacters *, ?, [ or \\", template)
+	}
+
+	return nil
+}
+
+// ownedBy returns whether the file was written by TenantFiles for the tenant.
+func ownedBy(path, tenant string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open rules file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to read rules file %s: %w", path, err)
+	}
+
+	return strings.HasPrefix(line, tenantFileHeader+tenant+"."), nil
+}
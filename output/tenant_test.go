@@ -0,0 +1,215 @@
+package output
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const tenantsRules = `groups:
+- name: tenant-a.test
+  rules:
+  - record: a
+    expr: vector(1)
+- name: tenant-b.test
+  rules:
+  - record: b
+    expr: vector(1)
+`
+
+func groupTenant(groupName string) string {
+	tenant, _, _ := strings.Cut(groupName, ".")
+	return tenant
+}
+
+func TestTenantFiles(t *testing.T) {
+	dir := t.TempDir()
+	// Files not written by the syncer are kept.
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "manual.yaml"), []byte("groups: []\n"), 0o644))
+
+	now := time.Now()
+	files := NewTenantFiles(nil, dir, groupTenant, time.Hour)
+	files.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// The rules of each tenant are written to their file.
+	assert.NoError(t, files.Write(ctx, strings.NewReader(tenantsRules)))
+	content, err := os.ReadFile(filepath.Join(dir, "tenant-a.yaml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "record: a")
+	assert.NotContains(t, string(content), "record: b")
+	assert.FileExists(t, filepath.Join(dir, "tenant-b.yaml"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(files.unowned))
+
+	// The file of a tenant without rules is kept during the grace period.
+	onlyTenantA := tenantsRules[:strings.Index(tenantsRules, "- name: tenant-b")]
+	assert.NoError(t, files.Write(ctx, strings.NewReader(onlyTenantA)))
+	assert.FileExists(t, filepath.Join(dir, "tenant-b.yaml"))
+
+	now = now.Add(time.Hour)
+	assert.NoError(t, files.Write(ctx, strings.NewReader(onlyTenantA)))
+	assert.NoFileExists(t, filepath.Join(dir, "tenant-b.yaml"))
+	assert.FileExists(t, filepath.Join(dir, "tenant-a.yaml"))
+	assert.FileExists(t, filepath.Join(dir, "manual.yaml"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(files.removed))
+
+	// The grace period restarts when a tenant has rules again.
+	assert.NoError(t, files.Write(ctx, strings.NewReader(tenantsRules)))
+	assert.NoError(t, files.Write(ctx, strings.NewReader(onlyTenantA)))
+	now = now.Add(30 * time.Minute)
+	assert.NoError(t, files.Write(ctx, strings.NewReader(tenantsRules)))
+	now = now.Add(45 * time.Minute)
+	assert.NoError(t, files.Write(ctx, strings.NewReader(onlyTenantA)))
+	assert.FileExists(t, filepath.Join(dir, "tenant-b.yaml"))
+
+	// Tenants that can't be used as file names are refused.
+	assert.Error(t, files.Write(ctx, strings.NewReader("groups:\n- name: ..test\n  rules: []\n")))
+}
+
+func TestTenantFilesTemplate(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.Chmod(root, 0o750))
+	template := filepath.Join(root, "{tenant}", "rules.yaml")
+	// Files of the directory of a tenant other than its rules file are kept.
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "tenant-b"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "tenant-b", "notes.txt"), nil, 0o644))
+
+	now := time.Now()
+	files := NewTenantFilesTemplate(nil, template, groupTenant, time.Hour)
+	files.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// The directories of the tenants are created with the permissions of the root directory.
+	assert.NoError(t, files.Write(ctx, strings.NewReader(tenantsRules)))
+	info, err := os.Stat(filepath.Join(root, "tenant-a"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o750), info.Mode().Perm())
+	content, err := os.ReadFile(filepath.Join(root, "tenant-a", "rules.yaml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "record: a")
+	assert.FileExists(t, filepath.Join(root, "tenant-b", "rules.yaml"))
+
+	// The root directory is only created with a directory mode.
+	missing := filepath.Join(t.TempDir(), "missing")
+	err = NewTenantFilesTemplate(nil, filepath.Join(missing, "{tenant}", "rules.yaml"), groupTenant, time.Hour).Write(ctx, strings.NewReader(tenantsRules))
+	assert.Error(t, err)
+	assert.NoDirExists(t, missing)
+	err = NewTenantFilesTemplate(nil, filepath.Join(missing, "{tenant}", "rules.yaml"), groupTenant, time.Hour, WithDirMode(0o700)).Write(ctx, strings.NewReader(tenantsRules))
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(missing, "tenant-a", "rules.yaml"))
+
+	// The files and the emptied directories of removed tenants are removed after the grace period.
+	assert.NoError(t, files.Write(ctx, strings.NewReader("groups: []\n")))
+	now = now.Add(time.Hour)
+	assert.NoError(t, files.Write(ctx, strings.NewReader("groups: []\n")))
+	assert.NoDirExists(t, filepath.Join(root, "tenant-a"))
+	assert.NoFileExists(t, filepath.Join(root, "tenant-b", "rules.yaml"))
+	assert.FileExists(t, filepath.Join(root, "tenant-b", "notes.txt"))
+	assert.DirExists(t, root)
+	assert.Equal(t, 2.0, testutil.ToFloat64(files.removed))
+}
+
+func TestTenantFilesUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	assert.NoError(t, NewTenantFiles(nil, dir, groupTenant, time.Hour).Write(ctx, strings.NewReader(tenantsRules)))
+
+	// The files whose content didn't change aren't written again, even after a restart.
+	path := filepath.Join(dir, "tenant-a.yaml")
+	modified := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(path, modified, modified))
+	changed := strings.Replace(tenantsRules, "record: b", "record: c", 1)
+	assert.NoError(t, NewTenantFiles(nil, dir, groupTenant, time.Hour).Write(ctx, strings.NewReader(changed)))
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.True(t, modified.Equal(info.ModTime()))
+	content, err := os.ReadFile(filepath.Join(dir, "tenant-b.yaml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "record: c")
+}
+
+func TestTenantFilesTenant(t *testing.T) {
+	testCases := map[string]struct {
+		template string
+		path     string
+
+		expectTenant string
+	}{
+		"file name": {
+			template:     "/rules/{tenant}.yaml",
+			path:         "/rules/tenant-a.yaml",
+			expectTenant: "tenant-a",
+		},
+		"directory": {
+			template:     "/rules/{tenant}/rules.yaml",
+			path:         "/rules/tenant-a/rules.yaml",
+			expectTenant: "tenant-a",
+		},
+		"several placeholders": {
+			template:     "/rules/{tenant}/{tenant}.yaml",
+			path:         "/rules/tenant-a/tenant-a.yaml",
+			expectTenant: "tenant-a",
+		},
+		"several placeholders of different tenants": {
+			template: "/rules/{tenant}/{tenant}.yaml",
+			path:     "/rules/tenant-a/tenant-b.yaml",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tenant, ok := NewTenantFilesTemplate(nil, tc.template, groupTenant, time.Hour).tenant(tc.path)
+			assert.Equal(t, tc.expectTenant != "", ok)
+			assert.Equal(t, tc.expectTenant, tenant)
+		})
+	}
+}
+
+func TestValidateTenantTemplate(t *testing.T) {
+	testCases := map[string]struct {
+		template string
+
+		expectErr string
+		expectDir string
+	}{
+		"file name": {
+			template:  "/etc/thanos/rules/{tenant}.yaml",
+			expectDir: "/etc/thanos/rules",
+		},
+		"directory": {
+			template:  "/etc/thanos/rules/{tenant}/rules.yaml",
+			expectDir: "/etc/thanos/rules",
+		},
+		"prefixed file name": {
+			template:  "/etc/thanos/rules/tenant-{tenant}.yaml",
+			expectDir: "/etc/thanos/rules",
+		},
+		"no placeholder": {
+			template:  "/etc/thanos/rules/rules.yaml",
+			expectErr: "has no {tenant} placeholder",
+		},
+		"glob metacharacters": {
+			template:  "/etc/thanos/rules/*/{tenant}.yaml",
+			expectErr: "can't have the glob metacharacters",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateTenantTemplate(tc.template)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectDir, TemplateRoot(tc.template))
+		})
+	}
+}
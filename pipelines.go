@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	syncconfig "github.com/observatorium/thanos-rule-syncer/config"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// pipelineConfig configures one of several independent sync pipelines run by a single process, e.g. syncing the rules
+// of metrics to a Thanos Ruler and the rules of logs to a Loki ruler. Its fields are named like the flags they replace.
+// The other settings of the pipeline are the ones of pipelineFlags, e.g. -thanos.unsupported-fields, and the other
+// flags can't be used with pipelines.
+type pipelineConfig struct {
+	// Name tells the pipeline apart in logs and in the pipeline label of metrics.
+	Name                string `yaml:"name"`
+	RulesBackendURL     string `yaml:"rules-backend-url"`
+	ObservatoriumAPIURL string `yaml:"observatorium-api-url"`
+	// Tenants are the tenants whose rules are fetched from the rules backend, or the tenant of the Observatorium API.
+	// If empty, the rules of all tenants are fetched from the rules backend.
+	Tenants       []string `yaml:"tenants"`
+	File          string   `yaml:"file"`
+	ThanosRuleURL string   `yaml:"thanos-rule-url"`
+	ThanosVersion string   `yaml:"thanos.version"`
+	// Interval is in seconds, like -interval, which it defaults to.
+	Interval uint   `yaml:"interval"`
+	Schedule string `yaml:"schedule"`
+}
+
+// pipelineFields are the fields of a pipeline in the config file.
+var pipelineFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(pipelineConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		fields[t.Field(i).Tag.Get("yaml")] = true
+	}
+	return fields
+}()
+
+// pipelineFlags are the flags applying to the pipelines: the settings of the clients, the startup and the internal
+// server shared by the pipelines, and the settings passed to the options of each pipeline. The other flags configure
+// the pipeline of the flags, which the pipelines replace.
+var pipelineFlags = map[string]bool{
+	"config": true,
+
+	"observatorium-ca":                true,
+	"tls.min-version":                 true,
+	"tls.cipher-suites":               true,
+	"tls.reload-interval":             true,
+	"http.dial-timeout":               true,
+	"http.tls-handshake-timeout":      true,
+	"http.proxy-username":             true,
+	"http.proxy-password":             true,
+	"oidc.issuer-url":                 true,
+	"oidc.client-id":                  true,
+	"oidc.client-secret":              true,
+	"oidc.audience":                   true,
+	"oidc.discovery.refresh-interval": true,
+	"oidc.discovery.startup-timeout":  true,
+	"oidc.discovery.cache-file":       true,
+	"secrets.cache-ttl":               true,
+	"secrets.vault.address":           true,
+	"secrets.vault.token-file":        true,
+	"fetch.bind-address":              true,
+	"fetch.dns.resolver":              true,
+	"fetch.spiffe":                    true,
+	"fetch.spiffe.endpoint-socket":    true,
+	"fetch.spiffe.server-id":          true,
+	"fetch.cache-ttl":                 true,
+	"fetch.rate-limit.pace":           true,
+	"debug.fail-fetch-percent":        true,
+
+	"startup.timeout":           true,
+	"web.internal.listen":       true,
+	"metrics.native-histograms": true,
+
+	"output.name-template":    true,
+	"output.ruler-rule-files": true,
+
+	"interval":                           true,
+	"sync.overlap-policy":                true,
+	"sync.skip-unchanged":                true,
+	"sync.watchdog":                      true,
+	"fetch.timeout":                      true,
+	"parse.timeout":                      true,
+	"write.timeout":                      true,
+	"reload.timeout":                     true,
+	"fetch.concurrency":                  true,
+	"fetch.watch":                        true,
+	"fetch.batch-size":                   true,
+	"thanos.unsupported-fields":          true,
+	"thanos.unsupported-fields.policies": true,
+	"merge.partial-response-strategy":    true,
+	"merge.duplicate-alerts":             true,
+	"merge.duplicate-alerts.label":       true,
+	"merge.slo-dir":                      true,
+	"merge.tenant-label":                 true,
+	"merge.source-tenants":               true,
+	"merge.reserved-labels":              true,
+	"merge.reserved-metric-names":        true,
+	"merge.reserved-labels.policy":       true,
+	"merge.record-names.allow":           true,
+	"merge.record-names.deny":            true,
+	"merge.record-names.prefix":          true,
+	"merge.record-names.policy":          true,
+}
+
+// unsupportedPipelineFlags returns the flags set on the command line or in the config file that don't apply to the
+// pipelines, see pipelineFlags, in lexicographical order.
+func unsupportedPipelineFlags(fs *flag.FlagSet) []string {
+	var unsupported []string
+	fs.Visit(func(f *flag.Flag) {
+		if !pipelineFlags[f.Name] {
+			unsupported = append(unsupported, "-"+f.Name)
+		}
+	})
+
+	return unsupported
+}
+
+// readPipelines reads the pipelines of the config file, rejecting unknown fields and pipelines without a unique name.
+// All the invalid pipelines are reported, joined, along with the valid ones.
+func readPipelines(node *yaml.Node) ([]pipelineConfig, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("line %d: pipelines must be a list", node.Line)
+	}
+
+	var pipelines []pipelineConfig
+	var errs []error
+	names := map[string]bool{}
+	for _, item := range node.Content {
+		if item.Kind != yaml.MappingNode {
+			errs = append(errs, fmt.Errorf("line %d: pipeline must be a mapping", item.Line))
+			continue
+		}
+		unknown := false
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			if key := item.Content[i]; !pipelineFields[key.Value] {
+				errs = append(errs, fmt.Errorf("line %d: unknown pipeline field %q", key.Line, key.Value))
+				unknown = true
+			}
+		}
+		if unknown {
+			continue
+		}
+
+		var p pipelineConfig
+		if err := item.Decode(&p); err != nil {
+			errs = append(errs, fmt.Errorf("invalid pipeline: %w", err))
+			continue
+		}
+		if p.Name == "" {
+			errs = append(errs, fmt.Errorf("line %d: pipeline has no name", item.Line))
+			continue
+		}
+		if names[p.Name] {
+			errs = append(errs, fmt.Errorf("line %d: duplicate pipeline %s", item.Line, p.Name))
+			continue
+		}
+		names[p.Name] = true
+
+		pipelines = append(pipelines, p)
+	}
+
+	return pipelines, errors.Join(errs...)
+}
+
+// options returns the options of the pipeline, with the settings of the flags it doesn't override.
+func (p pipelineConfig) options(cfg *config) (*syncconfig.Options, error) {
+	fieldPolicies, err := parseFieldPolicies(cfg.thanos.unsupportedFieldPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse -thanos.unsupported-fields.policies: %w", err)
+	}
+
+	interval := p.Interval
+	if interval == 0 {
+		interval = cfg.interval
+	}
+
+	opts := []syncconfig.Option{
+		syncconfig.WithThanosRule(p.ThanosRuleURL, p.ThanosVersion),
+		syncconfig.WithInterval(time.Duration(interval) * time.Second),
+		syncconfig.WithSchedule(p.Schedule),
+		syncconfig.WithOverlapPolicy(cfg.overlapPolicy),
+		syncconfig.WithTimeouts(cfg.timeouts),
+		syncconfig.WithFetchConcurrency(cfg.fetchConcurrency),
+		syncconfig.WithWatch(cfg.fetchWatch),
+		syncconfig.WithBatchSize(cfg.fetchBatchSize),
+		syncconfig.WithSkipUnchanged(cfg.skipUnchanged),
+		syncconfig.WithMerge(cfg.merge.Config),
+		syncconfig.WithUnsupportedFields(cfg.thanos.unsupportedFields, fieldPolicies),
+	}
+	if p.File != "" {
+		opts = append(opts, syncconfig.WithFile(p.File))
+	}
+	switch {
+	case p.RulesBackendURL != "" && p.ObservatoriumAPIURL != "":
+		return nil, fmt.Errorf("only one of rules-backend-url and observatorium-api-url can be specified")
+	case p.RulesBackendURL != "":
+		opts = append(opts, syncconfig.WithRulesBackend(p.RulesBackendURL, p.Tenants...))
+	case p.ObservatoriumAPIURL != "":
+		if len(p.Tenants) != 1 {
+			return nil, fmt.Errorf("a single tenant must be specified when using the Observatorium API")
+		}
+		opts = append(opts, syncconfig.WithObservatoriumAPI(p.ObservatoriumAPIURL, p.Tenants[0]))
+	}
+
+	return syncconfig.New(opts...)
+}
+
+// addPipelines adds the sync loops of the pipelines to the run group, fetching rules with fetchClient and reloading
+// the rulers with the clients returned by reloadClient. The metrics of each pipeline are registered with r, with
+// the name of the pipeline as pipeline label.
+func addPipelines(ctx context.Context, gr *run.Group, cfg *config, pipelines []pipelineConfig, fetchClient *http.Client, reloadClient func(url string) *http.Client, r prometheus.Registerer) error {
+	pipelines, err := pipelineFiles(cfg, pipelines)
+	if err != nil {
+		return err
+	}
+
+	syncers := make([]*syncer.Syncer, 0, len(pipelines))
+	for _, p := range pipelines {
+		opts, err := p.options(cfg)
+		if err != nil {
+			return fmt.Errorf("pipeline %s: %w", p.Name, err)
+		}
+
+		s, err := opts.SyncerWithClients(fetchClient, reloadClient(opts.ThanosRuleURL), prometheus.WrapRegistererWith(prometheus.Labels{"pipeline": p.Name}, r))
+		if err != nil {
+			return fmt.Errorf("pipeline %s: %w", p.Name, err)
+		}
+		syncers = append(syncers, s)
+	}
+
+	for i, s := range syncers {
+		s := s
+		ctx, cancel := context.WithCancel(ctx)
+		gr.Add(func() error {
+			return s.Loop(ctx)
+		}, func(_ error) {
+			cancel()
+		})
+		if cfg.syncWatchdog {
+			gr.Add(watchdog(ctx, s, pipelines[i].Name), func(_ error) {
+				cancel()
+			})
+		}
+	}
+
+	return nil
+}
+
+// runPipelines runs the pipelines of the config file, instead of the pipeline configured by the flags,
+// with the internal server, until the process is interrupted. The pipelines start once the startup is over.
+func runPipelines(ctx context.Context, cfg *config, st *startup, cas *caFiles, fetchClient *http.Client, reloadClient func(url string) *http.Client, registry *prometheus.Registry) {
+	if flags := unsupportedPipelineFlags(flag.CommandLine); len(flags) > 0 {
+		fatalf(syncer.ErrorConfig, "%s can't be used with pipelines, which configure their own sources, files and rulers, and only support the flags of the settings they share", strings.Join(flags, ", "))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var pipelines run.Group
+	pipelines.Add(func() error {
+		return cas.Run(ctx)
+	}, func(_ error) {
+		cancel()
+	})
+	if err := addPipelines(ctx, &pipelines, cfg, cfg.pipelines, fetchClient, reloadClient, registry); err != nil {
+		fatalf(syncer.ErrorConfig, "failed to configure pipelines: %v", err)
+	}
+
+	var gr run.Group
+	gr.Add(run.SignalHandler(ctx, os.Interrupt))
+	gr.Add(func() error {
+		if err := st.Run(ctx); err != nil {
+			return err
+		}
+		log.Printf("running %d pipelines", len(cfg.pipelines))
+		return pipelines.Run()
+	}, func(_ error) {
+		cancel()
+	})
+
+	h := newInternalHandler(registry)
+	addReadyEndpoint(h, st.Ready)
+	addInternalServer(&gr, cfg.listenInternal, h)
+
+	if err := gr.Run(); err != nil {
+		fatal(fmt.Errorf("thanos-rule-syncer quit unexpectectly: %w", err))
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/compat"
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPipelinesConfig() *config {
+	return &config{
+		interval:      60,
+		overlapPolicy: syncer.OverlapQueue,
+		thanos:        thanosConfig{unsupportedFields: compat.PolicyStrip},
+		merge:         mergeConfig{Config: merge.Config{DuplicateAlerts: merge.DuplicateAlertsWarn, DuplicateAlertsLabel: "tenant"}},
+	}
+}
+
+func TestPipelineOptions(t *testing.T) {
+	testCases := map[string]struct {
+		pipeline pipelineConfig
+
+		expectErr      string
+		expectInterval time.Duration
+		expectFile     string
+	}{
+		"settings of the flags": {
+			pipeline:       pipelineConfig{Name: "metrics", RulesBackendURL: "http://rules-objstore", ThanosRuleURL: "http://thanos-rule:10902"},
+			expectInterval: time.Minute,
+			expectFile:     "rules.yaml",
+		},
+		"overridden settings": {
+			pipeline:       pipelineConfig{Name: "logs", ObservatoriumAPIURL: "http://observatorium", Tenants: []string{"tenant1"}, File: "loki.yaml", ThanosRuleURL: "http://loki-ruler:3100", Interval: 10},
+			expectInterval: 10 * time.Second,
+			expectFile:     "loki.yaml",
+		},
+		"no source": {
+			pipeline:  pipelineConfig{Name: "metrics", ThanosRuleURL: "http://thanos-rule:10902"},
+			expectErr: "either the rules backend or the Observatorium API must be used",
+		},
+		"both sources": {
+			pipeline:  pipelineConfig{Name: "metrics", RulesBackendURL: "http://rules-objstore", ObservatoriumAPIURL: "http://observatorium", ThanosRuleURL: "http://thanos-rule:10902"},
+			expectErr: "only one of rules-backend-url and observatorium-api-url can be specified",
+		},
+		"several tenants of the Observatorium API": {
+			pipeline:  pipelineConfig{Name: "logs", ObservatoriumAPIURL: "http://observatorium", Tenants: []string{"tenant1", "tenant2"}, ThanosRuleURL: "http://loki-ruler:3100"},
+			expectErr: "a single tenant must be specified when using the Observatorium API",
+		},
+		"no ruler": {
+			pipeline:  pipelineConfig{Name: "metrics", RulesBackendURL: "http://rules-objstore"},
+			expectErr: "the URL of Thanos Ruler must be specified",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			opts, err := tc.pipeline.options(testPipelinesConfig())
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectInterval, opts.Interval)
+			assert.Equal(t, tc.expectFile, opts.File)
+		})
+	}
+}
+
+func TestAddPipelines(t *testing.T) {
+	dir := t.TempDir()
+	reloads := make(chan string, 2)
+	newPipeline := func(name string) pipelineConfig {
+		rules := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/api/v1/rules/tenant1", r.URL.Path)
+			_, _ = w.Write([]byte("groups:\n- name: " + name + "\n  rules:\n  - record: " + name + ":up\n    expr: up\n"))
+		}))
+		t.Cleanup(rules.Close)
+		ruler := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/-/reload", r.URL.Path)
+			reloads <- name
+		}))
+		t.Cleanup(ruler.Close)
+
+		return pipelineConfig{
+			Name:            name,
+			RulesBackendURL: rules.URL,
+			Tenants:         []string{"tenant1"},
+			File:            filepath.Join(dir, name+".yaml"),
+			ThanosRuleURL:   ruler.URL,
+			ThanosVersion:   "v0.36.0",
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	pipelines := []pipelineConfig{newPipeline("metrics"), newPipeline("logs")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var gr run.Group
+	err := addPipelines(ctx, &gr, testPipelinesConfig(), pipelines, http.DefaultClient, func(string) *http.Client { return http.DefaultClient }, registry)
+	assert.NoError(t, err)
+
+	// Both pipelines sync right away.
+	gr.Add(func() error {
+		reloaded := map[string]bool{}
+		for len(reloaded) < 2 {
+			select {
+			case name := <-reloads:
+				reloaded[name] = true
+			case <-time.After(10 * time.Second):
+				t.Error("pipelines did not reload their ruler")
+				return nil
+			}
+		}
+		return nil
+	}, func(error) {})
+	assert.NoError(t, gr.Run())
+
+	for _, name := range []string{"metrics", "logs"} {
+		content, err := os.ReadFile(filepath.Join(dir, name+".yaml"))
+		assert.NoError(t, err)
+		assert.Contains(t, string(content), "record: "+name+":up")
+	}
+
+	// The metrics of the pipelines are told apart by their label.
+	metrics, err := registry.Gather()
+	assert.NoError(t, err)
+	var pipelineLabels []string
+	for _, mf := range metrics {
+		if mf.GetName() != "thanos_rule_syncer_paused" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "pipeline" {
+					pipelineLabels = append(pipelineLabels, l.GetValue())
+				}
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{"metrics", "logs"}, pipelineLabels)
+	assert.Equal(t, 2, testutil.CollectAndCount(registry, "thanos_rule_syncer_paused"))
+}
+
+func TestAddPipelinesSameFile(t *testing.T) {
+	pipelines := []pipelineConfig{
+		{Name: "metrics", RulesBackendURL: "http://rules-objstore", ThanosRuleURL: "http://thanos-rule:10902", File: "rules.yaml"},
+		{Name: "logs", RulesBackendURL: "http://loki-rules-objstore", ThanosRuleURL: "http://loki-ruler:3100"},
+	}
+
+	var gr run.Group
+	err := addPipelines(context.Background(), &gr, testPipelinesConfig(), pipelines, http.DefaultClient, func(string) *http.Client { return http.DefaultClient }, prometheus.NewRegistry())
+	assert.ErrorContains(t, err, "pipeline logs and pipeline metrics write the same rules file rules.yaml")
+}
+
+func TestUnsupportedPipelineFlags(t *testing.T) {
+	testCases := map[string]struct {
+		args []string
+
+		expectFlags []string
+	}{
+		"shared settings": {
+			args: []string{"-config=config.yaml", "-interval=30", "-fetch.watch"},
+		},
+		"settings of the pipeline of the flags": {
+			args:        []string{"-thanos-rule-url=http://thanos-rule:10902", "-interval=30", "-reload.extra-urls=http://thanos-rule-2:10902"},
+			expectFlags: []string{"-reload.extra-urls", "-thanos-rule-url"},
+		},
+		"source": {
+			args:        []string{"-tenants-file=tenants.yaml"},
+			expectFlags: []string{"-tenants-file"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expectFlags, unsupportedPipelineFlags(testFlagSet(t, tc.args...)))
+		})
+	}
+}
+
+func TestPipelineFiles(t *testing.T) {
+	metrics := pipelineConfig{Name: "metrics", RulesBackendURL: "http://rules-objstore", ThanosRuleURL: "http://thanos-rule:10902"}
+	logs := pipelineConfig{Name: "logs", RulesBackendURL: "http://loki-rules-objstore", ThanosRuleURL: "http://loki-ruler:3100"}
+	withFile := func(p pipelineConfig, file string) pipelineConfig {
+		p.File = file
+		return p
+	}
+
+	testCases := map[string]struct {
+		pipelines    []pipelineConfig
+		nameTemplate string
+		ruleFiles    string
+
+		expectErr   string
+		expectFiles []string
+	}{
+		"files of the pipelines": {
+			pipelines:   []pipelineConfig{withFile(metrics, "/etc/thanos/rules.yaml"), withFile(logs, "/etc/loki/rules.yaml")},
+			expectFiles: []string{"/etc/thanos/rules.yaml", "/etc/loki/rules.yaml"},
+		},
+		"default files": {
+			pipelines: []pipelineConfig{metrics, logs},
+			expectErr: "pipeline logs and pipeline metrics write the same rules file rules.yaml",
+		},
+		"same files": {
+			pipelines: []pipelineConfig{withFile(metrics, "/etc/rules/rules.yaml"), withFile(logs, "/etc/rules/../rules/rules.yaml")},
+			expectErr: "pipeline logs and pipeline metrics write the same rules file /etc/rules/rules.yaml",
+		},
+		"name template": {
+			pipelines:    []pipelineConfig{metrics, logs},
+			nameTemplate: "/etc/rules/{{.Signal}}-{{.Shard}}-rules.yaml",
+			ruleFiles:    "/etc/rules/*-rules.yaml",
+			expectFiles:  []string{"/etc/rules/metrics-default-rules.yaml", "/etc/rules/logs-default-rules.yaml"},
+		},
+		"name template without signal": {
+			pipelines:    []pipelineConfig{metrics, logs},
+			nameTemplate: "/etc/rules/{{.Shard}}.yaml",
+			expectErr:    "pipeline logs and pipeline metrics write the same rules file /etc/rules/default.yaml",
+		},
+		"name template and file": {
+			pipelines:    []pipelineConfig{withFile(metrics, "/etc/thanos/rules.yaml"), logs},
+			nameTemplate: "/etc/rules/{{.Signal}}.yaml",
+			expectErr:    "pipeline metrics: file can't be set with -output.name-template",
+		},
+		"unmatched rule files": {
+			pipelines:    []pipelineConfig{metrics, logs},
+			nameTemplate: "/etc/rules/{{.Signal}}.yaml",
+			ruleFiles:    "/etc/rules/metrics.yaml,/etc/rules/*.yml",
+			expectErr:    "the rules file /etc/rules/logs.yaml of pipeline logs doesn't match any of the rule files globs",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := testPipelinesConfig()
+			cfg.output.nameTemplate = tc.nameTemplate
+			cfg.output.ruleFiles = tc.ruleFiles
+
+			pipelines, err := pipelineFiles(cfg, tc.pipelines)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			var files []string
+			for _, p := range pipelines {
+				files = append(files, p.File)
+			}
+			assert.Equal(t, tc.expectFiles, files)
+		})
+	}
+}
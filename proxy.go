@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/observatorium/thanos-rule-syncer/secret"
+)
+
+// proxyConnectHeader returns the function giving the headers of the CONNECT requests to the proxy, authenticating with
+// basic auth. The password can be a reference to a secret, resolved for each connection so that a rotated one is used.
+// The credentials of the URL of the proxy, if any, are used instead by the transport.
+func proxyConnectHeader(username, password string, secrets *secret.Resolver) func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+	return func(ctx context.Context, _ *url.URL, _ string) (http.Header, error) {
+		password, err := secrets.Secret(ctx, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get -http.proxy-password: %w", err)
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+
+		return http.Header{"Proxy-Authorization": []string{"Basic " + credentials}}, nil
+	}
+}
@@ -0,0 +1,185 @@
+package reload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/internal/flock"
+	"github.com/observatorium/thanos-rule-syncer/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lockPollInterval is how often a held lock file is tried again.
+const lockPollInterval = 50 * time.Millisecond
+
+// Coordinated reloads a ruler shared with other syncers, e.g. syncing the rules of other signals or sets of tenants,
+// holding a lock file shared by all of them, so that the ruler isn't reloaded several times within seconds.
+// The lock file records when the ruler was last reloaded: a reload is skipped if another syncer reloaded the ruler
+// after it was requested, as the ruler then read the rules written before, and delayed until the debounce period
+// after the last reload otherwise. Reloads fail on platforms without file locks, see flock.
+type Coordinated struct {
+	reloader Reloader
+	path     string
+	debounce time.Duration
+
+	lockWait  prometheus.Histogram
+	contended prometheus.Counter
+	coalesced prometheus.Counter
+	debounced prometheus.Counter
+}
+
+// NewCoordinated creates a new Coordinated reloading with reloader while holding the lock file at path, at most once
+// per debounce period across the syncers sharing it. Its metrics are registered with the given registerer, if not nil.
+func NewCoordinated(r prometheus.Registerer, reloader Reloader, path string, debounce time.Duration) *Coordinated {
+	c := &Coordinated{
+		reloader: reloader,
+		path:     path,
+		debounce: debounce,
+		lockWait: prometheus.NewHistogram(metrics.HistogramOpts(prometheus.HistogramOpts{
+			Name:    "thanos_rule_syncer_reload_lock_wait_duration_seconds",
+			Help:    "Duration of waits for the reload lock file shared with other syncers.",
+			Buckets: prometheus.DefBuckets,
+		})),
+		contended: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_reload_lock_contended_total",
+			Help: "Total number of reloads that waited for the reload lock file held by another syncer.",
+		}),
+		coalesced: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_reloads_coalesced_total",
+			Help: "Total number of reloads skipped because another syncer reloaded the ruler after they were requested.",
+		}),
+		debounced: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_reloads_debounced_total",
+			Help: "Total number of reloads delayed because the ruler was reloaded less than the debounce period before.",
+		}),
+	}
+
+	if r != nil {
+		r.MustRegister(c.lockWait, c.contended, c.coalesced, c.debounced)
+	}
+
+	return c
+}
+
+// Reload reloads the ruler, unless another syncer reloaded it since, once the lock file is held
+// and the debounce period after the last reload has passed.
+func (c *Coordinated) Reload(ctx context.Context) error {
+	requested := time.Now()
+
+	f, err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := flock.Unlock(f); err != nil {
+			log.Printf("failed to unlock the reload lock file %s: %v", c.path, err)
+		}
+		f.Close()
+	}()
+
+	last, err := lastReload(f)
+	if err != nil {
+		return fmt.Errorf("failed to read the reload lock file %s: %w", c.path, err)
+	}
+	if last.After(requested) {
+		c.coalesced.Inc()
+		return nil
+	}
+
+	if wait := time.Until(last.Add(c.debounce)); wait > 0 {
+		c.debounced.Inc()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("failed to wait for the debounce period of reloads: %w", ctx.Err())
+		}
+	}
+
+	start := time.Now()
+	if err := c.reloader.Reload(ctx); err != nil {
+		return err
+	}
+
+	// Only successful reloads are recorded, so that the syncers waiting for the lock reload after a failure.
+	if err := recordReload(f, start); err != nil {
+		return fmt.Errorf("failed to write the reload lock file %s: %w", c.path, err)
+	}
+
+	return nil
+}
+
+// lock opens the lock file and waits until it holds its lock, or the context is done.
+func (c *Coordinated) lock(ctx context.Context) (*os.File, error) {
+	f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the reload lock file: %w", err)
+	}
+
+	start := time.Now()
+	defer func() {
+		c.lockWait.Observe(time.Since(start).Seconds())
+	}()
+
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for attempt := 0; ; attempt++ {
+		locked, err := flock.TryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock the reload lock file %s: %w", c.path, err)
+		}
+		if locked {
+			return f, nil
+		}
+		if attempt == 0 {
+			c.contended.Inc()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("failed to lock the reload lock file %s: %w", c.path, ctx.Err())
+		}
+	}
+}
+
+// lastReload returns the start time of the last successful reload recorded in the lock file, or the zero time.
+func lastReload(f *os.File) (time.Time, error) {
+	content := make([]byte, 64)
+	n, err := f.ReadAt(content, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return time.Time{}, err
+	}
+	if n == 0 {
+		// The lock file was just created.
+		return time.Time{}, nil
+	}
+
+	last, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(content[:n])))
+	if err != nil {
+		// The lock file was written by something else, the reload isn't skipped.
+		log.Printf("ignoring the invalid reload lock file %s: %v", f.Name(), err)
+		return time.Time{}, nil
+	}
+
+	return last, nil
+}
+
+// recordReload records the start time of a successful reload in the lock file.
+func recordReload(f *os.File, start time.Time) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt([]byte(start.UTC().Format(time.RFC3339Nano)+"\n"), 0)
+
+	return err
+}
@@ -0,0 +1,103 @@
+package reload
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingReloader blocks its reloads until release is closed, after signalling them on started.
+type blockingReloader struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingReloader) Reload(_ context.Context) error {
+	r.started <- struct{}{}
+	<-r.release
+	return nil
+}
+
+func TestCoordinatedReloadCoalesced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reload.lock")
+	blocking := &blockingReloader{started: make(chan struct{}, 1), release: make(chan struct{})}
+	first := NewCoordinated(nil, blocking, path, 500*time.Millisecond)
+
+	// The other syncers request reloads while the first one reloads the ruler.
+	done := make(chan error, 1)
+	go func() {
+		done <- first.Reload(context.Background())
+	}()
+	<-blocking.started
+
+	others := make([]*Coordinated, 2)
+	reloaders := make([]*failingReloader, 2)
+	var wg sync.WaitGroup
+	for i := range others {
+		reloaders[i] = &failingReloader{}
+		others[i] = NewCoordinated(nil, reloaders[i], path, 500*time.Millisecond)
+		wg.Add(1)
+		go func(c *Coordinated) {
+			defer wg.Done()
+			assert.NoError(t, c.Reload(context.Background()))
+		}(others[i])
+	}
+	// Let both of them try the lock before releasing it.
+	time.Sleep(2 * lockPollInterval)
+	close(blocking.release)
+	assert.NoError(t, <-done)
+	wg.Wait()
+
+	// The next of them reloads the ruler after the debounce period, and the last one reuses its reload.
+	assert.Equal(t, int64(1), reloaders[0].calls.Load()+reloaders[1].calls.Load())
+	var contended, coalesced, debounced float64
+	for _, c := range others {
+		contended += testutil.ToFloat64(c.contended)
+		coalesced += testutil.ToFloat64(c.coalesced)
+		debounced += testutil.ToFloat64(c.debounced)
+	}
+	assert.Equal(t, 2.0, contended)
+	assert.Equal(t, 1.0, coalesced)
+	assert.Equal(t, 1.0, debounced)
+}
+
+func TestCoordinatedReloadDebounced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reload.lock")
+	reloader := &failingReloader{failures: 1}
+	c := NewCoordinated(nil, reloader, path, 200*time.Millisecond)
+
+	// A failed reload isn't recorded, so the next reload isn't delayed.
+	assert.Error(t, c.Reload(context.Background()))
+	start := time.Now()
+	assert.NoError(t, c.Reload(context.Background()))
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+
+	assert.NoError(t, c.Reload(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	assert.Equal(t, int64(3), reloader.calls.Load())
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.debounced))
+}
+
+func TestCoordinatedReloadLockTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reload.lock")
+	blocking := &blockingReloader{started: make(chan struct{}, 1), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- NewCoordinated(nil, blocking, path, 0).Reload(context.Background())
+	}()
+	<-blocking.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*lockPollInterval)
+	defer cancel()
+	err := NewCoordinated(nil, &failingReloader{}, path, 0).Reload(ctx)
+	assert.ErrorContains(t, err, "failed to lock the reload lock file")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(blocking.release)
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,191 @@
+package reload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Target is a ruler reloaded by a Multi, e.g. the ruler of a cluster.
+type Target struct {
+	// Name identifies the target in errors and metrics, e.g. the URL of the ruler.
+	Name     string
+	Reloader Reloader
+}
+
+// Multi reloads several rulers, e.g. across clusters, retrying each of them on failure.
+// A reload succeeds if a quorum of the rulers reloaded, and the other failures are only reported.
+type Multi struct {
+	targets []Target
+	retries int
+	backoff time.Duration
+	quorum  int
+	clock   clock.Clock
+
+	retriesTotal    *prometheus.CounterVec
+	targetSuccess   *prometheus.GaugeVec
+	lastSuccess     *prometheus.GaugeVec
+	reloadedTargets prometheus.Gauge
+	quorumFailures  prometheus.Counter
+	partialFailures prometheus.Counter
+}
+
+// MultiOption configures a Multi.
+type MultiOption func(*Multi)
+
+// WithRetries retries the reload of each ruler up to the given number of times, waiting for the backoff
+// before the first retry and twice as long before each following one.
+func WithRetries(retries int, backoff time.Duration) MultiOption {
+	return func(m *Multi) {
+		m.retries = retries
+		m.backoff = backoff
+	}
+}
+
+// WithQuorum makes a reload succeed once the given number of rulers reloaded. If 0, all rulers must reload.
+func WithQuorum(quorum int) MultiOption {
+	return func(m *Multi) {
+		m.quorum = quorum
+	}
+}
+
+// WithMultiClock sets the clock timing the retries, e.g. a fake clock in tests.
+func WithMultiClock(c clock.Clock) MultiOption {
+	return func(m *Multi) {
+		m.clock = c
+	}
+}
+
+// NewMulti creates a new Multi reloading the targets, and registers its metrics with the given registerer, if not nil.
+func NewMulti(r prometheus.Registerer, targets []Target, opts ...MultiOption) (*Multi, error) {
+	m := &Multi{
+		targets: targets,
+		clock:   clock.Real(),
+		retriesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_reload_target_retries_total",
+			Help: "Total number of retried reloads of rulers, by target.",
+		}, []string{"target"}),
+		targetSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_reload_target_success",
+			Help: "Whether the last reload of a ruler succeeded, after retries, by target. 1 if it succeeded, 0 otherwise.",
+		}, []string{"target"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_reload_target_last_success_timestamp_seconds",
+			Help: "Timestamp of the last successful reload of a ruler, by target.",
+		}, []string{"target"}),
+		reloadedTargets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_reload_targets_reloaded",
+			Help: "Number of rulers reloaded by the last reload.",
+		}),
+		quorumFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_reload_quorum_failures_total",
+			Help: "Total number of reloads failing because fewer rulers than the quorum reloaded.",
+		}),
+		partialFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_reload_partial_failures_total",
+			Help: "Total number of reloads succeeding with the quorum of rulers while other rulers failed to reload.",
+		}),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("no rulers to reload")
+	}
+	names := map[string]bool{}
+	for _, t := range targets {
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate ruler %q", t.Name)
+		}
+		names[t.Name] = true
+	}
+	if m.retries < 0 {
+		return nil, fmt.Errorf("negative number of retries %d", m.retries)
+	}
+	if m.quorum < 0 || m.quorum > len(targets) {
+		return nil, fmt.Errorf("quorum %d must be between 0 and the number of rulers %d", m.quorum, len(targets))
+	}
+
+	if r != nil {
+		r.MustRegister(m.retriesTotal, m.targetSuccess, m.lastSuccess, m.reloadedTargets, m.quorumFailures, m.partialFailures)
+	}
+
+	return m, nil
+}
+
+// Reload reloads all rulers concurrently. It fails if fewer rulers than the quorum reloaded,
+// with an error listing the failure of each ruler. Failures of rulers beyond the quorum are logged.
+func (m *Multi) Reload(ctx context.Context) error {
+	errs := make([]error, len(m.targets))
+
+	var wg sync.WaitGroup
+	for i, t := range m.targets {
+		wg.Add(1)
+		go func(i int, t Target) {
+			defer wg.Done()
+			errs[i] = m.reload(ctx, t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	var failed []error
+	for i, t := range m.targets {
+		if errs[i] != nil {
+			m.targetSuccess.WithLabelValues(t.Name).Set(0)
+			failed = append(failed, fmt.Errorf("ruler %s: %w", t.Name, errs[i]))
+			continue
+		}
+		m.targetSuccess.WithLabelValues(t.Name).Set(1)
+		m.lastSuccess.WithLabelValues(t.Name).Set(float64(m.clock.Now().Unix()))
+	}
+
+	reloaded := len(m.targets) - len(failed)
+	m.reloadedTargets.Set(float64(reloaded))
+	if len(failed) == 0 {
+		return nil
+	}
+
+	quorum := m.quorum
+	if quorum == 0 {
+		quorum = len(m.targets)
+	}
+	if reloaded < quorum {
+		m.quorumFailures.Inc()
+		return fmt.Errorf("reloaded %d of %d rulers, fewer than the quorum of %d: %w", reloaded, len(m.targets), quorum, errors.Join(failed...))
+	}
+
+	m.partialFailures.Inc()
+	log.Printf("reloaded %d of %d rulers, reaching the quorum of %d: %v", reloaded, len(m.targets), quorum, errors.Join(failed...))
+
+	return nil
+}
+
+// reload reloads a ruler, retrying until it succeeds, the retries are exhausted or the context is cancelled.
+func (m *Multi) reload(ctx context.Context, t Target) error {
+	backoff := m.backoff
+	for attempt := 0; ; attempt++ {
+		err := t.Reloader.Reload(ctx)
+		if err == nil || attempt == m.retries {
+			return err
+		}
+
+		timer := m.clock.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+		case <-timer.C():
+		}
+		backoff *= 2
+
+		m.retriesTotal.WithLabelValues(t.Name).Inc()
+	}
+}
@@ -0,0 +1,165 @@
+package reload
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingReloader fails its first failures reloads.
+type failingReloader struct {
+	failures int64
+	calls    atomic.Int64
+}
+
+func (r *failingReloader) Reload(_ context.Context) error {
+	if r.calls.Add(1) <= r.failures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestMultiReload(t *testing.T) {
+	testCases := map[string]struct {
+		failures []int64
+		retries  int
+		quorum   int
+
+		expectErr             string
+		expectCalls           []int64
+		expectSuccess         []float64
+		expectRetries         []float64
+		expectPartialFailures float64
+		expectQuorumFailures  float64
+	}{
+		"all rulers reload": {
+			failures:      []int64{0, 0, 0},
+			expectCalls:   []int64{1, 1, 1},
+			expectSuccess: []float64{1, 1, 1},
+			expectRetries: []float64{0, 0, 0},
+		},
+		"failed reloads are retried": {
+			failures:      []int64{0, 2, 0},
+			retries:       2,
+			expectCalls:   []int64{1, 3, 1},
+			expectSuccess: []float64{1, 1, 1},
+			expectRetries: []float64{0, 2, 0},
+		},
+		"all rulers must reload without quorum": {
+			failures:             []int64{0, 5, 0},
+			retries:              1,
+			expectErr:            "reloaded 2 of 3 rulers, fewer than the quorum of 3: ruler b: connection refused",
+			expectCalls:          []int64{1, 2, 1},
+			expectSuccess:        []float64{1, 0, 1},
+			expectRetries:        []float64{0, 1, 0},
+			expectQuorumFailures: 1,
+		},
+		"quorum reached": {
+			failures:              []int64{0, 5, 0},
+			quorum:                2,
+			expectCalls:           []int64{1, 1, 1},
+			expectSuccess:         []float64{1, 0, 1},
+			expectRetries:         []float64{0, 0, 0},
+			expectPartialFailures: 1,
+		},
+		"quorum not reached": {
+			failures:             []int64{5, 5, 0},
+			quorum:               2,
+			expectErr:            "reloaded 1 of 3 rulers, fewer than the quorum of 2",
+			expectCalls:          []int64{1, 1, 1},
+			expectSuccess:        []float64{0, 0, 1},
+			expectRetries:        []float64{0, 0, 0},
+			expectQuorumFailures: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			names := []string{"a", "b", "c"}
+			reloaders := make([]*failingReloader, len(tc.failures))
+			targets := make([]Target, len(tc.failures))
+			for i, failures := range tc.failures {
+				reloaders[i] = &failingReloader{failures: failures}
+				targets[i] = Target{Name: names[i], Reloader: reloaders[i]}
+			}
+
+			fake := clock.NewFake(time.Unix(0, 0))
+			m, err := NewMulti(nil, targets, WithRetries(tc.retries, time.Second), WithQuorum(tc.quorum), WithMultiClock(fake))
+			assert.NoError(t, err)
+
+			// Fire the backoff timers of the retries as soon as they are waited on.
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				for fake.BlockUntil(ctx, 1) == nil {
+					fake.Advance(time.Hour)
+				}
+			}()
+
+			err = m.Reload(context.Background())
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			for i, r := range reloaders {
+				assert.Equal(t, tc.expectCalls[i], r.calls.Load(), names[i])
+				assert.Equal(t, tc.expectSuccess[i], testutil.ToFloat64(m.targetSuccess.WithLabelValues(names[i])), names[i])
+				assert.Equal(t, tc.expectRetries[i], testutil.ToFloat64(m.retriesTotal.WithLabelValues(names[i])), names[i])
+			}
+			assert.Equal(t, tc.expectPartialFailures, testutil.ToFloat64(m.partialFailures))
+			assert.Equal(t, tc.expectQuorumFailures, testutil.ToFloat64(m.quorumFailures))
+		})
+	}
+}
+
+func TestNewMulti(t *testing.T) {
+	reloader := &failingReloader{}
+
+	testCases := map[string]struct {
+		targets []Target
+		opts    []MultiOption
+
+		expectErr string
+	}{
+		"valid": {
+			targets: []Target{{Name: "a", Reloader: reloader}, {Name: "b", Reloader: reloader}},
+			opts:    []MultiOption{WithQuorum(1), WithRetries(3, time.Second)},
+		},
+		"no rulers": {
+			expectErr: "no rulers to reload",
+		},
+		"duplicate ruler": {
+			targets:   []Target{{Name: "a", Reloader: reloader}, {Name: "a", Reloader: reloader}},
+			expectErr: `duplicate ruler "a"`,
+		},
+		"quorum larger than the rulers": {
+			targets:   []Target{{Name: "a", Reloader: reloader}},
+			opts:      []MultiOption{WithQuorum(2)},
+			expectErr: "quorum 2 must be between 0 and the number of rulers 1",
+		},
+		"negative retries": {
+			targets:   []Target{{Name: "a", Reloader: reloader}},
+			opts:      []MultiOption{WithRetries(-1, time.Second)},
+			expectErr: "negative number of retries -1",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewMulti(nil, tc.targets, tc.opts...)
+			if tc.expectErr != "" {
+				assert.EqualError(t, err, tc.expectErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+// Package reload triggers reloads of the rules of rulers.
+package reload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/observatorium/thanos-rule-syncer/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of reloads.
+const (
+	outcomeSuccess = "success"
+	// outcomeError is a request that failed, e.g. the ruler is unreachable.
+	outcomeError = "error"
+	// outcomeRejected is a request answered with a non-2xx status, e.g. the ruler failed to load the rules.
+	outcomeRejected = "rejected"
+)
+
+// maxErrorBodySize is the size of the start of the response body of a failed reload included in its error.
+const maxErrorBodySize = 4 << 10
+
+// Reloader triggers a reload of rules.
+type Reloader interface {
+	Reload(ctx context.Context) error
+}
+
+// unixSocketScheme is the scheme of the URLs of rulers listening on a Unix domain socket, e.g. unix:///run/thanos/rule.sock.
+const unixSocketScheme = "unix://"
+
+// UnixSocketPath returns the path of the socket of a unix:// URL, and whether the URL is one.
+func UnixSocketPath(url string) (string, bool) {
+	return strings.CutPrefix(url, unixSocketScheme)
+}
+
+// NewUnixSocketTransport creates a transport sending all requests to the Unix domain socket at the given path.
+func NewUnixSocketTransport(path string) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+}
+
+// Metrics instruments the reloads of rulers, by target and outcome.
+// They can be shared by the reloaders of several rulers.
+type Metrics struct {
+	reloads        *prometheus.CounterVec
+	reloadDuration *prometheus.HistogramVec
+}
+
+// NewMetrics creates the metrics of reloads and registers them with the given registerer, if not nil.
+func NewMetrics(r prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_reloads_total",
+			Help: "Total number of reloads of rulers, by target and outcome.",
+		}, []string{"target", "outcome"}),
+		reloadDuration: prometheus.NewHistogramVec(metrics.HistogramOpts(prometheus.HistogramOpts{
+			Name:    "thanos_rule_syncer_reload_request_duration_seconds",
+			Help:    "Duration of reload requests to rulers, by target and outcome.",
+			Buckets: prometheus.DefBuckets,
+		}), []string{"target", "outcome"}),
+	}
+
+	if r != nil {
+		r.MustRegister(m.reloads, m.reloadDuration)
+	}
+
+	return m
+}
+
+func (m *Metrics) observe(target, outcome string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.reloads.WithLabelValues(target, outcome).Inc()
+	m.reloadDuration.WithLabelValues(target, outcome).Observe(d.Seconds())
+}
+
+// ThanosRule triggers reloads of Thanos Ruler.
+type ThanosRule struct {
+	url     string
+	client  *http.Client
+	metrics *Metrics
+	clock   clock.Clock
+}
+
+// ThanosRuleOption configures a ThanosRule.
+type ThanosRuleOption func(*ThanosRule)
+
+// WithMetrics instruments the reloads with the given metrics.
+func WithMetrics(m *Metrics) ThanosRuleOption {
+	return func(r *ThanosRule) {
+		r.metrics = m
+	}
+}
+
+// WithClock sets the clock timing the reloads, e.g. a fake clock in tests.
+func WithClock(c clock.Clock) ThanosRuleOption {
+	return func(r *ThanosRule) {
+		r.clock = c
+	}
+}
+
+// NewThanosRule creates a new ThanosRule reloading the Thanos Ruler at the given URL.
+// For a unix:// URL, the client must send requests to the socket, e.g. with a NewUnixSocketTransport.
+func NewThanosRule(url string, client *http.Client, opts ...ThanosRuleOption) *ThanosRule {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	r := &ThanosRule{
+		url:    url,
+		client: client,
+		clock:  clock.Real(),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// Reload reloads the rules of Thanos Ruler with a POST request against its /-/reload endpoint.
+// Errors include the start of the response body of the ruler, which explains why it failed to load the rules.
+func (r *ThanosRule) Reload(ctx context.Context) error {
+	start := r.clock.Now()
+	outcome, err := r.reload(ctx)
+	r.metrics.observe(r.url, outcome, r.clock.Since(start))
+
+	return err
+}
+
+func (r *ThanosRule) reload(ctx context.Context) (string, error) {
+	url := r.url
+	if _, ok := UnixSocketPath(url); ok {
+		// The host is ignored by the transport dialing the socket.
+		url = "http://localhost"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/-/reload", url), nil)
+	if err != nil {
+		return outcomeError, err
+	}
+	req = req.WithContext(ctx)
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return outcomeError, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+		return outcomeRejected, fmt.Errorf("got unexpected status from Thanos Ruler: %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return outcomeSuccess, nil
+}
@@ -0,0 +1,96 @@
+package reload
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThanosRuleReload(t *testing.T) {
+	testCases := map[string]struct {
+		responseStatus int
+		responseBody   string
+		unreachable    bool
+
+		expectErr     string
+		expectOutcome string
+	}{
+		"successful reload": {
+			responseStatus: http.StatusOK,
+			expectOutcome:  outcomeSuccess,
+		},
+		"rejected reload includes the response body": {
+			responseStatus: http.StatusInternalServerError,
+			responseBody:   "failed to reload rules: group \"a\": duplicate rule\n",
+			expectErr:      `got unexpected status from Thanos Ruler: 500: failed to reload rules: group "a": duplicate rule`,
+			expectOutcome:  outcomeRejected,
+		},
+		"unreachable ruler": {
+			unreachable:   true,
+			expectErr:     "connection refused",
+			expectOutcome: outcomeError,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "/-/reload", r.URL.Path)
+				w.WriteHeader(tc.responseStatus)
+				_, _ = w.Write([]byte(tc.responseBody))
+			}))
+			if tc.unreachable {
+				server.Close()
+			} else {
+				defer server.Close()
+			}
+
+			metrics := NewMetrics(prometheus.NewRegistry())
+			err := NewThanosRule(server.URL, nil, WithMetrics(metrics)).Reload(context.Background())
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, 1.0, testutil.ToFloat64(metrics.reloads.WithLabelValues(server.URL, tc.expectOutcome)))
+			assert.Equal(t, 1, testutil.CollectAndCount(metrics.reloadDuration))
+		})
+	}
+}
+
+func TestThanosRuleReloadUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "reload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rule.sock")
+	l, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+
+	var reloaded bool
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/-/reload", r.URL.Path)
+		reloaded = true
+	}))
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	url := "unix://" + path
+	socketPath, ok := UnixSocketPath(url)
+	assert.True(t, ok)
+
+	client := &http.Client{Transport: NewUnixSocketTransport(socketPath)}
+	assert.NoError(t, NewThanosRule(url, client).Reload(context.Background()))
+	assert.True(t, reloaded)
+}
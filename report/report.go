@@ -0,0 +1,435 @@
+// Package report writes a machine-readable report of each sync cycle, e.g. for compliance tooling wanting an artifact
+// per change of the rules rather than scraped metrics: the outcome of the cycle and of each tenant, the durations of its
+// phases, the hashes of the rules and a summary of the changes of the rule groups of each tenant.
+package report
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// Outcomes of sync cycles.
+const (
+	// OutcomeSynced is a cycle that wrote rules different from the ones written before.
+	OutcomeSynced = "synced"
+	// OutcomeUnchanged is a cycle that wrote the same rules as before.
+	OutcomeUnchanged = "unchanged"
+	// OutcomePaused is a cycle that didn't write the rules because sync is paused.
+	OutcomePaused = "paused"
+	// OutcomeStandby is a cycle that didn't write the rules because the syncer is a standby not promoted yet.
+	OutcomeStandby = "standby"
+	// OutcomeFailed is a failed cycle.
+	OutcomeFailed = "failed"
+)
+
+// Outcomes of tenants in a sync cycle.
+const (
+	TenantAdded     = "added"
+	TenantChanged   = "changed"
+	TenantUnchanged = "unchanged"
+	TenantRemoved   = "removed"
+	TenantFailed    = "failed"
+)
+
+// Outcomes of the reload of the ruler.
+const (
+	ReloadSucceeded = "succeeded"
+	ReloadFailed    = "failed"
+	ReloadSkipped   = "skipped"
+)
+
+// Sinks of the reports.
+const (
+	SinkDirectory = "directory"
+	SinkWebhook   = "webhook"
+)
+
+const defaultWebhookTimeout = 10 * time.Second
+
+// Report is the report of a sync cycle.
+type Report struct {
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Outcome         string    `json:"outcome"`
+	Error           string    `json:"error,omitempty"`
+	ErrorClass      string    `json:"errorClass,omitempty"`
+	Phases          []Phase   `json:"phases"`
+	// FetchedSHA256 is the hash of the rules fetched, before they were post-processed.
+	FetchedSHA256 string `json:"fetchedSHA256,omitempty"`
+	// PreviousSHA256 is the hash of the rules written before the cycle.
+	PreviousSHA256 string `json:"previousSHA256,omitempty"`
+	// WrittenSHA256 is the hash of the rules written by the cycle.
+	WrittenSHA256 string   `json:"writtenSHA256,omitempty"`
+	Tenants       []Tenant `json:"tenants"`
+	Reload        Reload   `json:"reload"`
+}
+
+// Phase is the report of a phase of a sync cycle.
+type Phase struct {
+	Name            string  `json:"name"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// Tenant is the report of the rules of a tenant in a sync cycle.
+type Tenant struct {
+	Tenant  string `json:"tenant"`
+	Outcome string `json:"outcome"`
+	// Errors are the errors of the tenant that failed the cycle.
+	Errors []string `json:"errors,omitempty"`
+	// SHA256 is the hash of the rule groups of the tenant written by the cycle.
+	SHA256 string `json:"sha256,omitempty"`
+	Groups int    `json:"groups"`
+	Rules  int    `json:"rules"`
+	Diff   *Diff  `json:"diff,omitempty"`
+}
+
+// Diff summarizes the changes of the rule groups of a tenant, by group name.
+type Diff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+// Reload is the report of the reload of the ruler.
+type Reload struct {
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Reporter reports the sync cycles it observes to a directory and a webhook.
+type Reporter struct {
+	groupTenant func(groupName string) string
+	dir         string
+	webhookURL  string
+	client      *http.Client
+	timeout     time.Duration
+	changesOnly bool
+
+	reports *prometheus.CounterVec
+}
+
+// Option configures a Reporter.
+type Option func(*Reporter)
+
+// WithDirectory writes each report to a file of the given directory, named after the start time of its cycle.
+func WithDirectory(dir string) Option {
+	return func(r *Reporter) {
+		r.dir = dir
+	}
+}
+
+// WithWebhook posts each report to the given URL with the given client, within the given timeout.
+func WithWebhook(url string, client *http.Client, timeout time.Duration) Option {
+	return func(r *Reporter) {
+		if client == nil {
+			client = http.DefaultClient
+		}
+		if timeout <= 0 {
+			timeout = defaultWebhookTimeout
+		}
+
+		r.webhookURL = url
+		r.client = client
+		r.timeout = timeout
+	}
+}
+
+// WithChangesOnly only reports the cycles that changed the rules or failed.
+func WithChangesOnly(changesOnly bool) Option {
+	return func(r *Reporter) {
+		r.changesOnly = changesOnly
+	}
+}
+
+// New creates a new Reporter telling the tenants of rule groups apart with groupTenant, e.g. merge.GroupTenantFunc.
+// Its metrics are registered with the given registerer, if not nil.
+func New(reg prometheus.Registerer, groupTenant func(groupName string) string, opts ...Option) *Reporter {
+	r := &Reporter{
+		groupTenant: groupTenant,
+		reports: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_reports_total",
+			Help: "Total number of reports of sync cycles, by sink and result.",
+		}, []string{"sink", "result"}),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if reg != nil {
+		reg.MustRegister(r.reports)
+	}
+
+	return r
+}
+
+// Observe reports the sync cycle, and is a syncer.Observer. Failures to report are logged and counted, and don't fail the cycle.
+func (r *Reporter) Observe(ctx context.Context, c syncer.Cycle) {
+	report := r.Report(c)
+	if r.changesOnly && report.Outcome != OutcomeSynced && report.Outcome != OutcomeFailed {
+		return
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Printf("failed to marshal the report of the sync cycle: %v", err)
+		return
+	}
+
+	if r.dir != "" {
+		r.result(SinkDirectory, r.write(report.Start, content))
+	}
+	if r.webhookURL != "" {
+		// The report is posted even if the cycle ran out of time.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.timeout)
+		defer cancel()
+		r.result(SinkWebhook, r.post(ctx, content))
+	}
+}
+
+// result counts the result of a report to a sink, and logs its error.
+func (r *Reporter) result(sink string, err error) {
+	if err != nil {
+		log.Printf("failed to report the sync cycle to the %s: %v", sink, err)
+		r.reports.WithLabelValues(sink, "failure").Inc()
+		return
+	}
+
+	r.reports.WithLabelValues(sink, "success").Inc()
+}
+
+// write writes the report to a file of the directory, renamed once complete so that readers never see a partial report.
+func (r *Reporter) write(start time.Time, content []byte) error {
+	name := start.UTC().Format("20060102T150405.000000000Z") + ".json"
+
+	tmp, err := os.CreateTemp(r.dir, "."+name+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create report file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write report file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close report file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(r.dir, name)); err != nil {
+		return fmt.Errorf("failed to rename report file: %w", err)
+	}
+
+	return nil
+}
+
+// post posts the report to the webhook.
+func (r *Reporter) post(ctx context.Context, content []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.webhookURL, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("got unexpected status from the webhook: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Report returns the report of the sync cycle.
+func (r *Reporter) Report(c syncer.Cycle) *Report {
+	report := &Report{
+		Start:           c.Start,
+		DurationSeconds: c.Duration.Seconds(),
+		Phases:          make([]Phase, 0, len(c.Phases)),
+		FetchedSHA256:   hash(c.Fetched),
+		PreviousSHA256:  hash(c.Previous),
+		WrittenSHA256:   hash(c.Written),
+		Tenants:         []Tenant{},
+		Reload:          Reload{Outcome: ReloadSkipped},
+	}
+
+	switch {
+	case c.Err != nil:
+		report.Outcome = OutcomeFailed
+		report.Error = c.Err.Error()
+		report.ErrorClass = syncer.ErrorClass(c.Err)
+	case c.Standby:
+		report.Outcome = OutcomeStandby
+	case c.Paused:
+		report.Outcome = OutcomePaused
+	case report.WrittenSHA256 == report.PreviousSHA256:
+		report.Outcome = OutcomeUnchanged
+	default:
+		report.Outcome = OutcomeSynced
+	}
+
+	for _, phase := range c.Phases {
+		p := Phase{Name: phase.Name, DurationSeconds: phase.Duration.Seconds()}
+		if phase.Err != nil {
+			p.Error = phase.Err.Error()
+		}
+		report.Phases = append(report.Phases, p)
+
+		if phase.Name == syncer.PhaseReload {
+			report.Reload = Reload{Outcome: ReloadSucceeded}
+			if phase.Err != nil {
+				report.Reload = Reload{Outcome: ReloadFailed, Error: p.Error}
+			}
+		}
+	}
+
+	report.Tenants = r.tenants(c)
+
+	return report
+}
+
+// tenants returns the reports of the tenants of the rules written by the cycle, compared with the rules written before,
+// and of the tenants that failed the cycle.
+func (r *Reporter) tenants(c syncer.Cycle) []Tenant {
+	tenants := map[string]*Tenant{}
+	tenant := func(name string) *Tenant {
+		if _, ok := tenants[name]; !ok {
+			tenants[name] = &Tenant{Tenant: name}
+		}
+		return tenants[name]
+	}
+
+	if c.Written != nil {
+		previous, written := r.groups(c.Previous), r.groups(c.Written)
+		for name, groups := range written {
+			t := tenant(name)
+			t.SHA256 = hash(groupsContent(groups))
+			t.Groups = len(groups)
+			for _, group := range groups {
+				t.Rules += len(group.Rules)
+			}
+
+			t.Diff = diff(previous[name], groups)
+			switch {
+			case len(previous[name]) == 0:
+				t.Outcome = TenantAdded
+			case len(t.Diff.Added)+len(t.Diff.Removed)+len(t.Diff.Changed) > 0:
+				t.Outcome = TenantChanged
+			default:
+				t.Outcome = TenantUnchanged
+				t.Diff = nil
+			}
+		}
+		for name, groups := range previous {
+			if _, ok := written[name]; !ok {
+				t := tenant(name)
+				t.Outcome = TenantRemoved
+				t.Diff = diff(groups, nil)
+			}
+		}
+	}
+
+	// The tenants whose last rules were synced failed too.
+	for _, tenantErr := range append(rules.TenantErrors(c.Err), c.TenantErrors...) {
+		t := tenant(tenantErr.Tenant)
+		t.Outcome = TenantFailed
+		t.Errors = append(t.Errors, tenantErr.Err.Error())
+	}
+
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reports := make([]Tenant, 0, len(names))
+	for _, name := range names {
+		reports = append(reports, *tenants[name])
+	}
+
+	return reports
+}
+
+// groups returns the rule groups of the rules by tenant. Rules that can't be parsed, which weren't written, have no groups.
+func (r *Reporter) groups(content []byte) map[string][]rules.RuleGroup {
+	var parsed rules.RuleGroups
+	if err := yaml.Unmarshal(content, &parsed); err != nil {
+		return nil
+	}
+
+	groups := map[string][]rules.RuleGroup{}
+	for _, group := range parsed.Groups {
+		tenant := r.groupTenant(group.Name)
+		groups[tenant] = append(groups[tenant], group)
+	}
+
+	return groups
+}
+
+// diff returns the changes from the previous rule groups of a tenant to the current ones, by group name.
+func diff(previous, current []rules.RuleGroup) *Diff {
+	d := &Diff{}
+	previousContent := map[string][]byte{}
+	for _, group := range previous {
+		previousContent[group.Name] = groupsContent([]rules.RuleGroup{group})
+	}
+
+	for _, group := range current {
+		content, ok := previousContent[group.Name]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, group.Name)
+		case !bytes.Equal(content, groupsContent([]rules.RuleGroup{group})):
+			d.Changed = append(d.Changed, group.Name)
+		}
+		delete(previousContent, group.Name)
+	}
+	for _, group := range previous {
+		if _, ok := previousContent[group.Name]; ok {
+			d.Removed = append(d.Removed, group.Name)
+			delete(previousContent, group.Name)
+		}
+	}
+
+	return d
+}
+
+// groupsContent returns the YAML of the rule groups, or nil if they can't be marshalled.
+func groupsContent(groups []rules.RuleGroup) []byte {
+	content, err := yaml.Marshal(rules.RuleGroups{Groups: groups})
+	if err != nil {
+		return nil
+	}
+
+	return content
+}
+
+// hash returns the hex SHA-256 hash of the content, or an empty string if there is none.
+func hash(content []byte) string {
+	if content == nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
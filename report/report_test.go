@@ -0,0 +1,223 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const previousRules = `groups:
+- name: tenant-a.test
+  rules:
+  - record: a
+    expr: vector(1)
+- name: tenant-b.test
+  rules:
+  - record: b
+    expr: vector(1)
+- name: tenant-c.test
+  rules:
+  - record: c
+    expr: vector(1)
+`
+
+const writtenRules = `groups:
+- name: tenant-a.test
+  rules:
+  - record: a
+    expr: vector(1)
+- name: tenant-b.test
+  rules:
+  - record: b
+    expr: vector(2)
+- name: tenant-b.new
+  rules:
+  - record: b
+    expr: vector(1)
+- name: tenant-d.test
+  rules:
+  - record: d
+    expr: vector(1)
+  - record: d2
+    expr: vector(1)
+`
+
+func TestReport(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	testCases := map[string]struct {
+		cycle syncer.Cycle
+
+		expectOutcome string
+		expectReload  Reload
+		expectTenants []Tenant
+	}{
+		"synced": {
+			cycle: syncer.Cycle{
+				Phases: []syncer.PhaseResult{
+					{Name: syncer.PhaseFetch, Duration: time.Second},
+					{Name: syncer.PhaseWrite},
+					{Name: syncer.PhaseReload},
+				},
+				Previous: []byte(previousRules),
+				Written:  []byte(writtenRules),
+			},
+			expectOutcome: OutcomeSynced,
+			expectReload:  Reload{Outcome: ReloadSucceeded},
+			expectTenants: []Tenant{
+				{Tenant: "tenant-a", Outcome: TenantUnchanged, Groups: 1, Rules: 1},
+				{Tenant: "tenant-b", Outcome: TenantChanged, Groups: 2, Rules: 2, Diff: &Diff{Added: []string{"tenant-b.new"}, Changed: []string{"tenant-b.test"}}},
+				{Tenant: "tenant-c", Outcome: TenantRemoved, Diff: &Diff{Removed: []string{"tenant-c.test"}}},
+				{Tenant: "tenant-d", Outcome: TenantAdded, Groups: 1, Rules: 2, Diff: &Diff{Added: []string{"tenant-d.test"}}},
+			},
+		},
+		"unchanged": {
+			cycle: syncer.Cycle{
+				Previous: []byte(previousRules),
+				Written:  []byte(previousRules),
+			},
+			expectOutcome: OutcomeUnchanged,
+			expectReload:  Reload{Outcome: ReloadSkipped},
+			expectTenants: []Tenant{
+				{Tenant: "tenant-a", Outcome: TenantUnchanged, Groups: 1, Rules: 1},
+				{Tenant: "tenant-b", Outcome: TenantUnchanged, Groups: 1, Rules: 1},
+				{Tenant: "tenant-c", Outcome: TenantUnchanged, Groups: 1, Rules: 1},
+			},
+		},
+		"failed tenants": {
+			cycle: syncer.Cycle{
+				Phases: []syncer.PhaseResult{
+					{Name: syncer.PhaseFetch, Err: errors.New("failed")},
+				},
+				Previous: []byte(previousRules),
+				Err: &syncer.Error{Class: syncer.ErrorFetch, Err: errors.Join(
+					&rules.TenantError{Tenant: "tenant-b", Err: errors.New("timeout")},
+					&rules.TenantError{Tenant: "tenant-e", Err: errors.New("not found")},
+				)},
+			},
+			expectOutcome: OutcomeFailed,
+			expectReload:  Reload{Outcome: ReloadSkipped},
+			expectTenants: []Tenant{
+				{Tenant: "tenant-b", Outcome: TenantFailed, Errors: []string{"timeout"}},
+				{Tenant: "tenant-e", Outcome: TenantFailed, Errors: []string{"not found"}},
+			},
+		},
+		"tenants with their last rules": {
+			cycle: syncer.Cycle{
+				Previous:     []byte(previousRules),
+				Written:      []byte(previousRules),
+				TenantErrors: []*rules.TenantError{{Tenant: "tenant-b", Err: errors.New("timeout")}},
+			},
+			expectOutcome: OutcomeUnchanged,
+			expectReload:  Reload{Outcome: ReloadSkipped},
+			expectTenants: []Tenant{
+				{Tenant: "tenant-a", Outcome: TenantUnchanged, Groups: 1, Rules: 1},
+				{Tenant: "tenant-b", Outcome: TenantFailed, Groups: 1, Rules: 1, Errors: []string{"timeout"}},
+				{Tenant: "tenant-c", Outcome: TenantUnchanged, Groups: 1, Rules: 1},
+			},
+		},
+		"failed reload": {
+			cycle: syncer.Cycle{
+				Phases: []syncer.PhaseResult{
+					{Name: syncer.PhaseReload, Err: errors.New("connection refused")},
+				},
+				Previous: []byte(previousRules),
+				Written:  []byte(previousRules),
+				Err:      errors.New("connection refused"),
+			},
+			expectOutcome: OutcomeFailed,
+			expectReload:  Reload{Outcome: ReloadFailed, Error: "connection refused"},
+			expectTenants: []Tenant{
+				{Tenant: "tenant-a", Outcome: TenantUnchanged, Groups: 1, Rules: 1},
+				{Tenant: "tenant-b", Outcome: TenantUnchanged, Groups: 1, Rules: 1},
+				{Tenant: "tenant-c", Outcome: TenantUnchanged, Groups: 1, Rules: 1},
+			},
+		},
+		"paused": {
+			cycle: syncer.Cycle{
+				Previous: []byte(previousRules),
+				Paused:   true,
+			},
+			expectOutcome: OutcomePaused,
+			expectReload:  Reload{Outcome: ReloadSkipped},
+			expectTenants: []Tenant{},
+		},
+		"standby": {
+			cycle: syncer.Cycle{
+				Standby: true,
+			},
+			expectOutcome: OutcomeStandby,
+			expectReload:  Reload{Outcome: ReloadSkipped},
+			expectTenants: []Tenant{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tc.cycle.Start = start
+			report := New(nil, merge.GroupTenantFunc("")).Report(tc.cycle)
+
+			assert.Equal(t, start, report.Start)
+			assert.Equal(t, tc.expectOutcome, report.Outcome)
+			assert.Equal(t, tc.expectReload, report.Reload)
+			assert.Len(t, report.Phases, len(tc.cycle.Phases))
+			assert.Equal(t, hash(tc.cycle.Written), report.WrittenSHA256)
+
+			// The hashes of the tenants are checked apart.
+			for i := range report.Tenants {
+				if report.Tenants[i].Outcome != TenantRemoved && report.Tenants[i].Outcome != TenantFailed {
+					assert.Len(t, report.Tenants[i].SHA256, 64)
+				}
+				report.Tenants[i].SHA256 = ""
+			}
+			assert.Equal(t, tc.expectTenants, report.Tenants)
+		})
+	}
+}
+
+func TestReporterObserve(t *testing.T) {
+	var posted Report
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(body, &posted))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := New(nil, merge.GroupTenantFunc(""), WithDirectory(dir), WithWebhook(server.URL, server.Client(), 0), WithChangesOnly(true))
+
+	start := time.Date(2024, 1, 16, 4, 3, 5, 0, time.UTC)
+	r.Observe(context.Background(), syncer.Cycle{Start: start, Previous: []byte(previousRules), Written: []byte(writtenRules)})
+
+	content, err := os.ReadFile(filepath.Join(dir, "20240116T040305.000000000Z.json"))
+	assert.NoError(t, err)
+	var written Report
+	assert.NoError(t, json.Unmarshal(content, &written))
+	assert.Equal(t, OutcomeSynced, written.Outcome)
+	assert.Equal(t, written, posted)
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.reports.WithLabelValues(SinkDirectory, "success")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.reports.WithLabelValues(SinkWebhook, "success")))
+
+	// Cycles that didn't change the rules aren't reported.
+	r.Observe(context.Background(), syncer.Cycle{Start: start.Add(time.Minute), Previous: []byte(writtenRules), Written: []byte(writtenRules)})
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.reports.WithLabelValues(SinkWebhook, "success")))
+}
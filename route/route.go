@@ -0,0 +1,263 @@
+// Package route routes the rule groups of tenants to several outputs by their labels,
+// e.g. to sync critical alerts to a dedicated ruler.
+package route
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/output"
+	"github.com/observatorium/thanos-rule-syncer/reload"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultRoute is the name of the route of the groups not selected by any route of the table.
+const DefaultRoute = "default"
+
+// Table holds the routes of rule groups. The first route selecting a group applies.
+type Table struct {
+	Routes []Route `yaml:"routes"`
+}
+
+// Route sends the groups it selects to a rules file and the ruler reading it.
+type Route struct {
+	Name                string `yaml:"name"`
+	merge.GroupSelector `yaml:",inline"`
+	File                string `yaml:"file"`
+	// ThanosRuleURL is the URL of the ruler reading the file. If empty, the default ruler is reloaded.
+	ThanosRuleURL string `yaml:"thanosRuleURL"`
+}
+
+// TableOption configures the reading of a routing table.
+type TableOption func(*tableOptions)
+
+type tableOptions struct {
+	fileName func(route string) (string, error)
+}
+
+// WithFileNames names the rules files of the routes with fileName, given the name of the route, e.g. from the name
+// template of the outputs, instead of the file of each route, which must then not be set.
+func WithFileNames(fileName func(route string) (string, error)) TableOption {
+	return func(o *tableOptions) {
+		o.fileName = fileName
+	}
+}
+
+// ReadTableFile reads and validates the routing table file.
+func ReadTableFile(file string, opts ...TableOption) (*Table, error) {
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing file: %w", err)
+	}
+
+	return parseTable(f, opts...)
+}
+
+func parseTable(f []byte, opts ...TableOption) (*Table, error) {
+	o := &tableOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	t := &Table{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(f))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(t); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal routing file: %w", err)
+	}
+
+	names := map[string]bool{DefaultRoute: true}
+	for i := range t.Routes {
+		r := &t.Routes[i]
+		if r.Name == "" || names[r.Name] {
+			return nil, fmt.Errorf("route %d: name must be set and unique, and not %q", i, DefaultRoute)
+		}
+		names[r.Name] = true
+
+		switch {
+		case o.fileName != nil && r.File != "":
+			return nil, fmt.Errorf("route %s: file can't be set when the files of the routes are named by a template", r.Name)
+		case o.fileName != nil:
+			file, err := o.fileName(r.Name)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", r.Name, err)
+			}
+			r.File = file
+		case r.File == "":
+			return nil, fmt.Errorf("route %s: file must be set", r.Name)
+		}
+		if err := r.Compile(); err != nil {
+			return nil, fmt.Errorf("route %s: %w", r.Name, err)
+		}
+	}
+
+	return t, nil
+}
+
+// Output is where the groups of a route are synced to.
+type Output struct {
+	Writer   output.Writer
+	Reloader reload.Reloader
+}
+
+type routeOutput struct {
+	Output
+
+	lastHash [sha256.Size]byte
+	written  bool
+	changed  bool
+}
+
+// Router writes the groups of the rules to the outputs of the routes selecting them, and reloads the rulers
+// whose rules changed. It is both the writer and the reloader of a syncer.
+type Router struct {
+	table       *Table
+	groupTenant func(groupName string) string
+
+	outputs  []*routeOutput
+	fallback *routeOutput
+
+	mu sync.Mutex
+	// tenantRoutes are the indexes of the outputs the groups of tenants are sent to, the fallback being -1.
+	tenantRoutes map[string]int
+}
+
+// NewRouter creates a new Router. The outputs are those of the routes of the table, in the same order,
+// and fallback is the output of the groups not selected by any route.
+// If tenant is empty, the tenant owning a group is given by the prefix of its name.
+func NewRouter(t *Table, tenant string, outputs []Output, fallback Output) (*Router, error) {
+	if len(outputs) != len(t.Routes) {
+		return nil, fmt.Errorf("got %d outputs for %d routes", len(outputs), len(t.Routes))
+	}
+
+	r := &Router{
+		table:       t,
+		groupTenant: merge.GroupTenantFunc(tenant),
+		fallback:    &routeOutput{Output: fallback},
+	}
+	for _, o := range outputs {
+		r.outputs = append(r.outputs, &routeOutput{Output: o})
+	}
+
+	return r, nil
+}
+
+// SetTenantRoutes replaces the routes the groups of tenants are sent to by name, e.g. the route of the organization of
+// a tenant, regardless of the selectors of the routes. DefaultRoute sends them to the fallback output. The routes
+// aren't replaced if one of them isn't a route of the table.
+func (r *Router) SetTenantRoutes(routes map[string]string) error {
+	tenantRoutes := make(map[string]int, len(routes))
+	for tenant, name := range routes {
+		i := slices.IndexFunc(r.table.Routes, func(route Route) bool {
+			return route.Name == name
+		})
+		if i < 0 && name != DefaultRoute {
+			return fmt.Errorf("tenant %s: unknown route %q", tenant, name)
+		}
+		tenantRoutes[tenant] = i
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tenantRoutes = tenantRoutes
+
+	return nil
+}
+
+// Write splits the rules by route and writes the ones of each route that changed since the last write.
+func (r *Router) Write(ctx context.Context, content io.Reader) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(data, &groups); err != nil {
+		return fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	r.mu.Lock()
+	tenantRoutes := r.tenantRoutes
+	r.mu.Unlock()
+
+	routed := make([][]rules.RuleGroup, len(r.outputs))
+	var unrouted []rules.RuleGroup
+groups:
+	for _, group := range groups.Groups {
+		tenant := r.groupTenant(group.Name)
+		if i, ok := tenantRoutes[tenant]; ok {
+			if i < 0 {
+				unrouted = append(unrouted, group)
+			} else {
+				routed[i] = append(routed[i], group)
+			}
+			continue
+		}
+
+		for i, route := range r.table.Routes {
+			if route.Matches(tenant, group.RuleGroup) {
+				routed[i] = append(routed[i], group)
+				continue groups
+			}
+		}
+		unrouted = append(unrouted, group)
+	}
+
+	for i, o := range r.outputs {
+		if err := o.write(ctx, routed[i]); err != nil {
+			return fmt.Errorf("route %s: %w", r.table.Routes[i].Name, err)
+		}
+	}
+
+	return r.fallback.write(ctx, unrouted)
+}
+
+// Reload reloads the rulers of the routes whose rules changed since their last reload.
+// A ruler shared by several routes is reloaded once.
+func (r *Router) Reload(ctx context.Context) error {
+	reloaded := map[reload.Reloader]bool{}
+	for _, o := range append(r.outputs, r.fallback) {
+		if !o.changed {
+			continue
+		}
+
+		if !reloaded[o.Reloader] {
+			if err := o.Reloader.Reload(ctx); err != nil {
+				return err
+			}
+			reloaded[o.Reloader] = true
+		}
+		o.changed = false
+	}
+
+	return nil
+}
+
+func (o *routeOutput) write(ctx context.Context, groups []rules.RuleGroup) error {
+	content, err := yaml.Marshal(rules.RuleGroups{Groups: groups})
+	if err != nil {
+		return fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	hash := sha256.Sum256(content)
+	if o.written && hash == o.lastHash {
+		return nil
+	}
+
+	if err := o.Writer.Write(ctx, bytes.NewReader(content)); err != nil {
+		return err
+	}
+	o.lastHash = hash
+	o.written = true
+	o.changed = true
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package route
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTable(t *testing.T) {
+	testCases := map[string]struct {
+		fileContent string
+		// fileNames names the files of the routes by template.
+		fileNames bool
+
+		expectErr   bool
+		expectFiles []string
+	}{
+		"valid table": {
+			fileContent: `
+routes:
+- name: critical
+  selector: '{criticality="critical"}'
+  file: /etc/thanos-rule-critical/rules.yaml
+  thanosRuleURL: http://critical-ruler:10902
+- name: team-a
+  tenants: [tenant-a]
+  file: /etc/thanos-rule/team-a.yaml
+`,
+		},
+		"missing name": {
+			fileContent: `
+routes:
+- file: rules.yaml
+`,
+			expectErr: true,
+		},
+		"duplicate name": {
+			fileContent: `
+routes:
+- name: a
+  file: a.yaml
+- name: a
+  file: b.yaml
+`,
+			expectErr: true,
+		},
+		"default name": {
+			fileContent: `
+routes:
+- name: default
+  file: a.yaml
+`,
+			expectErr: true,
+		},
+		"missing file": {
+			fileContent: `
+routes:
+- name: a
+`,
+			expectErr: true,
+		},
+		"named files": {
+			fileContent: `
+routes:
+- name: critical
+  selector: '{criticality="critical"}'
+- name: team-a
+  tenants: [tenant-a]
+`,
+			fileNames:   true,
+			expectFiles: []string{"/etc/thanos-rule/critical.yaml", "/etc/thanos-rule/team-a.yaml"},
+		},
+		"named file set": {
+			fileContent: `
+routes:
+- name: a
+  file: a.yaml
+`,
+			fileNames: true,
+			expectErr: true,
+		},
+		"invalid named file": {
+			fileContent: `
+routes:
+- name: a/b
+`,
+			fileNames: true,
+			expectErr: true,
+		},
+		"invalid selector": {
+			fileContent: `
+routes:
+- name: a
+  selector: '{criticality='
+  file: a.yaml
+`,
+			expectErr: true,
+		},
+		"unknown field": {
+			fileContent: `
+routes:
+- name: a
+  file: a.yaml
+  url: http://ruler
+`,
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var opts []TableOption
+			if tc.fileNames {
+				opts = append(opts, WithFileNames(func(route string) (string, error) {
+					if strings.Contains(route, "/") {
+						return "", fmt.Errorf("invalid route %q", route)
+					}
+					return "/etc/thanos-rule/" + route + ".yaml", nil
+				}))
+			}
+			table, err := parseTable([]byte(tc.fileContent), opts...)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			if tc.expectFiles != nil {
+				var files []string
+				for _, r := range table.Routes {
+					files = append(files, r.File)
+				}
+				assert.Equal(t, tc.expectFiles, files)
+			}
+		})
+	}
+}
+
+type testWriter struct {
+	written bytes.Buffer
+	writes  int
+}
+
+func (w *testWriter) Write(_ context.Context, rules io.Reader) error {
+	w.writes++
+	w.written.Reset()
+	_, err := io.Copy(&w.written, rules)
+	return err
+}
+
+type testReloader struct {
+	calls int
+}
+
+func (r *testReloader) Reload(_ context.Context) error {
+	r.calls++
+	return nil
+}
+
+const routedRules = `
+groups:
+- name: tenant-a.critical
+  rules:
+  - alert: A
+    expr: vector(1)
+    labels:
+      criticality: critical
+- name: tenant-a.other
+  rules:
+  - alert: B
+    expr: vector(1)
+- name: tenant-b.other
+  rules:
+  - alert: C
+    expr: vector(1)
+`
+
+func TestRouter(t *testing.T) {
+	table, err := parseTable([]byte(`
+routes:
+- name: critical
+  selector: '{criticality="critical"}'
+  file: critical.yaml
+- name: tenant-b
+  tenants: [tenant-b]
+  file: tenant-b.yaml
+`))
+	assert.NoError(t, err)
+
+	criticalWriter, tenantBWriter, defaultWriter := &testWriter{}, &testWriter{}, &testWriter{}
+	criticalRuler, defaultRuler := &testReloader{}, &testReloader{}
+	router, err := NewRouter(table, "", []Output{
+		{Writer: criticalWriter, Reloader: criticalRuler},
+		{Writer: tenantBWriter, Reloader: defaultRuler},
+	}, Output{Writer: defaultWriter, Reloader: defaultRuler})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	assert.NoError(t, router.Write(ctx, strings.NewReader(routedRules)))
+	assert.NoError(t, router.Reload(ctx))
+
+	assert.Contains(t, criticalWriter.written.String(), "tenant-a.critical")
+	assert.NotContains(t, criticalWriter.written.String(), "other")
+	assert.Contains(t, tenantBWriter.written.String(), "tenant-b.other")
+	assert.Contains(t, defaultWriter.written.String(), "tenant-a.other")
+	assert.NotContains(t, defaultWriter.written.String(), "tenant-b")
+	// The default ruler reads two routes, but is reloaded once.
+	assert.Equal(t, 1, criticalRuler.calls)
+	assert.Equal(t, 1, defaultRuler.calls)
+
+	// Only the outputs whose rules changed are written, and only their rulers reloaded.
+	changed := strings.Replace(routedRules, "alert: A", "alert: A2", 1)
+	assert.NoError(t, router.Write(ctx, strings.NewReader(changed)))
+	assert.NoError(t, router.Reload(ctx))
+
+	assert.Equal(t, 2, criticalWriter.writes)
+	assert.Equal(t, 1, tenantBWriter.writes)
+	assert.Equal(t, 1, defaultWriter.writes)
+	assert.Equal(t, 2, criticalRuler.calls)
+	assert.Equal(t, 1, defaultRuler.calls)
+
+	// The routes of tenants apply regardless of the selectors of the routes, and aren't replaced if one is unknown.
+	assert.ErrorContains(t, router.SetTenantRoutes(map[string]string{"tenant-a": "unknown"}), `tenant tenant-a: unknown route "unknown"`)
+	assert.NoError(t, router.SetTenantRoutes(map[string]string{"tenant-a": "tenant-b", "tenant-b": DefaultRoute}))
+	assert.NoError(t, router.Write(ctx, strings.NewReader(changed)))
+
+	assert.NotContains(t, criticalWriter.written.String(), "tenant-a")
+	assert.Contains(t, tenantBWriter.written.String(), "tenant-a.critical")
+	assert.Contains(t, tenantBWriter.written.String(), "tenant-a.other")
+	assert.NotContains(t, tenantBWriter.written.String(), "tenant-b")
+	assert.Contains(t, defaultWriter.written.String(), "tenant-b.other")
+	assert.NotContains(t, defaultWriter.written.String(), "tenant-a")
+}
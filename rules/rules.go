@@ -0,0 +1,153 @@
+// Package rules parses and validates rule groups in the format read by Thanos Ruler.
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"gopkg.in/yaml.v3"
+)
+
+// Partial response strategies supported by Thanos Ruler.
+const (
+	PartialResponseWarn  = "warn"
+	PartialResponseAbort = "abort"
+)
+
+// RuleGroups is a set of rule groups as read by Thanos Ruler.
+type RuleGroups struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+// RuleGroup is a Prometheus rule group extended with the fields specific to Thanos Ruler.
+type RuleGroup struct {
+	rulefmt.RuleGroup       `yaml:",inline"`
+	PartialResponseStrategy string `yaml:"partial_response_strategy,omitempty"`
+	// QueryOffset is supported by recent rulers only, and is not known to the vendored Prometheus parser.
+	QueryOffset *model.Duration `yaml:"query_offset,omitempty"`
+	// SourceTenants are the tenants whose data a multi-tenant ruler queries to evaluate the rules of the group.
+	SourceTenants []string `yaml:"source_tenants,omitempty"`
+
+	// Library is specific to the syncer and is expanded into rules before groups are written.
+	Library *LibraryReference `yaml:"library,omitempty"`
+}
+
+// LibraryReference references a template of the rule library from a rule group.
+type LibraryReference struct {
+	Template string            `yaml:"template"`
+	Params   map[string]string `yaml:"params"`
+}
+
+// Parse parses and validates a set of rules that may use the fields specific to Thanos Ruler.
+func Parse(content []byte) (*RuleGroups, []error) {
+	var groups RuleGroups
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	// Ignore io.EOF which happens with empty input.
+	if err := decoder.Decode(&groups); err != nil && !errors.Is(err, io.EOF) {
+		return nil, []error{err}
+	}
+
+	var errs []error
+	for _, group := range groups.Groups {
+		if err := ValidatePartialResponseStrategy(group.PartialResponseStrategy); err != nil {
+			errs = append(errs, fmt.Errorf("group %q: %w", group.Name, err))
+		}
+	}
+
+	// Validate the Prometheus part of the groups with the upstream parser,
+	// once the fields it doesn't know about are left out.
+	promGroups := rulefmt.RuleGroups{Groups: make([]rulefmt.RuleGroup, 0, len(groups.Groups))}
+	for _, group := range groups.Groups {
+		promGroups.Groups = append(promGroups.Groups, group.RuleGroup)
+	}
+
+	promContent, err := yaml.Marshal(promGroups)
+	if err != nil {
+		return nil, []error{fmt.Errorf("failed to marshal rules: %w", err)}
+	}
+
+	if _, promErrs := rulefmt.Parse(promContent); len(promErrs) > 0 {
+		errs = append(errs, promErrs...)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return &groups, nil
+}
+
+// ValidatePartialResponseStrategy returns an error if the strategy is not supported by Thanos Ruler.
+// An empty strategy is valid and leaves the default one of Thanos Ruler.
+func ValidatePartialResponseStrategy(strategy string) error {
+	switch strings.ToLower(strategy) {
+	case "", PartialResponseWarn, PartialResponseAbort:
+		return nil
+	default:
+		return fmt.Errorf("unknown partial response strategy %q", strategy)
+	}
+}
+
+// TenantError is an error of the rules of a tenant, e.g. a failed fetch or invalid rules, so that the tenants that
+// failed can be told from an error joining the errors of several tenants with errors.Join, see ErrorTenants.
+type TenantError struct {
+	Tenant string
+	Err    error
+}
+
+func (e *TenantError) Error() string {
+	return "tenant " + e.Tenant + ": " + e.Err.Error()
+}
+
+func (e *TenantError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorTenants returns the tenants of the TenantErrors in the tree of the error, in the order they are found
+// and without duplicates, e.g. to report which tenants a sync failed for.
+func ErrorTenants(err error) []string {
+	var tenants []string
+	for _, tenantErr := range TenantErrors(err) {
+		if !slices.Contains(tenants, tenantErr.Tenant) {
+			tenants = append(tenants, tenantErr.Tenant)
+		}
+	}
+
+	return tenants
+}
+
+// TenantErrors returns the TenantErrors in the tree of the error, in the order they are found, e.g. to report
+// why the sync of each tenant failed.
+func TenantErrors(err error) []*TenantError {
+	var tenantErrs []*TenantError
+	var walk func(err error)
+	walk = func(err error) {
+		if tenantErr, ok := err.(*TenantError); ok {
+			tenantErrs = append(tenantErrs, tenantErr)
+		}
+
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			if wrapped := e.Unwrap(); wrapped != nil {
+				walk(wrapped)
+			}
+		case interface{ Unwrap() []error }:
+			for _, wrapped := range e.Unwrap() {
+				walk(wrapped)
+			}
+		}
+	}
+	if err != nil {
+		walk(err)
+	}
+
+	return tenantErrs
+}
@@ -0,0 +1,69 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidateStrict validates a rules document like Thanos Ruler does when it loads the file, e.g. the rules to be
+// written after they went through the policies and checks of a sync, so that the ruler doesn't fail to reload them:
+// unknown fields, repeated labels and annotations, invalid label names, expressions and templates, and repeated
+// group names. Each group is validated on its own, so that the findings are returned as TenantErrors of the tenant
+// owning the offending group, as given by groupTenant.
+func ValidateStrict(content []byte, groupTenant func(groupName string) string) error {
+	var doc struct {
+		Groups []yaml.Node `yaml:"groups"`
+	}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	var errs []error
+	names := make(map[string]struct{}, len(doc.Groups))
+	for i := range doc.Groups {
+		name := groupNodeName(&doc.Groups[i])
+
+		var groupErrs []error
+		if _, ok := names[name]; ok {
+			groupErrs = append(groupErrs, errors.New("group name is repeated"))
+		}
+		names[name] = struct{}{}
+
+		single, err := yaml.Marshal(struct {
+			Groups []*yaml.Node `yaml:"groups"`
+		}{Groups: []*yaml.Node{&doc.Groups[i]}})
+		if err != nil {
+			return fmt.Errorf("failed to marshal group %q: %w", name, err)
+		}
+		if _, parseErrs := Parse(single); len(parseErrs) > 0 {
+			groupErrs = append(groupErrs, parseErrs...)
+		}
+
+		if len(groupErrs) > 0 {
+			errs = append(errs, &TenantError{
+				Tenant: groupTenant(name),
+				Err:    fmt.Errorf("group %q: %w", name, errors.Join(groupErrs...)),
+			})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// groupNodeName returns the name of the group of a node, or an empty string if it has none, so that the group can be
+// told even if it doesn't decode.
+func groupNodeName(node *yaml.Node) string {
+	if node.Kind != yaml.MappingNode {
+		return ""
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == "name" && node.Content[i+1].Kind == yaml.ScalarNode {
+			return node.Content[i+1].Value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,139 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateStrict(t *testing.T) {
+	groupTenant := func(groupName string) string {
+		tenant, _, _ := strings.Cut(groupName, ".")
+		return tenant
+	}
+
+	testCases := map[string]struct {
+		content string
+
+		expectErr     string
+		expectTenants []string
+	}{
+		"valid": {
+			content: `groups:
+- name: tenant-a.alerts
+  partial_response_strategy: warn
+  rules:
+  - alert: Down
+    expr: up == 0
+    annotations:
+      summary: '{{ $labels.job }} is down'
+- name: tenant-b.records
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)
+`,
+		},
+		"empty": {
+			content: "",
+		},
+		"repeated label": {
+			content: `groups:
+- name: tenant-a.alerts
+  rules:
+  - alert: Down
+    expr: up == 0
+    labels:
+      severity: warning
+      severity: critical
+- name: tenant-b.alerts
+  rules:
+  - alert: Down
+    expr: up == 0
+`,
+			expectErr:     `mapping key "severity" already defined`,
+			expectTenants: []string{"tenant-a"},
+		},
+		"invalid label name": {
+			content: `groups:
+- name: tenant-a.alerts
+  rules:
+  - alert: Down
+    expr: up == 0
+    labels:
+      team-name: a
+`,
+			expectErr:     "invalid label name",
+			expectTenants: []string{"tenant-a"},
+		},
+		"invalid annotation template": {
+			content: `groups:
+- name: tenant-b.alerts
+  rules:
+  - alert: Down
+    expr: up == 0
+    annotations:
+      summary: '{{ $labels.job '
+`,
+			expectErr:     `annotation "summary"`,
+			expectTenants: []string{"tenant-b"},
+		},
+		"repeated group name": {
+			content: `groups:
+- name: tenant-a.alerts
+  rules:
+  - alert: Down
+    expr: up == 0
+- name: tenant-a.alerts
+  rules:
+  - alert: Up
+    expr: up == 1
+`,
+			expectErr:     "group name is repeated",
+			expectTenants: []string{"tenant-a"},
+		},
+		"unknown partial response strategy": {
+			content: `groups:
+- name: tenant-b.alerts
+  partial_response_strategy: ignore
+  rules:
+  - alert: Down
+    expr: up == 0
+`,
+			expectErr:     "unknown partial response strategy",
+			expectTenants: []string{"tenant-b"},
+		},
+		"findings of several tenants": {
+			content: `groups:
+- name: tenant-a.alerts
+  rules:
+  - alert: Down
+    expr: up ==
+- name: tenant-b.alerts
+  rules:
+  - alert: Down
+    expr: up == 0
+    unknown: true
+`,
+			expectErr:     "tenant tenant-a",
+			expectTenants: []string{"tenant-a", "tenant-b"},
+		},
+		"invalid document": {
+			content:   "groups: {",
+			expectErr: "failed to unmarshal rules",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateStrict([]byte(tc.content), groupTenant)
+			if tc.expectErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorContains(t, err, tc.expectErr)
+			assert.Equal(t, tc.expectTenants, ErrorTenants(err))
+		})
+	}
+}
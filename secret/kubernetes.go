@@ -0,0 +1,127 @@
+package secret
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// serviceAccountDir is where the credentials of the service account of a pod are mounted.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Kubernetes gets secrets from Kubernetes secrets through the API server, at locations of the form
+// [<namespace>/]<name>/<key>, e.g. monitoring/thanos-rule-syncer/client-secret. Without namespace,
+// the namespace of the Kubernetes provider is used. The service account must be allowed to get the secrets.
+type Kubernetes struct {
+	url       string
+	namespace string
+	// tokenFile is read at every request, as projected service account tokens are rotated.
+	tokenFile string
+	client    *http.Client
+}
+
+// NewKubernetes creates a new Kubernetes provider requesting the API server at the given URL with the bearer token
+// of tokenFile, for secrets of namespace by default.
+func NewKubernetes(apiURL, namespace, tokenFile string, client *http.Client) *Kubernetes {
+	return &Kubernetes{
+		url:       strings.TrimSuffix(apiURL, "/"),
+		namespace: namespace,
+		tokenFile: tokenFile,
+		client:    client,
+	}
+}
+
+// NewInClusterKubernetes creates a new Kubernetes provider with the service account of the pod it runs in,
+// for secrets of the namespace of the pod by default.
+func NewInClusterKubernetes() (*Kubernetes, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the namespace of the service account: %w", err)
+	}
+
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA certificate of the API server: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("failed to parse the CA certificate of the API server")
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		},
+	}
+
+	return NewKubernetes("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(namespace)), filepath.Join(serviceAccountDir, "token"), client), nil
+}
+
+// Secret gets the value of the key of the Kubernetes secret at location.
+func (k *Kubernetes) Secret(ctx context.Context, location string) (string, error) {
+	parts := strings.Split(location, "/")
+	switch len(parts) {
+	case 2:
+		parts = append([]string{k.namespace}, parts...)
+	case 3:
+	default:
+		return "", fmt.Errorf("invalid Kubernetes secret %q, must be [<namespace>/]<name>/<key>", location)
+	}
+	namespace, name, key := parts[0], parts[1], parts[2]
+
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the service account token: %w", err)
+	}
+
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/secrets/%s", k.url, url.PathEscape(namespace), url.PathEscape(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the Kubernetes secret: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get the Kubernetes secret: unexpected status code %d", resp.StatusCode)
+	}
+
+	var secret struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("failed to decode the Kubernetes secret: %w", err)
+	}
+
+	encoded, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("Kubernetes secret %s/%s has no key %s", namespace, name, key)
+	}
+	value, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode key %s of the Kubernetes secret: %w", key, err)
+	}
+
+	return string(value), nil
+}
@@ -0,0 +1,75 @@
+package secret
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKubernetesSecret(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sa-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/monitoring/secrets/syncer":
+			_, _ = w.Write([]byte(`{"data": {"client-secret": "ZnJvbS1tb25pdG9yaW5n"}}`))
+		case "/api/v1/namespaces/observatorium/secrets/syncer":
+			_, _ = w.Write([]byte(`{"data": {"client-secret": "ZnJvbS1vYnNlcnZhdG9yaXVt"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("sa-token\n"), 0o600))
+	k := NewKubernetes(server.URL, "monitoring", tokenFile, server.Client())
+
+	testCases := map[string]struct {
+		location string
+
+		expectErr    string
+		expectSecret string
+	}{
+		"namespace of the provider": {
+			location:     "syncer/client-secret",
+			expectSecret: "from-monitoring",
+		},
+		"other namespace": {
+			location:     "observatorium/syncer/client-secret",
+			expectSecret: "from-observatorium",
+		},
+		"missing key": {
+			location:  "syncer/client-id",
+			expectErr: "Kubernetes secret monitoring/syncer has no key client-id",
+		},
+		"missing secret": {
+			location:  "other/client-secret",
+			expectErr: "unexpected status code 404",
+		},
+		"invalid location": {
+			location:  "client-secret",
+			expectErr: `invalid Kubernetes secret "client-secret"`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			secret, err := k.Secret(context.Background(), tc.location)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectSecret, secret)
+		})
+	}
+}
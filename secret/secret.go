@@ -0,0 +1,223 @@
+// Package secret gets credentials, e.g. OIDC client secrets, from where they are kept instead of from plaintext flags:
+// environment variables, files, Kubernetes secrets or Vault.
+package secret
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Schemes of references to secrets, naming their provider.
+const (
+	SchemeEnv        = "env"
+	SchemeFile       = "file"
+	SchemeKubernetes = "kubernetes"
+	SchemeVault      = "vault"
+)
+
+// DefaultTTL is how long secrets are cached by default.
+const DefaultTTL = 5 * time.Minute
+
+// schemes are the schemes of references, including the ones of providers that aren't configured,
+// so that their references fail instead of being taken for plaintext secrets.
+var schemes = []string{SchemeEnv, SchemeFile, SchemeKubernetes, SchemeVault}
+
+// Provider gets the secret at a location specific to the provider, e.g. the name of an environment variable.
+type Provider interface {
+	Secret(ctx context.Context, location string) (string, error)
+}
+
+// ProviderFunc is a function getting secrets.
+type ProviderFunc func(ctx context.Context, location string) (string, error)
+
+// Secret gets the secret at the location.
+func (f ProviderFunc) Secret(ctx context.Context, location string) (string, error) {
+	return f(ctx, location)
+}
+
+// Env gets secrets from the environment variables named by their location.
+var Env = ProviderFunc(func(_ context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	return value, nil
+})
+
+// File gets secrets from the files at their location, without trailing newlines, e.g. mounted Kubernetes secrets.
+var File = ProviderFunc(func(_ context.Context, path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+})
+
+// Scheme returns the scheme of the reference to a secret, or an empty string if the value is a plaintext secret.
+func Scheme(value string) string {
+	scheme, _, ok := strings.Cut(value, ":")
+	if !ok {
+		return ""
+	}
+	for _, s := range schemes {
+		if s == scheme {
+			return scheme
+		}
+	}
+
+	return ""
+}
+
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+// secretFetch is a fetch of a secret from its provider, shared by the lookups of the secret until done is closed.
+type secretFetch struct {
+	done chan struct{}
+	// value and err are the result of the fetch, set before done is closed.
+	value string
+	err   error
+}
+
+// Resolver resolves references to secrets of the form <scheme>:<location>, e.g. env:OIDC_CLIENT_SECRET, with the
+// provider of their scheme. Values without the scheme of a provider are plaintext secrets, returned as they are.
+// Secrets are cached, and fetched again once their TTL expired, so that rotated secrets are picked up. If fetching
+// a rotated secret fails, the cached one is used until the next attempt and the failure is logged and counted.
+// Providers are called without blocking the lookups of other secrets, and concurrent lookups of a secret share a fetch.
+type Resolver struct {
+	providers map[string]Provider
+	ttl       time.Duration
+	now       func() time.Time
+
+	mtx     sync.Mutex
+	cache   map[string]cachedSecret
+	fetches map[string]*secretFetch
+
+	failures *prometheus.CounterVec
+}
+
+// Option configures a Resolver.
+type Option func(*Resolver)
+
+// WithProvider resolves the references of the scheme with the provider.
+func WithProvider(scheme string, p Provider) Option {
+	return func(r *Resolver) {
+		r.providers[scheme] = p
+	}
+}
+
+// WithTTL sets how long secrets are cached. If 0, secrets are fetched every time they are resolved.
+func WithTTL(ttl time.Duration) Option {
+	return func(r *Resolver) {
+		r.ttl = ttl
+	}
+}
+
+// WithRegisterer registers the metrics of the Resolver with the given registerer.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(r *Resolver) {
+		reg.MustRegister(r.failures)
+	}
+}
+
+// NewResolver creates a new Resolver, resolving the references of the env and file schemes by default.
+func NewResolver(opts ...Option) *Resolver {
+	r := &Resolver{
+		providers: map[string]Provider{
+			SchemeEnv:  Env,
+			SchemeFile: File,
+		},
+		ttl:     DefaultTTL,
+		now:     time.Now,
+		cache:   map[string]cachedSecret{},
+		fetches: map[string]*secretFetch{},
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_secret_fetch_failures_total",
+			Help: "Total number of failed fetches of secrets, by scheme of their reference.",
+		}, []string{"scheme"}),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// Secret returns the secret the value refers to, or the value itself if it is a plaintext secret.
+func (r *Resolver) Secret(ctx context.Context, value string) (string, error) {
+	scheme := Scheme(value)
+	if scheme == "" {
+		return value, nil
+	}
+
+	r.mtx.Lock()
+	cached, ok := r.cache[value]
+	if ok && r.now().Sub(cached.fetched) < r.ttl {
+		r.mtx.Unlock()
+		return cached.value, nil
+	}
+
+	p, found := r.providers[scheme]
+	if !found {
+		r.mtx.Unlock()
+		return "", fmt.Errorf("no provider is configured for %s secrets", scheme)
+	}
+
+	f, shared := r.fetches[value]
+	if !shared {
+		f = &secretFetch{done: make(chan struct{})}
+		r.fetches[value] = f
+	}
+	r.mtx.Unlock()
+
+	if shared {
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	} else {
+		r.fetch(ctx, p, scheme, value, f)
+	}
+
+	if f.err != nil {
+		if ok {
+			return cached.value, nil
+		}
+		return "", f.err
+	}
+
+	return f.value, nil
+}
+
+// fetch fetches the secret the value refers to from the provider, caches it, and closes the fetch with its result.
+func (r *Resolver) fetch(ctx context.Context, p Provider, scheme, value string, f *secretFetch) {
+	// The location of the reference isn't secret, so it is included in errors.
+	f.value, f.err = p.Secret(ctx, strings.TrimPrefix(value, scheme+":"))
+	if f.err != nil {
+		r.failures.WithLabelValues(scheme).Inc()
+		f.err = fmt.Errorf("failed to get secret %s: %w", value, f.err)
+	}
+
+	r.mtx.Lock()
+	if f.err == nil {
+		r.cache[value] = cachedSecret{value: f.value, fetched: r.now()}
+	} else if _, ok := r.cache[value]; ok {
+		log.Printf("using the cached secret: %v", f.err)
+	}
+	delete(r.fetches, value)
+	r.mtx.Unlock()
+	close(f.done)
+}
@@ -0,0 +1,153 @@
+package secret
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolverSecret(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	assert.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0o600))
+	t.Setenv("TEST_SECRET", "from-env")
+
+	testCases := map[string]struct {
+		value string
+
+		expectErr    string
+		expectSecret string
+	}{
+		"plaintext": {
+			value:        "plaintext",
+			expectSecret: "plaintext",
+		},
+		"plaintext with a colon": {
+			value:        "pass:word",
+			expectSecret: "pass:word",
+		},
+		"environment variable": {
+			value:        "env:TEST_SECRET",
+			expectSecret: "from-env",
+		},
+		"unset environment variable": {
+			value:     "env:TEST_SECRET_UNSET",
+			expectErr: "failed to get secret env:TEST_SECRET_UNSET: environment variable TEST_SECRET_UNSET is not set",
+		},
+		"file": {
+			value:        "file:" + file,
+			expectSecret: "from-file",
+		},
+		"provider not configured": {
+			value:     "vault:secret/data/syncer#client-secret",
+			expectErr: "no provider is configured for vault secrets",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			secret, err := NewResolver().Secret(context.Background(), tc.value)
+			if tc.expectErr != "" {
+				assert.EqualError(t, err, tc.expectErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectSecret, secret)
+		})
+	}
+}
+
+func TestResolverRotation(t *testing.T) {
+	var (
+		secret = "v1"
+		err    error
+		calls  int
+	)
+	p := ProviderFunc(func(_ context.Context, location string) (string, error) {
+		assert.Equal(t, "syncer#client-secret", location)
+		calls++
+		return secret, err
+	})
+
+	now := time.Now()
+	r := NewResolver(WithProvider(SchemeVault, p), WithTTL(time.Minute))
+	r.now = func() time.Time { return now }
+	resolve := func() string {
+		t.Helper()
+		value, err := r.Secret(context.Background(), "vault:syncer#client-secret")
+		assert.NoError(t, err)
+		return value
+	}
+
+	// The secret is cached until its TTL expires.
+	assert.Equal(t, "v1", resolve())
+	secret = "v2"
+	assert.Equal(t, "v1", resolve())
+	assert.Equal(t, 1, calls)
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, "v2", resolve())
+	assert.Equal(t, 2, calls)
+
+	// The cached secret is used while the rotated one can't be fetched.
+	err = errors.New("unavailable")
+	now = now.Add(time.Minute)
+	assert.Equal(t, "v2", resolve())
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.failures.WithLabelValues(SchemeVault)))
+
+	err = nil
+	secret = "v3"
+	assert.Equal(t, "v3", resolve())
+	assert.Equal(t, 4, calls)
+}
+
+func TestResolverConcurrentFetches(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	slow := ProviderFunc(func(_ context.Context, _ string) (string, error) {
+		calls.Add(1)
+		<-release
+		return "from-vault", nil
+	})
+	r := NewResolver(WithProvider(SchemeVault, slow))
+
+	results := make(chan string)
+	for i := 0; i < 3; i++ {
+		go func() {
+			value, err := r.Secret(context.Background(), "vault:syncer#client-secret")
+			assert.NoError(t, err)
+			results <- value
+		}()
+	}
+
+	assert.Eventually(t, func() bool { return calls.Load() == 1 }, 5*time.Second, time.Millisecond)
+
+	// The other secrets are resolved while the provider is slow.
+	t.Setenv("TEST_SECRET", "from-env")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		value, err := r.Secret(context.Background(), "env:TEST_SECRET")
+		assert.NoError(t, err)
+		assert.Equal(t, "from-env", value)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lookup of another secret was blocked by the provider")
+	}
+
+	// The concurrent lookups of the secret share a single fetch.
+	close(release)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "from-vault", <-results)
+	}
+	assert.Equal(t, int32(1), calls.Load())
+}
@@ -0,0 +1,98 @@
+package secret
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Vault gets secrets from the KV secrets engine of Vault, at locations of the form <path>#<key>,
+// e.g. secret/data/thanos-rule-syncer#client-secret with version 2 of the engine.
+type Vault struct {
+	addr string
+	// tokenFile is read at every request, e.g. a sink of the Vault agent renewing the token. If empty, the token is
+	// the VAULT_TOKEN environment variable.
+	tokenFile string
+	client    *http.Client
+}
+
+// NewVault creates a new Vault provider requesting the Vault server at addr with the token of tokenFile,
+// or of the VAULT_TOKEN environment variable if empty.
+func NewVault(addr, tokenFile string, client *http.Client) *Vault {
+	return &Vault{
+		addr:      strings.TrimSuffix(addr, "/"),
+		tokenFile: tokenFile,
+		client:    client,
+	}
+}
+
+// Secret gets the value of the key of the Vault secret at location.
+func (v *Vault) Secret(ctx context.Context, location string) (string, error) {
+	path, key, ok := strings.Cut(location, "#")
+	if !ok || path == "" || key == "" {
+		return "", fmt.Errorf("invalid Vault secret %q, must be <path>#<key>", location)
+	}
+
+	token, err := v.token()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the Vault secret: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get the Vault secret: unexpected status code %d", resp.StatusCode)
+	}
+
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("failed to decode the Vault secret: %w", err)
+	}
+
+	data := secret.Data
+	// Version 2 of the KV engine nests the secret in its metadata.
+	if nested, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no string key %s", path, key)
+	}
+
+	return value, nil
+}
+
+func (v *Vault) token() (string, error) {
+	if v.tokenFile == "" {
+		token := os.Getenv("VAULT_TOKEN")
+		if token == "" {
+			return "", fmt.Errorf("the Vault token is not set")
+		}
+		return token, nil
+	}
+
+	token, err := os.ReadFile(v.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the Vault token: %w", err)
+	}
+
+	return strings.TrimSpace(string(token)), nil
+}
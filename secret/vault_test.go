@@ -0,0 +1,92 @@
+package secret
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVaultSecret(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/syncer":
+			_, _ = w.Write([]byte(`{"data": {"data": {"client-secret": "from-kv2"}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/syncer":
+			_, _ = w.Write([]byte(`{"data": {"client-secret": "from-kv1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("vault-token\n"), 0o600))
+
+	testCases := map[string]struct {
+		location  string
+		tokenFile string
+		envToken  string
+
+		expectErr    string
+		expectSecret string
+	}{
+		"version 2 of the KV engine": {
+			location:     "secret/data/syncer#client-secret",
+			tokenFile:    tokenFile,
+			expectSecret: "from-kv2",
+		},
+		"version 1 of the KV engine": {
+			location:     "kv/syncer#client-secret",
+			tokenFile:    tokenFile,
+			expectSecret: "from-kv1",
+		},
+		"token of the environment": {
+			location:     "kv/syncer#client-secret",
+			envToken:     "vault-token",
+			expectSecret: "from-kv1",
+		},
+		"no token": {
+			location:  "kv/syncer#client-secret",
+			expectErr: "the Vault token is not set",
+		},
+		"missing key": {
+			location:  "secret/data/syncer#client-id",
+			tokenFile: tokenFile,
+			expectErr: "Vault secret secret/data/syncer has no string key client-id",
+		},
+		"denied": {
+			location:  "kv/syncer#client-secret",
+			envToken:  "other-token",
+			expectErr: "unexpected status code 403",
+		},
+		"invalid location": {
+			location:  "kv/syncer",
+			tokenFile: tokenFile,
+			expectErr: `invalid Vault secret "kv/syncer"`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("VAULT_TOKEN", tc.envToken)
+
+			secret, err := NewVault(server.URL, tc.tokenFile, server.Client()).Secret(context.Background(), tc.location)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectSecret, secret)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/nats-io/nats.go"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+)
+
+// Sources of the rules.
+const (
+	// sourceAPI fetches the rules from -rules-backend-url or -observatorium-api-url.
+	sourceAPI = "api"
+	// sourceStdin reads the rules from the standard input, e.g. piped by an external generator.
+	sourceStdin = "stdin"
+	// sourceNATS receives the rules of tenants from a NATS JetStream key-value bucket, e.g. put by a control plane.
+	sourceNATS = "nats"
+)
+
+// stdinRules reads a complete rules document from the standard input, so that the rules of external generators are
+// validated, transformed, written and reloaded like fetched ones. It is read once, and read again from its start
+// after reread if the standard input is a regular file, e.g. rewritten by the generator, as a pipe can't be.
+type stdinRules struct {
+	file *os.File
+
+	mu   sync.Mutex
+	data []byte
+	read bool
+}
+
+func newStdinRules(file *os.File) *stdinRules {
+	return &stdinRules{file: file}
+}
+
+// GetRules returns the rules read from the standard input, reading it until EOF the first time.
+func (s *stdinRules) GetRules(_ context.Context) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.read {
+		data, err := io.ReadAll(s.file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rules from standard input: %w", err)
+		}
+		// Empty rules would remove the rules of all tenants, e.g. if the generator failed before writing them.
+		if len(bytes.TrimSpace(data)) == 0 {
+			return nil, errors.New("no rules read from standard input")
+		}
+		s.data, s.read = data, true
+	}
+
+	return io.NopCloser(bytes.NewReader(s.data)), nil
+}
+
+// reread makes the next GetRules read the standard input again from its start. It returns an error if it can't be,
+// e.g. a pipe, in which case the rules already read are kept.
+func (s *stdinRules) reread() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("standard input can't be read again: %w", err)
+	}
+	s.read = false
+
+	return nil
+}
+
+// rereadOnHangup returns an actor reading the rules from the standard input again and running a sync cycle on each
+// SIGHUP, e.g. sent by a generator that rewrote them.
+func rereadOnHangup(ctx context.Context, rules *stdinRules, s *syncer.Syncer) func() error {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	return func() error {
+		defer signal.Stop(hangup)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-hangup:
+			}
+
+			if err := rules.reread(); err != nil {
+				log.Printf("received SIGHUP, syncing the rules already read: %v", err)
+			} else {
+				log.Print("received SIGHUP, syncing the rules read again from standard input")
+			}
+			s.Trigger()
+		}
+	}
+}
+
+// natsBucket is the NATS key-value bucket the rules of tenants are received from, set once connected by the startup.
+type natsBucket struct {
+	conn *nats.Conn
+	kv   nats.KeyValue
+}
+
+// connectNATS adds the startup step connecting to -nats.url and looking up -nats.bucket, retried until the server can
+// be reached and the bucket exists, e.g. until the control plane created it.
+func connectNATS(cfg *config, st *startup) *natsBucket {
+	bucket := &natsBucket{}
+	st.add("-nats.url", func(context.Context) error {
+		opts := []nats.Option{nats.Name("thanos-rule-syncer"), nats.MaxReconnects(-1)}
+		opts = append(opts, natsTLS(cfg.nats.url, cfg.httpClient.tls)...)
+		if cfg.nats.credentialsFile != "" {
+			opts = append(opts, nats.UserCredentials(cfg.nats.credentialsFile))
+		}
+
+		conn, err := nats.Connect(cfg.nats.url, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		js, err := conn.JetStream()
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to use JetStream: %w", err)
+		}
+		kv, err := js.KeyValue(cfg.nats.bucket)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to look up NATS bucket %s: %w", cfg.nats.bucket, err)
+		}
+
+		bucket.conn, bucket.kv = conn, kv
+		return nil
+	})
+
+	return bucket
+}
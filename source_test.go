@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStdinRules(t *testing.T) {
+	const rules = "groups:\n- name: test\n  rules: []\n"
+
+	testCases := map[string]struct {
+		// pipe reads the rules from a pipe instead of a regular file.
+		pipe    bool
+		content string
+		// rewritten replaces the content before it is read again.
+		rewritten string
+
+		expectErr       string
+		expectRereadErr bool
+		expectRules     string
+	}{
+		"regular file read again": {
+			content:     rules,
+			rewritten:   "groups: []\n",
+			expectRules: "groups: []\n",
+		},
+		"pipe read once": {
+			pipe:            true,
+			content:         rules,
+			expectRereadErr: true,
+			expectRules:     rules,
+		},
+		"empty": {
+			content:   " \n",
+			expectErr: "no rules read from standard input",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var file *os.File
+			path := filepath.Join(t.TempDir(), "rules.yaml")
+			if tc.pipe {
+				r, w, err := os.Pipe()
+				assert.NoError(t, err)
+				_, err = io.WriteString(w, tc.content)
+				assert.NoError(t, err)
+				assert.NoError(t, w.Close())
+				file = r
+			} else {
+				assert.NoError(t, os.WriteFile(path, []byte(tc.content), 0o600))
+				var err error
+				file, err = os.Open(path)
+				assert.NoError(t, err)
+			}
+			defer file.Close()
+
+			s := newStdinRules(file)
+			get := func() (string, error) {
+				rules, err := s.GetRules(context.Background())
+				if err != nil {
+					return "", err
+				}
+				content, err := io.ReadAll(rules)
+				return string(content), err
+			}
+
+			content, err := get()
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.content, content)
+
+			if tc.rewritten != "" {
+				assert.NoError(t, os.WriteFile(path, []byte(tc.rewritten), 0o600))
+			}
+			if tc.expectRereadErr {
+				assert.Error(t, s.reread())
+			} else {
+				assert.NoError(t, s.reread())
+			}
+
+			content, err = get()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectRules, content)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// spiffeAttemptTimeout is how long an attempt to get the first SVID from the Workload API waits, so that the startup
+// logs and retries while the agent is unavailable instead of waiting silently.
+const spiffeAttemptTimeout = 10 * time.Second
+
+// x509Source is the source of the X.509 SVID of the syncer and of the bundles its servers are verified against.
+type x509Source interface {
+	x509svid.Source
+	x509bundle.Source
+}
+
+// spiffeIdentity is the identity of the syncer in a SPIFFE trust domain, e.g. issued by SPIRE: the X.509 SVID it
+// presents to the servers of the upstreams, and the bundles their own SVIDs are verified against. The SVID and the
+// bundles are streamed by the Workload API of the local agent, so that they are rotated without restarting the syncer.
+type spiffeIdentity struct {
+	source atomic.Pointer[x509Source]
+
+	expiry prometheus.GaugeFunc
+}
+
+// newSPIFFEIdentity returns an identity without SVID, which fails the TLS handshakes until it is set or started.
+func newSPIFFEIdentity(r prometheus.Registerer) *spiffeIdentity {
+	s := &spiffeIdentity{}
+	s.expiry = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "thanos_rule_syncer_fetch_svid_expiry_timestamp_seconds",
+		Help: "When the X.509 SVID presented to the upstreams expires, as a Unix timestamp. 0 until it is received from the Workload API.",
+	}, func() float64 {
+		svid, err := s.GetX509SVID()
+		if err != nil || len(svid.Certificates) == 0 {
+			return 0
+		}
+		return float64(svid.Certificates[0].NotAfter.Unix())
+	})
+
+	if r != nil {
+		r.MustRegister(s.expiry)
+	}
+
+	return s
+}
+
+// start connects to the Workload API at the address, e.g. unix:///run/spire/sockets/agent.sock, or at the one of the
+// SPIFFE_ENDPOINT_SOCKET environment variable if it is empty, and waits for the first SVID. The SVID and the bundles are
+// updated until done is closed.
+func (s *spiffeIdentity) start(ctx context.Context, addr string, done <-chan struct{}) error {
+	var opts []workloadapi.X509SourceOption
+	if addr != "" {
+		opts = append(opts, workloadapi.WithClientOptions(workloadapi.WithAddr(addr)))
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, spiffeAttemptTimeout)
+	defer cancel()
+	source, err := workloadapi.NewX509Source(attemptCtx, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to get the X.509 SVID from the Workload API: %w", err)
+	}
+
+	s.set(source)
+	go func() {
+		<-done
+		source.Close()
+	}()
+
+	return nil
+}
+
+// set sets the source of the SVID and the bundles.
+func (s *spiffeIdentity) set(source x509Source) {
+	s.source.Store(&source)
+}
+
+// GetX509SVID returns the SVID of the syncer. It implements x509svid.Source.
+func (s *spiffeIdentity) GetX509SVID() (*x509svid.SVID, error) {
+	source := s.source.Load()
+	if source == nil {
+		return nil, errors.New("the X.509 SVID wasn't received from the Workload API yet")
+	}
+
+	return (*source).GetX509SVID()
+}
+
+// GetX509BundleForTrustDomain returns the bundle of the trust domain. It implements x509bundle.Source.
+func (s *spiffeIdentity) GetX509BundleForTrustDomain(td spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	source := s.source.Load()
+	if source == nil {
+		return nil, errors.New("the X.509 bundles weren't received from the Workload API yet")
+	}
+
+	return (*source).GetX509BundleForTrustDomain(td)
+}
+
+// configure makes the transport present the SVID to the servers, and verify their SVIDs against the bundles instead of
+// the certificates of the system or of a CA file: the server must have the SPIFFE ID serverID, or be a member of the trust
+// domain of the syncer if it is empty. The TLS configuration is updated rather than replaced, to keep the HTTP/2
+// protocols added to it.
+func (s *spiffeIdentity) configure(t *http.Transport, serverID string) error {
+	authorizer, err := s.authorizer(serverID)
+	if err != nil {
+		return err
+	}
+
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	tlsconfig.HookMTLSClientConfig(t.TLSClientConfig, s, s, authorizer)
+
+	return nil
+}
+
+// authorizer returns the authorizer of the SPIFFE ID of the servers, see configure.
+func (s *spiffeIdentity) authorizer(serverID string) (tlsconfig.Authorizer, error) {
+	if serverID != "" {
+		id, err := spiffeid.FromString(serverID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPIFFE ID %q: %w", serverID, err)
+		}
+		return tlsconfig.AuthorizeID(id), nil
+	}
+
+	// The trust domain of the syncer is only known once its SVID is received.
+	return func(id spiffeid.ID, _ [][]*x509.Certificate) error {
+		svid, err := s.GetX509SVID()
+		if err != nil {
+			return err
+		}
+		if !id.MemberOf(svid.ID.TrustDomain()) {
+			return fmt.Errorf("the SPIFFE ID %s of the server is not a member of the trust domain %s", id, svid.ID.TrustDomain())
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSPIFFECA issues the X.509 SVIDs of a trust domain.
+type testSPIFFECA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestSPIFFECA(t *testing.T, td string) *testSPIFFECA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: td},
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: td}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return &testSPIFFECA{cert: cert, key: key}
+}
+
+// svid issues the SVID of the SPIFFE ID, expiring at notAfter.
+func (ca *testSPIFFECA) svid(t *testing.T, id string, notAfter time.Time) *x509svid.SVID {
+	spiffeID := spiffeid.RequireFromString(id)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		URIs:         []*url.URL{spiffeID.URL()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return &x509svid.SVID{ID: spiffeID, Certificates: []*x509.Certificate{cert}, PrivateKey: key}
+}
+
+// testX509Source is a static source of an SVID and of the bundle of its trust domain.
+type testX509Source struct {
+	svid   *x509svid.SVID
+	bundle *x509bundle.Bundle
+}
+
+func (s testX509Source) GetX509SVID() (*x509svid.SVID, error) {
+	return s.svid, nil
+}
+
+func (s testX509Source) GetX509BundleForTrustDomain(td spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	return s.bundle.GetX509BundleForTrustDomain(td)
+}
+
+func TestSPIFFEIdentity(t *testing.T) {
+	ca := newTestSPIFFECA(t, "example.org")
+	otherCA := newTestSPIFFECA(t, "other.org")
+	bundle := x509bundle.FromX509Authorities(spiffeid.RequireTrustDomainFromString("example.org"), []*x509.Certificate{ca.cert})
+
+	serverSVID := ca.svid(t, "spiffe://example.org/observatorium-api", time.Now().Add(time.Hour))
+	otherServerSVID := otherCA.svid(t, "spiffe://other.org/observatorium-api", time.Now().Add(time.Hour))
+	clientExpiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	clientSVID := ca.svid(t, "spiffe://example.org/thanos-rule-syncer", clientExpiry)
+	rotatedSVID := ca.svid(t, "spiffe://example.org/thanos-rule-syncer/rotated", clientExpiry.Add(time.Hour))
+
+	// newServer returns a server presenting the SVID and responding with the SPIFFE ID of the client.
+	newServer := func(svid *x509svid.SVID) *httptest.Server {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].URIs[0].String()))
+		}))
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{svid.Certificates[0].Raw}, PrivateKey: svid.PrivateKey}},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		}
+		server.StartTLS()
+		return server
+	}
+	server := newServer(serverSVID)
+	defer server.Close()
+	otherServer := newServer(otherServerSVID)
+	defer otherServer.Close()
+
+	testCases := map[string]struct {
+		serverID string
+		server   *httptest.Server
+
+		expectConfigErr bool
+		expectErr       string
+	}{
+		"member of the trust domain": {
+			server: server,
+		},
+		"server ID": {
+			serverID: "spiffe://example.org/observatorium-api",
+			server:   server,
+		},
+		"other server ID": {
+			serverID:  "spiffe://example.org/rules-objstore",
+			server:    server,
+			expectErr: "unexpected ID",
+		},
+		"other trust domain": {
+			server:    otherServer,
+			expectErr: `no X.509 bundle found for trust domain: "other.org"`,
+		},
+		"invalid server ID": {
+			serverID:        "https://example.org",
+			expectConfigErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := prometheus.NewRegistry()
+			identity := newSPIFFEIdentity(r)
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.DisableKeepAlives = true
+			err := identity.configure(transport, tc.serverID)
+			if tc.expectConfigErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			client := &http.Client{Transport: transport}
+			get := func() (string, error) {
+				res, err := client.Get(tc.server.URL)
+				if err != nil {
+					return "", err
+				}
+				defer res.Body.Close()
+				body, err := io.ReadAll(res.Body)
+				return string(body), err
+			}
+
+			// The handshakes fail until the SVID is received.
+			_, err = get()
+			assert.ErrorContains(t, err, "received from the Workload API yet")
+			assert.Equal(t, float64(0), testutil.ToFloat64(identity.expiry))
+
+			identity.set(testX509Source{svid: clientSVID, bundle: bundle})
+			id, err := get()
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "spiffe://example.org/thanos-rule-syncer", id)
+			assert.Equal(t, float64(clientExpiry.Unix()), testutil.ToFloat64(identity.expiry))
+
+			// The rotated SVID is presented on the next connections.
+			identity.set(testX509Source{svid: rotatedSVID, bundle: bundle})
+			id, err = get()
+			assert.NoError(t, err)
+			assert.Equal(t, "spiffe://example.org/thanos-rule-syncer/rotated", id)
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// startup initializes the dependencies of the syncer that may be briefly unavailable when it starts, e.g. a CA file not
+// mounted yet, a secret store or an OIDC issuer that can't be reached, retrying each step with backoff within the run
+// group instead of exiting, so that the pod doesn't crash loop. The syncer is ready once all the steps succeeded.
+// Steps failing with a backoff.Permanent error, e.g. an invalid file, aren't retried.
+type startup struct {
+	timeout time.Duration
+	steps   []startupStep
+	done    chan struct{}
+
+	ready    prometheus.Gauge
+	failures *prometheus.CounterVec
+}
+
+type startupStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// newStartup returns the startup retrying its steps for up to the timeout, or until they succeed if it is 0.
+func newStartup(r prometheus.Registerer, timeout time.Duration) *startup {
+	s := &startup{
+		timeout: timeout,
+		done:    make(chan struct{}),
+		ready: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_ready",
+			Help: "Whether the dependencies of the syncer were initialized at startup.",
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_startup_failures_total",
+			Help: "Total number of failed attempts of the startup steps, by step.",
+		}, []string{"step"}),
+	}
+	if r != nil {
+		r.MustRegister(s.ready, s.failures)
+	}
+
+	return s
+}
+
+// add adds a step, run once the steps added before succeeded. Its name is used in the logs and errors.
+func (s *startup) add(name string, run func(ctx context.Context) error) {
+	s.steps = append(s.steps, startupStep{name: name, run: run})
+}
+
+// Run runs the steps in order, retrying each with backoff until it succeeds, and marks the syncer as ready.
+// It fails if a step fails permanently, the timeout is over or the context is done.
+func (s *startup) Run(ctx context.Context) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	for _, step := range s.steps {
+		step := step
+		b := backoff.NewExponentialBackOff()
+		b.MaxElapsedTime = 0
+
+		var last error
+		err := backoff.RetryNotify(func() error {
+			last = step.run(ctx)
+			if last != nil {
+				s.failures.WithLabelValues(step.name).Inc()
+			}
+			return last
+		}, backoff.WithContext(b, ctx), func(err error, next time.Duration) {
+			log.Printf("failed to initialize %s, retrying in %s: %v", step.name, next.Round(time.Millisecond), err)
+		})
+		if err != nil {
+			// Once the timeout is over, the last failure tells why better than the context.
+			if ctx.Err() != nil && last != nil {
+				err = last
+			}
+			return fmt.Errorf("failed to initialize %s: %w", step.name, err)
+		}
+	}
+
+	s.ready.Set(1)
+	close(s.done)
+	if len(s.steps) > 0 {
+		log.Print("initialized the dependencies of the syncer")
+	}
+
+	return nil
+}
+
+// actor returns the function of the run group actor running the steps, see Run. Once they succeeded, it keeps running
+// until the context is done, since the run group stops all the other actors as soon as one of them returns.
+func (s *startup) actor(ctx context.Context) func() error {
+	return func() error {
+		if err := s.Run(ctx); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return nil
+	}
+}
+
+// Ready tells whether all the steps succeeded.
+func (s *startup) Ready() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// then returns the function calling run once all the steps succeeded, failing if the context is done first.
+func (s *startup) then(ctx context.Context, run func() error) func() error {
+	return func() error {
+		select {
+		case <-s.done:
+			return run()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// transport returns the transport waiting for all the steps to succeed before sending requests with base, so that the
+// steps can still configure base, e.g. with the CA of a file, and requests aren't sent with credentials not checked yet.
+func (s *startup) transport(base http.RoundTripper) http.RoundTripper {
+	return startupTransport{startup: s, base: base}
+}
+
+type startupTransport struct {
+	startup *startup
+	base    http.RoundTripper
+}
+
+func (t startupTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case <-t.startup.done:
+		return t.base.RoundTrip(req)
+	case <-req.Context().Done():
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, req.Context().Err()
+	}
+}
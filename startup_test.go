@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/metalmatze/signal/internalserver"
+	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartup(t *testing.T) {
+	testCases := map[string]struct {
+		// failures is the number of attempts of the second step failing before it succeeds, -1 if it fails permanently.
+		failures int
+		timeout  time.Duration
+
+		expectErr      string
+		expectAttempts int
+	}{
+		"succeeds": {
+			expectAttempts: 1,
+		},
+		"retries": {
+			failures:       2,
+			expectAttempts: 3,
+		},
+		"permanent failure": {
+			failures:       -1,
+			expectErr:      "failed to initialize step-b: invalid",
+			expectAttempts: 1,
+		},
+		"timeout": {
+			failures:  1000,
+			timeout:   100 * time.Millisecond,
+			expectErr: "failed to initialize step-b: unavailable",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			st := newStartup(nil, tc.timeout)
+			var steps []string
+			attempts := 0
+			st.add("step-a", func(context.Context) error {
+				steps = append(steps, "step-a")
+				return nil
+			})
+			st.add("step-b", func(context.Context) error {
+				attempts++
+				switch {
+				case tc.failures < 0:
+					return backoff.Permanent(errors.New("invalid"))
+				case attempts <= tc.failures:
+					return errors.New("unavailable")
+				}
+				steps = append(steps, "step-b")
+				return nil
+			})
+
+			err := st.Run(context.Background())
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				assert.False(t, st.Ready())
+				assert.Equal(t, 0.0, testutil.ToFloat64(st.ready))
+				if tc.expectAttempts > 0 {
+					assert.Equal(t, tc.expectAttempts, attempts)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, st.Ready())
+			assert.Equal(t, 1.0, testutil.ToFloat64(st.ready))
+			assert.Equal(t, []string{"step-a", "step-b"}, steps)
+			assert.Equal(t, tc.expectAttempts, attempts)
+			assert.Equal(t, float64(tc.failures), testutil.ToFloat64(st.failures.WithLabelValues("step-b")))
+		})
+	}
+}
+
+func TestStartupWaits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+
+	st := newStartup(nil, 0)
+	unblock := make(chan struct{})
+	st.add("step", func(context.Context) error {
+		<-unblock
+		return nil
+	})
+	h := internalserver.NewHandler()
+	addReadyEndpoint(h, st.Ready)
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+		return rec.Code
+	}
+
+	// Neither the actors nor the requests start before the steps succeeded.
+	ran := make(chan struct{})
+	go func() {
+		_ = st.then(context.Background(), func() error {
+			close(ran)
+			return nil
+		})()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	_, err := (&http.Client{Transport: st.transport(http.DefaultTransport)}).Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+
+	done := make(chan error)
+	go func() {
+		done <- st.Run(context.Background())
+	}()
+	close(unblock)
+	assert.NoError(t, <-done)
+	<-ran
+
+	res, err := (&http.Client{Transport: st.transport(http.DefaultTransport)}).Get(server.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, ready())
+
+	// Actors waiting for the startup fail once the context is done.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, newStartup(nil, 0).then(ctx, func() error { return nil })(), context.Canceled)
+}
+
+func TestStartupActor(t *testing.T) {
+	st := newStartup(nil, 0)
+	st.add("step", func(context.Context) error { return nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var gr run.Group
+	gr.Add(st.actor(ctx), func(_ error) {
+		cancel()
+	})
+	gr.Add(st.then(ctx, func() error {
+		<-ctx.Done()
+		return nil
+	}), func(_ error) {
+		cancel()
+	})
+	done := make(chan error)
+	go func() {
+		done <- gr.Run()
+	}()
+
+	// The run group keeps running once the startup is over.
+	assert.Eventually(t, st.Ready, time.Second, time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("the run group stopped after the startup: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
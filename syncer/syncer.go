@@ -0,0 +1,838 @@
+// Package syncer runs the pipeline syncing rules: fetching them, writing them and reloading the ruler.
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/metrics"
+	"github.com/observatorium/thanos-rule-syncer/output"
+	"github.com/observatorium/thanos-rule-syncer/reload"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// OverlapSkip skips the sync cycles due while a cycle is still in progress.
+	OverlapSkip = "skip"
+	// OverlapQueue runs a single sync cycle right after the one in progress when any were due meanwhile.
+	OverlapQueue = "queue"
+)
+
+const (
+	defaultInterval = 60 * time.Second
+	// minTimeout is the minimum time a sync cycle is given before it is cancelled.
+	minTimeout = 60 * time.Second
+)
+
+// Phases of a sync cycle.
+const (
+	PhaseFetch  = "fetch"
+	PhaseParse  = "parse"
+	PhaseWrite  = "write"
+	PhaseReload = "reload"
+)
+
+// Classes of errors, by their cause.
+const (
+	ErrorConfig     = "config"
+	ErrorAuth       = "auth"
+	ErrorFetch      = "fetch"
+	ErrorValidation = "validation"
+	ErrorWrite      = "write"
+	ErrorReload     = "reload"
+)
+
+// phaseErrorClasses are the classes of the errors of the phases of a sync cycle.
+var phaseErrorClasses = map[string]string{
+	PhaseFetch:  ErrorFetch,
+	PhaseParse:  ErrorValidation,
+	PhaseWrite:  ErrorWrite,
+	PhaseReload: ErrorReload,
+}
+
+// Error is an error of a class, e.g. so that automation can tell rejected credentials from an unavailable rules source.
+type Error struct {
+	Class string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorClass returns the class of the error, or an empty string if it has none.
+func ErrorClass(err error) string {
+	var classErr *Error
+	if errors.As(err, &classErr) {
+		return classErr.Class
+	}
+
+	return ""
+}
+
+// Timeouts are the maximum durations of the phases of a sync cycle. A zero timeout doesn't limit the phase,
+// which is still limited by the timeout of the whole cycle.
+type Timeouts struct {
+	// Fetch limits fetching the rules.
+	Fetch time.Duration
+	// Parse limits post-processing the rules with the processors.
+	Parse time.Duration
+	// Write limits writing the rules.
+	Write time.Duration
+	// Reload limits reloading the ruler.
+	Reload time.Duration
+}
+
+// Processor post-processes fetched rules, e.g. merging or checking them, in the parse phase of a sync cycle.
+type Processor func(ctx context.Context, rules []byte) ([]byte, error)
+
+// Cycle is the outcome of a sync cycle, given to the observers of the Syncer once it is over, e.g. to report it.
+type Cycle struct {
+	// Start is when the cycle started, and Duration how long it took.
+	Start    time.Time
+	Duration time.Duration
+	// Budget is how long the cycle had before the next one was due, or 0 if it wasn't run by the Loop.
+	Budget time.Duration
+	// Phases are the phases the cycle ran, in order.
+	Phases []PhaseResult
+	// Fetched are the rules fetched by the cycle, before they were post-processed, or nil if the fetch failed.
+	Fetched []byte
+	// Previous are the rules last written before the cycle, or nil if none were written yet.
+	Previous []byte
+	// Written are the rules written by the cycle, or the rules unchanged since they were last written, or nil if it failed
+	// before, sync is paused or the Syncer is a standby.
+	Written []byte
+	// Unchanged is whether the rules are unchanged since the ruler was last reloaded with them, so that they weren't
+	// written again nor the ruler reloaded, see WithSkipUnchanged.
+	Unchanged bool
+	// Paused is whether sync is paused, so that the rules weren't written.
+	Paused bool
+	// Standby is whether the Syncer is a standby not promoted yet, so that the rules weren't written.
+	Standby bool
+	// TenantErrors are the errors of the tenants whose last rules were fetched instead of failing the cycle, e.g.
+	// because their fetch was aborted, see fetch.TenantErrors.
+	TenantErrors []*rules.TenantError
+	// Err is the error of the cycle, if it failed.
+	Err error
+}
+
+// PhaseResult is the outcome of a phase of a sync cycle.
+type PhaseResult struct {
+	Name     string
+	Duration time.Duration
+	// Err is the error of the phase, if it failed.
+	Err error
+}
+
+// Observer is called with each sync cycle once it is over.
+type Observer func(ctx context.Context, c Cycle)
+
+// Schedule returns the time of the next sync cycle after the given time, e.g. a parsed cron expression.
+type Schedule interface {
+	Next(time.Time) time.Time
+}
+
+// Syncer syncs rules from a fetcher to a writer, and reloads the ruler reading them.
+type Syncer struct {
+	fetcher    fetch.Fetcher
+	processors []Processor
+	observers  []Observer
+	writer     output.Writer
+	reloader   reload.Reloader
+	interval   time.Duration
+	schedule   Schedule
+	overlap    string
+	trigger    chan struct{}
+	timeouts   Timeouts
+	clock      clock.Clock
+	// tuningMu guards the interval and timeouts, which can be changed at runtime, and retuned signals
+	// the Loop that the interval changed.
+	tuningMu sync.RWMutex
+	retuned  chan struct{}
+	// running is held by the cycle run by the Handler.
+	running sync.Mutex
+
+	paused  atomic.Bool
+	standby atomic.Bool
+	// lastHash is the hash of the rules last written, and reloadedHash the hash of the rules the ruler was last
+	// reloaded with, if reloaded is set.
+	lastHash     [sha256.Size]byte
+	reloadedHash [sha256.Size]byte
+	reloaded     bool
+	lastHashMu   sync.Mutex
+	// skipUnchanged skips writing and reloading unchanged rules, see WithSkipUnchanged.
+	skipUnchanged bool
+	// lastFetched and lastWritten are the rules last fetched and last written, for debugging.
+	lastFetched []byte
+	lastWritten []byte
+	lastRulesMu sync.RWMutex
+
+	reloadDuration prometheus.Gauge
+	pausedGauge    prometheus.Gauge
+	standbyGauge   prometheus.Gauge
+	pendingChanges prometheus.Gauge
+	cyclesSkipped  prometheus.Counter
+	rulesUpdates   *prometheus.CounterVec
+	phaseDuration  *prometheus.HistogramVec
+	phaseTimeouts  *prometheus.CounterVec
+	errorsTotal    *prometheus.CounterVec
+	tenantErrors   *prometheus.CounterVec
+	cycleBudget    prometheus.Gauge
+	phaseBudget    *prometheus.GaugeVec
+	// cycleStart is the start time in Unix nanoseconds of the cycle in progress, or 0.
+	cycleStart         atomic.Int64
+	cycleInProgressDur prometheus.GaugeFunc
+	// heartbeat is the time in Unix nanoseconds the Loop last progressed at, i.e. started or got a cycle over, or 0.
+	heartbeat atomic.Int64
+}
+
+// Option configures a Syncer.
+type Option func(*Syncer)
+
+// WithInterval sets the interval between sync cycles.
+func WithInterval(interval time.Duration) Option {
+	return func(s *Syncer) {
+		s.interval = interval
+	}
+}
+
+// WithSchedule runs sync cycles at the times of the schedule instead of at every interval.
+func WithSchedule(schedule Schedule) Option {
+	return func(s *Syncer) {
+		s.schedule = schedule
+	}
+}
+
+// WithOverlapPolicy sets what happens to sync cycles due while a cycle is still in progress.
+// One of OverlapSkip or OverlapQueue.
+func WithOverlapPolicy(policy string) Option {
+	return func(s *Syncer) {
+		s.overlap = policy
+	}
+}
+
+// WithProcessors post-processes the fetched rules with the given processors, in order.
+func WithProcessors(processors ...Processor) Option {
+	return func(s *Syncer) {
+		s.processors = append(s.processors, processors...)
+	}
+}
+
+// WithObservers calls the given observers with each sync cycle once it is over, in order.
+func WithObservers(observers ...Observer) Option {
+	return func(s *Syncer) {
+		s.observers = append(s.observers, observers...)
+	}
+}
+
+// WithTimeouts sets the timeouts of the phases of sync cycles.
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(s *Syncer) {
+		s.timeouts = timeouts
+	}
+}
+
+// WithStandby starts the Syncer as a standby, e.g. of another instance in a disaster recovery setup, fetching and
+// post-processing the rules like the active instance, but never writing them nor reloading the ruler until promoted.
+func WithStandby() Option {
+	return func(s *Syncer) {
+		s.standby.Store(true)
+		s.standbyGauge.Set(1)
+	}
+}
+
+// WithSkipUnchanged skips writing the rules and reloading the ruler when the rules are unchanged since the ruler was
+// last reloaded with them, as reloading restarts the evaluation of the rules, unless the writer has pending changes,
+// see output.Pending.
+func WithSkipUnchanged() Option {
+	return func(s *Syncer) {
+		s.skipUnchanged = true
+	}
+}
+
+// WithClock sets the clock timing sync cycles, e.g. a fake clock in tests.
+func WithClock(c clock.Clock) Option {
+	return func(s *Syncer) {
+		s.clock = c
+	}
+}
+
+// WithRegisterer registers the metrics of the Syncer with the given registerer.
+func WithRegisterer(r prometheus.Registerer) Option {
+	return func(s *Syncer) {
+		r.MustRegister(s.reloadDuration, s.pausedGauge, s.standbyGauge, s.pendingChanges, s.cyclesSkipped, s.rulesUpdates, s.cycleInProgressDur, s.phaseDuration, s.phaseTimeouts, s.errorsTotal, s.tenantErrors, s.cycleBudget, s.phaseBudget)
+	}
+}
+
+// New creates a new Syncer.
+func New(f fetch.Fetcher, w output.Writer, r reload.Reloader, opts ...Option) *Syncer {
+	s := &Syncer{
+		fetcher:  f,
+		writer:   w,
+		reloader: r,
+		interval: defaultInterval,
+		overlap:  OverlapQueue,
+		clock:    clock.Real(),
+		trigger:  make(chan struct{}, 1),
+		retuned:  make(chan struct{}, 1),
+		reloadDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_reload_duration_seconds",
+			Help: "Total duration of tenants file reload.",
+		}),
+		pausedGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_paused",
+			Help: "Whether writing rules and reloading the ruler is paused.",
+		}),
+		standbyGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_standby",
+			Help: "Whether the syncer is a standby not promoted yet, never writing rules nor reloading the ruler.",
+		}),
+		pendingChanges: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_paused_pending_changes",
+			Help: "Whether the rules fetched while paused differ from the rules last written.",
+		}),
+		cyclesSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_cycles_skipped_total",
+			Help: "Total number of sync cycles skipped because a cycle was still in progress.",
+		}),
+		rulesUpdates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_rules_updates_total",
+			Help: "Total number of sync cycles updating the rules, by result: performed if the rules were written and the ruler reloaded, skipped if the rules were unchanged since the ruler was last reloaded with them.",
+		}, []string{"result"}),
+		phaseDuration: prometheus.NewHistogramVec(metrics.HistogramOpts(prometheus.HistogramOpts{
+			Name:    "thanos_rule_syncer_phase_duration_seconds",
+			Help:    "Duration of the phases of sync cycles, by phase.",
+			Buckets: prometheus.DefBuckets,
+		}), []string{"phase"}),
+		phaseTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_phase_timeouts_total",
+			Help: "Total number of phases of sync cycles that timed out, by phase.",
+		}, []string{"phase"}),
+		errorsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_sync_errors_total",
+			Help: "Total number of failed sync cycles, by class of error.",
+		}, []string{"class"}),
+		tenantErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_tenant_sync_errors_total",
+			Help: "Total number of failed sync cycles, by class of error and tenant the error is attributed to.",
+		}, []string{"class", "tenant"}),
+		cycleBudget: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_cycle_budget_used_ratio",
+			Help: "Share of its budget, the time before the next cycle was due, the last sync cycle run by the loop took.",
+		}),
+		phaseBudget: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_phase_budget_used_ratio",
+			Help: "Share of the budget of the last sync cycle run by the loop each of its phases took, by phase.",
+		}, []string{"phase"}),
+	}
+	s.rulesUpdates.WithLabelValues("performed")
+	s.rulesUpdates.WithLabelValues("skipped")
+	s.cycleInProgressDur = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "thanos_rule_syncer_cycle_in_progress_duration_seconds",
+		Help: "Duration of the sync cycle in progress, or 0 if there is none.",
+	}, func() float64 {
+		start := s.cycleStart.Load()
+		if start == 0 {
+			return 0
+		}
+		return s.clock.Since(time.Unix(0, start)).Seconds()
+	})
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Pause stops writing rules and reloading the ruler. Rules are still fetched, and whether they differ
+// from the rules last written is reported.
+func (s *Syncer) Pause() {
+	s.paused.Store(true)
+	s.pausedGauge.Set(1)
+}
+
+// Resume resumes writing rules and reloading the ruler from the next sync cycle.
+func (s *Syncer) Resume() {
+	s.paused.Store(false)
+	s.pausedGauge.Set(0)
+	s.pendingChanges.Set(0)
+}
+
+// Paused returns whether the Syncer is paused.
+func (s *Syncer) Paused() bool {
+	return s.paused.Load()
+}
+
+// Promote turns a standby Syncer into an active one, writing rules and reloading the ruler from the next sync cycle,
+// and returns whether it was a standby. Once promoted, it stays active.
+func (s *Syncer) Promote() bool {
+	if !s.standby.Swap(false) {
+		return false
+	}
+	s.standbyGauge.Set(0)
+	return true
+}
+
+// Standby returns whether the Syncer is a standby not promoted yet.
+func (s *Syncer) Standby() bool {
+	return s.standby.Load()
+}
+
+// Trigger runs a sync cycle right away instead of waiting for the next one due, e.g. after urgent
+// changes to rules. It is handled like a due cycle by the overlap policy.
+func (s *Syncer) Trigger() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// SetInterval sets the interval between sync cycles, e.g. to throttle the syncer during an incident of the rules source.
+// The Loop waits for the new interval from the last cycle due on. It has no effect on cycles run at the times of a schedule.
+func (s *Syncer) SetInterval(interval time.Duration) {
+	s.tuningMu.Lock()
+	s.interval = interval
+	s.tuningMu.Unlock()
+
+	select {
+	case s.retuned <- struct{}{}:
+	default:
+	}
+}
+
+// Interval returns the interval between sync cycles.
+func (s *Syncer) Interval() time.Duration {
+	s.tuningMu.RLock()
+	defer s.tuningMu.RUnlock()
+
+	return s.interval
+}
+
+// SetTimeouts sets the timeouts of the phases of sync cycles, from the next cycle on.
+func (s *Syncer) SetTimeouts(timeouts Timeouts) {
+	s.tuningMu.Lock()
+	defer s.tuningMu.Unlock()
+
+	s.timeouts = timeouts
+}
+
+// Timeouts returns the timeouts of the phases of sync cycles.
+func (s *Syncer) Timeouts() Timeouts {
+	s.tuningMu.RLock()
+	defer s.tuningMu.RUnlock()
+
+	return s.timeouts
+}
+
+// LastFetched returns the rules fetched by the last sync cycle, before they were post-processed,
+// or nil if none were fetched yet.
+func (s *Syncer) LastFetched() []byte {
+	s.lastRulesMu.RLock()
+	defer s.lastRulesMu.RUnlock()
+
+	return s.lastFetched
+}
+
+// LastWritten returns the rules last written, after they were post-processed, or nil if none were written yet.
+func (s *Syncer) LastWritten() []byte {
+	s.lastRulesMu.RLock()
+	defer s.lastRulesMu.RUnlock()
+
+	return s.lastWritten
+}
+
+// Sync runs a single sync cycle: it fetches the rules, post-processes them, writes them and reloads the ruler.
+// Each phase is limited by its timeout. The observers are called with the cycle once it is over.
+func (s *Syncer) Sync(ctx context.Context) error {
+	return s.syncWithin(ctx, 0)
+}
+
+// syncWithin runs a sync cycle like Sync, with the given budget, if any, whose share used by the cycle and its phases
+// is reported.
+func (s *Syncer) syncWithin(ctx context.Context, budget time.Duration) error {
+	c := Cycle{Start: s.clock.Now(), Budget: budget}
+	err := s.sync(ctx, &c)
+	c.Duration, c.Err = s.clock.Since(c.Start), err
+
+	if budget > 0 {
+		s.cycleBudget.Set(c.Duration.Seconds() / budget.Seconds())
+		// The phases the cycle didn't run didn't use any of it.
+		s.phaseBudget.Reset()
+		for _, phase := range c.Phases {
+			s.phaseBudget.WithLabelValues(phase.Name).Set(phase.Duration.Seconds() / budget.Seconds())
+		}
+	}
+
+	for _, observe := range s.observers {
+		observe(ctx, c)
+	}
+
+	return err
+}
+
+// sync runs the phases of a sync cycle, recording them in the cycle.
+func (s *Syncer) sync(ctx context.Context, c *Cycle) error {
+	timeouts := s.Timeouts()
+	c.Previous = s.LastWritten()
+
+	var content []byte
+	err := s.phase(ctx, c, PhaseFetch, timeouts.Fetch, func(ctx context.Context) error {
+		rules, err := s.fetcher.GetRules(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get rules from url: %w", err)
+		}
+		defer rules.Close()
+
+		content, err = io.ReadAll(rules)
+		if err != nil {
+			return fmt.Errorf("failed to read rules: %w", err)
+		}
+		c.TenantErrors = fetch.TenantErrors(rules)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.lastRulesMu.Lock()
+	s.lastFetched = content
+	s.lastRulesMu.Unlock()
+	c.Fetched = content
+
+	if len(s.processors) > 0 {
+		err = s.phase(ctx, c, PhaseParse, timeouts.Parse, func(ctx context.Context) error {
+			for _, process := range s.processors {
+				if content, err = process(ctx, content); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	hash := sha256.Sum256(content)
+
+	s.lastHashMu.Lock()
+	changed := hash != s.lastHash
+	unchanged := s.reloaded && hash == s.reloadedHash
+	s.lastHashMu.Unlock()
+
+	// A standby doesn't write rules until promoted, and has no rules written to compare with.
+	if s.Standby() {
+		c.Standby = true
+		return nil
+	}
+	if s.Paused() {
+		c.Paused = true
+		s.pendingChanges.Set(0)
+		if changed {
+			log.Print("sync is paused, skipping write and reload of changed rules")
+			s.pendingChanges.Set(1)
+		}
+		return nil
+	}
+	// The writer may have changes to make anyway, e.g. the files of removed tenants to remove after a grace period.
+	if s.skipUnchanged && unchanged && !output.Pending(s.writer) {
+		c.Unchanged = true
+		c.Written = content
+		s.rulesUpdates.WithLabelValues("skipped").Inc()
+		return nil
+	}
+
+	err = s.phase(ctx, c, PhaseWrite, timeouts.Write, func(ctx context.Context) error {
+		return s.writer.Write(ctx, bytes.NewReader(content))
+	})
+	if err != nil {
+		return err
+	}
+
+	s.lastHashMu.Lock()
+	s.lastHash = hash
+	s.lastHashMu.Unlock()
+
+	s.lastRulesMu.Lock()
+	s.lastWritten = content
+	s.lastRulesMu.Unlock()
+	c.Written = content
+
+	err = s.phase(ctx, c, PhaseReload, timeouts.Reload, func(ctx context.Context) error {
+		if err := s.reloader.Reload(ctx); err != nil {
+			return fmt.Errorf("failed to trigger thanos rule reload: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The rules are written and the ruler reloaded again until a reload succeeds.
+	s.lastHashMu.Lock()
+	s.reloadedHash, s.reloaded = hash, true
+	s.lastHashMu.Unlock()
+	s.rulesUpdates.WithLabelValues("performed").Inc()
+
+	return nil
+}
+
+// phase runs a phase of a sync cycle with the given timeout, if any, and reports its duration and whether it timed out.
+// Its errors are classified by phase, and by cause for fetch errors. The phase is recorded in the cycle.
+func (s *Syncer) phase(ctx context.Context, c *Cycle, name string, timeout time.Duration, run func(ctx context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := s.clock.Now()
+	err := run(ctx)
+	duration := s.clock.Since(start)
+	s.phaseDuration.WithLabelValues(name).Observe(duration.Seconds())
+
+	if err == nil {
+		c.Phases = append(c.Phases, PhaseResult{Name: name, Duration: duration})
+		return nil
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		s.phaseTimeouts.WithLabelValues(name).Inc()
+		err = fmt.Errorf("%s phase timed out: %w", name, err)
+	}
+
+	class := phaseErrorClasses[name]
+	if name == PhaseFetch && fetch.IsAuthError(err) {
+		class = ErrorAuth
+	}
+	s.errorsTotal.WithLabelValues(class).Inc()
+	for _, tenant := range rules.ErrorTenants(err) {
+		s.tenantErrors.WithLabelValues(class, tenant).Inc()
+	}
+
+	err = &Error{Class: class, Err: err}
+	c.Phases = append(c.Phases, PhaseResult{Name: name, Duration: duration, Err: err})
+
+	return err
+}
+
+// Loop runs a sync cycle right away and then at every interval or at the times of the schedule,
+// until the context is cancelled. Failed cycles are logged and don't stop the loop. Cycles due while
+// one is still in progress are handled according to the overlap policy.
+func (s *Syncer) Loop(ctx context.Context) error {
+	var tick <-chan time.Time
+	var timer clock.Timer
+	var ticker clock.Ticker
+	if s.schedule != nil {
+		timer = s.clock.NewTimer(s.clock.Until(s.schedule.Next(s.clock.Now())))
+		defer timer.Stop()
+		tick = timer.C()
+	} else {
+		ticker = s.clock.NewTicker(s.Interval())
+		defer func() {
+			ticker.Stop()
+		}()
+		tick = ticker.C()
+	}
+
+	s.beat()
+	done := make(chan struct{})
+	running, queued := true, false
+	go s.cycle(ctx, done)
+
+	due := func() {
+		if !running {
+			running = true
+			go s.cycle(ctx, done)
+			return
+		}
+
+		if s.overlap == OverlapQueue && !queued {
+			queued = true
+			return
+		}
+		log.Print("sync cycle still in progress, skipping the next one")
+		s.cyclesSkipped.Inc()
+	}
+
+	for {
+		select {
+		case <-tick:
+			if timer != nil {
+				timer.Reset(s.clock.Until(s.schedule.Next(s.clock.Now())))
+			}
+			due()
+		case <-s.trigger:
+			due()
+		case <-s.retuned:
+			if ticker != nil {
+				ticker.Stop()
+				ticker = s.clock.NewTicker(s.Interval())
+				tick = ticker.C()
+			}
+		case <-done:
+			s.beat()
+			running = false
+			if queued {
+				running, queued = true, false
+				go s.cycle(ctx, done)
+			}
+		case <-ctx.Done():
+			if running {
+				<-done
+			}
+			return nil
+		}
+	}
+}
+
+// Once runs a single sync cycle with the timeout of a cycle, instead of the Loop, e.g. in job-style setups.
+func (s *Syncer) Once(ctx context.Context) error {
+	return s.timedSync(ctx, 0)
+}
+
+// Watchdog checks at every interval that the Loop progresses, i.e. that sync cycles are over, and returns an error
+// once it is stalled, e.g. by a deadlocked fetch ignoring its timeout, so that the process can exit and be restarted.
+// It returns nil when the context is cancelled.
+func (s *Syncer) Watchdog(ctx context.Context) error {
+	ticker := s.clock.NewTicker(s.Interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+
+		heartbeat := s.heartbeat.Load()
+		if heartbeat == 0 {
+			// The Loop hasn't started yet.
+			continue
+		}
+		last := time.Unix(0, heartbeat)
+		if now := s.clock.Now(); !now.Before(s.stallDeadline(last)) {
+			return fmt.Errorf("sync loop stalled: no sync cycle is over since %s, %s ago", last.UTC().Format(time.RFC3339), now.Sub(last))
+		}
+	}
+}
+
+// stallDeadline returns when the Loop is stalled if no sync cycle is over since it last progressed: 3 intervals later,
+// or once the next cycle due has timed out, whichever is later, so that slow cycles aren't mistaken for stalls.
+func (s *Syncer) stallDeadline(heartbeat time.Time) time.Time {
+	interval := s.Interval()
+	next := heartbeat.Add(interval)
+	if s.schedule != nil {
+		next = s.schedule.Next(heartbeat)
+	}
+
+	deadline := next.Add(s.cycleTimeout())
+	if stalled := heartbeat.Add(3 * interval); stalled.After(deadline) {
+		return stalled
+	}
+
+	return deadline
+}
+
+// beat records that the Loop progressed.
+func (s *Syncer) beat() {
+	s.heartbeat.Store(s.clock.Now().UnixNano())
+}
+
+// Handler returns an HTTP handler running a sync cycle on each POST request and responding once it is over,
+// e.g. to run on a serverless platform triggered by an external scheduler instead of running the Loop.
+// Requests made while a cycle is still in progress are handled according to the overlap policy:
+// they are rejected with 409 Conflict if it is OverlapSkip, and wait for the cycle to be over otherwise.
+func (s *Syncer) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if s.overlap == OverlapSkip {
+			if !s.running.TryLock() {
+				log.Print("sync cycle still in progress, skipping the requested one")
+				s.cyclesSkipped.Inc()
+				http.Error(w, "sync cycle still in progress", http.StatusConflict)
+				return
+			}
+		} else {
+			s.running.Lock()
+		}
+		defer s.running.Unlock()
+
+		if err := s.timedSync(r.Context(), 0); err != nil {
+			log.Printf("sync failed (%s): %v", ErrorClass(err), err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "rules synced")
+	})
+}
+
+// cycle runs a sync cycle with a timeout, and signals done once it is over.
+func (s *Syncer) cycle(ctx context.Context, done chan<- struct{}) {
+	defer func() {
+		done <- struct{}{}
+	}()
+
+	if err := s.timedSync(ctx, s.budget()); err != nil {
+		log.Printf("sync failed (%s): %v", ErrorClass(err), err)
+	}
+}
+
+// budget returns how long a cycle of the Loop starting now has before the next one is due.
+func (s *Syncer) budget() time.Duration {
+	if s.schedule != nil {
+		now := s.clock.Now()
+		return s.schedule.Next(now).Sub(now)
+	}
+
+	return s.Interval()
+}
+
+// timedSync runs a sync cycle with a timeout and the given budget, if any, reporting its duration.
+func (s *Syncer) timedSync(ctx context.Context, budget time.Duration) error {
+	startTime := s.clock.Now()
+	s.cycleStart.Store(startTime.UnixNano())
+	defer s.cycleStart.Store(0)
+
+	ctx, cancel := context.WithTimeout(ctx, s.cycleTimeout())
+	defer cancel()
+
+	if err := s.syncWithin(ctx, budget); err != nil {
+		return err
+	}
+	s.reloadDuration.Set(s.clock.Since(startTime).Seconds())
+
+	return nil
+}
+
+// cycleTimeout returns the timeout of a whole sync cycle with the current interval and timeouts.
+func (s *Syncer) cycleTimeout() time.Duration {
+	return CycleTimeout(s.Interval(), s.Timeouts())
+}
+
+// CycleTimeout returns the timeout of a whole sync cycle: the interval or the sum of the timeouts of its phases,
+// whichever is longer, and at least 60s.
+func CycleTimeout(interval time.Duration, timeouts Timeouts) time.Duration {
+	return max(minTimeout, interval, timeouts.Fetch+timeouts.Parse+timeouts.Write+timeouts.Reload)
+}
@@ -0,0 +1,783 @@
+package syncer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/output"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type testWriter struct {
+	written bytes.Buffer
+	err     error
+}
+
+func (w *testWriter) Write(_ context.Context, rules io.Reader) error {
+	if w.err != nil {
+		return w.err
+	}
+	_, err := io.Copy(&w.written, rules)
+	return err
+}
+
+type testReloader struct {
+	calls int
+	err   error
+}
+
+func (r *testReloader) Reload(_ context.Context) error {
+	r.calls++
+	return r.err
+}
+
+func TestSyncerSync(t *testing.T) {
+	testCases := map[string]struct {
+		fetchErr  error
+		writeErr  error
+		reloadErr error
+
+		expectErr         bool
+		expectClass       string
+		expectWritten     string
+		expectReloadCalls int
+	}{
+		"rules are written and ruler reloaded": {
+			expectWritten:     "groups: []",
+			expectReloadCalls: 1,
+		},
+		"fetch error skips write and reload": {
+			fetchErr:    errors.New("fetch error"),
+			expectErr:   true,
+			expectClass: syncer.ErrorFetch,
+		},
+		"auth error skips write and reload": {
+			fetchErr:    &fetch.StatusError{Source: "Observatorium API", StatusCode: http.StatusForbidden},
+			expectErr:   true,
+			expectClass: syncer.ErrorAuth,
+		},
+		"write error skips reload": {
+			writeErr:    errors.New("write error"),
+			expectErr:   true,
+			expectClass: syncer.ErrorWrite,
+		},
+		"reload error is returned": {
+			reloadErr:         errors.New("reload error"),
+			expectErr:         true,
+			expectClass:       syncer.ErrorReload,
+			expectWritten:     "groups: []",
+			expectReloadCalls: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+				if tc.fetchErr != nil {
+					return nil, tc.fetchErr
+				}
+				return io.NopCloser(strings.NewReader("groups: []")), nil
+			})
+			writer := &testWriter{err: tc.writeErr}
+			reloader := &testReloader{err: tc.reloadErr}
+
+			s := syncer.New(fetcher, writer, reloader)
+			err := s.Sync(context.Background())
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.Equal(t, tc.expectClass, syncer.ErrorClass(err))
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, tc.expectWritten, writer.written.String())
+			assert.Equal(t, tc.expectWritten, string(s.LastWritten()))
+			assert.Equal(t, tc.fetchErr == nil, s.LastFetched() != nil)
+			assert.Equal(t, tc.expectReloadCalls, reloader.calls)
+		})
+	}
+}
+
+func TestSyncerPause(t *testing.T) {
+	content := "groups: []"
+	fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(content)), nil
+	})
+	writer := &testWriter{}
+	reloader := &testReloader{}
+	s := syncer.New(fetcher, writer, reloader)
+
+	s.Pause()
+	assert.True(t, s.Paused())
+	assert.NoError(t, s.Sync(context.Background()))
+	assert.Equal(t, "", writer.written.String())
+	assert.Equal(t, 0, reloader.calls)
+
+	s.Resume()
+	assert.False(t, s.Paused())
+	assert.NoError(t, s.Sync(context.Background()))
+	assert.Equal(t, content, writer.written.String())
+	assert.Equal(t, 1, reloader.calls)
+}
+
+func TestSyncerStandby(t *testing.T) {
+	content := "groups: []"
+	fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(content)), nil
+	})
+	writer := &testWriter{}
+	reloader := &testReloader{}
+	var cycles []syncer.Cycle
+	s := syncer.New(fetcher, writer, reloader, syncer.WithStandby(), syncer.WithObservers(func(_ context.Context, c syncer.Cycle) {
+		cycles = append(cycles, c)
+	}))
+
+	// A standby fetches the rules, but doesn't write them, even if resumed.
+	assert.True(t, s.Standby())
+	s.Resume()
+	assert.NoError(t, s.Sync(context.Background()))
+	assert.Equal(t, "", writer.written.String())
+	assert.Equal(t, 0, reloader.calls)
+	assert.Equal(t, content, string(s.LastFetched()))
+	assert.True(t, cycles[0].Standby)
+	assert.Nil(t, cycles[0].Written)
+
+	assert.True(t, s.Promote())
+	assert.False(t, s.Standby())
+	assert.False(t, s.Promote())
+	assert.NoError(t, s.Sync(context.Background()))
+	assert.Equal(t, content, writer.written.String())
+	assert.Equal(t, 1, reloader.calls)
+	assert.False(t, cycles[1].Standby)
+}
+
+func TestSyncerLoopOverlap(t *testing.T) {
+	const interval = time.Minute
+
+	testCases := map[string]struct {
+		policy      string
+		expectQueue bool
+	}{
+		"skip": {
+			policy: syncer.OverlapSkip,
+		},
+		"queue": {
+			policy:      syncer.OverlapQueue,
+			expectQueue: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			release := make(chan struct{})
+			var calls atomic.Int64
+			fetcher := fetch.FetcherFunc(func(ctx context.Context) (io.ReadCloser, error) {
+				if calls.Add(1) == 1 {
+					<-release
+				}
+				return io.NopCloser(strings.NewReader("groups: []")), nil
+			})
+			fakeClock := clock.NewFake(time.Unix(0, 0))
+			registry := prometheus.NewRegistry()
+			s := syncer.New(fetcher, &testWriter{}, &testReloader{},
+				syncer.WithInterval(interval),
+				syncer.WithOverlapPolicy(tc.policy),
+				syncer.WithClock(fakeClock),
+				syncer.WithRegisterer(registry),
+			)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			loopDone := make(chan struct{})
+			go func() {
+				assert.NoError(t, s.Loop(ctx))
+				close(loopDone)
+			}()
+			defer func() {
+				cancel()
+				<-loopDone
+			}()
+
+			// Keep the first cycle in progress while cycles are due.
+			assert.NoError(t, fakeClock.BlockUntil(ctx, 1))
+			skipped := func() float64 {
+				families, err := registry.Gather()
+				assert.NoError(t, err)
+				for _, family := range families {
+					if family.GetName() == "thanos_rule_syncer_cycles_skipped_total" {
+						return family.GetMetric()[0].GetCounter().GetValue()
+					}
+				}
+				return 0
+			}
+			if tc.expectQueue {
+				fakeClock.Advance(interval)
+				close(release)
+
+				// The queued cycle runs right after the first one, without waiting for the next tick.
+				assert.Eventually(t, func() bool { return calls.Load() == 2 }, time.Second, time.Millisecond)
+				assert.Equal(t, 0.0, skipped())
+				return
+			}
+
+			fakeClock.Advance(interval)
+			assert.Eventually(t, func() bool { return skipped() == 1 }, time.Second, time.Millisecond)
+			fakeClock.Advance(interval)
+			assert.Eventually(t, func() bool { return skipped() == 2 }, time.Second, time.Millisecond)
+			close(release)
+			assert.Equal(t, int64(1), calls.Load())
+		})
+	}
+}
+
+type scheduleFunc func(time.Time) time.Time
+
+func (f scheduleFunc) Next(t time.Time) time.Time {
+	return f(t)
+}
+
+func TestSyncerLoopTriggers(t *testing.T) {
+	testCases := map[string]struct {
+		opts    []syncer.Option
+		advance time.Duration
+		trigger bool
+	}{
+		"interval": {
+			opts:    []syncer.Option{syncer.WithInterval(time.Hour)},
+			advance: time.Hour,
+		},
+		"schedule": {
+			opts: []syncer.Option{
+				syncer.WithInterval(time.Hour),
+				syncer.WithSchedule(scheduleFunc(func(t time.Time) time.Time {
+					return t.Add(time.Minute)
+				})),
+			},
+			advance: time.Minute,
+		},
+		"trigger": {
+			opts:    []syncer.Option{syncer.WithInterval(time.Hour)},
+			advance: time.Hour,
+			trigger: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var calls atomic.Int64
+			fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+				calls.Add(1)
+				return io.NopCloser(strings.NewReader("groups: []")), nil
+			})
+			fakeClock := clock.NewFake(time.Unix(0, 0))
+			s := syncer.New(fetcher, &testWriter{}, &testReloader{}, append(tc.opts, syncer.WithClock(fakeClock))...)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			loopDone := make(chan struct{})
+			go func() {
+				assert.NoError(t, s.Loop(ctx))
+				close(loopDone)
+			}()
+
+			// The first cycle is run right away.
+			assert.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+			assert.NoError(t, fakeClock.BlockUntil(ctx, 1))
+
+			// No cycle is due before the next tick.
+			fakeClock.Advance(tc.advance - time.Second)
+			if tc.trigger {
+				s.Trigger()
+			} else {
+				fakeClock.Advance(time.Second)
+			}
+
+			assert.Eventually(t, func() bool { return calls.Load() == 2 }, time.Second, time.Millisecond)
+			cancel()
+			<-loopDone
+		})
+	}
+}
+
+func TestSyncerSetInterval(t *testing.T) {
+	var calls atomic.Int64
+	fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+		calls.Add(1)
+		return io.NopCloser(strings.NewReader("groups: []")), nil
+	})
+	fakeClock := clock.NewFake(time.Unix(0, 0))
+	s := syncer.New(fetcher, &testWriter{}, &testReloader{}, syncer.WithInterval(time.Hour), syncer.WithClock(fakeClock))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	loopDone := make(chan struct{})
+	go func() {
+		assert.NoError(t, s.Loop(ctx))
+		close(loopDone)
+	}()
+	assert.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	assert.NoError(t, fakeClock.BlockUntil(ctx, 1))
+
+	// The next cycle is due at the new interval, long before the previous one.
+	s.SetInterval(time.Minute)
+	assert.Equal(t, time.Minute, s.Interval())
+	var advanced time.Duration
+	assert.Eventually(t, func() bool {
+		if calls.Load() == 2 {
+			return true
+		}
+		fakeClock.Advance(time.Minute)
+		advanced += time.Minute
+		return false
+	}, time.Second, 10*time.Millisecond)
+	assert.Less(t, advanced, time.Hour)
+
+	cancel()
+	<-loopDone
+}
+
+func TestSyncerWatchdog(t *testing.T) {
+	const interval = time.Minute
+
+	testCases := map[string]struct {
+		// wedged blocks the fetches, ignoring their context.
+		wedged bool
+
+		expectStalled bool
+	}{
+		"progressing": {},
+		"wedged": {
+			wedged:        true,
+			expectStalled: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+			fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+				if tc.wedged {
+					<-release
+				}
+				return io.NopCloser(strings.NewReader("groups: []")), nil
+			})
+			// The clock doesn't start at 0, which is no heartbeat.
+			fakeClock := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			s := syncer.New(fetcher, &testWriter{}, &testReloader{}, syncer.WithInterval(interval), syncer.WithClock(fakeClock))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				_ = s.Loop(ctx)
+			}()
+			assert.NoError(t, fakeClock.BlockUntil(ctx, 1))
+			stalled := make(chan error, 1)
+			go func() {
+				stalled <- s.Watchdog(ctx)
+			}()
+			assert.NoError(t, fakeClock.BlockUntil(ctx, 2))
+
+			// The loop isn't stalled before 3 intervals without any cycle over.
+			for i := 0; i < 2; i++ {
+				fakeClock.Advance(interval)
+				assert.NoError(t, fakeClock.BlockUntil(ctx, 2))
+			}
+			select {
+			case err := <-stalled:
+				t.Fatalf("watchdog returned early: %v", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			fakeClock.Advance(interval)
+			if tc.expectStalled {
+				select {
+				case err := <-stalled:
+					assert.ErrorContains(t, err, "sync loop stalled: no sync cycle is over since 2024-01-01T00:00:00Z, 3m0s ago")
+				case <-time.After(time.Second):
+					t.Fatal("watchdog didn't report the stalled loop")
+				}
+				return
+			}
+
+			select {
+			case err := <-stalled:
+				t.Fatalf("watchdog reported a progressing loop: %v", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			cancel()
+			assert.NoError(t, <-stalled)
+		})
+	}
+}
+
+func TestSyncerHandler(t *testing.T) {
+	testCases := map[string]struct {
+		method   string
+		fetchErr error
+
+		expectStatus      int
+		expectReloadCalls int
+	}{
+		"rules are synced": {
+			method:            http.MethodPost,
+			expectStatus:      http.StatusOK,
+			expectReloadCalls: 1,
+		},
+		"failed sync": {
+			method:       http.MethodPost,
+			fetchErr:     errors.New("fetch error"),
+			expectStatus: http.StatusInternalServerError,
+		},
+		"other methods are not allowed": {
+			method:       http.MethodGet,
+			expectStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+				if tc.fetchErr != nil {
+					return nil, tc.fetchErr
+				}
+				return io.NopCloser(strings.NewReader("groups: []")), nil
+			})
+			reloader := &testReloader{}
+			s := syncer.New(fetcher, &testWriter{}, reloader)
+
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, httptest.NewRequest(tc.method, "/sync", nil))
+
+			assert.Equal(t, tc.expectStatus, rec.Code)
+			assert.Equal(t, tc.expectReloadCalls, reloader.calls)
+		})
+	}
+}
+
+func TestSyncerHandlerOverlap(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+		close(started)
+		<-release
+		return io.NopCloser(strings.NewReader("groups: []")), nil
+	})
+	s := syncer.New(fetcher, &testWriter{}, &testReloader{}, syncer.WithOverlapPolicy(syncer.OverlapSkip))
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		s.Handler().ServeHTTP(first, httptest.NewRequest(http.MethodPost, "/sync", nil))
+		close(done)
+	}()
+
+	// Requests made while the first cycle is in progress are skipped.
+	<-started
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/sync", nil))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	close(release)
+	<-done
+	assert.Equal(t, http.StatusOK, first.Code)
+}
+
+func TestSyncerPhaseTimeouts(t *testing.T) {
+	testCases := map[string]struct {
+		timeouts  syncer.Timeouts
+		slowPhase string
+
+		expectErr   bool
+		expectPhase string
+	}{
+		"no timeouts": {
+			slowPhase: syncer.PhaseFetch,
+		},
+		"fetch times out": {
+			timeouts:    syncer.Timeouts{Fetch: 10 * time.Millisecond},
+			slowPhase:   syncer.PhaseFetch,
+			expectErr:   true,
+			expectPhase: syncer.PhaseFetch,
+		},
+		"parse times out": {
+			timeouts:    syncer.Timeouts{Fetch: time.Second, Parse: 10 * time.Millisecond},
+			slowPhase:   syncer.PhaseParse,
+			expectErr:   true,
+			expectPhase: syncer.PhaseParse,
+		},
+		"slow phase within its timeout": {
+			timeouts:  syncer.Timeouts{Parse: time.Second},
+			slowPhase: syncer.PhaseParse,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// slow waits for the timeout of the slow phase, or returns after a while if it has none.
+			slow := func(ctx context.Context, phase string) error {
+				if phase != tc.slowPhase {
+					return nil
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(50 * time.Millisecond):
+					return nil
+				}
+			}
+
+			fetcher := fetch.FetcherFunc(func(ctx context.Context) (io.ReadCloser, error) {
+				if err := slow(ctx, syncer.PhaseFetch); err != nil {
+					return nil, err
+				}
+				return io.NopCloser(strings.NewReader("groups: []")), nil
+			})
+			processor := func(ctx context.Context, rules []byte) ([]byte, error) {
+				return rules, slow(ctx, syncer.PhaseParse)
+			}
+			registry := prometheus.NewRegistry()
+			s := syncer.New(fetcher, &testWriter{}, &testReloader{},
+				syncer.WithProcessors(processor),
+				syncer.WithTimeouts(tc.timeouts),
+				syncer.WithRegisterer(registry),
+			)
+
+			err := s.Sync(context.Background())
+			if !tc.expectErr {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tc.expectPhase+" phase timed out")
+			assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP thanos_rule_syncer_phase_timeouts_total Total number of phases of sync cycles that timed out, by phase.
+# TYPE thanos_rule_syncer_phase_timeouts_total counter
+thanos_rule_syncer_phase_timeouts_total{phase="`+tc.expectPhase+`"} 1
+`), "thanos_rule_syncer_phase_timeouts_total"))
+		})
+	}
+}
+
+func TestSyncerTenantErrors(t *testing.T) {
+	fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+		return nil, errors.Join(
+			&rules.TenantError{Tenant: "a", Err: errors.New("fetch error")},
+			&rules.TenantError{Tenant: "b", Err: context.DeadlineExceeded},
+		)
+	})
+	registry := prometheus.NewRegistry()
+	s := syncer.New(fetcher, &testWriter{}, &testReloader{}, syncer.WithRegisterer(registry))
+
+	err := s.Sync(context.Background())
+	assert.Equal(t, []string{"a", "b"}, rules.ErrorTenants(err))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP thanos_rule_syncer_tenant_sync_errors_total Total number of failed sync cycles, by class of error and tenant the error is attributed to.
+# TYPE thanos_rule_syncer_tenant_sync_errors_total counter
+thanos_rule_syncer_tenant_sync_errors_total{class="fetch",tenant="a"} 1
+thanos_rule_syncer_tenant_sync_errors_total{class="fetch",tenant="b"} 1
+`), "thanos_rule_syncer_tenant_sync_errors_total"))
+}
+
+func TestSyncerObservers(t *testing.T) {
+	var content atomic.Value
+	content.Store("groups: []")
+	fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(content.Load().(string))), nil
+	})
+	reloader := &testReloader{}
+	var cycles []syncer.Cycle
+	s := syncer.New(fetcher, &testWriter{}, reloader, syncer.WithObservers(func(_ context.Context, c syncer.Cycle) {
+		cycles = append(cycles, c)
+	}))
+
+	assert.NoError(t, s.Sync(context.Background()))
+	content.Store("groups:\n- name: a\n")
+	reloader.err = errors.New("reload failed")
+	assert.Error(t, s.Sync(context.Background()))
+
+	assert.Len(t, cycles, 2)
+	assert.Nil(t, cycles[0].Previous)
+	assert.Equal(t, "groups: []", string(cycles[0].Written))
+	assert.NoError(t, cycles[0].Err)
+
+	assert.Equal(t, "groups: []", string(cycles[1].Previous))
+	assert.Equal(t, "groups:\n- name: a\n", string(cycles[1].Fetched))
+	assert.Equal(t, "groups:\n- name: a\n", string(cycles[1].Written))
+	assert.Equal(t, syncer.ErrorReload, syncer.ErrorClass(cycles[1].Err))
+	var phases []string
+	for _, phase := range cycles[1].Phases {
+		phases = append(phases, phase.Name)
+	}
+	assert.Equal(t, []string{syncer.PhaseFetch, syncer.PhaseWrite, syncer.PhaseReload}, phases)
+	assert.ErrorIs(t, cycles[1].Phases[2].Err, reloader.err)
+}
+
+func TestSyncerBudget(t *testing.T) {
+	fakeClock := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+		fakeClock.Advance(30 * time.Second)
+		return io.NopCloser(strings.NewReader("groups: []")), nil
+	})
+	cycles := make(chan syncer.Cycle, 2)
+	reg := prometheus.NewRegistry()
+	s := syncer.New(fetcher, &testWriter{}, &testReloader{},
+		syncer.WithInterval(time.Minute),
+		syncer.WithClock(fakeClock),
+		syncer.WithRegisterer(reg),
+		syncer.WithObservers(func(_ context.Context, c syncer.Cycle) {
+			cycles <- c
+		}),
+	)
+
+	// Cycles not run by the loop have no budget.
+	assert.NoError(t, s.Sync(context.Background()))
+	assert.Zero(t, (<-cycles).Budget)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	loopDone := make(chan struct{})
+	go func() {
+		assert.NoError(t, s.Loop(ctx))
+		close(loopDone)
+	}()
+	cycle := <-cycles
+	cancel()
+	<-loopDone
+
+	assert.Equal(t, time.Minute, cycle.Budget)
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP thanos_rule_syncer_cycle_budget_used_ratio Share of its budget, the time before the next cycle was due, the last sync cycle run by the loop took.
+# TYPE thanos_rule_syncer_cycle_budget_used_ratio gauge
+thanos_rule_syncer_cycle_budget_used_ratio 0.5
+# HELP thanos_rule_syncer_phase_budget_used_ratio Share of the budget of the last sync cycle run by the loop each of its phases took, by phase.
+# TYPE thanos_rule_syncer_phase_budget_used_ratio gauge
+thanos_rule_syncer_phase_budget_used_ratio{phase="fetch"} 0.5
+thanos_rule_syncer_phase_budget_used_ratio{phase="reload"} 0
+thanos_rule_syncer_phase_budget_used_ratio{phase="write"} 0
+`), "thanos_rule_syncer_cycle_budget_used_ratio", "thanos_rule_syncer_phase_budget_used_ratio"))
+}
+
+func TestSyncerSkipUnchanged(t *testing.T) {
+	testCases := map[string]struct {
+		opts []syncer.Option
+		// contents are the rules fetched by each cycle.
+		contents  []string
+		reloadErr error
+
+		expectReloadCalls int
+		expectUnchanged   []bool
+		expectPerformed   float64
+		expectSkipped     float64
+	}{
+		"unchanged rules are skipped": {
+			opts:              []syncer.Option{syncer.WithSkipUnchanged()},
+			contents:          []string{"groups: []", "groups: []", "groups: []"},
+			expectReloadCalls: 1,
+			expectUnchanged:   []bool{false, true, true},
+			expectPerformed:   1,
+			expectSkipped:     2,
+		},
+		"changed rules are written": {
+			opts:              []syncer.Option{syncer.WithSkipUnchanged()},
+			contents:          []string{"groups: []", "groups: [{name: a}]", "groups: []"},
+			expectReloadCalls: 3,
+			expectUnchanged:   []bool{false, false, false},
+			expectPerformed:   3,
+		},
+		"rules are written again until the ruler is reloaded": {
+			opts:              []syncer.Option{syncer.WithSkipUnchanged()},
+			contents:          []string{"groups: []", "groups: []"},
+			reloadErr:         errors.New("reload error"),
+			expectReloadCalls: 2,
+			expectUnchanged:   []bool{false, false},
+		},
+		"unchanged rules are written without the option": {
+			contents:          []string{"groups: []", "groups: []"},
+			expectReloadCalls: 2,
+			expectUnchanged:   []bool{false, false},
+			expectPerformed:   2,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var cycle int
+			fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader(tc.contents[cycle])), nil
+			})
+			reloader := &testReloader{err: tc.reloadErr}
+			registry := prometheus.NewRegistry()
+			var unchanged []bool
+			opts := append([]syncer.Option{syncer.WithObservers(func(_ context.Context, c syncer.Cycle) {
+				unchanged = append(unchanged, c.Unchanged)
+				assert.Equal(t, tc.contents[cycle], string(c.Written))
+			}), syncer.WithRegisterer(registry)}, tc.opts...)
+			s := syncer.New(fetcher, &testWriter{}, reloader, opts...)
+
+			for cycle = range tc.contents {
+				err := s.Sync(context.Background())
+				assert.Equal(t, tc.reloadErr != nil, err != nil)
+			}
+
+			assert.Equal(t, tc.expectReloadCalls, reloader.calls)
+			assert.Equal(t, tc.expectUnchanged, unchanged)
+			assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(fmt.Sprintf(`
+# HELP thanos_rule_syncer_rules_updates_total Total number of sync cycles updating the rules, by result: performed if the rules were written and the ruler reloaded, skipped if the rules were unchanged since the ruler was last reloaded with them.
+# TYPE thanos_rule_syncer_rules_updates_total counter
+thanos_rule_syncer_rules_updates_total{result="performed"} %v
+thanos_rule_syncer_rules_updates_total{result="skipped"} %v
+`, tc.expectPerformed, tc.expectSkipped)), "thanos_rule_syncer_rules_updates_total"))
+		})
+	}
+}
+
+func TestSyncerSkipUnchangedTenantFiles(t *testing.T) {
+	dir := t.TempDir()
+	c := clock.NewFake(time.Now())
+	groupTenant := func(groupName string) string {
+		tenant, _, _ := strings.Cut(groupName, "/")
+		return tenant
+	}
+	files := output.NewTenantFiles(nil, dir, groupTenant, time.Hour)
+	files.SetClock(c)
+
+	content := "groups: [{name: a/g, rules: []}, {name: b/g, rules: []}]"
+	fetcher := fetch.FetcherFunc(func(_ context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(content)), nil
+	})
+	reloader := &testReloader{}
+	s := syncer.New(fetcher, files, reloader, syncer.WithSkipUnchanged(), syncer.WithClock(c))
+	assert.NoError(t, s.Sync(context.Background()))
+
+	// Tenant b is removed, its file is kept for the grace period while the rules are unchanged.
+	content = "groups: [{name: a/g, rules: []}]"
+	assert.NoError(t, s.Sync(context.Background()))
+	c.Advance(30 * time.Minute)
+	assert.NoError(t, s.Sync(context.Background()))
+	assert.FileExists(t, filepath.Join(dir, "b.yaml"))
+	assert.Equal(t, 2, reloader.calls)
+
+	// Once the grace period is over, the unchanged rules are written again to remove it, and the ruler reloaded.
+	c.Advance(30 * time.Minute)
+	assert.NoError(t, s.Sync(context.Background()))
+	_, err := os.Stat(filepath.Join(dir, "b.yaml"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.FileExists(t, filepath.Join(dir, "a.yaml"))
+	assert.Equal(t, 3, reloader.calls)
+
+	assert.NoError(t, s.Sync(context.Background()))
+	assert.Equal(t, 3, reloader.calls)
+}
@@ -1,27 +1,171 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/output"
+	"github.com/observatorium/thanos-rule-syncer/route"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v3"
 )
 
+// Formats of the tenants file.
+const (
+	// tenantsFormatAuto detects the format: YAML if the file is a YAML mapping, lines otherwise.
+	tenantsFormatAuto = "auto"
+	// tenantsFormatYAML is a YAML document with a list of tenants, which can configure each tenant.
+	tenantsFormatYAML = "yaml"
+	// tenantsFormatLines is one tenant ID per line. Empty lines and lines starting with # are ignored.
+	tenantsFormatLines = "lines"
+)
+
 type tenantsSetter interface {
-	SetTenants(tenants []string)
+	SetTenants(tenants *TenantsConfig)
+}
+
+type tenantsReader func() (*TenantsConfig, error)
+
+// objstoreTenantsSetter sets the tenants, their fallback sources and rule limits, on a rules-objstore fetcher,
+// the shadow tenants and the labels of the tenants on the merger, the priorities of the tenants on the capacity
+// guard, if any, and the routes of the tenants on the router, if any.
+type objstoreTenantsSetter struct {
+	fetcher  *fetch.RulesObjstoreFetcher
+	merger   *merge.Merger
+	capacity *output.Capacity
+	router   *route.Router
+	// clients returns the client querying the fallback sources of a tenant, and the Observatorium API
+	// if observatoriumAPI is set, as the rules of the tenants are fetched from it.
+	clients          func(tenant TenantConfig) *http.Client
+	observatoriumAPI bool
+	// includeClients returns the client requesting a document included in the rules of a tenant.
+	includeClients func(include IncludeRulesConfig) *http.Client
+}
+
+func (s objstoreTenantsSetter) SetTenants(tenants *TenantsConfig) {
+	s.fetcher.SetTenants(tenants.IDs())
+	s.fetcher.SetRuleLimits(tenants.ruleLimits())
+	s.merger.SetShadowTenants(tenants.shadowIDs())
+	s.merger.SetTenantLabels(tenants.labels())
+	if s.capacity != nil {
+		s.capacity.SetPriorities(tenants.priorities())
+	}
+	if routes := tenants.routes(); s.router != nil {
+		if err := s.router.SetTenantRoutes(routes); err != nil {
+			log.Printf("failed to configure routes of tenants, keeping the previous ones: %v", err)
+		}
+	} else if len(routes) > 0 {
+		log.Printf("ignoring the routes of tenants, as -output.routing-file isn't specified")
+	}
+
+	if s.observatoriumAPI {
+		s.fetcher.SetTenantClients(tenants.oidcClients(s.clients))
+	}
+	if s.includeClients != nil {
+		s.fetcher.SetIncludedRules(tenants.includedRules(s.includeClients))
+	}
+
+	fallbacks, err := tenants.fallbacks(s.clients)
+	if err != nil {
+		log.Printf("failed to configure fallback sources of tenants, keeping the previous ones: %v", err)
+		return
+	}
+	s.fetcher.SetFallbacks(fallbacks)
+}
+
+// removalGuard refuses to set tenants removing more than a share of the previous tenants at once,
+// e.g. because of a truncated tenants file, which would wipe the rules of the removed tenants.
+type removalGuard struct {
+	next tenantsSetter
+	// maxRemoval is the maximum share of the previous tenants that can be removed at once, from 0 to 1.
+	maxRemoval float64
+	// allowMassRemoval logs larger removals instead of refusing them.
+	allowMassRemoval bool
+
+	mu sync.Mutex
+	// previous are the IDs of the tenants last set, or nil before the first ones are set.
+	previous []string
+
+	refused prometheus.Counter
+}
+
+func newRemovalGuard(r prometheus.Registerer, next tenantsSetter, maxRemoval float64, allowMassRemoval bool) *removalGuard {
+	g := &removalGuard{
+		next:             next,
+		maxRemoval:       maxRemoval,
+		allowMassRemoval: allowMassRemoval,
+		refused: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_tenants_mass_removals_refused_total",
+			Help: "Total number of tenants reloads refused because they removed too many tenants at once.",
+		}),
+	}
+
+	if r != nil {
+		r.MustRegister(g.refused)
+	}
+
+	return g
 }
 
-type tenantsReader func() ([]string, error)
+// SetTenants sets the tenants on the next tenantsSetter, unless they remove too many of the previous tenants.
+func (g *removalGuard) SetTenants(tenants *TenantsConfig) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ids := tenants.IDs()
+	if g.previous != nil {
+		var added, removed []string
+		for _, id := range ids {
+			if !slices.Contains(g.previous, id) {
+				added = append(added, id)
+			}
+		}
+		for _, id := range g.previous {
+			if !slices.Contains(ids, id) {
+				removed = append(removed, id)
+			}
+		}
+
+		if len(added) > 0 || len(removed) > 0 {
+			log.Printf("tenants changed: added %v, removed %v", added, removed)
+		}
+
+		if len(g.previous) > 0 && float64(len(removed))/float64(len(g.previous)) > g.maxRemoval {
+			if !g.allowMassRemoval {
+				g.refused.Inc()
+				log.Printf("refusing to remove %d of %d tenants at once, keeping the previous tenants; set -tenants.allow-mass-removal to allow it", len(removed), len(g.previous))
+				return
+			}
+			log.Printf("removing %d of %d tenants at once, as mass removals are allowed", len(removed), len(g.previous))
+		}
+	}
+
+	g.next.SetTenants(tenants)
+	g.previous = ids
+}
 
 // newTenantsFileReloader reloads tenants at a given interval and sets them on the given tenantsSetter.
 // It returns an error if the tenants file cannot be read 3 times in a row.
 // It stops reloading when the context is cancelled.
 func newTenantsFileReloader(ctx context.Context, readTenants tenantsReader, interval time.Duration, tenset tenantsSetter) error {
-	var tenants []string
+	var tenants *TenantsConfig
 	var err error
 	interval = min(interval, 1*time.Minute)
 	ticker := time.NewTicker(interval)
@@ -39,7 +183,7 @@ func newTenantsFileReloader(ctx context.Context, readTenants tenantsReader, inte
 				errorCount++
 
 				if errorCount >= 3 {
-					return fmt.Errorf("failed to read tenants file 3 times in a row")
+					return classError(syncer.ErrorConfig, "failed to read tenants file 3 times in a row")
 				}
 
 				continue
@@ -55,8 +199,37 @@ func newTenantsFileReloader(ctx context.Context, readTenants tenantsReader, inte
 	}
 }
 
-// readTenantsFile reads tenants from a file.
-func readTenantsFile(file string) ([]string, error) {
+// readTenantsFile reads tenants from a file in the given format, along with the tenants of the fragments it includes.
+// The file is read from the standard input if it is -, with relative includes relative to the working directory.
+func readTenantsFile(file, format string) (*TenantsConfig, error) {
+	tenantsCfg, err := parseTenantsFile(file, format)
+	if err != nil {
+		return nil, err
+	}
+
+	tenantsCfg, err = includeTenants(tenantsCfg, filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+
+	// Tenants of included fragments can belong to the organizations of the file too.
+	if err := tenantsCfg.inheritOrganizations(); err != nil {
+		return nil, err
+	}
+
+	return tenantsCfg, nil
+}
+
+// parseTenantsFile reads tenants from a file in the given format, without the fragments it includes.
+func parseTenantsFile(file, format string) (*TenantsConfig, error) {
+	if file == stdinFile {
+		fileData, err := readStdinTenants()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tenants file: %w", err)
+		}
+		return readTenantsConfig(fileData, format)
+	}
+
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open tenants file: %w", err)
@@ -68,54 +241,625 @@ func readTenantsFile(file string) ([]string, error) {
 		return nil, fmt.Errorf("failed to read tenants file: %w", err)
 	}
 
-	return readTenantsConfig(fileData)
+	return readTenantsConfig(fileData, format)
 }
 
+// tenantsFileVersion is the latest version of the schema of YAML tenants files.
+const tenantsFileVersion = 1
+
 type TenantsConfig struct {
-	Tenants []TenantConfig `yaml:"tenants"`
+	// Version is the version of the schema of the file. Files without a version, in the YAML or lines format,
+	// are migrated to the latest version when they are read, but only files with a version are validated strictly,
+	// e.g. rejecting unknown fields instead of ignoring them.
+	Version int `yaml:"version,omitempty"`
+	// Include are directories of fragment files, each configuring a single tenant, e.g. managed by different pipelines.
+	// Relative directories are relative to the directory of the tenants file.
+	Include []string `yaml:"include,omitempty"`
+	// Organizations group tenants sharing the same settings, e.g. the tenants of a customer, which they inherit.
+	Organizations []OrganizationConfig `yaml:"organizations,omitempty"`
+	Tenants       []TenantConfig       `yaml:"tenants"`
 }
 
 type TenantConfig struct {
 	ID string `yaml:"id"`
+	// Organization is the name of the organization of the tenant, whose settings the tenant inherits unless it sets them.
+	Organization string `yaml:"organization,omitempty"`
+	// Fallback is the source of the rules of the tenant used while the primary one is failing.
+	Fallback *FallbackConfig `yaml:"fallback,omitempty"`
+	// OIDC are the OIDC client credentials the Observatorium API is queried with for the tenant, instead of the ones
+	// of the flags, e.g. for a tenant authenticating against another IdP.
+	OIDC *TenantOIDCConfig `yaml:"oidc,omitempty"`
+	// IncludeRules are rules documents outside of the rules source whose rule groups are added to the ones of the tenant,
+	// e.g. for a tenant whose rules are migrated to Observatorium.
+	IncludeRules []IncludeRulesConfig `yaml:"includeRules,omitempty"`
+	// Shadow makes the rules of the tenant fetched, validated and reported but not synced,
+	// e.g. to evaluate them before they affect the ruler.
+	Shadow bool `yaml:"shadow,omitempty"`
+	// Priority orders the tenants whose rules are dropped when the rules exceed the capacity of the ruler,
+	// lowest priority first.
+	Priority int `yaml:"priority,omitempty"`
+	// Labels are set on all the rules of the tenant, overriding the labels of its rules, e.g. the team owning its alerts.
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// MaxRules is the maximum number of rules of the tenant. Rules exceeding it are handled like invalid rules:
+	// the last valid rules of the tenant are kept. If 0, the rules of the tenant aren't limited.
+	MaxRules int `yaml:"maxRules,omitempty"`
+	// Route is the name of the route of the routing file the rule groups of the tenant are sent to,
+	// regardless of the selectors of the routes.
+	Route string `yaml:"route,omitempty"`
 }
 
-func readTenantsConfig(f []byte) ([]string, error) {
-	if len(f) == 0 {
-		return nil, fmt.Errorf("no tenants found in file")
+// OrganizationConfig configures the settings inherited by the tenants of an organization. The settings set by a tenant
+// override the ones of its organization, and its labels are added to the ones of its organization.
+type OrganizationConfig struct {
+	Name     string            `yaml:"name"`
+	Shadow   bool              `yaml:"shadow,omitempty"`
+	Priority int               `yaml:"priority,omitempty"`
+	Labels   map[string]string `yaml:"labels,omitempty"`
+	MaxRules int               `yaml:"maxRules,omitempty"`
+	Route    string            `yaml:"route,omitempty"`
+}
+
+// FallbackConfig configures a fallback source of rules. Exactly one of its fields must be set.
+type FallbackConfig struct {
+	// ObservatoriumAPIURL is the URL of an Observatorium API, e.g. in a secondary region, queried with the configured auth.
+	ObservatoriumAPIURL string `yaml:"observatoriumAPIURL,omitempty"`
+	// File is the path to a file with the rules of the tenant, e.g. a snapshot.
+	File string `yaml:"file,omitempty"`
+}
+
+// TenantOIDCConfig configures the OIDC client credentials of a tenant, like the -oidc flags.
+type TenantOIDCConfig struct {
+	IssuerURL string `yaml:"issuerURL"`
+	ClientID  string `yaml:"clientID"`
+	// ClientSecret is the client secret, or a reference to it like the -oidc.client-secret flag, e.g. vault:path#key.
+	ClientSecret string `yaml:"clientSecret"`
+	Audience     string `yaml:"audience,omitempty"`
+}
+
+// IncludeRulesConfig configures a rules document included in the rules of a tenant. It is requested without the
+// credentials of the flags, with the bearer token or the OIDC client credentials, if any.
+type IncludeRulesConfig struct {
+	URL string `yaml:"url"`
+	// BearerToken is the bearer token, or a reference to it like the -oidc.client-secret flag, e.g. file:path.
+	BearerToken string            `yaml:"bearerToken,omitempty"`
+	OIDC        *TenantOIDCConfig `yaml:"oidc,omitempty"`
+}
+
+// IDs returns the IDs of the tenants.
+func (c *TenantsConfig) IDs() []string {
+	ids := make([]string, 0, len(c.Tenants))
+	for _, tenant := range c.Tenants {
+		ids = append(ids, tenant.ID)
 	}
 
-	tenantsCfg := &TenantsConfig{}
-	err := yaml.Unmarshal(f, tenantsCfg)
+	return ids
+}
+
+// shadowIDs returns the IDs of the shadow tenants.
+func (c *TenantsConfig) shadowIDs() []string {
+	var ids []string
+	for _, tenant := range c.Tenants {
+		if tenant.Shadow {
+			ids = append(ids, tenant.ID)
+		}
+	}
+
+	return ids
+}
+
+// priorities returns the priorities of the tenants that have one.
+func (c *TenantsConfig) priorities() map[string]int {
+	priorities := map[string]int{}
+	for _, tenant := range c.Tenants {
+		if tenant.Priority != 0 {
+			priorities[tenant.ID] = tenant.Priority
+		}
+	}
+
+	return priorities
+}
+
+// labels returns the labels of the tenants that have some.
+func (c *TenantsConfig) labels() map[string]map[string]string {
+	labels := map[string]map[string]string{}
+	for _, tenant := range c.Tenants {
+		if len(tenant.Labels) > 0 {
+			labels[tenant.ID] = tenant.Labels
+		}
+	}
+
+	return labels
+}
+
+// ruleLimits returns the rule limits of the tenants that have one.
+func (c *TenantsConfig) ruleLimits() map[string]int {
+	limits := map[string]int{}
+	for _, tenant := range c.Tenants {
+		if tenant.MaxRules > 0 {
+			limits[tenant.ID] = tenant.MaxRules
+		}
+	}
+
+	return limits
+}
+
+// routes returns the routes of the tenants that have one.
+func (c *TenantsConfig) routes() map[string]string {
+	routes := map[string]string{}
+	for _, tenant := range c.Tenants {
+		if tenant.Route != "" {
+			routes[tenant.ID] = tenant.Route
+		}
+	}
+
+	return routes
+}
+
+// inheritOrganizations sets the settings of the organizations on their tenants, unless the tenants set them.
+func (c *TenantsConfig) inheritOrganizations() error {
+	organizations := make(map[string]*OrganizationConfig, len(c.Organizations))
+	for i := range c.Organizations {
+		organizations[c.Organizations[i].Name] = &c.Organizations[i]
+	}
+
+	for i := range c.Tenants {
+		tenant := &c.Tenants[i]
+		if tenant.Organization == "" {
+			continue
+		}
+		org, ok := organizations[tenant.Organization]
+		if !ok {
+			return fmt.Errorf("tenant %s: unknown organization %q", tenant.ID, tenant.Organization)
+		}
+
+		tenant.Shadow = tenant.Shadow || org.Shadow
+		if tenant.Priority == 0 {
+			tenant.Priority = org.Priority
+		}
+		if tenant.MaxRules == 0 {
+			tenant.MaxRules = org.MaxRules
+		}
+		if tenant.Route == "" {
+			tenant.Route = org.Route
+		}
+		if len(org.Labels) > 0 {
+			labels := maps.Clone(org.Labels)
+			maps.Copy(labels, tenant.Labels)
+			tenant.Labels = labels
+		}
+	}
+
+	return nil
+}
+
+// validateTenantSettings validates the settings shared by tenants and organizations.
+func validateTenantSettings(labels map[string]string, maxRules int) error {
+	for name := range labels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	if maxRules < 0 {
+		return fmt.Errorf("maxRules must not be negative")
+	}
+
+	return nil
+}
+
+// fallbacks returns the fetchers of the fallback sources of the tenants that have one.
+func (c *TenantsConfig) fallbacks(clients func(tenant TenantConfig) *http.Client) (map[string]fetch.Fetcher, error) {
+	fallbacks := map[string]fetch.Fetcher{}
+	for _, tenant := range c.Tenants {
+		if tenant.Fallback == nil {
+			continue
+		}
+
+		fallback, err := tenant.Fallback.fetcher(tenant.ID, clients(tenant))
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tenant.ID, err)
+		}
+		fallbacks[tenant.ID] = fallback
+	}
+
+	return fallbacks, nil
+}
+
+// includedRules returns the fetchers of the documents included in the rules of the tenants that include some.
+func (c *TenantsConfig) includedRules(clients func(include IncludeRulesConfig) *http.Client) map[string][]fetch.IncludedRules {
+	included := map[string][]fetch.IncludedRules{}
+	for _, tenant := range c.Tenants {
+		for _, include := range tenant.IncludeRules {
+			included[tenant.ID] = append(included[tenant.ID], fetch.IncludedRules{
+				Name:    include.URL,
+				Fetcher: fetch.NewURLFetcher(include.URL, clients(include)),
+			})
+		}
+	}
+
+	return included
+}
+
+// oidcClients returns the clients of the tenants with their own OIDC client credentials.
+func (c *TenantsConfig) oidcClients(clients func(tenant TenantConfig) *http.Client) map[string]*http.Client {
+	oidcClients := map[string]*http.Client{}
+	for _, tenant := range c.Tenants {
+		if tenant.OIDC != nil {
+			oidcClients[tenant.ID] = clients(tenant)
+		}
+	}
+
+	return oidcClients
+}
+
+func (c *TenantOIDCConfig) validate() error {
+	if c.IssuerURL == "" || c.ClientID == "" || c.ClientSecret == "" {
+		return fmt.Errorf("issuerURL, clientID and clientSecret must be set")
+	}
+	if _, err := url.Parse(c.IssuerURL); err != nil {
+		return fmt.Errorf("invalid issuerURL: %w", err)
+	}
+
+	return nil
+}
+
+func (c *IncludeRulesConfig) validate() error {
+	u, err := url.Parse(c.URL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal tenants file: %w", err)
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url must be an HTTP(S) URL, got %q", c.URL)
+	}
+	if c.BearerToken != "" && c.OIDC != nil {
+		return fmt.Errorf("only one of bearerToken and oidc can be set")
+	}
+	if c.OIDC != nil {
+		if err := c.OIDC.validate(); err != nil {
+			return fmt.Errorf("oidc: %w", err)
+		}
 	}
 
-	tenants := make([]string, 0, len(tenantsCfg.Tenants))
-	for _, tenant := range tenantsCfg.Tenants {
-		tenants = append(tenants, tenant.ID)
+	return nil
+}
+
+// validateIncludeRules validates the documents included in the rules of a tenant.
+func validateIncludeRules(includes []IncludeRulesConfig) error {
+	for i, include := range includes {
+		if err := include.validate(); err != nil {
+			return fmt.Errorf("includeRules %d: %w", i+1, err)
+		}
 	}
 
-	if len(tenants) == 0 {
+	return nil
+}
+
+func (c *FallbackConfig) validate() error {
+	if (c.ObservatoriumAPIURL == "") == (c.File == "") {
+		return fmt.Errorf("exactly one of observatoriumAPIURL and file must be set")
+	}
+
+	return nil
+}
+
+// fetcher returns the fetcher of the rules of the tenant from the fallback source.
+func (c *FallbackConfig) fetcher(tenant string, client *http.Client) (fetch.Fetcher, error) {
+	if c.File != "" {
+		return fetch.NewFileFetcher(c.File), nil
+	}
+
+	return fetch.NewObservatoriumAPIFetcher(c.ObservatoriumAPIURL, tenant, client)
+}
+
+// detectTenantsFormat returns the YAML format if the file is a YAML mapping, and the lines format otherwise.
+func detectTenantsFormat(f []byte) string {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(f, &doc); err == nil && len(doc.Content) > 0 && doc.Content[0].Kind == yaml.MappingNode {
+		return tenantsFormatYAML
+	}
+
+	return tenantsFormatLines
+}
+
+func readTenantsConfig(f []byte, format string) (*TenantsConfig, error) {
+	if len(f) == 0 {
 		return nil, fmt.Errorf("no tenants found in file")
 	}
 
-	// check for duplicates
-	tenantsSet := make(map[string]struct{}, len(tenants))
-	duplicates := []string{}
-	for _, tenant := range tenants {
-		if tenant != "" {
-			if _, ok := tenantsSet[tenant]; ok {
-				duplicates = append(duplicates, tenant)
+	if format == tenantsFormatAuto {
+		format = detectTenantsFormat(f)
+	}
+
+	var (
+		tenantsCfg *TenantsConfig
+		// lines are the lines of the tenants in the file, to point errors at them.
+		lines []int
+	)
+	switch format {
+	case tenantsFormatYAML:
+		var err error
+		tenantsCfg, lines, err = readTenantsYAML(f)
+		if err != nil {
+			return nil, err
+		}
+	case tenantsFormatLines:
+		tenantsCfg = &TenantsConfig{Version: tenantsFileVersion}
+		for i, line := range strings.Split(string(f), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
 				continue
 			}
+			tenantsCfg.Tenants = append(tenantsCfg.Tenants, TenantConfig{ID: line})
+			lines = append(lines, i+1)
+		}
+	default:
+		return nil, fmt.Errorf("unknown tenants file format %q", format)
+	}
 
-			tenantsSet[tenant] = struct{}{}
+	// The tenants can all be defined in included fragments.
+	if len(tenantsCfg.Tenants) == 0 && len(tenantsCfg.Include) == 0 {
+		return nil, fmt.Errorf("no tenants found in file")
+	}
+
+	// check for duplicates
+	tenantsSet := make(map[string]int, len(tenantsCfg.Tenants))
+	duplicates := []string{}
+	for i, tenant := range tenantsCfg.Tenants {
+		if tenant.ID == "" {
+			continue
+		}
+		if first, ok := tenantsSet[tenant.ID]; ok {
+			duplicates = append(duplicates, fmt.Sprintf("%s (lines %d and %d)", tenant.ID, first, lines[i]))
+			continue
 		}
+		tenantsSet[tenant.ID] = lines[i]
 	}
 
 	if len(duplicates) > 0 {
 		return nil, fmt.Errorf("found duplicate tenants in file: %v", duplicates)
 	}
 
-	return tenants, nil
+	for i, tenant := range tenantsCfg.Tenants {
+		if err := validateTenantSettings(tenant.Labels, tenant.MaxRules); err != nil {
+			return nil, fmt.Errorf("line %d: tenant %s: %w", lines[i], tenant.ID, err)
+		}
+		if tenant.OIDC != nil {
+			if err := tenant.OIDC.validate(); err != nil {
+				return nil, fmt.Errorf("line %d: tenant %s: oidc: %w", lines[i], tenant.ID, err)
+			}
+		}
+		if err := validateIncludeRules(tenant.IncludeRules); err != nil {
+			return nil, fmt.Errorf("line %d: tenant %s: %w", lines[i], tenant.ID, err)
+		}
+		if tenant.Fallback == nil {
+			continue
+		}
+		if err := tenant.Fallback.validate(); err != nil {
+			return nil, fmt.Errorf("line %d: tenant %s: fallback: %w", lines[i], tenant.ID, err)
+		}
+	}
+
+	organizations := make(map[string]bool, len(tenantsCfg.Organizations))
+	for _, org := range tenantsCfg.Organizations {
+		if org.Name == "" || organizations[org.Name] {
+			return nil, fmt.Errorf("organization names must be set and unique, got %q", org.Name)
+		}
+		organizations[org.Name] = true
+		if err := validateTenantSettings(org.Labels, org.MaxRules); err != nil {
+			return nil, fmt.Errorf("organization %s: %w", org.Name, err)
+		}
+	}
+
+	return tenantsCfg, nil
+}
+
+// readTenantsYAML reads a tenants file in the YAML format, migrated to the latest version, along with the lines of its tenants.
+// Files with a version are decoded strictly, so that e.g. misspelled fields are reported with their line.
+func readTenantsYAML(f []byte) (*TenantsConfig, []int, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(f, &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal tenants file: %w", err)
+	}
+
+	version, versionLine, err := tenantsYAMLVersion(&doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tenantsCfg := &TenantsConfig{}
+	lines := tenantsYAMLLines(&doc)
+	switch {
+	case version == 0:
+		// Files without a version predate versioning, and are read leniently like before.
+		if err := doc.Decode(tenantsCfg); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal tenants file: %w", err)
+		}
+		tenantsCfg.Version = tenantsFileVersion
+	case version <= tenantsFileVersion:
+		decoder := yaml.NewDecoder(bytes.NewReader(f))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(tenantsCfg); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal tenants file of version %d: %w", version, err)
+		}
+	default:
+		return nil, nil, fmt.Errorf("line %d: unsupported tenants file version %d, the latest supported version is %d", versionLine, version, tenantsFileVersion)
+	}
+
+	// Tenants decoded from anything else than a sequence of mappings, e.g. through aliases, have no known line.
+	for len(lines) < len(tenantsCfg.Tenants) {
+		lines = append(lines, 0)
+	}
+
+	if version > 0 {
+		for i, tenant := range tenantsCfg.Tenants {
+			if tenant.ID == "" {
+				return nil, nil, fmt.Errorf("line %d: tenant has no id", lines[i])
+			}
+		}
+	}
+
+	return tenantsCfg, lines, nil
+}
+
+// tenantsYAMLVersion returns the version of a YAML tenants file and its line, or 0 if it has none.
+func tenantsYAMLVersion(doc *yaml.Node) (int, int, error) {
+	value := mappingValue(doc, "version")
+	if value == nil {
+		return 0, 0, nil
+	}
+
+	var version int
+	if err := value.Decode(&version); err != nil || version < 1 {
+		return 0, 0, fmt.Errorf("line %d: invalid tenants file version %q, must be a positive integer", value.Line, value.Value)
+	}
+
+	return version, value.Line, nil
+}
+
+// tenantsYAMLLines returns the lines of the tenants of a YAML tenants file, in order.
+func tenantsYAMLLines(doc *yaml.Node) []int {
+	tenants := mappingValue(doc, "tenants")
+	if tenants == nil || tenants.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	lines := make([]int, 0, len(tenants.Content))
+	for _, tenant := range tenants.Content {
+		lines = append(lines, tenant.Line)
+	}
+
+	return lines
+}
+
+// mappingValue returns the value of the key of the top-level mapping of a YAML document, or nil if it has none.
+func mappingValue(doc *yaml.Node, key string) *yaml.Node {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == key {
+			return root.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// includeTenants returns the tenants of a tenants file read from dir, along with the tenants of the fragment files
+// of the directories it includes. Tenants defined more than once, in the file or in fragments, are rejected.
+func includeTenants(tenantsCfg *TenantsConfig, dir string) (*TenantsConfig, error) {
+	if len(tenantsCfg.Include) == 0 {
+		return tenantsCfg, nil
+	}
+
+	// definedIn is where each tenant is defined, to report conflicts.
+	definedIn := make(map[string]string, len(tenantsCfg.Tenants))
+	for _, tenant := range tenantsCfg.Tenants {
+		definedIn[tenant.ID] = "the tenants file"
+	}
+
+	included := *tenantsCfg
+	included.Tenants = slices.Clone(tenantsCfg.Tenants)
+	for _, include := range tenantsCfg.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(dir, include)
+		}
+
+		fragments, err := tenantFragments(include)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fragment := range fragments {
+			tenant, err := readTenantFragment(fragment)
+			if err != nil {
+				return nil, err
+			}
+
+			if other, ok := definedIn[tenant.ID]; ok {
+				return nil, fmt.Errorf("tenant %s is defined in both %s and %s", tenant.ID, other, fragment)
+			}
+			definedIn[tenant.ID] = fragment
+			included.Tenants = append(included.Tenants, *tenant)
+		}
+	}
+
+	if len(included.Tenants) == 0 {
+		return nil, fmt.Errorf("no tenants found in file nor in its included fragments")
+	}
+
+	return &included, nil
+}
+
+// tenantFragments returns the paths of the YAML files of a directory, in lexical order.
+// Hidden files are skipped, such as the ones Kubernetes uses to update mounted ConfigMaps atomically.
+func tenantFragments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read included tenants directory: %w", err)
+	}
+
+	var fragments []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || (filepath.Ext(name) != ".yaml" && filepath.Ext(name) != ".yml") {
+			continue
+		}
+
+		// Follow symlinks, e.g. of mounted ConfigMaps, to skip directories.
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat tenant fragment: %w", err)
+		}
+		if info.IsDir() {
+			continue
+		}
+
+		fragments = append(fragments, path)
+	}
+
+	return fragments, nil
+}
+
+// readTenantFragment reads a fragment file configuring a single tenant, with the fields of the tenants of a tenants file.
+// Fragments are validated strictly, like tenants files with a version.
+func readTenantFragment(file string) (*TenantConfig, error) {
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant fragment: %w", err)
+	}
+
+	tenant := &TenantConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(f))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(tenant); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("tenant fragment %s is empty", file)
+		}
+		return nil, fmt.Errorf("failed to unmarshal tenant fragment %s: %w", file, err)
+	}
+
+	if tenant.ID == "" {
+		return nil, fmt.Errorf("tenant fragment %s: tenant has no id", file)
+	}
+	if err := validateTenantSettings(tenant.Labels, tenant.MaxRules); err != nil {
+		return nil, fmt.Errorf("tenant fragment %s: tenant %s: %w", file, tenant.ID, err)
+	}
+	if tenant.OIDC != nil {
+		if err := tenant.OIDC.validate(); err != nil {
+			return nil, fmt.Errorf("tenant fragment %s: tenant %s: oidc: %w", file, tenant.ID, err)
+		}
+	}
+	if err := validateIncludeRules(tenant.IncludeRules); err != nil {
+		return nil, fmt.Errorf("tenant fragment %s: tenant %s: %w", file, tenant.ID, err)
+	}
+	if tenant.Fallback != nil {
+		if err := tenant.Fallback.validate(); err != nil {
+			return nil, fmt.Errorf("tenant fragment %s: tenant %s: fallback: %w", file, tenant.ID, err)
+		}
+	}
+
+	return tenant, nil
 }
@@ -3,19 +3,24 @@ package main
 import (
 	"context"
 	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v3"
 )
 
 func TestTenantsConfig(t *testing.T) {
 	testCases := map[string]struct {
-		fileContent   TenantsConfig
-		expectErr     bool
-		expectTenants []string
-		expectPanics  bool
+		fileContent    TenantsConfig
+		expectErr      bool
+		expectTenants  []string
+		expectShadow   []string
+		expectPriority map[string]int
+		expectPanics   bool
 	}{
 		"empty file": {
 			fileContent: TenantsConfig{},
@@ -34,6 +39,72 @@ func TestTenantsConfig(t *testing.T) {
 			},
 			expectTenants: []string{"tenant1", "tenant2"},
 		},
+		"tenant with fallback": {
+			fileContent: TenantsConfig{
+				Tenants: []TenantConfig{
+					{
+						ID:       "tenant1",
+						Fallback: &FallbackConfig{File: "/snapshots/tenant1.yaml"},
+					},
+				},
+			},
+			expectTenants: []string{"tenant1"},
+		},
+		"shadow tenant": {
+			fileContent: TenantsConfig{
+				Tenants: []TenantConfig{
+					{
+						ID: "tenant1",
+					},
+					{
+						ID:     "tenant2",
+						Shadow: true,
+					},
+				},
+			},
+			expectTenants: []string{"tenant1", "tenant2"},
+			expectShadow:  []string{"tenant2"},
+		},
+		"tenants with priorities": {
+			fileContent: TenantsConfig{
+				Tenants: []TenantConfig{
+					{
+						ID:       "tenant1",
+						Priority: 10,
+					},
+					{
+						ID: "tenant2",
+					},
+				},
+			},
+			expectTenants:  []string{"tenant1", "tenant2"},
+			expectPriority: map[string]int{"tenant1": 10},
+		},
+		"tenant with oidc": {
+			fileContent: TenantsConfig{
+				Tenants: []TenantConfig{
+					{
+						ID:   "tenant1",
+						OIDC: &TenantOIDCConfig{IssuerURL: "https://idp.example.com", ClientID: "syncer", ClientSecret: "vault:secret/syncer#secret"},
+					},
+				},
+			},
+			expectTenants: []string{"tenant1"},
+		},
+		"tenant with invalid fallback": {
+			fileContent: TenantsConfig{
+				Tenants: []TenantConfig{
+					{
+						ID: "tenant1",
+						Fallback: &FallbackConfig{
+							ObservatoriumAPIURL: "https://observatorium.example.com",
+							File:                "/snapshots/tenant1.yaml",
+						},
+					},
+				},
+			},
+			expectErr: true,
+		},
 		"multiple tenants with duplicates": {
 			fileContent: TenantsConfig{
 				Tenants: []TenantConfig{
@@ -54,42 +125,415 @@ func TestTenantsConfig(t *testing.T) {
 			tenantsCfg, err := yaml.Marshal(tc.fileContent)
 			assert.NoError(t, err)
 
-			tenants, err := readTenantsConfig(tenantsCfg)
+			tenants, err := readTenantsConfig(tenantsCfg, tenantsFormatYAML)
 			if tc.expectErr {
 				assert.Error(t, err)
 				return
 			}
 
 			assert.NoError(t, err)
-			assert.Len(t, tenants, len(tc.expectTenants))
+			assert.Equal(t, tc.expectTenants, tenants.IDs())
+			assert.Equal(t, tc.expectShadow, tenants.shadowIDs())
+			if tc.expectPriority == nil {
+				tc.expectPriority = map[string]int{}
+			}
+			assert.Equal(t, tc.expectPriority, tenants.priorities())
 		})
 	}
 }
 
-type testTenantsSetterFunc func(tenants []string) error
+func TestTenantsFileVersions(t *testing.T) {
+	testCases := map[string]struct {
+		fileContent string
+		format      string
 
-func (f testTenantsSetterFunc) SetTenants(tenants []string) {
+		expectErr     string
+		expectTenants []string
+	}{
+		"unversioned yaml is migrated": {
+			fileContent:   "tenants:\n- id: tenant1\n  unknown: true\n",
+			format:        tenantsFormatAuto,
+			expectTenants: []string{"tenant1"},
+		},
+		"lines are migrated": {
+			fileContent:   "tenant1\ntenant2\n",
+			format:        tenantsFormatAuto,
+			expectTenants: []string{"tenant1", "tenant2"},
+		},
+		"latest version": {
+			fileContent:   "version: 1\ntenants:\n- id: tenant1\n  shadow: true\n",
+			format:        tenantsFormatAuto,
+			expectTenants: []string{"tenant1"},
+		},
+		"unknown field of versioned file": {
+			fileContent: "version: 1\ntenants:\n- id: tenant1\n- id: tenant2\n  shadw: true\n",
+			format:      tenantsFormatAuto,
+			expectErr:   "line 5: field shadw not found",
+		},
+		"unsupported version": {
+			fileContent: "tenants:\n- id: tenant1\nversion: 2\n",
+			format:      tenantsFormatYAML,
+			expectErr:   "line 3: unsupported tenants file version 2",
+		},
+		"invalid version": {
+			fileContent: "version: latest\ntenants:\n- id: tenant1\n",
+			format:      tenantsFormatYAML,
+			expectErr:   `line 1: invalid tenants file version "latest"`,
+		},
+		"tenant without id in versioned file": {
+			fileContent: "version: 1\ntenants:\n- id: tenant1\n- shadow: true\n",
+			format:      tenantsFormatYAML,
+			expectErr:   "line 4: tenant has no id",
+		},
+		"duplicate tenants": {
+			fileContent: "tenants:\n- id: tenant1\n- id: tenant2\n- id: tenant1\n",
+			format:      tenantsFormatYAML,
+			expectErr:   "tenant1 (lines 2 and 4)",
+		},
+		"duplicate lines": {
+			fileContent: "# tenants\ntenant1\n\ntenant1\n",
+			format:      tenantsFormatLines,
+			expectErr:   "tenant1 (lines 2 and 4)",
+		},
+		"invalid fallback": {
+			fileContent: "version: 1\ntenants:\n- id: tenant1\n- id: tenant2\n  fallback: {}\n",
+			format:      tenantsFormatYAML,
+			expectErr:   "line 4: tenant tenant2: fallback:",
+		},
+		"incomplete oidc": {
+			fileContent: "version: 1\ntenants:\n- id: tenant1\n  oidc:\n    issuerURL: https://idp.example.com\n    clientID: syncer\n",
+			format:      tenantsFormatYAML,
+			expectErr:   "line 3: tenant tenant1: oidc: issuerURL, clientID and clientSecret must be set",
+		},
+		"included rules": {
+			fileContent:   "version: 1\ntenants:\n- id: tenant1\n  includeRules:\n  - url: https://git.example.com/rules.yaml\n    bearerToken: file:/var/run/secrets/token\n",
+			format:        tenantsFormatYAML,
+			expectTenants: []string{"tenant1"},
+		},
+		"included rules with two credentials": {
+			fileContent: "version: 1\ntenants:\n- id: tenant1\n  includeRules:\n  - url: https://git.example.com/rules.yaml\n    bearerToken: token\n    oidc:\n      issuerURL: https://idp.example.com\n      clientID: syncer\n      clientSecret: secret\n",
+			format:      tenantsFormatYAML,
+			expectErr:   "line 3: tenant tenant1: includeRules 1: only one of bearerToken and oidc can be set",
+		},
+		"included rules without an HTTP URL": {
+			fileContent: "version: 1\ntenants:\n- id: tenant1\n  includeRules:\n  - url: /etc/rules.yaml\n",
+			format:      tenantsFormatYAML,
+			expectErr:   "line 3: tenant tenant1: includeRules 1: url must be an HTTP(S) URL",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tenants, err := readTenantsConfig([]byte(tc.fileContent), tc.format)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tenantsFileVersion, tenants.Version)
+			assert.Equal(t, tc.expectTenants, tenants.IDs())
+		})
+	}
+}
+
+func TestTenantsFileIncludes(t *testing.T) {
+	testCases := map[string]struct {
+		tenantsFile string
+		fragments   map[string]string
+
+		expectErr     string
+		expectTenants []string
+		expectShadow  []string
+	}{
+		"tenants file and fragments": {
+			tenantsFile: "version: 1\ninclude: [tenants.d]\ntenants:\n- id: tenant1\n",
+			fragments: map[string]string{
+				"tenants.d/tenant3.yml":  "id: tenant3\nshadow: true\n",
+				"tenants.d/tenant2.yaml": "id: tenant2\n",
+			},
+			expectTenants: []string{"tenant1", "tenant2", "tenant3"},
+			expectShadow:  []string{"tenant3"},
+		},
+		"only fragments": {
+			tenantsFile: "include: [tenants.d]\n",
+			fragments: map[string]string{
+				"tenants.d/tenant1.yaml": "id: tenant1\n",
+			},
+			expectTenants: []string{"tenant1"},
+		},
+		"other and hidden files are skipped": {
+			tenantsFile: "include: [tenants.d]\n",
+			fragments: map[string]string{
+				"tenants.d/tenant1.yaml":        "id: tenant1\n",
+				"tenants.d/README.md":           "# tenants",
+				"tenants.d/.tenant2.yaml":       "id: tenant2\n",
+				"tenants.d/..data/tenant3.yaml": "id: tenant3\n",
+			},
+			expectTenants: []string{"tenant1"},
+		},
+		"tenant of the file and a fragment": {
+			tenantsFile: "include: [tenants.d]\ntenants:\n- id: tenant1\n",
+			fragments: map[string]string{
+				"tenants.d/tenant1.yaml": "id: tenant1\n",
+			},
+			expectErr: "tenant tenant1 is defined in both the tenants file and ",
+		},
+		"tenant of two fragments": {
+			tenantsFile: "include: [team-a, team-b]\n",
+			fragments: map[string]string{
+				"team-a/tenant1.yaml": "id: tenant1\n",
+				"team-b/tenant1.yaml": "id: tenant1\n",
+			},
+			expectErr: "team-a/tenant1.yaml and ",
+		},
+		"unknown field of fragment": {
+			tenantsFile: "include: [tenants.d]\n",
+			fragments: map[string]string{
+				"tenants.d/tenant1.yaml": "id: tenant1\nshadw: true\n",
+			},
+			expectErr: "line 2: field shadw not found",
+		},
+		"fragment without id": {
+			tenantsFile: "include: [tenants.d]\n",
+			fragments: map[string]string{
+				"tenants.d/tenant1.yaml": "shadow: true\n",
+			},
+			expectErr: "tenant has no id",
+		},
+		"empty fragment": {
+			tenantsFile: "include: [tenants.d]\n",
+			fragments: map[string]string{
+				"tenants.d/tenant1.yaml": "",
+			},
+			expectErr: "is empty",
+		},
+		"no tenants": {
+			tenantsFile: "include: [tenants.d]\n",
+			fragments: map[string]string{
+				"tenants.d/README.md": "# tenants",
+			},
+			expectErr: "no tenants found",
+		},
+		"missing directory": {
+			tenantsFile: "include: [tenants.d]\n",
+			expectErr:   "failed to read included tenants directory",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tc.fragments {
+				assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o700))
+				assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+			}
+			tenantsFile := filepath.Join(dir, "tenants.yaml")
+			assert.NoError(t, os.WriteFile(tenantsFile, []byte(tc.tenantsFile), 0o600))
+
+			tenants, err := readTenantsFile(tenantsFile, tenantsFormatAuto)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectTenants, tenants.IDs())
+			assert.Equal(t, tc.expectShadow, tenants.shadowIDs())
+		})
+	}
+}
+
+func TestTenantsFileOrganizations(t *testing.T) {
+	const organizations = `organizations:
+- name: acme
+  shadow: true
+  priority: 10
+  labels: {team: acme, severity_class: customer}
+  maxRules: 100
+  route: acme
+`
+
+	testCases := map[string]struct {
+		tenantsFile string
+		fragments   map[string]string
+
+		expectErr        string
+		expectShadow     []string
+		expectPriorities map[string]int
+		expectLabels     map[string]map[string]string
+		expectRuleLimits map[string]int
+		expectRoutes     map[string]string
+	}{
+		"tenants inherit their organization": {
+			tenantsFile:      organizations + "tenants:\n- id: tenant1\n  organization: acme\n- id: tenant2\n",
+			expectShadow:     []string{"tenant1"},
+			expectPriorities: map[string]int{"tenant1": 10},
+			expectLabels:     map[string]map[string]string{"tenant1": {"team": "acme", "severity_class": "customer"}},
+			expectRuleLimits: map[string]int{"tenant1": 100},
+			expectRoutes:     map[string]string{"tenant1": "acme"},
+		},
+		"tenants override their organization": {
+			tenantsFile:      organizations + "tenants:\n- id: tenant1\n  organization: acme\n  priority: 1\n  maxRules: 5\n  route: other\n  labels: {team: acme-sre}\n",
+			expectShadow:     []string{"tenant1"},
+			expectPriorities: map[string]int{"tenant1": 1},
+			expectLabels:     map[string]map[string]string{"tenant1": {"team": "acme-sre", "severity_class": "customer"}},
+			expectRuleLimits: map[string]int{"tenant1": 5},
+			expectRoutes:     map[string]string{"tenant1": "other"},
+		},
+		"tenant of a fragment in an organization": {
+			tenantsFile: organizations + "include: [tenants.d]\n",
+			fragments: map[string]string{
+				"tenants.d/tenant1.yaml": "id: tenant1\norganization: acme\n",
+			},
+			expectShadow:     []string{"tenant1"},
+			expectPriorities: map[string]int{"tenant1": 10},
+			expectLabels:     map[string]map[string]string{"tenant1": {"team": "acme", "severity_class": "customer"}},
+			expectRuleLimits: map[string]int{"tenant1": 100},
+			expectRoutes:     map[string]string{"tenant1": "acme"},
+		},
+		"unknown organization": {
+			tenantsFile: organizations + "tenants:\n- id: tenant1\n  organization: umbrella\n",
+			expectErr:   `tenant tenant1: unknown organization "umbrella"`,
+		},
+		"duplicate organization": {
+			tenantsFile: organizations + "- name: acme\ntenants:\n- id: tenant1\n",
+			expectErr:   `organization names must be set and unique, got "acme"`,
+		},
+		"organization without name": {
+			tenantsFile: "organizations:\n- shadow: true\ntenants:\n- id: tenant1\n",
+			expectErr:   `organization names must be set and unique, got ""`,
+		},
+		"invalid label of organization": {
+			tenantsFile: "organizations:\n- name: acme\n  labels: {team-name: acme}\ntenants:\n- id: tenant1\n",
+			expectErr:   `organization acme: invalid label name "team-name"`,
+		},
+		"invalid label of tenant": {
+			tenantsFile: "tenants:\n- id: tenant1\n  labels: {team-name: acme}\n",
+			expectErr:   `line 2: tenant tenant1: invalid label name "team-name"`,
+		},
+		"negative rule limit of fragment": {
+			tenantsFile: "include: [tenants.d]\n",
+			fragments: map[string]string{
+				"tenants.d/tenant1.yaml": "id: tenant1\nmaxRules: -1\n",
+			},
+			expectErr: "tenant tenant1: maxRules must not be negative",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tc.fragments {
+				assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o700))
+				assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+			}
+			tenantsFile := filepath.Join(dir, "tenants.yaml")
+			assert.NoError(t, os.WriteFile(tenantsFile, []byte(tc.tenantsFile), 0o600))
+
+			tenants, err := readTenantsFile(tenantsFile, tenantsFormatAuto)
+			if tc.expectErr != "" {
+				assert.ErrorContains(t, err, tc.expectErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectShadow, tenants.shadowIDs())
+			assert.Equal(t, tc.expectPriorities, tenants.priorities())
+			assert.Equal(t, tc.expectLabels, tenants.labels())
+			assert.Equal(t, tc.expectRuleLimits, tenants.ruleLimits())
+			assert.Equal(t, tc.expectRoutes, tenants.routes())
+		})
+	}
+}
+
+func TestTenantsFileFormats(t *testing.T) {
+	testCases := map[string]struct {
+		fileContent   string
+		format        string
+		expectErr     bool
+		expectTenants []string
+	}{
+		"yaml is detected": {
+			fileContent:   "tenants:\n- id: tenant1\n- id: tenant2\n",
+			format:        tenantsFormatAuto,
+			expectTenants: []string{"tenant1", "tenant2"},
+		},
+		"lines are detected": {
+			fileContent:   "tenant1\ntenant2\n",
+			format:        tenantsFormatAuto,
+			expectTenants: []string{"tenant1", "tenant2"},
+		},
+		"single line is detected": {
+			fileContent:   "tenant1",
+			format:        tenantsFormatAuto,
+			expectTenants: []string{"tenant1"},
+		},
+		"lines skip comments and blank lines": {
+			fileContent:   "# production tenants\ntenant1\n\n  tenant2  \r\n",
+			format:        tenantsFormatLines,
+			expectTenants: []string{"tenant1", "tenant2"},
+		},
+		"lines with duplicates": {
+			fileContent: "tenant1\ntenant1\n",
+			format:      tenantsFormatLines,
+			expectErr:   true,
+		},
+		"only comments": {
+			fileContent: "# no tenants yet\n",
+			format:      tenantsFormatAuto,
+			expectErr:   true,
+		},
+		"lines as yaml": {
+			fileContent: "tenant1\ntenant2\n",
+			format:      tenantsFormatYAML,
+			expectErr:   true,
+		},
+		"unknown format": {
+			fileContent: "tenant1\n",
+			format:      "json",
+			expectErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tenants, err := readTenantsConfig([]byte(tc.fileContent), tc.format)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectTenants, tenants.IDs())
+		})
+	}
+}
+
+type testTenantsSetterFunc func(tenants *TenantsConfig) error
+
+func (f testTenantsSetterFunc) SetTenants(tenants *TenantsConfig) {
 	f(tenants)
 }
 
 func TestTenantsFileReloader(t *testing.T) {
 	testCases := map[string]struct {
-		tenantsReader            func() ([]string, error)
+		tenantsReader            func() (*TenantsConfig, error)
 		interval                 time.Duration
 		contextDuration          time.Duration
 		expectTenantsUpdateCalls int
 		expectErr                bool
 	}{
 		"reloads tenants until context cancel": {
-			tenantsReader: func() ([]string, error) {
-				return []string{"tenant1"}, nil
+			tenantsReader: func() (*TenantsConfig, error) {
+				return &TenantsConfig{Tenants: []TenantConfig{{ID: "tenant1"}}}, nil
 			},
 			interval:                 100 * time.Millisecond,
 			contextDuration:          250 * time.Millisecond,
 			expectTenantsUpdateCalls: 2,
 		},
 		"3 errors in a row exits with error": {
-			tenantsReader: func() ([]string, error) {
+			tenantsReader: func() (*TenantsConfig, error) {
 				return nil, errors.New("test error")
 			},
 			interval:                 100 * time.Millisecond,
@@ -102,7 +546,7 @@ func TestTenantsFileReloader(t *testing.T) {
 	for name, tc := range testCases {
 		t.Run(name, func(t *testing.T) {
 			tenantsUpdateCalls := 0
-			tenantsUpdate := func(tenants []string) error {
+			tenantsUpdate := func(tenants *TenantsConfig) error {
 				tenantsUpdateCalls++
 				return nil
 			}
@@ -121,3 +565,58 @@ func TestTenantsFileReloader(t *testing.T) {
 		})
 	}
 }
+
+func TestRemovalGuard(t *testing.T) {
+	tenants := func(ids ...string) *TenantsConfig {
+		cfg := &TenantsConfig{}
+		for _, id := range ids {
+			cfg.Tenants = append(cfg.Tenants, TenantConfig{ID: id})
+		}
+		return cfg
+	}
+
+	testCases := map[string]struct {
+		next             *TenantsConfig
+		allowMassRemoval bool
+		expectTenants    []string
+	}{
+		"tenants are added": {
+			next:          tenants("a", "b", "c", "d", "e"),
+			expectTenants: []string{"a", "b", "c", "d", "e"},
+		},
+		"some tenants are removed": {
+			next:          tenants("a", "b"),
+			expectTenants: []string{"a", "b"},
+		},
+		"mass removal is refused": {
+			next:          tenants("a"),
+			expectTenants: []string{"a", "b", "c", "d"},
+		},
+		"mass removal is allowed": {
+			next:             tenants("a"),
+			allowMassRemoval: true,
+			expectTenants:    []string{"a"},
+		},
+		"all tenants are replaced": {
+			next:          tenants("e", "f", "g", "h"),
+			expectTenants: []string{"a", "b", "c", "d"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var set []string
+			next := testTenantsSetterFunc(func(tenants *TenantsConfig) error {
+				set = tenants.IDs()
+				return nil
+			})
+
+			g := newRemovalGuard(prometheus.NewRegistry(), next, 0.5, tc.allowMassRemoval)
+			// The first tenants are always set.
+			g.SetTenants(tenants("a", "b", "c", "d"))
+			g.SetTenants(tc.next)
+
+			assert.Equal(t, tc.expectTenants, set)
+		})
+	}
+}
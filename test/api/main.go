@@ -1,24 +1,74 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 // Run this HTTP server for a deterministic rules API for testing.
+// It serves the rules of multiple tenants from the Observatorium API and rules-objstore endpoints,
+// with optional latency and failures, and admin endpoints changing rules and failures over time:
+//
+//	PUT    /admin/rules/<tenant>  sets the rules of a tenant to the request body.
+//	DELETE /admin/rules/<tenant>  removes a tenant.
+//	POST   /admin/faults          sets the faults given as form values: latency, error-rate, rate-limit-rate, retry-after.
+//	GET    /admin/requests        returns the number of requests for the rules of each tenant.
+//
+// Failures are drawn from a pseudo-random sequence seeded with -seed, so that runs are reproducible.
 
 func main() {
-	m := http.NewServeMux()
-	m.HandleFunc("/api/metrics/v1/test-oidc/rules", tenantTest)
+	var (
+		addr     = flag.String("listen", ":8443", "The address on which to listen.")
+		rulesDir = flag.String("rules-dir", "", "A directory with the rules of tenants, one <tenant>.yaml file per tenant. If empty, the test-oidc tenant is served with test rules.")
+		f        faults
+		seed     int64
+	)
+	flag.DurationVar(&f.latency, "latency", 0, "The latency added to the responses of the rules API.")
+	flag.Float64Var(&f.errorRate, "error-rate", 0, "The share of requests to the rules API failing with 500 Internal Server Error, from 0 to 1.")
+	flag.Float64Var(&f.rateLimitRate, "rate-limit-rate", 0, "The share of requests to the rules API failing with 429 Too Many Requests, from 0 to 1.")
+	flag.StringVar(&f.retryAfter, "retry-after", "", "The Retry-After header of 429 responses, e.g. 1s. If empty, it is not set.")
+	flag.Int64Var(&seed, "seed", 1, "The seed of the sequence from which failures are drawn.")
+	flag.Parse()
 
-	addr := ":8443"
-	fmt.Println("serving mocked api rules", addr)
-	if err := http.ListenAndServe(addr, m); err != nil {
+	tenantRules := map[string]string{"test-oidc": testRules}
+	if *rulesDir != "" {
+		var err error
+		tenantRules, err = readRulesDir(*rulesDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Println("serving mocked api rules", *addr)
+	if err := http.ListenAndServe(*addr, newServer(tenantRules, f, seed).handler()); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// readRulesDir reads the rules of tenants from the <tenant>.yaml files of a directory.
+func readRulesDir(dir string) (map[string]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules files: %w", err)
+	}
+
+	tenantRules := make(map[string]string, len(files))
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rules file: %w", err)
+		}
+		tenantRules[strings.TrimSuffix(filepath.Base(file), ".yaml")] = string(content)
+	}
+
+	return tenantRules, nil
+}
+
 const testRules = `
 groups:
   - name: kubelet.rules
@@ -43,7 +93,3 @@ groups:
     interval: 0s
     rules: []
 `
-
-func tenantTest(w http.ResponseWriter, r *http.Request) {
-	_, _ = w.Write([]byte(testRules))
-}
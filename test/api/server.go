@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"gopkg.in/yaml.v3"
+)
+
+// faults are injected into the responses of the rules API.
+type faults struct {
+	// latency delays each response.
+	latency time.Duration
+	// errorRate is the share of requests failing with 500 Internal Server Error.
+	errorRate float64
+	// rateLimitRate is the share of requests failing with 429 Too Many Requests.
+	rateLimitRate float64
+	// retryAfter is the value of the Retry-After header of 429 responses, if not empty.
+	retryAfter string
+}
+
+// server mocks the rules API of the Observatorium API and of the rules-objstore for multiple tenants,
+// with faults injected into its responses. Rules and faults can be changed over time with its admin endpoints.
+type server struct {
+	mu       sync.Mutex
+	rules    map[string]string
+	faults   faults
+	rand     *rand.Rand
+	requests map[string]int
+	// versions are the versions of the rules of tenants, set to the next value of a sequence whenever they are set.
+	versions map[string]int
+	sequence int
+	// modified are the times the rules of tenants were last set, sent as their Last-Modified time.
+	modified map[string]time.Time
+}
+
+func newServer(tenantRules map[string]string, f faults, seed int64) *server {
+	versions := make(map[string]int, len(tenantRules))
+	modified := make(map[string]time.Time, len(tenantRules))
+	now := time.Now()
+	for tenant := range tenantRules {
+		versions[tenant] = 1
+		modified[tenant] = now
+	}
+
+	return &server{
+		rules:    tenantRules,
+		faults:   f,
+		rand:     rand.New(rand.NewSource(seed)),
+		requests: map[string]int{},
+		versions: versions,
+		sequence: 1,
+		modified: modified,
+	}
+}
+
+func (s *server) handler() http.Handler {
+	m := http.NewServeMux()
+	// Observatorium API, see fetch.ObservatoriumAPIFetcher.
+	m.HandleFunc("/api/metrics/v1/", s.withFaults(s.observatoriumRules))
+	// rules-objstore, see fetch.RulesObjstoreFetcher.
+	m.HandleFunc("/api/v1/rules", s.withFaults(s.allRules))
+	m.HandleFunc("/api/v1/rules/", s.withFaults(s.objstoreRules))
+	m.HandleFunc("/api/v1/changes", s.withFaults(s.changes))
+
+	m.HandleFunc("/admin/rules/", s.adminRules)
+	m.HandleFunc("/admin/faults", s.adminFaults)
+	m.HandleFunc("/admin/requests", s.adminRequests)
+
+	return m
+}
+
+// withFaults injects the configured faults before calling the handler.
+func (s *server) withFaults(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		f := s.faults
+		n := s.rand.Float64()
+		s.mu.Unlock()
+
+		select {
+		case <-time.After(f.latency):
+		case <-r.Context().Done():
+			return
+		}
+
+		switch {
+		case n < f.rateLimitRate:
+			if f.retryAfter != "" {
+				w.Header().Set("Retry-After", f.retryAfter)
+			}
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+		case n < f.rateLimitRate+f.errorRate:
+			http.Error(w, "injected error", http.StatusInternalServerError)
+		default:
+			next(w, r)
+		}
+	}
+}
+
+// observatoriumRules serves the rules of a tenant at /api/metrics/v1/<tenant>/api/v1/rules/raw,
+// and at the legacy /api/metrics/v1/<tenant>/rules.
+func (s *server) observatoriumRules(w http.ResponseWriter, r *http.Request) {
+	tenant, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/metrics/v1/"), "/")
+	if rest != "api/v1/rules/raw" && rest != "rules" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.tenantRules(w, r, tenant)
+}
+
+// objstoreRules serves the rules of a tenant at /api/v1/rules/<tenant>.
+func (s *server) objstoreRules(w http.ResponseWriter, r *http.Request) {
+	s.tenantRules(w, r, strings.TrimPrefix(r.URL.Path, "/api/v1/rules/"))
+}
+
+func (s *server) tenantRules(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	s.requests[tenant]++
+	content, ok := s.rules[tenant]
+	modified := s.modified[tenant]
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown tenant %q", tenant), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	_, _ = io.WriteString(w, content)
+}
+
+// allRules serves the rules of all tenants, with group names prefixed with their tenant like the rules-objstore.
+// It supports range requests, with a strong ETag and the SHA-256 digest of the rules, to resume downloads.
+func (s *server) allRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	tenants := make([]string, 0, len(s.rules))
+	for tenant := range s.rules {
+		s.requests[tenant]++
+		tenants = append(tenants, tenant)
+	}
+	tenantRules := make(map[string]string, len(s.rules))
+	var modified time.Time
+	for tenant, content := range s.rules {
+		tenantRules[tenant] = content
+		if s.modified[tenant].After(modified) {
+			modified = s.modified[tenant]
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(tenants)
+
+	var all rules.RuleGroups
+	for _, tenant := range tenants {
+		parsed, errs := rules.Parse([]byte(tenantRules[tenant]))
+		if len(errs) > 0 {
+			http.Error(w, (&rules.TenantError{Tenant: tenant, Err: errors.Join(errs...)}).Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, group := range parsed.Groups {
+			group.Name = tenant + "." + group.Name
+			all.Groups = append(all.Groups, group)
+		}
+	}
+
+	content, err := yaml.Marshal(all)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(content)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum))
+	w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	http.ServeContent(w, r, "", modified, bytes.NewReader(content))
+}
+
+// changes serves the versions of the rules of tenants as the change feed of the rules backend.
+func (s *server) changes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	tenants := make(map[string]string, len(s.versions))
+	for tenant, version := range s.versions {
+		tenants[tenant] = strconv.Itoa(version)
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"tenants": tenants})
+}
+
+// adminRules sets the rules of a tenant with PUT /admin/rules/<tenant>, adding it if needed,
+// and removes the tenant with DELETE /admin/rules/<tenant>.
+func (s *server) adminRules(w http.ResponseWriter, r *http.Request) {
+	tenant := strings.TrimPrefix(r.URL.Path, "/admin/rules/")
+	if tenant == "" {
+		http.Error(w, "missing tenant", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		s.rules[tenant] = string(content)
+		s.sequence++
+		s.versions[tenant] = s.sequence
+		s.modified[tenant] = time.Now()
+		s.mu.Unlock()
+		log.Printf("set rules of tenant %s", tenant)
+	case http.MethodDelete:
+		s.mu.Lock()
+		delete(s.rules, tenant)
+		delete(s.versions, tenant)
+		delete(s.modified, tenant)
+		s.mu.Unlock()
+		log.Printf("removed tenant %s", tenant)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+// adminFaults changes the faults given as form values with POST /admin/faults, e.g. latency=1s&error-rate=0.5.
+// Faults not given are kept.
+func (s *server) adminFaults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	f := s.faults
+	s.mu.Unlock()
+
+	var err error
+	if v := r.FormValue("latency"); v != "" {
+		if f.latency, err = time.ParseDuration(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid latency: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("error-rate"); v != "" {
+		if f.errorRate, err = strconv.ParseFloat(v, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid error rate: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("rate-limit-rate"); v != "" {
+		if f.rateLimitRate, err = strconv.ParseFloat(v, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid rate limit rate: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if r.Form.Has("retry-after") {
+		f.retryAfter = r.FormValue("retry-after")
+	}
+
+	s.mu.Lock()
+	s.faults = f
+	s.mu.Unlock()
+	log.Printf("set faults: latency %s, error rate %g, rate limit rate %g, retry after %q", f.latency, f.errorRate, f.rateLimitRate, f.retryAfter)
+}
+
+// adminRequests returns the number of requests for the rules of each tenant as JSON with GET /admin/requests.
+func (s *server) adminRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.requests)
+}
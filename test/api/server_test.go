@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/fetch"
+	"github.com/stretchr/testify/assert"
+)
+
+const tenantARules = `groups:
+- name: a
+  rules:
+  - record: a
+    expr: vector(1)
+`
+
+const tenantBRules = `groups:
+- name: b
+  rules:
+  - record: b
+    expr: vector(1)
+`
+
+func TestServer(t *testing.T) {
+	testCases := map[string]struct {
+		faults faults
+		path   string
+		header http.Header
+
+		expectStatus     int
+		expectRetryAfter string
+		expectContains   string
+	}{
+		"observatorium api": {
+			path:           "/api/metrics/v1/tenant-a/api/v1/rules/raw",
+			expectStatus:   http.StatusOK,
+			expectContains: "record: a",
+		},
+		"rules-objstore": {
+			path:           "/api/v1/rules/tenant-a",
+			expectStatus:   http.StatusOK,
+			expectContains: "record: a",
+		},
+		"all rules are prefixed with tenants": {
+			path:           "/api/v1/rules",
+			expectStatus:   http.StatusOK,
+			expectContains: "name: tenant-a.a",
+		},
+		"all rules support range requests": {
+			path:           "/api/v1/rules",
+			header:         http.Header{"Range": {"bytes=0-6"}},
+			expectStatus:   http.StatusPartialContent,
+			expectContains: "groups:",
+		},
+		"change feed": {
+			path:           "/api/v1/changes",
+			expectStatus:   http.StatusOK,
+			expectContains: `{"tenants":{"tenant-a":"1"}}`,
+		},
+		"unknown tenant": {
+			path:         "/api/v1/rules/tenant-b",
+			expectStatus: http.StatusNotFound,
+		},
+		"errors": {
+			faults:       faults{errorRate: 1},
+			path:         "/api/v1/rules/tenant-a",
+			expectStatus: http.StatusInternalServerError,
+		},
+		"rate limits": {
+			faults:           faults{rateLimitRate: 1, retryAfter: "1s"},
+			path:             "/api/v1/rules/tenant-a",
+			expectStatus:     http.StatusTooManyRequests,
+			expectRetryAfter: "1s",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(newServer(map[string]string{"tenant-a": tenantARules}, tc.faults, 1).handler())
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodGet, server.URL+tc.path, nil)
+			assert.NoError(t, err)
+			for key, values := range tc.header {
+				req.Header[key] = values
+			}
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			assert.NoError(t, err)
+
+			assert.Equal(t, tc.expectStatus, res.StatusCode)
+			assert.Equal(t, tc.expectRetryAfter, res.Header.Get("Retry-After"))
+			assert.Contains(t, string(body), tc.expectContains)
+		})
+	}
+}
+
+func TestServerAdmin(t *testing.T) {
+	server := httptest.NewServer(newServer(map[string]string{"tenant-a": tenantARules}, faults{}, 1).handler())
+	defer server.Close()
+
+	f, err := fetch.NewRulesObjstoreFetcher(server.URL, []string{"tenant-a", "tenant-b"}, server.Client())
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	// Rules of tenants can be added and changed.
+	_, err = f.GetTenantsRules(ctx)
+	assert.Error(t, err)
+
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/admin/rules/tenant-b", strings.NewReader(tenantBRules))
+	assert.NoError(t, err)
+	_, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+
+	fetched, err := f.GetTenantsRules(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err := io.ReadAll(fetched)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "tenant-b.b")
+
+	// Requests are counted by tenant, including those for unknown tenants.
+	res, err := http.Get(server.URL + "/admin/requests")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var requests map[string]int
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&requests))
+	assert.Equal(t, 2, requests["tenant-b"])
+
+	// Faults can be injected.
+	_, err = http.PostForm(server.URL+"/admin/faults", url.Values{"latency": {"50ms"}, "error-rate": {"1"}})
+	assert.NoError(t, err)
+
+	start := time.Now()
+	_, err = f.GetTenantsRules(ctx)
+	assert.Error(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
@@ -0,0 +1,147 @@
+//go:build e2e
+
+// Package e2e tests the syncer end to end: it syncs the rules served by the mock rules API to a Thanos Ruler
+// running in a container, and checks that the ruler loads them. It requires Docker, and runs with:
+//
+//	go test -tags e2e ./test/e2e
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/e2e"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// thanosImage is the image of the Thanos Ruler the rules are synced to.
+var thanosImage = envOrDefault("THANOS_IMAGE", "quay.io/thanos/thanos:v0.34.1")
+
+const tenantRules = `groups:
+- name: e2e
+  rules:
+  - record: e2e:up
+    expr: vector(1)
+`
+
+func TestSyncToThanosRuler(t *testing.T) {
+	env, err := e2e.New()
+	require.NoError(t, err)
+	t.Cleanup(env.Close)
+
+	future := env.Runnable("thanos-rule").WithPorts(map[string]int{"http": 10902, "grpc": 10901}).Future()
+	rulesFile := filepath.Join(future.Dir(), "rules.yaml")
+	require.NoError(t, os.WriteFile(rulesFile, nil, 0o666))
+
+	ruler := future.Init(e2e.StartOptions{
+		Image: thanosImage,
+		Command: e2e.NewCommand("rule",
+			"--rule-file="+rulesFile,
+			"--data-dir="+filepath.Join(future.Dir(), "data"),
+			"--http-address=0.0.0.0:10902",
+			"--grpc-address=0.0.0.0:10901",
+			// The rules are not evaluated successfully without a querier, which doesn't prevent loading them.
+			"--query=localhost:9090",
+			`--label=replica="e2e"`,
+		),
+		Readiness: e2e.NewHTTPReadinessProbe("http", "/-/ready", 200, 200),
+		// The rules file is written by the syncer running on the host.
+		User: fmt.Sprintf("%d", os.Getuid()),
+	})
+	require.NoError(t, e2e.StartAndWaitReady(ruler))
+
+	bin := t.TempDir()
+	goBuild(t, filepath.Join(bin, "thanos-rule-syncer"), "../..")
+	goBuild(t, filepath.Join(bin, "api"), "../api")
+
+	rulesDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rulesDir, "tenant-a.yaml"), []byte(tenantRules), 0o666))
+	apiAddr := freeAddr(t)
+	start(t, filepath.Join(bin, "api"), "-listen="+apiAddr, "-rules-dir="+rulesDir)
+
+	start(t, filepath.Join(bin, "thanos-rule-syncer"),
+		"-observatorium-api-url=http://"+apiAddr,
+		"-tenant=tenant-a",
+		"-thanos-rule-url=http://"+ruler.Endpoint("http"),
+		"-file="+rulesFile,
+		"-interval=1",
+		"-web.internal.listen="+freeAddr(t),
+	)
+
+	rulerRules := func() string {
+		res, err := http.Get("http://" + ruler.Endpoint("http") + "/api/v1/rules")
+		if err != nil {
+			return ""
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return string(body)
+	}
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(rulerRules(), `"name":"e2e:up"`)
+	}, time.Minute, time.Second, "the ruler didn't load the rules of the tenant")
+
+	// Changes to the rules of the tenant are synced.
+	req, err := http.NewRequest(http.MethodPut, "http://"+apiAddr+"/admin/rules/tenant-a", strings.NewReader(strings.ReplaceAll(tenantRules, "e2e:up", "e2e:changed")))
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(rulerRules(), `"name":"e2e:changed"`)
+	}, time.Minute, time.Second, "the ruler didn't load the changed rules of the tenant")
+}
+
+func goBuild(t *testing.T, out, pkg string) {
+	t.Helper()
+
+	cmd := exec.Command("go", "build", "-o", out, pkg)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	require.NoError(t, cmd.Run())
+}
+
+// start starts a process until the end of the test.
+func start(t *testing.T, name string, args ...string) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	require.NoError(t, cmd.Start())
+
+	t.Cleanup(func() {
+		cancel()
+		_ = cmd.Wait()
+	})
+}
+
+// freeAddr returns a free local address for a process to listen on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func envOrDefault(key, defaultValue string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+
+	return defaultValue
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// tlsVersions are the TLS versions -tls.min-version accepts.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// outboundTLS returns the TLS configuration of -tls.min-version and -tls.cipher-suites, applied to all the outbound
+// connections, e.g. to the upstreams, the OIDC issuers and the ruler.
+func outboundTLS(minVersion, cipherSuites string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q, must be one of: 1.0, 1.1, 1.2, 1.3", minVersion)
+	}
+	c := &tls.Config{MinVersion: version}
+
+	if cipherSuites == "" {
+		return c, nil
+	}
+	ids := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		ids[suite.Name] = suite.ID
+	}
+	insecure := map[string]bool{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+	for _, name := range strings.Split(cipherSuites, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := ids[name]
+		if !ok {
+			if insecure[name] {
+				return nil, fmt.Errorf("insecure cipher suite %s", name)
+			}
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		c.CipherSuites = append(c.CipherSuites, id)
+	}
+
+	return c, nil
+}
+
+// configureTLS makes the transport negotiate TLS with the outbound TLS configuration. The TLS configuration of the
+// transport is updated rather than replaced, to keep its CA and the HTTP/2 protocols added to it.
+func configureTLS(t *http.Transport, c *tls.Config) {
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.MinVersion = c.MinVersion
+	t.TLSClientConfig.CipherSuites = c.CipherSuites
+}
+
+// outboundTransport returns a transport like http.DefaultTransport negotiating TLS with the outbound TLS configuration,
+// e.g. to post reports.
+func outboundTransport(c *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	configureTLS(t, c)
+
+	return t
+}
+
+// natsTLS returns the options of the connections to the NATS servers at the URLs, negotiating TLS with the outbound
+// TLS configuration if the URLs require TLS. It isn't set otherwise, since it would require TLS.
+func natsTLS(urls string, c *tls.Config) []nats.Option {
+	for _, u := range strings.Split(urls, ",") {
+		if strings.HasPrefix(strings.TrimSpace(u), "tls://") {
+			return []nats.Option{nats.Secure(c.Clone())}
+		}
+	}
+
+	return nil
+}
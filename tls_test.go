@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboundTLS(t *testing.T) {
+	testCases := map[string]struct {
+		minVersion   string
+		cipherSuites string
+
+		expectErr          bool
+		expectMinVersion   uint16
+		expectCipherSuites []uint16
+	}{
+		"default": {
+			minVersion:       "1.2",
+			expectMinVersion: tls.VersionTLS12,
+		},
+		"cipher suites": {
+			minVersion:         "1.2",
+			cipherSuites:       "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			expectMinVersion:   tls.VersionTLS12,
+			expectCipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		},
+		"unknown version": {
+			minVersion: "1.4",
+			expectErr:  true,
+		},
+		"unknown cipher suite": {
+			minVersion:   "1.2",
+			cipherSuites: "TLS_NOPE",
+			expectErr:    true,
+		},
+		"insecure cipher suite": {
+			minVersion:   "1.2",
+			cipherSuites: "TLS_RSA_WITH_RC4_128_SHA",
+			expectErr:    true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c, err := outboundTLS(tc.minVersion, tc.cipherSuites)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectMinVersion, c.MinVersion)
+			assert.Equal(t, tc.expectCipherSuites, c.CipherSuites)
+		})
+	}
+}
+
+func TestOutboundTransport(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	testCases := map[string]struct {
+		minVersion string
+
+		expectErr bool
+	}{
+		"server version accepted": {
+			minVersion: "1.2",
+		},
+		"server version too old": {
+			minVersion: "1.3",
+			expectErr:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c, err := outboundTLS(tc.minVersion, "")
+			assert.NoError(t, err)
+			transport := outboundTransport(c)
+			// The server is verified against its own certificate.
+			transport.TLSClientConfig.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+			res, err := (&http.Client{Transport: transport}).Get(server.URL)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			res.Body.Close()
+		})
+	}
+}
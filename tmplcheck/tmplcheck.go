@@ -0,0 +1,271 @@
+// Package tmplcheck renders the label and annotation templates of alerts when rules are synced, so that templates
+// failing to render, e.g. calling a function with arguments of the wrong type or an undefined template, are found
+// before the alerts fire instead of when they do.
+package tmplcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/template"
+	"gopkg.in/yaml.v3"
+)
+
+// Policies of handling the alerts whose templates fail to render.
+const (
+	// PolicyIgnore doesn't render the templates.
+	PolicyIgnore = "ignore"
+	// PolicyWarn only reports the failures.
+	PolicyWarn = "warn"
+	// PolicyDrop removes the alerts from the rules, keeping the other rules of their groups.
+	PolicyDrop = "drop"
+	// PolicyReject fails the sync, so that the ruler keeps its rules.
+	PolicyReject = "reject"
+)
+
+// Finding is a template of an alert failing to render.
+type Finding struct {
+	Group string `json:"group"`
+	Alert string `json:"alert"`
+	// Field is the label or annotation of the template, e.g. annotation "summary".
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Checker renders the templates of the alerts of tenants, and reports the failures of each tenant.
+type Checker struct {
+	policy      string
+	groupTenant func(groupName string) string
+
+	// report are the findings of the last check, by tenant.
+	report   map[string][]Finding
+	reportMu sync.RWMutex
+
+	findings *prometheus.GaugeVec
+}
+
+// New creates a new Checker handling the failures according to the policy. The tenant owning a group is given by groupTenant.
+func New(r prometheus.Registerer, policy string, groupTenant func(groupName string) string) (*Checker, error) {
+	switch policy {
+	case PolicyIgnore, PolicyWarn, PolicyDrop, PolicyReject:
+	default:
+		return nil, fmt.Errorf("unknown template failures policy %q", policy)
+	}
+
+	c := &Checker{
+		policy:      policy,
+		groupTenant: groupTenant,
+		report:      map[string][]Finding{},
+		findings: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_rule_syncer_template_failures",
+			Help: "Number of label and annotation templates of alerts of tenants failing to render in the last synced rules, by tenant.",
+		}, []string{"tenant"}),
+	}
+
+	if r != nil {
+		r.MustRegister(c.findings)
+	}
+
+	return c, nil
+}
+
+// Enabled returns whether the templates are rendered.
+func (c *Checker) Enabled() bool {
+	return c.policy != PolicyIgnore
+}
+
+// Check renders the templates of the alerts, reports the failures and handles them according to the policy.
+func (c *Checker) Check(ctx context.Context, content []byte) ([]byte, error) {
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	report := map[string][]Finding{}
+	dropped := 0
+	for i := range groups.Groups {
+		group := &groups.Groups[i]
+		tenant := c.groupTenant(group.Name)
+		if _, ok := report[tenant]; !ok {
+			// Tenants whose templates render are reported without findings.
+			report[tenant] = []Finding{}
+		}
+
+		kept := group.Rules[:0]
+		for _, rule := range group.Rules {
+			findings := check(ctx, group.Name, rule)
+			report[tenant] = append(report[tenant], findings...)
+			if len(findings) > 0 && c.policy == PolicyDrop {
+				dropped++
+				continue
+			}
+			kept = append(kept, rule)
+		}
+		group.Rules = kept
+	}
+
+	c.setReport(report)
+
+	tenants := make([]string, 0, len(report))
+	for tenant := range report {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	var errs []error
+	var msgs []string
+	for _, tenant := range tenants {
+		var tenantMsgs []string
+		for _, f := range report[tenant] {
+			tenantMsgs = append(tenantMsgs, f.Message)
+		}
+		if len(tenantMsgs) > 0 {
+			errs = append(errs, &rules.TenantError{Tenant: tenant, Err: fmt.Errorf("%s", strings.Join(tenantMsgs, "; "))})
+			msgs = append(msgs, fmt.Sprintf("tenant %s: %s", tenant, strings.Join(tenantMsgs, "; ")))
+		}
+	}
+	if len(msgs) == 0 {
+		return content, nil
+	}
+
+	switch c.policy {
+	case PolicyReject:
+		return nil, fmt.Errorf("alert templates fail to render: %w", errors.Join(errs...))
+	case PolicyDrop:
+		log.Printf("dropped %d alerts whose templates fail to render: %s", dropped, strings.Join(msgs, "; "))
+	default:
+		log.Printf("alert templates fail to render: %s", strings.Join(msgs, "; "))
+		return content, nil
+	}
+
+	checked, err := yaml.Marshal(groups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	return checked, nil
+}
+
+// Validate renders the templates of the alerts like Check, without reporting the failures nor changing the rules,
+// e.g. to give feedback on the rules of a tenant before they are synced. It returns the findings, and an error if there
+// are any and the policy rejects them.
+func (c *Checker) Validate(ctx context.Context, content []byte) ([]Finding, error) {
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	var findings []Finding
+	for _, group := range groups.Groups {
+		for _, rule := range group.Rules {
+			findings = append(findings, check(ctx, group.Name, rule)...)
+		}
+	}
+
+	if len(findings) > 0 && c.policy == PolicyReject {
+		msgs := make([]string, 0, len(findings))
+		for _, f := range findings {
+			msgs = append(msgs, f.Message)
+		}
+		return findings, fmt.Errorf("alert templates fail to render: %s", strings.Join(msgs, "; "))
+	}
+
+	return findings, nil
+}
+
+// check renders the label and annotation templates of a rule like Thanos Ruler does when the alert fires, and returns
+// the templates failing to render, which are none for recording rules. The templates are rendered for a series with the
+// static labels of the alert and a value of 0, and the query function returns that series for any valid expression,
+// so that a template only fails because of itself and not because of the data it's rendered with.
+func check(ctx context.Context, group string, rule rulefmt.RuleNode) []Finding {
+	if rule.Alert.Value == "" {
+		return nil
+	}
+
+	series := make(map[string]string, len(rule.Labels))
+	for name, value := range rule.Labels {
+		if !strings.Contains(value, "{{") {
+			series[name] = value
+		}
+	}
+	queryFunc := func(_ context.Context, q string, ts time.Time) (promql.Vector, error) {
+		if _, err := parser.ParseExpr(q); err != nil {
+			return nil, err
+		}
+		return promql.Vector{{Metric: labels.FromMap(series), T: ts.UnixMilli()}}, nil
+	}
+
+	data := template.AlertTemplateData(series, map[string]string{}, "", 0)
+	defs := "{{$labels := .Labels}}{{$externalLabels := .ExternalLabels}}{{$externalURL := .ExternalURL}}{{$value := .Value}}"
+
+	var findings []Finding
+	render := func(field, text string) {
+		expander := template.NewTemplateExpander(ctx, defs+text, "__alert_"+rule.Alert.Value, data, model.Now(), queryFunc, &url.URL{}, nil)
+		if _, err := expander.Expand(); err != nil {
+			findings = append(findings, Finding{
+				Group:   group,
+				Alert:   rule.Alert.Value,
+				Field:   field,
+				Message: fmt.Sprintf("group %q: alert %s: %s: %v", group, rule.Alert.Value, field, err),
+			})
+		}
+	}
+
+	for _, name := range sortedKeys(rule.Labels) {
+		render(fmt.Sprintf("label %q", name), rule.Labels[name])
+	}
+	for _, name := range sortedKeys(rule.Annotations) {
+		render(fmt.Sprintf("annotation %q", name), rule.Annotations[name])
+	}
+
+	return findings
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+func (c *Checker) setReport(report map[string][]Finding) {
+	c.reportMu.Lock()
+	defer c.reportMu.Unlock()
+
+	c.findings.Reset()
+	for tenant, findings := range report {
+		c.findings.WithLabelValues(tenant).Set(float64(len(findings)))
+	}
+	c.report = report
+}
+
+// Report returns the findings of the last check, by tenant.
+func (c *Checker) Report() map[string][]Finding {
+	c.reportMu.RLock()
+	defer c.reportMu.RUnlock()
+
+	report := make(map[string][]Finding, len(c.report))
+	for tenant, findings := range c.report {
+		report[tenant] = slices.Clone(findings)
+	}
+
+	return report
+}
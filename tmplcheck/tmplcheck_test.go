@@ -0,0 +1,169 @@
+package tmplcheck
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const tenantsRules = `groups:
+- name: tenant-a.alerts
+  rules:
+  - alert: Down
+    expr: up == 0
+    labels:
+      severity: warning
+      instance_name: '{{ $labels.instance }}'
+    annotations:
+      summary: '{{ $labels.job }} is down since {{ $value | humanizeDuration }}'
+      targets: '{{ with query "count(up)" }}{{ . | first | value | humanize }}{{ end }} targets'
+  - alert: Undefined
+    expr: vector(1)
+    annotations:
+      summary: '{{ template "missing" . }}'
+  - record: job:up:sum
+    expr: sum by (job) (up)
+- name: tenant-b.alerts
+  rules:
+  - alert: Field
+    expr: vector(1)
+    annotations:
+      summary: '{{ .Missing }}'
+  - alert: Query
+    expr: vector(1)
+    labels:
+      severity: '{{ humanize "high" }}'
+    annotations:
+      summary: '{{ query "up ==" }}'
+`
+
+func groupTenant(groupName string) string {
+	tenant, _, _ := strings.Cut(groupName, ".")
+	return tenant
+}
+
+func TestChecker(t *testing.T) {
+	testCases := map[string]struct {
+		policy string
+
+		expectErr      bool
+		expectAlerts   []string
+		expectFindings map[string][]string
+	}{
+		"warn": {
+			policy:       PolicyWarn,
+			expectAlerts: []string{"Down", "Undefined", "Field", "Query"},
+			expectFindings: map[string][]string{
+				"tenant-a": {`Undefined annotation "summary"`},
+				"tenant-b": {`Field annotation "summary"`, `Query label "severity"`, `Query annotation "summary"`},
+			},
+		},
+		"drop": {
+			policy:       PolicyDrop,
+			expectAlerts: []string{"Down"},
+			expectFindings: map[string][]string{
+				"tenant-a": {`Undefined annotation "summary"`},
+				"tenant-b": {`Field annotation "summary"`, `Query label "severity"`, `Query annotation "summary"`},
+			},
+		},
+		"reject": {
+			policy:    PolicyReject,
+			expectErr: true,
+			expectFindings: map[string][]string{
+				"tenant-a": {`Undefined annotation "summary"`},
+				"tenant-b": {`Field annotation "summary"`, `Query label "severity"`, `Query annotation "summary"`},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := prometheus.NewRegistry()
+			c, err := New(r, tc.policy, groupTenant)
+			assert.NoError(t, err)
+
+			checked, err := c.Check(context.Background(), []byte(tenantsRules))
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.Equal(t, []string{"tenant-a", "tenant-b"}, rules.ErrorTenants(err))
+			} else {
+				assert.NoError(t, err)
+
+				groups, errs := rules.Parse(checked)
+				assert.Empty(t, errs)
+				var alerts []string
+				for _, group := range groups.Groups {
+					for _, rule := range group.Rules {
+						if rule.Alert.Value != "" {
+							alerts = append(alerts, rule.Alert.Value)
+						}
+					}
+				}
+				assert.Equal(t, tc.expectAlerts, alerts)
+			}
+
+			findings := map[string][]string{}
+			for tenant, tenantFindings := range c.Report() {
+				findings[tenant] = []string{}
+				for _, f := range tenantFindings {
+					findings[tenant] = append(findings[tenant], f.Alert+" "+f.Field)
+				}
+			}
+			assert.Equal(t, tc.expectFindings, findings)
+			assert.Equal(t, float64(1), testutil.ToFloat64(c.findings.WithLabelValues("tenant-a")))
+			assert.Equal(t, float64(3), testutil.ToFloat64(c.findings.WithLabelValues("tenant-b")))
+		})
+	}
+}
+
+func TestCheckerValidate(t *testing.T) {
+	content := []byte(`groups:
+- name: alerts
+  rules:
+  - alert: Down
+    expr: up == 0
+    annotations:
+      summary: '{{ $labels.instance }} is down'
+  - alert: Undefined
+    expr: vector(1)
+    annotations:
+      summary: '{{ template "missing" . }}'
+`)
+
+	testCases := map[string]struct {
+		policy string
+
+		expectErr bool
+	}{
+		"warn":   {policy: PolicyWarn},
+		"reject": {policy: PolicyReject, expectErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c, err := New(nil, tc.policy, groupTenant)
+			assert.NoError(t, err)
+
+			findings, err := c.Validate(context.Background(), content)
+			if tc.expectErr {
+				assert.ErrorContains(t, err, `template "missing" not defined`)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Len(t, findings, 1)
+			assert.Equal(t, "Undefined", findings[0].Alert)
+			// Validated rules are not reported.
+			assert.Empty(t, c.Report())
+		})
+	}
+}
+
+func TestNewUnknownPolicy(t *testing.T) {
+	_, err := New(nil, "fix", groupTenant)
+	assert.Error(t, err)
+}
@@ -0,0 +1,339 @@
+// Package usage periodically reports the demands of the rules of each tenant on the shared ruler, e.g. for chargeback
+// and capacity planning: how many rules a tenant has, how often they are evaluated and an estimate of what querying
+// their expressions costs.
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/observatorium/thanos-rule-syncer/rules"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultEvaluationInterval is the evaluation interval of the groups that don't set one, like the ruler's default.
+	DefaultEvaluationInterval = time.Minute
+
+	defaultUploadTimeout = 10 * time.Second
+)
+
+// Report is the usage of the rules last written, by tenant.
+type Report struct {
+	Generated time.Time `json:"generated"`
+	// RulesWritten is when the rules the report summarizes were written.
+	RulesWritten time.Time `json:"rulesWritten"`
+	Tenants      []Tenant  `json:"tenants"`
+}
+
+// Tenant is the usage of the rules of a tenant.
+type Tenant struct {
+	Tenant         string `json:"tenant"`
+	Groups         int    `json:"groups"`
+	RecordingRules int    `json:"recordingRules"`
+	AlertingRules  int    `json:"alertingRules"`
+	// Intervals are the numbers of rules by evaluation interval, e.g. 30s.
+	Intervals map[string]int `json:"intervals"`
+	// EvaluationsPerMinute is how many rules of the tenant are evaluated per minute.
+	EvaluationsPerMinute float64 `json:"evaluationsPerMinute"`
+	// Selectors is the number of series selectors of the expressions of the rules.
+	Selectors int `json:"selectors"`
+	// EstimatedCostPerMinute is the cost of the selectors queried per minute, each selector costing 1 plus the
+	// minutes of its range, and the selectors of subqueries being queried at each of their steps.
+	EstimatedCostPerMinute float64 `json:"estimatedCostPerMinute"`
+}
+
+// Reporter reports the usage of the rules written by the sync cycles it observes.
+type Reporter struct {
+	groupTenant        func(groupName string) string
+	interval           time.Duration
+	evaluationInterval time.Duration
+	uploadURL          *url.URL
+	client             *http.Client
+	timeout            time.Duration
+	clock              clock.Clock
+
+	mu      sync.Mutex
+	written []byte
+	at      time.Time
+	// first is signalled when the first rules are written, so that a report is available without waiting for the interval.
+	first  chan struct{}
+	report atomic.Pointer[[]byte]
+
+	uploads *prometheus.CounterVec
+}
+
+// Option configures a Reporter.
+type Option func(*Reporter)
+
+// WithEvaluationInterval sets the evaluation interval of the groups that don't set one, the -eval-interval of the ruler.
+func WithEvaluationInterval(interval time.Duration) Option {
+	return func(r *Reporter) {
+		r.evaluationInterval = interval
+	}
+}
+
+// WithUpload puts each report to the given URL of an object store bucket with the given client, within the given
+// timeout, as an object named after the time the report was generated.
+func WithUpload(u *url.URL, client *http.Client, timeout time.Duration) Option {
+	return func(r *Reporter) {
+		if client == nil {
+			client = http.DefaultClient
+		}
+		if timeout <= 0 {
+			timeout = defaultUploadTimeout
+		}
+
+		r.uploadURL = u
+		r.client = client
+		r.timeout = timeout
+	}
+}
+
+// WithClock sets the clock timing the reports.
+func WithClock(c clock.Clock) Option {
+	return func(r *Reporter) {
+		r.clock = c
+	}
+}
+
+// New creates a new Reporter generating a report at the given interval, telling the tenants of rule groups apart with
+// groupTenant, e.g. merge.GroupTenantFunc. Its metrics are registered with the given registerer, if not nil.
+func New(reg prometheus.Registerer, groupTenant func(groupName string) string, interval time.Duration, opts ...Option) *Reporter {
+	r := &Reporter{
+		groupTenant:        groupTenant,
+		interval:           interval,
+		evaluationInterval: DefaultEvaluationInterval,
+		clock:              clock.Real(),
+		first:              make(chan struct{}, 1),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_rule_syncer_usage_report_uploads_total",
+			Help: "Total number of uploads of usage reports, by result.",
+		}, []string{"result"}),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if reg != nil {
+		reg.MustRegister(r.uploads)
+	}
+
+	return r
+}
+
+// Observe keeps the rules written by the sync cycle, and is a syncer.Observer.
+func (r *Reporter) Observe(_ context.Context, c syncer.Cycle) {
+	if c.Written == nil {
+		return
+	}
+
+	r.mu.Lock()
+	first := r.written == nil
+	r.written, r.at = c.Written, c.Start.Add(c.Duration)
+	r.mu.Unlock()
+
+	if first {
+		r.first <- struct{}{}
+	}
+}
+
+// Run generates a report once the first rules are written, then at the interval, until the context is done.
+// Failures to upload a report are logged and counted, and don't stop the next reports.
+func (r *Reporter) Run(ctx context.Context) error {
+	ticker := r.clock.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.first:
+		case <-ticker.C():
+		}
+
+		if err := r.generate(ctx); err != nil {
+			log.Printf("failed to report usage: %v", err)
+		}
+	}
+}
+
+// generate generates a report of the rules last written, and uploads it.
+func (r *Reporter) generate(ctx context.Context) error {
+	r.mu.Lock()
+	written, at := r.written, r.at
+	r.mu.Unlock()
+	if written == nil {
+		return nil
+	}
+
+	report, err := r.Report(written, at)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage report: %w", err)
+	}
+	r.report.Store(&content)
+
+	if r.uploadURL == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	if err := r.upload(ctx, report.Generated, content); err != nil {
+		r.uploads.WithLabelValues("failure").Inc()
+		return err
+	}
+	r.uploads.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+// upload puts the report to the bucket, keeping the query of its URL, e.g. a shared access signature.
+func (r *Reporter) upload(ctx context.Context, generated time.Time, content []byte) error {
+	u := *r.uploadURL
+	u.Path = path.Join(u.Path, generated.UTC().Format("20060102T150405Z")+".json")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to do http request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("got unexpected status from the object store: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// ServeHTTP serves the last report.
+func (r *Reporter) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	content := r.report.Load()
+	if content == nil {
+		http.Error(w, "no usage report generated yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(*content); err != nil {
+		log.Printf("failed to write usage report: %v", err)
+	}
+}
+
+// Report returns the report of the rules written at the given time.
+func (r *Reporter) Report(written []byte, at time.Time) (*Report, error) {
+	var groups rules.RuleGroups
+	if err := yaml.Unmarshal(written, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules: %w", err)
+	}
+
+	tenants := map[string]*Tenant{}
+	for _, group := range groups.Groups {
+		name := r.groupTenant(group.Name)
+		t, ok := tenants[name]
+		if !ok {
+			t = &Tenant{Tenant: name, Intervals: map[string]int{}}
+			tenants[name] = t
+		}
+
+		interval := time.Duration(group.Interval)
+		if interval <= 0 {
+			interval = r.evaluationInterval
+		}
+		perMinute := float64(time.Minute) / float64(interval)
+
+		t.Groups++
+		for _, rule := range group.Rules {
+			if rule.Record.Value != "" {
+				t.RecordingRules++
+			} else {
+				t.AlertingRules++
+			}
+			t.Intervals[interval.String()]++
+			t.EvaluationsPerMinute += perMinute
+
+			// The expressions were validated when the rules were parsed.
+			expr, err := parser.ParseExpr(rule.Expr.Value)
+			if err != nil {
+				continue
+			}
+			selectors, cost := estimate(expr, interval)
+			t.Selectors += selectors
+			t.EstimatedCostPerMinute += cost * perMinute
+		}
+	}
+
+	report := &Report{
+		Generated:    r.clock.Now(),
+		RulesWritten: at,
+		Tenants:      make([]Tenant, 0, len(tenants)),
+	}
+	for _, t := range tenants {
+		t.EvaluationsPerMinute = round(t.EvaluationsPerMinute)
+		t.EstimatedCostPerMinute = round(t.EstimatedCostPerMinute)
+		report.Tenants = append(report.Tenants, *t)
+	}
+	sort.Slice(report.Tenants, func(i, j int) bool {
+		return report.Tenants[i].Tenant < report.Tenants[j].Tenant
+	})
+
+	return report, nil
+}
+
+// estimate returns the number of selectors of the expression and the estimated cost of an evaluation, subqueries
+// without a step being evaluated at the evaluation interval.
+func estimate(node parser.Node, interval time.Duration) (int, float64) {
+	switch n := node.(type) {
+	case *parser.VectorSelector:
+		return 1, 1
+	case *parser.MatrixSelector:
+		return 1, 1 + n.Range.Minutes()
+	case *parser.SubqueryExpr:
+		step := n.Step
+		if step <= 0 {
+			step = interval
+		}
+		selectors, cost := estimate(n.Expr, interval)
+		return selectors, cost * math.Max(1, float64(n.Range/step))
+	}
+
+	var selectors int
+	var cost float64
+	for _, child := range parser.Children(node) {
+		s, c := estimate(child, interval)
+		selectors += s
+		cost += c
+	}
+
+	return selectors, cost
+}
+
+func round(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,175 @@
+package usage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/observatorium/thanos-rule-syncer/clock"
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/syncer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const writtenRules = `groups:
+- name: tenant-a.fast
+  interval: 30s
+  rules:
+  - record: a:rate5m
+    expr: sum(rate(http_requests_total[5m]))
+  - alert: High
+    expr: a:rate5m > 10
+- name: tenant-a.slow
+  rules:
+  - record: a:rate5m:max10m
+    expr: max_over_time(a:rate5m[10m:1m])
+- name: tenant-b.test
+  interval: 2m
+  rules:
+  - alert: Down
+    expr: up == 0
+  - record: b
+    expr: vector(1)
+`
+
+func TestReport(t *testing.T) {
+	now := time.Unix(2000, 0)
+	written := time.Unix(1000, 0)
+
+	testCases := map[string]struct {
+		opts []Option
+
+		expectTenants []Tenant
+	}{
+		"default evaluation interval": {
+			expectTenants: []Tenant{
+				{
+					Tenant:                 "tenant-a",
+					Groups:                 2,
+					RecordingRules:         2,
+					AlertingRules:          1,
+					Intervals:              map[string]int{"30s": 2, "1m0s": 1},
+					EvaluationsPerMinute:   5,
+					Selectors:              3,
+					EstimatedCostPerMinute: 24,
+				},
+				{
+					Tenant:                 "tenant-b",
+					Groups:                 1,
+					RecordingRules:         1,
+					AlertingRules:          1,
+					Intervals:              map[string]int{"2m0s": 2},
+					EvaluationsPerMinute:   1,
+					Selectors:              1,
+					EstimatedCostPerMinute: 0.5,
+				},
+			},
+		},
+		"evaluation interval": {
+			opts: []Option{WithEvaluationInterval(2 * time.Minute)},
+			expectTenants: []Tenant{
+				{
+					Tenant:                 "tenant-a",
+					Groups:                 2,
+					RecordingRules:         2,
+					AlertingRules:          1,
+					Intervals:              map[string]int{"30s": 2, "2m0s": 1},
+					EvaluationsPerMinute:   4.5,
+					Selectors:              3,
+					EstimatedCostPerMinute: 19,
+				},
+				{
+					Tenant:                 "tenant-b",
+					Groups:                 1,
+					RecordingRules:         1,
+					AlertingRules:          1,
+					Intervals:              map[string]int{"2m0s": 2},
+					EvaluationsPerMinute:   1,
+					Selectors:              1,
+					EstimatedCostPerMinute: 0.5,
+				},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			opts := append([]Option{WithClock(clock.NewFake(now))}, tc.opts...)
+			r := New(nil, merge.GroupTenantFunc(""), time.Hour, opts...)
+
+			report, err := r.Report([]byte(writtenRules), written)
+			assert.NoError(t, err)
+			assert.Equal(t, &Report{Generated: now, RulesWritten: written, Tenants: tc.expectTenants}, report)
+		})
+	}
+}
+
+func TestReporterRun(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		objects = map[string][]byte{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "sig=1", r.URL.RawQuery)
+		content, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		objects[r.URL.Path] = content
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/bucket/usage?sig=1")
+	assert.NoError(t, err)
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := New(nil, merge.GroupTenantFunc(""), time.Hour, WithClock(fake), WithUpload(u, server.Client(), time.Second))
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage", nil))
+		return rec
+	}
+	assert.Equal(t, http.StatusNotFound, get().Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+	assert.NoError(t, fake.BlockUntil(ctx, 1))
+
+	// A failed cycle doesn't replace the rules last written, and the first rules written are reported immediately.
+	r.Observe(ctx, syncer.Cycle{Start: fake.Now(), Written: []byte(writtenRules)})
+	r.Observe(ctx, syncer.Cycle{Start: fake.Now(), Err: assert.AnError})
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(r.uploads.WithLabelValues("success")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	res := get()
+	assert.Equal(t, http.StatusOK, res.Code)
+	var report Report
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &report))
+	assert.Len(t, report.Tenants, 2)
+
+	fake.Advance(time.Hour)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(r.uploads.WithLabelValues("success")) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, res.Body.Bytes(), objects["/bucket/usage/20240101T000000Z.json"])
+	assert.Contains(t, objects, "/bucket/usage/20240101T010000Z.json")
+	mu.Unlock()
+
+	cancel()
+	assert.NoError(t, <-done)
+}
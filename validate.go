@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+
+	"github.com/observatorium/thanos-rule-syncer/compat"
+	"github.com/observatorium/thanos-rule-syncer/lint"
+	"github.com/observatorium/thanos-rule-syncer/merge"
+	"github.com/observatorium/thanos-rule-syncer/tmplcheck"
+)
+
+// validation is the result of the validation of the rules of a tenant.
+type validation struct {
+	Accepted bool `json:"accepted"`
+	// Errors are why the rules are rejected.
+	Errors []string `json:"errors,omitempty"`
+	// Warnings are problems of the rules that don't fail syncs, e.g. alerts violating conventions with the warn policy.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// ruleValidator validates the rules of a tenant with the checks of the sync pipeline, without syncing them,
+// so that the rules rejected at sync time can be rejected when the tenant uploads them instead.
+type ruleValidator struct {
+	merger *merge.Merger
+	// linter is nil if no convention is checked.
+	linter *lint.Linter
+	// templates is nil if the templates of alerts are not rendered.
+	templates *tmplcheck.Checker
+	checker   *compat.Checker
+}
+
+// Validate validates the rules of a tenant, as they are uploaded, without the prefix of their group names.
+func (v *ruleValidator) Validate(ctx context.Context, content []byte) validation {
+	result := validation{}
+	if err := v.merger.Validate(ctx, content); err != nil {
+		// The rules can't be checked further.
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	if v.linter != nil {
+		violations, err := v.linter.Validate(ctx, content)
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		} else {
+			for _, violation := range violations {
+				result.Warnings = append(result.Warnings, violation.Message)
+			}
+		}
+	}
+
+	if v.templates != nil {
+		findings, err := v.templates.Validate(ctx, content)
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		} else {
+			for _, finding := range findings {
+				result.Warnings = append(result.Warnings, finding.Message)
+			}
+		}
+	}
+
+	warnings, err := v.checker.Validate(ctx, content)
+	result.Warnings = append(result.Warnings, warnings...)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	result.Accepted = len(result.Errors) == 0
+	return result
+}